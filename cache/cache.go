@@ -25,7 +25,9 @@ import (
 	"path/filepath"
 	"sync"
 
+	"github.com/containerd/stargz-snapshotter/errdefs"
 	"github.com/containerd/stargz-snapshotter/util/cacheutil"
+	"github.com/containerd/stargz-snapshotter/util/iouring"
 	"github.com/containerd/stargz-snapshotter/util/namedmutex"
 	"golang.org/x/sys/unix"
 )
@@ -65,6 +67,25 @@ type DirectoryCacheConfig struct {
 
 	// FadvDontNeed forcefully clean fscache pagecache for saving memory.
 	FadvDontNeed bool
+
+	// SeedDirectory is a read-only directory laid out in the same way as the cache
+	// directory (e.g. LayerDirectory of a synced cache directory). Entries missed in
+	// the cache directory are read from this directory.
+	SeedDirectory string
+
+	// WriteBackSize enables write-back mode when it is positive. Data added in direct
+	// mode is kept on memory and written to the cache directory in background, keeping
+	// up to WriteBackSize bytes waiting to be written. Adding blocks while the limit is
+	// exceeded. Data not written yet is lost on crash and fetched again.
+	WriteBackSize int64
+
+	// IOUring reads the cached files with io_uring if specified. The ring can be shared
+	// among caches.
+	IOUring *iouring.Ring
+
+	// DirectIOSize enables reading the cached files of at least DirectIOSize bytes with
+	// O_DIRECT when it is positive, which keeps them out of the page cache.
+	DirectIOSize int64
 }
 
 // TODO: contents validation.
@@ -91,6 +112,20 @@ type Reader interface {
 	GetReaderAt() io.ReaderAt
 }
 
+// Flusher is implemented by caches that write data in background. Flush waits until all
+// data added to the cache is written.
+type Flusher interface {
+	Flush() error
+}
+
+// Remover is implemented by caches that can remove contents (e.g. corrupted ones) so that
+// they are fetched again.
+type Remover interface {
+	// Remove removes the contents of the key. Readers already returned by Get keep reading
+	// the removed contents. This is nop if the key isn't cached.
+	Remove(key string) error
+}
+
 // Writer enables the client to cache byte data. Commit() must be
 // called after data is fully written to Write(). To abort the written
 // data, Abort() must be called.
@@ -180,6 +215,12 @@ func NewDirectoryCache(directory string, config DirectoryCacheConfig) (BlobCache
 		fadvDontNeed: config.FadvDontNeed,
 	}
 	dc.syncAdd = config.SyncAdd
+	dc.seedDirectory = config.SeedDirectory
+	dc.ring = config.IOUring
+	dc.directIOSize = config.DirectIOSize
+	if config.WriteBackSize > 0 {
+		dc.writeBack = newWriteBack(dc, config.WriteBackSize)
+	}
 	return dc, nil
 }
 
@@ -193,9 +234,13 @@ type directoryCache struct {
 
 	bufPool *sync.Pool
 
-	syncAdd      bool
-	direct       bool
-	fadvDontNeed bool
+	syncAdd       bool
+	direct        bool
+	fadvDontNeed  bool
+	seedDirectory string
+	writeBack     *writeBack
+	ring          *iouring.Ring
+	directIOSize  int64
 
 	closed   bool
 	closedMu sync.Mutex
@@ -211,6 +256,18 @@ func (dc *directoryCache) Get(key string, opts ...Option) (Reader, error) {
 		opt = o(opt)
 	}
 
+	if dc.writeBack != nil {
+		if opt.passThrough {
+			// Passthrough needs the file so wait for the data to be written.
+			dc.writeBack.wait(key)
+		} else if b, ok := dc.writeBack.get(key); ok {
+			return &reader{
+				ReaderAt:  bytes.NewReader(b),
+				closeFunc: func() error { return nil },
+			}, nil
+		}
+	}
+
 	if !dc.direct && !opt.direct {
 		// Get data from memory
 		if b, done, ok := dc.cache.Get(key); ok {
@@ -226,7 +283,7 @@ func (dc *directoryCache) Get(key string, opts ...Option) (Reader, error) {
 		// Get data from disk. If the file is already opened, use it.
 		if f, done, ok := dc.fileCache.Get(key); ok {
 			return &reader{
-				ReaderAt: f.(*os.File),
+				ReaderAt: dc.fileReaderAt(f.(*os.File)),
 				closeFunc: func() error {
 					done() // file will be closed when it's evicted from the cache
 					return nil
@@ -235,10 +292,20 @@ func (dc *directoryCache) Get(key string, opts ...Option) (Reader, error) {
 		}
 	}
 
+	if !opt.passThrough {
+		// Passthrough needs the file read without O_DIRECT.
+		if r, ok := dc.directIOReader(key); ok {
+			return r, nil
+		}
+	}
+
 	// Open the cache file and read the target region
 	// TODO: If the target cache is write-in-progress, should we wait for the completion
 	//       or simply report the cache miss?
 	file, err := os.Open(dc.cachePath(key))
+	if err != nil && dc.seedDirectory != "" {
+		file, err = os.Open(filepath.Join(dc.seedDirectory, key[:2], key))
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to open blob file for %q: %w", key, err)
 	}
@@ -248,7 +315,7 @@ func (dc *directoryCache) Get(key string, opts ...Option) (Reader, error) {
 	// that won't be accessed immediately.
 	if dc.direct || opt.direct {
 		return &reader{
-			ReaderAt: file,
+			ReaderAt: dc.fileReaderAt(file),
 			closeFunc: func() error {
 				if dc.fadvDontNeed {
 					if err := dropFilePageCache(file); err != nil {
@@ -265,7 +332,7 @@ func (dc *directoryCache) Get(key string, opts ...Option) (Reader, error) {
 	//       but making I/O (possibly huge) on every fetching
 	//       might be costly.
 	return &reader{
-		ReaderAt: file,
+		ReaderAt: dc.fileReaderAt(file),
 		closeFunc: func() error {
 			_, done, added := dc.fileCache.Add(key, file)
 			defer done() // Release it immediately. Cleaned up on eviction.
@@ -287,6 +354,18 @@ func (dc *directoryCache) Add(key string, opts ...Option) (Writer, error) {
 		opt = o(opt)
 	}
 
+	if dc.writeBack != nil && (dc.direct || opt.direct) {
+		// The buffer isn't pooled because readers of the write-back buffer may refer to it.
+		b := new(bytes.Buffer)
+		return &writer{
+			WriteCloser: nopWriteCloser(io.Writer(b)),
+			commitFunc: func() error {
+				return dc.writeBack.add(key, b.Bytes())
+			},
+			abortFunc: func() error { return nil },
+		}, nil
+	}
+
 	wip, err := dc.wipFile(key)
 	if err != nil {
 		return nil, err
@@ -297,24 +376,7 @@ func (dc *directoryCache) Add(key string, opts ...Option) (Writer, error) {
 			if dc.isClosed() {
 				return fmt.Errorf("cache is already closed")
 			}
-			// Commit the cache contents
-			c := dc.cachePath(key)
-			if err := os.MkdirAll(filepath.Dir(c), os.ModePerm); err != nil {
-				var errs []error
-				if err := os.Remove(wip.Name()); err != nil {
-					errs = append(errs, err)
-				}
-				errs = append(errs, fmt.Errorf("failed to create cache directory %q: %w", c, err))
-				return errors.Join(errs...)
-			}
-
-			if dc.fadvDontNeed {
-				if err := dropFilePageCache(wip); err != nil {
-					fmt.Printf("Warning: failed to drop page cache: %v\n", err)
-				}
-			}
-
-			return os.Rename(wip.Name(), c)
+			return dc.commitFile(key, wip)
 		},
 		abortFunc: func() error {
 			return os.Remove(wip.Name())
@@ -376,6 +438,53 @@ func (dc *directoryCache) putBuffer(b *bytes.Buffer) {
 	dc.bufPool.Put(b)
 }
 
+// commitFile moves the wip file to the cache directory as the contents of the key.
+func (dc *directoryCache) commitFile(key string, wip *os.File) error {
+	c := dc.cachePath(key)
+	if err := os.MkdirAll(filepath.Dir(c), os.ModePerm); err != nil {
+		var errs []error
+		if err := os.Remove(wip.Name()); err != nil {
+			errs = append(errs, err)
+		}
+		errs = append(errs, fmt.Errorf("failed to create cache directory %q: %w", c, err))
+		return errors.Join(errs...)
+	}
+
+	if dc.fadvDontNeed {
+		if err := dropFilePageCache(wip); err != nil {
+			fmt.Printf("Warning: failed to drop page cache: %v\n", err)
+		}
+	}
+
+	return os.Rename(wip.Name(), c)
+}
+
+// Remove removes the contents of the key from the memory and the directory. Contents in the
+// seed directory are shared with other nodes and aren't removed.
+func (dc *directoryCache) Remove(key string) error {
+	if dc.isClosed() {
+		return fmt.Errorf("cache is already closed")
+	}
+	if dc.writeBack != nil {
+		dc.writeBack.wait(key) // the pending data would be written after the removal
+	}
+	dc.cache.Remove(key)
+	dc.fileCache.Remove(key)
+	dc.fileCache.Remove(key + directIOKeySuffix)
+	if err := os.Remove(dc.cachePath(key)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove blob file for %q: %w", key, err)
+	}
+	return nil
+}
+
+// Flush waits until all data kept by write-back mode is written to the cache directory.
+func (dc *directoryCache) Flush() error {
+	if dc.writeBack == nil {
+		return nil
+	}
+	return dc.writeBack.flush()
+}
+
 func (dc *directoryCache) Close() error {
 	dc.closedMu.Lock()
 	defer dc.closedMu.Unlock()
@@ -383,6 +492,12 @@ func (dc *directoryCache) Close() error {
 		return nil
 	}
 	dc.closed = true
+	if dc.writeBack != nil {
+		// Stop writing before removing the directory. Data not written yet is dropped
+		// with the directory. Callers that keep the directory (e.g. for resuming it after
+		// restart) must Flush instead.
+		dc.writeBack.close()
+	}
 	return os.RemoveAll(dc.directory)
 }
 
@@ -393,6 +508,24 @@ func (dc *directoryCache) isClosed() bool {
 	return closed
 }
 
+// fileReaderAt returns the reader of the cached file, reading with io_uring if enabled.
+func (dc *directoryCache) fileReaderAt(file *os.File) io.ReaderAt {
+	if dc.ring == nil {
+		return file
+	}
+	return &ringFile{file, dc.ring}
+}
+
+// ringFile reads the file with io_uring.
+type ringFile struct {
+	*os.File
+	ring *iouring.Ring
+}
+
+func (f *ringFile) ReadAt(p []byte, off int64) (int, error) {
+	return f.ring.ReadAt(int(f.Fd()), p, off)
+}
+
 func (dc *directoryCache) cachePath(key string) string {
 	return filepath.Join(dc.directory, key[:2], key)
 }
@@ -418,7 +551,7 @@ func (mc *MemoryCache) Get(key string, opts ...Option) (Reader, error) {
 	defer mc.mu.Unlock()
 	b, ok := mc.Membuf[key]
 	if !ok {
-		return nil, fmt.Errorf("missed cache: %q", key)
+		return nil, fmt.Errorf("missed cache: %q: %w", key, errdefs.ErrNotFound)
 	}
 	return &reader{bytes.NewReader(b.Bytes()), func() error { return nil }}, nil
 }
@@ -437,6 +570,13 @@ func (mc *MemoryCache) Add(key string, opts ...Option) (Writer, error) {
 	}, nil
 }
 
+func (mc *MemoryCache) Remove(key string) error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	delete(mc.Membuf, key)
+	return nil
+}
+
 func (mc *MemoryCache) Close() error {
 	return nil
 }
@@ -449,6 +589,9 @@ type reader struct {
 func (r *reader) Close() error { return r.closeFunc() }
 
 func (r *reader) GetReaderAt() io.ReaderAt {
+	if f, ok := r.ReaderAt.(*ringFile); ok {
+		return f.File // for FUSE passthrough
+	}
 	return r.ReaderAt
 }
 
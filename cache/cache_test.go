@@ -23,11 +23,19 @@
 package cache
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"fmt"
 	"io"
+	"math/rand"
 	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/containerd/stargz-snapshotter/util/iouring"
+	digest "github.com/opencontainers/go-digest"
 )
 
 const (
@@ -69,6 +77,227 @@ func TestDirectoryCache(t *testing.T) {
 		return c, func() { os.RemoveAll(tmp) }
 	}
 	testCache(t, "dir-with-small-mem", newCache)
+
+	// with write-back buffer
+	newCache = func() (BlobCache, cleanFunc) {
+		tmp, err := os.MkdirTemp("", "testcache")
+		if err != nil {
+			t.Fatalf("failed to make tempdir: %v", err)
+		}
+		c, err := NewDirectoryCache(tmp, DirectoryCacheConfig{
+			Direct:        true,
+			WriteBackSize: 4,
+		})
+		if err != nil {
+			t.Fatalf("failed to make cache: %v", err)
+		}
+		return c, func() { c.Close(); os.RemoveAll(tmp) }
+	}
+	testCache(t, "dir-with-write-back", newCache)
+}
+
+func TestDirectoryCacheDirectIO(t *testing.T) {
+	newCache := func(direct bool) func() (BlobCache, cleanFunc) {
+		return func() (BlobCache, cleanFunc) {
+			tmp, err := os.MkdirTemp("", "testcache")
+			if err != nil {
+				t.Fatalf("failed to make tempdir: %v", err)
+			}
+			c, err := NewDirectoryCache(tmp, DirectoryCacheConfig{
+				SyncAdd:      true,
+				Direct:       direct,
+				DirectIOSize: 1,
+			})
+			if err != nil {
+				t.Fatalf("failed to make cache: %v", err)
+			}
+			return c, func() { c.Close(); os.RemoveAll(tmp) }
+		}
+	}
+	testCache(t, "dir-with-direct-io", newCache(true))
+	testCache(t, "dir-with-direct-io-and-memory-cache", newCache(false))
+
+	c, clean := newCache(true)()
+	defer clean()
+	data := make([]byte, 3*directIOAlign+100)
+	rand.New(rand.NewSource(1)).Read(data)
+	key := digestFor(string(data))
+	addBlob(t, c, key, data)
+	r, err := c.Get(key)
+	if err != nil {
+		t.Fatalf("failed to get: %v", err)
+	}
+	df, ok := r.(*reader).ReaderAt.(*directFile)
+	if !ok {
+		r.Close()
+		t.Skipf("O_DIRECT is unsupported by the filesystem of the temporary directory")
+	}
+	for _, rg := range [][2]int{{0, len(data)}, {1, 10}, {directIOAlign - 1, 2}, {directIOAlign, directIOAlign}, {len(data) - 50, 50}, {len(data) - 50, 100}, {len(data), 10}} {
+		off, size := rg[0], rg[1]
+		p := make([]byte, size)
+		n, err := r.ReadAt(p, int64(off))
+		want := data[min(off, len(data)):min(off+size, len(data))]
+		if n != len(want) || !bytes.Equal(p[:n], want) {
+			t.Errorf("read %d bytes at %d = %d bytes; want %d bytes", size, off, n, len(want))
+		}
+		if (n < size && err != io.EOF) || (n == size && err != nil) {
+			t.Errorf("read %d bytes at %d: unexpected error %v", size, off, err)
+		}
+	}
+	if err := r.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+
+	// The file opened with O_DIRECT is reused.
+	r2, err := c.Get(key)
+	if err != nil {
+		t.Fatalf("failed to get: %v", err)
+	}
+	defer r2.Close()
+	if df2, ok := r2.(*reader).ReaderAt.(*directFile); !ok || df2.File != df.File {
+		t.Errorf("file opened with O_DIRECT must be reused")
+	}
+
+	// Passthrough needs the file.
+	pr, err := c.Get(key, PassThrough())
+	if err != nil {
+		t.Fatalf("failed to get: %v", err)
+	}
+	defer pr.Close()
+	if _, ok := pr.GetReaderAt().(*os.File); !ok {
+		t.Errorf("passthrough must get the file")
+	}
+}
+
+func TestDirectoryCacheIOUring(t *testing.T) {
+	ring, err := iouring.New(8)
+	if err != nil {
+		t.Skipf("io_uring is unavailable: %v", err)
+	}
+	defer ring.Close()
+	newCache := func() (BlobCache, cleanFunc) {
+		tmp, err := os.MkdirTemp("", "testcache")
+		if err != nil {
+			t.Fatalf("failed to make tempdir: %v", err)
+		}
+		c, err := NewDirectoryCache(tmp, DirectoryCacheConfig{
+			SyncAdd: true,
+			Direct:  true,
+			IOUring: ring,
+		})
+		if err != nil {
+			t.Fatalf("failed to make cache: %v", err)
+		}
+		return c, func() { os.RemoveAll(tmp) }
+	}
+	testCache(t, "dir-with-io-uring", newCache)
+
+	// Passthrough needs the file.
+	c, clean := newCache()
+	defer clean()
+	key := digestFor(sampleData)
+	w, err := c.Add(key)
+	if err != nil {
+		t.Fatalf("failed to add: %v", err)
+	}
+	if _, err := w.Write([]byte(sampleData)); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	if err := w.Commit(); err != nil {
+		t.Fatalf("failed to commit: %v", err)
+	}
+	w.Close()
+	r, err := c.Get(key, PassThrough())
+	if err != nil {
+		t.Fatalf("failed to get: %v", err)
+	}
+	defer r.Close()
+	if _, ok := r.GetReaderAt().(*os.File); !ok {
+		t.Errorf("passthrough reader isn't a file: %T", r.GetReaderAt())
+	}
+}
+
+func TestWriteBack(t *testing.T) {
+	tmp := t.TempDir()
+	c, err := NewDirectoryCache(tmp, DirectoryCacheConfig{Direct: true, WriteBackSize: 1 << 20})
+	if err != nil {
+		t.Fatalf("failed to make cache: %v", err)
+	}
+	key := digestFor(sampleData)
+	w, err := c.Add(key)
+	if err != nil {
+		t.Fatalf("failed to add: %v", err)
+	}
+	if _, err := w.Write([]byte(sampleData)); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	if err := w.Commit(); err != nil {
+		t.Fatalf("failed to commit: %v", err)
+	}
+	w.Close()
+	hit(sampleData)(t, c)
+
+	// Passthrough reads the written file.
+	r, err := c.Get(key, PassThrough())
+	if err != nil {
+		t.Fatalf("failed to get with passthrough: %v", err)
+	}
+	if _, ok := r.GetReaderAt().(*os.File); !ok {
+		t.Errorf("passthrough reader isn't a file: %T", r.GetReaderAt())
+	}
+	r.Close()
+
+	if err := c.(Flusher).Flush(); err != nil {
+		t.Fatalf("failed to flush: %v", err)
+	}
+	if b, err := os.ReadFile(filepath.Join(tmp, key[:2], key)); err != nil || string(b) != sampleData {
+		t.Errorf("unexpected flushed data %q: %v", string(b), err)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+	if err := c.(Flusher).Flush(); err == nil {
+		t.Errorf("flush must fail after close")
+	}
+}
+
+func TestWriteBackLimit(t *testing.T) {
+	// The flusher isn't running so data stays pending.
+	wb := &writeBack{maxSize: 10, pending: make(map[string][]byte), done: make(chan struct{})}
+	close(wb.done)
+	wb.cond = sync.NewCond(&wb.mu)
+	if err := wb.add("a", make([]byte, 8)); err != nil {
+		t.Fatalf("failed to add: %v", err)
+	}
+	added := make(chan error)
+	go func() { added <- wb.add("b", make([]byte, 8)) }()
+	select {
+	case err := <-added:
+		t.Fatalf("add must block while the limit is exceeded: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if _, ok := wb.get("a"); !ok {
+		t.Errorf("pending data must be readable")
+	}
+
+	// Emulate the flusher writing "a".
+	wb.mu.Lock()
+	wb.queue = wb.queue[1:]
+	delete(wb.pending, "a")
+	wb.size -= 8
+	wb.cond.Broadcast()
+	wb.mu.Unlock()
+	if err := <-added; err != nil {
+		t.Fatalf("failed to add: %v", err)
+	}
+
+	// Blocked adding fails on close.
+	go func() { added <- wb.add("c", make([]byte, 8)) }()
+	time.Sleep(100 * time.Millisecond)
+	wb.close()
+	if err := <-added; err == nil {
+		t.Errorf("add must fail after close")
+	}
 }
 
 func TestMemoryCache(t *testing.T) {
@@ -114,6 +343,20 @@ func testCache(t *testing.T, name string, newCache func() (BlobCache, cleanFunc)
 				miss("dummy"),
 			},
 		},
+		{
+			name: "removed_data",
+			blobs: []string{
+				sampleData,
+				"test",
+			},
+			checks: []check{
+				hit(sampleData),
+				remove(sampleData),
+				miss(sampleData),
+				hit("test"),
+				remove("dummy"),
+			},
+		},
 		{
 			name: "dup_data",
 			blobs: []string{
@@ -200,3 +443,84 @@ func miss(sample string) check {
 		}
 	}
 }
+
+func remove(sample string) check {
+	return func(t *testing.T, c BlobCache) {
+		d := digestFor(sample)
+		if err := c.(Remover).Remove(d); err != nil {
+			t.Errorf("failed to remove blob %q: %v", d, err)
+		}
+	}
+}
+
+func TestSync(t *testing.T) {
+	layer := digest.FromString("layer")
+	src, dst := t.TempDir(), t.TempDir()
+	lc, err := NewDirectoryCache(filepath.Join(src, "layer"), DirectoryCacheConfig{SyncAdd: true, Direct: true})
+	if err != nil {
+		t.Fatalf("failed to make cache: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "layer", LayerFileName), []byte(layer.String()), 0600); err != nil {
+		t.Fatalf("failed to record layer: %v", err)
+	}
+	if _, err := NewDirectoryCache(filepath.Join(src, "unknown"), DirectoryCacheConfig{}); err != nil {
+		t.Fatalf("failed to make cache: %v", err)
+	}
+	add := func(c BlobCache, blob string) {
+		w, err := c.Add(digestFor(blob))
+		if err != nil {
+			t.Fatalf("failed to add %q: %v", blob, err)
+		}
+		defer w.Close()
+		if _, err := w.Write([]byte(blob)); err != nil {
+			t.Fatalf("failed to write %q: %v", blob, err)
+		}
+		if err := w.Commit(); err != nil {
+			t.Fatalf("failed to commit %q: %v", blob, err)
+		}
+	}
+	add(lc, sampleData)
+	add(lc, "test")
+
+	res, err := Sync(src, dst)
+	if err != nil {
+		t.Fatalf("failed to sync: %v", err)
+	}
+	if res.Copied != 2 || res.CopiedSize != int64(len(sampleData)+len("test")) || res.Skipped != 0 {
+		t.Errorf("unexpected result of the first sync: %+v", res)
+	}
+
+	// Only the entries missing in the destination are copied.
+	add(lc, "delta")
+	if res, err = Sync(src, dst); err != nil {
+		t.Fatalf("failed to sync: %v", err)
+	}
+	if res.Copied != 1 || res.Skipped != 2 {
+		t.Errorf("unexpected result of the second sync: %+v", res)
+	}
+	m, err := ReadManifest(dst)
+	if err != nil {
+		t.Fatalf("failed to read manifest: %v", err)
+	}
+	if len(m.Layers) != 1 || m.Layers[0].Digest != layer || len(m.Layers[0].Entries) != 3 {
+		t.Fatalf("unexpected manifest: %+v", m)
+	}
+
+	// The synced directory is used as the seed of a cache.
+	seeded, err := NewDirectoryCache(t.TempDir(), DirectoryCacheConfig{SeedDirectory: LayerDirectory(dst, layer)})
+	if err != nil {
+		t.Fatalf("failed to make cache: %v", err)
+	}
+	hit(sampleData)(t, seeded)
+	hit("delta")(t, seeded)
+	miss("dummy")(t, seeded)
+
+	// The synced directory can be the source.
+	dst2 := t.TempDir()
+	if res, err = Sync(dst, dst2, WithMaxSize(int64(len(sampleData)))); err != nil {
+		t.Fatalf("failed to sync from synced directory: %v", err)
+	}
+	if res.Copied == 0 || res.CopiedSize > int64(len(sampleData)) {
+		t.Errorf("unexpected result of the sync with max size: %+v", res)
+	}
+}
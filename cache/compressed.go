@@ -0,0 +1,114 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cache
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"sync"
+
+	"github.com/containerd/stargz-snapshotter/errdefs"
+	"github.com/klauspost/compress/zstd"
+)
+
+var (
+	zstdEncoder = sync.OnceValues(func() (*zstd.Encoder, error) {
+		return zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest), zstd.WithEncoderConcurrency(1))
+	})
+	zstdDecoder = sync.OnceValues(func() (*zstd.Decoder, error) {
+		return zstd.NewReader(nil, zstd.WithDecoderConcurrency(0))
+	})
+)
+
+// NewCompressedCache returns a cache storing the contents compressed with zstd in c, which
+// saves the disk at the cost of the CPU. Contents are decompressed on memory on Get.
+// Readers don't support FUSE passthrough because the contents aren't stored as plain files.
+// Contents that fail to be decompressed (e.g. stored by a cache without compression) are
+// treated as missed.
+func NewCompressedCache(c BlobCache) BlobCache {
+	return &compressedCache{c}
+}
+
+// IsCompressed returns true if c stores the contents compressed (see NewCompressedCache).
+func IsCompressed(c BlobCache) bool {
+	_, ok := c.(*compressedCache)
+	return ok
+}
+
+type compressedCache struct {
+	BlobCache
+}
+
+func (cc *compressedCache) Get(key string, opts ...Option) (Reader, error) {
+	r, err := cc.BlobCache.Get(key, opts...)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	compressed, err := io.ReadAll(io.NewSectionReader(r, 0, math.MaxInt64))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read compressed contents of %q: %w", key, err)
+	}
+	dec, err := zstdDecoder()
+	if err != nil {
+		return nil, err
+	}
+	data, err := dec.DecodeAll(compressed, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress contents of %q: %v: %w", key, err, errdefs.ErrNotFound)
+	}
+	return &reader{bytes.NewReader(data), func() error { return nil }}, nil
+}
+
+func (cc *compressedCache) Add(key string, opts ...Option) (Writer, error) {
+	w, err := cc.BlobCache.Add(key, opts...)
+	if err != nil {
+		return nil, err
+	}
+	b := new(bytes.Buffer)
+	return &writer{
+		WriteCloser: &writeCloser{b, w.Close},
+		commitFunc: func() error {
+			enc, err := zstdEncoder()
+			if err != nil {
+				return err
+			}
+			if _, err := w.Write(enc.EncodeAll(b.Bytes(), nil)); err != nil {
+				return fmt.Errorf("failed to write compressed contents: %w", err)
+			}
+			return w.Commit()
+		},
+		abortFunc: w.Abort,
+	}, nil
+}
+
+func (cc *compressedCache) Remove(key string) error {
+	rm, ok := cc.BlobCache.(Remover)
+	if !ok {
+		return fmt.Errorf("cache doesn't support removing contents")
+	}
+	return rm.Remove(key)
+}
+
+func (cc *compressedCache) Flush() error {
+	if f, ok := cc.BlobCache.(Flusher); ok {
+		return f.Flush()
+	}
+	return nil
+}
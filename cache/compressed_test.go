@@ -0,0 +1,197 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cache
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/stargz-snapshotter/errdefs"
+)
+
+func TestCompressedCache(t *testing.T) {
+	testCache(t, "compressed-memory", func() (BlobCache, cleanFunc) {
+		return NewCompressedCache(NewMemoryCache()), func() {}
+	})
+	testCache(t, "compressed-dir", func() (BlobCache, cleanFunc) {
+		tmp, err := os.MkdirTemp("", "testcache")
+		if err != nil {
+			t.Fatalf("failed to make tempdir: %v", err)
+		}
+		c, err := NewDirectoryCache(tmp, DirectoryCacheConfig{SyncAdd: true, Direct: true})
+		if err != nil {
+			t.Fatalf("failed to make cache: %v", err)
+		}
+		return NewCompressedCache(c), func() { os.RemoveAll(tmp) }
+	})
+
+	mc := NewMemoryCache()
+	c := NewCompressedCache(mc)
+	if !IsCompressed(c) || IsCompressed(mc) {
+		t.Errorf("IsCompressed must be true only for the compressed cache")
+	}
+
+	// Contents are stored compressed.
+	data := bytes.Repeat([]byte(sampleData), 1000)
+	addBlob(t, c, "compressible", data)
+	if stored := mc.(*MemoryCache).Membuf["compressible"].Len(); stored >= len(data)/10 {
+		t.Errorf("stored %d bytes for %d bytes of compressible contents", stored, len(data))
+	}
+	hit(string(data))(t, &keyedCache{c, "compressible"})
+
+	// Contents stored without compression are missed.
+	addBlob(t, mc, "plain", []byte(sampleData))
+	if _, err := c.Get("plain"); !errors.Is(err, errdefs.ErrNotFound) {
+		t.Errorf("contents without compression must be missed: %v", err)
+	}
+
+	// Aborted contents aren't stored.
+	w, err := c.Add("aborted")
+	if err != nil {
+		t.Fatalf("failed to add: %v", err)
+	}
+	if _, err := w.Write([]byte(sampleData)); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	w.Abort()
+	w.Close()
+	if _, err := c.Get("aborted"); err == nil {
+		t.Errorf("aborted contents must be missed")
+	}
+}
+
+// keyedCache gets the contents of key regardless of the digest of the sample (see hit).
+type keyedCache struct {
+	BlobCache
+	key string
+}
+
+func (kc *keyedCache) Get(_ string, opts ...Option) (Reader, error) {
+	return kc.BlobCache.Get(kc.key, opts...)
+}
+
+func addBlob(t testing.TB, c BlobCache, key string, data []byte) {
+	w, err := c.Add(key)
+	if err != nil {
+		t.Fatalf("failed to add %q: %v", key, err)
+	}
+	defer w.Close()
+	if _, err := w.Write(data); err != nil {
+		t.Fatalf("failed to write %q: %v", key, err)
+	}
+	if err := w.Commit(); err != nil {
+		t.Fatalf("failed to commit %q: %v", key, err)
+	}
+}
+
+// benchmarkChunks returns chunks of the default chunk size of the snapshotter, each of
+// which is half random bytes and half text to resemble the contents of layers.
+func benchmarkChunks(n int) [][]byte {
+	rnd := rand.New(rand.NewSource(1))
+	chunks := make([][]byte, n)
+	for i := range chunks {
+		c := make([]byte, 50000)
+		rnd.Read(c[:len(c)/2])
+		for j := len(c) / 2; j < len(c); j++ {
+			c[j] = "the quick brown fox jumps over the lazy dog\n"[j%44]
+		}
+		chunks[i] = c
+	}
+	return chunks
+}
+
+func newBenchmarkCache(b *testing.B, compressed bool) (BlobCache, string) {
+	dir := b.TempDir()
+	dc, err := NewDirectoryCache(dir, DirectoryCacheConfig{SyncAdd: true, Direct: true})
+	if err != nil {
+		b.Fatalf("failed to make cache: %v", err)
+	}
+	if compressed {
+		return NewCompressedCache(dc), dir
+	}
+	return dc, dir
+}
+
+func diskUsage(b *testing.B, dir string) (size int64) {
+	if err := filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		size += fi.Size()
+		return nil
+	}); err != nil {
+		b.Fatalf("failed to walk cache: %v", err)
+	}
+	return size
+}
+
+// BenchmarkCacheAdd compares adding chunks to the directory cache with and without
+// compression. "stored_bytes/op" is the size of each chunk on the disk.
+func BenchmarkCacheAdd(b *testing.B) {
+	chunks := benchmarkChunks(64)
+	for _, compressed := range []bool{false, true} {
+		b.Run(fmt.Sprintf("compressed=%v", compressed), func(b *testing.B) {
+			c, dir := newBenchmarkCache(b, compressed)
+			defer c.Close()
+			b.SetBytes(int64(len(chunks[0])))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				addBlob(b, c, digestFor(fmt.Sprint(i%len(chunks))), chunks[i%len(chunks)])
+			}
+			b.StopTimer()
+			b.ReportMetric(float64(diskUsage(b, dir))/float64(min(b.N, len(chunks))), "stored_bytes/op")
+		})
+	}
+}
+
+// BenchmarkCacheGet compares reading chunks from the directory cache with and without
+// compression.
+func BenchmarkCacheGet(b *testing.B) {
+	chunks := benchmarkChunks(64)
+	for _, compressed := range []bool{false, true} {
+		b.Run(fmt.Sprintf("compressed=%v", compressed), func(b *testing.B) {
+			c, _ := newBenchmarkCache(b, compressed)
+			defer c.Close()
+			for i, chunk := range chunks {
+				addBlob(b, c, digestFor(fmt.Sprint(i)), chunk)
+			}
+			p := make([]byte, len(chunks[0]))
+			b.SetBytes(int64(len(p)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				r, err := c.Get(digestFor(fmt.Sprint(i % len(chunks))))
+				if err != nil {
+					b.Fatalf("failed to get: %v", err)
+				}
+				if _, err := r.ReadAt(p, 0); err != nil {
+					b.Fatalf("failed to read: %v", err)
+				}
+				r.Close()
+			}
+		})
+	}
+}
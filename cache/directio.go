@@ -0,0 +1,130 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cache
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// directIOAlign is the alignment of the offsets, the sizes and the buffers of reads with
+// O_DIRECT. This is a multiple of the logical block size of most devices.
+const directIOAlign = 4096
+
+// directIOKeySuffix is appended to the key of the file opened with O_DIRECT in the fd cache
+// so it doesn't collide with the file of the same key opened without O_DIRECT.
+const directIOKeySuffix = "/direct"
+
+var directIOBufPool sync.Pool // *[]byte aligned to directIOAlign
+
+// directIOReader returns the reader of the file of the key opened with O_DIRECT if the file
+// is at least DirectIOSize bytes. The opened file is kept in the fd cache and reused by the
+// following reads of the key. This returns false if the file is smaller or the filesystem
+// doesn't support O_DIRECT (e.g. tmpfs) so the file is read as is. io_uring isn't used for
+// the file read with O_DIRECT.
+func (dc *directoryCache) directIOReader(key string) (Reader, bool) {
+	if dc.directIOSize <= 0 {
+		return nil, false
+	}
+	fkey := key + directIOKeySuffix
+	if f, done, ok := dc.fileCache.Get(fkey); ok {
+		return &reader{
+			ReaderAt: &directFile{f.(*os.File)},
+			closeFunc: func() error {
+				done() // file will be closed when it's evicted from the cache
+				return nil
+			},
+		}, true
+	}
+	p := dc.cachePath(key)
+	fi, err := os.Stat(p)
+	if err != nil && dc.seedDirectory != "" {
+		p = filepath.Join(dc.seedDirectory, key[:2], key)
+		fi, err = os.Stat(p)
+	}
+	if err != nil || fi.Size() < dc.directIOSize {
+		return nil, false
+	}
+	df, err := os.OpenFile(p, os.O_RDONLY|unix.O_DIRECT, 0)
+	if err != nil {
+		return nil, false
+	}
+	return &reader{
+		ReaderAt: &directFile{df},
+		closeFunc: func() error {
+			_, done, added := dc.fileCache.Add(fkey, df)
+			defer done() // Release it immediately. Cleaned up on eviction.
+			if !added {
+				return df.Close() // file already exists in the cache. close it.
+			}
+			return nil
+		},
+	}, true
+}
+
+// directFile reads the file opened with O_DIRECT through aligned buffers.
+type directFile struct {
+	*os.File
+}
+
+func (f *directFile) ReadAt(p []byte, off int64) (n int, err error) {
+	start := off &^ (directIOAlign - 1)
+	end := (off + int64(len(p)) + directIOAlign - 1) &^ (directIOAlign - 1)
+	bp := getDirectIOBuf(int(end - start))
+	defer directIOBufPool.Put(bp)
+	buf := *bp
+	var nr int
+	for nr < len(buf) {
+		m, err := unix.Pread(int(f.Fd()), buf[nr:], start+int64(nr))
+		if err == unix.EINTR {
+			continue
+		} else if err != nil {
+			return 0, &os.PathError{Op: "pread", Path: f.Name(), Err: err}
+		}
+		nr += m
+		if m == 0 || nr%directIOAlign != 0 {
+			break // reached the end of the file
+		}
+	}
+	if skip := int(off - start); nr > skip {
+		n = copy(p, buf[skip:nr])
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// getDirectIOBuf returns a buffer of size bytes aligned to directIOAlign.
+func getDirectIOBuf(size int) *[]byte {
+	if bp, ok := directIOBufPool.Get().(*[]byte); ok && cap(*bp) >= size {
+		*bp = (*bp)[:size]
+		return bp
+	}
+	b := make([]byte, size+directIOAlign)
+	skip := 0
+	if r := int(uintptr(unsafe.Pointer(&b[0])) & (directIOAlign - 1)); r != 0 {
+		skip = directIOAlign - r
+	}
+	b = b[skip : skip+size : skip+size]
+	return &b
+}
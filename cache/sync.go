@@ -0,0 +1,343 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cache
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+const (
+	// LayerFileName is the name of the file in a directory cache that records the digest
+	// of the layer cached in the directory. Sync uses this to find the layers of the
+	// directory caches created by the snapshotter.
+	LayerFileName = "layer"
+
+	// ManifestFileName is the name of the manifest at the root of a synced cache directory.
+	ManifestFileName = "manifest.json"
+
+	// ManifestVersion is the version of the layout of synced cache directories.
+	ManifestVersion = 1
+
+	layersDirName = "layers"
+)
+
+// Manifest lists the entries of a synced cache directory. The entries of a layer are
+// stored under LayerDirectory in the same layout as the directory cache so the directory
+// can be used as DirectoryCacheConfig.SeedDirectory. Entries are never modified once
+// written so the synced cache directory can be efficiently replicated with rsync.
+type Manifest struct {
+	// Version is the version of the layout. This must be ManifestVersion.
+	Version int `json:"version"`
+
+	// Layers are the cached layers sorted by the digest.
+	Layers []LayerManifest `json:"layers"`
+}
+
+// LayerManifest lists the cache entries of a layer.
+type LayerManifest struct {
+	// Digest is the digest of the layer.
+	Digest digest.Digest `json:"digest"`
+
+	// Entries are the cache entries of the layer sorted by the key.
+	Entries []ManifestEntry `json:"entries"`
+}
+
+// ManifestEntry is a cache entry.
+type ManifestEntry struct {
+	// Key is the key of the entry in the cache.
+	Key string `json:"key"`
+
+	// Size is the size of the entry.
+	Size int64 `json:"size"`
+}
+
+// LayerDirectory returns the directory of the entries of the layer in the synced cache
+// directory.
+func LayerDirectory(dir string, layer digest.Digest) string {
+	return filepath.Join(dir, layersDirName, layer.Algorithm().String(), layer.Encoded())
+}
+
+// ReadManifest reads the manifest of the synced cache directory.
+func ReadManifest(dir string) (*Manifest, error) {
+	b, err := os.ReadFile(filepath.Join(dir, ManifestFileName))
+	if err != nil {
+		return nil, err
+	}
+	var m Manifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest: %w", err)
+	}
+	if m.Version != ManifestVersion {
+		return nil, fmt.Errorf("unsupported manifest version %d", m.Version)
+	}
+	return &m, nil
+}
+
+func writeManifest(dir string, m *Manifest) error {
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, ManifestFileName+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(dir, ManifestFileName))
+}
+
+// SyncOption is an option for Sync.
+type SyncOption func(*syncOptions)
+
+type syncOptions struct {
+	maxSize int64
+}
+
+// WithMaxSize limits the total size of the entries taken from the source. Recently
+// accessed entries are preferred.
+func WithMaxSize(size int64) SyncOption {
+	return func(o *syncOptions) {
+		o.maxSize = size
+	}
+}
+
+// SyncResult is the result of Sync.
+type SyncResult struct {
+	// Copied is the number of entries copied to the destination.
+	Copied int
+
+	// CopiedSize is the total size of the entries copied to the destination.
+	CopiedSize int64
+
+	// Skipped is the number of entries that already exist in the destination.
+	Skipped int
+}
+
+// Sync copies the cache entries missing in the synced cache directory dst from src and
+// updates the manifest of dst. src is either a synced cache directory or a directory
+// containing directory caches of layers (e.g. "fscache" directory of the snapshotter)
+// that record the layer digest in LayerFileName. Both nodes need to use the same
+// version of the snapshotter so the cache keys match.
+func Sync(src, dst string, opts ...SyncOption) (res SyncResult, _ error) {
+	var sOpts syncOptions
+	for _, o := range opts {
+		o(&sOpts)
+	}
+	srcEntries, err := scanSource(src)
+	if err != nil {
+		return res, fmt.Errorf("failed to scan %q: %w", src, err)
+	}
+	if err := os.MkdirAll(dst, 0700); err != nil {
+		return res, err
+	}
+	synced := make(map[digest.Digest]map[string]int64) // layer -> key -> size
+	if m, err := ReadManifest(dst); err == nil {
+		for _, l := range m.Layers {
+			synced[l.Digest] = make(map[string]int64)
+			for _, e := range l.Entries {
+				synced[l.Digest][e.Key] = e.Size
+			}
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return res, err
+	}
+
+	// Hot entries first
+	sort.SliceStable(srcEntries, func(i, j int) bool {
+		return srcEntries[i].atime.After(srcEntries[j].atime)
+	})
+	var total int64
+	for _, e := range srcEntries {
+		if sOpts.maxSize > 0 && total+e.Size > sOpts.maxSize {
+			continue
+		}
+		total += e.Size
+		if size, ok := synced[e.layer][e.Key]; ok && size == e.Size {
+			res.Skipped++
+			continue
+		}
+		if err := copyEntry(e.path, filepath.Join(LayerDirectory(dst, e.layer), e.Key[:2], e.Key)); err != nil {
+			return res, fmt.Errorf("failed to copy %q: %w", e.path, err)
+		}
+		if synced[e.layer] == nil {
+			synced[e.layer] = make(map[string]int64)
+		}
+		synced[e.layer][e.Key] = e.Size
+		res.Copied++
+		res.CopiedSize += e.Size
+	}
+
+	m := &Manifest{Version: ManifestVersion}
+	for layer, entries := range synced {
+		lm := LayerManifest{Digest: layer}
+		for key, size := range entries {
+			lm.Entries = append(lm.Entries, ManifestEntry{Key: key, Size: size})
+		}
+		sort.Slice(lm.Entries, func(i, j int) bool { return lm.Entries[i].Key < lm.Entries[j].Key })
+		m.Layers = append(m.Layers, lm)
+	}
+	sort.Slice(m.Layers, func(i, j int) bool { return m.Layers[i].Digest < m.Layers[j].Digest })
+	return res, writeManifest(dst, m)
+}
+
+type sourceEntry struct {
+	ManifestEntry
+	layer digest.Digest
+	path  string
+	atime time.Time
+}
+
+// scanSource returns the cache entries in src.
+func scanSource(src string) ([]sourceEntry, error) {
+	if m, err := ReadManifest(src); err == nil {
+		var entries []sourceEntry
+		for _, l := range m.Layers {
+			if err := l.Digest.Validate(); err != nil {
+				return nil, fmt.Errorf("invalid layer digest in manifest: %w", err)
+			}
+			for _, e := range l.Entries {
+				if !validKey(e.Key) {
+					return nil, fmt.Errorf("invalid key %q in manifest", e.Key)
+				}
+				p := filepath.Join(LayerDirectory(src, l.Digest), e.Key[:2], e.Key)
+				fi, err := os.Stat(p)
+				if err != nil {
+					continue // removed after the manifest was written
+				}
+				entries = append(entries, sourceEntry{e, l.Digest, p, accessTime(fi)})
+			}
+		}
+		return entries, nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	dirs, err := os.ReadDir(src)
+	if err != nil {
+		return nil, err
+	}
+	var entries []sourceEntry
+	seen := make(map[digest.Digest]map[string]struct{})
+	for _, d := range dirs {
+		if !d.IsDir() {
+			continue
+		}
+		dir := filepath.Join(src, d.Name())
+		b, err := os.ReadFile(filepath.Join(dir, LayerFileName))
+		if err != nil {
+			continue // not a cache of a layer
+		}
+		layer, err := digest.Parse(strings.TrimSpace(string(b)))
+		if err != nil {
+			return nil, fmt.Errorf("invalid layer digest in %q: %w", dir, err)
+		}
+		if seen[layer] == nil {
+			seen[layer] = make(map[string]struct{})
+		}
+		subdirs, err := os.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, sd := range subdirs {
+			if !sd.IsDir() || len(sd.Name()) != 2 {
+				continue // skip "wip" directory
+			}
+			files, err := os.ReadDir(filepath.Join(dir, sd.Name()))
+			if err != nil {
+				return nil, err
+			}
+			for _, f := range files {
+				key := f.Name()
+				if _, ok := seen[layer][key]; ok || !f.Type().IsRegular() || !strings.HasPrefix(key, sd.Name()) {
+					continue
+				}
+				fi, err := f.Info()
+				if err != nil {
+					continue // removed during the scan
+				}
+				seen[layer][key] = struct{}{}
+				p := filepath.Join(dir, sd.Name(), key)
+				entries = append(entries, sourceEntry{ManifestEntry{key, fi.Size()}, layer, p, accessTime(fi)})
+			}
+		}
+	}
+	return entries, nil
+}
+
+// validKey returns true if the key can be used as a name of a file in the layout of
+// the directory cache.
+func validKey(key string) bool {
+	return len(key) > 2 && !strings.ContainsAny(key, `/\`) && !strings.HasPrefix(key, ".")
+}
+
+// copyEntry copies the entry to dst atomically. The entry is hard-linked if possible.
+func copyEntry(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+		return err
+	}
+	tmpName := dst + ".tmp"
+	os.Remove(tmpName)
+	if err := os.Link(src, tmpName); err != nil {
+		if err := copyFile(src, tmpName); err != nil {
+			os.Remove(tmpName)
+			return err
+		}
+	}
+	return os.Rename(tmpName, dst)
+}
+
+func copyFile(src, dst string) error {
+	r, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	w, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+func accessTime(fi os.FileInfo) time.Time {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return time.Unix(st.Atim.Unix())
+	}
+	return fi.ModTime()
+}
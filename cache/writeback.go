@@ -0,0 +1,161 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cache
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// writeBack keeps data added to the directory cache on memory and writes it to the
+// directory in background so that slow disks don't stall fetching. Data is written to
+// a wip file and renamed in the same way as Add so the directory never contains
+// partially written data; data lost on crash is simply missing from the cache.
+type writeBack struct {
+	dc      *directoryCache
+	maxSize int64
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	pending map[string][]byte
+	queue   []string // keys in the order of adding
+	size    int64    // total size of pending data
+	closed  bool
+	done    chan struct{}
+}
+
+func newWriteBack(dc *directoryCache, maxSize int64) *writeBack {
+	wb := &writeBack{
+		dc:      dc,
+		maxSize: maxSize,
+		pending: make(map[string][]byte),
+		done:    make(chan struct{}),
+	}
+	wb.cond = sync.NewCond(&wb.mu)
+	go wb.run()
+	return wb
+}
+
+// add queues the data of the key. This blocks while the pending data exceeds the max size.
+// Data larger than the max size is accepted when nothing is pending.
+func (wb *writeBack) add(key string, p []byte) error {
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+	for !wb.closed && wb.size > 0 && wb.size+int64(len(p)) > wb.maxSize {
+		wb.cond.Wait()
+	}
+	if wb.closed {
+		return fmt.Errorf("cache is already closed")
+	}
+	if _, ok := wb.pending[key]; ok {
+		return nil // already pending
+	}
+	wb.pending[key] = p
+	wb.queue = append(wb.queue, key)
+	wb.size += int64(len(p))
+	wb.cond.Broadcast()
+	return nil
+}
+
+// get returns the pending data of the key.
+func (wb *writeBack) get(key string) ([]byte, bool) {
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+	p, ok := wb.pending[key]
+	return p, ok
+}
+
+// wait waits until the data of the key is written.
+func (wb *writeBack) wait(key string) {
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+	for !wb.closed {
+		if _, ok := wb.pending[key]; !ok {
+			return
+		}
+		wb.cond.Wait()
+	}
+}
+
+// flush waits until all pending data is written.
+func (wb *writeBack) flush() error {
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+	for !wb.closed && len(wb.queue) > 0 {
+		wb.cond.Wait()
+	}
+	if wb.closed {
+		return fmt.Errorf("cache is already closed")
+	}
+	return nil
+}
+
+// close stops writing and drops pending data. This waits for the data being written.
+// This is used only when the cache directory is removed; flush the data to keep it.
+func (wb *writeBack) close() {
+	wb.mu.Lock()
+	wb.closed = true
+	wb.pending, wb.queue, wb.size = nil, nil, 0
+	wb.cond.Broadcast()
+	wb.mu.Unlock()
+	<-wb.done
+}
+
+func (wb *writeBack) run() {
+	defer close(wb.done)
+	for {
+		wb.mu.Lock()
+		for !wb.closed && len(wb.queue) == 0 {
+			wb.cond.Wait()
+		}
+		if wb.closed {
+			wb.mu.Unlock()
+			return
+		}
+		key := wb.queue[0]
+		p := wb.pending[key]
+		wb.mu.Unlock()
+
+		if err := wb.write(key, p); err != nil {
+			fmt.Println("failed to commit to file:", err) // the data is fetched again on the next access
+		}
+
+		// Data stays pending until it's written so readers always find it.
+		wb.mu.Lock()
+		if !wb.closed {
+			wb.queue = wb.queue[1:]
+			delete(wb.pending, key)
+			wb.size -= int64(len(p))
+			wb.cond.Broadcast()
+		}
+		wb.mu.Unlock()
+	}
+}
+
+func (wb *writeBack) write(key string, p []byte) error {
+	wip, err := wb.dc.wipFile(key)
+	if err != nil {
+		return err
+	}
+	defer wip.Close()
+	if _, err := wip.Write(p); err != nil {
+		os.Remove(wip.Name())
+		return err
+	}
+	return wb.dc.commitFile(key, wip)
+}
@@ -0,0 +1,139 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/containerd/log"
+	stargzfs "github.com/containerd/stargz-snapshotter/fs"
+	"github.com/containerd/stargz-snapshotter/fs/tuning"
+	"github.com/containerd/stargz-snapshotter/util/kernelprobe"
+)
+
+// adminServerMux returns the handler of the admin API. "/fetch" returns the current
+// params of fetching layer contents on GET and applies the update in the request body
+// on POST (e.g. {"bandwidth_limit": 10485760}). "/kernel" returns the kernel features
+// probed at startup on GET. "/mounts/quiesce" fetches the remaining contents of the files
+// read from the mounted layers within the duration in the request body on POST (e.g.
+// {"within_sec": 600}) and returns the results. "/mounts/restart" restarts serving the layer
+// mounted on the mountpoint in the request body on POST (e.g. {"mountpoint": "/path"}) and
+// returns the result.
+func adminServerMux(tuner *tuning.Tuner, quiescer *stargzfs.Quiescer, restarter *stargzfs.MountRestarter, kernel *kernelprobe.Results) *http.ServeMux {
+	m := http.NewServeMux()
+	m.HandleFunc("/fetch", func(w http.ResponseWriter, r *http.Request) {
+		p := tuner.Params()
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			var u tuning.Update
+			if err := json.NewDecoder(r.Body).Decode(&u); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			var err error
+			if p, err = tuner.Apply(u); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			log.G(r.Context()).Infof("fetch params updated: %+v", p)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(p); err != nil {
+			log.G(r.Context()).WithError(err).Warn("failed to write fetch params")
+		}
+	})
+	m.HandleFunc("/mounts/quiesce", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req quiesceRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.WithinSec <= 0 {
+			http.Error(w, "within_sec must be positive", http.StatusBadRequest)
+			return
+		}
+		since := time.Now().Add(-time.Duration(req.WithinSec) * time.Second)
+		log.G(r.Context()).Infof("quiescing files read since %v", since)
+		results, err := quiescer.Quiesce(r.Context(), since)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(results); err != nil {
+			log.G(r.Context()).WithError(err).Warn("failed to write quiesce results")
+		}
+	})
+	m.HandleFunc("/mounts/restart", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req restartRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Mountpoint == "" {
+			http.Error(w, "mountpoint must be specified", http.StatusBadRequest)
+			return
+		}
+		log.G(r.Context()).Infof("restarting mount %q", req.Mountpoint)
+		result, err := restarter.Restart(r.Context(), req.Mountpoint)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(result); err != nil {
+			log.G(r.Context()).WithError(err).Warn("failed to write restart result")
+		}
+	})
+	m.HandleFunc("/kernel", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(kernel); err != nil {
+			log.G(r.Context()).WithError(err).Warn("failed to write kernel features")
+		}
+	})
+	return m
+}
+
+// quiesceRequest is the request body of "/mounts/quiesce".
+type quiesceRequest struct {
+	// WithinSec is the duration (in seconds) before now in which the files have been read.
+	WithinSec int64 `json:"within_sec"`
+}
+
+// restartRequest is the request body of "/mounts/restart".
+type restartRequest struct {
+	// Mountpoint is the mountpoint of the layer to restart.
+	Mountpoint string `json:"mountpoint"`
+}
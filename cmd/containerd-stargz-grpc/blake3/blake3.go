@@ -0,0 +1,59 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package blake3 registers the verifier of the "blake3" chunk digests to estargz.
+// Importing this package allows reading and building eStargz layers whose TOC records
+// blake3 digests.
+package blake3
+
+import (
+	"encoding/hex"
+	"hash"
+
+	"github.com/containerd/stargz-snapshotter/estargz"
+	digest "github.com/opencontainers/go-digest"
+	"lukechampine.com/blake3"
+)
+
+// Algorithm is the algorithm of the blake3 digests (256bits).
+const Algorithm = digest.Algorithm("blake3")
+
+func init() {
+	estargz.RegisterChunkVerifier(Algorithm, chunkVerifier{})
+}
+
+type chunkVerifier struct{}
+
+func (chunkVerifier) Verifier(d digest.Digest) (digest.Verifier, bool) {
+	return &verifier{h: blake3.New(32, nil), want: d.Encoded()}, true
+}
+
+func (chunkVerifier) Hash() (hash.Hash, bool) {
+	return blake3.New(32, nil), true
+}
+
+type verifier struct {
+	h    hash.Hash
+	want string
+}
+
+func (v *verifier) Write(p []byte) (int, error) {
+	return v.h.Write(p)
+}
+
+func (v *verifier) Verified() bool {
+	return hex.EncodeToString(v.h.Sum(nil)) == v.want
+}
@@ -0,0 +1,61 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package blake3
+
+import (
+	"io"
+	"testing"
+
+	"github.com/containerd/stargz-snapshotter/estargz"
+)
+
+func TestChunkVerifier(t *testing.T) {
+	const (
+		data = "abc"
+		want = "blake3:6437b3ac38465133ffb63b75273a8db548c558465d79db03fd359c6cd5bd9d85"
+	)
+	dgstr, err := estargz.ChunkDigester(Algorithm)
+	if err != nil {
+		t.Fatalf("failed to get digester: %v", err)
+	}
+	if _, err := io.WriteString(dgstr.Hash(), data); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	if got := dgstr.Digest().String(); got != want {
+		t.Errorf("digest = %q; want %q", got, want)
+	}
+
+	d, err := estargz.ParseChunkDigest(want)
+	if err != nil {
+		t.Fatalf("failed to parse digest: %v", err)
+	}
+	for _, tt := range []struct {
+		data string
+		want bool
+	}{{data, true}, {data + "d", false}} {
+		v, err := estargz.ChunkDigestVerifier(d)
+		if err != nil {
+			t.Fatalf("failed to get verifier: %v", err)
+		}
+		if _, err := io.WriteString(v, tt.data); err != nil {
+			t.Fatalf("failed to write: %v", err)
+		}
+		if v.Verified() != tt.want {
+			t.Errorf("verified(%q) = %v; want %v", tt.data, v.Verified(), tt.want)
+		}
+	}
+}
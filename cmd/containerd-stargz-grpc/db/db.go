@@ -30,6 +30,7 @@ import (
 //
 // - filesystems
 //   - *filesystem id*                    : bucket for each filesystem keyed by a unique string.
+//     - baseChunks : <varint>            : 1 if the blob is a delta blob that has chunks stored in the base blob.
 //     - nodes
 //       - *node id*                      : bucket for each node keyed by a uniqe uint64.
 //         - size : <varint>              : size of the regular node.
@@ -45,22 +46,30 @@ import (
 //         - xattrsExtra                  : 2nd and the following extended attribute.
 //           - *key* : <string>           : map of key to value string
 //         - numLink : <varint>           : the number of links pointing to this node.
+//         - digest : <string>            : digest of the contents of the regular node recorded in the TOC.
 //     - metadata
 //       - *node id*                      : bucket for each node keyed by a uniqe uint64.
+//         - parentID : <node id>         : id of the directory containing the node (the one of the first name for hardlinks)
+//         - name : <string>              : base name of the node in the parent directory
 //         - childName : <string>         : base name of the first child
 //         - childID   : <node id>        : id of the first child
 //         - childrenExtra                : 2nd and following child nodes of directory.
 //           - *basename* : <node id>     : map of basename string to the child node id
+//         - childrenFolded               : children of directory in case-insensitive lookup mode.
+//           - *folded basename* : <node id> : map of case-folded basename string to the child node id
 //         - chunk : <encoded>            : information of the first chunkn
 //         - chunksExtra                  : 2nd and following chunks (this is rarely used so we can avoid the cost of creating the bucket)
 //           - *chunk offset* : <encoded> : keyed by chunk offset (varint) in the estargz file to the chunk.
 //         - nextOffset : <varint>        : the offset of the next node with a non-zero offset.
+//         - dirSize : <varint>           : total size of the regular files under the directory.
+//         - dirEntries : <varint>        : number of the names under the directory (recursively).
 //     - stream
 //       - *offset*                       : bucket for each chunk stream that have multiple inner chunks.
 //         - *innerOffset* : node id      : node id that has the contents at the keyed innerOffset.
 
 var (
 	bucketKeyFilesystems = []byte("filesystems")
+	bucketKeyBaseChunks  = []byte("baseChunks")
 
 	bucketKeyNodes       = []byte("nodes")
 	bucketKeySize        = []byte("size")
@@ -75,14 +84,20 @@ var (
 	bucketKeyXattrValue  = []byte("xattrValue")
 	bucketKeyXattrsExtra = []byte("xattrsExtra")
 	bucketKeyNumLink     = []byte("numLink")
-
-	bucketKeyMetadata      = []byte("metadata")
-	bucketKeyChildName     = []byte("childName")
-	bucketKeyChildID       = []byte("childID")
-	bucketKeyChildrenExtra = []byte("childrenExtra")
-	bucketKeyChunk         = []byte("chunk")
-	bucketKeyChunksExtra   = []byte("chunksExtra")
-	bucketKeyNextOffset    = []byte("nextOffset")
+	bucketKeyDigest      = []byte("digest")
+
+	bucketKeyMetadata       = []byte("metadata")
+	bucketKeyParentID       = []byte("parentID")
+	bucketKeyName           = []byte("name")
+	bucketKeyChildName      = []byte("childName")
+	bucketKeyChildID        = []byte("childID")
+	bucketKeyChildrenExtra  = []byte("childrenExtra")
+	bucketKeyChildrenFolded = []byte("childrenFolded")
+	bucketKeyChunk          = []byte("chunk")
+	bucketKeyChunksExtra    = []byte("chunksExtra")
+	bucketKeyNextOffset     = []byte("nextOffset")
+	bucketKeyDirSize        = []byte("dirSize")
+	bucketKeyDirEntries     = []byte("dirEntries")
 
 	bucketKeyStream = []byte("stream")
 )
@@ -93,17 +108,49 @@ type childEntry struct {
 }
 
 type chunkEntry struct {
-	offset      int64
+	offset      int64 // -1 indicates a hole of a sparse file. -2 indicates a base chunk of a delta blob.
 	chunkOffset int64
 	chunkSize   int64
 	chunkDigest string
 	innerOffset int64 // -1 indicates that no following chunks in the stream.
 }
 
+// isHole returns true if this chunk is a hole of a sparse file. Holes aren't stored
+// in the blob.
+func (e chunkEntry) isHole() bool {
+	return e.offset == -1
+}
+
+// isBaseChunk returns true if this chunk of a delta blob is stored in the base blob.
+func (e chunkEntry) isBaseChunk() bool {
+	return e.offset == -2
+}
+
+// isStored returns true if this chunk is stored in the blob.
+func (e chunkEntry) isStored() bool {
+	return e.offset >= 0
+}
+
 type metadataEntry struct {
+	parent     uint32 // 0 for the root
+	base       string
 	children   map[string]childEntry
+	folded     map[string]uint32 // case-folded basename -> id; only in case-insensitive lookup mode
 	chunks     []chunkEntry
 	nextOffset int64
+	dirStats   metadata.DirStats // only for directories
+}
+
+func getFilesystem(tx *bolt.Tx, fsID string) (*bolt.Bucket, error) {
+	filesystems := tx.Bucket(bucketKeyFilesystems)
+	if filesystems == nil {
+		return nil, fmt.Errorf("fs %q not found: no fs is registered", fsID)
+	}
+	lbkt := filesystems.Bucket([]byte(fsID))
+	if lbkt == nil {
+		return nil, fmt.Errorf("fs bucket for %q not found", fsID)
+	}
+	return lbkt, nil
 }
 
 func getNodes(tx *bolt.Tx, fsID string) (*bolt.Bucket, error) {
@@ -395,6 +442,14 @@ func readInnerChunks(tx *bolt.Tx, fsID string, off int64) (chunks []chunkEntryWi
 	return chunks, nil
 }
 
+func readParent(md *bolt.Bucket) (pid uint32, base string, _ error) {
+	b := md.Get(bucketKeyParentID)
+	if len(b) == 0 {
+		return 0, "", fmt.Errorf("parent not found")
+	}
+	return decodeID(b), string(md.Get(bucketKeyName)), nil
+}
+
 func readChild(md *bolt.Bucket, base string) (uint32, error) {
 	if base == string(md.Get(bucketKeyChildName)) {
 		return decodeID(md.Get(bucketKeyChildID)), nil
@@ -410,7 +465,48 @@ func readChild(md *bolt.Bucket, base string) (uint32, error) {
 	return decodeID(eid), nil
 }
 
+// readFoldedChild returns the child that matches the base name case-insensitively.
+func readFoldedChild(md *bolt.Bucket, base string) (uint32, error) {
+	cbkt := md.Bucket(bucketKeyChildrenFolded)
+	if cbkt == nil {
+		return 0, fmt.Errorf("case-folded children not found")
+	}
+	eid := cbkt.Get([]byte(metadata.FoldName(base)))
+	if len(eid) == 0 {
+		return 0, fmt.Errorf("children %q not found case-insensitively", base)
+	}
+	return decodeID(eid), nil
+}
+
+// foldChildren returns the children keyed by the case-folded base names.
+func foldChildren(pid uint32, children map[string]childEntry) (map[string]uint32, error) {
+	names := make([]string, 0, len(children))
+	for name := range children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	folded := make(map[string]uint32, len(children))
+	baseOf := make(map[string]string, len(children))
+	for _, name := range names {
+		key := metadata.FoldName(name)
+		if other, ok := baseOf[key]; ok {
+			return nil, fmt.Errorf("%q and %q in %d: %w", other, name, pid, metadata.ErrCaseConflict)
+		}
+		baseOf[key] = name
+		folded[key] = children[name].id
+	}
+	return folded, nil
+}
+
 func writeMetadataEntry(md *bolt.Bucket, m *metadataEntry) error {
+	if m.parent != 0 {
+		if err := md.Put(bucketKeyParentID, encodeID(m.parent)); err != nil {
+			return fmt.Errorf("failed to put parent id %d: %w", m.parent, err)
+		}
+		if err := md.Put(bucketKeyName, []byte(m.base)); err != nil {
+			return fmt.Errorf("failed to put name %q: %w", m.base, err)
+		}
+	}
 	if len(m.children) > 0 {
 		var firstChildName string
 		var firstChild childEntry
@@ -449,6 +545,17 @@ func writeMetadataEntry(md *bolt.Bucket, m *metadataEntry) error {
 			}
 		}
 	}
+	if len(m.folded) > 0 {
+		cbkt, err := md.CreateBucket(bucketKeyChildrenFolded)
+		if err != nil {
+			return err
+		}
+		for k, id := range m.folded {
+			if err := cbkt.Put([]byte(k), encodeID(id)); err != nil {
+				return fmt.Errorf("failed to add case-folded child ID %q: %w", id, err)
+			}
+		}
+	}
 	if len(m.chunks) > 0 {
 		first := m.chunks[0]
 		if err := md.Put(bucketKeyChunk, encodeChunkEntry(first)); err != nil {
@@ -483,6 +590,16 @@ func writeMetadataEntry(md *bolt.Bucket, m *metadataEntry) error {
 			return fmt.Errorf("failed to set next offset value %d: %w", m.nextOffset, err)
 		}
 	}
+	if m.dirStats.Size > 0 {
+		if err := putInt(md, bucketKeyDirSize, m.dirStats.Size); err != nil {
+			return fmt.Errorf("failed to set directory size %d: %w", m.dirStats.Size, err)
+		}
+	}
+	if m.dirStats.Entries > 0 {
+		if err := putInt(md, bucketKeyDirEntries, m.dirStats.Entries); err != nil {
+			return fmt.Errorf("failed to set directory entries %d: %w", m.dirStats.Entries, err)
+		}
+	}
 	return nil
 }
 
@@ -27,6 +27,7 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"slices"
 	"sort"
 	"strings"
 	"sync"
@@ -56,6 +57,8 @@ type reader struct {
 	initG   *errgroup.Group
 
 	decompressor metadata.Decompressor
+
+	caseInsensitive bool
 }
 
 func (r *reader) nextID() (uint32, error) {
@@ -105,7 +108,6 @@ func NewReader(db *bolt.DB, sr *io.SectionReader, opts ...metadata.Option) (meta
 	for _, d := range decompressors {
 		fSize := d.FooterSize()
 		fOffset := positive(int64(len(footer)) - fSize)
-		maybeTocBytes := footer[:fOffset]
 		_, tocOffset, tocSize, err := d.ParseFooter(footer[fOffset:])
 		if err != nil {
 			errs = append(errs, err)
@@ -114,8 +116,15 @@ func NewReader(db *bolt.DB, sr *io.SectionReader, opts ...metadata.Option) (meta
 		if tocOffset >= 0 && tocSize <= 0 {
 			tocSize = sr.Size() - tocOffset - fSize
 		}
-		if tocOffset >= 0 && tocSize < int64(len(maybeTocBytes)) {
-			maybeTocBytes = maybeTocBytes[:tocSize]
+		if tocOffset >= 0 && (tocSize < 0 || tocSize > sr.Size()-tocOffset) {
+			errs = append(errs, &estargz.RangeError{Field: "tocSize", Value: tocSize, Limit: sr.Size() - tocOffset})
+			continue
+		}
+		// The fetched bytes may already contain the TOC. The footer can be followed by
+		// other metadata (e.g. tar-split) so the TOC is located by its offset in the blob.
+		var maybeTocBytes []byte
+		if fetchOffset := sr.Size() - int64(len(footer)); tocOffset >= fetchOffset && tocOffset+tocSize <= sr.Size() {
+			maybeTocBytes = footer[tocOffset-fetchOffset : tocOffset-fetchOffset+tocSize]
 		}
 		tocR, err = decompressTOC(d, sr, tocOffset, tocSize, maybeTocBytes, rOpts)
 		if err != nil {
@@ -134,7 +143,7 @@ func NewReader(db *bolt.DB, sr *io.SectionReader, opts ...metadata.Option) (meta
 		return nil, fmt.Errorf("failed to get the reader of TOC: %w", allErr)
 	}
 	defer tocR.Close()
-	r := &reader{sr: sr, db: db, initG: new(errgroup.Group), decompressor: decompressor}
+	r := &reader{sr: sr, db: db, initG: new(errgroup.Group), decompressor: decompressor, caseInsensitive: rOpts.CaseInsensitive}
 	if err := r.init(tocR, rOpts); err != nil {
 		return nil, fmt.Errorf("failed to initialize matadata: %w", err)
 	}
@@ -200,20 +209,38 @@ func (r *reader) TOCDigest() digest.Digest {
 	return r.tocDigest
 }
 
+func (r *reader) HasBaseChunks() (has bool, _ error) {
+	if err := r.view(func(tx *bolt.Tx) error {
+		lbkt, err := getFilesystem(tx, r.fsID)
+		if err != nil {
+			return err
+		}
+		v, _ := binary.Varint(lbkt.Get(bucketKeyBaseChunks))
+		has = v == 1
+		return nil
+	}); err != nil {
+		return false, err
+	}
+	return has, nil
+}
+
 // Clone returns a new reader identical to the current reader
 // but uses the provided section reader for retrieving file paylaods.
 func (r *reader) Clone(sr *io.SectionReader) (metadata.Reader, error) {
-	if err := r.waitInit(); err != nil {
-		return nil, err
-	}
-	return &reader{
+	cr := &reader{
 		db:           r.db,
 		fsID:         r.fsID,
 		rootID:       r.rootID,
+		tocDigest:    r.tocDigest,
 		sr:           sr,
 		initG:        new(errgroup.Group),
 		decompressor: r.decompressor,
-	}, nil
+
+		caseInsensitive: r.caseInsensitive,
+	}
+	// Metadata may be still being initialized in background by the original reader.
+	cr.initG.Go(r.waitInit)
+	return cr, nil
 }
 
 func (r *reader) init(decompressedR io.Reader, rOpts metadata.Options) (retErr error) {
@@ -349,6 +376,8 @@ func (r *reader) initNodes(tr io.Reader) error {
 	}
 	md := make(map[uint32]*metadataEntry)
 	st := make(map[int64]map[int64]uint32)
+	sizes := make(map[uint32]int64) // sizes of regular files
+	var dedups [][2]uint32          // pairs of a deduplicated file and the file storing the contents
 	if err := r.db.Batch(func(tx *bolt.Tx) (err error) {
 		nodes, err := getNodes(tx, r.fsID)
 		if err != nil {
@@ -360,12 +389,17 @@ func (r *reader) initNodes(tr io.Reader) error {
 		var lastEntSize int64
 		var attr metadata.Attr
 		var ent estargz.TOCEntry
+		var hasBaseChunks bool
 		for dec.More() {
 			resetEnt(&ent)
 			if err := dec.Decode(&ent); err != nil {
 				return err
 			}
 			ent.Name = cleanEntryName(ent.Name)
+			// Zero chunks are read as holes (the contents in the blob aren't used).
+			if ent.ChunkType == estargz.ChunkTypeZeros {
+				ent.Hole, ent.Offset, ent.InnerOffset = true, 0, 0
+			}
 			if ent.Type == "chunk" {
 				if lastEntBucketID == 0 {
 					return fmt.Errorf("chunk entry must not be the topmost")
@@ -426,6 +460,14 @@ func (r *reader) initNodes(tr io.Reader) error {
 					if err := writeAttr(b, attrFromTOCEntry(&ent, &attr)); err != nil {
 						return fmt.Errorf("failed to set attr to %d(%q): %w", id, ent.Name, err)
 					}
+					if ent.Type == "reg" && ent.Digest != "" {
+						if err := b.Put(bucketKeyDigest, []byte(ent.Digest)); err != nil {
+							return fmt.Errorf("failed to set digest to %d(%q): %w", id, ent.Name, err)
+						}
+					}
+					if ent.Type == "reg" {
+						sizes[id] = ent.Size
+					}
 				}
 
 				pdirName := parentDir(ent.Name)
@@ -436,6 +478,13 @@ func (r *reader) initNodes(tr io.Reader) error {
 				if err := setChild(md, pb, pid, path.Base(ent.Name), id, ent.Type == "dir"); err != nil {
 					return err
 				}
+				if ent.Type == "reg" && ent.Dedup != "" {
+					srcID, err := getDedupSource(nodes, md, &ent, id, r.rootID)
+					if err != nil {
+						return err
+					}
+					dedups = append(dedups, [2]uint32{id, srcID})
+				}
 
 				if ent.Offset > 0 && ent.InnerOffset == 0 && len(wantNextOffsetID) > 0 {
 					for _, i := range wantNextOffsetID {
@@ -446,17 +495,29 @@ func (r *reader) initNodes(tr io.Reader) error {
 					}
 					wantNextOffsetID = nil
 				}
-				if ent.Type == "reg" && ent.Size > 0 {
+				if ent.Type == "reg" && ent.Size > 0 && ent.Dedup == "" {
 					wantNextOffsetID = append(wantNextOffsetID, id)
 				}
 
 				lastEntSize = ent.Size
 				lastEntBucketID = id
 			}
-			if (ent.Type == "reg" && ent.Size > 0) || (ent.Type == "chunk" && ent.ChunkSize > 0) {
+			if (ent.Type == "reg" && ent.Size > 0 && ent.Dedup == "") || (ent.Type == "chunk" && ent.ChunkSize > 0) {
 				if md[lastEntBucketID] == nil {
 					md[lastEntBucketID] = &metadataEntry{}
 				}
+				hasBaseChunks = hasBaseChunks || ent.BaseChunk
+				if ent.Hole || ent.BaseChunk {
+					// Holes and base chunks aren't stored in the blob. They are indicated
+					// by offset -1 and -2 respectively.
+					offset := int64(-1)
+					if ent.BaseChunk {
+						offset = -2
+					}
+					ce := chunkEntry{offset, ent.ChunkOffset, ent.ChunkSize, ent.ChunkDigest, -1}
+					md[lastEntBucketID].chunks = append(md[lastEntBucketID].chunks, ce)
+					continue
+				}
 				ce := chunkEntry{ent.Offset, ent.ChunkOffset, ent.ChunkSize, ent.ChunkDigest, ent.InnerOffset}
 				md[lastEntBucketID].chunks = append(md[lastEntBucketID].chunks, ce)
 				if _, ok := st[ent.Offset]; !ok {
@@ -473,11 +534,31 @@ func (r *reader) initNodes(tr io.Reader) error {
 				md[i].nextOffset = r.sr.Size()
 			}
 		}
+		if hasBaseChunks {
+			lbkt, err := getFilesystem(tx, r.fsID)
+			if err != nil {
+				return err
+			}
+			if err := putInt(lbkt, bucketKeyBaseChunks, 1); err != nil {
+				return err
+			}
+		}
 		return nil
 	}); err != nil {
 		return err
 	}
 
+	// Deduplicated files are read from the chunks of the files storing the contents.
+	for _, d := range dedups {
+		if md[d[0]] == nil {
+			md[d[0]] = &metadataEntry{}
+		}
+		if src := md[d[1]]; src != nil {
+			md[d[0]].chunks = slices.Clone(src.chunks)
+			md[d[0]].nextOffset = src.nextOffset
+		}
+	}
+
 	for mdK, d := range md {
 		for cK, ce := range d.chunks {
 			if len(st[ce.offset]) == 1 {
@@ -492,6 +573,21 @@ func (r *reader) initNodes(tr io.Reader) error {
 		}
 	}
 
+	setDirStats(md, sizes, r.rootID)
+
+	if r.caseInsensitive {
+		for id, d := range md {
+			if len(d.children) == 0 {
+				continue
+			}
+			folded, err := foldChildren(id, d.children)
+			if err != nil {
+				return err
+			}
+			d.folded = folded
+		}
+	}
+
 	addendum := make([]struct {
 		id []byte
 		md *metadataEntry
@@ -583,6 +679,26 @@ func (r *reader) initNodes(tr io.Reader) error {
 	return nil
 }
 
+// setDirStats sets the aggregates of the directory and the directories under it to the
+// metadata entries and returns the aggregates of the directory.
+func setDirStats(md map[uint32]*metadataEntry, sizes map[uint32]int64, id uint32) (s metadata.DirStats) {
+	d := md[id]
+	if d == nil {
+		return // empty directory
+	}
+	for name, c := range d.children {
+		s.Entries++
+		// Hardlinks are counted at the first name, which also avoids walking loops.
+		if cd := md[c.id]; cd != nil && cd.parent == id && cd.base == name {
+			cs := setDirStats(md, sizes, c.id)
+			s.Size += sizes[c.id] + cs.Size
+			s.Entries += cs.Entries
+		}
+	}
+	d.dirStats = s
+	return s
+}
+
 func (r *reader) getOrCreateDir(nodes *bolt.Bucket, md map[uint32]*metadataEntry, d string, rootID uint32) (id uint32, b *bolt.Bucket, err error) {
 	id, err = getIDByName(md, d, rootID)
 	if err != nil {
@@ -677,8 +793,11 @@ func (r *reader) GetOffset(id uint32) (offset int64, _ error) {
 			if err != nil {
 				return err
 			}
-			if len(chunks) > 0 {
-				offset = chunks[0].offset
+			for _, e := range chunks {
+				if e.isStored() {
+					offset = e.offset
+					break
+				}
 			}
 		}
 		return nil
@@ -734,6 +853,11 @@ func (r *reader) GetChild(pid uint32, base string) (id uint32, attr metadata.Att
 			return fmt.Errorf("failed to get parent metadata %d: %w", pid, err)
 		}
 		id, err = readChild(md, base)
+		if err != nil && r.caseInsensitive {
+			if fid, ferr := readFoldedChild(md, base); ferr == nil {
+				id, err = fid, nil
+			}
+		}
 		if err != nil {
 			return fmt.Errorf("failed to read child %q of %d: %w", base, pid, err)
 		}
@@ -752,6 +876,91 @@ func (r *reader) GetChild(pid uint32, base string) (id uint32, attr metadata.Att
 	return
 }
 
+// GetParent returns the ID of the directory containing the specified node.
+func (r *reader) GetParent(id uint32) (pid uint32, _ error) {
+	if id == r.rootID {
+		return r.rootID, nil
+	}
+	if err := r.view(func(tx *bolt.Tx) error {
+		metadataEntries, err := getMetadata(tx, r.fsID)
+		if err != nil {
+			return fmt.Errorf("metadata bucket of %q not found for getting parent of %d: %w", r.fsID, id, err)
+		}
+		md, err := getMetadataBucketByID(metadataEntries, id)
+		if err != nil {
+			return fmt.Errorf("failed to get metadata %d: %w", id, err)
+		}
+		pid, _, err = readParent(md)
+		return err
+	}); err != nil {
+		return 0, err
+	}
+	return pid, nil
+}
+
+// PathOf returns the absolute path of the specified node.
+func (r *reader) PathOf(id uint32) (p string, _ error) {
+	if id == r.rootID {
+		return "/", nil
+	}
+	if err := r.view(func(tx *bolt.Tx) error {
+		metadataEntries, err := getMetadata(tx, r.fsID)
+		if err != nil {
+			return fmt.Errorf("metadata bucket of %q not found for getting path of %d: %w", r.fsID, id, err)
+		}
+		var names []string
+		for cur := id; cur != r.rootID; {
+			md, err := getMetadataBucketByID(metadataEntries, cur)
+			if err != nil {
+				return fmt.Errorf("failed to get metadata %d: %w", cur, err)
+			}
+			pid, base, err := readParent(md)
+			if err != nil {
+				return fmt.Errorf("failed to get parent of %d: %w", cur, err)
+			}
+			names = append(names, base)
+			cur = pid
+		}
+		slices.Reverse(names)
+		p = "/" + strings.Join(names, "/")
+		return nil
+	}); err != nil {
+		return "", err
+	}
+	return p, nil
+}
+
+// DirStats returns the aggregates of the nodes under the specified directory.
+func (r *reader) DirStats(id uint32) (s metadata.DirStats, _ error) {
+	if err := r.view(func(tx *bolt.Tx) error {
+		nodes, err := getNodes(tx, r.fsID)
+		if err != nil {
+			return fmt.Errorf("nodes bucket of %q not found for getting stats of %d: %w", r.fsID, id, err)
+		}
+		b, err := getNodeBucketByID(nodes, id)
+		if err != nil {
+			return err
+		}
+		if m, _ := binary.Uvarint(b.Get(bucketKeyMode)); !os.FileMode(uint32(m)).IsDir() {
+			return fmt.Errorf("node %d isn't a directory", id)
+		}
+		metadataEntries, err := getMetadata(tx, r.fsID)
+		if err != nil {
+			return fmt.Errorf("metadata bucket of %q not found for getting stats of %d: %w", r.fsID, id, err)
+		}
+		md, err := getMetadataBucketByID(metadataEntries, id)
+		if err != nil {
+			return nil // empty directory
+		}
+		s.Size, _ = binary.Varint(md.Get(bucketKeyDirSize))
+		s.Entries, _ = binary.Varint(md.Get(bucketKeyDirEntries))
+		return nil
+	}); err != nil {
+		return metadata.DirStats{}, err
+	}
+	return s, nil
+}
+
 // ForeachChild calls the specified callback function for each child node.
 // When the callback returns non-nil error, this stops the iteration.
 func (r *reader) ForeachChild(id uint32, f func(name string, id uint32, mode os.FileMode) bool) error {
@@ -834,6 +1043,7 @@ func (r *reader) OpenFile(id uint32) (metadata.File, error) {
 func (r *reader) openFile(id uint32, preRead func(id uint32, chunkOffset, chunkSize int64, chunkDigest string, r io.Reader) error) (metadata.File, error) {
 	var chunks []chunkEntry
 	var size int64
+	var dgst string
 
 	var nextOffset int64
 	if err := r.view(func(tx *bolt.Tx) error {
@@ -846,6 +1056,7 @@ func (r *reader) openFile(id uint32, preRead func(id uint32, chunkOffset, chunkS
 			return fmt.Errorf("failed to get file bucket %d: %w", id, err)
 		}
 		size, _ = binary.Varint(b.Get(bucketKeySize))
+		dgst = string(b.Get(bucketKeyDigest))
 		m, _ := binary.Uvarint(b.Get(bucketKeyMode))
 		if !os.FileMode(uint32(m)).IsRegular() {
 			return fmt.Errorf("%q is not a regular file", id)
@@ -873,12 +1084,20 @@ func (r *reader) openFile(id uint32, preRead func(id uint32, chunkOffset, chunkS
 		nextOffset: nextOffset,
 		preRead:    preRead,
 	}
-	return &file{io.NewSectionReader(fr, 0, size), chunks}, nil
+	for _, e := range chunks {
+		fr.sparse = fr.sparse || !e.isStored()
+	}
+	return &file{io.NewSectionReader(fr, 0, size), chunks, dgst}, nil
 }
 
 type file struct {
 	io.ReaderAt
-	ents []chunkEntry
+	ents   []chunkEntry
+	digest string
+}
+
+func (fr *file) FileDigest() string {
+	return fr.digest
 }
 
 func (fr *file) ChunkEntryForOffset(offset int64) (off int64, size int64, dgst string, ok bool) {
@@ -893,11 +1112,26 @@ func (fr *file) ChunkEntryForOffset(offset int64) (off int64, size int64, dgst s
 	return ci.chunkOffset, ci.chunkSize, ci.chunkDigest, true
 }
 
+func (fr *file) IsHole(offset int64) bool {
+	i := sort.Search(len(fr.ents), func(i int) bool {
+		return fr.ents[i].chunkOffset > offset
+	})
+	return i > 0 && fr.ents[i-1].isHole()
+}
+
+func (fr *file) IsBaseChunk(offset int64) bool {
+	i := sort.Search(len(fr.ents), func(i int) bool {
+		return fr.ents[i].chunkOffset > offset
+	})
+	return i > 0 && fr.ents[i-1].isBaseChunk()
+}
+
 type fileReader struct {
 	r          *reader
 	size       int64
 	ents       []chunkEntry
 	nextOffset int64
+	sparse     bool // true if ents contain holes or base chunks
 	preRead    func(id uint32, chunkOffset, chunkSize int64, chunkDigest string, r io.Reader) error
 }
 
@@ -909,32 +1143,71 @@ func (fr *fileReader) ReadAt(p []byte, off int64) (n int, err error) {
 	if off < 0 {
 		return 0, errors.New("invalid offset")
 	}
+	if fr.sparse {
+		return fr.readAtSparse(p, off)
+	}
+	return fr.readAt(p, off)
+}
+
+// readAtSparse reads the payload of a sparse file. Holes and base chunks aren't stored
+// in the blob so each read must not go across the boundary of the chunk. Reading a base
+// chunk fails with estargz.ErrBaseChunk.
+func (fr *fileReader) readAtSparse(p []byte, off int64) (n int, err error) {
+	for n < len(p) && off < fr.size {
+		ent, err := fr.chunkEntry(off)
+		if err != nil {
+			return n, err
+		}
+		l := min(int64(len(p)-n), ent.chunkOffset+ent.chunkSize-off)
+		if ent.isBaseChunk() {
+			return n, fmt.Errorf("failed to read at %d: %w", off, estargz.ErrBaseChunk)
+		} else if ent.isHole() {
+			clear(p[n : int64(n)+l])
+		} else if _, err := fr.readAt(p[n:int64(n)+l], off); err != nil && err != io.EOF {
+			return n, err
+		}
+		n += int(l)
+		off += l
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
 
-	var ent chunkEntry
+func (fr *fileReader) chunkEntry(off int64) (ent chunkEntry, _ error) {
 	switch len(fr.ents) {
 	case 0:
-		return 0, errors.New("no chunk is registered")
+		return ent, errors.New("no chunk is registered")
 	case 1:
 		ent = fr.ents[0]
 		if ent.chunkOffset > off {
-			return 0, fmt.Errorf("no chunk coveres offset %d", off)
+			return ent, fmt.Errorf("no chunk coveres offset %d", off)
 		}
 	default:
 		i := sort.Search(len(fr.ents), func(i int) bool {
 			return fr.ents[i].chunkOffset > off
 		})
 		if i == 0 {
-			return 0, fmt.Errorf("no chunk coveres offset %d", off)
+			return ent, fmt.Errorf("no chunk coveres offset %d", off)
 		}
 		ent = fr.ents[i-1]
 	}
+	return ent, nil
+}
+
+func (fr *fileReader) readAt(p []byte, off int64) (n int, err error) {
+	ent, err := fr.chunkEntry(off)
+	if err != nil {
+		return 0, err
+	}
 
 	compressedBytesRemain := fr.nextOffset - ent.offset
 	bufSize := min(int(2<<20), int(compressedBytesRemain))
 
 	br := bufio.NewReaderSize(io.NewSectionReader(fr.r.sr, ent.offset, compressedBytesRemain), bufSize)
 	if _, err := br.Peek(bufSize); err != nil {
-		return 0, fmt.Errorf("failed to peek read file payload: %v", err)
+		return 0, fmt.Errorf("failed to peek read file payload: %w", err)
 	}
 	dr, err := fr.r.decompressor.Reader(br)
 	if err != nil {
@@ -1031,6 +1304,28 @@ func getIDByName(md map[uint32]*metadataEntry, name string, rootID uint32) (uint
 	return c.id, nil
 }
 
+// getDedupSource returns the ID of the regular file storing the contents of the
+// deduplicated file ent of the ID.
+func getDedupSource(nodes *bolt.Bucket, md map[uint32]*metadataEntry, ent *estargz.TOCEntry, id, rootID uint32) (uint32, error) {
+	srcID, err := getIDByName(md, ent.Dedup, rootID)
+	if err != nil {
+		return 0, fmt.Errorf("deduplicated file %q refers to unknown file %q: %w", ent.Name, ent.Dedup, err)
+	}
+	if srcID == id {
+		return 0, fmt.Errorf("deduplicated file %q refers to itself", ent.Name)
+	}
+	b, err := getNodeBucketByID(nodes, srcID)
+	if err != nil {
+		return 0, err
+	}
+	m, _ := binary.Uvarint(b.Get(bucketKeyMode))
+	size, _ := binary.Varint(b.Get(bucketKeySize))
+	if !os.FileMode(uint32(m)).IsRegular() || size != ent.Size {
+		return 0, fmt.Errorf("deduplicated file %q refers to invalid file %q", ent.Name, ent.Dedup)
+	}
+	return srcID, nil
+}
+
 func setChild(md map[uint32]*metadataEntry, pb *bolt.Bucket, pid uint32, base string, id uint32, isDir bool) error {
 	if md[pid] == nil {
 		md[pid] = &metadataEntry{}
@@ -1039,6 +1334,12 @@ func setChild(md map[uint32]*metadataEntry, pb *bolt.Bucket, pid uint32, base st
 		md[pid].children = make(map[string]childEntry)
 	}
 	md[pid].children[base] = childEntry{base, id}
+	if md[id] == nil {
+		md[id] = &metadataEntry{}
+	}
+	if md[id].parent == 0 { // hardlinks belong to the directory of the first name
+		md[id].parent, md[id].base = pid, base
+	}
 	if isDir {
 		numLink, _ := binary.Varint(pb.Get(bucketKeyNumLink))
 		if err := putInt(pb, bucketKeyNumLink, numLink+1); err != nil {
@@ -1078,7 +1379,11 @@ func resetEnt(ent *estargz.TOCEntry) {
 	ent.ChunkOffset = 0
 	ent.ChunkSize = 0
 	ent.ChunkDigest = ""
+	ent.ChunkType = ""
 	ent.InnerOffset = 0
+	ent.Hole = false
+	ent.BaseChunk = false
+	ent.Dedup = ""
 }
 
 func positive(n int64) int64 {
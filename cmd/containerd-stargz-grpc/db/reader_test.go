@@ -137,9 +137,16 @@ type readCloser struct {
 	closeFn func() error
 }
 
+// HasBaseChunks exposes the optional interface of the wrapped reader.
+func (r *readCloser) HasBaseChunks() (bool, error) {
+	return metadata.HasBaseChunks(r.Reader)
+}
+
 func (r *readCloser) Close() error {
+	// Close the reader before the underlying db is closed.
+	err := r.Reader.Close()
 	r.closeFn()
-	return r.Reader.Close()
+	return err
 }
 
 type testableReadCloser struct {
@@ -148,6 +155,8 @@ type testableReadCloser struct {
 }
 
 func (r *testableReadCloser) Close() error {
+	// Close the reader before the underlying db is closed.
+	err := r.TestableReader.Close()
 	r.closeFn()
-	return r.TestableReader.Close()
+	return err
 }
@@ -49,7 +49,7 @@ func ConfigFsOpts(ctx context.Context, rootDir string, config *Config) ([]fs.Opt
 		fsOpts = append(fsOpts, fs.WithResolveHandler("ipfs", new(ipfs.ResolveHandler)))
 	}
 
-	mt, err := getMetadataStore(rootDir, config)
+	mt, err := NewMetadataStore(rootDir, config)
 	if err != nil {
 		return nil, fmt.Errorf("failed to configure metadata store: %w", err)
 	}
@@ -58,7 +58,9 @@ func ConfigFsOpts(ctx context.Context, rootDir string, config *Config) ([]fs.Opt
 	return fsOpts, nil
 }
 
-func getMetadataStore(rootDir string, config *Config) (metadata.Store, error) {
+// NewMetadataStore returns the metadata store of config. The metadata DB is created under
+// rootDir if the store is "db".
+func NewMetadataStore(rootDir string, config *Config) (metadata.Store, error) {
 	switch config.MetadataStore {
 	case "", memoryMetadataType:
 		return memorymetadata.NewReader, nil
@@ -0,0 +1,62 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/containerd/log"
+	stargzfs "github.com/containerd/stargz-snapshotter/fs"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// localityServerMux returns the handler of the cache locality API for schedulers.
+// "/locality" returns the cache locality of the mounted images on GET. The images are
+// narrowed down by the "digest" query params of the manifest digests
+// (e.g. /locality?digest=sha256:...&digest=sha256:...).
+func localityServerMux(reporter *stargzfs.LocalityReporter) *http.ServeMux {
+	m := http.NewServeMux()
+	m.HandleFunc("/locality", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var images []digest.Digest
+		for _, d := range r.URL.Query()["digest"] {
+			dgst, err := digest.Parse(d)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			images = append(images, dgst)
+		}
+		res, err := reporter.Report(images...)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		if res == nil {
+			res = []stargzfs.ImageLocality{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(res); err != nil {
+			log.G(r.Context()).WithError(err).Warn("failed to write cache locality")
+		}
+	})
+	return m
+}
@@ -36,10 +36,18 @@ import (
 	"github.com/containerd/containerd/v2/pkg/sys"
 	"github.com/containerd/log"
 	"github.com/containerd/stargz-snapshotter/cmd/containerd-stargz-grpc/fsopts"
+	"github.com/containerd/stargz-snapshotter/cmd/containerd-stargz-grpc/sandbox"
+	stargzfs "github.com/containerd/stargz-snapshotter/fs"
+	"github.com/containerd/stargz-snapshotter/fs/tuning"
 	"github.com/containerd/stargz-snapshotter/fusemanager"
 	"github.com/containerd/stargz-snapshotter/service"
 	"github.com/containerd/stargz-snapshotter/service/keychain/keychainconfig"
+	"github.com/containerd/stargz-snapshotter/service/preview"
+	"github.com/containerd/stargz-snapshotter/service/resolver"
 	snbase "github.com/containerd/stargz-snapshotter/snapshot"
+	"github.com/containerd/stargz-snapshotter/store"
+	"github.com/containerd/stargz-snapshotter/store/pb"
+	"github.com/containerd/stargz-snapshotter/util/kernelprobe"
 	"github.com/containerd/stargz-snapshotter/version"
 	sddaemon "github.com/coreos/go-systemd/v22/daemon"
 	metrics "github.com/docker/go-metrics"
@@ -47,6 +55,9 @@ import (
 	bolt "go.etcd.io/bbolt"
 	"golang.org/x/sys/unix"
 	"google.golang.org/grpc"
+
+	// Register the verifier of blake3 chunk digests.
+	_ "github.com/containerd/stargz-snapshotter/cmd/containerd-stargz-grpc/blake3"
 )
 
 const (
@@ -77,8 +88,18 @@ type snapshotterConfig struct {
 	NoPrometheus bool `toml:"no_prometheus" json:"no_prometheus"`
 
 	// DebugAddress is a Unix domain socket address where the snapshotter exposes /debug/ endpoints.
+	// The status page (/debug/status) isn't available when the FUSE manager is enabled.
 	DebugAddress string `toml:"debug_address" json:"debug_address"`
 
+	// AdminAddress is a Unix domain socket address where the snapshotter exposes the admin API
+	// for changing the params of fetching layer contents at runtime (e.g. bandwidth limits).
+	// This isn't available when the FUSE manager is enabled.
+	AdminAddress string `toml:"admin_address" json:"admin_address"`
+
+	// LocalityAddress is a TCP address where the snapshotter exposes the cache locality of the
+	// mounted images for schedulers. This isn't available when the FUSE manager is enabled.
+	LocalityAddress string `toml:"locality_address" json:"locality_address"`
+
 	// IPFS is a flag to enbale lazy pulling from IPFS.
 	IPFS bool `toml:"ipfs" json:"ipfs"`
 
@@ -87,6 +108,35 @@ type snapshotterConfig struct {
 
 	// FuseManagerConfig is configuration for fusemanager
 	FuseManagerConfig `toml:"fuse_manager" json:"fuse_manager"`
+
+	// Sandbox is configuration for restricting the snapshotter process after it's initialized.
+	Sandbox sandbox.Config `toml:"sandbox" json:"sandbox"`
+
+	// Preview is configuration for the API to browse files of images without pulling them.
+	// This isn't available when the FUSE manager is enabled.
+	Preview preview.Config `toml:"preview" json:"preview"`
+
+	// Store is configuration for serving the additional layer store of CRI-O and Podman.
+	// This isn't available when the FUSE manager is enabled.
+	Store StoreConfig `toml:"store" json:"store"`
+
+	// Sockets is configuration for the permissions of the sockets and the peers allowed to
+	// connect to them.
+	Sockets SocketsConfig `toml:"sockets" json:"sockets"`
+}
+
+// StoreConfig is configuration for serving the additional layer store (see stargz-store) in
+// the snapshotter so that one daemon serves both containerd and CRI-O (or Podman) on a node.
+// The store shares the config and the keychains of the snapshotter.
+type StoreConfig struct {
+	// MountPoint is the directory where the store is mounted, which is specified in
+	// additionallayerstores of CRI-O and Podman (e.g. "/var/lib/stargz-store/store:ref"). The
+	// store is disabled if empty.
+	MountPoint string `toml:"mount_point" json:"mount_point"`
+
+	// Address is a Unix domain socket address where the controller API of the store is served
+	// for clients passing credentials of images (e.g. Podman). The API is disabled if empty.
+	Address string `toml:"address" json:"address"`
 }
 
 type FuseManagerConfig struct {
@@ -135,6 +185,18 @@ func main() {
 		log.G(ctx).WithError(err).Fatalf("snapshotter is not supported")
 	}
 
+	// Disable the optional features the kernel doesn't support
+	kernel := kernelprobe.Probe()
+	log.G(ctx).Debugf("kernel %s features: %+v", kernel.KernelVersion, kernel.Features)
+	if config.PassThrough && !kernel.Available(kernelprobe.FUSEPassthrough) {
+		log.G(ctx).Warnf("disabling FUSE passthrough: %s", kernel.Features[kernelprobe.FUSEPassthrough].Reason)
+		config.PassThrough = false
+	}
+	if config.DataOnlyLower && !kernel.Available(kernelprobe.OverlayDataOnlyLowers) {
+		log.G(ctx).Warnf("disabling data-only lowers: %s", kernel.Features[kernelprobe.OverlayDataOnlyLowers].Reason)
+		config.DataOnlyLower = false
+	}
+
 	// Create a gRPC server
 	rpc := grpc.NewServer()
 
@@ -154,7 +216,10 @@ func main() {
 		ImageServicePath:           config.ImageServicePath,
 	}
 
-	var rs snapshots.Snapshotter
+	var (
+		rs snapshots.Snapshotter
+		c  = components{kernel: kernel}
+	)
 	fuseManagerConfig := config.FuseManagerConfig
 	if fuseManagerConfig.Enable {
 		fmPath := fuseManagerConfig.Path
@@ -197,6 +262,17 @@ func main() {
 		if !managerNewlyStarted {
 			flags = append(flags, snbase.NoRestore)
 		}
+		if config.WriteLayerRedirect != "" {
+			flags = append(flags, snbase.WithWriteLayerRedirect(config.WriteLayerRedirect))
+		}
+		if config.EventsConfig.Enable {
+			// Events of the filesystem are published by the fusemanager.
+			publisher, err := service.NewEventPublisher(config.EventsConfig)
+			if err != nil {
+				log.G(ctx).WithError(err).Fatalf("failed to configure event publisher")
+			}
+			flags = append(flags, snbase.WithEventPublisher(publisher))
+		}
 		rs, err = snbase.NewSnapshotter(ctx, filepath.Join(*rootDir, "snapshotter"), fs, flags...)
 		if err != nil {
 			log.G(ctx).WithError(err).Fatalf("failed to configure snapshotter")
@@ -253,14 +329,42 @@ func main() {
 			log.G(ctx).WithError(err).Fatalf("failed to configure fs config")
 		}
 
+		c.tuner = tuning.New()
+		fsOpts = append(fsOpts, stargzfs.WithTuner(c.tuner))
+		c.quiescer = stargzfs.NewQuiescer()
+		fsOpts = append(fsOpts, stargzfs.WithQuiescer(c.quiescer))
+		c.restarter = stargzfs.NewMountRestarter()
+		fsOpts = append(fsOpts, stargzfs.WithMountRestarter(c.restarter))
+		c.locality = stargzfs.NewLocalityReporter()
+		fsOpts = append(fsOpts, stargzfs.WithLocalityReporter(c.locality))
+		c.status = stargzfs.NewStatusReporter()
+		fsOpts = append(fsOpts, stargzfs.WithStatusReporter(c.status))
+
+		if config.Preview.Address != "" {
+			hosts := resolver.RegistryHostsFromConfig(resolver.Config(config.ResolverConfig), credsFuncs...)
+			c.previewAPI = preview.NewHandler(config.Preview, hosts, config.BlobConfig)
+		}
+
 		rs, err = service.NewStargzSnapshotterService(ctx, *rootDir, &config.Config,
 			service.WithCredsFuncs(credsFuncs...), service.WithFilesystemOptions(fsOpts...))
 		if err != nil {
 			log.G(ctx).WithError(err).Fatalf("failed to configure snapshotter")
 		}
+
+		if config.Store.MountPoint != "" {
+			c.keychain = new(store.Keychain)
+			if err := mountStore(ctx, config, &fsConfig, append([]resolver.Credential{c.keychain.Credentials}, credsFuncs...)); err != nil {
+				log.G(ctx).WithError(err).Fatalf("failed to serve store")
+			}
+			defer func() {
+				if err := unix.Unmount(config.Store.MountPoint, 0); err != nil {
+					log.G(ctx).WithError(err).Warnf("failed to unmount store %q", config.Store.MountPoint)
+				}
+			}()
+		}
 	}
 
-	cleanup, err := serve(ctx, rpc, *address, rs, config)
+	cleanup, err := serve(ctx, rpc, *address, rs, c, config)
 	if err != nil {
 		log.G(ctx).WithError(err).Fatalf("failed to serve snapshotter")
 	}
@@ -283,7 +387,50 @@ func main() {
 	log.G(ctx).Info("Exiting")
 }
 
-func serve(ctx context.Context, rpc *grpc.Server, addr string, rs snapshots.Snapshotter, config snapshotterConfig) (bool, error) {
+// mountStore mounts the additional layer store at config.Store.MountPoint. The data of the
+// store is kept under "store" in the root directory.
+func mountStore(ctx context.Context, config snapshotterConfig, fsConfig *fsopts.Config, credsFuncs []resolver.Credential) error {
+	if config.DisableVerification {
+		return fmt.Errorf("content verification can't be disabled for store")
+	}
+	root := filepath.Join(*rootDir, "store")
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(config.Store.MountPoint, 0755); err != nil {
+		return fmt.Errorf("failed to prepare mountpoint %q: %w", config.Store.MountPoint, err)
+	}
+	mt, err := fsopts.NewMetadataStore(root, fsConfig)
+	if err != nil {
+		return fmt.Errorf("failed to configure metadata store: %w", err)
+	}
+	hosts := resolver.RegistryHostsFromConfig(resolver.Config(config.ResolverConfig), credsFuncs...)
+	layerManager, err := store.NewLayerManager(ctx, root, hosts, mt, config.Config.Config)
+	if err != nil {
+		return fmt.Errorf("failed to prepare pool: %w", err)
+	}
+	if err := store.Mount(ctx, config.Store.MountPoint, layerManager, config.Debug); err != nil {
+		return fmt.Errorf("failed to mount store at %q: %w", config.Store.MountPoint, err)
+	}
+	log.G(ctx).Infof("mounted store at %q", config.Store.MountPoint)
+	return nil
+}
+
+// components are the components of the snapshotter served by the APIs other than the
+// snapshotter API. Fields are nil if the component isn't available in this process (e.g.
+// when the FUSE manager is enabled).
+type components struct {
+	tuner      *tuning.Tuner
+	quiescer   *stargzfs.Quiescer
+	restarter  *stargzfs.MountRestarter
+	locality   *stargzfs.LocalityReporter
+	status     *stargzfs.StatusReporter
+	kernel     *kernelprobe.Results
+	previewAPI http.Handler
+	keychain   *store.Keychain // nil if the store is disabled
+}
+
+func serve(ctx context.Context, rpc *grpc.Server, addr string, rs snapshots.Snapshotter, c components, config snapshotterConfig) (bool, error) {
 	// Convert the snapshotter to a gRPC service,
 	snsvc := snapshotservice.FromSnapshotter(rs)
 
@@ -324,23 +471,105 @@ func serve(ctx context.Context, rpc *grpc.Server, addr string, rs snapshots.Snap
 			return false, fmt.Errorf("failed to listen %q: %w", config.DebugAddress, err)
 		}
 		go func() {
-			if err := http.Serve(l, debugServerMux()); err != nil {
+			if err := http.Serve(l, debugServerMux(c.status)); err != nil {
 				errCh <- fmt.Errorf("error on serving a debug endpoint via socket %q: %w", addr, err)
 			}
 		}()
 	}
 
+	if config.AdminAddress != "" {
+		if c.tuner == nil {
+			log.G(ctx).Warnf("admin API isn't available with the FUSE manager; ignoring %q", config.AdminAddress)
+		} else {
+			log.G(ctx).Infof("listen %q for admin API", config.AdminAddress)
+			l, err := sys.GetLocalListener(config.AdminAddress, 0, 0)
+			if err != nil {
+				return false, fmt.Errorf("failed to listen %q: %w", config.AdminAddress, err)
+			}
+			if l, err = secureListener(l, config.AdminAddress, config.Sockets.Admin); err != nil {
+				return false, err
+			}
+			go func() {
+				if err := http.Serve(l, adminServerMux(c.tuner, c.quiescer, c.restarter, c.kernel)); err != nil {
+					errCh <- fmt.Errorf("error on serving admin API via socket %q: %w", config.AdminAddress, err)
+				}
+			}()
+		}
+	}
+
+	if config.LocalityAddress != "" {
+		if c.locality == nil {
+			log.G(ctx).Warnf("locality API isn't available with the FUSE manager; ignoring %q", config.LocalityAddress)
+		} else {
+			log.G(ctx).Infof("listen %q for locality API", config.LocalityAddress)
+			l, err := net.Listen("tcp", config.LocalityAddress)
+			if err != nil {
+				return false, fmt.Errorf("failed to listen %q: %w", config.LocalityAddress, err)
+			}
+			go func() {
+				if err := http.Serve(l, localityServerMux(c.locality)); err != nil {
+					errCh <- fmt.Errorf("error on serving locality API via socket %q: %w", config.LocalityAddress, err)
+				}
+			}()
+		}
+	}
+
+	if config.Preview.Address != "" {
+		if c.previewAPI == nil {
+			log.G(ctx).Warnf("preview API isn't available with the FUSE manager; ignoring %q", config.Preview.Address)
+		} else {
+			log.G(ctx).Infof("listen %q for preview API", config.Preview.Address)
+			l, err := sys.GetLocalListener(config.Preview.Address, 0, 0)
+			if err != nil {
+				return false, fmt.Errorf("failed to listen %q: %w", config.Preview.Address, err)
+			}
+			go func() {
+				if err := http.Serve(l, c.previewAPI); err != nil {
+					errCh <- fmt.Errorf("error on serving preview API via socket %q: %w", config.Preview.Address, err)
+				}
+			}()
+		}
+	}
+
+	if config.Store.MountPoint != "" && c.keychain == nil {
+		log.G(ctx).Warnf("store isn't available with the FUSE manager; ignoring %q", config.Store.MountPoint)
+	} else if c.keychain != nil && config.Store.Address != "" {
+		log.G(ctx).Infof("listen %q for store controller API", config.Store.Address)
+		l, err := sys.GetLocalListener(config.Store.Address, 0, 0)
+		if err != nil {
+			return false, fmt.Errorf("failed to listen %q: %w", config.Store.Address, err)
+		}
+		if l, err = secureListener(l, config.Store.Address, config.Sockets.Store); err != nil {
+			return false, err
+		}
+		storeRPC := grpc.NewServer()
+		pb.RegisterControllerServer(storeRPC, store.NewControllerServer(c.keychain))
+		go func() {
+			if err := storeRPC.Serve(l); err != nil {
+				errCh <- fmt.Errorf("error on serving store controller API via socket %q: %w", config.Store.Address, err)
+			}
+		}()
+	}
+
 	// Listen and serve
 	l, err := net.Listen("unix", addr)
 	if err != nil {
 		return false, fmt.Errorf("error on listen socket %q: %w", addr, err)
 	}
+	if l, err = secureListener(l, addr, config.Sockets.Snapshotter); err != nil {
+		return false, err
+	}
 	go func() {
 		if err := rpc.Serve(l); err != nil {
 			errCh <- fmt.Errorf("error on serving via socket %q: %w", addr, err)
 		}
 	}()
 
+	// All listeners are created so the process can be restricted.
+	if err := sandbox.Apply(ctx, config.Sandbox); err != nil {
+		return false, fmt.Errorf("failed to apply sandbox: %w", err)
+	}
+
 	if os.Getenv("NOTIFY_SOCKET") != "" {
 		notified, notifyErr := sddaemon.SdNotify(false, sddaemon.SdNotifyReady)
 		log.G(ctx).Debugf("SdNotifyReady notified=%v, err=%v", notified, notifyErr)
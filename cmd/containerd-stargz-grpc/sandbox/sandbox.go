@@ -0,0 +1,229 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package sandbox restricts the snapshotter process itself after it's initialized.
+// The snapshotter parses untrusted image data as root so this limits what a
+// compromised snapshotter can do to the node.
+//
+// The snapshotter mounts FUSE filesystems and Landlock forbids mounting once the
+// filesystem access is restricted. So Landlock only restricts the network and the
+// interaction with other processes. The filesystem and the kernel surface are
+// limited by seccomp instead.
+package sandbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"syscall"
+	"unsafe"
+
+	"github.com/containerd/log"
+	"golang.org/x/sys/unix"
+)
+
+// Config is the configuration of the sandbox of the snapshotter process.
+type Config struct {
+	// Seccomp denies the syscalls that aren't needed by the snapshotter (e.g. loading
+	// kernel modules, ptrace, bpf and switching namespaces).
+	Seccomp bool `toml:"seccomp" json:"seccomp"`
+
+	// Landlock denies binding TCP ports and, on Linux 6.12 or later, sending signals to
+	// processes outside of the snapshotter. This needs Linux 6.7 or later and the
+	// snapshotter built without cgo (CGO_ENABLED=0). Landlock doesn't restrict MPTCP
+	// sockets so this needs to be used with Seccomp that denies them.
+	Landlock bool `toml:"landlock" json:"landlock"`
+}
+
+// deniedSyscalls are the syscalls denied by seccomp.
+var deniedSyscalls = []uintptr{
+	// Kernel and system administration
+	unix.SYS_INIT_MODULE,
+	unix.SYS_FINIT_MODULE,
+	unix.SYS_DELETE_MODULE,
+	unix.SYS_KEXEC_LOAD,
+	unix.SYS_KEXEC_FILE_LOAD,
+	unix.SYS_REBOOT,
+	unix.SYS_SWAPON,
+	unix.SYS_SWAPOFF,
+	unix.SYS_ACCT,
+	unix.SYS_SETTIMEOFDAY,
+	unix.SYS_CLOCK_SETTIME,
+	unix.SYS_CLOCK_ADJTIME,
+	unix.SYS_ADJTIMEX,
+	unix.SYS_SETHOSTNAME,
+	unix.SYS_SETDOMAINNAME,
+	unix.SYS_SYSLOG,
+	unix.SYS_QUOTACTL,
+	unix.SYS_VHANGUP,
+
+	// Inspecting and tampering other processes
+	unix.SYS_PTRACE,
+	unix.SYS_PROCESS_VM_READV,
+	unix.SYS_PROCESS_VM_WRITEV,
+	unix.SYS_KCMP,
+	unix.SYS_PERF_EVENT_OPEN,
+	unix.SYS_BPF,
+	unix.SYS_USERFAULTFD,
+	unix.SYS_ADD_KEY,
+	unix.SYS_REQUEST_KEY,
+	unix.SYS_KEYCTL,
+
+	// Escaping the filesystem and namespaces of the snapshotter
+	unix.SYS_OPEN_BY_HANDLE_AT,
+	unix.SYS_CHROOT,
+	unix.SYS_PIVOT_ROOT,
+	unix.SYS_SETNS,
+	unix.SYS_UNSHARE,
+
+	// io_uring bypasses the syscall filter
+	unix.SYS_IO_URING_SETUP,
+	unix.SYS_IO_URING_ENTER,
+	unix.SYS_IO_URING_REGISTER,
+}
+
+// auditArch is the architecture of the syscalls allowed by seccomp.
+var auditArch = map[string]uint32{
+	"amd64":   unix.AUDIT_ARCH_X86_64,
+	"arm64":   unix.AUDIT_ARCH_AARCH64,
+	"ppc64le": unix.AUDIT_ARCH_PPC64LE,
+	"s390x":   unix.AUDIT_ARCH_S390X,
+	"riscv64": unix.AUDIT_ARCH_RISCV64,
+}
+
+// Apply restricts the current process (all threads) as configured. This needs to be
+// called after the snapshotter is initialized (e.g. all listeners are created). The
+// restrictions can't be removed and are inherited by the child processes.
+func Apply(ctx context.Context, config Config) error {
+	if config.Seccomp {
+		if err := applySeccomp(); err != nil {
+			return fmt.Errorf("failed to apply seccomp: %w", err)
+		}
+		log.G(ctx).Info("seccomp filter applied")
+	}
+	if config.Landlock {
+		if !config.Seccomp {
+			log.G(ctx).Warn("landlock doesn't restrict MPTCP sockets; enable seccomp as well")
+		}
+		if err := applyLandlock(ctx); err != nil {
+			return fmt.Errorf("failed to apply landlock: %w", err)
+		}
+		log.G(ctx).Info("landlock rules applied")
+	}
+	return nil
+}
+
+func applySeccomp() error {
+	prog, err := seccompFilter(runtime.GOARCH)
+	if err != nil {
+		return err
+	}
+	// TSYNC applies the filter to all threads of the process. Without no_new_privs, this
+	// needs CAP_SYS_ADMIN which the snapshotter has for mounting filesystems.
+	fprog := unix.SockFprog{Len: uint16(len(prog)), Filter: &prog[0]}
+	if tid, _, errno := unix.Syscall(unix.SYS_SECCOMP, unix.SECCOMP_SET_MODE_FILTER,
+		unix.SECCOMP_FILTER_FLAG_TSYNC, uintptr(unsafe.Pointer(&fprog))); errno != 0 {
+		return errno
+	} else if tid != 0 {
+		return fmt.Errorf("thread %d can't be synchronized", tid)
+	}
+	return nil
+}
+
+// seccompFilter returns the BPF program that fails the denied syscalls with EPERM.
+// Syscalls of other architectures (e.g. 32bit syscalls and x32 ABI on x86_64) are
+// denied as well. Creating MPTCP sockets is also denied because Landlock doesn't
+// restrict them. Go falls back to TCP in that case.
+func seccompFilter(goarch string) ([]unix.SockFilter, error) {
+	arch, ok := auditArch[goarch]
+	if !ok {
+		return nil, fmt.Errorf("seccomp isn't supported on %q", goarch)
+	}
+	const (
+		offsetNr    = 0  // offsetof(struct seccomp_data, nr)
+		offsetArch  = 4  // offsetof(struct seccomp_data, arch)
+		offsetArgs2 = 32 // offsetof(struct seccomp_data, args[2])
+		x32Bit      = 0x40000000
+	)
+	offsetProto := uint32(offsetArgs2) // lower 32 bits of the protocol of socket(2)
+	if goarch == "s390x" {
+		offsetProto += 4 // big endian
+	}
+	n := uint8(len(deniedSyscalls))
+	// The program ends with the following instructions. Jumps are relative to the next
+	// instruction so jumping to deny from the instruction at i is (n+8)-(i+1).
+	//   n+4: jeq socket  ; otherwise jump to allow
+	//   n+5: ld protocol
+	//   n+6: jeq mptcp   ; jump to deny
+	//   n+7: ret allow
+	//   n+8: ret deny
+	prog := []unix.SockFilter{
+		stmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, offsetArch),
+		jump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, arch, 0, n+6),
+		stmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, offsetNr),
+		jump(unix.BPF_JMP|unix.BPF_JGE|unix.BPF_K, x32Bit, n+4, 0),
+	}
+	for i, nr := range deniedSyscalls {
+		prog = append(prog, jump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, uint32(nr), n+3-uint8(i), 0))
+	}
+	return append(prog,
+		jump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, unix.SYS_SOCKET, 0, 2),
+		stmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, offsetProto),
+		jump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, unix.IPPROTO_MPTCP, 1, 0),
+		stmt(unix.BPF_RET|unix.BPF_K, unix.SECCOMP_RET_ALLOW),
+		stmt(unix.BPF_RET|unix.BPF_K, unix.SECCOMP_RET_ERRNO|uint32(unix.EPERM)),
+	), nil
+}
+
+func stmt(code uint16, k uint32) unix.SockFilter {
+	return unix.SockFilter{Code: code, K: k}
+}
+
+func jump(code uint16, k uint32, jt, jf uint8) unix.SockFilter {
+	return unix.SockFilter{Code: code, Jt: jt, Jf: jf, K: k}
+}
+
+func applyLandlock(ctx context.Context) error {
+	abi, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, 0, 0, unix.LANDLOCK_CREATE_RULESET_VERSION)
+	if errno != 0 {
+		return fmt.Errorf("landlock isn't available: %w", errno)
+	}
+	if abi < 4 {
+		return fmt.Errorf("landlock ABI %d doesn't support restricting network (needs 4 or later)", abi)
+	}
+	// No rule is added so all of the handled accesses are denied.
+	attr := unix.LandlockRulesetAttr{Access_net: unix.LANDLOCK_ACCESS_NET_BIND_TCP}
+	if abi >= 6 {
+		attr.Scoped = unix.LANDLOCK_SCOPE_SIGNAL
+	} else {
+		log.G(ctx).Warnf("landlock ABI %d doesn't support restricting signals; skipped", abi)
+	}
+	fd, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr), 0)
+	if errno != 0 {
+		return fmt.Errorf("failed to create ruleset: %w", errno)
+	}
+	defer unix.Close(int(fd))
+	// Landlock restricts only the calling thread so the ruleset is applied to all threads.
+	// Without no_new_privs, this needs CAP_SYS_ADMIN same as seccomp.
+	if _, _, errno := syscall.AllThreadsSyscall(unix.SYS_LANDLOCK_RESTRICT_SELF, fd, 0, 0); errno != 0 {
+		if errors.Is(errno, unix.ENOTSUP) {
+			return fmt.Errorf("landlock needs the snapshotter built without cgo: %w", errno)
+		}
+		return fmt.Errorf("failed to restrict threads: %w", errno)
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package sandbox
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+const sandboxTestEnv = "STARGZ_SANDBOX_TEST"
+
+// TestApply applies the sandbox to a child process because it can't be removed.
+func TestApply(t *testing.T) {
+	if mode := os.Getenv(sandboxTestEnv); mode != "" {
+		testSandboxed(t, mode)
+		return
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("sandbox needs CAP_SYS_ADMIN")
+	}
+	for _, mode := range []string{"seccomp", "landlock"} {
+		t.Run(mode, func(t *testing.T) {
+			cmd := exec.Command(os.Args[0], "-test.run=^TestApply$", "-test.v")
+			cmd.Env = append(os.Environ(), sandboxTestEnv+"="+mode)
+			out, err := cmd.CombinedOutput()
+			if strings.Contains(string(out), "--- SKIP") {
+				t.Skipf("skipped in the child: %s", out)
+			}
+			if err != nil {
+				t.Fatalf("sandboxed child failed: %v: %s", err, out)
+			}
+		})
+	}
+}
+
+func testSandboxed(t *testing.T, mode string) {
+	config := Config{Seccomp: true, Landlock: mode == "landlock"}
+	if err := Apply(context.Background(), config); err != nil {
+		if errors.Is(err, unix.ENOTSUP) || errors.Is(err, unix.ENOSYS) || strings.Contains(err.Error(), "ABI") {
+			t.Skipf("%s isn't available: %v", mode, err)
+		}
+		t.Fatalf("failed to apply %s: %v", mode, err)
+	}
+	switch mode {
+	case "seccomp":
+		// All threads are restricted.
+		errCh := make(chan error)
+		go func() {
+			runtime.LockOSThread()
+			defer runtime.UnlockOSThread()
+			errCh <- unix.Unshare(unix.CLONE_NEWUTS)
+		}()
+		if err := <-errCh; !errors.Is(err, unix.EPERM) {
+			t.Errorf("unshare must be denied but got %v", err)
+		}
+		if _, _, err := unix.Syscall(unix.SYS_BPF, 0, 0, 0); !errors.Is(err, unix.EPERM) {
+			t.Errorf("bpf must be denied but got %v", err)
+		}
+		if _, err := os.ReadFile("/proc/self/status"); err != nil {
+			t.Errorf("reading files must be allowed: %v", err)
+		}
+		if _, err := unix.Socket(unix.AF_INET, unix.SOCK_STREAM, unix.IPPROTO_MPTCP); !errors.Is(err, unix.EPERM) {
+			t.Errorf("MPTCP must be denied but got %v", err)
+		}
+		fd, err := unix.Socket(unix.AF_INET, unix.SOCK_STREAM, unix.IPPROTO_TCP)
+		if err != nil {
+			t.Fatalf("TCP must be allowed: %v", err)
+		}
+		unix.Close(fd)
+	case "landlock":
+		if l, err := net.Listen("tcp", "127.0.0.1:0"); err == nil {
+			l.Close()
+			t.Errorf("binding TCP port must be denied")
+		}
+		l, err := net.Listen("unix", filepath.Join(t.TempDir(), "sock"))
+		if err != nil {
+			t.Fatalf("listening unix socket must be allowed: %v", err)
+		}
+		l.Close()
+	}
+}
@@ -20,10 +20,17 @@ import (
 	"expvar"
 	"net/http"
 	"net/http/pprof"
+
+	stargzfs "github.com/containerd/stargz-snapshotter/fs"
 )
 
-func debugServerMux() *http.ServeMux {
+// debugServerMux returns the handler of the debug endpoints. The status page of the node is
+// served if status isn't nil.
+func debugServerMux(status *stargzfs.StatusReporter) *http.ServeMux {
 	m := http.NewServeMux()
+	if status != nil {
+		handleStatus(m, status)
+	}
 	m.Handle("/debug/vars", expvar.Handler())
 	m.Handle("/debug/pprof/", http.HandlerFunc(pprof.Index))
 	m.Handle("/debug/pprof/cmdline", http.HandlerFunc(pprof.Cmdline))
@@ -0,0 +1,131 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"slices"
+
+	"github.com/containerd/log"
+	"golang.org/x/sys/unix"
+)
+
+// SocketsConfig is configuration for the Unix domain sockets served by the snapshotter.
+type SocketsConfig struct {
+	// Snapshotter is configuration for the socket of the snapshotter (-address).
+	Snapshotter SocketConfig `toml:"snapshotter" json:"snapshotter"`
+
+	// Admin is configuration for the socket of the admin API (admin_address).
+	Admin SocketConfig `toml:"admin" json:"admin"`
+
+	// Store is configuration for the socket of the controller API of the store (store.address).
+	Store SocketConfig `toml:"store" json:"store"`
+}
+
+// SocketConfig is configuration for the permissions of a Unix domain socket and the peers
+// allowed to connect to it. The directory of the socket needs to be accessible by the peers
+// other than root.
+type SocketConfig struct {
+	// UID and GID are the owner of the socket. Default is 0 (root).
+	UID int `toml:"uid" json:"uid"`
+	GID int `toml:"gid" json:"gid"`
+
+	// Mode is the permission bits of the socket (e.g. 0o660). Default is 0, which keeps the
+	// permissions the socket is created with.
+	Mode uint32 `toml:"mode" json:"mode"`
+
+	// AllowedUIDs and AllowedGIDs are the UIDs and the primary GIDs of the peer processes
+	// allowed to connect to the socket, checked with SO_PEERCRED. Root is always allowed and
+	// connections of the other peers are closed. Default is empty (any peer that can open
+	// the socket is allowed).
+	AllowedUIDs []uint32 `toml:"allowed_uids" json:"allowed_uids"`
+	AllowedGIDs []uint32 `toml:"allowed_gids" json:"allowed_gids"`
+}
+
+// secureListener applies the permissions of cfg to the socket of l listening on addr and
+// returns the listener accepting only the allowed peers.
+func secureListener(l net.Listener, addr string, cfg SocketConfig) (net.Listener, error) {
+	if cfg.UID != 0 || cfg.GID != 0 {
+		if err := os.Chown(addr, cfg.UID, cfg.GID); err != nil {
+			l.Close()
+			return nil, fmt.Errorf("failed to change owner of %q: %w", addr, err)
+		}
+	}
+	if cfg.Mode != 0 {
+		if err := os.Chmod(addr, os.FileMode(cfg.Mode).Perm()); err != nil {
+			l.Close()
+			return nil, fmt.Errorf("failed to change mode of %q: %w", addr, err)
+		}
+	}
+	if len(cfg.AllowedUIDs) == 0 && len(cfg.AllowedGIDs) == 0 {
+		return l, nil
+	}
+	return &peerListener{Listener: l, addr: addr, cfg: cfg}, nil
+}
+
+// peerListener closes the connections of the peers not allowed by cfg.
+type peerListener struct {
+	net.Listener
+	addr string
+	cfg  SocketConfig
+}
+
+func (l *peerListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		cred, err := peerCred(c)
+		if err == nil && l.allowed(cred) {
+			return c, nil
+		}
+		if err != nil {
+			log.L.WithError(err).Warnf("failed to get peer credentials on %q", l.addr)
+		} else {
+			log.L.Warnf("rejected connection of uid=%d gid=%d pid=%d on %q", cred.Uid, cred.Gid, cred.Pid, l.addr)
+		}
+		c.Close()
+	}
+}
+
+func (l *peerListener) allowed(cred *unix.Ucred) bool {
+	return cred.Uid == 0 || slices.Contains(l.cfg.AllowedUIDs, cred.Uid) || slices.Contains(l.cfg.AllowedGIDs, cred.Gid)
+}
+
+func peerCred(c net.Conn) (*unix.Ucred, error) {
+	uc, ok := c.(*net.UnixConn)
+	if !ok {
+		return nil, fmt.Errorf("not a unix connection: %T", c)
+	}
+	rc, err := uc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var (
+		cred    *unix.Ucred
+		credErr error
+	)
+	if err := rc.Control(func(fd uintptr) {
+		cred, credErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	}); err != nil {
+		return nil, err
+	}
+	return cred, credErr
+}
@@ -0,0 +1,62 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"net/http"
+
+	"github.com/containerd/log"
+	stargzfs "github.com/containerd/stargz-snapshotter/fs"
+)
+
+// statusPage is the static page showing the status of the node. It polls /debug/status.json.
+//
+//go:embed status.html
+var statusPage []byte
+
+// handleStatus registers the status page of the node. "/debug/status" serves the page and
+// "/debug/status.json" returns the status (mounts, fetch progress of the layers, cache usage,
+// recent errors and the throughput of fetching layers) on GET.
+func handleStatus(m *http.ServeMux, status *stargzfs.StatusReporter) {
+	m.HandleFunc("/debug/status", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if _, err := w.Write(statusPage); err != nil {
+			log.G(r.Context()).WithError(err).Warn("failed to write status page")
+		}
+	})
+	m.HandleFunc("/debug/status.json", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		st, err := status.Status()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(st); err != nil {
+			log.G(r.Context()).WithError(err).Warn("failed to write status")
+		}
+	})
+}
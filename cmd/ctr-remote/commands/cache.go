@@ -0,0 +1,66 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/containerd/stargz-snapshotter/cache"
+	"github.com/urfave/cli/v2"
+)
+
+// CacheCommand manages the cache of the snapshotter
+var CacheCommand = &cli.Command{
+	Name:  "cache",
+	Usage: "manage the cache of stargz snapshotter",
+	Subcommands: []*cli.Command{
+		cacheSyncCommand,
+	},
+}
+
+var cacheSyncCommand = &cli.Command{
+	Name:      "sync",
+	Usage:     "copy cache entries missing in the synced cache directory",
+	ArgsUsage: "<source directory> <destination directory>",
+	Description: `Copies the cache entries missing in the destination from the source and updates
+the manifest of the destination.
+The source is the filesystem cache directory of a running snapshotter
+(e.g. /var/lib/containerd-stargz-grpc/stargz/fscache) or a synced cache directory.
+The synced cache directory consists of immutable files so it can be efficiently
+replicated with rsync to other nodes. Specify it as "seed_dir" of "[directory_cache]"
+of the snapshotter on these nodes.`,
+	Flags: []cli.Flag{
+		&cli.Int64Flag{
+			Name:  "max-size",
+			Usage: "Maximum total size (in bytes) of entries taken from the source. Recently accessed entries are preferred. 0 means no limit",
+		},
+	},
+	Action: func(clicontext *cli.Context) error {
+		if clicontext.NArg() != 2 {
+			return errors.New("source and destination directories need to be specified")
+		}
+		res, err := cache.Sync(clicontext.Args().Get(0), clicontext.Args().Get(1),
+			cache.WithMaxSize(clicontext.Int64("max-size")))
+		if err != nil {
+			return fmt.Errorf("failed to sync cache: %w", err)
+		}
+		fmt.Printf("copied: %d (%d bytes)\n", res.Copied, res.CopiedSize)
+		fmt.Printf("skipped: %d\n", res.Skipped)
+		return nil
+	},
+}
@@ -0,0 +1,52 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/containerd/stargz-snapshotter/util/criuutil"
+	"github.com/urfave/cli/v2"
+)
+
+var mountsPrepareCheckpointCommand = &cli.Command{
+	Name:      "prepare-checkpoint",
+	Usage:     "prepare checkpointing a process running on lazily pulled layers",
+	ArgsUsage: "PID",
+	Description: `Fetches all regions of the files mapped by the process so that checkpointing it (e.g.
+with CRIU) doesn't block on the registry. Then the options of "criu dump" are shown to record
+the layers mounted in the mount namespace of the process as external mounts keyed by the
+layer digests, which are the same on the node where the process is restored.`,
+	Action: func(clicontext *cli.Context) error {
+		pid, err := strconv.Atoi(clicontext.Args().First())
+		if err != nil || pid <= 0 {
+			return fmt.Errorf("pid must be specified")
+		}
+		if err := criuutil.FetchMappedRegions(clicontext.Context, pid); err != nil {
+			return err
+		}
+		mounts, err := criuutil.ExternalMounts(pid)
+		if err != nil {
+			return err
+		}
+		for _, m := range mounts {
+			fmt.Fprintln(clicontext.App.Writer, m.DumpOption())
+		}
+		return nil
+	},
+}
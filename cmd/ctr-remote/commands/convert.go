@@ -33,12 +33,16 @@ import (
 	"github.com/containerd/log"
 	"github.com/containerd/platforms"
 	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/containerd/stargz-snapshotter/nativeconverter"
+	encryptionconvert "github.com/containerd/stargz-snapshotter/nativeconverter/encryption"
 	estargzconvert "github.com/containerd/stargz-snapshotter/nativeconverter/estargz"
 	esgzexternaltocconvert "github.com/containerd/stargz-snapshotter/nativeconverter/estargz/externaltoc"
 	zstdchunkedconvert "github.com/containerd/stargz-snapshotter/nativeconverter/zstdchunked"
 	"github.com/containerd/stargz-snapshotter/recorder"
 	"github.com/containerd/stargz-snapshotter/util/decompressutil"
+	ocicrypthelpers "github.com/containers/ocicrypt/helpers"
 	"github.com/klauspost/compress/zstd"
+	digest "github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/urfave/cli/v2"
 )
@@ -52,6 +56,12 @@ var ConvertCommand = &cli.Command{
 
 e.g., 'ctr-remote convert --estargz --oci example.com/foo:orig example.com/foo:esgz'
 
+When both '--estargz' and '--zstdchunked' are given, the image is converted into both
+formats in a single pass over the layers and the zstd:chunked image is stored as the
+second target.
+
+e.g., 'ctr-remote convert --estargz --zstdchunked --oci example.com/foo:orig example.com/foo:esgz example.com/foo:zstdchunked'
+
 Use '--platform' to define the output platform.
 When '--all-platforms' is given all images in a manifest list must be available.
 `,
@@ -65,6 +75,14 @@ When '--all-platforms' is given all images in a manifest list must be available.
 			Name:  "estargz-record-in",
 			Usage: "Read 'ctr-remote optimize --record-out=<FILE>' record file",
 		},
+		&cli.StringSliceFlag{
+			Name:  "estargz-prefetch-tier-in",
+			Usage: "Read record files of prefetch tiers (e.g. files needed at exec, files needed within 10s and the rest) in the order of tiers. Each file has the same format as '--estargz-record-in'. Cannot be used in conjunction with '--estargz-record-in'",
+		},
+		&cli.StringFlag{
+			Name:  "estargz-access-order-in",
+			Usage: "Read access order tar index (a tar archive of empty entries named by the accessed paths with the time of the first access as the modification time) generated by external profilers and prioritize files in the order of the first access. Cannot be used in conjunction with '--estargz-record-in' or '--estargz-prefetch-tier-in'",
+		},
 		&cli.IntFlag{
 			Name:  "estargz-compression-level",
 			Usage: "eStargz compression level",
@@ -80,10 +98,35 @@ When '--all-platforms' is given all images in a manifest list must be available.
 			Usage: "The minimal number of bytes of data must be written in one gzip stream. Note that this adds a TOC property that old reader doesn't understand.",
 			Value: 0,
 		},
+		&cli.BoolFlag{
+			Name:  "estargz-auto-chunk-size",
+			Usage: "Choose chunk sizes from the access pattern recorded in '--estargz-record-in'. Accessed files are split into large chunks and compressed together and others are split into small chunks (--estargz-chunk-size or 1MiB by default). Note that this adds a TOC property that old reader doesn't understand.",
+		},
+		&cli.StringFlag{
+			Name:  "estargz-digest-algorithm",
+			Usage: "Algorithm of the digests of files and chunks recorded in TOC. Options: sha256, sha384, sha512, or blake3. Default is sha256. Note that older readers can't read layers recorded with blake3.",
+			Value: "",
+		},
 		&cli.BoolFlag{
 			Name:  "estargz-external-toc",
 			Usage: "Separate TOC JSON into another image (called \"TOC image\"). The name of TOC image is the original + \"-esgztoc\" suffix. Both eStargz and the TOC image should be pushed to the same registry. stargz-snapshotter refers to the TOC image when it pulls the result eStargz image.",
 		},
+		&cli.BoolFlag{
+			Name:  "estargz-prefix-toc",
+			Usage: "Place a copy of TOC JSON at the beginning of the blob so that consumers reading the blob forward can get the metadata early (cannot be used in conjunction with '--estargz-external-toc')",
+		},
+		&cli.BoolFlag{
+			Name:  "estargz-compressed-toc",
+			Usage: "Compress TOC JSON with zstd to reduce the size of layers containing many files. Requires stargz-snapshotter supporting the compressed TOC (cannot be used in conjunction with '--estargz-external-toc')",
+		},
+		&cli.BoolFlag{
+			Name:  "estargz-adaptive-compression",
+			Usage: "Choose the compression level of each file from the entropy of the contents. Poorly compressible files (e.g. already compressed assets) are compressed with a fast level or stored without compression.",
+		},
+		&cli.BoolFlag{
+			Name:  "estargz-dedup-files",
+			Usage: "Store the contents of regular files that have the same contents as a preceding file only once. Note that this adds a TOC property that old reader doesn't understand and such files are zero-filled when the layer is extracted as a plain tar.",
+		},
 		&cli.BoolFlag{
 			Name:  "estargz-keep-diff-id",
 			Usage: "convert to esgz without changing diffID (cannot be used in conjunction with '--estargz-record-in'. must be specified with '--estargz-external-toc')",
@@ -108,6 +151,16 @@ When '--all-platforms' is given all images in a manifest list must be available.
 			Usage: "zstd:chunked compression level",
 			Value: 3, // SpeedDefault; see also https://pkg.go.dev/github.com/klauspost/compress/zstd#EncoderLevel
 		},
+		&cli.IntFlag{
+			Name:  "zstdchunked-encoder-concurrency",
+			Usage: "Number of goroutines used by each zstd encoder (0 uses the default of the zstd library)",
+			Value: 0,
+		},
+		&cli.IntFlag{
+			Name:  "zstdchunked-window-size",
+			Usage: "Maximum window size of zstd encoder in bytes. Must be a power of two (0 uses the default for the compression level)",
+			Value: 0,
+		},
 		&cli.IntFlag{
 			Name:  "zstdchunked-chunk-size",
 			Usage: "zstd:chunked chunk size",
@@ -122,6 +175,11 @@ When '--all-platforms' is given all images in a manifest list must be available.
 			Name:  "oci",
 			Usage: "convert Docker media types to OCI media types",
 		},
+		&cli.StringSliceFlag{
+			Name:  "encrypt-recipient",
+			Usage: "encrypt layers with ocicrypt for the recipient (e.g. jwe:/path/to/pubkey.pem) after the conversion",
+			Value: &cli.StringSlice{},
+		},
 		// platform flags
 		&cli.StringSliceFlag{
 			Name:  "platform",
@@ -177,6 +235,12 @@ When '--all-platforms' is given all images in a manifest list must be available.
 					if context.String("estargz-record-in") != "" {
 						return fmt.Errorf("option --estargz-keep-diff-id conflicts with --estargz-record-in")
 					}
+					if len(context.StringSlice("estargz-prefetch-tier-in")) > 0 {
+						return fmt.Errorf("option --estargz-keep-diff-id conflicts with --estargz-prefetch-tier-in")
+					}
+					if context.String("estargz-access-order-in") != "" {
+						return fmt.Errorf("option --estargz-keep-diff-id conflicts with --estargz-access-order-in")
+					}
 					layerConvertFunc, finalize = esgzexternaltocconvert.LayerConvertLossLessFunc(esgzexternaltocconvert.LayerConvertLossLessConfig{
 						CompressionLevel: context.Int("estargz-compression-level"),
 						ChunkSize:        context.Int("estargz-chunk-size"),
@@ -195,34 +259,60 @@ When '--all-platforms' is given all images in a manifest list must be available.
 			if context.Bool("uncompress") {
 				return errors.New("option --estargz conflicts with --uncompress")
 			}
-			if context.Bool("zstdchunked") {
-				return errors.New("option --estargz conflicts with --zstdchunked")
-			}
 		}
 
+		// zstdchunkedTargetRef is the target of the zstd:chunked image converted along with
+		// the eStargz image.
+		var zstdchunkedTargetRef string
+		var zstdchunkedLayerConvertFunc converter.ConvertFunc
 		if context.Bool("zstdchunked") {
 			esgzOpts, err := getZstdchunkedConvertOpts(context)
 			if err != nil {
 				return err
 			}
-			layerConvertFunc = zstdchunkedconvert.LayerConvertFuncWithCompressionLevel(
-				zstd.EncoderLevelFromZstd(context.Int("zstdchunked-compression-level")), esgzOpts...)
+			zstdchunkedLayerConvertFunc = zstdchunkedconvert.LayerConvertFuncWithEncoderConfig(
+				getZstdchunkedEncoderConfig(context), esgzOpts...)
 			if !context.Bool("oci") {
 				return errors.New("option --zstdchunked must be used in conjunction with --oci")
 			}
 			if context.Bool("uncompress") {
 				return errors.New("option --zstdchunked conflicts with --uncompress")
 			}
+			if context.Bool("estargz") {
+				if finalize != nil {
+					return errors.New("option --estargz-external-toc conflicts with --zstdchunked")
+				}
+				if zstdchunkedTargetRef = context.Args().Get(2); zstdchunkedTargetRef == "" {
+					return errors.New("target image of zstd:chunked needs to be specified with --estargz and --zstdchunked")
+				}
+				variants := nativeconverter.NewVariants(layerConvertFunc, zstdchunkedLayerConvertFunc)
+				layerConvertFunc, zstdchunkedLayerConvertFunc = variants.LayerConvertFunc(0), variants.LayerConvertFunc(1)
+			} else {
+				layerConvertFunc, zstdchunkedLayerConvertFunc = zstdchunkedLayerConvertFunc, nil
+			}
 		}
 
 		if context.Bool("uncompress") {
 			layerConvertFunc = uncompress.LayerConvertFunc
 		}
 
+		if recipients := context.StringSlice("encrypt-recipient"); len(recipients) > 0 {
+			cc, err := ocicrypthelpers.CreateCryptoConfig(recipients, nil)
+			if err != nil {
+				return fmt.Errorf("invalid recipients: %w", err)
+			}
+			if !context.Bool("oci") {
+				log.L.Warn("option --encrypt-recipient should be used in conjunction with --oci")
+			}
+			layerConvertFunc = encryptionconvert.LayerConvertFunc(cc.EncryptConfig, layerConvertFunc)
+			if zstdchunkedLayerConvertFunc != nil {
+				zstdchunkedLayerConvertFunc = encryptionconvert.LayerConvertFunc(cc.EncryptConfig, zstdchunkedLayerConvertFunc)
+			}
+		}
+
 		if layerConvertFunc == nil {
 			return errors.New("specify layer converter")
 		}
-		convertOpts = append(convertOpts, converter.WithLayerConvertFunc(layerConvertFunc))
 
 		if context.Bool("oci") {
 			convertOpts = append(convertOpts, converter.WithDockerToOCI(true))
@@ -251,10 +341,25 @@ When '--all-platforms' is given all images in a manifest list must be available.
 			case <-ctx.Done():
 			}
 		}()
-		newImg, err := converter.Convert(ctx, client, targetRef, srcRef, convertOpts...)
+		// Record the prefetch coverage of the layers to the manifests.
+		withLayerConvertFunc := func(f converter.ConvertFunc) converter.Opt {
+			return converter.WithIndexConvertFunc(converter.IndexConvertFuncWithHook(f, context.Bool("oci"), platformMC,
+				converter.ConvertHooks{PostConvertHook: nativeconverter.PrefetchCoverageHook}))
+		}
+		newImg, err := converter.Convert(ctx, client, targetRef, srcRef,
+			append(convertOpts, withLayerConvertFunc(layerConvertFunc))...)
 		if err != nil {
 			return err
 		}
+		if zstdchunkedLayerConvertFunc != nil {
+			// Layers are already converted into zstd:chunked during the conversion above.
+			zstdchunkedImg, err := converter.Convert(ctx, client, zstdchunkedTargetRef, srcRef,
+				append(convertOpts, withLayerConvertFunc(zstdchunkedLayerConvertFunc))...)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintln(context.App.Writer, "zstd:chunked image:", zstdchunkedImg.Target.Digest.String())
+		}
 		if finalize != nil {
 			newI, err := finalize(ctx, client.ContentStore(), targetRef, &newImg.Target)
 			if err != nil {
@@ -284,9 +389,64 @@ func getESGZConvertOpts(context *cli.Context) ([]estargz.Option, error) {
 		if err != nil {
 			return nil, err
 		}
-		esgzOpts = append(esgzOpts, estargz.WithPrioritizedFiles(paths))
+		if context.Bool("estargz-auto-chunk-size") {
+			esgzOpts = append(esgzOpts, estargz.WithAccessTrace(paths))
+		} else {
+			esgzOpts = append(esgzOpts, estargz.WithPrioritizedFiles(paths))
+		}
 		var ignored []string
 		esgzOpts = append(esgzOpts, estargz.WithAllowPrioritizeNotFound(&ignored))
+	} else if context.Bool("estargz-auto-chunk-size") {
+		return nil, fmt.Errorf("option --estargz-auto-chunk-size must be specified with --estargz-record-in")
+	}
+	if tierIn := context.StringSlice("estargz-prefetch-tier-in"); len(tierIn) > 0 {
+		if context.String("estargz-record-in") != "" {
+			return nil, fmt.Errorf("option --estargz-prefetch-tier-in conflicts with --estargz-record-in")
+		}
+		var tiers [][]string
+		for _, f := range tierIn {
+			paths, err := readPathsFromRecordFile(f)
+			if err != nil {
+				return nil, err
+			}
+			tiers = append(tiers, paths)
+		}
+		var ignored []string
+		esgzOpts = append(esgzOpts, estargz.WithPrefetchTiers(tiers), estargz.WithAllowPrioritizeNotFound(&ignored))
+	}
+	if accessOrderIn := context.String("estargz-access-order-in"); accessOrderIn != "" {
+		if context.String("estargz-record-in") != "" || len(context.StringSlice("estargz-prefetch-tier-in")) > 0 {
+			return nil, fmt.Errorf("option --estargz-access-order-in conflicts with --estargz-record-in and --estargz-prefetch-tier-in")
+		}
+		f, err := os.Open(accessOrderIn)
+		if err != nil {
+			return nil, err
+		}
+		opt := estargz.WithPrioritizedFilesFromTar(f)
+		f.Close()
+		var ignored []string
+		esgzOpts = append(esgzOpts, opt, estargz.WithAllowPrioritizeNotFound(&ignored))
+	}
+	if alg := context.String("estargz-digest-algorithm"); alg != "" {
+		esgzOpts = append(esgzOpts, estargz.WithDigestAlgorithm(digest.Algorithm(alg)))
+	}
+	if context.Bool("estargz-prefix-toc") {
+		if context.Bool("estargz-external-toc") {
+			return nil, fmt.Errorf("option --estargz-prefix-toc conflicts with --estargz-external-toc")
+		}
+		esgzOpts = append(esgzOpts, estargz.WithPrefixTOC())
+	}
+	if context.Bool("estargz-compressed-toc") {
+		if context.Bool("estargz-external-toc") {
+			return nil, fmt.Errorf("option --estargz-compressed-toc conflicts with --estargz-external-toc")
+		}
+		esgzOpts = append(esgzOpts, estargz.WithCompressedTOC())
+	}
+	if context.Bool("estargz-adaptive-compression") {
+		esgzOpts = append(esgzOpts, estargz.WithAdaptiveCompression())
+	}
+	if context.Bool("estargz-dedup-files") {
+		esgzOpts = append(esgzOpts, estargz.WithDedupFiles())
 	}
 	if estargzGzipHelper := context.String("estargz-gzip-helper"); estargzGzipHelper != "" {
 		gzipHelperFunc, err := decompressutil.GetGzipHelperFunc(estargzGzipHelper)
@@ -298,6 +458,14 @@ func getESGZConvertOpts(context *cli.Context) ([]estargz.Option, error) {
 	return esgzOpts, nil
 }
 
+func getZstdchunkedEncoderConfig(context *cli.Context) zstdchunkedconvert.EncoderConfig {
+	return zstdchunkedconvert.EncoderConfig{
+		CompressionLevel: zstd.EncoderLevelFromZstd(context.Int("zstdchunked-compression-level")),
+		Concurrency:      context.Int("zstdchunked-encoder-concurrency"),
+		WindowSize:       context.Int("zstdchunked-window-size"),
+	}
+}
+
 func getZstdchunkedConvertOpts(context *cli.Context) ([]estargz.Option, error) {
 	esgzOpts := []estargz.Option{
 		estargz.WithChunkSize(context.Int("zstdchunked-chunk-size")),
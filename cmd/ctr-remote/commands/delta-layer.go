@@ -0,0 +1,127 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/containerd/containerd/v2/cmd/ctr/commands"
+	"github.com/containerd/containerd/v2/core/content"
+	"github.com/containerd/containerd/v2/pkg/labels"
+	"github.com/containerd/errdefs"
+	"github.com/containerd/stargz-snapshotter/estargz"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/urfave/cli/v2"
+)
+
+// DeltaLayerCommand builds an eStargz delta layer against a base eStargz layer
+var DeltaLayerCommand = &cli.Command{
+	Name:      "delta-layer",
+	Usage:     "build an eStargz delta layer against a base eStargz layer in the content store",
+	ArgsUsage: "<base layer digest> <layer digest>",
+	Description: `Builds an eStargz delta layer from the layer (gzip, zstd or plain tar).
+Chunks identical to a chunk in the base eStargz layer aren't stored in the delta layer but
+are referenced by the chunk digest. The delta layer isn't a standalone layer; the chunks
+stored in the base layer are resolved from the cache of the base layer mounted on the node
+(see "enable_delta_layers" of the snapshotter).
+The digest of the delta layer is printed.`,
+	Flags: []cli.Flag{
+		&cli.IntFlag{
+			Name:  "estargz-compression-level",
+			Usage: "eStargz compression level",
+			Value: 9,
+		},
+		&cli.IntFlag{
+			Name:  "estargz-chunk-size",
+			Usage: "eStargz chunk size. Use the same chunk size as the base layer to share more chunks",
+			Value: 0,
+		},
+		&cli.IntFlag{
+			Name:  "estargz-min-chunk-size",
+			Usage: "The minimal number of bytes of data must be written in one gzip stream",
+			Value: 0,
+		},
+	},
+	Action: func(clicontext *cli.Context) error {
+		if clicontext.NArg() != 2 {
+			return errors.New("base layer digest and layer digest need to be specified")
+		}
+
+		client, ctx, cancel, err := commands.NewClient(clicontext)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+
+		cs := client.ContentStore()
+		var layers []*io.SectionReader
+		for _, s := range clicontext.Args().Slice() {
+			dgst, err := digest.Parse(s)
+			if err != nil {
+				return err
+			}
+			ra, err := cs.ReaderAt(ctx, ocispec.Descriptor{Digest: dgst})
+			if err != nil {
+				return err
+			}
+			defer ra.Close()
+			layers = append(layers, io.NewSectionReader(ra, 0, ra.Size()))
+		}
+		base, err := estargz.Open(layers[0])
+		if err != nil {
+			return fmt.Errorf("failed to open base layer: %w", err)
+		}
+
+		blob, err := estargz.Build(layers[1],
+			estargz.WithCompressionLevel(clicontext.Int("estargz-compression-level")),
+			estargz.WithChunkSize(clicontext.Int("estargz-chunk-size")),
+			estargz.WithMinChunkSize(clicontext.Int("estargz-min-chunk-size")),
+			estargz.WithDeltaBase(base),
+			estargz.WithContext(ctx),
+		)
+		if err != nil {
+			return fmt.Errorf("failed to build delta layer: %w", err)
+		}
+		defer blob.Close()
+
+		w, err := content.OpenWriter(ctx, cs, content.WithRef("delta-estargz-"+digest.FromString(fmt.Sprint(clicontext.Args().Slice())).Encoded()))
+		if err != nil {
+			return err
+		}
+		defer w.Close()
+		if err := w.Truncate(0); err != nil {
+			return err
+		}
+		n, err := io.Copy(w, blob)
+		if err != nil {
+			return err
+		}
+		if err := blob.Close(); err != nil {
+			return err
+		}
+		labelz := map[string]string{labels.LabelUncompressed: blob.DiffID().String()}
+		if err := w.Commit(ctx, n, "", content.WithLabels(labelz)); err != nil && !errdefs.IsAlreadyExists(err) {
+			return err
+		}
+
+		printLayer(clicontext.App.Writer, w.Digest(), n, blob)
+		return nil
+	},
+}
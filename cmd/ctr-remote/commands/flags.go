@@ -124,6 +124,10 @@ var samplerFlags = []cli.Flag{
 		Name:  "add-hosts",
 		Usage: "comma-separated hosts configuration (host:IP) added to container's /etc/hosts",
 	},
+	&cli.StringFlag{
+		Name:  "runtime-files",
+		Usage: "path to a JSON file listing synthetic files (e.g. /etc/resolv.conf or placeholders of secrets) mounted read-only into the container",
+	},
 	&cli.BoolFlag{
 		Name:  "cni",
 		Usage: "enable CNI-based networking",
@@ -241,6 +245,18 @@ func getSpecOpts(clicontext *cli.Context) func(image containerd.Image, rootfs st
 				}
 			}
 		}
+		// Runtime files are mounted last so they take precedence over the files generated
+		// from the other flags (e.g. /etc/resolv.conf).
+		if rf := clicontext.String("runtime-files"); rf != "" {
+			var rOpt oci.SpecOpts
+			rOpt, cleanup, err = withRuntimeFiles(rf)
+			if err != nil {
+				rErr = fmt.Errorf("failed to prepare runtime files: %w", err)
+				return
+			}
+			cleanups = append(cleanups, cleanup)
+			opts = append(opts, rOpt)
+		}
 
 		return
 	}
@@ -71,7 +71,7 @@ var GetTOCDigestCommand = &cli.Command{
 
 		footerSize := estargz.FooterSize
 		if clicontext.Bool("zstdchunked") {
-			footerSize = zstdchunked.FooterSize
+			footerSize = zstdchunked.TarSplitFooterSize
 		}
 		footer := make([]byte, footerSize)
 		if _, err := ra.ReadAt(footer, ra.Size()-int64(footerSize)); err != nil {
@@ -0,0 +1,143 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	stargzfs "github.com/containerd/stargz-snapshotter/fs"
+	"github.com/urfave/cli/v2"
+)
+
+// MountsCommand manages the layers mounted by a running snapshotter through its admin API.
+var MountsCommand = &cli.Command{
+	Name:  "mounts",
+	Usage: "manage the layers mounted by stargz snapshotter",
+	Subcommands: []*cli.Command{
+		mountsQuiesceCommand,
+		mountsRestartCommand,
+		mountsPrepareCheckpointCommand,
+	},
+}
+
+var mountsQuiesceCommand = &cli.Command{
+	Name:  "quiesce",
+	Usage: "fetch the remaining contents of the files recently read from the mounted layers",
+	Description: `Fetches the remaining contents of the files read from the mounted layers within the
+specified duration, so the running containers keep working while the registry is unavailable
+(e.g. before a planned maintenance of the registry). The results of the layers are shown.
+The snapshotter needs to expose the admin API with "admin_address" and record the reads with
+"access_trace_size" in its configuration.`,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "address",
+			Usage: "address of the admin API of the snapshotter",
+			Value: defaultAdminAddress,
+		},
+		&cli.DurationFlag{
+			Name:  "within",
+			Usage: "fetch the files read within this duration",
+			Value: 10 * time.Minute,
+		},
+	},
+	Action: func(clicontext *cli.Context) error {
+		addr := clicontext.String("address")
+		within := clicontext.Duration("within")
+		if within < time.Second {
+			return fmt.Errorf("within must be at least a second")
+		}
+		body, err := json.Marshal(map[string]int64{"within_sec": int64(within / time.Second)})
+		if err != nil {
+			return err
+		}
+		resp, err := newAdminClient(addr).Post("http://admin/mounts/quiesce", "application/json", bytes.NewReader(body))
+		if err != nil {
+			return fmt.Errorf("failed to access admin API %q: %w", addr, err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			msg, _ := io.ReadAll(resp.Body)
+			return fmt.Errorf("failed to quiesce (%s): %s", resp.Status, bytes.TrimSpace(msg))
+		}
+		var results []stargzfs.QuiesceResult
+		if err := json.NewDecoder(resp.Body).Decode(&results); err != nil {
+			return fmt.Errorf("failed to decode results: %w", err)
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(results); err != nil {
+			return err
+		}
+		for _, r := range results {
+			if r.Error != "" {
+				return fmt.Errorf("failed to quiesce some layers")
+			}
+		}
+		return nil
+	},
+}
+
+var mountsRestartCommand = &cli.Command{
+	Name:      "restart",
+	Usage:     "restart serving a mounted layer",
+	ArgsUsage: "MOUNTPOINT",
+	Description: `Restarts serving the layer mounted on the mountpoint without touching the other mounts,
+to recover the layer from a wedge. If the mountpoint isn't in use, it is unmounted and the layer is
+mounted again with a new reader, cache and FUSE session. Otherwise, the connection of the layer to
+the registry is refreshed in place. The snapshotter needs to expose the admin API with
+"admin_address" in its configuration.`,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "address",
+			Usage: "address of the admin API of the snapshotter",
+			Value: defaultAdminAddress,
+		},
+	},
+	Action: func(clicontext *cli.Context) error {
+		addr := clicontext.String("address")
+		mountpoint := clicontext.Args().First()
+		if mountpoint == "" {
+			return fmt.Errorf("mountpoint must be specified")
+		}
+		body, err := json.Marshal(map[string]string{"mountpoint": mountpoint})
+		if err != nil {
+			return err
+		}
+		resp, err := newAdminClient(addr).Post("http://admin/mounts/restart", "application/json", bytes.NewReader(body))
+		if err != nil {
+			return fmt.Errorf("failed to access admin API %q: %w", addr, err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			msg, _ := io.ReadAll(resp.Body)
+			return fmt.Errorf("failed to restart (%s): %s", resp.Status, bytes.TrimSpace(msg))
+		}
+		var result stargzfs.RestartResult
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			return fmt.Errorf("failed to decode result: %w", err)
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(result)
+	},
+}
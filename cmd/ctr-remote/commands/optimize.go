@@ -47,7 +47,6 @@ import (
 	"github.com/containerd/stargz-snapshotter/recorder"
 	"github.com/containerd/stargz-snapshotter/util/containerdutil"
 	"github.com/containerd/stargz-snapshotter/util/decompressutil"
-	"github.com/klauspost/compress/zstd"
 	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/urfave/cli/v2"
@@ -113,6 +112,10 @@ var OptimizeCommand = &cli.Command{
 			Usage: "The minimal number of bytes of data must be written in one gzip stream. Note that this adds a TOC property that old reader doesn't understand (not applied to zstd:chunked)",
 			Value: 0,
 		},
+		&cli.BoolFlag{
+			Name:  "estargz-auto-chunk-size",
+			Usage: "Choose chunk sizes from the recorded access pattern. Accessed files are split into large chunks and compressed together and others are split into small chunks (--estargz-chunk-size or 1MiB by default). Note that this adds a TOC property that old reader doesn't understand",
+		},
 		&cli.StringFlag{
 			Name:    "estargz-gzip-helper",
 			Aliases: []string{"GH"},
@@ -128,6 +131,16 @@ var OptimizeCommand = &cli.Command{
 			Usage: "zstd:chunked compression level",
 			Value: 3, // SpeedDefault; see also https://pkg.go.dev/github.com/klauspost/compress/zstd#EncoderLevel
 		},
+		&cli.IntFlag{
+			Name:  "zstdchunked-encoder-concurrency",
+			Usage: "Number of goroutines used by each zstd encoder (0 uses the default of the zstd library)",
+			Value: 0,
+		},
+		&cli.IntFlag{
+			Name:  "zstdchunked-window-size",
+			Usage: "Maximum window size of zstd encoder in bytes. Must be a power of two (0 uses the default for the compression level)",
+			Value: 0,
+		},
 		&cli.StringFlag{
 			Name:  "prefetch-list",
 			Usage: "path to a text file listing files/patterns to prefetch (one per line; supports glob *, ?, [], and **)",
@@ -195,8 +208,8 @@ var OptimizeCommand = &cli.Command{
 		var f converter.ConvertFunc
 		var finalize func(ctx context.Context, cs content.Store, ref string, desc *ocispec.Descriptor) (*images.Image, error)
 		if clicontext.Bool("zstdchunked") {
-			f = zstdchunkedconvert.LayerConvertWithLayerOptsFuncWithCompressionLevel(
-				zstd.EncoderLevelFromZstd(clicontext.Int("zstdchunked-compression-level")), esgzOptsPerLayer)
+			f = zstdchunkedconvert.LayerConvertWithLayerOptsFuncWithEncoderConfig(
+				getZstdchunkedEncoderConfig(clicontext), esgzOptsPerLayer)
 		} else {
 			esgzOpts := []estargz.Option{
 				estargz.WithChunkSize(clicontext.Int("estargz-chunk-size")),
@@ -359,7 +372,11 @@ func buildLayerOptsFromRecord(
 	layerOpts := make(map[digest.Digest][]estargz.Option, len(manifest.Layers))
 	for _, desc := range manifest.Layers {
 		if layerLog, ok := layerLogs[desc.Digest]; ok && len(layerLog) > 0 {
-			layerOpts[desc.Digest] = []estargz.Option{estargz.WithPrioritizedFiles(layerLog)}
+			if clicontext.Bool("estargz-auto-chunk-size") {
+				layerOpts[desc.Digest] = []estargz.Option{estargz.WithAccessTrace(layerLog)}
+			} else {
+				layerOpts[desc.Digest] = []estargz.Option{estargz.WithPrioritizedFiles(layerLog)}
+			}
 		} else if clicontext.Bool("reuse") && isReusableESGZLayer(ctx, desc, cs) {
 			excludes = append(excludes, desc.Digest) // reuse layer without conversion
 		}
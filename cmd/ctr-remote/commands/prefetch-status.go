@@ -0,0 +1,332 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/containerd/log"
+	stargzfs "github.com/containerd/stargz-snapshotter/fs"
+	"github.com/distribution/reference"
+	"github.com/urfave/cli/v2"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// PrefetchStatusCommand summarizes how much of an image is cached across the nodes by querying
+// the locality API of the snapshotter on each node.
+var PrefetchStatusCommand = &cli.Command{
+	Name:      "prefetch-status",
+	Usage:     "summarize how much of an image is cached across nodes",
+	ArgsUsage: "<ref>",
+	Description: `Queries the locality API ("locality_address" in the configuration of the snapshotter) of
+each node in parallel and summarizes how much of the image is cached across the nodes, e.g. to
+judge whether a rollout of the image is ready. The nodes are specified with --nodes or listed from
+the Kubernetes API with --kubeconfig. Specify the image by the digest of the manifest (e.g.
+"ghcr.io/org/app@sha256:...") to tell apart the images pushed to the same tag.`,
+	Flags: []cli.Flag{
+		&cli.StringSliceFlag{
+			Name:  "nodes",
+			Usage: "hosts of the nodes to query (comma-separated)",
+		},
+		&cli.StringFlag{
+			Name:  "kubeconfig",
+			Usage: "list the nodes to query from the Kubernetes API using this kubeconfig",
+		},
+		&cli.StringFlag{
+			Name:  "node-selector",
+			Usage: "label selector of the nodes listed from the Kubernetes API (e.g. \"pool=gpu\")",
+		},
+		&cli.StringFlag{
+			Name:  "locality-url",
+			Usage: "URL of the locality API of the snapshotter on the nodes. %s is replaced with the host of the node",
+			Value: "http://%s:8235/locality",
+		},
+		&cli.DurationFlag{
+			Name:  "timeout",
+			Usage: "timeout of querying each node",
+			Value: 5 * time.Second,
+		},
+		&cli.IntFlag{
+			Name:  "max-concurrency",
+			Usage: "max number of the nodes queried in parallel",
+			Value: 32,
+		},
+		&cli.BoolFlag{
+			Name:  "json",
+			Usage: "show the status in JSON",
+		},
+	},
+	Action: func(clicontext *cli.Context) error {
+		ref := clicontext.Args().First()
+		if ref == "" {
+			return fmt.Errorf("image reference must be specified")
+		}
+		named, err := reference.ParseDockerRef(ref)
+		if err != nil {
+			return fmt.Errorf("invalid reference %q: %w", ref, err)
+		}
+		if !strings.Contains(clicontext.String("locality-url"), "%s") {
+			return fmt.Errorf("locality-url must contain %%s")
+		}
+		ctx := context.Background()
+		nodes, err := listNodes(ctx, clicontext.StringSlice("nodes"), clicontext.String("kubeconfig"), clicontext.String("node-selector"))
+		if err != nil {
+			return err
+		}
+		if len(nodes) == 0 {
+			return fmt.Errorf("no node to query; specify --nodes or --kubeconfig")
+		}
+		q := &localityQuerier{
+			client:   &http.Client{Timeout: clicontext.Duration("timeout")},
+			urlTmpl:  clicontext.String("locality-url"),
+			workers:  max(clicontext.Int("max-concurrency"), 1),
+			imageRef: named,
+		}
+		status := summarizePrefetchStatus(named.String(), q.query(ctx, nodes))
+		if clicontext.Bool("json") {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			return enc.Encode(status)
+		}
+		return status.print(os.Stdout)
+	},
+}
+
+// prefetchStatusNode is a node to query.
+type prefetchStatusNode struct {
+	name string // name shown in the status
+	host string // host of the locality API
+}
+
+// listNodes returns the nodes specified by the hosts and the nodes listed from the Kubernetes
+// API if kubeconfig is specified. Nodes listed from the Kubernetes API are queried at their
+// internal IP addresses, or their names if they don't have one.
+func listNodes(ctx context.Context, hosts []string, kubeconfig, selector string) ([]prefetchStatusNode, error) {
+	var nodes []prefetchStatusNode
+	for _, h := range hosts {
+		if h = strings.TrimSpace(h); h != "" {
+			nodes = append(nodes, prefetchStatusNode{name: h, host: h})
+		}
+	}
+	if kubeconfig == "" {
+		return nodes, nil
+	}
+	cfg, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load kubeconfig %q: %w", kubeconfig, err)
+	}
+	client, err := kubernetes.NewForConfig(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Kubernetes client: %w", err)
+	}
+	list, err := client.CoreV1().Nodes().List(ctx, metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list nodes: %w", err)
+	}
+	for _, n := range list.Items {
+		host := n.Name
+		for _, a := range n.Status.Addresses {
+			if a.Type == corev1.NodeInternalIP {
+				host = a.Address
+				break
+			}
+		}
+		nodes = append(nodes, prefetchStatusNode{name: n.Name, host: host})
+	}
+	return nodes, nil
+}
+
+// localityQuerier queries the locality API of the nodes for the images of imageRef.
+type localityQuerier struct {
+	client   *http.Client
+	urlTmpl  string
+	workers  int
+	imageRef reference.Named
+}
+
+// nodePrefetchStatus is the cache state of the image on a node.
+type nodePrefetchStatus struct {
+	// Node is the name of the node.
+	Node string `json:"node"`
+
+	// Images are the images of the reference mounted on the node. Several images are
+	// reported if the tag has pointed to different manifests.
+	Images []stargzfs.ImageLocality `json:"images,omitempty"`
+
+	// Error is the error of querying the node.
+	Error string `json:"error,omitempty"`
+}
+
+// cachedRatio returns the highest cached ratio of the images on the node.
+func (s nodePrefetchStatus) cachedRatio() (ratio float64) {
+	for _, img := range s.Images {
+		ratio = max(ratio, img.CachedRatio)
+	}
+	return ratio
+}
+
+// query queries the nodes in parallel. The statuses are in the order of the nodes.
+func (q *localityQuerier) query(ctx context.Context, nodes []prefetchStatusNode) []nodePrefetchStatus {
+	res := make([]nodePrefetchStatus, len(nodes))
+	sem := make(chan struct{}, q.workers)
+	var wg sync.WaitGroup
+	for i, n := range nodes {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			res[i].Node = n.name
+			images, err := q.queryNode(ctx, n.host)
+			if err != nil {
+				log.G(ctx).WithError(err).Debugf("failed to query node %q", n.name)
+				res[i].Error = err.Error()
+				return
+			}
+			res[i].Images = images
+		}()
+	}
+	wg.Wait()
+	return res
+}
+
+// queryNode returns the images of the reference mounted on the node.
+func (q *localityQuerier) queryNode(ctx context.Context, host string) ([]stargzfs.ImageLocality, error) {
+	u := fmt.Sprintf(q.urlTmpl, host)
+	digested, isDigested := q.imageRef.(reference.Digested)
+	if isDigested {
+		u += "?" + url.Values{"digest": {digested.Digest().String()}}.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := q.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("unexpected status %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	var images []stargzfs.ImageLocality
+	if err := json.NewDecoder(resp.Body).Decode(&images); err != nil {
+		return nil, fmt.Errorf("failed to decode the locality: %w", err)
+	}
+	if isDigested {
+		return images, nil
+	}
+	var matched []stargzfs.ImageLocality
+	for _, img := range images {
+		for _, r := range img.Refs {
+			if named, err := reference.ParseDockerRef(r); err == nil && named.String() == q.imageRef.String() {
+				matched = append(matched, img)
+				break
+			}
+		}
+	}
+	return matched, nil
+}
+
+// prefetchStatus is the cache state of an image across the nodes.
+type prefetchStatus struct {
+	// Ref is the reference of the image.
+	Ref string `json:"ref"`
+
+	// Nodes is the number of the nodes queried.
+	Nodes int `json:"nodes"`
+
+	// Unreachable is the number of the nodes failed to be queried.
+	Unreachable int `json:"unreachable"`
+
+	// Mounted is the number of the nodes mounting the image.
+	Mounted int `json:"mounted"`
+
+	// FullyCached is the number of the nodes caching the whole image.
+	FullyCached int `json:"fully_cached"`
+
+	// MeanCachedRatio is the mean of the cached ratio of the image over the reachable nodes.
+	// The ratio of the nodes not mounting the image is 0.
+	MeanCachedRatio float64 `json:"mean_cached_ratio"`
+
+	// NodeStatuses are the states of the image on the nodes.
+	NodeStatuses []nodePrefetchStatus `json:"node_statuses"`
+}
+
+func summarizePrefetchStatus(ref string, nodes []nodePrefetchStatus) prefetchStatus {
+	s := prefetchStatus{Ref: ref, Nodes: len(nodes), NodeStatuses: nodes}
+	var sum float64
+	for _, n := range nodes {
+		if n.Error != "" {
+			s.Unreachable++
+			continue
+		}
+		if len(n.Images) == 0 {
+			continue
+		}
+		s.Mounted++
+		ratio := n.cachedRatio()
+		if ratio >= 1 {
+			s.FullyCached++
+		}
+		sum += ratio
+	}
+	if reachable := s.Nodes - s.Unreachable; reachable > 0 {
+		s.MeanCachedRatio = sum / float64(reachable)
+	}
+	return s
+}
+
+// print shows the status as a table of the nodes followed by the summary.
+func (s prefetchStatus) print(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "NODE\tIMAGE\tCACHED\tSIZE\tRATIO\t")
+	for _, n := range s.NodeStatuses {
+		switch {
+		case n.Error != "":
+			fmt.Fprintf(tw, "%s\t-\t-\t-\t-\t(error: %s)\n", n.Node, n.Error)
+		case len(n.Images) == 0:
+			fmt.Fprintf(tw, "%s\t-\t0\t-\t0.0%%\t(not mounted)\n", n.Node)
+		default:
+			for _, img := range n.Images {
+				fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%.1f%%\t\n", n.Node, img.Digest, img.CachedSize, img.Size, img.CachedRatio*100)
+			}
+		}
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, "\n%s: mounted on %d/%d nodes, fully cached on %d, mean cached ratio %.1f%%, %d unreachable\n",
+		s.Ref, s.Mounted, s.Nodes, s.FullyCached, s.MeanCachedRatio*100, s.Unreachable)
+	return err
+}
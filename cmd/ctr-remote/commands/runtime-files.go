@@ -0,0 +1,148 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+
+	"github.com/containerd/containerd/v2/pkg/oci"
+	runtimespec "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// memoryTempDir is a memory-backed directory where the runtime files are written if it exists.
+const memoryTempDir = "/dev/shm"
+
+// defaultRuntimeFileMode is the mode of the runtime files unless specified.
+const defaultRuntimeFileMode = 0644
+
+// runtimeFile is a synthetic file injected into the sample container (e.g. /etc/resolv.conf
+// or a placeholder of a secret) so the application reaches its real hot paths during the
+// sampling. The file is mounted read-only and isn't a part of the image so reads of it aren't
+// recorded.
+type runtimeFile struct {
+	// Path is the absolute path of the file in the container.
+	Path string `json:"path"`
+
+	// Content is the content of the file. This can't be specified with Source.
+	Content string `json:"content,omitempty"`
+
+	// Source is the path of the file on the host whose content is copied. This can't be
+	// specified with Content.
+	Source string `json:"source,omitempty"`
+
+	// Mode is the permission bits of the file in octal (e.g. "0600"). Default is "0644".
+	Mode string `json:"mode,omitempty"`
+}
+
+// loadRuntimeFiles reads the runtime files from the JSON array in the config file.
+func loadRuntimeFiles(configPath string) ([]runtimeFile, error) {
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return nil, err
+	}
+	var files []runtimeFile
+	if err := json.Unmarshal(data, &files); err != nil {
+		return nil, fmt.Errorf("failed to parse runtime files: %w", err)
+	}
+	seen := make(map[string]bool)
+	for i, f := range files {
+		if !path.IsAbs(f.Path) || path.Clean(f.Path) == "/" {
+			return nil, fmt.Errorf("path of runtime file %q must be an absolute path of a file", f.Path)
+		}
+		files[i].Path = path.Clean(f.Path)
+		if seen[files[i].Path] {
+			return nil, fmt.Errorf("runtime file %q is specified more than once", f.Path)
+		}
+		seen[files[i].Path] = true
+		if f.Content != "" && f.Source != "" {
+			return nil, fmt.Errorf("runtime file %q can't have both content and source", f.Path)
+		}
+		if _, err := f.mode(); err != nil {
+			return nil, fmt.Errorf("invalid mode of runtime file %q: %w", f.Path, err)
+		}
+	}
+	return files, nil
+}
+
+func (f runtimeFile) mode() (os.FileMode, error) {
+	if f.Mode == "" {
+		return defaultRuntimeFileMode, nil
+	}
+	m, err := strconv.ParseUint(f.Mode, 8, 32)
+	if err != nil {
+		return 0, err
+	}
+	if m&^uint64(os.ModePerm) != 0 {
+		return 0, fmt.Errorf("%q has bits other than the permission bits", f.Mode)
+	}
+	return os.FileMode(m), nil
+}
+
+// withRuntimeFiles writes the runtime files listed in the config file to a temporary directory
+// (memory-backed if possible) and bind-mounts them read-only into the container. The files
+// are removed by cleanup.
+func withRuntimeFiles(configPath string) (specOpt oci.SpecOpts, cleanup func() error, rErr error) {
+	files, err := loadRuntimeFiles(configPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	tmpRoot := ""
+	if fi, err := os.Stat(memoryTempDir); err == nil && fi.IsDir() {
+		tmpRoot = memoryTempDir
+	}
+	dir, err := os.MkdirTemp(tmpRoot, "runtimefiles")
+	if err != nil {
+		return nil, nil, err
+	}
+	cleanup = func() error { return os.RemoveAll(dir) }
+	defer func() {
+		if rErr != nil {
+			if err := cleanup(); err != nil {
+				rErr = fmt.Errorf("failed to cleanup: %w", rErr)
+			}
+		}
+	}()
+	var mounts []runtimespec.Mount
+	for i, f := range files {
+		content := []byte(f.Content)
+		if f.Source != "" {
+			if content, err = os.ReadFile(f.Source); err != nil {
+				return nil, nil, fmt.Errorf("failed to read source of runtime file %q: %w", f.Path, err)
+			}
+		}
+		mode, _ := f.mode() // validated on load
+		p := filepath.Join(dir, strconv.Itoa(i))
+		if err := os.WriteFile(p, content, mode); err != nil {
+			return nil, nil, fmt.Errorf("failed to write runtime file %q: %w", f.Path, err)
+		}
+		if err := os.Chmod(p, mode); err != nil { // not masked by umask
+			return nil, nil, fmt.Errorf("failed to change mode of runtime file %q: %w", f.Path, err)
+		}
+		mounts = append(mounts, runtimespec.Mount{
+			Destination: f.Path,
+			Type:        "bind",
+			Source:      p,
+			Options:     []string{"bind", "ro"},
+		})
+	}
+	return oci.WithMounts(mounts), cleanup, nil
+}
@@ -0,0 +1,124 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/containerd/containerd/v2/cmd/ctr/commands"
+	"github.com/containerd/containerd/v2/core/content"
+	"github.com/containerd/containerd/v2/pkg/labels"
+	"github.com/containerd/errdefs"
+	"github.com/containerd/stargz-snapshotter/estargz"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/urfave/cli/v2"
+)
+
+// SquashLayersCommand merges eStargz layers into one eStargz layer
+var SquashLayersCommand = &cli.Command{
+	Name:      "squash-layers",
+	Usage:     "merge eStargz layers into one eStargz layer in the content store",
+	ArgsUsage: "<layer digest> [<layer digest>...]",
+	Description: `Merges eStargz layers into one eStargz layer with applying whiteouts.
+Layers must be ordered from the lowest to the uppermost.
+The chunk boundaries and the prioritized files of the source layers are kept so the
+squashed layer remains lazily pullable.
+The digest of the squashed layer is printed.`,
+	Flags: []cli.Flag{
+		&cli.IntFlag{
+			Name:  "estargz-compression-level",
+			Usage: "eStargz compression level",
+			Value: 9,
+		},
+		&cli.IntFlag{
+			Name:  "estargz-min-chunk-size",
+			Usage: "The minimal number of bytes of data must be written in one gzip stream",
+			Value: 0,
+		},
+	},
+	Action: func(clicontext *cli.Context) error {
+		if clicontext.NArg() == 0 {
+			return errors.New("layer digests need to be specified")
+		}
+
+		client, ctx, cancel, err := commands.NewClient(clicontext)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+
+		cs := client.ContentStore()
+		var layers []*io.SectionReader
+		for _, s := range clicontext.Args().Slice() {
+			dgst, err := digest.Parse(s)
+			if err != nil {
+				return err
+			}
+			ra, err := cs.ReaderAt(ctx, ocispec.Descriptor{Digest: dgst})
+			if err != nil {
+				return err
+			}
+			defer ra.Close()
+			layers = append(layers, io.NewSectionReader(ra, 0, ra.Size()))
+		}
+
+		blob, err := estargz.Squash(layers,
+			estargz.WithCompressionLevel(clicontext.Int("estargz-compression-level")),
+			estargz.WithMinChunkSize(clicontext.Int("estargz-min-chunk-size")),
+			estargz.WithContext(ctx),
+		)
+		if err != nil {
+			return fmt.Errorf("failed to squash layers: %w", err)
+		}
+		defer blob.Close()
+
+		w, err := content.OpenWriter(ctx, cs, content.WithRef("squash-estargz-"+digest.FromString(fmt.Sprint(clicontext.Args().Slice())).Encoded()))
+		if err != nil {
+			return err
+		}
+		defer w.Close()
+		if err := w.Truncate(0); err != nil {
+			return err
+		}
+		n, err := io.Copy(w, blob)
+		if err != nil {
+			return err
+		}
+		if err := blob.Close(); err != nil {
+			return err
+		}
+		labelz := map[string]string{labels.LabelUncompressed: blob.DiffID().String()}
+		if err := w.Commit(ctx, n, "", content.WithLabels(labelz)); err != nil && !errdefs.IsAlreadyExists(err) {
+			return err
+		}
+
+		printLayer(clicontext.App.Writer, w.Digest(), n, blob)
+		return nil
+	},
+}
+
+// printLayer prints the digest, the size, the diffID and the TOC digest of the eStargz layer
+// written to the content store.
+func printLayer(w io.Writer, dgst digest.Digest, size int64, blob *estargz.Blob) {
+	fmt.Fprintf(w, "digest: %s\n", dgst)
+	fmt.Fprintf(w, "size: %d\n", size)
+	fmt.Fprintf(w, "diffID: %s\n", blob.DiffID())
+	fmt.Fprintf(w, "%s: %s\n", estargz.TOCJSONDigestAnnotation, blob.TOCDigest())
+}
@@ -0,0 +1,125 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+
+	"github.com/containerd/stargz-snapshotter/fs/tuning"
+	"github.com/urfave/cli/v2"
+)
+
+const defaultAdminAddress = "/run/containerd-stargz-grpc/admin.sock"
+
+// TuneCommand shows and changes the params of fetching layer contents of a running
+// snapshotter through its admin API.
+var TuneCommand = &cli.Command{
+	Name:  "tune",
+	Usage: "show and change the params of fetching layer contents of stargz snapshotter at runtime",
+	Description: `Shows the current params of fetching layer contents of a running snapshotter.
+If any of the flags are specified, the params are changed and the new params are shown.
+The changes are effective until the snapshotter restarts.
+The snapshotter needs to expose the admin API with "admin_address" in its configuration.`,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "address",
+			Usage: "address of the admin API of the snapshotter",
+			Value: defaultAdminAddress,
+		},
+		&cli.Int64Flag{
+			Name:  "max-concurrency",
+			Usage: "max number of concurrent background tasks for fetching layer contents",
+		},
+		&cli.Int64Flag{
+			Name:  "prefetch-chunk-size",
+			Usage: "maximum bytes transferred per http GET during prefetch. 0 means a single http GET",
+		},
+		&cli.Int64Flag{
+			Name:  "bandwidth-limit",
+			Usage: "maximum bytes per second fetched from remote registries. 0 means unlimited",
+		},
+		&cli.Int64Flag{
+			Name:  "background-bandwidth-limit",
+			Usage: "maximum bytes per second fetched by prefetch and background fetch. 0 means unlimited",
+		},
+	},
+	Action: func(clicontext *cli.Context) error {
+		addr := clicontext.String("address")
+		client := newAdminClient(addr)
+		var u tuning.Update
+		for name, f := range map[string]**int64{
+			"max-concurrency":            &u.MaxConcurrency,
+			"prefetch-chunk-size":        &u.PrefetchChunkSize,
+			"bandwidth-limit":            &u.BandwidthLimit,
+			"background-bandwidth-limit": &u.BackgroundBandwidthLimit,
+		} {
+			if clicontext.IsSet(name) {
+				v := clicontext.Int64(name)
+				*f = &v
+			}
+		}
+
+		const url = "http://admin/fetch"
+		var (
+			resp *http.Response
+			err  error
+		)
+		if u == (tuning.Update{}) {
+			resp, err = client.Get(url)
+		} else {
+			body, mErr := json.Marshal(u)
+			if mErr != nil {
+				return mErr
+			}
+			resp, err = client.Post(url, "application/json", bytes.NewReader(body))
+		}
+		if err != nil {
+			return fmt.Errorf("failed to access admin API %q: %w", addr, err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			msg, _ := io.ReadAll(resp.Body)
+			return fmt.Errorf("failed to tune (%s): %s", resp.Status, bytes.TrimSpace(msg))
+		}
+		var p tuning.Params
+		if err := json.NewDecoder(resp.Body).Decode(&p); err != nil {
+			return fmt.Errorf("failed to decode params: %w", err)
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(p)
+	},
+}
+
+// newAdminClient returns the client of the admin API served on the Unix domain socket.
+func newAdminClient(addr string) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", addr)
+			},
+		},
+	}
+}
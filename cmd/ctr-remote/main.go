@@ -23,6 +23,9 @@ import (
 	"github.com/containerd/containerd/v2/cmd/ctr/app"
 	"github.com/containerd/stargz-snapshotter/cmd/ctr-remote/commands"
 	"github.com/urfave/cli/v2"
+
+	// Register the verifier of blake3 chunk digests.
+	_ "github.com/containerd/stargz-snapshotter/cmd/containerd-stargz-grpc/blake3"
 )
 
 func main() {
@@ -31,7 +34,10 @@ func main() {
 		commands.OptimizeCommand,
 		commands.ConvertCommand,
 		commands.GetTOCDigestCommand,
+		commands.SquashLayersCommand,
+		commands.DeltaLayerCommand,
 		commands.IPFSPushCommand,
+		commands.PrefetchStatusCommand,
 	}
 	app := app.New()
 	for i := range app.Commands {
@@ -58,7 +64,7 @@ func main() {
 			break
 		}
 	}
-	app.Commands = append(app.Commands, commands.FanotifyCommand)
+	app.Commands = append(app.Commands, commands.FanotifyCommand, commands.CacheCommand, commands.TuneCommand, commands.MountsCommand)
 	if err := app.Run(os.Args); err != nil {
 		fmt.Fprintf(os.Stderr, "ctr-remote: %v\n", err)
 		os.Exit(1)
@@ -29,6 +29,9 @@ import (
 	"github.com/containerd/stargz-snapshotter/service"
 	"github.com/containerd/stargz-snapshotter/service/keychain/keychainconfig"
 	"google.golang.org/grpc"
+
+	// Register the verifier of blake3 chunk digests.
+	_ "github.com/containerd/stargz-snapshotter/cmd/containerd-stargz-grpc/blake3"
 )
 
 func init() {
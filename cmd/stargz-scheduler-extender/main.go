@@ -0,0 +1,326 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// stargz-scheduler-extender is a sample scheduler extender of Kubernetes preferring the
+// nodes where Stargz Snapshotter has fetched the layers of the images of the pod. The
+// preference of each image is weighted by the prefetch coverage of the image
+// (estargz.PrefetchCoverageAnnotation) because the larger part of the image needs to be
+// fetched before the container starts, the more the container benefits from the cache.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/v2/core/images"
+	"github.com/containerd/containerd/v2/core/remotes"
+	"github.com/containerd/containerd/v2/core/remotes/docker"
+	"github.com/containerd/log"
+	"github.com/containerd/platforms"
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/distribution/reference"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+)
+
+const (
+	// maxScore is the maximum score of nodes returned to the scheduler (MaxExtenderPriority).
+	maxScore = 10
+
+	// fetchedSizeMetric is the metric of the size of the layer fetched by the snapshotter.
+	fetchedSizeMetric = "stargz_fs_layer_fetched_size_bytes"
+
+	// maxManifestSize is the maximum size of the manifests read from the registry.
+	maxManifestSize = 4 << 20
+
+	// imageCacheTTL is the duration the manifests of images are cached.
+	imageCacheTTL = 10 * time.Minute
+)
+
+var (
+	address    = flag.String("address", ":8888", "address to serve the extender API")
+	metricsURL = flag.String("metrics-url", "http://%s:8234/metrics", "URL of the metrics of the snapshotter on the node (metrics_address). %s is replaced with the node name")
+	plainHTTP  = flag.Bool("plain-http", false, "access registries with plain HTTP")
+	platform   = flag.String("platform", platforms.DefaultString(), "platform of the images")
+)
+
+// extenderArgs is the part of ExtenderArgs of the scheduler extender API used by this extender.
+type extenderArgs struct {
+	Pod struct {
+		Spec struct {
+			Containers     []container `json:"containers"`
+			InitContainers []container `json:"initContainers"`
+		} `json:"spec"`
+	} `json:"pod"`
+	Nodes *struct {
+		Items []struct {
+			Metadata struct {
+				Name string `json:"name"`
+			} `json:"metadata"`
+		} `json:"items"`
+	} `json:"nodes,omitempty"`
+	NodeNames *[]string `json:"nodenames,omitempty"`
+}
+
+type container struct {
+	Image string `json:"image"`
+}
+
+// hostPriority is HostPriority of the scheduler extender API.
+type hostPriority struct {
+	Host  string `json:"host"`
+	Score int64  `json:"score"`
+}
+
+// imageInfo is the layers and the prefetch coverage of an image.
+type imageInfo struct {
+	layers   []ocispec.Descriptor
+	coverage float64
+	expires  time.Time
+}
+
+type extender struct {
+	metricsURL   string
+	client       *http.Client
+	resolveImage func(ctx context.Context, ref string) (*imageInfo, error)
+
+	mu     sync.Mutex
+	images map[string]*imageInfo
+}
+
+func main() {
+	flag.Parse()
+	p, err := platforms.Parse(*platform)
+	if err != nil {
+		log.L.WithError(err).Fatalf("invalid platform %q", *platform)
+	}
+	e := &extender{
+		metricsURL:   *metricsURL,
+		client:       &http.Client{Timeout: 5 * time.Second},
+		resolveImage: registryResolver(*plainHTTP, platforms.Only(p)),
+		images:       make(map[string]*imageInfo),
+	}
+	http.HandleFunc("/prioritize", e.servePrioritize)
+	log.L.Infof("serving scheduler extender on %q", *address)
+	if err := http.ListenAndServe(*address, nil); err != nil {
+		log.L.WithError(err).Fatal("failed to serve")
+	}
+}
+
+func (e *extender) servePrioritize(w http.ResponseWriter, r *http.Request) {
+	var args extenderArgs
+	if err := json.NewDecoder(r.Body).Decode(&args); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var nodes []string
+	if args.NodeNames != nil {
+		nodes = *args.NodeNames
+	} else if args.Nodes != nil {
+		for _, n := range args.Nodes.Items {
+			nodes = append(nodes, n.Metadata.Name)
+		}
+	}
+	var refs []string
+	for _, c := range append(args.Pod.Spec.InitContainers, args.Pod.Spec.Containers...) {
+		refs = append(refs, c.Image)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(e.prioritize(r.Context(), refs, nodes)); err != nil {
+		log.G(r.Context()).WithError(err).Warn("failed to write response")
+	}
+}
+
+// prioritize scores the nodes by the fraction of the layers of the images fetched on the
+// nodes weighted by the prefetch coverage of the images.
+func (e *extender) prioritize(ctx context.Context, refs []string, nodes []string) []hostPriority {
+	var imgs []*imageInfo
+	for _, ref := range refs {
+		img, err := e.image(ctx, ref)
+		if err != nil {
+			log.G(ctx).WithError(err).Warnf("failed to resolve image %q", ref)
+			continue
+		}
+		imgs = append(imgs, img)
+	}
+	res := make([]hostPriority, len(nodes))
+	var wg sync.WaitGroup
+	for i, node := range nodes {
+		res[i].Host = node
+		if len(imgs) == 0 {
+			continue
+		}
+		wg.Go(func() {
+			fetched, err := e.fetchedLayers(ctx, node)
+			if err != nil {
+				log.G(ctx).WithError(err).Warnf("failed to get metrics of node %q", node)
+				return
+			}
+			var score float64
+			for _, img := range imgs {
+				var size, cached int64
+				for _, l := range img.layers {
+					size += l.Size
+					cached += min(fetched[l.Digest], l.Size)
+				}
+				if size > 0 {
+					score += img.coverage * float64(cached) / float64(size)
+				}
+			}
+			res[i].Score = int64(math.Round(maxScore * score / float64(len(imgs))))
+		})
+	}
+	wg.Wait()
+	return res
+}
+
+// image returns the image of the reference, cached for imageCacheTTL.
+func (e *extender) image(ctx context.Context, ref string) (*imageInfo, error) {
+	e.mu.Lock()
+	img, ok := e.images[ref]
+	e.mu.Unlock()
+	if ok && time.Now().Before(img.expires) {
+		return img, nil
+	}
+	img, err := e.resolveImage(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	img.expires = time.Now().Add(imageCacheTTL)
+	e.mu.Lock()
+	e.images[ref] = img
+	e.mu.Unlock()
+	return img, nil
+}
+
+// fetchedLayers returns the sizes of the layers fetched on the node, reported by the
+// metrics of the snapshotter.
+func (e *extender) fetchedLayers(ctx context.Context, node string) (map[digest.Digest]int64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf(e.metricsURL, node), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %q", resp.Status)
+	}
+	parser := expfmt.NewTextParser(model.UTF8Validation)
+	families, err := parser.TextToMetricFamilies(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse metrics: %w", err)
+	}
+	fetched := make(map[digest.Digest]int64)
+	if mf, ok := families[fetchedSizeMetric]; ok {
+		for _, m := range mf.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "digest" {
+					dgst := digest.Digest(l.GetValue())
+					fetched[dgst] = max(fetched[dgst], int64(metricValue(m)))
+				}
+			}
+		}
+	}
+	return fetched, nil
+}
+
+func metricValue(m *dto.Metric) float64 {
+	switch {
+	case m.Counter != nil:
+		return m.GetCounter().GetValue()
+	case m.Gauge != nil:
+		return m.GetGauge().GetValue()
+	}
+	return m.GetUntyped().GetValue()
+}
+
+// registryResolver returns the function reading the manifest of the image of the platform
+// from the registry.
+func registryResolver(plainHTTP bool, platform platforms.MatchComparer) func(ctx context.Context, ref string) (*imageInfo, error) {
+	hostOpts := docker.WithPlainHTTP(docker.MatchLocalhost)
+	if plainHTTP {
+		hostOpts = docker.WithPlainHTTP(func(string) (bool, error) { return true, nil })
+	}
+	resolver := docker.NewResolver(docker.ResolverOptions{Hosts: docker.ConfigureDefaultRegistries(hostOpts)})
+	return func(ctx context.Context, ref string) (*imageInfo, error) {
+		named, err := reference.ParseDockerRef(ref)
+		if err != nil {
+			return nil, err
+		}
+		name, desc, err := resolver.Resolve(ctx, named.String())
+		if err != nil {
+			return nil, err
+		}
+		fetcher, err := resolver.Fetcher(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		if images.IsIndexType(desc.MediaType) {
+			var index ocispec.Index
+			if err := fetchJSON(ctx, fetcher, desc, &index); err != nil {
+				return nil, err
+			}
+			var found bool
+			for _, m := range index.Manifests {
+				if m.Platform != nil && platform.Match(*m.Platform) {
+					desc, found = m, true
+					break
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("no manifest of the platform in %q", ref)
+			}
+		}
+		var manifest ocispec.Manifest
+		if err := fetchJSON(ctx, fetcher, desc, &manifest); err != nil {
+			return nil, err
+		}
+		img := &imageInfo{layers: manifest.Layers}
+		if c, err := estargz.ParsePrefetchCoverage(manifest.Annotations[estargz.PrefetchCoverageAnnotation]); err == nil {
+			img.coverage = c.Ratio()
+		}
+		return img, nil
+	}
+}
+
+func fetchJSON(ctx context.Context, fetcher remotes.Fetcher, desc ocispec.Descriptor, v any) error {
+	rc, err := fetcher.Fetch(ctx, desc)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	b, err := io.ReadAll(io.LimitReader(rc, maxManifestSize))
+	if err != nil {
+		return err
+	}
+	if desc.Digest.Validate() == nil && digest.FromBytes(b) != desc.Digest {
+		return fmt.Errorf("digest of %s doesn't match", desc.Digest)
+	}
+	return json.Unmarshal(b, v)
+}
@@ -0,0 +1,83 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestPrioritize(t *testing.T) {
+	var (
+		layerA = digest.FromString("a")
+		layerB = digest.FromString("b")
+	)
+	metrics := map[string]string{
+		// all layers are fetched
+		"full": fmt.Sprintf("stargz_fs_layer_fetched_size_bytes{digest=%q,mountpoint=\"/a\"} 100\n"+
+			"stargz_fs_layer_fetched_size_bytes{digest=%q,mountpoint=\"/b\"} 300\n", layerA, layerB),
+		// half of the layers are fetched
+		"half": fmt.Sprintf("stargz_fs_layer_fetched_size_bytes{digest=%q,mountpoint=\"/b\"} 200\n", layerB),
+		// no layer is fetched
+		"none": "stargz_fs_layer_fetched_size_bytes{digest=\"sha256:0\",mountpoint=\"/c\"} 100\n",
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m, ok := metrics[strings.TrimPrefix(r.URL.Path, "/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, "# TYPE stargz_fs_layer_fetched_size_bytes gauge\n"+m)
+	}))
+	defer srv.Close()
+
+	resolved := 0
+	e := &extender{
+		metricsURL: srv.URL + "/%s",
+		client:     srv.Client(),
+		resolveImage: func(ctx context.Context, ref string) (*imageInfo, error) {
+			resolved++
+			if ref != "example.com/image" {
+				return nil, fmt.Errorf("unknown image %q", ref)
+			}
+			return &imageInfo{
+				layers:   []ocispec.Descriptor{{Digest: layerA, Size: 100}, {Digest: layerB, Size: 300}},
+				coverage: 0.8,
+			}, nil
+		},
+		images: make(map[string]*imageInfo),
+	}
+	got := e.prioritize(context.Background(), []string{"example.com/image", "example.com/unknown"},
+		[]string{"full", "half", "none", "unreachable"})
+	want := []hostPriority{{"full", 8}, {"half", 4}, {"none", 0}, {"unreachable", 0}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected scores %+v; want %+v", got, want)
+	}
+
+	e.prioritize(context.Background(), []string{"example.com/image"}, []string{"full"})
+	if resolved != 2 {
+		t.Errorf("image must be cached; resolved %d times", resolved)
+	}
+}
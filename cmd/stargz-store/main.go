@@ -17,25 +17,19 @@
 package main
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
-	"errors"
 	"flag"
 	"fmt"
 	"io"
 	golog "log"
-	"maps"
 	"math/rand"
 	"net"
 	"os"
 	"os/signal"
 	"path/filepath"
-	"sync"
 	"syscall"
 	"time"
 
-	"github.com/containerd/containerd/v2/pkg/reference"
 	"github.com/containerd/log"
 	dbmetadata "github.com/containerd/stargz-snapshotter/cmd/containerd-stargz-grpc/db"
 	"github.com/containerd/stargz-snapshotter/fs/config"
@@ -49,6 +43,9 @@ import (
 	"github.com/pelletier/go-toml"
 	bolt "go.etcd.io/bbolt"
 	grpc "google.golang.org/grpc"
+
+	// Register the verifier of blake3 chunk digests.
+	_ "github.com/containerd/stargz-snapshotter/cmd/containerd-stargz-grpc/blake3"
 )
 
 const (
@@ -117,12 +114,12 @@ func main() {
 		}
 	}
 
-	sk := new(storeKeychain)
+	sk := new(store.Keychain)
 
 	errCh := serveController(*listenaddr, sk)
 
 	// Prepare kubeconfig-based keychain if required
-	credsFuncs := []resolver.Credential{sk.credentials}
+	credsFuncs := []resolver.Credential{sk.Credentials}
 	if config.EnableKeychain {
 		var opts []kubeconfig.Option
 		if kcp := config.KubeconfigPath; kcp != "" {
@@ -217,67 +214,11 @@ func getMetadataStore(rootDir string, config Config) (metadata.Store, error) {
 	}
 }
 
-func newController(addCredentialFunc func(data []byte) error) *controller {
-	return &controller{
-		addCredentialFunc: addCredentialFunc,
-	}
-}
-
-type controller struct {
-	addCredentialFunc func(data []byte) error
-}
-
-func (c *controller) AddCredential(ctx context.Context, req *pb.AddCredentialRequest) (resp *pb.AddCredentialResponse, _ error) {
-	return &pb.AddCredentialResponse{}, c.addCredentialFunc(req.Data)
-}
-
-type authConfig struct {
-	Username      string `json:"username,omitempty"`
-	Password      string `json:"password,omitempty"`
-	IdentityToken string `json:"identityToken,omitempty"`
-}
-
-type storeKeychain struct {
-	config   map[string]authConfig
-	configMu sync.Mutex
-}
-
-func (sk *storeKeychain) add(data []byte) error {
-	conf := make(map[string]authConfig)
-	if err := json.NewDecoder(bytes.NewReader(data)).Decode(&conf); err != nil && !errors.Is(err, io.EOF) {
-		return err
-	}
-	sk.configMu.Lock()
-	if sk.config == nil {
-		sk.config = make(map[string]authConfig)
-	}
-	maps.Copy(sk.config, conf)
-	sk.configMu.Unlock()
-	return nil
-}
-
-func (sk *storeKeychain) credentials(host string, refspec reference.Spec) (string, string, error) {
-	if host != refspec.Hostname() {
-		return "", "", nil // Do not use creds for mirrors
-	}
-	sk.configMu.Lock()
-	defer sk.configMu.Unlock()
-	if acfg, ok := sk.config[refspec.String()]; ok {
-		if acfg.IdentityToken != "" {
-			return "", acfg.IdentityToken, nil
-		} else if acfg.Username != "" || acfg.Password != "" {
-			return acfg.Username, acfg.Password, nil
-		}
-	}
-	return "", "", nil
-}
-
-func serveController(addr string, sk *storeKeychain) <-chan error {
+func serveController(addr string, sk *store.Keychain) <-chan error {
 	// Try to remove the socket file to avoid EADDRINUSE
 	os.Remove(addr)
 	rpc := grpc.NewServer()
-	c := newController(sk.add)
-	pb.RegisterControllerServer(rpc, c)
+	pb.RegisterControllerServer(rpc, store.NewControllerServer(sk))
 	errCh := make(chan error, 1)
 	go func() {
 		l, err := net.Listen("unix", addr)
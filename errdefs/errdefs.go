@@ -0,0 +1,251 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package errdefs defines the kinds of errors of the filesystem, the remote blobs, the caches
+// and the metadata readers so callers can tell auth failures from corrupted contents and
+// timeouts without parsing messages.
+//
+// Errors carry their kind by wrapping one of the sentinels (e.g. fmt.Errorf("...: %w",
+// errdefs.ErrTimeout)) or by being created with New or WithKind. Errors from the standard
+// library are classified as well (e.g. context.DeadlineExceeded is a timeout).
+//
+// Each kind is mapped to the errno returned to FUSE and whether the operation can be retried.
+// The latter decides the retries of the chunk sources, of the requests to the registries and
+// of the broken transfers of the remote blobs:
+//
+//	Kind          Errno         Retryable  Example
+//	unknown       EIO           no
+//	not found     EIO           no         blob or chunk doesn't exist in the source
+//	unauthorized  EACCES        no         registry denied the credentials
+//	corrupted     EBADMSG       no         contents don't match the digest
+//	timeout       ETIMEDOUT     yes        fetch timed out
+//	unavailable   EHOSTUNREACH  yes        registry is in outage or returned 5xx
+//	canceled      EINTR         no         FUSE request is interrupted
+//	unsupported   EOPNOTSUPP    no         layer format is disabled
+//	invalid       EIO           no         layer or metadata is malformed
+package errdefs
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+)
+
+// Kind is the kind of an error.
+type Kind int
+
+const (
+	KindUnknown Kind = iota
+	KindNotFound
+	KindUnauthorized
+	KindCorrupted
+	KindTimeout
+	KindUnavailable
+	KindCanceled
+	KindUnsupported
+	KindInvalid
+)
+
+var kinds = []struct {
+	name      string
+	errno     syscall.Errno
+	retryable bool
+}{
+	KindUnknown:      {"unknown", syscall.EIO, false},
+	KindNotFound:     {"not found", syscall.EIO, false},
+	KindUnauthorized: {"unauthorized", syscall.EACCES, false},
+	KindCorrupted:    {"corrupted", syscall.EBADMSG, false},
+	KindTimeout:      {"timeout", syscall.ETIMEDOUT, true},
+	KindUnavailable:  {"unavailable", syscall.EHOSTUNREACH, true},
+	KindCanceled:     {"canceled", syscall.EINTR, false},
+	KindUnsupported:  {"unsupported", syscall.EOPNOTSUPP, false},
+	KindInvalid:      {"invalid", syscall.EIO, false},
+}
+
+func (k Kind) String() string {
+	if k < 0 || int(k) >= len(kinds) {
+		return kinds[KindUnknown].name
+	}
+	return kinds[k].name
+}
+
+// Errno returns the errno returned to FUSE for errors of the kind.
+func (k Kind) Errno() syscall.Errno {
+	if k < 0 || int(k) >= len(kinds) {
+		return kinds[KindUnknown].errno
+	}
+	return kinds[k].errno
+}
+
+// Retryable returns true if operations failed with errors of the kind can succeed on retry.
+func (k Kind) Retryable() bool {
+	if k < 0 || int(k) >= len(kinds) {
+		return false
+	}
+	return kinds[k].retryable
+}
+
+// Sentinels of the kinds. errors.Is reports whether an error is of the kind.
+var (
+	ErrNotFound     error = &kindError{KindNotFound, "not found"}
+	ErrUnauthorized error = &kindError{KindUnauthorized, "unauthorized"}
+	ErrCorrupted    error = &kindError{KindCorrupted, "corrupted"}
+	ErrTimeout      error = &kindError{KindTimeout, "timeout"}
+	ErrUnavailable  error = &kindError{KindUnavailable, "unavailable"}
+	ErrCanceled     error = &kindError{KindCanceled, "canceled"}
+	ErrUnsupported  error = &kindError{KindUnsupported, "unsupported"}
+	ErrInvalid      error = &kindError{KindInvalid, "invalid"}
+)
+
+func sentinel(k Kind) error {
+	switch k {
+	case KindNotFound:
+		return ErrNotFound
+	case KindUnauthorized:
+		return ErrUnauthorized
+	case KindCorrupted:
+		return ErrCorrupted
+	case KindTimeout:
+		return ErrTimeout
+	case KindUnavailable:
+		return ErrUnavailable
+	case KindCanceled:
+		return ErrCanceled
+	case KindUnsupported:
+		return ErrUnsupported
+	case KindInvalid:
+		return ErrInvalid
+	}
+	return nil
+}
+
+// kindError is an error of a kind. This matches the sentinel of the kind with errors.Is.
+type kindError struct {
+	kind Kind
+	msg  string
+}
+
+func (e *kindError) Error() string { return e.msg }
+
+func (e *kindError) Kind() Kind { return e.kind }
+
+func (e *kindError) Is(target error) bool {
+	return target == sentinel(e.kind)
+}
+
+// New returns an error of the kind with the message. This is useful for defining sentinels
+// of packages (e.g. ErrRegistryUnavailable of the remote blobs).
+func New(kind Kind, msg string) error {
+	return &kindError{kind, msg}
+}
+
+// wrappedError is an error with the kind of the error overridden.
+type wrappedError struct {
+	err  error
+	kind Kind
+}
+
+func (e *wrappedError) Error() string { return e.err.Error() }
+
+func (e *wrappedError) Unwrap() error { return e.err }
+
+func (e *wrappedError) Kind() Kind { return e.kind }
+
+func (e *wrappedError) Is(target error) bool {
+	return target == sentinel(e.kind)
+}
+
+// WithKind returns the error marked as the kind without changing the message. nil is returned
+// if err is nil.
+func WithKind(err error, kind Kind) error {
+	if err == nil {
+		return nil
+	}
+	return &wrappedError{err, kind}
+}
+
+// KindOf returns the kind of the error. The outermost kind in the chain of the error is
+// used. Errors without kinds are classified by well-known errors of the standard library.
+func KindOf(err error) Kind {
+	if err == nil {
+		return KindUnknown
+	}
+	var k interface{ Kind() Kind }
+	if errors.As(err, &k) {
+		return k.Kind()
+	}
+	var errno syscall.Errno
+	var netErr net.Error
+	switch {
+	case errors.Is(err, context.Canceled):
+		return KindCanceled
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, os.ErrDeadlineExceeded):
+		return KindTimeout
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return KindTimeout
+	case errors.Is(err, fs.ErrNotExist):
+		return KindNotFound
+	case errors.Is(err, fs.ErrPermission):
+		return KindUnauthorized
+	case errors.As(err, &errno):
+		switch errno {
+		case syscall.ETIMEDOUT:
+			return KindTimeout
+		case syscall.ECONNREFUSED, syscall.ECONNRESET, syscall.EHOSTUNREACH, syscall.ENETUNREACH:
+			return KindUnavailable
+		case syscall.EINTR:
+			return KindCanceled
+		case syscall.ENOTSUP:
+			return KindUnsupported
+		}
+	}
+	return KindUnknown
+}
+
+// Errno returns the errno returned to FUSE for the error. 0 is returned if err is nil.
+func Errno(err error) syscall.Errno {
+	if err == nil {
+		return 0
+	}
+	return KindOf(err).Errno()
+}
+
+// IsRetryable returns true if the operation failed with the error can succeed on retry.
+func IsRetryable(err error) bool {
+	return err != nil && KindOf(err).Retryable()
+}
+
+// KindOfHTTPStatus returns the kind of the failure indicated by the HTTP status code of a
+// response of a registry.
+func KindOfHTTPStatus(code int) Kind {
+	switch {
+	case code == http.StatusUnauthorized, code == http.StatusForbidden:
+		return KindUnauthorized
+	case code == http.StatusNotFound:
+		return KindNotFound
+	case code == http.StatusRequestTimeout, code == http.StatusGatewayTimeout:
+		return KindTimeout
+	case code == http.StatusTooManyRequests, code >= 500 && code != http.StatusNotImplemented:
+		return KindUnavailable
+	case code == http.StatusNotImplemented:
+		return KindUnsupported
+	}
+	return KindUnknown
+}
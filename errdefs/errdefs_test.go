@@ -0,0 +1,108 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package errdefs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestKindOf(t *testing.T) {
+	errRegistry := New(KindUnavailable, "registry is unavailable")
+	tests := []struct {
+		name      string
+		err       error
+		want      Kind
+		errno     syscall.Errno
+		retryable bool
+	}{
+		{name: "nil", err: nil, want: KindUnknown, errno: 0},
+		{name: "unknown", err: io.ErrUnexpectedEOF, want: KindUnknown, errno: syscall.EIO},
+		{name: "sentinel", err: ErrCorrupted, want: KindCorrupted, errno: syscall.EBADMSG},
+		{name: "wrapped-sentinel", err: fmt.Errorf("read: %w", ErrUnauthorized), want: KindUnauthorized, errno: syscall.EACCES},
+		{name: "new", err: fmt.Errorf("fetch: %w", errRegistry), want: KindUnavailable, errno: syscall.EHOSTUNREACH, retryable: true},
+		{name: "with-kind", err: WithKind(errors.New("unexpected status code 504"), KindOfHTTPStatus(http.StatusGatewayTimeout)), want: KindTimeout, errno: syscall.ETIMEDOUT, retryable: true},
+		{name: "outermost", err: WithKind(fmt.Errorf("failed: %w", ErrNotFound), KindInvalid), want: KindInvalid, errno: syscall.EIO},
+		{name: "canceled", err: fmt.Errorf("read: %w", context.Canceled), want: KindCanceled, errno: syscall.EINTR},
+		{name: "deadline", err: context.DeadlineExceeded, want: KindTimeout, errno: syscall.ETIMEDOUT, retryable: true},
+		{name: "not-exist", err: &os.PathError{Op: "open", Path: "/a", Err: syscall.ENOENT}, want: KindNotFound, errno: syscall.EIO},
+		{name: "conn-refused", err: &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}, want: KindUnavailable, errno: syscall.EHOSTUNREACH, retryable: true},
+		{name: "io-timeout", err: &net.OpError{Op: "read", Err: os.ErrDeadlineExceeded}, want: KindTimeout, errno: syscall.ETIMEDOUT, retryable: true},
+		{name: "joined", err: errors.Join(errors.New("source a"), fmt.Errorf("source b: %w", ErrTimeout)), want: KindTimeout, errno: syscall.ETIMEDOUT, retryable: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if k := KindOf(tt.err); k != tt.want {
+				t.Errorf("kind = %v; want %v", k, tt.want)
+			}
+			if errno := Errno(tt.err); errno != tt.errno {
+				t.Errorf("errno = %v; want %v", errno, tt.errno)
+			}
+			if r := IsRetryable(tt.err); r != tt.retryable {
+				t.Errorf("retryable = %v; want %v", r, tt.retryable)
+			}
+		})
+	}
+}
+
+func TestIs(t *testing.T) {
+	errRegistry := New(KindUnavailable, "registry is unavailable")
+	err := fmt.Errorf("read: %w", errRegistry)
+	if !errors.Is(err, errRegistry) || !errors.Is(err, ErrUnavailable) {
+		t.Errorf("error must match the sentinels")
+	}
+	if errors.Is(err, ErrTimeout) {
+		t.Errorf("error must not match other kinds")
+	}
+	if err.Error() != "read: registry is unavailable" {
+		t.Errorf("unexpected message %q", err.Error())
+	}
+	base := errors.New("unexpected status code 401")
+	err = WithKind(base, KindOfHTTPStatus(http.StatusUnauthorized))
+	if !errors.Is(err, ErrUnauthorized) || !errors.Is(err, base) || err.Error() != base.Error() {
+		t.Errorf("unexpected error with kind: %v", err)
+	}
+	if WithKind(nil, KindTimeout) != nil {
+		t.Errorf("nil must be kept")
+	}
+}
+
+func TestKindOfHTTPStatus(t *testing.T) {
+	for code, want := range map[int]Kind{
+		http.StatusUnauthorized:        KindUnauthorized,
+		http.StatusForbidden:           KindUnauthorized,
+		http.StatusNotFound:            KindNotFound,
+		http.StatusRequestTimeout:      KindTimeout,
+		http.StatusGatewayTimeout:      KindTimeout,
+		http.StatusTooManyRequests:     KindUnavailable,
+		http.StatusInternalServerError: KindUnavailable,
+		http.StatusServiceUnavailable:  KindUnavailable,
+		http.StatusNotImplemented:      KindUnsupported,
+		http.StatusBadRequest:          KindUnknown,
+	} {
+		if k := KindOfHTTPStatus(code); k != want {
+			t.Errorf("kind of %d = %v; want %v", code, k, want)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package estargz
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"slices"
+	"time"
+)
+
+// AccessOrderEntry is an entry of the access order tar index. See WithPrioritizedFilesFromTar.
+type AccessOrderEntry struct {
+	// Path is the path of the file accessed by the workload.
+	Path string
+
+	// FirstAccess is the time when the file is accessed for the first time.
+	FirstAccess time.Time
+}
+
+// WithPrioritizedFilesFromTar option prioritizes the files recorded in the access order tar
+// index read from index. This allows the access pattern to be collected by profilers outside
+// of this package (e.g. eBPF-based tracers). The index is a tar archive whose entries have no
+// contents. The name of each entry is the path of an accessed file and the modification time
+// is the time when the file is accessed for the first time. Files are placed in the order of
+// the first access (the order in the index for the same time) same as WithPrioritizedFiles.
+// Paths recorded more than once are placed at their earliest access. Use
+// WithAllowPrioritizeNotFound if the index covers files in other layers of the image.
+// The index is read when this function is called so the option can be passed to Build of
+// each layer. See also WriteAccessOrderIndex.
+func WithPrioritizedFilesFromTar(index io.Reader) Option {
+	entries, err := ReadAccessOrderIndex(index)
+	files := make([]string, len(entries))
+	for i, e := range entries {
+		files[i] = e.Path
+	}
+	return func(o *options) error {
+		if err != nil {
+			return fmt.Errorf("WithPrioritizedFilesFromTar: %w", err)
+		}
+		return WithPrioritizedFiles(files)(o)
+	}
+}
+
+// ReadAccessOrderIndex reads the entries of the access order tar index in the order of the
+// first access. Each path appears once in the result.
+func ReadAccessOrderIndex(index io.Reader) ([]AccessOrderEntry, error) {
+	var entries []AccessOrderEntry
+	seen := make(map[string]int) // index in entries
+	tr := tar.NewReader(index)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to read access order index: %w", err)
+		}
+		name := cleanEntryName(h.Name)
+		if i, ok := seen[name]; ok {
+			if h.ModTime.Before(entries[i].FirstAccess) {
+				entries[i].FirstAccess = h.ModTime
+			}
+			continue
+		}
+		seen[name] = len(entries)
+		entries = append(entries, AccessOrderEntry{Path: name, FirstAccess: h.ModTime})
+	}
+	slices.SortStableFunc(entries, func(a, b AccessOrderEntry) int {
+		return a.FirstAccess.Compare(b.FirstAccess)
+	})
+	return entries, nil
+}
+
+// WriteAccessOrderIndex writes the access order tar index of the entries to w.
+func WriteAccessOrderIndex(w io.Writer, entries []AccessOrderEntry) error {
+	tw := tar.NewWriter(w)
+	for _, e := range entries {
+		if err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     e.Path,
+			ModTime:  e.FirstAccess,
+			Format:   tar.FormatPAX, // sub-second precision
+		}); err != nil {
+			return fmt.Errorf("failed to write access order index entry of %q: %w", e.Path, err)
+		}
+	}
+	return tw.Close()
+}
@@ -47,11 +47,23 @@ type options struct {
 	chunkSize              int
 	compressionLevel       int
 	prioritizedFiles       []string
+	prefetchTiers          []int
 	missedPrioritizedFiles *[]string
 	compression            Compression
 	ctx                    context.Context
 	minChunkSize           int
+	accessTrace            bool
 	gzipHelperFunc         GzipHelperFunc
+	sparseFiles            bool
+	dedupFiles             bool
+	adaptiveCompression    bool
+	deltaBase              *Reader
+	prefixTOC              bool
+	compressedTOC          bool
+	digestAlgorithm        digest.Algorithm
+	progressFunc           func(Progress)
+	progress               *progress
+	scanners               []Scanner
 }
 
 type Option func(o *options) error
@@ -81,7 +93,27 @@ func WithCompressionLevel(level int) Option {
 // are treated as "/foo/bar".
 func WithPrioritizedFiles(files []string) Option {
 	return func(o *options) error {
-		o.prioritizedFiles = files
+		o.prioritizedFiles, o.prefetchTiers = files, nil
+		return nil
+	}
+}
+
+// WithPrefetchTiers option specifies the lists of prioritized files grouped into
+// prefetch tiers (e.g. files needed at exec, files needed within a few seconds
+// and the rest). Files are placed in the order of tiers and each tier except the last
+// one is followed by the landmark returned by PrefetchTierLandmark so that the
+// snapshotter can prefetch tiers in order. The last tier is followed by
+// PrefetchLandmark so snapshotters that don't understand tiers prefetch all of them.
+// This option overrides WithPrioritizedFiles.
+func WithPrefetchTiers(tiers [][]string) Option {
+	return func(o *options) error {
+		o.prioritizedFiles, o.prefetchTiers = nil, nil
+		for i, tier := range tiers {
+			o.prioritizedFiles = append(o.prioritizedFiles, tier...)
+			if i < len(tiers)-1 {
+				o.prefetchTiers = append(o.prefetchTiers, len(o.prioritizedFiles))
+			}
+		}
 		return nil
 	}
 }
@@ -109,7 +141,8 @@ func WithCompression(compression Compression) Option {
 	}
 }
 
-// WithContext specifies a context that can be used for clean canceleration.
+// WithContext specifies a context that can be used for clean canceleration. Build
+// stops processing tar entries after the context is canceled.
 func WithContext(ctx context.Context) Option {
 	return func(o *options) error {
 		o.ctx = ctx
@@ -129,6 +162,110 @@ func WithMinChunkSize(minChunkSize int) Option {
 	}
 }
 
+// WithAccessTrace option specifies the list of files accessed by the workload (e.g.
+// recorded by `ctr-remote image optimize --record-out`) and makes the chunk sizes chosen
+// for each region of the blob to reduce the read amplification of that access pattern.
+// These files are prioritized same as WithPrioritizedFiles. They are fetched together by
+// prefetch so they are split into large chunks and small files are compressed together
+// up to the chunk size. Other files are read on demand so they are split into small chunks
+// and compressed separately from each other (unless WithMinChunkSize is specified), which
+// reduces the amount of data fetched for reading a part of the blob.
+// The chunk size of the files read on demand is the one specified by WithChunkSize (1 MiB
+// by default) and the chunk size of the accessed files is the larger one of it and 4 MiB.
+// NOTE: This adds a TOC property that old reader doesn't understand.
+func WithAccessTrace(files []string) Option {
+	return func(o *options) error {
+		o.prioritizedFiles, o.prefetchTiers = files, nil
+		o.accessTrace = true
+		return nil
+	}
+}
+
+// WithSparseFiles option makes chunks of regular files that are filled with zeros
+// (e.g. holes of VM images and preallocated database files) recorded as holes in TOC
+// instead of being stored in the blob. Readers synthesize zeros for these chunks
+// without fetching the blob. Such files are stored in the tar as sparse files.
+// NOTE: This adds a TOC property that old reader doesn't understand.
+func WithSparseFiles() Option {
+	return func(o *options) error {
+		o.sparseFiles = true
+		return nil
+	}
+}
+
+// WithDeltaBase option builds a delta blob against the base eStargz blob. Chunks of
+// regular files identical to a chunk in the base blob (compared by the chunk digest)
+// aren't stored in the blob but are recorded in TOC as references to the base blob.
+// The resulting blob isn't a standalone layer; readers need to resolve the references
+// from the base blob (e.g. through the chunk cache shared with the base layer).
+// NOTE: This adds a TOC property that old reader doesn't understand.
+func WithDeltaBase(base *Reader) Option {
+	return func(o *options) error {
+		o.deltaBase = base
+		return nil
+	}
+}
+
+// WithDedupFiles option makes regular files that have the same contents as a preceding
+// file refer to that file in TOC, so their contents are stored in the blob only once.
+// Unlike hardlinks, the attributes of the files can differ and the files don't share the
+// inode. Entries are processed sequentially when this option is specified.
+// NOTE: This adds a TOC property that old reader doesn't understand.
+func WithDedupFiles() Option {
+	return func(o *options) error {
+		o.dedupFiles = true
+		return nil
+	}
+}
+
+// WithAdaptiveCompression option makes each regular file compressed with the level chosen
+// from the entropy of the beginning of the payload. Poorly compressible files (e.g. already
+// compressed assets) are compressed with a fast level or stored without compression, which
+// cuts the conversion time while keeping good compression ratio for text files. This is
+// ignored if the compression doesn't implement AdaptiveCompressor.
+func WithAdaptiveCompression() Option {
+	return func(o *options) error {
+		o.adaptiveCompression = true
+		return nil
+	}
+}
+
+// WithPrefixTOC option places a copy of the TOC JSON at the beginning of the blob, in
+// addition to the one referenced by the footer. This allows consumers that can only read
+// the blob forward (e.g. some proxies) to get the metadata before the whole blob arrives.
+// See ParsePrefixTOC. This option is supported only with gzip compression.
+func WithPrefixTOC() Option {
+	return func(o *options) error {
+		o.prefixTOC = true
+		return nil
+	}
+}
+
+// WithCompressedTOC option compresses the TOC JSON with zstd. This reduces the size of
+// the blob and the time to fetch the TOC of layers containing a large number of files.
+// The footer is flagged so readers that don't support the compressed TOC fail to parse the
+// blob instead of misreading it. This option is supported only with gzip compression.
+func WithCompressedTOC() Option {
+	return func(o *options) error {
+		o.compressedTOC = true
+		return nil
+	}
+}
+
+// WithDigestAlgorithm option specifies the algorithm of the digests of regular files and
+// chunks recorded in TOC. The default is digest.Canonical (sha256). sha384 and sha512 are
+// supported as well as the algorithms whose verifiers implementing ChunkHasher are
+// registered with RegisterChunkVerifier.
+func WithDigestAlgorithm(alg digest.Algorithm) Option {
+	return func(o *options) error {
+		if _, err := ChunkDigester(alg); err != nil {
+			return fmt.Errorf("digest algorithm %q is unavailable: %w", alg, err)
+		}
+		o.digestAlgorithm = alg
+		return nil
+	}
+}
+
 // WithGzipHelperFunc option specifies a custom function to decompress gzip-compressed layers.
 // When a gzip-compressed layer is detected, this function will be used instead of the
 // Go standard library gzip decompression for better performance.
@@ -146,8 +283,10 @@ type Blob struct {
 	io.ReadCloser
 	diffID           digest.Digester
 	tocDigest        digest.Digest
+	prefetchCoverage PrefetchCoverage
 	readCompleted    *atomic.Bool
 	uncompressedSize *atomic.Int64
+	scanFindings     []ScanFinding
 }
 
 // DiffID returns the digest of uncompressed blob.
@@ -161,6 +300,18 @@ func (b *Blob) TOCDigest() digest.Digest {
 	return b.tocDigest
 }
 
+// PrefetchCoverage returns the size of the prioritized files compared to the size of all
+// regular files of the blob. This is recorded to PrefetchCoverageAnnotation.
+func (b *Blob) PrefetchCoverage() PrefetchCoverage {
+	return b.prefetchCoverage
+}
+
+// ScanFindings returns the findings of the scanners specified by WithScanners in the order
+// of the entries. See ScanAnnotations for the annotations of the converted layer.
+func (b *Blob) ScanFindings() []ScanFinding {
+	return b.scanFindings
+}
+
 // UncompressedSize returns the size of uncompressed blob.
 // UncompressedSize should only be called after the blob has been fully read.
 func (b *Blob) UncompressedSize() (int64, error) {
@@ -180,15 +331,9 @@ func (b *Blob) UncompressedSize() (int64, error) {
 // (e.g. prefetch). This function builds a blob in parallel, with dividing that blob into several
 // (at least the number of runtime.GOMAXPROCS(0)) sub-blobs.
 func Build(tarBlob *io.SectionReader, opt ...Option) (_ *Blob, rErr error) {
-	var opts options
-	opts.compressionLevel = gzip.BestCompression // BestCompression by default
-	for _, o := range opt {
-		if err := o(&opts); err != nil {
-			return nil, err
-		}
-	}
-	if opts.compression == nil {
-		opts.compression = newGzipCompressionWithLevel(opts.compressionLevel)
+	opts, err := parseOptions(opt...)
+	if err != nil {
+		return nil, err
 	}
 	layerFiles := newTempFiles()
 	ctx := opts.ctx
@@ -215,49 +360,43 @@ func Build(tarBlob *io.SectionReader, opt ...Option) (_ *Blob, rErr error) {
 			rErr = fmt.Errorf("error from context %q: %w", cErr, rErr)
 		}
 	}()
-	tarBlob, err := decompressBlob(tarBlob, layerFiles, opts.gzipHelperFunc)
+	tarBlob, err = decompressBlob(tarBlob, layerFiles, opts.gzipHelperFunc)
 	if err != nil {
 		return nil, err
 	}
-	entries, err := sortEntries(tarBlob, opts.prioritizedFiles, opts.missedPrioritizedFiles)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	entries, err := sortEntries(tarBlob, opts.prioritizedFiles, opts.prefetchTiers, opts.missedPrioritizedFiles)
 	if err != nil {
 		return nil, err
 	}
 	var tarParts [][]*entry
-	if opts.minChunkSize > 0 {
+	if opts.minChunkSize > 0 || opts.accessTrace {
 		// Each entry needs to know the size of the current gzip stream so they
 		// cannot be processed in parallel.
 		tarParts = [][]*entry{entries}
+	} else if opts.dedupFiles {
+		// Deduplicated files must be placed after the file storing the contents
+		// so duplicates need to be found from all preceding entries.
+		tarParts = [][]*entry{entries}
 	} else {
 		tarParts = divideEntries(entries, runtime.GOMAXPROCS(0))
 	}
-	writers := make([]*Writer, len(tarParts))
-	payloads := make([]*os.File, len(tarParts))
+	fragments := make([]*Fragment, len(tarParts))
 	var wg sync.WaitGroup
 	errCh := make(chan error, len(tarParts)) // buffered to avoid goroutine leaks
 	for i, parts := range tarParts {
 		// builds verifiable stargz sub-blobs
 		wg.Go(func() {
-			esgzFile, err := layerFiles.TempFile("", "esgzdata")
+			tarPart := readerFromEntries(parts...)
+			defer tarPart.Close()
+			f, err := buildFragment(tarPart, opts, layerFiles)
 			if err != nil {
 				errCh <- err
 				return
 			}
-			sw := NewWriterWithCompressor(esgzFile, opts.compression)
-			sw.ChunkSize = opts.chunkSize
-			sw.MinChunkSize = opts.minChunkSize
-			if sw.needsOpenGzEntries == nil {
-				sw.needsOpenGzEntries = make(map[string]struct{})
-			}
-			for _, f := range []string{PrefetchLandmark, NoPrefetchLandmark} {
-				sw.needsOpenGzEntries[f] = struct{}{}
-			}
-			if err := sw.AppendTar(readerFromEntries(parts...)); err != nil {
-				errCh <- err
-				return
-			}
-			writers[i] = sw
-			payloads[i] = esgzFile
+			fragments[i] = f
 		})
 	}
 	wg.Wait()
@@ -268,19 +407,33 @@ func Build(tarBlob *io.SectionReader, opt ...Option) (_ *Blob, rErr error) {
 			return nil, err
 		}
 	}
-	tocAndFooter, tocDgst, err := closeWithCombine(writers...)
+	opts.progress.done()
+	r, toc, tocDgst, err := concatFragments(fragments, opts)
 	if err != nil {
-		rErr = err
 		return nil, err
 	}
-	var rs []io.Reader
-	for _, p := range payloads {
-		fs, err := fileSectionReader(p)
-		if err != nil {
+	return newBlob(r, opts, toc, tocDgst, scanFindingsOf(fragments), layerFiles.CleanupAll), nil
+}
+
+// parseOptions applies the options to the default ones.
+func parseOptions(opt ...Option) (*options, error) {
+	var opts options
+	opts.compressionLevel = gzip.BestCompression // BestCompression by default
+	for _, o := range opt {
+		if err := o(&opts); err != nil {
 			return nil, err
 		}
-		rs = append(rs, fs)
 	}
+	if opts.compression == nil {
+		opts.compression = newGzipCompressionWithLevel(opts.compressionLevel)
+	}
+	opts.progress = newProgress(opts.progressFunc)
+	return &opts, nil
+}
+
+// newBlob returns a Blob that reads the eStargz blob of the TOC from r. DiffID and the
+// uncompressed size are calculated while the blob is read.
+func newBlob(r io.Reader, opts *options, toc *JTOC, tocDgst digest.Digest, findings []ScanFinding, closeFunc func() error) *Blob {
 	diffID := digest.Canonical.Digester()
 	pr, pw := io.Pipe()
 	readCompleted := new(atomic.Bool)
@@ -293,7 +446,7 @@ func Build(tarBlob *io.SectionReader, opt ...Option) (_ *Blob, rErr error) {
 		} else {
 			decompressFunc = opts.compression.Reader
 		}
-		decompressR, err := decompressFunc(io.TeeReader(io.MultiReader(append(rs, tocAndFooter)...), pw))
+		decompressR, err := decompressFunc(io.TeeReader(r, pw))
 		if err != nil {
 			pw.CloseWithError(err)
 			return
@@ -310,56 +463,15 @@ func Build(tarBlob *io.SectionReader, opt ...Option) (_ *Blob, rErr error) {
 	return &Blob{
 		ReadCloser: readCloser{
 			Reader:    pr,
-			closeFunc: layerFiles.CleanupAll,
+			closeFunc: closeFunc,
 		},
 		tocDigest:        tocDgst,
+		prefetchCoverage: prefetchCoverage(toc),
 		diffID:           diffID,
 		readCompleted:    readCompleted,
 		uncompressedSize: uncompressedSize,
-	}, nil
-}
-
-// closeWithCombine takes unclosed Writers and close them. This also returns the
-// toc that combined all Writers into.
-// Writers doesn't write TOC and footer to the underlying writers so they can be
-// combined into a single eStargz and tocAndFooter returned by this function can
-// be appended at the tail of that combined blob.
-func closeWithCombine(ws ...*Writer) (tocAndFooterR io.Reader, tocDgst digest.Digest, err error) {
-	if len(ws) == 0 {
-		return nil, "", fmt.Errorf("at least one writer must be passed")
+		scanFindings:     findings,
 	}
-	for _, w := range ws {
-		if w.closed {
-			return nil, "", fmt.Errorf("writer must be unclosed")
-		}
-		defer func(w *Writer) { w.closed = true }(w)
-		if err := w.closeGz(); err != nil {
-			return nil, "", err
-		}
-		if err := w.bw.Flush(); err != nil {
-			return nil, "", err
-		}
-	}
-	var (
-		mtoc          = new(JTOC)
-		currentOffset int64
-	)
-	mtoc.Version = ws[0].toc.Version
-	for _, w := range ws {
-		for _, e := range w.toc.Entries {
-			// Recalculate Offset of non-empty files/chunks
-			if (e.Type == "reg" && e.Size > 0) || e.Type == "chunk" {
-				e.Offset += currentOffset
-			}
-			mtoc.Entries = append(mtoc.Entries, e)
-		}
-		if w.toc.Version > mtoc.Version {
-			mtoc.Version = w.toc.Version
-		}
-		currentOffset += w.cw.n
-	}
-
-	return tocAndFooter(ws[0].compressor, mtoc, currentOffset)
 }
 
 func tocAndFooter(compressor Compressor, toc *JTOC, offset int64) (io.Reader, digest.Digest, error) {
@@ -399,8 +511,9 @@ var errNotFound = errors.New("not found")
 
 // sortEntries reads the specified tar blob and returns a list of tar entries.
 // If some of prioritized files are specified, the list starts from these
-// files with keeping the order specified by the argument.
-func sortEntries(in io.ReaderAt, prioritized []string, missedPrioritized *[]string) ([]*entry, error) {
+// files with keeping the order specified by the argument. tiers is the list of
+// the indexes of prioritized where the prefetch tiers except the first one start.
+func sortEntries(in io.ReaderAt, prioritized []string, tiers []int, missedPrioritized *[]string) ([]*entry, error) {
 
 	// Import tar file.
 	intar, err := importTar(in)
@@ -411,7 +524,11 @@ func sortEntries(in io.ReaderAt, prioritized []string, missedPrioritized *[]stri
 	// Sort the tar file respecting to the prioritized files list.
 	sorted := &tarFile{}
 	picked := make(map[string]struct{})
-	for _, l := range prioritized {
+	tier := 0
+	for i, l := range prioritized {
+		for ; tier < len(tiers) && tiers[tier] <= i; tier++ {
+			sorted.add(landmarkEntry(PrefetchTierLandmark(tier)))
+		}
 		if err := moveRec(l, intar, sorted, picked); err != nil {
 			if errors.Is(err, errNotFound) && missedPrioritized != nil {
 				*missedPrioritized = append(*missedPrioritized, l)
@@ -421,32 +538,33 @@ func sortEntries(in io.ReaderAt, prioritized []string, missedPrioritized *[]stri
 		}
 	}
 	if len(prioritized) == 0 {
-		sorted.add(&entry{
-			header: &tar.Header{
-				Name:     NoPrefetchLandmark,
-				Typeflag: tar.TypeReg,
-				Size:     int64(len([]byte{landmarkContents})),
-			},
-			payload: bytes.NewReader([]byte{landmarkContents}),
-		})
+		sorted.add(landmarkEntry(NoPrefetchLandmark))
 	} else {
-		sorted.add(&entry{
-			header: &tar.Header{
-				Name:     PrefetchLandmark,
-				Typeflag: tar.TypeReg,
-				Size:     int64(len([]byte{landmarkContents})),
-			},
-			payload: bytes.NewReader([]byte{landmarkContents}),
-		})
+		for ; tier < len(tiers); tier++ {
+			sorted.add(landmarkEntry(PrefetchTierLandmark(tier)))
+		}
+		sorted.add(landmarkEntry(PrefetchLandmark))
 	}
 
 	// Dump prioritized entries followed by the rest entries while skipping picked ones.
 	return append(sorted.dump(nil), intar.dump(picked)...), nil
 }
 
+// landmarkEntry returns a tar entry of the landmark file.
+func landmarkEntry(name string) *entry {
+	return &entry{
+		header: &tar.Header{
+			Name:     name,
+			Typeflag: tar.TypeReg,
+			Size:     int64(len([]byte{landmarkContents})),
+		},
+		payload: bytes.NewReader([]byte{landmarkContents}),
+	}
+}
+
 // readerFromEntries returns a reader of tar archive that contains entries passed
 // through the arguments.
-func readerFromEntries(entries ...*entry) io.Reader {
+func readerFromEntries(entries ...*entry) io.ReadCloser {
 	pr, pw := io.Pipe()
 	go func() {
 		tw := tar.NewWriter(pw)
@@ -484,8 +602,7 @@ func importTar(in io.ReaderAt) (*tarFile, error) {
 			}
 			return nil, fmt.Errorf("failed to parse tar file, %w", err)
 		}
-		switch cleanEntryName(h.Name) {
-		case PrefetchLandmark, NoPrefetchLandmark:
+		if IsLandmark(cleanEntryName(h.Name)) {
 			// Ignore existing landmark
 			continue
 		}
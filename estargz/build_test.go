@@ -26,10 +26,23 @@ import (
 	"archive/tar"
 	"bytes"
 	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"os"
+	"path"
 	"reflect"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
 )
 
 func TestSort(t *testing.T) {
@@ -672,3 +685,1648 @@ func TestCountReader(t *testing.T) {
 	}
 
 }
+
+func TestRechunk(t *testing.T) {
+	in := tarOf(
+		file("foo", "foofoofoofoofoo"),
+		dir("bar/"),
+		file("bar/baz", "b"),
+		symlink("barlink", "bar/baz"),
+		file("empty", ""),
+		file("bar/long", longstring(100)),
+		prefetchLandmark(),
+		file("bar/small", "smallsmall"),
+	)
+	tests := []struct {
+		name            string
+		chunkSize       int
+		minChunkSize    int
+		newChunkSize    int
+		newMinChunkSize int
+		wantChunks      map[string]int
+		wantSamePayload bool
+	}{
+		{
+			name:            "same chunk size",
+			chunkSize:       4,
+			newChunkSize:    4,
+			wantChunks:      map[string]int{"foo": 4, "bar/baz": 1, "bar/long": 25, "bar/small": 3},
+			wantSamePayload: true,
+		},
+		{
+			name:         "larger chunks",
+			chunkSize:    4,
+			newChunkSize: 16,
+			wantChunks:   map[string]int{"foo": 1, "bar/baz": 1, "bar/long": 7, "bar/small": 1},
+		},
+		{
+			name:         "smaller chunks",
+			chunkSize:    16,
+			newChunkSize: 3,
+			wantChunks:   map[string]int{"foo": 5, "bar/baz": 1, "bar/long": 34, "bar/small": 4},
+		},
+		{
+			name:            "min chunk size",
+			chunkSize:       4,
+			newChunkSize:    8,
+			newMinChunkSize: 64000,
+			wantChunks:      map[string]int{"foo": 2, "bar/baz": 1, "bar/long": 13, "bar/small": 2},
+		},
+		{
+			name:         "from min chunk size",
+			chunkSize:    4,
+			minChunkSize: 64000,
+			newChunkSize: 5,
+			wantChunks:   map[string]int{"foo": 3, "bar/baz": 1, "bar/long": 20, "bar/small": 2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src, err := Build(buildTar(t, in, ""), WithChunkSize(tt.chunkSize), WithMinChunkSize(tt.minChunkSize))
+			if err != nil {
+				t.Fatalf("failed to build: %v", err)
+			}
+			srcData, err := io.ReadAll(src)
+			if err != nil {
+				t.Fatalf("failed to read source blob: %v", err)
+			}
+			src.Close()
+			srcSR := io.NewSectionReader(bytes.NewReader(srcData), 0, int64(len(srcData)))
+
+			rechunked, err := Rechunk(srcSR, WithChunkSize(tt.newChunkSize), WithMinChunkSize(tt.newMinChunkSize))
+			if err != nil {
+				t.Fatalf("failed to rechunk: %v", err)
+			}
+			data, err := io.ReadAll(rechunked)
+			if err != nil {
+				t.Fatalf("failed to read rechunked blob: %v", err)
+			}
+			rechunked.Close()
+			sr := io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data)))
+			if diffID := GzipDiffIDOf(t, data); diffID != rechunked.DiffID().String() {
+				t.Errorf("DiffID = %q; want %q", rechunked.DiffID(), diffID)
+			}
+
+			// The uncompressed tar contents must be kept.
+			wantTar, err := Unpack(srcSR, new(GzipDecompressor))
+			if err != nil {
+				t.Fatalf("failed to unpack source blob: %v", err)
+			}
+			gotTar, err := Unpack(sr, new(GzipDecompressor))
+			if err != nil {
+				t.Fatalf("failed to unpack rechunked blob: %v", err)
+			}
+			want, err := io.ReadAll(wantTar)
+			if err != nil {
+				t.Fatalf("failed to read source tar: %v", err)
+			}
+			got, err := io.ReadAll(gotTar)
+			if err != nil {
+				t.Fatalf("failed to read rechunked tar: %v", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("uncompressed contents differ")
+			}
+
+			r, err := Open(sr)
+			if err != nil {
+				t.Fatalf("failed to open rechunked blob: %v", err)
+			}
+			tocOffset, _, err := OpenFooter(sr)
+			if err != nil {
+				t.Fatalf("failed to parse footer: %v", err)
+			}
+			if tt.wantSamePayload {
+				srcTOCOffset, _, err := OpenFooter(srcSR)
+				if err != nil {
+					t.Fatalf("failed to parse source footer: %v", err)
+				}
+				if !bytes.Equal(data[:tocOffset], srcData[:srcTOCOffset]) {
+					t.Errorf("payload must be reused as-is")
+				}
+			}
+			if tt.newMinChunkSize == 0 {
+				// TOC verification doesn't support multiple chunks in one stream.
+				if _, err := r.VerifyTOC(rechunked.TOCDigest()); err != nil {
+					t.Fatalf("failed to verify TOC: %v", err)
+				}
+			}
+			for name, wantChunks := range tt.wantChunks {
+				var chunks int
+				for _, e := range r.toc.Entries {
+					if e.Name != name || !e.isDataType() {
+						continue
+					}
+					chunks++
+					if e.ChunkSize > int64(tt.newChunkSize) {
+						t.Errorf("%q: chunk size %d exceeds %d", name, e.ChunkSize, tt.newChunkSize)
+					}
+					cr, err := r.OpenFile(name)
+					if err != nil {
+						t.Fatalf("failed to open %q: %v", name, err)
+					}
+					chunk := make([]byte, e.ChunkSize)
+					if _, err := cr.ReadAt(chunk, e.ChunkOffset); err != nil && err != io.EOF {
+						t.Fatalf("failed to read chunk %d of %q: %v", e.ChunkOffset, name, err)
+					}
+					if dgst := digest.FromBytes(chunk).String(); dgst != e.ChunkDigest {
+						t.Errorf("chunk %d of %q: digest = %q; want %q", e.ChunkOffset, name, e.ChunkDigest, dgst)
+					}
+				}
+				if chunks != wantChunks {
+					t.Errorf("%q: got %d chunks; want %d", name, chunks, wantChunks)
+				}
+			}
+			if _, ok := r.Lookup("barlink"); !ok {
+				t.Errorf("symlink must be kept")
+			}
+		})
+	}
+}
+
+func TestSquash(t *testing.T) {
+	layers := []struct {
+		in          []tarEntry
+		chunkSize   int
+		prioritized []string
+	}{
+		{
+			in: tarOf(
+				file("foo", "foofoofoofoofoo"),
+				dir("bar/"),
+				file("bar/baz", "bazbazbazbaz"),
+				file("bar/removed", "removed"),
+				dir("opq/"),
+				file("opq/hidden", "hidden"),
+				file("target", "targettarget"),
+				link("hardlink", "target"),
+				link("hardlink2", "target"),
+				file("overridden", "lower"),
+			),
+			chunkSize:   4,
+			prioritized: []string{"bar/baz"},
+		},
+		{
+			in: tarOf(
+				dir("bar/"),
+				file("bar/.wh.removed", ""),
+				dir("opq/"),
+				file("opq/.wh..wh..opq", ""),
+				file("opq/new", "newnewnew"),
+				file(".wh.target", ""),
+				file("overridden", "upperupperupper"),
+				file("prio", "priopriopriopri"),
+			),
+			chunkSize:   6,
+			prioritized: []string{"prio"},
+		},
+	}
+	var srs []*io.SectionReader
+	for i, l := range layers {
+		blob, err := Build(buildTar(t, l.in, ""), WithChunkSize(l.chunkSize), WithPrioritizedFiles(l.prioritized))
+		if err != nil {
+			t.Fatalf("failed to build layer %d: %v", i, err)
+		}
+		data, err := io.ReadAll(blob)
+		if err != nil {
+			t.Fatalf("failed to read layer %d: %v", i, err)
+		}
+		blob.Close()
+		srs = append(srs, io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data))))
+	}
+
+	squashed, err := Squash(srs, WithChunkSize(100))
+	if err != nil {
+		t.Fatalf("failed to squash: %v", err)
+	}
+	data, err := io.ReadAll(squashed)
+	if err != nil {
+		t.Fatalf("failed to read squashed blob: %v", err)
+	}
+	squashed.Close()
+	if diffID := GzipDiffIDOf(t, data); diffID != squashed.DiffID().String() {
+		t.Errorf("DiffID = %q; want %q", squashed.DiffID(), diffID)
+	}
+	sr := io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data)))
+	r, err := Open(sr)
+	if err != nil {
+		t.Fatalf("failed to open squashed blob: %v", err)
+	}
+	if _, err := r.VerifyTOC(squashed.TOCDigest()); err != nil {
+		t.Fatalf("failed to verify TOC: %v", err)
+	}
+
+	wantFiles := map[string]struct {
+		contents string
+		chunks   int
+	}{
+		"foo":              {"foofoofoofoofoo", 4},
+		"bar/baz":          {"bazbazbazbaz", 3},
+		"opq/new":          {"newnewnew", 2},
+		"hardlink":         {"targettarget", 3},
+		"overridden":       {"upperupperupper", 3},
+		"prio":             {"priopriopriopri", 3},
+		"opq/.wh..wh..opq": {"", 0},
+	}
+	for name, want := range wantFiles {
+		e, ok := r.Lookup(name)
+		if !ok {
+			t.Errorf("%q must exist", name)
+			continue
+		}
+		if e.Type == "hardlink" {
+			t.Errorf("%q: hardlink to the removed file must be a regular file", name)
+		}
+		fr, err := r.OpenFile(name)
+		if err != nil {
+			t.Fatalf("failed to open %q: %v", name, err)
+		}
+		got := make([]byte, len(want.contents))
+		if _, err := fr.ReadAt(got, 0); err != nil && err != io.EOF {
+			t.Fatalf("failed to read %q: %v", name, err)
+		}
+		if string(got) != want.contents {
+			t.Errorf("%q: contents = %q; want %q", name, string(got), want.contents)
+		}
+		var chunks int
+		for _, e := range r.toc.Entries {
+			if e.Name == name && e.isDataType() && e.Size > 0 || e.Name == name && e.Type == "chunk" {
+				chunks++
+			}
+		}
+		if chunks != want.chunks {
+			t.Errorf("%q: got %d chunks; want %d", name, chunks, want.chunks)
+		}
+	}
+	// Contents of the removed target are stored once and shared by the hardlinks.
+	var linkChunks int
+	for _, e := range r.toc.Entries {
+		if e.Name == "hardlink2" {
+			if e.Type != "hardlink" || e.LinkName != "hardlink" {
+				t.Errorf("hardlink2 must be a hardlink to hardlink: %+v", e)
+			}
+			linkChunks++
+		}
+	}
+	if linkChunks != 1 {
+		t.Errorf("hardlink2 must not store the contents: %d entries", linkChunks)
+	}
+	if e, ok := r.Lookup("hardlink2"); !ok || e.Name != "hardlink" || e.NumLink != 2 {
+		t.Errorf("hardlink2 must share the inode with hardlink: %+v", e)
+	}
+	for _, name := range []string{"bar/removed", "opq/hidden", "target"} {
+		if _, ok := r.Lookup(name); ok {
+			t.Errorf("%q must not exist", name)
+		}
+	}
+	for _, name := range []string{"bar/.wh.removed", ".wh.target"} {
+		if _, ok := r.Lookup(name); !ok {
+			t.Errorf("whiteout %q must be kept to hide lower layers", name)
+		}
+	}
+
+	// Prioritized files of all layers must be placed before the landmark.
+	var names []string
+	for _, e := range r.toc.Entries {
+		if e.Type != "chunk" {
+			names = append(names, e.Name)
+		}
+	}
+	landmark := -1
+	for i, name := range names {
+		if name == PrefetchLandmark {
+			landmark = i
+		}
+	}
+	if landmark < 0 {
+		t.Fatalf("prefetch landmark not found: %v", names)
+	}
+	for _, name := range []string{"bar/baz", "prio"} {
+		for i, n := range names {
+			if n == name && i > landmark {
+				t.Errorf("%q must be placed before the landmark: %v", name, names)
+			}
+		}
+	}
+}
+
+func TestSparseFiles(t *testing.T) {
+	const chunkSize = 8192
+	zeros := func(n int) string { return string(make([]byte, n)) }
+	sparse := strings.Repeat("a", chunkSize) + // data
+		zeros(chunkSize*2) + // holes
+		strings.Repeat("b", 10) + zeros(chunkSize-10) + // data
+		zeros(5000) // hole at the end
+	contents := map[string]string{
+		"sparse":     sparse,
+		"allzero":    zeros(10000),
+		"smallzero":  zeros(100),
+		"foo":        "foofoofoo",
+		"long/large": longstring(chunkSize*2 + 100),
+	}
+	wantHoles := map[string]int{"sparse": 3, "allzero": 1}
+	in := tarOf(
+		file("foo", contents["foo"]),
+		file("sparse", contents["sparse"]),
+		file("allzero", contents["allzero"]),
+		file("smallzero", contents["smallzero"]),
+		dir("long/"),
+		file("long/large", contents["long/large"]),
+	)
+	for _, minChunkSize := range []int{0, 64000} {
+		t.Run(fmt.Sprintf("min-chunk-size=%d", minChunkSize), func(t *testing.T) {
+			blob, err := Build(buildTar(t, in, ""), WithChunkSize(chunkSize), WithMinChunkSize(minChunkSize), WithSparseFiles())
+			if err != nil {
+				t.Fatalf("failed to build: %v", err)
+			}
+			data, err := io.ReadAll(blob)
+			if err != nil {
+				t.Fatalf("failed to read blob: %v", err)
+			}
+			blob.Close()
+			if diffID := GzipDiffIDOf(t, data); diffID != blob.DiffID().String() {
+				t.Errorf("DiffID = %q; want %q", blob.DiffID(), diffID)
+			}
+			sr := io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data)))
+
+			// The tar must be extracted with the holes filled with zeros.
+			rc, err := Unpack(sr, new(GzipDecompressor))
+			if err != nil {
+				t.Fatalf("failed to unpack: %v", err)
+			}
+			tr := tar.NewReader(rc)
+			found := make(map[string]bool)
+			for {
+				h, err := tr.Next()
+				if err == io.EOF {
+					break
+				} else if err != nil {
+					t.Fatalf("failed to read tar: %v", err)
+				}
+				want, ok := contents[cleanEntryName(h.Name)]
+				if !ok {
+					continue
+				}
+				got, err := io.ReadAll(tr)
+				if err != nil {
+					t.Fatalf("failed to read %q in tar: %v", h.Name, err)
+				}
+				if string(got) != want {
+					t.Errorf("%q: unexpected contents in tar", h.Name)
+				}
+				found[cleanEntryName(h.Name)] = true
+			}
+			if len(found) != len(contents) {
+				t.Errorf("some files aren't found in tar: %v", found)
+			}
+
+			r, err := Open(sr)
+			if err != nil {
+				t.Fatalf("failed to open: %v", err)
+			}
+			if minChunkSize == 0 {
+				if _, err := r.VerifyTOC(blob.TOCDigest()); err != nil {
+					t.Fatalf("failed to verify TOC: %v", err)
+				}
+			}
+			holes := make(map[string]int)
+			for _, e := range r.toc.Entries {
+				if e.Hole {
+					holes[e.Name]++
+					if e.Offset != 0 {
+						t.Errorf("%q: offset of hole must be zero: %d", e.Name, e.Offset)
+					}
+				}
+			}
+			if !reflect.DeepEqual(holes, wantHoles) {
+				t.Errorf("holes = %v; want %v", holes, wantHoles)
+			}
+			for name, want := range contents {
+				fr, err := r.OpenFile(name)
+				if err != nil {
+					t.Fatalf("failed to open %q: %v", name, err)
+				}
+				// Read across the boundaries of chunks
+				for _, off := range []int64{0, chunkSize - 5, chunkSize*3 - 5, int64(len(want)) - 5} {
+					if off < 0 || off >= int64(len(want)) {
+						continue
+					}
+					got := make([]byte, min(chunkSize*2, int64(len(want))-off))
+					if _, err := fr.ReadAt(got, off); err != nil && err != io.EOF {
+						t.Fatalf("failed to read %q at %d: %v", name, off, err)
+					}
+					if string(got) != want[off:off+int64(len(got))] {
+						t.Errorf("%q: unexpected contents at %d", name, off)
+					}
+				}
+				ce, ok := r.ChunkEntryForOffset(name, 0)
+				if !ok {
+					t.Fatalf("chunk of %q not found", name)
+				}
+				if ce.Hole {
+					chunk := make([]byte, ce.ChunkSize)
+					if _, err := fr.ReadAt(chunk, ce.ChunkOffset); err != nil && err != io.EOF {
+						t.Fatalf("failed to read hole of %q: %v", name, err)
+					}
+					if dgst := digest.FromBytes(chunk).String(); dgst != ce.ChunkDigest {
+						t.Errorf("%q: digest of hole = %q; want %q", name, ce.ChunkDigest, dgst)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestPrefixTOC(t *testing.T) {
+	const chunkSize = 8192
+	contents := map[string]string{
+		"foo":     longstring(chunkSize*3 + 100),
+		"bar/baz": "baz",
+		"bar/a":   longstring(chunkSize - 1),
+	}
+	in := tarOf(
+		file("foo", contents["foo"]),
+		dir("bar/"),
+		file("bar/baz", contents["bar/baz"]),
+		file("bar/a", contents["bar/a"]),
+		file("empty", ""),
+	)
+	blob, err := Build(buildTar(t, in, ""), WithChunkSize(chunkSize), WithPrefixTOC(),
+		WithPrioritizedFiles([]string{"bar/baz"}))
+	if err != nil {
+		t.Fatalf("failed to build: %v", err)
+	}
+	data, err := io.ReadAll(blob)
+	if err != nil {
+		t.Fatalf("failed to read blob: %v", err)
+	}
+	blob.Close()
+	if diffID := GzipDiffIDOf(t, data); diffID != blob.DiffID().String() {
+		t.Errorf("DiffID = %q; want %q", blob.DiffID(), diffID)
+	}
+
+	// The prefix TOC must be readable without the rest of the blob.
+	prefixTOC, prefixDgst, err := ParsePrefixTOC(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("failed to parse prefix TOC: %v", err)
+	}
+	if prefixDgst != blob.TOCDigest() {
+		t.Errorf("prefix TOC digest = %q; want %q", prefixDgst, blob.TOCDigest())
+	}
+
+	r, err := Open(io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data))))
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+	if _, err := r.VerifyTOC(blob.TOCDigest()); err != nil {
+		t.Fatalf("failed to verify TOC: %v", err)
+	}
+	if len(prefixTOC.Entries) != len(r.toc.Entries) {
+		t.Fatalf("prefix TOC has %d entries; want %d", len(prefixTOC.Entries), len(r.toc.Entries))
+	}
+	for i, e := range prefixTOC.Entries {
+		if want := r.toc.Entries[i].Offset; e.Offset != want {
+			t.Errorf("offset of %q in prefix TOC = %d; want %d", e.Name, e.Offset, want)
+		}
+	}
+	for name, want := range contents {
+		fr, err := r.OpenFile(name)
+		if err != nil {
+			t.Fatalf("failed to open %q: %v", name, err)
+		}
+		got := make([]byte, len(want))
+		if _, err := fr.ReadAt(got, 0); err != nil && err != io.EOF {
+			t.Fatalf("failed to read %q: %v", name, err)
+		}
+		if string(got) != want {
+			t.Errorf("%q: unexpected contents", name)
+		}
+	}
+
+	// Rebuilding the blob must not duplicate the prefix TOC.
+	blob2, err := Build(io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data))), WithPrefixTOC())
+	if err != nil {
+		t.Fatalf("failed to rebuild: %v", err)
+	}
+	data2, err := io.ReadAll(blob2)
+	if err != nil {
+		t.Fatalf("failed to read rebuilt blob: %v", err)
+	}
+	blob2.Close()
+	r2, err := Open(io.NewSectionReader(bytes.NewReader(data2), 0, int64(len(data2))))
+	if err != nil {
+		t.Fatalf("failed to open rebuilt blob: %v", err)
+	}
+	if _, ok := r2.Lookup(PrefixTOCTarName); ok {
+		t.Errorf("prefix TOC must not be included in the TOC")
+	}
+
+	if _, err := Build(buildTar(t, in, ""), WithPrefixTOC(), WithCompression(nonGzipCompression{newGzipCompressionWithLevel(gzip.BestSpeed)})); err == nil {
+		t.Errorf("prefix TOC must be rejected for non-gzip compression")
+	}
+}
+
+func TestBuildFragments(t *testing.T) {
+	const chunkSize = 8192
+	contents := map[string]string{
+		"foo":     longstring(chunkSize*3 + 100),
+		"bar/baz": "baz",
+		"bar/a":   longstring(chunkSize - 1),
+		"bar/b":   longstring(chunkSize * 2),
+		"c":       longstring(chunkSize + 1),
+	}
+	in := tarOf(
+		file("foo", contents["foo"]),
+		dir("bar/"),
+		file("bar/baz", contents["bar/baz"]),
+		file("bar/a", contents["bar/a"]),
+		file("bar/b", contents["bar/b"]),
+		file("empty", ""),
+		link("bar/link", "bar/a"),
+		file("c", contents["c"]),
+	)
+	opts := []Option{WithChunkSize(chunkSize), WithPrioritizedFiles([]string{"bar/baz"})}
+	parts, err := SplitTar(buildTar(t, in, ""), 3, opts...)
+	if err != nil {
+		t.Fatalf("failed to split tar: %v", err)
+	}
+	if len(parts) < 2 {
+		t.Fatalf("tar must be divided into multiple parts but got %d", len(parts))
+	}
+	buildFragment := func(p io.ReadCloser) (*Fragment, error) {
+		defer p.Close()
+		f, err := BuildFragment(p, opts...)
+		if err != nil {
+			return nil, err
+		}
+
+		// Emulate transferring the fragment from another machine.
+		tocJSON, err := json.Marshal(f.TOC)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		var toc JTOC
+		if err := json.Unmarshal(tocJSON, &toc); err != nil {
+			f.Close()
+			return nil, err
+		}
+		return &Fragment{Payload: f.Payload, TOC: &toc, closeFunc: f.Close}, nil
+	}
+	fragments := make([]*Fragment, len(parts))
+	var wg sync.WaitGroup
+	errCh := make(chan error, len(parts))
+	for i, p := range parts {
+		wg.Go(func() {
+			f, err := buildFragment(p)
+			if err != nil {
+				errCh <- err
+				return
+			}
+			fragments[i] = f
+		})
+	}
+	wg.Wait()
+	close(errCh)
+	defer func() {
+		for _, f := range fragments {
+			if f != nil {
+				f.Close()
+			}
+		}
+	}()
+	for err := range errCh {
+		t.Fatalf("failed to build fragments: %v", err)
+	}
+
+	readBlob := func(blob *Blob) []byte {
+		data, err := io.ReadAll(blob)
+		if err != nil {
+			t.Fatalf("failed to read blob: %v", err)
+		}
+		blob.Close()
+		if diffID := GzipDiffIDOf(t, data); diffID != blob.DiffID().String() {
+			t.Errorf("DiffID = %q; want %q", blob.DiffID(), diffID)
+		}
+		return data
+	}
+	blob, err := ConcatFragments(fragments, opts...)
+	if err != nil {
+		t.Fatalf("failed to concatenate fragments: %v", err)
+	}
+	data := readBlob(blob)
+
+	// Concatenation must be deterministic.
+	blob2, err := ConcatFragments(fragments, opts...)
+	if err != nil {
+		t.Fatalf("failed to concatenate fragments: %v", err)
+	}
+	if data2 := readBlob(blob2); !bytes.Equal(data, data2) {
+		t.Errorf("concatenation isn't deterministic")
+	}
+
+	r, err := Open(io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data))))
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+	if _, err := r.VerifyTOC(blob.TOCDigest()); err != nil {
+		t.Fatalf("failed to verify TOC: %v", err)
+	}
+	if _, ok := r.Lookup(PrefetchLandmark); !ok {
+		t.Errorf("prefetch landmark not found")
+	}
+	contents["bar/link"] = contents["bar/a"]
+	for name, want := range contents {
+		fr, err := r.OpenFile(name)
+		if err != nil {
+			t.Fatalf("failed to open %q: %v", name, err)
+		}
+		got := make([]byte, len(want))
+		if _, err := fr.ReadAt(got, 0); err != nil && err != io.EOF {
+			t.Fatalf("failed to read %q: %v", name, err)
+		}
+		if string(got) != want {
+			t.Errorf("%q: unexpected contents", name)
+		}
+	}
+
+	if _, err := ConcatFragments(nil); err == nil {
+		t.Errorf("concatenating no fragment must fail")
+	}
+}
+
+func TestDigestAlgorithm(t *testing.T) {
+	const chunkSize = 8192
+	contents := map[string]string{
+		"foo":     longstring(chunkSize*2 + 100),
+		"bar/baz": "baz",
+	}
+	in := tarOf(
+		file("foo", contents["foo"]),
+		dir("bar/"),
+		file("bar/baz", contents["bar/baz"]),
+	)
+	blob, err := Build(buildTar(t, in, ""), WithChunkSize(chunkSize), WithDigestAlgorithm(digest.SHA512))
+	if err != nil {
+		t.Fatalf("failed to build: %v", err)
+	}
+	data, err := io.ReadAll(blob)
+	if err != nil {
+		t.Fatalf("failed to read blob: %v", err)
+	}
+	blob.Close()
+	r, err := Open(io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data))))
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+	for _, e := range r.toc.Entries {
+		for _, d := range []string{e.Digest, e.ChunkDigest} {
+			if d == "" {
+				continue
+			}
+			if dgst, err := digest.Parse(d); err != nil || dgst.Algorithm() != digest.SHA512 {
+				t.Errorf("digest %q of %q must be sha512: %v", d, e.Name, err)
+			}
+		}
+	}
+	v, err := r.VerifyTOC(blob.TOCDigest())
+	if err != nil {
+		t.Fatalf("failed to verify TOC: %v", err)
+	}
+	for name, want := range contents {
+		e, ok := r.Lookup(name)
+		if !ok {
+			t.Fatalf("%q not found", name)
+		}
+		for off := int64(0); off < e.Size; off += chunkSize {
+			ce, ok := r.ChunkEntryForOffset(name, off)
+			if !ok {
+				t.Fatalf("chunk of %q at %d not found", name, off)
+			}
+			dv, err := v.Verifier(ce)
+			if err != nil {
+				t.Fatalf("failed to get verifier of %q: %v", name, err)
+			}
+			sr, err := r.OpenFile(name)
+			if err != nil {
+				t.Fatalf("failed to open %q: %v", name, err)
+			}
+			if _, err := io.Copy(dv, io.NewSectionReader(sr, ce.ChunkOffset, ce.ChunkSize)); err != nil {
+				t.Fatalf("failed to read %q: %v", name, err)
+			}
+			if !dv.Verified() {
+				t.Errorf("chunk of %q at %d isn't verified", name, off)
+			}
+		}
+		if e.Size != int64(len(want)) {
+			t.Errorf("size of %q = %d; want %d", name, e.Size, len(want))
+		}
+	}
+
+	if _, err := Build(buildTar(t, in, ""), WithDigestAlgorithm("blake3")); err == nil {
+		t.Errorf("unavailable digest algorithm must be rejected")
+	}
+}
+
+func TestCompressedTOC(t *testing.T) {
+	const chunkSize = 8192
+	contents := map[string]string{
+		"foo": longstring(chunkSize*3 + 100),
+	}
+	ents := []tarEntry{file("foo", contents["foo"]), dir("bar/")}
+	for i := 0; i < 1000; i++ {
+		name := fmt.Sprintf("bar/file%d", i)
+		contents[name] = name
+		ents = append(ents, file(name, name))
+	}
+	in := tarOf(ents...)
+
+	build := func(opts ...Option) (*Blob, []byte) {
+		blob, err := Build(buildTar(t, in, ""), append(opts, WithChunkSize(chunkSize))...)
+		if err != nil {
+			t.Fatalf("failed to build: %v", err)
+		}
+		data, err := io.ReadAll(blob)
+		if err != nil {
+			t.Fatalf("failed to read blob: %v", err)
+		}
+		blob.Close()
+		return blob, data
+	}
+	plainBlob, plainData := build()
+	blob, data := build(WithCompressedTOC())
+	if len(data) >= len(plainData) {
+		t.Errorf("size of blob with compressed TOC = %d; want < %d", len(data), len(plainData))
+	}
+	if blob.TOCDigest() != plainBlob.TOCDigest() {
+		t.Errorf("TOC digest = %q; want %q", blob.TOCDigest(), plainBlob.TOCDigest())
+	}
+	if diffID := GzipDiffIDOf(t, data); diffID != blob.DiffID().String() {
+		t.Errorf("DiffID = %q; want %q", blob.DiffID(), diffID)
+	}
+
+	// The footer is flagged.
+	footer := data[len(data)-FooterSize:]
+	if !bytes.Contains(footer, []byte{'S', 'Z'}) {
+		t.Errorf("footer isn't flagged")
+	}
+	gz := new(GzipDecompressor)
+	_, tocOffset, _, err := gz.ParseFooter(footer)
+	if err != nil {
+		t.Fatalf("failed to parse footer: %v", err)
+	}
+	tocR, err := gz.DecompressTOC(bytes.NewReader(data[tocOffset:]))
+	if err != nil {
+		t.Fatalf("failed to decompress TOC: %v", err)
+	}
+	tocJSON, err := io.ReadAll(tocR)
+	if err != nil {
+		t.Fatalf("failed to read TOC: %v", err)
+	}
+	tocR.Close()
+	if dgst := digest.FromBytes(tocJSON); dgst != blob.TOCDigest() {
+		t.Errorf("digest of decompressed TOC = %q; want %q", dgst, blob.TOCDigest())
+	}
+
+	r, err := Open(io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data))))
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+	if rep, err := r.VerifyReport(blob.TOCDigest()); err != nil || !rep.OK() {
+		t.Fatalf("failed to verify: %+v, %v", rep, err)
+	}
+	for name, want := range contents {
+		fr, err := r.OpenFile(name)
+		if err != nil {
+			t.Fatalf("failed to open %q: %v", name, err)
+		}
+		got := make([]byte, len(want))
+		if _, err := fr.ReadAt(got, 0); err != nil && err != io.EOF {
+			t.Fatalf("failed to read %q: %v", name, err)
+		}
+		if string(got) != want {
+			t.Errorf("%q: unexpected contents", name)
+		}
+	}
+	if _, ok := r.Lookup(CompressedTOCTarName); ok {
+		t.Errorf("compressed TOC must not be included in the TOC")
+	}
+
+	if _, err := Build(buildTar(t, in, ""), WithCompressedTOC(), WithCompression(nonGzipCompression{newGzipCompressionWithLevel(gzip.BestSpeed)})); err == nil {
+		t.Errorf("compressed TOC must be rejected for non-gzip compression")
+	}
+}
+
+// nonGzipCompression hides the underlying gzip compression.
+type nonGzipCompression struct {
+	Compression
+}
+
+func TestAccessTrace(t *testing.T) {
+	const chunkSize = 8192
+	contents := map[string]string{
+		"hot/big":  longstring(chunkSize*3 + 100),
+		"hot/a":    "a",
+		"hot/b":    "b",
+		"cold/big": longstring(chunkSize*3 + 100),
+		"cold/a":   "a",
+		"cold/b":   "b",
+	}
+	in := tarOf(
+		dir("cold/"),
+		file("cold/big", contents["cold/big"]),
+		file("cold/a", contents["cold/a"]),
+		file("cold/b", contents["cold/b"]),
+		dir("hot/"),
+		file("hot/big", contents["hot/big"]),
+		file("hot/a", contents["hot/a"]),
+		file("hot/b", contents["hot/b"]),
+	)
+	blob, err := Build(buildTar(t, in, ""), WithChunkSize(chunkSize), WithAccessTrace([]string{"hot/big", "hot/a", "/hot/b"}))
+	if err != nil {
+		t.Fatalf("failed to build: %v", err)
+	}
+	data, err := io.ReadAll(blob)
+	if err != nil {
+		t.Fatalf("failed to read blob: %v", err)
+	}
+	blob.Close()
+	r, err := Open(io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data))))
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+	if rep, err := r.VerifyReport(blob.TOCDigest()); err != nil || !rep.OK() {
+		t.Fatalf("failed to verify: %+v, %v", rep, err)
+	}
+	for name, want := range contents {
+		sr, err := r.OpenFile(name)
+		if err != nil {
+			t.Fatalf("failed to open %q: %v", name, err)
+		}
+		got, err := io.ReadAll(sr)
+		if err != nil || string(got) != want {
+			t.Errorf("unexpected contents of %q: %v", name, err)
+		}
+	}
+
+	chunks := make(map[string][]Chunk)
+	for c := range r.Chunks() {
+		chunks[c.Name] = append(chunks[c.Name], c)
+	}
+	// Accessed files are split into large chunks and compressed together.
+	if n := len(chunks["hot/big"]); n != 1 {
+		t.Errorf("number of chunks of the accessed file = %d; want 1", n)
+	}
+	if o := chunks["hot/big"][0].Offset; chunks["hot/a"][0].Offset != o || chunks["hot/b"][0].Offset != o {
+		t.Errorf("accessed files must be compressed together: %+v", chunks)
+	}
+	// Other files are split into small chunks and compressed separately.
+	if n := len(chunks["cold/big"]); n != 4 {
+		t.Errorf("number of chunks of the file read on demand = %d; want 4", n)
+	}
+	if chunks["cold/a"][0].Offset == chunks["cold/b"][0].Offset {
+		t.Errorf("files read on demand must be compressed separately: %+v", chunks)
+	}
+}
+
+func TestPrefetchTiers(t *testing.T) {
+	in := tarOf(
+		file("a", "a"),
+		file("b", "b"),
+		file("c", "c"),
+		file("d", "d"),
+		file("e", "e"),
+	)
+	for _, minChunkSize := range []int{0, 8192} {
+		t.Run(fmt.Sprintf("minChunkSize=%d", minChunkSize), func(t *testing.T) {
+			blob, err := Build(buildTar(t, in, ""), WithMinChunkSize(minChunkSize),
+				WithPrefetchTiers([][]string{{"c"}, {"/b", "a"}, {"d"}}))
+			if err != nil {
+				t.Fatalf("failed to build: %v", err)
+			}
+			data, err := io.ReadAll(blob)
+			if err != nil {
+				t.Fatalf("failed to read blob: %v", err)
+			}
+			blob.Close()
+			r, err := Open(io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data))))
+			if err != nil {
+				t.Fatalf("failed to open: %v", err)
+			}
+			if rep, err := r.VerifyReport(blob.TOCDigest()); err != nil || !rep.OK() {
+				t.Fatalf("failed to verify: %+v, %v", rep, err)
+			}
+			var names []string
+			offsets := make(map[string]int64)
+			for _, e := range r.toc.Entries {
+				if e.Type == "reg" {
+					names = append(names, e.Name)
+					offsets[e.Name] = e.Offset
+				}
+			}
+			want := []string{"c", PrefetchTierLandmark(0), "b", "a", PrefetchTierLandmark(1), "d", PrefetchLandmark, "e"}
+			if !reflect.DeepEqual(names, want) {
+				t.Fatalf("entries = %v; want %v", names, want)
+			}
+			// Tiers must be fetchable separately.
+			if !(offsets["c"] < offsets[PrefetchTierLandmark(0)] &&
+				offsets[PrefetchTierLandmark(0)] <= offsets["b"] &&
+				offsets["a"] < offsets[PrefetchTierLandmark(1)] &&
+				offsets[PrefetchTierLandmark(1)] <= offsets["d"] &&
+				offsets["d"] < offsets[PrefetchLandmark]) {
+				t.Errorf("landmarks must start new gzip streams: %v", offsets)
+			}
+		})
+	}
+}
+
+func TestPrioritizedFilesFromTar(t *testing.T) {
+	in := tarOf(
+		file("a", "a"),
+		dir("b/"),
+		file("b/c", "c"),
+		file("d", "d"),
+		file("e", "e"),
+	)
+	base := time.Unix(1700000000, 0)
+	var index bytes.Buffer
+	if err := WriteAccessOrderIndex(&index, []AccessOrderEntry{
+		{Path: "/d", FirstAccess: base.Add(3 * time.Millisecond)},
+		{Path: "b/c", FirstAccess: base.Add(2 * time.Millisecond)},
+		{Path: "missing", FirstAccess: base.Add(time.Millisecond)},
+		{Path: "a", FirstAccess: base.Add(3 * time.Millisecond)},
+		{Path: "./b/c", FirstAccess: base}, // the earliest access is used
+	}); err != nil {
+		t.Fatalf("failed to write index: %v", err)
+	}
+	var missed []string
+	blob, err := Build(buildTar(t, in, ""),
+		WithPrioritizedFilesFromTar(&index), WithAllowPrioritizeNotFound(&missed))
+	if err != nil {
+		t.Fatalf("failed to build: %v", err)
+	}
+	data, err := io.ReadAll(blob)
+	if err != nil {
+		t.Fatalf("failed to read blob: %v", err)
+	}
+	blob.Close()
+	r, err := Open(io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data))))
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+	var names []string
+	for _, e := range r.toc.Entries {
+		names = append(names, e.Name)
+	}
+	want := []string{"b", "b/c", "d", "a", PrefetchLandmark, "e"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("entries = %v; want %v", names, want)
+	}
+	if !reflect.DeepEqual(missed, []string{"missing"}) {
+		t.Errorf("missed files = %v; want [missing]", missed)
+	}
+
+	if _, err := Build(buildTar(t, in, ""), WithPrioritizedFilesFromTar(strings.NewReader("invalid"))); err == nil {
+		t.Errorf("invalid index must be rejected")
+	}
+}
+
+func TestIsLandmark(t *testing.T) {
+	for name, want := range map[string]bool{
+		PrefetchLandmark:              true,
+		NoPrefetchLandmark:            true,
+		PrefetchTierLandmark(0):       true,
+		PrefetchTierLandmark(3):       true,
+		PrefetchLandmark + ".tierfoo": false,
+		"foo/" + PrefetchLandmark:     false,
+		"foo":                         false,
+	} {
+		if got := IsLandmark(name); got != want {
+			t.Errorf("IsLandmark(%q) = %v; want %v", name, got, want)
+		}
+	}
+}
+
+func TestDeltaBase(t *testing.T) {
+	const chunkSize = 8192
+	var (
+		shared  = strings.Repeat("a", chunkSize) + strings.Repeat("b", chunkSize)
+		changed = strings.Repeat("a", chunkSize) + strings.Repeat("c", chunkSize)
+	)
+	baseBlob, err := Build(buildTar(t, tarOf(
+		file("shared", shared),
+		file("changed", shared),
+		file("removed", "removed"),
+	), ""), WithChunkSize(chunkSize))
+	if err != nil {
+		t.Fatalf("failed to build base: %v", err)
+	}
+	baseData, err := io.ReadAll(baseBlob)
+	if err != nil {
+		t.Fatalf("failed to read base: %v", err)
+	}
+	baseBlob.Close()
+	base, err := Open(io.NewSectionReader(bytes.NewReader(baseData), 0, int64(len(baseData))))
+	if err != nil {
+		t.Fatalf("failed to open base: %v", err)
+	}
+
+	baseDigests := make(map[string]bool)
+	for c := range base.Chunks() {
+		baseDigests[c.Digest.String()] = true
+	}
+
+	contents := map[string]string{"shared": shared, "changed": changed, "new": "new"}
+	wantBase := map[string]int{"shared": 2, "changed": 1}
+	for _, minChunkSize := range []int{0, 64000} {
+		t.Run(fmt.Sprintf("min-chunk-size=%d", minChunkSize), func(t *testing.T) {
+			blob, err := Build(buildTar(t, tarOf(
+				file("shared", contents["shared"]),
+				file("changed", contents["changed"]),
+				file("new", contents["new"]),
+			), ""), WithChunkSize(chunkSize), WithMinChunkSize(minChunkSize), WithDeltaBase(base))
+			if err != nil {
+				t.Fatalf("failed to build: %v", err)
+			}
+			data, err := io.ReadAll(blob)
+			if err != nil {
+				t.Fatalf("failed to read blob: %v", err)
+			}
+			blob.Close()
+			r, err := Open(io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data))))
+			if err != nil {
+				t.Fatalf("failed to open: %v", err)
+			}
+			if r.toc.Base != base.TOCDigest().String() {
+				t.Errorf("base = %q; want %q", r.toc.Base, base.TOCDigest())
+			}
+			if rep, err := r.VerifyReport(blob.TOCDigest()); err != nil || !rep.OK() {
+				t.Fatalf("failed to verify: %+v, %v", rep, err)
+			}
+			baseChunks := make(map[string]int)
+			for _, e := range r.toc.Entries {
+				if !e.BaseChunk {
+					continue
+				}
+				baseChunks[e.Name]++
+				if e.Offset != 0 {
+					t.Errorf("%q: offset of base chunk must be zero: %d", e.Name, e.Offset)
+				}
+				if !baseDigests[e.ChunkDigest] {
+					t.Errorf("%q: chunk %q not found in base", e.Name, e.ChunkDigest)
+				}
+			}
+			if !reflect.DeepEqual(baseChunks, wantBase) {
+				t.Errorf("base chunks = %v; want %v", baseChunks, wantBase)
+			}
+			for c := range r.Chunks() {
+				if c.Name == "shared" {
+					t.Errorf("base chunk must not be yielded: %+v", c)
+				}
+			}
+
+			// Chunks stored in the delta blob are readable but base chunks aren't.
+			fr, err := r.OpenFile("changed")
+			if err != nil {
+				t.Fatalf("failed to open: %v", err)
+			}
+			got := make([]byte, chunkSize)
+			if _, err := fr.ReadAt(got, chunkSize); err != nil && err != io.EOF {
+				t.Fatalf("failed to read stored chunk: %v", err)
+			}
+			if string(got) != changed[chunkSize:] {
+				t.Errorf("unexpected contents of stored chunk")
+			}
+			if _, err := fr.ReadAt(got, 0); !errors.Is(err, ErrBaseChunk) {
+				t.Errorf("reading base chunk = %v; want %v", err, ErrBaseChunk)
+			}
+		})
+	}
+}
+
+func TestDedupFiles(t *testing.T) {
+	const chunkSize = 8192
+	shared := longstring(chunkSize*2 + 100)
+	in := tarOf(
+		file("foo", shared),
+		dir("dup/"),
+		file("dup/foo", shared),
+		file("mode", shared, os.FileMode(0600)),
+		file("owner", shared, owner{uid: 1000, gid: 1000}),
+		file("bar", "bar"),
+		file("dup/bar", "bar", os.FileMode(0755)),
+		file("empty", ""),
+		file("dup/empty", ""),
+	)
+	wantDedup := map[string]string{
+		"dup/foo": "foo",
+		"mode":    "foo",
+		"owner":   "foo",
+		"dup/bar": "bar",
+	}
+	for _, minChunkSize := range []int{0, 64000} {
+		t.Run(fmt.Sprintf("min-chunk-size=%d", minChunkSize), func(t *testing.T) {
+			blob, err := Build(buildTar(t, in, ""), WithChunkSize(chunkSize), WithMinChunkSize(minChunkSize), WithDedupFiles())
+			if err != nil {
+				t.Fatalf("failed to build: %v", err)
+			}
+			data, err := io.ReadAll(blob)
+			if err != nil {
+				t.Fatalf("failed to read blob: %v", err)
+			}
+			blob.Close()
+			if diffID := GzipDiffIDOf(t, data); diffID != blob.DiffID().String() {
+				t.Errorf("DiffID = %q; want %q", blob.DiffID(), diffID)
+			}
+			r, err := Open(io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data))))
+			if err != nil {
+				t.Fatalf("failed to open: %v", err)
+			}
+			if rep, err := r.VerifyReport(blob.TOCDigest()); err != nil || !rep.OK() {
+				t.Fatalf("failed to verify: %+v, %v", rep, err)
+			}
+			dedup := make(map[string]string)
+			for _, e := range r.toc.Entries {
+				if e.Dedup == "" {
+					continue
+				}
+				dedup[e.Name] = e.Dedup
+				if e.Offset != 0 {
+					t.Errorf("%q: offset of deduplicated file must be zero: %d", e.Name, e.Offset)
+				}
+			}
+			if !reflect.DeepEqual(dedup, wantDedup) {
+				t.Errorf("deduplicated files = %v; want %v", dedup, wantDedup)
+			}
+			for c := range r.Chunks() {
+				if _, ok := dedup[c.Name]; ok {
+					t.Errorf("chunk of deduplicated file must not be yielded: %+v", c)
+				}
+			}
+
+			for name, want := range map[string]string{
+				"foo": shared, "dup/foo": shared, "mode": shared, "owner": shared,
+				"bar": "bar", "dup/bar": "bar",
+			} {
+				fr, err := r.OpenFile(name)
+				if err != nil {
+					t.Fatalf("failed to open %q: %v", name, err)
+				}
+				got := make([]byte, len(want))
+				if _, err := fr.ReadAt(got, 0); err != nil && err != io.EOF {
+					t.Fatalf("failed to read %q: %v", name, err)
+				}
+				if string(got) != want {
+					t.Errorf("%q: unexpected contents", name)
+				}
+			}
+			ce, ok := r.ChunkEntryForOffset("mode", chunkSize+1)
+			if !ok || ce.ChunkOffset != chunkSize || ce.ChunkSize != chunkSize {
+				t.Errorf("unexpected chunk of mode at %d: %+v, %v", chunkSize+1, ce, ok)
+			}
+
+			// Deduplicated files keep their own attributes.
+			for name, wantMode := range map[string]os.FileMode{"mode": 0600, "dup/bar": 0755} {
+				e, ok := r.Lookup(name)
+				if !ok {
+					t.Fatalf("%q not found", name)
+				}
+				if e.Stat().Mode().Perm() != wantMode {
+					t.Errorf("mode of %q = %v; want %v", name, e.Stat().Mode().Perm(), wantMode)
+				}
+				if e.NumLink != 1 {
+					t.Errorf("link count of %q = %d; want 1", name, e.NumLink)
+				}
+			}
+		})
+	}
+}
+
+func TestCompressibility(t *testing.T) {
+	random := make([]byte, entropySampleSize)
+	if _, err := rand.Read(random); err != nil {
+		t.Fatalf("failed to read random bytes: %v", err)
+	}
+	mod100 := make([]byte, len(random))
+	for i, b := range random {
+		mod100[i] = b % 100
+	}
+	for _, tt := range []struct {
+		name   string
+		sample []byte
+		want   Compressibility
+	}{
+		{"zeros", make([]byte, entropySampleSize), Compressible},
+		{"text", []byte(strings.Repeat("the quick brown fox jumps over the lazy dog\n", 1000)), Compressible},
+		{"hex", []byte(hex.EncodeToString(random)), Compressible},
+		{"100 symbols", mod100, PoorlyCompressible},
+		{"random", random, Incompressible},
+		{"small random", random[:minEntropySampleSize-1], Compressible},
+	} {
+		if got := compressibilityOf(tt.sample); got != tt.want {
+			t.Errorf("%s: compressibility = %d; want %d", tt.name, got, tt.want)
+		}
+	}
+	for _, tt := range []struct {
+		c     Compressibility
+		level int
+		want  int
+	}{
+		{Compressible, gzip.BestCompression, gzip.BestCompression},
+		{PoorlyCompressible, gzip.BestCompression, gzip.BestSpeed},
+		{PoorlyCompressible, gzip.DefaultCompression, gzip.BestSpeed},
+		{PoorlyCompressible, gzip.NoCompression, gzip.NoCompression},
+		{Incompressible, gzip.BestCompression, gzip.NoCompression},
+	} {
+		if got := tt.c.GzipLevel(tt.level); got != tt.want {
+			t.Errorf("gzip level of %d for level %d = %d; want %d", tt.c, tt.level, got, tt.want)
+		}
+	}
+}
+
+func TestAdaptiveCompression(t *testing.T) {
+	random := make([]byte, 32000)
+	if _, err := rand.Read(random); err != nil {
+		t.Fatalf("failed to read random bytes: %v", err)
+	}
+	text := strings.Repeat("the quick brown fox jumps over the lazy dog\n", 1000)
+	contents := map[string]string{"random": string(random), "text": text, "small": "small"}
+	for _, minChunkSize := range []int{0, 64000} {
+		t.Run(fmt.Sprintf("min-chunk-size=%d", minChunkSize), func(t *testing.T) {
+			blob, err := Build(buildTar(t, tarOf(
+				file("text", contents["text"]),
+				file("random", contents["random"]),
+				file("small", contents["small"]),
+			), ""), WithMinChunkSize(minChunkSize), WithCompressionLevel(gzip.BestCompression), WithAdaptiveCompression())
+			if err != nil {
+				t.Fatalf("failed to build: %v", err)
+			}
+			data, err := io.ReadAll(blob)
+			if err != nil {
+				t.Fatalf("failed to read blob: %v", err)
+			}
+			blob.Close()
+			if diffID := GzipDiffIDOf(t, data); diffID != blob.DiffID().String() {
+				t.Errorf("DiffID = %q; want %q", blob.DiffID(), diffID)
+			}
+			r, err := Open(io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data))))
+			if err != nil {
+				t.Fatalf("failed to open: %v", err)
+			}
+			if rep, err := r.VerifyReport(blob.TOCDigest()); err != nil || !rep.OK() {
+				t.Fatalf("failed to verify: %+v, %v", rep, err)
+			}
+			for name, want := range contents {
+				fr, err := r.OpenFile(name)
+				if err != nil {
+					t.Fatalf("failed to open %q: %v", name, err)
+				}
+				got := make([]byte, len(want))
+				if _, err := fr.ReadAt(got, 0); err != nil && err != io.EOF {
+					t.Fatalf("failed to read %q: %v", name, err)
+				}
+				if string(got) != want {
+					t.Errorf("%q: unexpected contents", name)
+				}
+			}
+			chunks := make(map[string]Chunk)
+			for c := range r.Chunks() {
+				chunks[c.Name] = c
+			}
+			// The incompressible file is stored in its own stream without compression.
+			if c := chunks["random"]; c.InnerOffset != 0 || c.CompressedSize < c.ChunkSize {
+				t.Errorf("random file must be stored without compression: %+v", c)
+			}
+			if c := chunks["text"]; c.CompressedSize >= c.ChunkSize/10 {
+				t.Errorf("text file must be compressed: %+v", c)
+			}
+			if chunks["random"].Offset == chunks["text"].Offset || chunks["random"].Offset == chunks["small"].Offset {
+				t.Errorf("files of different compressibility must not share the stream: %+v", chunks)
+			}
+		})
+	}
+}
+
+// countingDecompressor counts the streams read by decompressing and by skipping the
+// framing of the compression.
+type countingDecompressor struct {
+	*GzipDecompressor
+	decompressed, raw int
+}
+
+func (d *countingDecompressor) Reader(r io.Reader) (io.ReadCloser, error) {
+	d.decompressed++
+	return d.GzipDecompressor.Reader(r)
+}
+
+func (d *countingDecompressor) RawReader(r io.Reader) (io.ReadCloser, error) {
+	d.raw++
+	return d.GzipDecompressor.RawReader(r)
+}
+
+func TestUncompressedPayload(t *testing.T) {
+	const chunkSize = 10000
+	random := make([]byte, 32000)
+	if _, err := rand.Read(random); err != nil {
+		t.Fatalf("failed to read random bytes: %v", err)
+	}
+	text := strings.Repeat("the quick brown fox jumps over the lazy dog\n", 1000)
+	contents := map[string]string{"random": string(random), "text": text}
+	blob, err := Build(buildTar(t, tarOf(
+		file("random", contents["random"]),
+		file("text", contents["text"]),
+	), ""), WithChunkSize(chunkSize), WithMinChunkSize(64000), WithAdaptiveCompression())
+	if err != nil {
+		t.Fatalf("failed to build: %v", err)
+	}
+	data, err := io.ReadAll(blob)
+	if err != nil {
+		t.Fatalf("failed to read blob: %v", err)
+	}
+	blob.Close()
+	r, err := Open(io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data))))
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+	for _, e := range r.toc.Entries {
+		if e.isDataType() && e.Uncompressed != (e.Name == "random") {
+			t.Errorf("uncompressed of %q chunk at %d = %v", e.Name, e.ChunkOffset, e.Uncompressed)
+		}
+	}
+	d := &countingDecompressor{GzipDecompressor: r.decompressor.(*GzipDecompressor)}
+	r.decompressor = d
+
+	readChunks := func(t *testing.T, name string, preRead func(*TOCEntry, io.Reader) error) {
+		fr, err := r.OpenFileWithPreReader(name, preRead)
+		if err != nil {
+			t.Fatalf("failed to open %q: %v", name, err)
+		}
+		want := contents[name]
+		for off := 0; off < len(want); off += chunkSize {
+			got := make([]byte, min(chunkSize, len(want)-off))
+			if _, err := fr.ReadAt(got, int64(off)); err != nil && err != io.EOF {
+				t.Fatalf("failed to read %q at %d: %v", name, off, err)
+			}
+			if string(got) != want[off:off+len(got)] {
+				t.Errorf("%q: unexpected contents at %d", name, off)
+			}
+		}
+	}
+
+	// Uncompressed chunks are read without decompression.
+	readChunks(t, "random", nil)
+	preRead := make(map[int64]string)
+	readChunks(t, "random", func(e *TOCEntry, cr io.Reader) error {
+		b, err := io.ReadAll(cr)
+		preRead[e.ChunkOffset] = string(b)
+		return err
+	})
+	if d.decompressed != 0 || d.raw == 0 {
+		t.Errorf("uncompressed chunks must be read without decompression: decompressed=%d, raw=%d", d.decompressed, d.raw)
+	}
+	if len(preRead) == 0 {
+		t.Errorf("chunks sharing the stream must be pre-read")
+	}
+	for off, got := range preRead {
+		if got != contents["random"][off:off+int64(len(got))] {
+			t.Errorf("unexpected pre-read contents at %d", off)
+		}
+	}
+
+	// Compressed chunks wrongly recorded as uncompressed are decompressed.
+	for _, e := range r.toc.Entries {
+		if e.Name == "text" {
+			e.Uncompressed = true
+		}
+	}
+	d.decompressed, d.raw = 0, 0
+	readChunks(t, "text", nil)
+	if d.decompressed == 0 || d.raw == 0 {
+		t.Errorf("compressed chunks must fall back to decompression: decompressed=%d, raw=%d", d.decompressed, d.raw)
+	}
+}
+
+func TestBuildProgress(t *testing.T) {
+	const chunkSize = 1000
+	in := tarOf(
+		dir("a/"),
+		file("a/foo", longstring(chunkSize*5)),
+		file("a/bar", "bar"),
+		file("baz", longstring(chunkSize*2+1)),
+		symlink("link", "baz"),
+	)
+	for _, minChunkSize := range []int{0, 64000} {
+		t.Run(fmt.Sprintf("min-chunk-size=%d", minChunkSize), func(t *testing.T) {
+			var reports []Progress
+			blob, err := Build(buildTar(t, in, ""), WithChunkSize(chunkSize), WithMinChunkSize(minChunkSize),
+				WithProgress(func(p Progress) { reports = append(reports, p) }))
+			if err != nil {
+				t.Fatalf("failed to build: %v", err)
+			}
+			data, err := io.ReadAll(blob)
+			if err != nil {
+				t.Fatalf("failed to read blob: %v", err)
+			}
+			blob.Close()
+			r, err := Open(io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data))))
+			if err != nil {
+				t.Fatalf("failed to open: %v", err)
+			}
+			var entries int64
+			for _, e := range r.toc.Entries {
+				if e.Type != "chunk" {
+					entries++
+				}
+			}
+			if len(reports) != int(entries)+1 {
+				t.Fatalf("got %d reports; want %d", len(reports), entries+1)
+			}
+			var prev Progress
+			for _, p := range reports[:len(reports)-1] {
+				if p.CurrentFile == "" || p.Entries < prev.Entries || p.BytesWritten < prev.BytesWritten {
+					t.Errorf("unexpected progress %+v after %+v", p, prev)
+				}
+				prev = p
+			}
+			last := reports[len(reports)-1]
+			if last.CurrentFile != "" || last.Entries != entries {
+				t.Errorf("last progress = %+v; want %d entries", last, entries)
+			}
+			if last.BytesWritten <= 0 || last.BytesWritten >= int64(len(data)) {
+				t.Errorf("bytes written = %d; want less than the blob size %d", last.BytesWritten, len(data))
+			}
+		})
+	}
+}
+
+// recordScanner records the contents of the entries and reports the entries whose
+// contents contain the keywords.
+type recordScanner struct {
+	reject, annotate string
+	mu               sync.Mutex
+	contents         map[string]string
+}
+
+func (s *recordScanner) Scan(h *tar.Header, r io.Reader) (ScanVerdict, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return ScanVerdict{}, err
+	}
+	s.mu.Lock()
+	s.contents[cleanEntryName(h.Name)] = string(b)
+	s.mu.Unlock()
+	switch {
+	case s.reject != "" && strings.Contains(string(b), s.reject):
+		return ScanVerdict{Reject: true, Reason: "found " + s.reject}, nil
+	case s.annotate != "" && strings.Contains(string(b), s.annotate):
+		return ScanVerdict{Reason: "found " + s.annotate, Annotations: map[string]string{"scanned/" + path.Base(h.Name): s.annotate}}, nil
+	}
+	return ScanVerdict{}, nil
+}
+
+// scanFunc is a Scanner that doesn't necessarily read the contents.
+type scanFunc func(*tar.Header, io.Reader) (ScanVerdict, error)
+
+func (f scanFunc) Scan(h *tar.Header, r io.Reader) (ScanVerdict, error) { return f(h, r) }
+
+func TestScanners(t *testing.T) {
+	large := strings.Repeat("large file ", 100000) // larger than the buffers of pipes
+	in := tarOf(
+		dir("dir/"),
+		file("dir/secret", "xxx SECRET xxx"),
+		file("dir/todo", "xxx TODO xxx"),
+		file("large", large),
+		file("dup", "xxx TODO xxx"),
+		file("empty", ""),
+	)
+	contents := map[string]string{"dir": "", "dir/secret": "xxx SECRET xxx", "dir/todo": "xxx TODO xxx", "large": large, "dup": "xxx TODO xxx", "empty": ""}
+	skip := scanFunc(func(*tar.Header, io.Reader) (ScanVerdict, error) { return ScanVerdict{}, nil })
+	for _, opts := range [][]Option{nil, {WithDedupFiles()}, {WithChunkSize(1000), WithMinChunkSize(10000)}} {
+		rec := &recordScanner{annotate: "TODO", contents: make(map[string]string)}
+		blob, err := Build(buildTar(t, in, ""), append(opts, WithScanners(skip, rec))...)
+		if err != nil {
+			t.Fatalf("failed to build: %v", err)
+		}
+		if _, err := io.Copy(io.Discard, blob); err != nil {
+			t.Fatalf("failed to read blob: %v", err)
+		}
+		blob.Close()
+		for name, want := range contents {
+			if got, ok := rec.contents[name]; !ok || got != want {
+				t.Errorf("scanned contents of %q = %d bytes (scanned: %v); want %d bytes", name, len(got), ok, len(want))
+			}
+		}
+		var names []string
+		for _, f := range blob.ScanFindings() {
+			names = append(names, f.Name)
+		}
+		slices.Sort(names)
+		if want := []string{"dir/todo", "dup"}; !slices.Equal(names, want) {
+			t.Errorf("findings = %v; want %v", names, want)
+		}
+		want := map[string]string{"scanned/todo": "TODO", "scanned/dup": "TODO"}
+		if got := ScanAnnotations(blob.ScanFindings()); !reflect.DeepEqual(got, want) {
+			t.Errorf("annotations = %v; want %v", got, want)
+		}
+	}
+
+	// A rejected entry fails the build.
+	rec := &recordScanner{reject: "SECRET", contents: make(map[string]string)}
+	_, err := Build(buildTar(t, in, ""), WithScanners(rec))
+	var rerr *ScanRejectedError
+	if !errors.As(err, &rerr) || rerr.Name != "dir/secret" {
+		t.Errorf("build must be rejected at dir/secret: %v", err)
+	}
+
+	// An error of a scanner fails the build.
+	scanErr := errors.New("scanner failure")
+	if _, err := Build(buildTar(t, in, ""), WithScanners(scanFunc(func(*tar.Header, io.Reader) (ScanVerdict, error) {
+		return ScanVerdict{}, scanErr
+	}))); !errors.Is(err, scanErr) {
+		t.Errorf("build must fail with the error of the scanner: %v", err)
+	}
+}
+
+func TestBuildCancel(t *testing.T) {
+	in := tarOf(
+		file("foo", "foo"),
+		file("bar", "bar"),
+		file("baz", "baz"),
+	)
+
+	// Canceled before building
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := Build(buildTar(t, in, ""), WithContext(ctx)); !errors.Is(err, context.Canceled) {
+		t.Errorf("build with canceled context = %v; want %v", err, context.Canceled)
+	}
+
+	// Canceled while building
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	var files []string
+	_, err := Build(buildTar(t, in, ""), WithContext(ctx), WithMinChunkSize(64000), WithProgress(func(p Progress) {
+		files = append(files, p.CurrentFile)
+		cancel()
+	}))
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("build canceled in progress = %v; want %v", err, context.Canceled)
+	}
+	if len(files) != 1 {
+		t.Errorf("entries processed after cancellation: %v", files)
+	}
+}
+
+func TestPrefetchCoverage(t *testing.T) {
+	shared := longstring(100)
+	in := tarOf(
+		file("a", "aaaaaaaaaa"),
+		dir("foo/"),
+		file("foo/b", "bbbbbbbbbbbbbbbbbbbb"),
+		file("c", shared),
+		file("d", ""),
+		link("foo/link", "c"),
+		file("e", shared),
+	)
+	tests := []struct {
+		name        string
+		prioritized []string
+		opts        []Option
+		want        PrefetchCoverage
+	}{
+		{name: "no-prioritized", want: PrefetchCoverage{0, 230}},
+		{name: "prioritized", prioritized: []string{"a", "foo/b"}, want: PrefetchCoverage{30, 230}},
+		{name: "all", prioritized: []string{"a", "foo/b", "c", "d", "e"}, want: PrefetchCoverage{230, 230}},
+		// "e" is stored as the duplicate of the prioritized "c".
+		{name: "dedup", prioritized: []string{"c"}, opts: []Option{WithDedupFiles()}, want: PrefetchCoverage{200, 230}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			blob, err := Build(buildTar(t, in, ""), append(tt.opts, WithPrioritizedFiles(tt.prioritized))...)
+			if err != nil {
+				t.Fatalf("failed to build: %v", err)
+			}
+			if _, err := io.Copy(io.Discard, blob); err != nil {
+				t.Fatalf("failed to read blob: %v", err)
+			}
+			blob.Close()
+			got := blob.PrefetchCoverage()
+			if got != tt.want {
+				t.Errorf("coverage = %+v; want %+v", got, tt.want)
+			}
+			parsed, err := ParsePrefetchCoverage(got.String())
+			if err != nil || parsed != got {
+				t.Errorf("failed to parse %q: %+v, %v", got, parsed, err)
+			}
+		})
+	}
+
+	for _, s := range []string{"", "10", "a/10", "10/a", "-1/10", "11/10"} {
+		if _, err := ParsePrefetchCoverage(s); err == nil {
+			t.Errorf("invalid coverage %q must be rejected", s)
+		}
+	}
+	if r := (PrefetchCoverage{30, 120}).Add(PrefetchCoverage{10, 80}).Ratio(); r != 0.2 {
+		t.Errorf("ratio = %v; want 0.2", r)
+	}
+}
@@ -0,0 +1,105 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package estargz
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// PrefetchCoverage is the size of the prioritized files of a blob (i.e. the regular files
+// whose contents are stored before PrefetchLandmark) compared to the size of all regular
+// files. Hardlinks and landmarks aren't counted. Deduplicated files (see WithDedupFiles) are
+// counted as stored where the contents of the preceding file are.
+type PrefetchCoverage struct {
+	// PrefetchSize is the uncompressed size of the prioritized files.
+	PrefetchSize int64
+
+	// TotalSize is the uncompressed size of all regular files.
+	TotalSize int64
+}
+
+// Ratio returns the fraction of the size of all regular files the prioritized files
+// constitute, in [0, 1].
+func (c PrefetchCoverage) Ratio() float64 {
+	if c.TotalSize <= 0 {
+		return 0
+	}
+	return float64(c.PrefetchSize) / float64(c.TotalSize)
+}
+
+// Add returns the coverage of the blobs of c and o combined (e.g. layers of an image).
+func (c PrefetchCoverage) Add(o PrefetchCoverage) PrefetchCoverage {
+	return PrefetchCoverage{PrefetchSize: c.PrefetchSize + o.PrefetchSize, TotalSize: c.TotalSize + o.TotalSize}
+}
+
+// String returns the value of PrefetchCoverageAnnotation ("<prefetch size>/<total size>").
+func (c PrefetchCoverage) String() string {
+	return fmt.Sprintf("%d/%d", c.PrefetchSize, c.TotalSize)
+}
+
+// ParsePrefetchCoverage parses the value of PrefetchCoverageAnnotation.
+func ParsePrefetchCoverage(s string) (PrefetchCoverage, error) {
+	p, t, ok := strings.Cut(s, "/")
+	if !ok {
+		return PrefetchCoverage{}, fmt.Errorf("invalid prefetch coverage %q", s)
+	}
+	prefetchSize, err := strconv.ParseInt(p, 10, 64)
+	if err != nil {
+		return PrefetchCoverage{}, fmt.Errorf("invalid prefetch size of prefetch coverage %q: %w", s, err)
+	}
+	totalSize, err := strconv.ParseInt(t, 10, 64)
+	if err != nil {
+		return PrefetchCoverage{}, fmt.Errorf("invalid total size of prefetch coverage %q: %w", s, err)
+	}
+	if prefetchSize < 0 || totalSize < prefetchSize {
+		return PrefetchCoverage{}, fmt.Errorf("invalid sizes of prefetch coverage %q", s)
+	}
+	return PrefetchCoverage{PrefetchSize: prefetchSize, TotalSize: totalSize}, nil
+}
+
+// prefetchCoverage returns the prefetch coverage of the blob of the TOC.
+func prefetchCoverage(toc *JTOC) (c PrefetchCoverage) {
+	landmark := int64(-1) // nothing is prefetched without the landmark
+	offsets := make(map[string]int64)
+	for _, e := range toc.Entries {
+		switch {
+		case e.Type != "reg":
+			continue
+		case e.Name == NoPrefetchLandmark:
+			landmark = -1
+		case e.Name == PrefetchLandmark:
+			landmark = e.Offset
+		}
+		offsets[cleanEntryName(e.Name)] = e.Offset
+	}
+	for _, e := range toc.Entries {
+		if e.Type != "reg" || IsLandmark(e.Name) {
+			continue
+		}
+		offset := e.Offset
+		if e.Dedup != "" {
+			offset = offsets[cleanEntryName(e.Dedup)]
+		}
+		c.TotalSize += e.Size
+		if e.Size > 0 && offset < landmark {
+			c.PrefetchSize += e.Size
+		}
+	}
+	return c
+}
@@ -0,0 +1,65 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package estargz
+
+import (
+	"fmt"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+// dedupSource returns the TOC entry of a preceding regular file whose contents have the
+// digest dgst.
+func (w *Writer) dedupSource(dgst digest.Digest) (*TOCEntry, bool) {
+	ent, ok := w.dedupSources[dgst]
+	return ent, ok
+}
+
+// addDedupSource records the regular file of ent as the file from which the following
+// files that have the contents of dgst are read.
+func (w *Writer) addDedupSource(ent *TOCEntry, dgst digest.Digest) {
+	if w.dedupSources == nil {
+		w.dedupSources = make(map[digest.Digest]*TOCEntry)
+		w.dedupSourceKeys = make(map[string]digest.Digest)
+	}
+	w.dedupSources[dgst] = ent
+	w.dedupSourceKeys[cleanEntryName(ent.Name)] = dgst
+}
+
+// forgetDedupSource stops using the file of the name as the source of duplicates.
+// This must be called when the name is overwritten by another entry.
+func (w *Writer) forgetDedupSource(name string) {
+	name = cleanEntryName(name)
+	if dgst, ok := w.dedupSourceKeys[name]; ok {
+		delete(w.dedupSources, dgst)
+		delete(w.dedupSourceKeys, name)
+	}
+}
+
+// resolveDedup makes the regular file of ent read from the chunks of the preceding file
+// recorded in ent.Dedup.
+func (r *Reader) resolveDedup(ent *TOCEntry) error {
+	src, ok := r.m[cleanEntryName(ent.Dedup)]
+	if !ok || src.Type != "reg" || src == ent {
+		return fmt.Errorf("deduplicated file %q refers to invalid file %q", ent.Name, ent.Dedup)
+	}
+	if src.Size != ent.Size {
+		return fmt.Errorf("size of deduplicated file %q (%d) doesn't match %q (%d)", ent.Name, ent.Size, ent.Dedup, src.Size)
+	}
+	r.chunks[ent.Name] = r.getChunks(src)
+	return nil
+}
@@ -0,0 +1,86 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package estargz
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+// ErrBaseChunk is returned when reading a chunk of a delta blob that isn't stored in
+// the blob but in the base blob. The chunk needs to be resolved from the base blob.
+var ErrBaseChunk = errors.New("chunk is stored in the base blob")
+
+// baseChunksOf reports which chunks of the spooled payload are stored in w.DeltaBase.
+// Holes are never reported. The returned slice is nil if no chunk is stored in the base.
+// f is rewound after reading.
+func (w *Writer) baseChunksOf(f *os.File, size, chunkSize int64, holes []bool) ([]bool, error) {
+	if w.baseChunks == nil {
+		w.baseChunks = make(map[string]struct{})
+		for c := range w.DeltaBase.Chunks() {
+			if c.Digest != "" {
+				w.baseChunks[c.Digest.String()] = struct{}{}
+			}
+		}
+	}
+	var (
+		based   []bool
+		hasBase bool
+		buf     = make([]byte, min(chunkSize, size))
+	)
+	for i, off := 0, int64(0); off < size; i, off = i+1, off+chunkSize {
+		b := buf[:min(chunkSize, size-off)]
+		if _, err := io.ReadFull(f, b); err != nil {
+			return nil, err
+		}
+		isBase := false
+		if holes == nil || !holes[i] {
+			dgstr, err := ChunkDigester(w.digestAlgorithm())
+			if err != nil {
+				return nil, err
+			}
+			dgstr.Hash().Write(b)
+			_, isBase = w.baseChunks[dgstr.Digest().String()]
+		}
+		hasBase = hasBase || isBase
+		based = append(based, isBase)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if !hasBase {
+		return nil, nil
+	}
+	return based, nil
+}
+
+// omittedChunks returns which chunks aren't stored in the blob, merging holes and
+// chunks stored in the base blob. This returns nil if all chunks are stored.
+func omittedChunks(holes, based []bool) []bool {
+	if based == nil {
+		return holes
+	}
+	if holes == nil {
+		return based
+	}
+	omitted := make([]bool, len(based))
+	for i := range omitted {
+		omitted[i] = holes[i] || based[i]
+	}
+	return omitted
+}
@@ -0,0 +1,92 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package estargz
+
+import (
+	"compress/gzip"
+	"math"
+)
+
+// Compressibility is the compressibility of the payload of a regular file estimated from
+// the entropy of the beginning of the payload.
+type Compressibility int
+
+const (
+	// Compressible payload is compressed with the configured compression level.
+	Compressible Compressibility = iota
+
+	// PoorlyCompressible payload is compressed with a fast compression level.
+	PoorlyCompressible
+
+	// Incompressible payload (e.g. already compressed assets) is stored without
+	// compression if the compression algorithm supports it.
+	Incompressible
+)
+
+const (
+	// entropySampleSize is the size of the beginning of the payload sampled for
+	// estimating the compressibility.
+	entropySampleSize = 64 << 10
+
+	// minEntropySampleSize is the minimal size of the sample. Smaller payloads are
+	// treated as compressible because the entropy of a few bytes is meaningless and
+	// the cost of compressing them is negligible.
+	minEntropySampleSize = 1 << 10
+
+	poorlyCompressibleEntropy = 6.0 // bits per byte
+	incompressibleEntropy     = 7.5 // bits per byte
+)
+
+// compressibilityOf estimates the compressibility of the payload from the Shannon entropy
+// of the sample.
+func compressibilityOf(sample []byte) Compressibility {
+	if len(sample) < minEntropySampleSize {
+		return Compressible
+	}
+	var counts [256]int
+	for _, b := range sample {
+		counts[b]++
+	}
+	var entropy float64
+	for _, c := range counts {
+		if c > 0 {
+			p := float64(c) / float64(len(sample))
+			entropy -= p * math.Log2(p)
+		}
+	}
+	switch {
+	case entropy >= incompressibleEntropy:
+		return Incompressible
+	case entropy >= poorlyCompressibleEntropy:
+		return PoorlyCompressible
+	}
+	return Compressible
+}
+
+// GzipLevel returns the gzip compression level used for the payload of the
+// compressibility instead of the configured level.
+func (c Compressibility) GzipLevel(level int) int {
+	switch c {
+	case Incompressible:
+		return gzip.NoCompression
+	case PoorlyCompressible:
+		if level > gzip.BestSpeed || level == gzip.DefaultCompression {
+			return gzip.BestSpeed
+		}
+	}
+	return level
+}
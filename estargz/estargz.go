@@ -25,14 +25,19 @@ package estargz
 import (
 	"bufio"
 	"bytes"
+	"cmp"
 	"compress/gzip"
 	"crypto/sha256"
+	_ "crypto/sha512" // for sha384 and sha512 digests in TOC
 	"errors"
 	"fmt"
 	"hash"
 	"io"
+	"iter"
+	"math"
 	"os"
 	"path"
+	"slices"
 	"sort"
 	"strings"
 	"sync"
@@ -56,9 +61,21 @@ type Reader struct {
 	// stored in m.
 	chunks map[string][]*TOCEntry
 
+	// hasBaseChunks is true if any chunk is stored in the base blob of the delta blob.
+	hasBaseChunks bool
+
+	// verifiableRanges is the index of the ranges for VerifiableRanges shared with clones.
+	verifiableRanges *rangeIndex
+
 	decompressor Decompressor
 }
 
+// rangeIndex is the ranges of the blob built on the first use.
+type rangeIndex struct {
+	once   sync.Once
+	ranges []CompressedRange
+}
+
 type openOpts struct {
 	tocOffset     int64
 	decompressors []Decompressor
@@ -143,17 +160,27 @@ func Open(sr *io.SectionReader, opt ...OpenOption) (*Reader, error) {
 	for _, d := range decompressors {
 		fSize := d.FooterSize()
 		fOffset := positive(int64(len(footer)) - fSize)
-		maybeTocBytes := footer[:fOffset]
 		_, tocOffset, tocSize, err := d.ParseFooter(footer[fOffset:])
 		if err != nil {
 			allErr = append(allErr, err)
 			continue
 		}
+		if tocOffset > sr.Size() {
+			allErr = append(allErr, &RangeError{Field: "tocOffset", Value: tocOffset, Limit: sr.Size()})
+			continue
+		}
 		if tocOffset >= 0 && tocSize <= 0 {
 			tocSize = sr.Size() - tocOffset - fSize
 		}
-		if tocOffset >= 0 && tocSize < int64(len(maybeTocBytes)) {
-			maybeTocBytes = maybeTocBytes[:tocSize]
+		if tocOffset >= 0 && (tocSize < 0 || tocSize > sr.Size()-tocOffset) {
+			allErr = append(allErr, &RangeError{Field: "tocSize", Value: tocSize, Limit: sr.Size() - tocOffset})
+			continue
+		}
+		// The fetched bytes may already contain the TOC. The footer can be followed by
+		// other metadata (e.g. tar-split) so the TOC is located by its offset in the blob.
+		var maybeTocBytes []byte
+		if fetchOffset := sr.Size() - int64(len(footer)); tocOffset >= fetchOffset && tocOffset+tocSize <= sr.Size() {
+			maybeTocBytes = footer[tocOffset-fetchOffset : tocOffset-fetchOffset+tocSize]
 		}
 		r, err = parseTOC(d, sr, tocOffset, tocSize, maybeTocBytes, opts)
 		if err == nil {
@@ -166,7 +193,7 @@ func Open(sr *io.SectionReader, opt ...OpenOption) (*Reader, error) {
 		return nil, errors.Join(allErr...)
 	}
 	if err := r.initFields(); err != nil {
-		return nil, fmt.Errorf("failed to initialize fields of entries: %v", err)
+		return nil, fmt.Errorf("failed to initialize fields of entries: %w", err)
 	}
 	return r, nil
 }
@@ -202,6 +229,7 @@ func OpenFooter(sr *io.SectionReader) (tocOffset int64, footerSize int64, rErr e
 func (r *Reader) initFields() error {
 	r.m = make(map[string]*TOCEntry, len(r.toc.Entries))
 	r.chunks = make(map[string][]*TOCEntry)
+	r.verifiableRanges = &rangeIndex{}
 	var lastPath string
 	uname := map[int]string{}
 	gname := map[int]string{}
@@ -209,6 +237,18 @@ func (r *Reader) initFields() error {
 	var chunkTopIndex int
 	for i, ent := range r.toc.Entries {
 		ent.Name = cleanEntryName(ent.Name)
+		// Zero chunks are read as holes (the contents in the blob aren't used).
+		if ent.ChunkType == ChunkTypeZeros {
+			ent.Hole, ent.Offset, ent.InnerOffset = true, 0, 0
+		}
+		r.hasBaseChunks = r.hasBaseChunks || ent.BaseChunk
+		fileEnt := ent
+		if ent.Type == "chunk" {
+			fileEnt = lastRegEnt
+		}
+		if err := checkEntryRange(ent, fileEnt); err != nil {
+			return err
+		}
 		switch ent.Type {
 		case "reg", "chunk":
 			if ent.Offset != r.toc.Entries[chunkTopIndex].Offset {
@@ -247,12 +287,18 @@ func (r *Reader) initFields() error {
 			r.m[ent.Name] = ent
 		}
 		if ent.Type == "reg" && ent.ChunkSize > 0 && ent.ChunkSize < ent.Size {
-			r.chunks[ent.Name] = make([]*TOCEntry, 0, ent.Size/ent.ChunkSize+1)
+			// The number of chunks can't exceed the number of the remaining entries.
+			r.chunks[ent.Name] = make([]*TOCEntry, 0, min(ent.Size/ent.ChunkSize+1, int64(len(r.toc.Entries)-i)))
 			r.chunks[ent.Name] = append(r.chunks[ent.Name], ent)
 		}
 		if ent.ChunkSize == 0 && ent.Size != 0 {
 			ent.ChunkSize = ent.Size
 		}
+		if ent.Type == "reg" && ent.Dedup != "" {
+			if err := r.resolveDedup(ent); err != nil {
+				return err
+			}
+		}
 	}
 
 	// Populate children, add implicit directories:
@@ -318,6 +364,24 @@ func (r *Reader) initFields() error {
 	return nil
 }
 
+// checkEntryRange checks that sizes and offsets of the entry are in the range of the file.
+// fileEnt is the entry of the regular file that contains the chunk entry. Offsets in the
+// blob aren't checked against the blob size because the reader doesn't always cover the
+// payload (e.g. external TOC).
+func checkEntryRange(ent, fileEnt *TOCEntry) error {
+	if err := errors.Join(
+		checkRange(ent.Name, "size", ent.Size, math.MaxInt64),
+		checkRange(ent.Name, "offset", ent.Offset, math.MaxInt64),
+		checkRange(ent.Name, "innerOffset", ent.InnerOffset, math.MaxInt64),
+	); err != nil || !ent.isDataType() || fileEnt == nil {
+		return err
+	}
+	if err := checkRange(ent.Name, "chunkOffset", ent.ChunkOffset, fileEnt.Size); err != nil {
+		return err
+	}
+	return checkRange(ent.Name, "chunkSize", ent.ChunkSize, fileEnt.Size-ent.ChunkOffset)
+}
+
 func (r *Reader) getSource(ent *TOCEntry) (_ *TOCEntry, err error) {
 	if ent.Type == "hardlink" {
 		org, ok := r.m[cleanEntryName(ent.LinkName)]
@@ -355,10 +419,24 @@ func (r *Reader) getOrCreateDir(d string) *TOCEntry {
 	return e
 }
 
+// Clone returns a Reader that reads the blob from sr. The returned Reader shares the
+// parsed TOC with r so sr must provide the same blob as r.
+func (r *Reader) Clone(sr *io.SectionReader) *Reader {
+	nr := *r
+	nr.sr = sr
+	return &nr
+}
+
 func (r *Reader) TOCDigest() digest.Digest {
 	return r.tocDigest
 }
 
+// HasBaseChunks returns true if the blob is a delta blob that has chunks stored in its base
+// blob (see WithDeltaBase).
+func (r *Reader) HasBaseChunks() bool {
+	return r.hasBaseChunks
+}
+
 // VerifyTOC checks that the TOC JSON in the passed blob matches the
 // passed digests and that the TOC JSON contains digests for all chunks
 // contained in the blob. If the verification succceeds, this function
@@ -383,6 +461,9 @@ func (r *Reader) Verifiers() (TOCEntryVerifier, error) {
 		if e.Type != "reg" && e.Type != "chunk" {
 			continue
 		}
+		if e.Hole || e.BaseChunk || e.Dedup != "" {
+			continue // holes, base chunks and deduplicated files aren't stored in the blob
+		}
 
 		// offset must be unique in stargz blob
 		_, dOK := chunkDigestMap[e.Offset]
@@ -398,7 +479,7 @@ func (r *Reader) Verifiers() (TOCEntryVerifier, error) {
 
 			// record the digest of regular file payload
 			if e.Digest != "" {
-				d, err := digest.Parse(e.Digest)
+				d, err := ParseChunkDigest(e.Digest)
 				if err != nil {
 					return nil, fmt.Errorf("failed to parse regular file digest %q: %w", e.Digest, err)
 				}
@@ -413,7 +494,7 @@ func (r *Reader) Verifiers() (TOCEntryVerifier, error) {
 		// "reg" also can contain ChunkDigest (e.g. when "reg" is the first entry of
 		// chunked file)
 		if e.ChunkDigest != "" {
-			d, err := digest.Parse(e.ChunkDigest)
+			d, err := ParseChunkDigest(e.ChunkDigest)
 			if err != nil {
 				return nil, fmt.Errorf("failed to parse chunk digest %q: %w", e.ChunkDigest, err)
 			}
@@ -451,7 +532,7 @@ func (v *verifier) Verifier(ce *TOCEntry) (digest.Verifier, error) {
 		return nil, fmt.Errorf("verifier for offset=%d,size=%d hasn't been registered",
 			ce.Offset, ce.ChunkSize)
 	}
-	return d.Verifier(), nil
+	return ChunkDigestVerifier(d)
 }
 
 // ChunkEntryForOffset returns the TOCEntry containing the byte of the
@@ -468,6 +549,9 @@ func (r *Reader) ChunkEntryForOffset(name string, offset int64) (e *TOCEntry, ok
 		if offset >= e.ChunkSize {
 			return nil, false
 		}
+		if len(ents) == 1 {
+			return ents[0], true // the source of the deduplicated file
+		}
 		return e, true
 	}
 	i := sort.Search(len(ents), func(i int) bool {
@@ -480,6 +564,204 @@ func (r *Reader) ChunkEntryForOffset(name string, offset int64) (e *TOCEntry, ok
 	return ents[i], true
 }
 
+// Chunk describes a chunk of a regular file stored in the blob.
+type Chunk struct {
+	// Name is the name of the file containing the chunk.
+	Name string
+
+	// ChunkOffset is the offset of the chunk in the file.
+	ChunkOffset int64
+
+	// ChunkSize is the uncompressed size of the chunk.
+	ChunkSize int64
+
+	// Offset is the offset of the compressed data containing the chunk in the blob.
+	Offset int64
+
+	// CompressedSize is the size of the compressed data containing the chunk.
+	CompressedSize int64
+
+	// InnerOffset is the offset of the chunk in the decompressed data at Offset.
+	// This is non-zero when several chunks are compressed together.
+	InnerOffset int64
+
+	// Digest is the digest of the uncompressed chunk. Empty if the TOC doesn't record it.
+	Digest digest.Digest
+}
+
+// Chunks returns an iterator over all chunks of the regular files in the blob in the
+// order of the offset in the blob. Holes of sparse files and chunks stored in the base
+// blob of a delta blob aren't stored in the blob so they aren't yielded. Deduplicated
+// files don't have their own chunks.
+func (r *Reader) Chunks() iter.Seq[Chunk] {
+	return func(yield func(Chunk) bool) {
+		for _, e := range r.toc.Entries {
+			if !e.isDataType() || e.ChunkSize == 0 || e.Hole || e.BaseChunk || e.Dedup != "" {
+				continue
+			}
+			if !yield(chunkOf(e)) {
+				return
+			}
+		}
+	}
+}
+
+func chunkOf(e *TOCEntry) Chunk {
+	return Chunk{
+		Name:           e.Name,
+		ChunkOffset:    e.ChunkOffset,
+		ChunkSize:      e.ChunkSize,
+		Offset:         e.Offset,
+		CompressedSize: e.NextOffset() - e.Offset,
+		InnerOffset:    e.InnerOffset,
+		Digest:         digest.Digest(e.ChunkDigest),
+	}
+}
+
+// CompressedRange is a range of the compressed blob that can be decompressed without
+// the other parts of the blob.
+type CompressedRange struct {
+	// Offset is the offset of the range in the blob.
+	Offset int64
+
+	// Size is the size of the range in the blob.
+	Size int64
+
+	// Chunks are the chunks of the file contained in the range in the order of the offset
+	// in the file. Each chunk is decompressed from the compressed data at Chunk.Offset.
+	Chunks []Chunk
+}
+
+// CompressedRanges returns the ranges of the blob that contain size bytes at off of the
+// named file, so proxies (e.g. registry-side accelerators and P2P agents) can serve the
+// exact compressed segments without decompressing them. Ranges adjacent in the blob are
+// merged. Holes of sparse files and chunks stored in the base blob of a delta blob aren't
+// stored in the blob so they aren't contained in the ranges. The ranges of a deduplicated
+// file are the ones of the file that stores the contents.
+func (r *Reader) CompressedRanges(name string, off, size int64) ([]CompressedRange, error) {
+	chunks, err := r.FileChunks(name, off, size)
+	if err != nil {
+		return nil, err
+	}
+	var ranges []CompressedRange
+	for c := range chunks {
+		if n := len(ranges); n > 0 {
+			last := &ranges[n-1]
+			if c.Offset >= last.Offset && c.Offset+c.CompressedSize <= last.Offset+last.Size {
+				last.Chunks = append(last.Chunks, c) // compressed together with the previous chunk
+				continue
+			}
+			if c.Offset == last.Offset+last.Size {
+				last.Size += c.CompressedSize
+				last.Chunks = append(last.Chunks, c)
+				continue
+			}
+		}
+		ranges = append(ranges, CompressedRange{Offset: c.Offset, Size: c.CompressedSize, Chunks: []Chunk{c}})
+	}
+	return ranges, nil
+}
+
+// VerifiableRanges returns the ranges of the blob wholly contained in size bytes at off of
+// the blob, whose chunks can be verified with VerifyRange. The ranges are sorted by the
+// offset. Each range is the compressed data of one or more chunks whose digests are recorded
+// in the TOC, so the contents of the blob can be verified while they are fetched without
+// waiting for the whole files.
+func (r *Reader) VerifiableRanges(off, size int64) []CompressedRange {
+	idx := r.verifiableRanges
+	if idx == nil {
+		idx = &rangeIndex{}
+	}
+	idx.once.Do(func() {
+		for c := range r.Chunks() {
+			if n := len(idx.ranges); n > 0 && idx.ranges[n-1].Offset == c.Offset {
+				last := &idx.ranges[n-1]
+				last.Chunks = append(last.Chunks, c) // compressed together with the previous chunk
+				last.Size = max(last.Size, c.CompressedSize)
+				continue
+			}
+			idx.ranges = append(idx.ranges, CompressedRange{Offset: c.Offset, Size: c.CompressedSize, Chunks: []Chunk{c}})
+		}
+		idx.ranges = slices.DeleteFunc(idx.ranges, func(cr CompressedRange) bool {
+			return slices.ContainsFunc(cr.Chunks, func(c Chunk) bool { return c.Digest == "" })
+		})
+		for _, cr := range idx.ranges {
+			slices.SortFunc(cr.Chunks, func(a, b Chunk) int { return cmp.Compare(a.InnerOffset, b.InnerOffset) })
+		}
+		slices.SortFunc(idx.ranges, func(a, b CompressedRange) int { return cmp.Compare(a.Offset, b.Offset) })
+	})
+	i, _ := slices.BinarySearchFunc(idx.ranges, off, func(cr CompressedRange, off int64) int { return cmp.Compare(cr.Offset, off) })
+	var ranges []CompressedRange
+	for ; i < len(idx.ranges) && idx.ranges[i].Offset+idx.ranges[i].Size <= off+size; i++ {
+		ranges = append(ranges, idx.ranges[i])
+	}
+	return ranges
+}
+
+// VerifyRange decompresses p, the compressed data of the range returned by VerifiableRanges,
+// and checks the chunks in it against their digests.
+func (r *Reader) VerifyRange(cr CompressedRange, p []byte) error {
+	if int64(len(p)) != cr.Size {
+		return fmt.Errorf("size of range at %d is %d; want %d", cr.Offset, len(p), cr.Size)
+	}
+	dr, err := r.decompressor.Reader(bytes.NewReader(p))
+	if err != nil {
+		return err
+	}
+	defer dr.Close()
+	var pos int64
+	for _, c := range cr.Chunks {
+		if c.InnerOffset < pos {
+			return fmt.Errorf("chunks at %d aren't sorted", cr.Offset)
+		}
+		if _, err := io.CopyN(io.Discard, dr, c.InnerOffset-pos); err != nil {
+			return fmt.Errorf("failed to skip to chunk of %q at %d: %w", c.Name, c.ChunkOffset, err)
+		}
+		v, err := ChunkDigestVerifier(c.Digest)
+		if err != nil {
+			return err
+		}
+		if _, err := io.CopyN(v, dr, c.ChunkSize); err != nil {
+			return fmt.Errorf("failed to decompress chunk of %q at %d: %w", c.Name, c.ChunkOffset, err)
+		}
+		if !v.Verified() {
+			return fmt.Errorf("invalid chunk of %q at %d: digest mismatch", c.Name, c.ChunkOffset)
+		}
+		pos = c.InnerOffset + c.ChunkSize
+	}
+	return nil
+}
+
+// FileChunks returns an iterator over the chunks of the named file that contain size bytes
+// at off of the file, in the order of the offset in the file. Each chunk tells the range of
+// the blob to fetch to decompress it, so tools (e.g. CDN pre-warmers and byte-range mirrors)
+// can map ranges of files to ranges of the blob with only the TOC of the blob. Holes of sparse
+// files and chunks stored in the base blob of a delta blob aren't stored in the blob so they
+// aren't yielded. The chunks of a deduplicated file are the ones of the file that stores the
+// contents.
+func (r *Reader) FileChunks(name string, off, size int64) (iter.Seq[Chunk], error) {
+	if off < 0 || size < 0 {
+		return nil, errors.New("invalid range")
+	}
+	fr, err := r.newFileReader(name)
+	if err != nil {
+		return nil, err
+	}
+	return func(yield func(Chunk) bool) {
+		for _, e := range fr.ents {
+			if e.ChunkOffset+e.ChunkSize <= off || e.ChunkOffset >= off+size {
+				continue
+			}
+			if e.ChunkSize == 0 || e.Hole || e.BaseChunk {
+				continue
+			}
+			if !yield(chunkOf(e)) {
+				return
+			}
+		}
+	}, nil
+}
+
 // Lookup returns the Table of Contents entry for the given path.
 //
 // To get the root directory, use the empty string.
@@ -529,11 +811,15 @@ func (r *Reader) newFileReader(name string) (*fileReader, error) {
 			Err:  errors.New("not a regular file"),
 		}
 	}
-	return &fileReader{
+	fr := &fileReader{
 		r:    r,
 		size: ent.Size,
 		ents: r.getChunks(ent),
-	}, nil
+	}
+	for _, e := range fr.ents {
+		fr.sparse = fr.sparse || e.Hole || e.BaseChunk
+	}
+	return fr, nil
 }
 
 func (r *Reader) OpenFileWithPreReader(name string, preRead func(*TOCEntry, io.Reader) error) (*io.SectionReader, error) {
@@ -556,6 +842,7 @@ type fileReader struct {
 	r       *Reader
 	size    int64
 	ents    []*TOCEntry // 1 or more reg/chunk entries
+	sparse  bool        // true if ents contain holes or base chunks
 	preRead func(*TOCEntry, io.Reader) error
 }
 
@@ -566,6 +853,39 @@ func (fr *fileReader) ReadAt(p []byte, off int64) (n int, err error) {
 	if off < 0 {
 		return 0, errors.New("invalid offset")
 	}
+	if fr.sparse {
+		return fr.readAtSparse(p, off)
+	}
+	return fr.readAt(p, off)
+}
+
+// readAtSparse reads the payload of a sparse file. Holes and base chunks aren't stored
+// in the blob so each read must not go across the boundary of the chunk. Reading a base
+// chunk fails with ErrBaseChunk.
+func (fr *fileReader) readAtSparse(p []byte, off int64) (n int, err error) {
+	for n < len(p) && off < fr.size {
+		ent, err := fr.chunkEntry(off)
+		if err != nil {
+			return n, err
+		}
+		l := min(int64(len(p)-n), ent.ChunkOffset+ent.ChunkSize-off)
+		if ent.BaseChunk {
+			return n, fmt.Errorf("failed to read %q at %d: %w", ent.Name, off, ErrBaseChunk)
+		} else if ent.Hole {
+			clear(p[n : int64(n)+l])
+		} else if _, err := fr.readAt(p[n:int64(n)+l], off); err != nil && err != io.EOF {
+			return n, err
+		}
+		n += int(l)
+		off += l
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (fr *fileReader) chunkEntry(off int64) (*TOCEntry, error) {
 	var i int
 	if len(fr.ents) > 1 {
 		i = sort.Search(len(fr.ents), func(i int) bool {
@@ -578,15 +898,38 @@ func (fr *fileReader) ReadAt(p []byte, off int64) (n int, err error) {
 	ent := fr.ents[i]
 	if ent.ChunkOffset > off {
 		if i == 0 {
-			return 0, errors.New("internal error; first chunk offset is non-zero")
+			return nil, errors.New("internal error; first chunk offset is non-zero")
 		}
 		ent = fr.ents[i-1]
 	}
+	return ent, nil
+}
+
+func (fr *fileReader) readAt(p []byte, off int64) (n int, err error) {
+	n, err = fr.readAtStream(p, off, true)
+	if err == ErrCompressed {
+		// The payload recorded as uncompressed in TOC is compressed. Decompress it.
+		return fr.readAtStream(p, off, false)
+	}
+	return n, err
+}
+
+// readAtStream reads the payload from the stream of the chunk at off. If raw is true and
+// the chunk is stored without compression, the payload is read skipping the framing of the
+// compression and ErrCompressed is returned if the stream contains compressed data.
+func (fr *fileReader) readAtStream(p []byte, off int64, raw bool) (n int, err error) {
+	ent, err := fr.chunkEntry(off)
+	if err != nil {
+		return 0, err
+	}
 
 	//  If ent is a chunk of a large file, adjust the ReadAt
 	//  offset by the chunk's offset.
 	off -= ent.ChunkOffset
 
+	// The next chunk may be in another stream that isn't uncompressed.
+	raw = raw && off+int64(len(p)) <= ent.ChunkSize
+
 	finalEnt := fr.ents[len(fr.ents)-1]
 	compressedOff := ent.Offset
 	// compressedBytesRemain is the number of compressed bytes in this
@@ -603,14 +946,21 @@ func (fr *fileReader) ReadAt(p []byte, off int64) (n int, err error) {
 
 	br := bufio.NewReaderSize(sr, bufSize)
 	if _, err := br.Peek(bufSize); err != nil {
-		return 0, fmt.Errorf("fileReader.ReadAt.peek: %v", err)
+		return 0, fmt.Errorf("fileReader.ReadAt.peek: %w", err)
 	}
 
-	dr, err := fr.r.decompressor.Reader(br)
+	dr, err := fr.r.payloadReader(ent, br, raw)
 	if err != nil {
 		return 0, fmt.Errorf("fileReader.ReadAt.decompressor.Reader: %v", err)
 	}
 	defer dr.Close()
+	if rr, ok := dr.(*rawPayloadReader); ok {
+		defer func() {
+			if rr.compressed {
+				n, err = 0, ErrCompressed
+			}
+		}()
+	}
 
 	if fr.preRead == nil {
 		if n, err := io.CopyN(io.Discard, dr, ent.InnerOffset+off); n != ent.InnerOffset+off || err != nil {
@@ -683,7 +1033,66 @@ type Writer struct {
 	// NOTE: This adds a TOC property that stargz snapshotter < v0.13.0 doesn't understand.
 	MinChunkSize int
 
+	// ChunkSizeFunc optionally returns the chunk size and the minimum chunk
+	// size used for the named regular file instead of ChunkSize and
+	// MinChunkSize. This allows using different chunk sizes for different
+	// regions of the blob (e.g. files read on demand and prefetched files).
+	ChunkSizeFunc func(name string, size int64) (chunkSize, minChunkSize int)
+
+	// SparseFiles optionally makes chunks of regular files that are filled
+	// with zeros recorded as holes in TOC instead of being stored in the blob.
+	// Such files are stored as sparse files in the tar.
+	// NOTE: This adds a TOC property that old reader doesn't understand.
+	SparseFiles bool
+
+	// DedupFiles optionally makes regular files that have the same contents
+	// as a preceding file recorded in TOC as references to that file (see
+	// TOCEntry.Dedup). Unlike hardlinks, the attributes of the files can
+	// differ. Their contents are stored in the blob only once and such
+	// files are stored in the tar as sparse files that consist of a hole.
+	// NOTE: This adds a TOC property that old reader doesn't understand.
+	DedupFiles bool
+
+	// DeltaBase optionally makes the writer emit a delta blob against the
+	// base blob. Chunks of regular files identical to a chunk in DeltaBase
+	// (compared by the chunk digest) are recorded in TOC as BaseChunk instead
+	// of being stored in the blob. Such files are stored in the tar as sparse
+	// files.
+	// NOTE: This adds a TOC property that old reader doesn't understand.
+	DeltaBase *Reader
+
+	// AdaptiveCompression optionally makes the writer estimate the
+	// compressibility of each regular file from the entropy of the beginning
+	// of the payload and compress poorly compressible payloads (e.g. already
+	// compressed assets) with a fast level or without compression. This is
+	// ignored if the compressor doesn't implement AdaptiveCompressor. Payloads
+	// of different compressibility aren't compressed in the same stream.
+	AdaptiveCompression bool
+
+	// DigestAlgorithm optionally controls the algorithm of the digests of
+	// regular files and chunks recorded in TOC. The algorithm must be
+	// available in go-digest or have a registered ChunkHasher. Zero means
+	// to use digest.Canonical (sha256).
+	DigestAlgorithm digest.Algorithm
+
+	// Scanners optionally scan the contents of each tar entry while it's
+	// written (see Scanner). AppendTar fails if a scanner rejects an entry.
+	// Other findings are returned by ScanFindings.
+	Scanners []Scanner
+
 	needsOpenGzEntries map[string]struct{}
+
+	baseChunks map[string]struct{} // chunk digests stored in DeltaBase
+
+	dedupSources    map[digest.Digest]*TOCEntry // digest of the contents -> entry of the file
+	dedupSourceKeys map[string]digest.Digest    // name of the file -> digest of the contents
+
+	compressibility   Compressibility // of the payload being written
+	gzCompressibility Compressibility // of the payload compressed by the current stream
+
+	entryHook func(name string) error // called when each entry starts to be written
+
+	scanFindings []ScanFinding
 }
 
 // currentCompressionWriter writes to the current w.gz field, which can
@@ -703,6 +1112,13 @@ func (ccw currentCompressionWriter) Write(p []byte) (int, error) {
 	return ccw.w.gz.Write(p)
 }
 
+func (w *Writer) digestAlgorithm() digest.Algorithm {
+	if w.DigestAlgorithm == "" {
+		return digest.Canonical
+	}
+	return w.DigestAlgorithm
+}
+
 func (w *Writer) chunkSize() int {
 	if w.ChunkSize <= 0 {
 		return 4 << 20
@@ -710,6 +1126,19 @@ func (w *Writer) chunkSize() int {
 	return w.ChunkSize
 }
 
+// chunkSizesOf returns the chunk size and the minimum chunk size of the file.
+func (w *Writer) chunkSizesOf(h *tar.Header) (chunkSize, minChunkSize int) {
+	if w.ChunkSizeFunc != nil {
+		chunkSize, minChunkSize = w.ChunkSizeFunc(cleanEntryName(h.Name), h.Size)
+	} else {
+		chunkSize, minChunkSize = w.ChunkSize, w.MinChunkSize
+	}
+	if chunkSize <= 0 {
+		chunkSize = w.chunkSize()
+	}
+	return chunkSize, minChunkSize
+}
+
 // Unpack decompresses the given estargz blob and returns a ReadCloser of the tar blob.
 // TOC JSON and footer are removed.
 func Unpack(sr *io.SectionReader, c Decompressor) (io.ReadCloser, error) {
@@ -833,7 +1262,12 @@ func (w *Writer) nameIfChanged(mp *map[int]string, id int, name string) string {
 
 func (w *Writer) condOpenGz() (err error) {
 	if w.gz == nil {
-		w.gz, err = w.compressor.Writer(w.cw)
+		if ac, ok := w.compressor.(AdaptiveCompressor); ok && w.AdaptiveCompression {
+			w.gz, err = ac.WriterFor(w.cw, w.compressibility)
+		} else {
+			w.gz, err = w.compressor.Writer(w.cw)
+		}
+		w.gzCompressibility = w.compressibility
 		if w.gz != nil {
 			w.gz = w.uncompressedCounter.register(w.gz)
 		}
@@ -868,6 +1302,12 @@ func (w *Writer) AppendTarLossLess(r io.Reader) error {
 }
 
 func (w *Writer) appendTar(r io.Reader, lossless bool) error {
+	if _, err := ChunkDigester(w.digestAlgorithm()); err != nil {
+		return fmt.Errorf("digest algorithm %q is unavailable: %w", w.digestAlgorithm(), err)
+	}
+	if w.DeltaBase != nil {
+		w.toc.Base = w.DeltaBase.TOCDigest().String()
+	}
 	var src io.Reader
 	br := bufio.NewReader(r)
 	if isGzip(br) {
@@ -887,6 +1327,21 @@ func (w *Writer) appendTar(r io.Reader, lossless bool) error {
 	}
 	prevOffset := w.cw.n
 	var prevOffsetUncompressed int64
+	var spool *os.File // temporary file of the current payload for detecting holes
+	cleanupSpool := func() {
+		if spool != nil {
+			spool.Close()
+			os.Remove(spool.Name())
+			spool = nil
+		}
+	}
+	defer cleanupSpool()
+	var scan *entryScan // scan of the current entry
+	defer func() {
+		if scan != nil {
+			scan.abort()
+		}
+	}()
 	for {
 		h, err := tr.Next()
 		if err == io.EOF {
@@ -904,7 +1359,7 @@ func (w *Writer) appendTar(r io.Reader, lossless bool) error {
 		if err != nil {
 			return fmt.Errorf("error reading from source tar: tar.Reader.Next: %v", err)
 		}
-		if cleanEntryName(h.Name) == TOCTarName {
+		if name := cleanEntryName(h.Name); name == TOCTarName || name == PrefixTOCTarName || name == CompressedTOCTarName {
 			// It is possible for a layer to be "stargzified" twice during the
 			// distribution lifecycle. So we reserve "TOCTarName" here to avoid
 			// duplicated entries in the resulting layer.
@@ -914,6 +1369,16 @@ func (w *Writer) appendTar(r io.Reader, lossless bool) error {
 			}
 			continue
 		}
+		if w.entryHook != nil {
+			if err := w.entryHook(h.Name); err != nil {
+				return err
+			}
+		}
+		var entryR io.Reader = tr
+		if len(w.Scanners) > 0 {
+			scan = w.startScan(h)
+			entryR = io.TeeReader(tr, scan)
+		}
 
 		xattrs := make(map[string][]byte)
 		const xattrPAXRecordsPrefix = "SCHILY.xattr."
@@ -937,7 +1402,46 @@ func (w *Writer) appendTar(r io.Reader, lossless bool) error {
 		if err := w.condOpenGz(); err != nil {
 			return err
 		}
-		if tw != nil {
+		w.forgetDedupSource(h.Name)
+		var payload io.Reader = entryR
+		var holes, based []bool // based is true for chunks stored in DeltaBase
+		fileChunkSize, fileMinChunkSize := w.chunkSizesOf(h)
+		var contentDigest digest.Digest // digest of the payload used for finding duplicates
+		var dedup *TOCEntry             // preceding file that has the same contents
+		if (w.SparseFiles || w.DedupFiles || w.DeltaBase != nil) && tw != nil && h.Typeflag == tar.TypeReg && h.Size > 0 {
+			dgstr := digest.Canonical.Digester()
+			f, hs, err := spoolPayload(io.TeeReader(entryR, dgstr.Hash()), h.Size, int64(fileChunkSize))
+			if err != nil {
+				return fmt.Errorf("failed to read payload of %q: %w", h.Name, err)
+			}
+			spool, payload = f, f
+			if w.SparseFiles {
+				holes = hs
+			}
+			if w.DeltaBase != nil && !IsLandmark(cleanEntryName(h.Name)) {
+				if based, err = w.baseChunksOf(f, h.Size, int64(fileChunkSize), holes); err != nil {
+					return fmt.Errorf("failed to read payload of %q: %w", h.Name, err)
+				}
+			}
+			if w.DedupFiles && h.Typeflag == tar.TypeReg && !IsLandmark(cleanEntryName(h.Name)) {
+				contentDigest = dgstr.Digest()
+				dedup, _ = w.dedupSource(contentDigest)
+			}
+		}
+		omitted := omittedChunks(holes, based) // chunks that aren't stored in the blob
+		if dedup != nil {
+			// The whole file is a hole in the tar.
+			omitted = make([]bool, (h.Size+int64(fileChunkSize)-1)/int64(fileChunkSize))
+			for i := range omitted {
+				omitted[i] = true
+			}
+		}
+		var sparseDataSize int64
+		if omitted != nil {
+			if sparseDataSize, err = writeSparseHeader(dst, h, omitted, int64(fileChunkSize)); err != nil {
+				return err
+			}
+		} else if tw != nil {
 			if err := tw.WriteHeader(h); err != nil {
 				return err
 			}
@@ -976,17 +1480,32 @@ func (w *Writer) appendTar(r io.Reader, lossless bool) error {
 		// can fill the digest later.
 		var regFileEntry *TOCEntry
 		var payloadDigest digest.Digester
-		if h.Typeflag == tar.TypeReg {
+		if h.Typeflag == tar.TypeReg && dedup == nil {
 			regFileEntry = ent
-			payloadDigest = digest.Canonical.Digester()
+			if payloadDigest, err = ChunkDigester(w.digestAlgorithm()); err != nil {
+				return err
+			}
 		}
 
-		if h.Typeflag == tar.TypeReg && ent.Size > 0 {
+		if dedup != nil {
+			// The contents are read from the chunks of the preceding file.
+			ent.Dedup = dedup.Name
+			ent.Digest = dedup.Digest
+			w.toc.Entries = append(w.toc.Entries, ent)
+		} else if h.Typeflag == tar.TypeReg && ent.Size > 0 {
+			if _, ok := w.compressor.(AdaptiveCompressor); ok && w.AdaptiveCompression {
+				br := bufio.NewReaderSize(payload, entropySampleSize)
+				sample, err := br.Peek(int(min(ent.Size, entropySampleSize)))
+				if err != nil {
+					return fmt.Errorf("error reading %q: %w", h.Name, err)
+				}
+				payload, w.compressibility = br, compressibilityOf(sample)
+			}
 			var written int64
 			totalSize := ent.Size // save it before we destroy ent
-			tee := io.TeeReader(tr, payloadDigest.Hash())
-			for written < totalSize {
-				chunkSize := int64(w.chunkSize())
+			tee := io.TeeReader(payload, payloadDigest.Hash())
+			for i := 0; written < totalSize; i++ {
+				chunkSize := int64(fileChunkSize)
 				remain := totalSize - written
 				if remain < chunkSize {
 					chunkSize = remain
@@ -994,11 +1513,36 @@ func (w *Writer) appendTar(r io.Reader, lossless bool) error {
 					ent.ChunkSize = chunkSize
 				}
 
+				if omitted != nil && omitted[i] {
+					// The hole and the chunk stored in the base blob aren't written to the blob.
+					chunkDigest, err := ChunkDigester(w.digestAlgorithm())
+					if err != nil {
+						return err
+					}
+					if _, err := io.CopyN(chunkDigest.Hash(), tee, chunkSize); err != nil {
+						return fmt.Errorf("error reading %q: %w", h.Name, err)
+					}
+					if based != nil && based[i] {
+						ent.BaseChunk = true
+					} else {
+						ent.Hole = true
+					}
+					ent.ChunkOffset = written
+					ent.ChunkDigest = chunkDigest.Digest().String()
+					w.toc.Entries = append(w.toc.Entries, ent)
+					written += chunkSize
+					ent = &TOCEntry{
+						Name: h.Name,
+						Type: "chunk",
+					}
+					continue
+				}
+
 				// We flush the underlying compression writer here to correctly calculate "w.cw.n".
 				if err := w.flushGz(); err != nil {
 					return err
 				}
-				if w.needsOpenGz(ent) || w.cw.n-prevOffset >= int64(w.MinChunkSize) {
+				if w.needsOpenGz(ent) || w.cw.n-prevOffset >= int64(fileMinChunkSize) || w.compressibility != w.gzCompressibility {
 					if err := w.closeGz(); err != nil {
 						return err
 					}
@@ -1011,21 +1555,25 @@ func (w *Writer) appendTar(r io.Reader, lossless bool) error {
 				}
 
 				ent.ChunkOffset = written
-				chunkDigest := digest.Canonical.Digester()
+				chunkDigest, err := ChunkDigester(w.digestAlgorithm())
+				if err != nil {
+					return err
+				}
 
 				if err := w.condOpenGz(); err != nil {
 					return err
 				}
+				ent.Uncompressed = w.gzCompressibility == Incompressible
 
 				teeChunk := io.TeeReader(tee, chunkDigest.Hash())
 				var out io.Writer
-				if tw != nil {
+				if tw != nil && omitted == nil {
 					out = tw
 				} else {
 					out = dst
 				}
 				if _, err := io.CopyN(out, teeChunk, chunkSize); err != nil {
-					return fmt.Errorf("error copying %q: %v", h.Name, err)
+					return fmt.Errorf("error copying %q: %w", h.Name, err)
 				}
 				ent.ChunkDigest = chunkDigest.Digest().String()
 				w.toc.Entries = append(w.toc.Entries, ent)
@@ -1040,12 +1588,29 @@ func (w *Writer) appendTar(r io.Reader, lossless bool) error {
 		}
 		if payloadDigest != nil {
 			regFileEntry.Digest = payloadDigest.Digest().String()
+			if contentDigest != "" {
+				w.addDedupSource(regFileEntry, contentDigest)
+			}
+		}
+		if pad := sparseDataSize % blockSize; pad > 0 {
+			// The sparse file is written bypassing tw so pad the data here.
+			if _, err := dst.Write(make([]byte, blockSize-pad)); err != nil {
+				return err
+			}
 		}
+		cleanupSpool()
 		if tw != nil {
 			if err := tw.Flush(); err != nil {
 				return err
 			}
 		}
+		if scan != nil {
+			s := scan
+			scan = nil
+			if err := s.finish(w, entryR); err != nil {
+				return err
+			}
+		}
 	}
 	remainDest := io.Discard
 	if lossless {
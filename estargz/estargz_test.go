@@ -22,7 +22,20 @@
 
 package estargz
 
-import "testing"
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	digest "github.com/opencontainers/go-digest"
+)
 
 // Tests *Reader.ChunkEntryForOffset about offset and size calculation.
 func TestChunkEntryForOffset(t *testing.T) {
@@ -120,3 +133,844 @@ func regularFileReader(name string, size int64, chunkSize int64) (*TOCEntry, *Re
 		chunks: map[string][]*TOCEntry{name: chunks},
 	}
 }
+
+// Tests blobs that have offsets larger than 8GiB and files larger than 8GiB. Contents
+// before the recorded offsets and holes are virtual so the tests don't use disk space.
+func TestLargeOffsets(t *testing.T) {
+	const (
+		chunkSize = 8192
+		padSize   = 9 << 30 // larger than the size limit of ustar and uint32
+	)
+	contents := map[string]string{
+		"foo": longstring(chunkSize*2 + 100),
+		"bar": "bar",
+	}
+	frag, err := BuildFragment(buildTar(t, tarOf(file("foo", contents["foo"]), file("bar", contents["bar"])), ""),
+		WithChunkSize(chunkSize))
+	if err != nil {
+		t.Fatalf("failed to build fragment: %v", err)
+	}
+	defer frag.Close()
+	pad := &Fragment{Payload: io.NewSectionReader(zeroReaderAt{}, 0, padSize), TOC: &JTOC{Version: 1}}
+	toc, tocOffset, err := mergeFragmentTOCs([]*Fragment{pad, frag})
+	if err != nil {
+		t.Fatalf("failed to merge TOCs: %v", err)
+	}
+	sr, tocDgst := largeBlob(t, toc, tocOffset, pad.Payload, frag.Payload)
+
+	r, err := Open(sr)
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+	v, err := r.VerifyTOC(tocDgst)
+	if err != nil {
+		t.Fatalf("failed to verify TOC: %v", err)
+	}
+	for name, want := range contents {
+		e, ok := r.Lookup(name)
+		if !ok {
+			t.Fatalf("%q not found", name)
+		}
+		if e.Offset < padSize {
+			t.Fatalf("offset of %q = %d; want >= %d", name, e.Offset, padSize)
+		}
+		fr, err := r.OpenFile(name)
+		if err != nil {
+			t.Fatalf("failed to open %q: %v", name, err)
+		}
+		got := make([]byte, len(want))
+		if _, err := fr.ReadAt(got, 0); err != nil && err != io.EOF {
+			t.Fatalf("failed to read %q: %v", name, err)
+		}
+		if string(got) != want {
+			t.Errorf("%q: unexpected contents", name)
+		}
+		ce, ok := r.ChunkEntryForOffset(name, 0)
+		if !ok {
+			t.Fatalf("chunk of %q not found", name)
+		}
+		dv, err := v.Verifier(ce)
+		if err != nil {
+			t.Fatalf("failed to get verifier of %q: %v", name, err)
+		}
+		if _, err := io.Copy(dv, io.NewSectionReader(fr, ce.ChunkOffset, ce.ChunkSize)); err != nil {
+			t.Fatalf("failed to read %q: %v", name, err)
+		}
+		if !dv.Verified() {
+			t.Errorf("chunk of %q isn't verified", name)
+		}
+	}
+}
+
+func TestLargeFile(t *testing.T) {
+	const (
+		holeSize = 9 << 30 // larger than the size limit of ustar and uint32
+		tail     = "tail"
+	)
+	frag, err := BuildFragment(buildTar(t, tarOf(file("tail", tail)), ""))
+	if err != nil {
+		t.Fatalf("failed to build fragment: %v", err)
+	}
+	defer frag.Close()
+	var tailEnt *TOCEntry
+	for _, e := range frag.TOC.Entries {
+		if e.Name == "tail" {
+			tailEnt = e
+		}
+	}
+	if tailEnt == nil {
+		t.Fatalf("tail entry not found")
+	}
+
+	// The file consists of a large hole followed by the contents of "tail".
+	toc := &JTOC{
+		Version: 1,
+		Entries: []*TOCEntry{
+			{
+				Name:        "big",
+				Type:        "reg",
+				Size:        holeSize + int64(len(tail)),
+				ChunkSize:   holeSize,
+				Hole:        true,
+				ChunkDigest: digest.FromString("dummy").String(), // holes aren't read in this test
+			},
+			{
+				Name:        "big",
+				Type:        "chunk",
+				Offset:      tailEnt.Offset,
+				ChunkOffset: holeSize,
+				ChunkDigest: tailEnt.ChunkDigest,
+			},
+		},
+	}
+	sr, tocDgst := largeBlob(t, toc, frag.Payload.Size(), frag.Payload)
+	r, err := Open(sr)
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+	if _, err := r.VerifyTOC(tocDgst); err != nil {
+		t.Fatalf("failed to verify TOC: %v", err)
+	}
+	e, ok := r.Lookup("big")
+	if !ok {
+		t.Fatalf("large file not found")
+	}
+	if want := holeSize + int64(len(tail)); e.Size != want {
+		t.Errorf("size = %d; want %d", e.Size, want)
+	}
+	ce, ok := r.ChunkEntryForOffset("big", holeSize+1)
+	if !ok || ce.ChunkOffset != holeSize || ce.ChunkSize != int64(len(tail)) {
+		t.Fatalf("unexpected chunk of the tail: %+v", ce)
+	}
+	fr, err := r.OpenFile("big")
+	if err != nil {
+		t.Fatalf("failed to open file: %v", err)
+	}
+	for _, off := range []int64{4<<30 - 2, holeSize - 2, holeSize} {
+		want := make([]byte, 4)
+		if off >= holeSize-int64(len(want)) {
+			copy(want[max(holeSize-off, 0):], tail)
+		}
+		got := make([]byte, len(want))
+		if _, err := fr.ReadAt(got, off); err != nil && err != io.EOF {
+			t.Fatalf("failed to read at %d: %v", off, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("read at %d = %q; want %q", off, got, want)
+		}
+	}
+}
+
+func TestInvalidRange(t *testing.T) {
+	tests := []struct {
+		name  string
+		ents  []*TOCEntry
+		field string
+	}{
+		{
+			name: "negative size",
+			ents: []*TOCEntry{
+				{Name: "foo", Type: "reg", Size: -1},
+			},
+			field: "size",
+		},
+		{
+			name: "negative offset",
+			ents: []*TOCEntry{
+				{Name: "foo", Type: "reg", Size: 1, Offset: -1},
+			},
+			field: "offset",
+		},
+		{
+			name: "chunk offset beyond file",
+			ents: []*TOCEntry{
+				{Name: "foo", Type: "reg", Size: 10, ChunkSize: 5},
+				{Name: "foo", Type: "chunk", ChunkOffset: 11},
+			},
+			field: "chunkOffset",
+		},
+		{
+			name: "chunk size overflow",
+			ents: []*TOCEntry{
+				{Name: "foo", Type: "reg", Size: 10, ChunkSize: 5},
+				{Name: "foo", Type: "chunk", ChunkOffset: 5, ChunkSize: 1<<63 - 1},
+			},
+			field: "chunkSize",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sr, _ := largeBlob(t, &JTOC{Version: 1, Entries: tt.ents}, 0)
+			_, err := Open(sr)
+			var rErr *RangeError
+			if !errors.As(err, &rErr) {
+				t.Fatalf("RangeError must be returned but got %v", err)
+			}
+			if rErr.Field != tt.field {
+				t.Errorf("field = %q; want %q", rErr.Field, tt.field)
+			}
+		})
+	}
+}
+
+// largeBlob returns an eStargz blob that consists of the payloads followed by the TOC and the footer.
+func largeBlob(t *testing.T, toc *JTOC, tocOffset int64, payloads ...*io.SectionReader) (*io.SectionReader, digest.Digest) {
+	tocAndFooterR, tocDgst, err := tocAndFooter(NewGzipCompressor(), toc, tocOffset)
+	if err != nil {
+		t.Fatalf("failed to make TOC and footer: %v", err)
+	}
+	tf, err := io.ReadAll(tocAndFooterR)
+	if err != nil {
+		t.Fatalf("failed to read TOC and footer: %v", err)
+	}
+	ra := concatReaderAt(append(payloads, io.NewSectionReader(bytes.NewReader(tf), 0, int64(len(tf)))))
+	return io.NewSectionReader(ra, 0, ra.size()), tocDgst
+}
+
+type zeroReaderAt struct{}
+
+func (zeroReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// concatReaderAt is an io.ReaderAt that reads the concatenation of the sections.
+type concatReaderAt []*io.SectionReader
+
+func (c concatReaderAt) size() (n int64) {
+	for _, s := range c {
+		n += s.Size()
+	}
+	return
+}
+
+func (c concatReaderAt) ReadAt(p []byte, off int64) (n int, err error) {
+	for _, s := range c {
+		if len(p) == 0 {
+			break
+		}
+		if off >= s.Size() {
+			off -= s.Size()
+			continue
+		}
+		m, err := s.ReadAt(p[:min(int64(len(p)), s.Size()-off)], off)
+		n += m
+		if err != nil && err != io.EOF {
+			return n, err
+		}
+		p = p[m:]
+		off = 0
+	}
+	if len(p) > 0 {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Tests *Reader.VerifyReport reports the corrupted chunk without stopping at the failure.
+func TestVerifyReport(t *testing.T) {
+	const chunkSize = 8192
+	in := tarOf(
+		file("foo", strings.Repeat("a", chunkSize)+strings.Repeat("b", chunkSize)),
+		dir("bar/"),
+		file("bar/baz", "baz"),
+	)
+	blob, err := Build(buildTar(t, in, ""), WithChunkSize(chunkSize), WithCompressionLevel(gzip.NoCompression))
+	if err != nil {
+		t.Fatalf("failed to build: %v", err)
+	}
+	data, err := io.ReadAll(blob)
+	if err != nil {
+		t.Fatalf("failed to read blob: %v", err)
+	}
+	blob.Close()
+	open := func(data []byte) *Reader {
+		r, err := Open(io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data))))
+		if err != nil {
+			t.Fatalf("failed to open: %v", err)
+		}
+		return r
+	}
+
+	rep, err := open(data).VerifyReport(blob.TOCDigest())
+	if err != nil {
+		t.Fatalf("failed to verify: %v", err)
+	}
+	if !rep.OK() || rep.Chunks != 4 { // including the landmark file
+		t.Fatalf("unexpected report of the valid blob: %+v", rep)
+	}
+
+	// Corrupt the second chunk of "foo". Contents are stored as-is without compression.
+	corrupted := bytes.Clone(data)
+	i := bytes.Index(corrupted, []byte(strings.Repeat("b", chunkSize)))
+	if i < 0 {
+		t.Fatalf("contents not found in the blob")
+	}
+	corrupted[i+100] = 'x'
+	r := open(corrupted)
+	rep, err = r.VerifyReport(blob.TOCDigest())
+	if err != nil {
+		t.Fatalf("failed to verify: %v", err)
+	}
+	if !rep.TOCVerified || rep.OK() || rep.Chunks != 4 || len(rep.Files) != 1 || rep.Files[0].Name != "foo" || len(rep.Files[0].Chunks) != 1 {
+		t.Fatalf("unexpected report of the corrupted blob: %+v", rep)
+	}
+	ce, ok := r.ChunkEntryForOffset("foo", chunkSize)
+	if !ok {
+		t.Fatalf("chunk of foo not found")
+	}
+	m := rep.Files[0].Chunks[0]
+	if m.Offset != ce.Offset || m.ChunkOffset != chunkSize || m.ChunkSize != chunkSize || m.Want != digest.Digest(ce.ChunkDigest) {
+		t.Errorf("unexpected mismatch %+v; want the chunk %+v", m, ce)
+	}
+	if m.Got == m.Want && m.Error == "" {
+		t.Errorf("mismatch must have the different digest or the error: %+v", m)
+	}
+
+	// Invalid TOC digest is reported.
+	if rep, err := open(data).VerifyReport(digest.FromString("")); err != nil || rep.TOCVerified || rep.OK() {
+		t.Errorf("invalid TOC digest must be reported: %+v, %v", rep, err)
+	}
+}
+
+// lengthVerifier is a ChunkVerifier of the fake algorithm whose digest is the size of the
+// contents.
+type lengthVerifier struct{}
+
+func (lengthVerifier) Verifier(d digest.Digest) (digest.Verifier, bool) {
+	return &lengthDigestVerifier{want: d.Encoded()}, true
+}
+
+type lengthDigestVerifier struct {
+	want string
+	n    int
+}
+
+func (v *lengthDigestVerifier) Write(p []byte) (int, error) {
+	v.n += len(p)
+	return len(p), nil
+}
+
+func (v *lengthDigestVerifier) Verified() bool {
+	return fmt.Sprintf("%d", v.n) == v.want
+}
+
+// countingVerifier uses the verifier of go-digest and counts the verifiers it returns. It
+// declines the digests if decline is true.
+type countingVerifier struct {
+	decline bool
+	count   int
+}
+
+func (c *countingVerifier) Verifier(d digest.Digest) (digest.Verifier, bool) {
+	if c.decline {
+		return nil, false
+	}
+	c.count++
+	return d.Verifier(), true
+}
+
+func TestChunkVerifier(t *testing.T) {
+	saved := chunkVerifiers
+	chunkVerifiers = make(map[digest.Algorithm][]ChunkVerifier)
+	t.Cleanup(func() { chunkVerifiers = saved })
+
+	// Algorithms that go-digest doesn't support are accepted once their verifiers are registered.
+	const lengthAlg = digest.Algorithm("length")
+	if _, err := ParseChunkDigest("length:3"); !errors.Is(err, digest.ErrDigestUnsupported) {
+		t.Fatalf("unregistered algorithm must be unsupported: %v", err)
+	}
+	RegisterChunkVerifier(lengthAlg, lengthVerifier{})
+	d, err := ParseChunkDigest("length:3")
+	if err != nil {
+		t.Fatalf("failed to parse digest of registered algorithm: %v", err)
+	}
+	if _, err := ParseChunkDigest("length:"); err == nil {
+		t.Errorf("invalid digest must be rejected")
+	}
+	for _, tt := range []struct {
+		data string
+		want bool
+	}{{"foo", true}, {"foobar", false}} {
+		v, err := ChunkDigestVerifier(d)
+		if err != nil {
+			t.Fatalf("failed to get verifier: %v", err)
+		}
+		if _, err := io.WriteString(v, tt.data); err != nil {
+			t.Fatalf("failed to write: %v", err)
+		}
+		if v.Verified() != tt.want {
+			t.Errorf("verified(%q) = %v; want %v", tt.data, v.Verified(), tt.want)
+		}
+	}
+
+	// Verifiers registered later are tried first and go-digest is the fallback.
+	const chunkSize = 8192
+	in := tarOf(
+		file("foo", longstring(chunkSize*2+100)),
+		file("bar", "bar"),
+	)
+	blob, err := Build(buildTar(t, in, ""), WithChunkSize(chunkSize))
+	if err != nil {
+		t.Fatalf("failed to build: %v", err)
+	}
+	data, err := io.ReadAll(blob)
+	if err != nil {
+		t.Fatalf("failed to read blob: %v", err)
+	}
+	blob.Close()
+	r, err := Open(io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data))))
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+	accepting, declining := &countingVerifier{}, &countingVerifier{decline: true}
+	RegisterChunkVerifier(digest.SHA256, accepting)
+	RegisterChunkVerifier(digest.SHA256, declining)
+	rep, err := r.VerifyReport(blob.TOCDigest())
+	if err != nil {
+		t.Fatalf("failed to verify: %v", err)
+	}
+	if !rep.OK() || rep.Chunks == 0 || accepting.count != rep.Chunks {
+		t.Errorf("registered verifier must verify all %d chunks; verified %d: %+v", rep.Chunks, accepting.count, rep)
+	}
+	chunkVerifiers[digest.SHA256] = []ChunkVerifier{declining}
+	if rep, err := r.VerifyReport(blob.TOCDigest()); err != nil || !rep.OK() {
+		t.Errorf("chunks must be verified by go-digest if the verifier declines: %+v, %v", rep, err)
+	}
+}
+
+// renamedVerifier verifies and hashes the digests of the fake algorithm "renamed" with sha256.
+type renamedVerifier struct{}
+
+func (renamedVerifier) Verifier(d digest.Digest) (digest.Verifier, bool) {
+	return digest.NewDigestFromEncoded(digest.SHA256, d.Encoded()).Verifier(), true
+}
+
+func (renamedVerifier) Hash() (hash.Hash, bool) {
+	return sha256.New(), true
+}
+
+func TestChunkHasher(t *testing.T) {
+	saved := chunkVerifiers
+	chunkVerifiers = make(map[digest.Algorithm][]ChunkVerifier)
+	t.Cleanup(func() { chunkVerifiers = saved })
+
+	const (
+		chunkSize  = 8192
+		renamedAlg = digest.Algorithm("renamed")
+	)
+	in := tarOf(
+		file("foo", longstring(chunkSize*2+100)),
+		file("bar", "bar"),
+	)
+	if _, err := Build(buildTar(t, in, ""), WithDigestAlgorithm(renamedAlg)); err == nil {
+		t.Fatalf("algorithm without registered hasher must be rejected")
+	}
+	RegisterChunkVerifier(renamedAlg, renamedVerifier{})
+	blob, err := Build(buildTar(t, in, ""), WithChunkSize(chunkSize), WithDigestAlgorithm(renamedAlg))
+	if err != nil {
+		t.Fatalf("failed to build with registered hasher: %v", err)
+	}
+	data, err := io.ReadAll(blob)
+	if err != nil {
+		t.Fatalf("failed to read blob: %v", err)
+	}
+	blob.Close()
+	r, err := Open(io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data))))
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+	e, ok := r.Lookup("foo")
+	if !ok {
+		t.Fatalf("foo not found")
+	}
+	want := digest.Digest(e.Digest)
+	if want.Algorithm() != renamedAlg {
+		t.Errorf("digest %q isn't of %q", want, renamedAlg)
+	}
+	if got := digest.FromString(longstring(chunkSize*2 + 100)).Encoded(); want.Encoded() != got {
+		t.Errorf("digest of foo = %q; want %q", want.Encoded(), got)
+	}
+	rep, err := r.VerifyReport(blob.TOCDigest())
+	if err != nil {
+		t.Fatalf("failed to verify: %v", err)
+	}
+	if !rep.OK() || rep.Chunks == 0 {
+		t.Errorf("chunks of registered algorithm must be verified: %+v", rep)
+	}
+}
+
+func TestLintAndNormalize(t *testing.T) {
+	const chunkSize = 8192
+	in := tarOf(
+		file("foo", strings.Repeat("a", chunkSize)+strings.Repeat("b", chunkSize)),
+		dir("bar/"),
+		file("bar/baz", "baz"),
+	)
+	blob, err := Build(buildTar(t, in, ""), WithChunkSize(chunkSize), WithPrioritizedFiles([]string{"bar/baz"}))
+	if err != nil {
+		t.Fatalf("failed to build: %v", err)
+	}
+	data, err := io.ReadAll(blob)
+	if err != nil {
+		t.Fatalf("failed to read blob: %v", err)
+	}
+	blob.Close()
+	open := func(data []byte) *Reader {
+		r, err := Open(io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data))))
+		if err != nil {
+			t.Fatalf("failed to open: %v", err)
+		}
+		return r
+	}
+	lint := func(data []byte) []LintIssue {
+		issues, err := open(data).Lint()
+		if err != nil {
+			t.Fatalf("failed to lint: %v", err)
+		}
+		return issues
+	}
+	if issues := lint(data); len(issues) != 0 {
+		t.Fatalf("unexpected issues of the valid blob: %v", issues)
+	}
+
+	// Rewrite the TOC with inconsistent chunks of "foo" and "bar/baz".
+	d := new(GzipDecompressor)
+	_, tocOffset, _, err := d.ParseFooter(data[len(data)-FooterSize:])
+	if err != nil {
+		t.Fatalf("failed to parse footer: %v", err)
+	}
+	toc, _, err := d.ParseTOC(bytes.NewReader(data[tocOffset:]))
+	if err != nil {
+		t.Fatalf("failed to parse TOC: %v", err)
+	}
+	for _, e := range toc.Entries {
+		switch {
+		case e.Type == "chunk" && e.ChunkOffset == chunkSize:
+			e.ChunkOffset-- // overlaps the first chunk and leaves the last byte
+		case e.Name == "bar/baz":
+			e.InnerOffset++
+		}
+	}
+	tocAndFooterR, _, err := tocAndFooter(newGzipCompressionWithLevel(gzip.BestCompression), toc, tocOffset)
+	if err != nil {
+		t.Fatalf("failed to write TOC: %v", err)
+	}
+	tocAndFooterData, err := io.ReadAll(tocAndFooterR)
+	if err != nil {
+		t.Fatalf("failed to read TOC: %v", err)
+	}
+	broken := append(bytes.Clone(data[:tocOffset]), tocAndFooterData...)
+	issues := lint(broken)
+	got := make(map[string]int)
+	for _, i := range issues {
+		got[i.Name]++
+	}
+	// "foo": the overlapping chunk and the uncovered end. "bar/baz": the mismatching digest.
+	if len(issues) != 3 || got["foo"] != 2 || got["bar/baz"] != 1 {
+		t.Fatalf("unexpected issues of the broken blob: %v", issues)
+	}
+
+	// Normalized blob has no issue and keeps the contents and the prioritized files.
+	normalized, err := Normalize(io.NewSectionReader(bytes.NewReader(broken), 0, int64(len(broken))))
+	if err != nil {
+		t.Fatalf("failed to normalize: %v", err)
+	}
+	nData, err := io.ReadAll(normalized)
+	if err != nil {
+		t.Fatalf("failed to read normalized blob: %v", err)
+	}
+	normalized.Close()
+	if issues := lint(nData); len(issues) != 0 {
+		t.Fatalf("unexpected issues of the normalized blob: %v", issues)
+	}
+	nr := open(nData)
+	if tiers := nr.prefetchTiers(); !reflect.DeepEqual(tiers, [][]string{{"bar", "bar/baz"}}) {
+		t.Errorf("unexpected prioritized files %v", tiers)
+	}
+	for name, want := range map[string]string{
+		"foo":     strings.Repeat("a", chunkSize) + strings.Repeat("b", chunkSize),
+		"bar/baz": "baz",
+	} {
+		fr, err := nr.OpenFile(name)
+		if err != nil {
+			t.Fatalf("failed to open %q: %v", name, err)
+		}
+		if got, err := io.ReadAll(fr); err != nil || string(got) != want {
+			t.Errorf("unexpected contents of %q: %q, %v", name, got, err)
+		}
+	}
+}
+
+func TestChunks(t *testing.T) {
+	const chunkSize = 8192
+	in := tarOf(
+		file("foo", strings.Repeat("a", chunkSize)+strings.Repeat("b", chunkSize)+"c"),
+		dir("bar/"),
+		file("bar/baz", "baz"),
+		file("bar/empty", ""),
+	)
+	blob, err := Build(buildTar(t, in, ""), WithChunkSize(chunkSize))
+	if err != nil {
+		t.Fatalf("failed to build: %v", err)
+	}
+	data, err := io.ReadAll(blob)
+	if err != nil {
+		t.Fatalf("failed to read blob: %v", err)
+	}
+	blob.Close()
+	r, err := Open(io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data))))
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+
+	type chunk struct {
+		name        string
+		chunkOffset int64
+		chunkSize   int64
+	}
+	var got []chunk
+	var lastOffset int64
+	for c := range r.Chunks() {
+		got = append(got, chunk{c.Name, c.ChunkOffset, c.ChunkSize})
+		if c.Offset < lastOffset {
+			t.Errorf("chunks must be yielded in the order of the offset: %+v", c)
+		}
+		lastOffset = c.Offset
+		ce, ok := r.ChunkEntryForOffset(c.Name, c.ChunkOffset)
+		if !ok {
+			t.Fatalf("chunk %+v not found", c)
+		}
+		if c.Offset != ce.Offset || c.CompressedSize != ce.NextOffset()-ce.Offset || c.Digest != digest.Digest(ce.ChunkDigest) {
+			t.Errorf("unexpected chunk %+v; want %+v", c, ce)
+		}
+		if c.Digest == "" {
+			t.Errorf("digest of chunk %+v must be recorded", c)
+		}
+	}
+	want := []chunk{
+		{"foo", 0, chunkSize},
+		{"foo", chunkSize, chunkSize},
+		{"foo", 2 * chunkSize, 1},
+		{"bar/baz", 0, 3},
+	}
+	if len(got) < 1 || (got[0].name != PrefetchLandmark && got[0].name != NoPrefetchLandmark) {
+		t.Fatalf("the landmark file must be yielded first: %+v", got)
+	}
+	if !reflect.DeepEqual(got[1:], want) {
+		t.Errorf("chunks = %+v; want %+v", got[1:], want)
+	}
+
+	// Stops iterating when yield returns false.
+	var n int
+	for range r.Chunks() {
+		n++
+		break
+	}
+	if n != 1 {
+		t.Errorf("iteration must stop after break; got %d", n)
+	}
+}
+
+func TestFileChunks(t *testing.T) {
+	const chunkSize = 8192
+	contents := strings.Repeat("a", chunkSize) + strings.Repeat("b", chunkSize) + "c"
+	blob, err := Build(buildTar(t, tarOf(file("foo", contents)), ""), WithChunkSize(chunkSize))
+	if err != nil {
+		t.Fatalf("failed to build: %v", err)
+	}
+	defer blob.Close()
+	data, err := io.ReadAll(blob)
+	if err != nil {
+		t.Fatalf("failed to read blob: %v", err)
+	}
+	r, err := Open(io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data))))
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+	chunks, err := r.FileChunks("foo", chunkSize-1, chunkSize+2)
+	if err != nil {
+		t.Fatalf("failed to get chunks: %v", err)
+	}
+	var got []int64
+	for c := range chunks {
+		got = append(got, c.ChunkOffset)
+		// Each chunk can be decompressed only from its range of the blob.
+		zr, err := gzip.NewReader(bytes.NewReader(data[c.Offset : c.Offset+c.CompressedSize]))
+		if err != nil {
+			t.Fatalf("failed to decompress chunk %+v: %v", c, err)
+		}
+		p := make([]byte, c.InnerOffset+c.ChunkSize)
+		if _, err := io.ReadFull(zr, p); err != nil {
+			t.Fatalf("failed to read chunk %+v: %v", c, err)
+		}
+		if c.Digest.Validate() != nil || c.Digest != digest.FromBytes(p[c.InnerOffset:]) {
+			t.Errorf("digest of chunk %+v doesn't match the contents", c)
+		}
+	}
+	if want := []int64{0, chunkSize, 2 * chunkSize}; !reflect.DeepEqual(got, want) {
+		t.Errorf("chunks = %v; want %v", got, want)
+	}
+
+	// Stops iterating when yield returns false.
+	var n int
+	for range chunks {
+		n++
+		break
+	}
+	if n != 1 {
+		t.Errorf("iteration must stop after break; got %d", n)
+	}
+	if _, err := r.FileChunks("notexist", 0, 10); err == nil {
+		t.Errorf("non-existent file must fail")
+	}
+}
+
+func TestCompressedRanges(t *testing.T) {
+	const chunkSize = 8192
+	contents := strings.Repeat("a", chunkSize) + strings.Repeat("b", chunkSize) + "c"
+	in := tarOf(
+		file("foo", contents),
+		file("bar", "bar"),
+		file("empty", ""),
+	)
+	for _, minChunkSize := range []int{0, 64000} {
+		t.Run(fmt.Sprintf("min-chunk-size=%d", minChunkSize), func(t *testing.T) {
+			blob, err := Build(buildTar(t, in, ""), WithChunkSize(chunkSize), WithMinChunkSize(minChunkSize))
+			if err != nil {
+				t.Fatalf("failed to build: %v", err)
+			}
+			data, err := io.ReadAll(blob)
+			if err != nil {
+				t.Fatalf("failed to read blob: %v", err)
+			}
+			blob.Close()
+			r, err := Open(io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data))))
+			if err != nil {
+				t.Fatalf("failed to open: %v", err)
+			}
+			for _, tt := range []struct {
+				off, size  int64
+				wantChunks []int64 // chunk offsets
+			}{
+				{0, int64(len(contents)), []int64{0, chunkSize, 2 * chunkSize}},
+				{chunkSize + 1, 1, []int64{chunkSize}},
+				{chunkSize - 1, 2, []int64{0, chunkSize}},
+				{int64(len(contents)), 10, nil},
+			} {
+				ranges, err := r.CompressedRanges("foo", tt.off, tt.size)
+				if err != nil {
+					t.Fatalf("failed to get ranges of (%d, %d): %v", tt.off, tt.size, err)
+				}
+				if len(ranges) > 1 {
+					t.Errorf("adjacent ranges must be merged: %+v", ranges)
+				}
+				var gotChunks []int64
+				for _, rg := range ranges {
+					// Each chunk can be decompressed only from the range.
+					seg := data[rg.Offset : rg.Offset+rg.Size]
+					for _, c := range rg.Chunks {
+						gotChunks = append(gotChunks, c.ChunkOffset)
+						zr, err := gzip.NewReader(bytes.NewReader(seg[c.Offset-rg.Offset:]))
+						if err != nil {
+							t.Fatalf("failed to decompress chunk %+v: %v", c, err)
+						}
+						got := make([]byte, c.InnerOffset+c.ChunkSize)
+						if _, err := io.ReadFull(zr, got); err != nil {
+							t.Fatalf("failed to read chunk %+v: %v", c, err)
+						}
+						if want := contents[c.ChunkOffset : c.ChunkOffset+c.ChunkSize]; string(got[c.InnerOffset:]) != want {
+							t.Errorf("unexpected contents of chunk %+v", c)
+						}
+					}
+				}
+				if !reflect.DeepEqual(gotChunks, tt.wantChunks) {
+					t.Errorf("chunks of (%d, %d) = %v; want %v", tt.off, tt.size, gotChunks, tt.wantChunks)
+				}
+			}
+			if ranges, err := r.CompressedRanges("empty", 0, 10); err != nil || len(ranges) != 0 {
+				t.Errorf("empty file must have no range: %+v, %v", ranges, err)
+			}
+			if _, err := r.CompressedRanges("notexist", 0, 10); err == nil {
+				t.Errorf("non-existent file must fail")
+			}
+			if _, err := r.CompressedRanges("foo", -1, 10); err == nil {
+				t.Errorf("negative offset must fail")
+			}
+		})
+	}
+}
+
+func TestVerifiableRanges(t *testing.T) {
+	const chunkSize = 8192
+	contents := strings.Repeat("a", chunkSize) + strings.Repeat("b", chunkSize) + "c"
+	in := tarOf(
+		file("foo", contents),
+		file("bar", "bar"),
+	)
+	for _, minChunkSize := range []int{0, 64000} {
+		t.Run(fmt.Sprintf("min-chunk-size=%d", minChunkSize), func(t *testing.T) {
+			blob, err := Build(buildTar(t, in, ""), WithChunkSize(chunkSize), WithMinChunkSize(minChunkSize))
+			if err != nil {
+				t.Fatalf("failed to build: %v", err)
+			}
+			data, err := io.ReadAll(blob)
+			if err != nil {
+				t.Fatalf("failed to read blob: %v", err)
+			}
+			blob.Close()
+			r, err := Open(io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data))))
+			if err != nil {
+				t.Fatalf("failed to open: %v", err)
+			}
+			ranges := r.VerifiableRanges(0, int64(len(data)))
+			var chunks int
+			for i, cr := range ranges {
+				if i > 0 && cr.Offset < ranges[i-1].Offset+ranges[i-1].Size {
+					t.Errorf("ranges overlap: %+v", ranges)
+				}
+				chunks += len(cr.Chunks)
+				if err := r.VerifyRange(cr, data[cr.Offset:cr.Offset+cr.Size]); err != nil {
+					t.Errorf("failed to verify range %+v: %v", cr, err)
+				}
+				broken := bytes.Clone(data[cr.Offset : cr.Offset+cr.Size])
+				broken[10] ^= 0xff // compressed data following the gzip header
+				if err := r.VerifyRange(cr, broken); err == nil {
+					t.Errorf("broken range %+v must not be verified", cr)
+				}
+			}
+			if chunks != 5 { // landmark, 3 chunks of foo and bar
+				t.Errorf("ranges must contain all chunks; got %d", chunks)
+			}
+
+			// Ranges partially contained aren't returned.
+			first := ranges[0]
+			if got := r.VerifiableRanges(first.Offset+1, int64(len(data))); len(got) != len(ranges)-1 {
+				t.Errorf("range starting after %d = %+v", first.Offset, got)
+			}
+			if got := r.VerifiableRanges(first.Offset, first.Size-1); len(got) != 0 {
+				t.Errorf("range shorter than %+v = %+v", first, got)
+			}
+		})
+	}
+}
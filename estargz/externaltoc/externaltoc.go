@@ -73,6 +73,10 @@ func (gc *GzipCompressor) Writer(w io.Writer) (estargz.WriteFlushCloser, error)
 	return gzip.NewWriterLevel(w, gc.compressionLevel)
 }
 
+func (gc *GzipCompressor) WriterFor(w io.Writer, c estargz.Compressibility) (estargz.WriteFlushCloser, error) {
+	return gzip.NewWriterLevel(w, c.GzipLevel(gc.compressionLevel))
+}
+
 func (gc *GzipCompressor) WriteTOCAndFooter(w io.Writer, off int64, toc *estargz.JTOC, diffHash hash.Hash) (digest.Digest, error) {
 	tocJSON, err := json.MarshalIndent(toc, "", "\t")
 	if err != nil {
@@ -181,7 +185,11 @@ func (gz *GzipDecompressor) getTOC() ([]byte, error) {
 }
 
 func (gz *GzipDecompressor) Reader(r io.Reader) (io.ReadCloser, error) {
-	return gzip.NewReader(r)
+	return estargz.NewGzipReader(r)
+}
+
+func (gz *GzipDecompressor) RawReader(r io.Reader) (io.ReadCloser, error) {
+	return estargz.NewRawGzipReader(r), nil
 }
 
 func (gz *GzipDecompressor) ParseTOC(r io.Reader) (toc *estargz.JTOC, tocDgst digest.Digest, err error) {
@@ -0,0 +1,313 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package estargz
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+// Fragment is a part of an eStargz blob. It contains the compressed contents of the
+// part without TOC and footer, and the TOC of these contents. Fragments are built
+// by BuildFragment and concatenated into a single eStargz blob by ConcatFragments.
+//
+// Fragments can be built on different machines. In that case, Payload, TOC and
+// ScanFindings (which can be marshaled to JSON) need to be transferred to the machine
+// that concatenates them and a Fragment can be constructed from these fields.
+type Fragment struct {
+	// Payload is the compressed contents of the fragment.
+	Payload *io.SectionReader
+
+	// TOC is the TOC of the fragment. Offsets of the entries are relative to
+	// the head of Payload.
+	TOC *JTOC
+
+	// ScanFindings are the findings of the scanners specified by WithScanners on
+	// the entries of the fragment.
+	ScanFindings []ScanFinding
+
+	closeFunc func() error
+}
+
+// Close releases resources held by the fragment.
+func (f *Fragment) Close() error {
+	if f.closeFunc == nil {
+		return nil
+	}
+	return f.closeFunc()
+}
+
+// SplitTar divides the tar blob (gzip, zstd or plain tar) into parts of similar sizes
+// that can be passed to BuildFragment. The number of parts is approximately n.
+// Entries are ordered in the same way as Build, respecting WithPrioritizedFiles and
+// WithAllowPrioritizeNotFound options. Each part is a plain tar stream and must be
+// read in parallel or stored somewhere because parts share the underlying blob.
+// The caller must close all parts to release resources.
+func SplitTar(tarBlob *io.SectionReader, n int, opt ...Option) (_ []io.ReadCloser, rErr error) {
+	if n <= 0 {
+		return nil, fmt.Errorf("number of parts must be positive but got %d", n)
+	}
+	opts, err := parseOptions(opt...)
+	if err != nil {
+		return nil, err
+	}
+	layerFiles := newTempFiles()
+	defer func() {
+		if rErr != nil {
+			if err := layerFiles.CleanupAll(); err != nil {
+				rErr = fmt.Errorf("failed to cleanup tmp files: %v: %w", err, rErr)
+			}
+		}
+	}()
+	tarBlob, err = decompressBlob(tarBlob, layerFiles, opts.gzipHelperFunc)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := sortEntries(tarBlob, opts.prioritizedFiles, opts.prefetchTiers, opts.missedPrioritizedFiles)
+	if err != nil {
+		return nil, err
+	}
+	tarParts := divideEntries(entries, n)
+	var remaining atomic.Int64
+	remaining.Store(int64(len(tarParts)))
+	parts := make([]io.ReadCloser, len(tarParts))
+	for i, p := range tarParts {
+		pr := readerFromEntries(p...)
+		var closeOnce sync.Once
+		parts[i] = readCloser{
+			Reader: pr,
+			closeFunc: func() (err error) {
+				closeOnce.Do(func() {
+					pr.Close()
+					if remaining.Add(-1) == 0 {
+						err = layerFiles.CleanupAll()
+					}
+				})
+				return
+			},
+		}
+	}
+	return parts, nil
+}
+
+const (
+	// accessedChunkSize is the minimum chunk size of the files in the access trace.
+	accessedChunkSize = 4 << 20
+
+	// onDemandChunkSize is the default chunk size of the files not in the access trace.
+	onDemandChunkSize = 1 << 20
+)
+
+// accessTraceChunkSizes returns the function to choose the chunk sizes of the files
+// depending on whether they are in the access trace.
+func accessTraceChunkSizes(opts *options) func(name string, size int64) (chunkSize, minChunkSize int) {
+	accessed := make(map[string]struct{}, len(opts.prioritizedFiles))
+	for _, f := range opts.prioritizedFiles {
+		accessed[cleanEntryName(f)] = struct{}{}
+	}
+	onDemand := opts.chunkSize
+	if onDemand <= 0 {
+		onDemand = onDemandChunkSize
+	}
+	prefetched := max(onDemand, accessedChunkSize)
+	return func(name string, size int64) (int, int) {
+		if _, ok := accessed[name]; ok {
+			// Prefetched files are fetched together so there is no need to
+			// split streams of small files.
+			return prefetched, prefetched
+		}
+		return onDemand, opts.minChunkSize
+	}
+}
+
+// BuildFragment builds a fragment of eStargz blob from a plain tar stream which is
+// typically one of the parts returned by SplitTar. Fragments can be built in parallel
+// and concatenated by ConcatFragments. Options for the chunks and compression are
+// applied to the fragment. Note that WithMinChunkSize and WithDedupFiles
+// are applied in each fragment so the resulting blob can be larger than the one built by
+// Build. The caller must close the fragment to remove the temporary file.
+func BuildFragment(tarPart io.Reader, opt ...Option) (*Fragment, error) {
+	opts, err := parseOptions(opt...)
+	if err != nil {
+		return nil, err
+	}
+	layerFiles := newTempFiles()
+	f, err := buildFragment(tarPart, opts, layerFiles)
+	if err != nil {
+		if cErr := layerFiles.CleanupAll(); cErr != nil {
+			err = fmt.Errorf("failed to cleanup tmp files: %v: %w", cErr, err)
+		}
+		return nil, err
+	}
+	opts.progress.done()
+	f.closeFunc = layerFiles.CleanupAll
+	return f, nil
+}
+
+// ConcatFragments concatenates fragments into a single eStargz blob that has one TOC
+// merging TOCs of all fragments. Fragments must be passed in the order of the parts
+// returned by SplitTar and must be built with the compression specified to this
+// function. The result is deterministic regardless of where and in which order the
+// fragments are built. Fragments must not be closed until the returned blob is fully
+// read. Closing the returned blob doesn't close fragments.
+func ConcatFragments(fragments []*Fragment, opt ...Option) (*Blob, error) {
+	opts, err := parseOptions(opt...)
+	if err != nil {
+		return nil, err
+	}
+	r, toc, tocDgst, err := concatFragments(fragments, opts)
+	if err != nil {
+		return nil, err
+	}
+	return newBlob(r, opts, toc, tocDgst, scanFindingsOf(fragments), func() error { return nil }), nil
+}
+
+func buildFragment(tarPart io.Reader, opts *options, layerFiles *tempFiles) (*Fragment, error) {
+	esgzFile, err := layerFiles.TempFile("", "esgzdata")
+	if err != nil {
+		return nil, err
+	}
+	sw := NewWriterWithCompressor(esgzFile, opts.compression)
+	sw.ChunkSize = opts.chunkSize
+	sw.MinChunkSize = opts.minChunkSize
+	if opts.accessTrace {
+		sw.ChunkSizeFunc = accessTraceChunkSizes(opts)
+	}
+	sw.SparseFiles = opts.sparseFiles
+	sw.DedupFiles = opts.dedupFiles
+	sw.AdaptiveCompression = opts.adaptiveCompression
+	sw.DeltaBase = opts.deltaBase
+	sw.DigestAlgorithm = opts.digestAlgorithm
+	sw.Scanners = opts.scanners
+	if sw.needsOpenGzEntries == nil {
+		sw.needsOpenGzEntries = make(map[string]struct{})
+	}
+	for _, f := range []string{PrefetchLandmark, NoPrefetchLandmark} {
+		sw.needsOpenGzEntries[f] = struct{}{}
+	}
+	for i := range opts.prefetchTiers {
+		sw.needsOpenGzEntries[PrefetchTierLandmark(i)] = struct{}{}
+	}
+	ctx := opts.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	flushProgress := opts.progress.trackEntries(ctx, sw)
+	if err := sw.AppendTar(&contextReader{ctx, tarPart}); err != nil {
+		return nil, err
+	}
+
+	// Close the writer without writing TOC and footer so the contents can be
+	// combined with other fragments.
+	if err := sw.closeGz(); err != nil {
+		return nil, err
+	}
+	if err := sw.bw.Flush(); err != nil {
+		return nil, err
+	}
+	sw.closed = true
+	flushProgress()
+	payload, err := fileSectionReader(esgzFile)
+	if err != nil {
+		return nil, err
+	}
+	return &Fragment{Payload: payload, TOC: sw.toc, ScanFindings: sw.ScanFindings()}, nil
+}
+
+// scanFindingsOf returns the scan findings of the fragments in order.
+func scanFindingsOf(fragments []*Fragment) (findings []ScanFinding) {
+	for _, f := range fragments {
+		findings = append(findings, f.ScanFindings...)
+	}
+	return
+}
+
+// concatFragments returns a reader of the eStargz blob that concatenates the fragments,
+// the merged TOC and its digest.
+func concatFragments(fragments []*Fragment, opts *options) (io.Reader, *JTOC, digest.Digest, error) {
+	gc, isGzip := opts.compression.(interface{ gzipCompressionLevel() int })
+	if opts.prefixTOC && !isGzip {
+		return nil, nil, "", fmt.Errorf("prefix TOC is supported only with gzip compression")
+	}
+	if opts.compressedTOC && !isGzip {
+		return nil, nil, "", fmt.Errorf("compressed TOC is supported only with gzip compression")
+	}
+	toc, tocOffset, err := mergeFragmentTOCs(fragments)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	var rs []io.Reader
+	if opts.prefixTOC {
+		prefix, err := prefixTOC(gc.gzipCompressionLevel(), toc)
+		if err != nil {
+			return nil, nil, "", err
+		}
+		rs = append(rs, bytes.NewReader(prefix))
+		tocOffset += int64(len(prefix))
+	}
+	var compressor Compressor = opts.compression
+	if opts.compressedTOC {
+		compressor = &GzipCompressor{compressionLevel: gc.gzipCompressionLevel(), compressedTOC: true}
+	}
+	tocAndFooterR, tocDgst, err := tocAndFooter(compressor, toc, tocOffset)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	for _, f := range fragments {
+		rs = append(rs, io.NewSectionReader(f.Payload, 0, f.Payload.Size()))
+	}
+	return io.MultiReader(append(rs, tocAndFooterR)...), toc, tocDgst, nil
+}
+
+// mergeFragmentTOCs returns the TOC that combines TOCs of all fragments and the
+// offset of the end of the combined payloads. TOCs of the fragments are not modified.
+func mergeFragmentTOCs(fragments []*Fragment) (toc *JTOC, tocOffset int64, err error) {
+	if len(fragments) == 0 {
+		return nil, 0, fmt.Errorf("at least one fragment must be passed")
+	}
+	var (
+		mtoc          = new(JTOC)
+		currentOffset int64
+	)
+	for i, f := range fragments {
+		if f == nil || f.Payload == nil || f.TOC == nil {
+			return nil, 0, fmt.Errorf("fragment %d doesn't have payload or TOC", i)
+		}
+		for _, e := range f.TOC.Entries {
+			e := *e
+			// Recalculate Offset of non-empty files/chunks stored in the blob
+			if ((e.Type == "reg" && e.Size > 0) || e.Type == "chunk") && !e.Hole && !e.BaseChunk && e.Dedup == "" {
+				e.Offset += currentOffset
+			}
+			mtoc.Entries = append(mtoc.Entries, &e)
+		}
+		if f.TOC.Version > mtoc.Version {
+			mtoc.Version = f.TOC.Version
+		}
+		if f.TOC.Base != "" {
+			mtoc.Base = f.TOC.Base
+		}
+		currentOffset += f.Payload.Size()
+	}
+	return mtoc, currentOffset, nil
+}
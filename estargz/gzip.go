@@ -33,6 +33,7 @@ import (
 	"io"
 	"strconv"
 
+	"github.com/klauspost/compress/zstd"
 	digest "github.com/opencontainers/go-digest"
 )
 
@@ -43,33 +44,53 @@ type gzipCompression struct {
 
 func newGzipCompressionWithLevel(level int) Compression {
 	return &gzipCompression{
-		&GzipCompressor{level},
+		&GzipCompressor{compressionLevel: level},
 		&GzipDecompressor{},
 	}
 }
 
 func NewGzipCompressor() *GzipCompressor {
-	return &GzipCompressor{gzip.BestCompression}
+	return &GzipCompressor{compressionLevel: gzip.BestCompression}
 }
 
 func NewGzipCompressorWithLevel(level int) *GzipCompressor {
-	return &GzipCompressor{level}
+	return &GzipCompressor{compressionLevel: level}
 }
 
 type GzipCompressor struct {
 	compressionLevel int
+
+	// compressedTOC compresses the TOC JSON with zstd. See WithCompressedTOC.
+	compressedTOC bool
 }
 
 func (gc *GzipCompressor) Writer(w io.Writer) (WriteFlushCloser, error) {
 	return gzip.NewWriterLevel(w, gc.compressionLevel)
 }
 
+func (gc *GzipCompressor) WriterFor(w io.Writer, c Compressibility) (WriteFlushCloser, error) {
+	return gzip.NewWriterLevel(w, c.GzipLevel(gc.compressionLevel))
+}
+
+func (gc *GzipCompressor) gzipCompressionLevel() int {
+	return gc.compressionLevel
+}
+
 func (gc *GzipCompressor) WriteTOCAndFooter(w io.Writer, off int64, toc *JTOC, diffHash hash.Hash) (digest.Digest, error) {
 	tocJSON, err := json.MarshalIndent(toc, "", "\t")
 	if err != nil {
 		return "", err
 	}
-	gz, _ := gzip.NewWriterLevel(w, gc.compressionLevel)
+	name, contents, level, footerID := TOCTarName, tocJSON, gc.compressionLevel, byte('G')
+	if gc.compressedTOC {
+		contents, err = compressTOCJSON(tocJSON)
+		if err != nil {
+			return "", err
+		}
+		// The contents are already compressed.
+		name, level, footerID = CompressedTOCTarName, gzip.NoCompression, 'Z'
+	}
+	gz, _ := gzip.NewWriterLevel(w, level)
 	gw := io.Writer(gz)
 	if diffHash != nil {
 		gw = io.MultiWriter(gz, diffHash)
@@ -77,12 +98,12 @@ func (gc *GzipCompressor) WriteTOCAndFooter(w io.Writer, off int64, toc *JTOC, d
 	tw := tar.NewWriter(gw)
 	if err := tw.WriteHeader(&tar.Header{
 		Typeflag: tar.TypeReg,
-		Name:     TOCTarName,
-		Size:     int64(len(tocJSON)),
+		Name:     name,
+		Size:     int64(len(contents)),
 	}); err != nil {
 		return "", err
 	}
-	if _, err := tw.Write(tocJSON); err != nil {
+	if _, err := tw.Write(contents); err != nil {
 		return "", err
 	}
 
@@ -92,21 +113,37 @@ func (gc *GzipCompressor) WriteTOCAndFooter(w io.Writer, off int64, toc *JTOC, d
 	if err := gz.Close(); err != nil {
 		return "", err
 	}
-	if _, err := w.Write(gzipFooterBytes(off)); err != nil {
+	if _, err := w.Write(gzipFooterBytesWithID(off, footerID)); err != nil {
 		return "", err
 	}
 	return digest.FromBytes(tocJSON), nil
 }
 
+// compressTOCJSON compresses the TOC JSON with zstd.
+func compressTOCJSON(tocJSON []byte) ([]byte, error) {
+	enc, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedBestCompression), zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	defer enc.Close()
+	return enc.EncodeAll(tocJSON, nil), nil
+}
+
 // gzipFooterBytes returns the 51 bytes footer.
 func gzipFooterBytes(tocOff int64) []byte {
+	return gzipFooterBytesWithID(tocOff, 'G')
+}
+
+// gzipFooterBytesWithID returns the 51 bytes footer with the subfield ID SI2. 'Z' indicates
+// that the TOC JSON is compressed with zstd.
+func gzipFooterBytesWithID(tocOff int64, si2 byte) []byte {
 	buf := bytes.NewBuffer(make([]byte, 0, FooterSize))
 	gz, _ := gzip.NewWriterLevel(buf, gzip.NoCompression) // MUST be NoCompression to keep 51 bytes
 
 	// Extra header indicating the offset of TOCJSON
 	// https://tools.ietf.org/html/rfc1952#section-2.3.1.1
 	header := make([]byte, 4)
-	header[0], header[1] = 'S', 'G'
+	header[0], header[1] = 'S', si2
 	subfield := fmt.Sprintf("%016xSTARGZ", tocOff)
 	binary.LittleEndian.PutUint16(header[2:4], uint16(len(subfield))) // little-endian per RFC1952
 	gz.Extra = append(header, []byte(subfield)...)
@@ -120,7 +157,7 @@ func gzipFooterBytes(tocOff int64) []byte {
 type GzipDecompressor struct{}
 
 func (gz *GzipDecompressor) Reader(r io.Reader) (io.ReadCloser, error) {
-	return gzip.NewReader(r)
+	return NewGzipReader(r)
 }
 
 func (gz *GzipDecompressor) ParseTOC(r io.Reader) (toc *JTOC, tocDgst digest.Digest, err error) {
@@ -141,8 +178,8 @@ func (gz *GzipDecompressor) ParseFooter(p []byte) (blobPayloadSize, tocOffset, t
 		return 0, 0, 0, fmt.Errorf("invalid extra field length %d; expected >= 4", len(extra))
 	}
 	si1, si2, subfieldlen, subfield := extra[0], extra[1], extra[2:4], extra[4:]
-	if si1 != 'S' || si2 != 'G' {
-		return 0, 0, 0, fmt.Errorf("invalid subfield IDs: %q, %q; want E, S", si1, si2)
+	if si1 != 'S' || (si2 != 'G' && si2 != 'Z') {
+		return 0, 0, 0, fmt.Errorf("invalid subfield IDs: %q, %q; want S, G or S, Z", si1, si2)
 	}
 	if slen := binary.LittleEndian.Uint16(subfieldlen); slen != uint16(16+len("STARGZ")) {
 		return 0, 0, 0, fmt.Errorf("invalid length of subfield %d; want %d", slen, 16+len("STARGZ"))
@@ -168,7 +205,7 @@ func (gz *GzipDecompressor) DecompressTOC(r io.Reader) (tocJSON io.ReadCloser, e
 type LegacyGzipDecompressor struct{}
 
 func (gz *LegacyGzipDecompressor) Reader(r io.Reader) (io.ReadCloser, error) {
-	return gzip.NewReader(r)
+	return NewGzipReader(r)
 }
 
 func (gz *LegacyGzipDecompressor) ParseTOC(r io.Reader) (toc *JTOC, tocDgst digest.Digest, err error) {
@@ -207,7 +244,11 @@ func (gz *LegacyGzipDecompressor) DecompressTOC(r io.Reader) (tocJSON io.ReadClo
 }
 
 func parseTOCEStargz(r io.Reader) (toc *JTOC, tocDgst digest.Digest, err error) {
-	tr, err := decompressTOCEStargz(r)
+	return parseTOCEntry(r, TOCTarName)
+}
+
+func parseTOCEntry(r io.Reader, name string) (toc *JTOC, tocDgst digest.Digest, err error) {
+	tr, err := decompressTOCEntry(r, name)
 	if err != nil {
 		return nil, "", err
 	}
@@ -223,6 +264,10 @@ func parseTOCEStargz(r io.Reader) (toc *JTOC, tocDgst digest.Digest, err error)
 }
 
 func decompressTOCEStargz(r io.Reader) (tocJSON io.ReadCloser, err error) {
+	return decompressTOCEntry(r, TOCTarName)
+}
+
+func decompressTOCEntry(r io.Reader, name string) (tocJSON io.ReadCloser, err error) {
 	zr, err := gzip.NewReader(r)
 	if err != nil {
 		return nil, fmt.Errorf("malformed TOC gzip header: %v", err)
@@ -233,8 +278,18 @@ func decompressTOCEStargz(r io.Reader) (tocJSON io.ReadCloser, err error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to find tar header in TOC gzip stream: %v", err)
 	}
-	if h.Name != TOCTarName {
-		return nil, fmt.Errorf("TOC tar entry had name %q; expected %q", h.Name, TOCTarName)
+	if name == TOCTarName && h.Name == CompressedTOCTarName {
+		dr, err := zstd.NewReader(tr, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, fmt.Errorf("malformed compressed TOC: %v", err)
+		}
+		return readCloser{dr, func() error {
+			dr.Close()
+			return zr.Close()
+		}}, nil
+	}
+	if h.Name != name {
+		return nil, fmt.Errorf("TOC tar entry had name %q; expected %q", h.Name, name)
 	}
 	return readCloser{tr, zr.Close}, nil
 }
@@ -26,6 +26,7 @@ import (
 	"bytes"
 	"compress/gzip"
 	"fmt"
+	"io"
 	"testing"
 )
 
@@ -57,7 +58,7 @@ func TestGzipEStargz(t *testing.T) {
 
 func gzipControllerWithLevel(compressionLevel int) TestingControllerFactory {
 	return func() TestingController {
-		return &gzipController{&GzipCompressor{compressionLevel}, &GzipDecompressor{}}
+		return &gzipController{&GzipCompressor{compressionLevel: compressionLevel}, &GzipDecompressor{}}
 	}
 }
 
@@ -160,3 +161,72 @@ func legacyFooterBytes(tocOff int64) []byte {
 	}
 	return buf.Bytes()
 }
+
+func TestGzipReaderReuse(t *testing.T) {
+	compress := func(data string) []byte {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write([]byte(data))
+		zw.Close()
+		return buf.Bytes()
+	}
+	for i, data := range []string{"first stream", "second stream", ""} {
+		zr, err := NewGzipReader(bytes.NewReader(compress(data)))
+		if err != nil {
+			t.Fatalf("failed to open stream %d: %v", i, err)
+		}
+		got, err := io.ReadAll(zr)
+		if err != nil || string(got) != data {
+			t.Errorf("stream %d = %q, %v; want %q", i, got, err, data)
+		}
+		if err := zr.Close(); err != nil {
+			t.Errorf("failed to close stream %d: %v", i, err)
+		}
+		if err := zr.Close(); err != nil {
+			t.Errorf("closing stream %d twice must succeed: %v", i, err)
+		}
+	}
+	if _, err := NewGzipReader(bytes.NewReader([]byte("invalid"))); err == nil {
+		t.Errorf("invalid stream must fail")
+	}
+	// The reader returned to the pool after the failure is reusable.
+	zr, err := NewGzipReader(bytes.NewReader(compress("after failure")))
+	if err != nil {
+		t.Fatalf("failed to open stream: %v", err)
+	}
+	defer zr.Close()
+	if got, err := io.ReadAll(zr); err != nil || string(got) != "after failure" {
+		t.Errorf("stream = %q, %v; want %q", got, err, "after failure")
+	}
+}
+
+func TestRawGzipReader(t *testing.T) {
+	data := bytes.Repeat([]byte("stored payload "), 10000) // more than a stored block
+	for _, tt := range []struct {
+		name   string
+		header gzip.Header
+		level  int
+		want   error
+	}{
+		{name: "stored", level: gzip.NoCompression},
+		{name: "stored with header fields", header: gzip.Header{Name: "name", Comment: "comment", Extra: []byte("extra")}, level: gzip.NoCompression},
+		{name: "compressed", level: gzip.BestSpeed, want: ErrCompressed},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			zw, _ := gzip.NewWriterLevel(&buf, tt.level)
+			zw.Header = tt.header
+			zw.Write(data[:len(data)/2])
+			zw.Flush()
+			zw.Write(data[len(data)/2:])
+			zw.Close()
+			got, err := io.ReadAll(NewRawGzipReader(bytes.NewReader(buf.Bytes())))
+			if err != tt.want {
+				t.Fatalf("err = %v; want %v", err, tt.want)
+			}
+			if tt.want == nil && !bytes.Equal(got, data) {
+				t.Errorf("unexpected payload of %d bytes", len(got))
+			}
+		})
+	}
+}
@@ -0,0 +1,200 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package estargz
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// LintIssue is an inconsistency of the TOC found by Lint.
+type LintIssue struct {
+	// Name is the name of the file.
+	Name string `json:"name"`
+
+	// Offset is the offset of the compressed chunk in the blob.
+	Offset int64 `json:"offset"`
+
+	// ChunkOffset is the offset of the chunk in the file.
+	ChunkOffset int64 `json:"chunkOffset"`
+
+	// Message describes the issue.
+	Message string `json:"message"`
+}
+
+func (i LintIssue) String() string {
+	return fmt.Sprintf("%q (offset=%d, chunkOffset=%d): %s", i.Name, i.Offset, i.ChunkOffset, i.Message)
+}
+
+// Lint checks the TOC of the blob for inconsistencies that blobs produced by other
+// builders can have and returns the found issues. The following are checked.
+//
+//   - Chunks are recorded in the order of their offsets in the blob. Readers assume that
+//     a compressed chunk ends at the offset of the next one.
+//   - Chunks in the same compressed stream don't overlap.
+//   - Chunks of each file cover the file without gaps and overlaps.
+//   - Each chunk can be read at its offset and innerOffset and matches the chunk
+//     digest if recorded.
+//
+// The returned error is non-nil only when the blob can't be walked. Normalize rewrites
+// blobs with issues into the layout of Build.
+func (r *Reader) Lint() ([]LintIssue, error) {
+	var issues []LintIssue
+	add := func(e *TOCEntry, format string, a ...any) {
+		issues = append(issues, LintIssue{
+			Name:        e.Name,
+			Offset:      e.Offset,
+			ChunkOffset: e.ChunkOffset,
+			Message:     fmt.Sprintf(format, a...),
+		})
+	}
+
+	var prev *TOCEntry
+	for _, e := range r.toc.Entries {
+		if !isStoredChunk(e) {
+			continue
+		}
+		if prev != nil {
+			if e.Offset < prev.Offset {
+				add(e, "offset is smaller than %d of the previous chunk of %q", prev.Offset, prev.Name)
+			} else if e.Offset == prev.Offset && e.InnerOffset < prev.InnerOffset+prev.ChunkSize {
+				add(e, "innerOffset %d overlaps the previous chunk of %q in the same stream (innerOffset=%d, chunkSize=%d)",
+					e.InnerOffset, prev.Name, prev.InnerOffset, prev.ChunkSize)
+			}
+		}
+		prev = e
+	}
+
+	seen := make(map[string]struct{})
+	for _, e := range r.toc.Entries {
+		if e.Type != "reg" || e.Size == 0 || e.Dedup != "" {
+			continue // deduplicated files are checked with the files storing the contents
+		}
+		if _, ok := seen[e.Name]; ok {
+			continue
+		}
+		seen[e.Name] = struct{}{}
+		fr, err := r.newFileReader(e.Name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open %q: %w", e.Name, err)
+		}
+		var end int64
+		for _, ce := range fr.ents {
+			if ce.ChunkOffset != end {
+				add(ce, "chunk starts at %d but the previous chunk ends at %d", ce.ChunkOffset, end)
+			}
+			end = ce.ChunkOffset + ce.ChunkSize
+			if !isStoredChunk(ce) {
+				continue
+			}
+			if ce.ChunkDigest != "" {
+				if m := fr.verifyChunk(ce, ce.ChunkDigest); m != nil {
+					if m.Error != "" {
+						add(ce, "%s", m.Error)
+					} else {
+						add(ce, "digest %s doesn't match %s", m.Got, m.Want)
+					}
+				}
+			} else if err := fr.copyChunk(io.Discard, ce); err != nil {
+				add(ce, "failed to read chunk: %v", err)
+			}
+		}
+		if end != e.Size {
+			add(e, "chunks end at %d but the file size is %d", end, e.Size)
+		}
+	}
+	return issues, nil
+}
+
+// isStoredChunk returns true if the contents of the entry are stored in the blob.
+func isStoredChunk(e *TOCEntry) bool {
+	return e.isDataType() && e.ChunkSize > 0 && !e.Hole && !e.BaseChunk && e.Dedup == ""
+}
+
+// Normalize rewrites the eStargz blob (e.g. produced by other builders) into the layout
+// of Build. The tar contents of the blob are kept and the TOC is regenerated, so the
+// inconsistencies reported by Lint are fixed. The prefetch landmarks and the tiers of
+// the blob are kept unless WithPrioritizedFiles or WithPrefetchTiers is specified.
+// If the blob isn't gzip-based, the compression algorithm of the blob must be specified
+// using WithCompression option, which is used for the new blob as well.
+//
+// Sparse files, delta blobs and deduplicated files aren't supported because their
+// contents aren't stored in the blob as a tar.
+func Normalize(sr *io.SectionReader, opt ...Option) (_ *Blob, rErr error) {
+	opts, err := parseOptions(opt...)
+	if err != nil {
+		return nil, err
+	}
+	r, err := Open(sr, WithDecompressors(opts.compression))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open eStargz blob: %w", err)
+	}
+	for _, e := range r.toc.Entries {
+		if e.Hole {
+			return nil, fmt.Errorf("blob with sparse files cannot be normalized")
+		}
+		if e.BaseChunk {
+			return nil, fmt.Errorf("delta blob cannot be normalized")
+		}
+		if e.Dedup != "" {
+			return nil, fmt.Errorf("blob with deduplicated files cannot be normalized")
+		}
+	}
+
+	tarR, err := Unpack(sr, r.decompressor)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unpack eStargz blob: %w", err)
+	}
+	defer tarR.Close()
+	tarFile, err := os.CreateTemp("", "normalizetar")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		tarFile.Close()
+		os.Remove(tarFile.Name())
+	}()
+	if _, err := io.Copy(tarFile, tarR); err != nil {
+		return nil, fmt.Errorf("failed to decompress eStargz blob: %w", err)
+	}
+	tarSR, err := fileSectionReader(tarFile)
+	if err != nil {
+		return nil, err
+	}
+	return Build(tarSR, append([]Option{WithPrefetchTiers(r.prefetchTiers())}, opt...)...)
+}
+
+// prefetchTiers returns the files placed before the prefetch landmark grouped by the
+// tier landmarks.
+func (r *Reader) prefetchTiers() [][]string {
+	if _, ok := r.Lookup(PrefetchLandmark); !ok {
+		return nil
+	}
+	tiers := [][]string{nil}
+	for _, e := range r.toc.Entries {
+		switch {
+		case e.Name == PrefetchLandmark:
+			return tiers
+		case IsLandmark(e.Name):
+			tiers = append(tiers, nil) // tier landmark
+		case e.Type != "chunk" && e.Name != "":
+			tiers[len(tiers)-1] = append(tiers[len(tiers)-1], e.Name)
+		}
+	}
+	return tiers
+}
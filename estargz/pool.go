@@ -0,0 +1,57 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package estargz
+
+import (
+	"compress/gzip"
+	"io"
+	"sync"
+)
+
+// gzipReaderPool is the pool of the gzip readers reused among the reads of chunks.
+var gzipReaderPool sync.Pool
+
+// NewGzipReader is the same as gzip.NewReader but reuses the gzip readers closed before
+// so reads of many chunks don't allocate the decompressor for each. The reader must not be
+// used after Close.
+func NewGzipReader(r io.Reader) (io.ReadCloser, error) {
+	zr, ok := gzipReaderPool.Get().(*gzip.Reader)
+	if !ok {
+		zr = new(gzip.Reader)
+	}
+	if err := zr.Reset(r); err != nil {
+		gzipReaderPool.Put(zr)
+		return nil, err
+	}
+	return &pooledGzipReader{Reader: zr}, nil
+}
+
+type pooledGzipReader struct {
+	*gzip.Reader
+	closed bool
+}
+
+func (r *pooledGzipReader) Close() error {
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	err := r.Reader.Close()
+	gzipReaderPool.Put(r.Reader)
+	r.Reader = nil
+	return err
+}
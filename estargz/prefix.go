@@ -0,0 +1,140 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package estargz
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+const (
+	// prefixTOCPaddingOverhead is the number of bytes needed for adding an empty
+	// padding subfield to the gzip header (2 bytes XLEN + SI1 + SI2 + 2 bytes LEN).
+	prefixTOCPaddingOverhead = 6
+
+	// prefixTOCSlack is the number of bytes reserved for the growth of the prefix
+	// TOC stream caused by shifting offsets in the TOC.
+	prefixTOCSlack = 64
+
+	maxPrefixTOCAttempts = 10
+)
+
+// ParsePrefixTOC parses the TOC JSON placed at the beginning of the blob built with
+// WithPrefixTOC option. r must be positioned at the beginning of the blob and only
+// the first gzip stream is read from r so this can be used by consumers that can
+// only read the blob forward. The returned digest is the same as the digest of the
+// TOC JSON referenced by the footer.
+func ParsePrefixTOC(r io.Reader) (toc *JTOC, tocDgst digest.Digest, err error) {
+	return parseTOCEntry(r, PrefixTOCTarName)
+}
+
+// prefixTOC returns a gzip stream that contains a copy of toc, to be placed at the
+// beginning of the blob. Offsets in toc are shifted by the size of the returned stream
+// so that toc can also be written as the footer-referenced TOC.
+//
+// Shifting offsets can change the size of the compressed TOC so this is repeated until
+// the size of the stream matches the shift. The stream is padded with an extra field
+// in the gzip header to fill the gap.
+func prefixTOC(compressionLevel int, toc *JTOC) ([]byte, error) {
+	var size, shifted int64
+	for i := 0; i < maxPrefixTOCAttempts; i++ {
+		shiftTOCOffsets(toc, size-shifted)
+		shifted = size
+		b, err := prefixTOCBytes(compressionLevel, toc, -1)
+		if err != nil {
+			return nil, err
+		}
+		n := int64(len(b))
+		if n == size {
+			return b, nil
+		}
+		if pad := size - n - prefixTOCPaddingOverhead; pad >= 0 && pad <= math.MaxUint16-4 {
+			b, err := prefixTOCBytes(compressionLevel, toc, int(pad))
+			if err != nil {
+				return nil, err
+			}
+			if int64(len(b)) != size {
+				return nil, fmt.Errorf("unexpected size of prefix TOC %d; want %d", len(b), size)
+			}
+			return b, nil
+		}
+		size = n + prefixTOCPaddingOverhead + prefixTOCSlack
+	}
+	return nil, fmt.Errorf("failed to determine the size of prefix TOC")
+}
+
+// prefixTOCBytes writes toc as a gzip stream. If pad is non-negative, a padding subfield
+// (SI1 = 'S', SI2 = 'P') with pad bytes of zeros is added to the gzip header.
+// The tar archive isn't closed because entries of the blob follow this stream.
+func prefixTOCBytes(compressionLevel int, toc *JTOC, pad int) ([]byte, error) {
+	tocJSON, err := json.MarshalIndent(toc, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+	buf := new(bytes.Buffer)
+	gz, err := gzip.NewWriterLevel(buf, compressionLevel)
+	if err != nil {
+		return nil, err
+	}
+	if pad >= 0 {
+		extra := make([]byte, 4+pad)
+		extra[0], extra[1] = 'S', 'P'
+		binary.LittleEndian.PutUint16(extra[2:4], uint16(pad)) // little-endian per RFC1952
+		gz.Extra = extra
+	}
+	tw := tar.NewWriter(gz)
+	if err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     PrefixTOCTarName,
+		Size:     int64(len(tocJSON)),
+	}); err != nil {
+		return nil, err
+	}
+	if _, err := tw.Write(tocJSON); err != nil {
+		return nil, err
+	}
+	if err := tw.Flush(); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// shiftTOCOffsets adds delta to the offsets of non-empty files and chunks in toc.
+func shiftTOCOffsets(toc *JTOC, delta int64) {
+	if delta == 0 {
+		return
+	}
+	for _, e := range toc.Entries {
+		if e.Hole || e.BaseChunk || e.Dedup != "" {
+			continue // holes, base chunks and deduplicated files aren't stored in the blob
+		}
+		if (e.Type == "reg" && e.Size > 0) || e.Type == "chunk" {
+			e.Offset += delta
+		}
+	}
+}
@@ -0,0 +1,136 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package estargz
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+// Progress is the progress of building an eStargz blob reported to the function
+// specified by WithProgress.
+type Progress struct {
+	// Entries is the number of tar entries processed.
+	Entries int64
+
+	// BytesWritten is the number of compressed bytes written to the blob. TOC and
+	// footer aren't included.
+	BytesWritten int64
+
+	// CurrentFile is the name of the tar entry being processed. This is empty when
+	// all entries are processed.
+	CurrentFile string
+}
+
+// WithProgress specifies a function called with the progress of Build and BuildFragment
+// when each tar entry starts to be processed and after all entries are processed. Calls
+// are serialized even when the blob is built in parallel, so f doesn't need to be safe
+// for concurrent use but should return quickly.
+func WithProgress(f func(Progress)) Option {
+	return func(o *options) error {
+		o.progressFunc = f
+		return nil
+	}
+}
+
+// progress accumulates the progress of the fragments of a blob built in parallel.
+type progress struct {
+	f func(Progress)
+
+	mu sync.Mutex
+	p  Progress
+}
+
+func newProgress(f func(Progress)) *progress {
+	if f == nil {
+		return nil
+	}
+	return &progress{f: f}
+}
+
+// update adds the entries processed and the bytes written by a fragment and reports
+// the progress with the entry being processed.
+func (p *progress) update(entries, written int64, current string) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.p.Entries += entries
+	p.p.BytesWritten += written
+	p.p.CurrentFile = current
+	p.f(p.p)
+}
+
+// add adds the entries processed and the bytes written by a fragment without reporting.
+func (p *progress) add(entries, written int64) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.p.Entries += entries
+	p.p.BytesWritten += written
+}
+
+// done reports that all entries are processed.
+func (p *progress) done() {
+	p.update(0, 0, "")
+}
+
+// trackEntries makes the writer report the progress and stop on the cancellation of ctx
+// when each entry starts to be written. The returned function must be called after the
+// writer is flushed to add the last entry and the remaining bytes.
+func (p *progress) trackEntries(ctx context.Context, w *Writer) (flush func()) {
+	var (
+		started bool
+		written int64
+	)
+	entryDone := func() int64 {
+		if started {
+			return 1
+		}
+		return 0
+	}
+	w.entryHook = func(name string) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		n := w.cw.n
+		p.update(entryDone(), n-written, name)
+		started, written = true, n
+		return nil
+	}
+	return func() {
+		p.add(entryDone(), w.cw.n-written)
+	}
+}
+
+// contextReader fails reads after ctx is canceled so that a large tar entry doesn't
+// delay the cancellation.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
@@ -0,0 +1,487 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package estargz
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+// Rechunk rewrites the existing eStargz blob with the chunk size and the minimal chunk size
+// specified by WithChunkSize and WithMinChunkSize options. If the blob isn't gzip-based,
+// the compression algorithm of the blob must be specified using WithCompression option.
+//
+// Unlike Build, this function doesn't recompress the entire blob. Compressed streams
+// whose boundaries are kept in the new layout are copied to the new blob as-is and only
+// streams affected by the new chunking are recompressed. TOC is regenerated for the new
+// layout. The uncompressed tar contents are kept unchanged.
+func Rechunk(sr *io.SectionReader, opt ...Option) (_ *Blob, rErr error) {
+	var opts options
+	opts.compressionLevel = gzip.BestCompression // BestCompression by default
+	for _, o := range opt {
+		if err := o(&opts); err != nil {
+			return nil, err
+		}
+	}
+	if opts.compression == nil {
+		opts.compression = newGzipCompressionWithLevel(opts.compressionLevel)
+	}
+	ctx := opts.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	r, err := Open(sr, WithDecompressors(opts.compression))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open eStargz blob: %w", err)
+	}
+	footerSize := r.decompressor.FooterSize()
+	if sr.Size() < footerSize {
+		return nil, fmt.Errorf("blob is too small; %d < %d", sr.Size(), footerSize)
+	}
+	footer := make([]byte, footerSize)
+	if _, err := sr.ReadAt(footer, sr.Size()-footerSize); err != nil {
+		return nil, fmt.Errorf("error reading footer: %w", err)
+	}
+	_, tocOffset, _, err := r.decompressor.ParseFooter(footer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse footer: %w", err)
+	}
+	if tocOffset < 0 {
+		return nil, fmt.Errorf("blob with external TOC cannot be rechunked")
+	}
+	for _, e := range r.toc.Entries {
+		if e.Hole {
+			return nil, fmt.Errorf("blob with sparse files cannot be rechunked")
+		}
+		if e.BaseChunk {
+			return nil, fmt.Errorf("delta blob cannot be rechunked")
+		}
+		if e.Dedup != "" {
+			return nil, fmt.Errorf("blob with deduplicated files cannot be rechunked")
+		}
+	}
+
+	layerFiles := newTempFiles()
+	defer func() {
+		if rErr != nil {
+			if err := layerFiles.CleanupAll(); err != nil {
+				rErr = fmt.Errorf("failed to cleanup tmp files: %v: %w", err, rErr)
+			}
+		}
+	}()
+	esgzFile, err := layerFiles.TempFile("", "esgzdata")
+	if err != nil {
+		return nil, err
+	}
+	bw := bufio.NewWriter(esgzFile)
+	rc := &rechunker{
+		ctx:          ctx,
+		sr:           sr,
+		compressor:   opts.compression,
+		decompressor: r.decompressor,
+		chunkSize:    int64(opts.chunkSize),
+		minChunkSize: int64(opts.minChunkSize),
+		digestAlg:    opts.digestAlgorithm,
+		cw:           &countWriter{w: bw},
+	}
+	if rc.chunkSize <= 0 {
+		rc.chunkSize = 4 << 20 // same as the default of Writer
+	}
+	if rc.digestAlg == "" {
+		rc.digestAlg = digest.Canonical // same as the default of Writer
+	}
+	toc, err := rc.rechunk(r.toc, tocOffset)
+	if err != nil {
+		return nil, err
+	}
+	if err := bw.Flush(); err != nil {
+		return nil, err
+	}
+	tocAndFooterR, tocDgst, err := tocAndFooter(opts.compression, toc, rc.cw.n)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := fileSectionReader(esgzFile)
+	if err != nil {
+		return nil, err
+	}
+	return newBlob(io.MultiReader(payload, tocAndFooterR), &opts, toc, tocDgst, nil, layerFiles.CleanupAll), nil
+}
+
+// rechunker rewrites the payload of an eStargz blob with the new chunking.
+// All positions of chunks are managed as the offset in the uncompressed tar stream.
+type rechunker struct {
+	ctx          context.Context
+	sr           *io.SectionReader
+	compressor   Compressor
+	decompressor Decompressor
+	chunkSize    int64
+	minChunkSize int64
+	digestAlg    digest.Algorithm
+
+	cw *countWriter
+
+	// the compression stream currently being written.
+	zw       WriteFlushCloser
+	zOpen    bool  // true if a stream is started; zw is lazily created on write.
+	zOffset  int64 // compressed offset of the current stream
+	zUncompP int64 // uncompressed position of the top of the current stream
+
+	pos    int64          // current uncompressed position
+	chunks []*rechunkInfo // chunks of the new layout sorted by the position
+	placed int            // index of the first chunk not yet placed in the new blob
+	hashed int            // index of the first chunk not yet fully digested
+}
+
+// rechunkInfo is a chunk in the new layout.
+type rechunkInfo struct {
+	pos         int64 // uncompressed position of the top of the chunk
+	chunkOffset int64
+	chunkSize   int64
+	forceOpen   bool // needs to be placed at the top of a new stream
+
+	offset      int64
+	innerOffset int64
+	digester    digest.Digester
+}
+
+func (rc *rechunker) rechunk(toc *JTOC, tocOffset int64) (*JTOC, error) {
+	// Enumerate compressed streams in the original blob. Each stream begins at the
+	// offset of a chunk (or at the top of the blob).
+	streamOffsets := []int64{0}
+	entsOfOffset := make(map[int64][]*TOCEntry)
+	for _, e := range toc.Entries {
+		if !isRechunkTarget(e) {
+			continue
+		}
+		if e.Offset >= tocOffset {
+			return nil, fmt.Errorf("offset %d of %q exceeds TOC offset %d", e.Offset, e.Name, tocOffset)
+		}
+		entsOfOffset[e.Offset] = append(entsOfOffset[e.Offset], e)
+		if e.InnerOffset == 0 {
+			streamOffsets = append(streamOffsets, e.Offset)
+		}
+	}
+	sort.Slice(streamOffsets, func(i, j int) bool { return streamOffsets[i] < streamOffsets[j] })
+	streamOffsets = uniqueOffsets(streamOffsets)
+
+	chunksOfEntry := make(map[*TOCEntry][]*rechunkInfo)
+	for i, off := range streamOffsets {
+		if err := rc.ctx.Err(); err != nil {
+			return nil, err
+		}
+		end := tocOffset
+		if i+1 < len(streamOffsets) {
+			end = streamOffsets[i+1]
+		}
+		data, err := rc.decompressStream(off, end)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress stream at %d: %w", off, err)
+		}
+
+		// Register chunks of the new layout for files starting from this stream.
+		oldInner := make(map[int64]struct{})
+		for _, e := range entsOfOffset[off] {
+			if e.InnerOffset > 0 {
+				oldInner[rc.pos+e.InnerOffset] = struct{}{}
+			}
+			if e.Type == "reg" {
+				if chunksOfEntry[e], err = rc.addChunks(e, rc.pos+e.InnerOffset); err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		// The next stream always begins at the top of a chunk in the new layout if the
+		// first chunk there is the top of a file or is kept in the new layout.
+		nextIsBoundary := end == tocOffset
+		if !nextIsBoundary {
+			for _, e := range entsOfOffset[end] {
+				if e.InnerOffset == 0 && (e.Type == "reg" || rc.hasChunkAt(rc.pos+int64(len(data)))) {
+					nextIsBoundary = true
+					break
+				}
+			}
+		}
+		reusable, err := rc.reusable(off == 0, data, oldInner, nextIsBoundary)
+		if err != nil {
+			return nil, err
+		}
+		if reusable {
+			err = rc.copyStream(off, end, data)
+		} else {
+			err = rc.writeStream(data)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := rc.closeStream(); err != nil {
+		return nil, err
+	}
+	if rc.placed != len(rc.chunks) || rc.hashed != len(rc.chunks) {
+		return nil, fmt.Errorf("payload of the blob is shorter than the files in TOC")
+	}
+
+	// Regenerate TOC with the new layout.
+	newTOC := &JTOC{Version: toc.Version}
+	for _, e := range toc.Entries {
+		if e.Type == "chunk" {
+			continue
+		}
+		chunks, ok := chunksOfEntry[e]
+		if !ok {
+			ne := *e
+			newTOC.Entries = append(newTOC.Entries, &ne)
+			continue
+		}
+		for i, c := range chunks {
+			var ne *TOCEntry
+			if i == 0 {
+				cp := *e
+				ne = &cp
+			} else {
+				ne = &TOCEntry{
+					Name: e.Name,
+					Type: "chunk",
+				}
+			}
+			ne.Offset = c.offset
+			ne.InnerOffset = c.innerOffset
+			ne.ChunkOffset = c.chunkOffset
+			ne.ChunkSize = 0
+			if e.Size-c.chunkOffset >= rc.chunkSize {
+				ne.ChunkSize = c.chunkSize
+			}
+			ne.ChunkDigest = c.digester.Digest().String()
+			newTOC.Entries = append(newTOC.Entries, ne)
+		}
+	}
+	return newTOC, nil
+}
+
+func (rc *rechunker) decompressStream(begin, end int64) ([]byte, error) {
+	dr, err := rc.decompressor.Reader(io.NewSectionReader(rc.sr, begin, end-begin))
+	if err != nil {
+		return nil, err
+	}
+	defer dr.Close()
+	return io.ReadAll(dr)
+}
+
+// addChunks registers chunks of the specified file in the new layout.
+func (rc *rechunker) addChunks(e *TOCEntry, pos int64) (chunks []*rechunkInfo, err error) {
+	forceOpen := IsLandmark(e.Name)
+	for off := int64(0); off < e.Size; off += rc.chunkSize {
+		size := rc.chunkSize
+		if remain := e.Size - off; remain < size {
+			size = remain
+		}
+		dgstr, err := ChunkDigester(rc.digestAlg)
+		if err != nil {
+			return nil, err
+		}
+		c := &rechunkInfo{
+			pos:         pos + off,
+			chunkOffset: off,
+			chunkSize:   size,
+			forceOpen:   forceOpen && off == 0,
+			digester:    dgstr,
+		}
+		rc.chunks = append(rc.chunks, c)
+		chunks = append(chunks, c)
+	}
+	return
+}
+
+func (rc *rechunker) hasChunkAt(pos int64) bool {
+	for _, c := range rc.chunks[rc.placed:] {
+		if c.pos == pos {
+			return true
+		} else if c.pos > pos {
+			break
+		}
+	}
+	return false
+}
+
+// reusable returns true if the current stream can be copied to the new blob without
+// recompression. This is possible when the stream begins and ends at the boundaries
+// of chunks of the new layout and there is no new chunk boundary inside of it.
+func (rc *rechunker) reusable(top bool, data []byte, oldInner map[int64]struct{}, nextIsBoundary bool) (bool, error) {
+	if !nextIsBoundary {
+		return false, nil
+	}
+	end := rc.pos + int64(len(data))
+	var startsAtTop bool
+	for _, c := range rc.chunks[rc.placed:] {
+		if c.pos >= end {
+			break
+		}
+		if c.pos == rc.pos {
+			startsAtTop = true
+			continue
+		}
+		if _, ok := oldInner[c.pos]; !ok || c.forceOpen {
+			return false, nil
+		}
+		delete(oldInner, c.pos)
+	}
+	if len(oldInner) > 0 || (!top && !startsAtTop) {
+		return false, nil
+	}
+	if !rc.zOpen || rc.zw == nil {
+		return true, nil
+	}
+	// A new stream can be started here only when the current stream is large enough.
+	if err := rc.zw.Flush(); err != nil {
+		return false, err
+	}
+	return rc.cw.n-rc.zOffset >= rc.minChunkSize, nil
+}
+
+// copyStream copies the compressed stream from the original blob as-is.
+func (rc *rechunker) copyStream(begin, end int64, data []byte) error {
+	if err := rc.closeStream(); err != nil {
+		return err
+	}
+	offset := rc.cw.n
+	if _, err := io.Copy(rc.cw, io.NewSectionReader(rc.sr, begin, end-begin)); err != nil {
+		return err
+	}
+	end = rc.pos + int64(len(data))
+	for ; rc.placed < len(rc.chunks) && rc.chunks[rc.placed].pos < end; rc.placed++ {
+		c := rc.chunks[rc.placed]
+		c.offset = offset
+		c.innerOffset = c.pos - rc.pos
+	}
+	rc.digest(data)
+	rc.pos = end
+	return nil
+}
+
+// writeStream compresses the passed data with starting new streams at chunk boundaries.
+func (rc *rechunker) writeStream(data []byte) error {
+	end := rc.pos + int64(len(data))
+	for ; rc.placed < len(rc.chunks) && rc.chunks[rc.placed].pos < end; rc.placed++ {
+		c := rc.chunks[rc.placed]
+		n := c.pos - rc.pos
+		if err := rc.write(data[:n]); err != nil { // this also advances rc.pos to c.pos
+			return err
+		}
+		data = data[n:]
+		newStream := !rc.zOpen || c.forceOpen
+		if !newStream {
+			if rc.zw != nil {
+				// We flush the underlying compression writer here to correctly calculate "rc.cw.n".
+				if err := rc.zw.Flush(); err != nil {
+					return err
+				}
+			}
+			newStream = rc.cw.n-rc.zOffset >= rc.minChunkSize
+		}
+		if newStream {
+			if err := rc.closeStream(); err != nil {
+				return err
+			}
+			rc.openStream()
+		}
+		c.offset = rc.zOffset
+		c.innerOffset = c.pos - rc.zUncompP
+	}
+	return rc.write(data)
+}
+
+func (rc *rechunker) write(p []byte) error {
+	if len(p) == 0 {
+		return nil
+	}
+	if !rc.zOpen {
+		rc.openStream()
+	}
+	if rc.zw == nil {
+		zw, err := rc.compressor.Writer(rc.cw)
+		if err != nil {
+			return err
+		}
+		rc.zw = zw
+	}
+	if _, err := rc.zw.Write(p); err != nil {
+		return err
+	}
+	rc.digest(p)
+	rc.pos += int64(len(p))
+	return nil
+}
+
+func (rc *rechunker) openStream() {
+	rc.zOpen = true
+	rc.zOffset = rc.cw.n
+	rc.zUncompP = rc.pos
+}
+
+func (rc *rechunker) closeStream() error {
+	if rc.zw != nil {
+		if err := rc.zw.Close(); err != nil {
+			return err
+		}
+		rc.zw = nil
+	}
+	rc.zOpen = false
+	return nil
+}
+
+// digest calculates the digests of chunks with the data at the current position.
+func (rc *rechunker) digest(p []byte) {
+	begin, end := rc.pos, rc.pos+int64(len(p))
+	for ; rc.hashed < len(rc.chunks); rc.hashed++ {
+		c := rc.chunks[rc.hashed]
+		if c.pos >= end {
+			return
+		}
+		cEnd := c.pos + c.chunkSize
+		lo, hi := max(c.pos, begin), min(cEnd, end)
+		if lo < hi {
+			c.digester.Hash().Write(p[lo-begin : hi-begin])
+		}
+		if cEnd > end {
+			return // this chunk continues to the next data
+		}
+	}
+}
+
+func isRechunkTarget(e *TOCEntry) bool {
+	return (e.Type == "reg" && e.Size > 0) || e.Type == "chunk"
+}
+
+func uniqueOffsets(offsets []int64) []int64 {
+	var res []int64
+	for i, o := range offsets {
+		if i > 0 && offsets[i-1] == o {
+			continue
+		}
+		res = append(res, o)
+	}
+	return res
+}
@@ -0,0 +1,189 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package estargz
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+// VerificationReport is the result of verifying all chunks in an eStargz blob.
+type VerificationReport struct {
+	// TOCDigest is the digest of the TOC JSON contained in the blob.
+	TOCDigest digest.Digest `json:"tocDigest"`
+
+	// TOCVerified is true if TOCDigest matches the expected TOC digest.
+	TOCVerified bool `json:"tocVerified"`
+
+	// Chunks is the number of chunks checked.
+	Chunks int `json:"chunks"`
+
+	// Files are the files containing chunks that failed the verification.
+	Files []FileVerificationReport `json:"files,omitempty"`
+}
+
+// OK returns true if the TOC and all chunks are verified.
+func (rep *VerificationReport) OK() bool {
+	return rep.TOCVerified && len(rep.Files) == 0
+}
+
+// FileVerificationReport is the list of chunks of a file that failed the verification.
+type FileVerificationReport struct {
+	// Name is the name of the file.
+	Name string `json:"name"`
+
+	// Chunks are the chunks that failed the verification.
+	Chunks []ChunkMismatch `json:"chunks"`
+}
+
+// ChunkMismatch describes a chunk that failed the verification.
+type ChunkMismatch struct {
+	// Offset is the offset of the compressed chunk in the blob.
+	Offset int64 `json:"offset"`
+
+	// ChunkOffset is the offset of the chunk in the file.
+	ChunkOffset int64 `json:"chunkOffset"`
+
+	// ChunkSize is the uncompressed size of the chunk.
+	ChunkSize int64 `json:"chunkSize"`
+
+	// Want is the digest of the chunk recorded in the TOC. Empty if no digest is recorded.
+	Want digest.Digest `json:"want,omitempty"`
+
+	// Got is the digest of the chunk contents in the blob. Empty if the chunk can't be read.
+	Got digest.Digest `json:"got,omitempty"`
+
+	// Error describes the failure of reading the chunk or of the digest recorded in the TOC.
+	Error string `json:"error,omitempty"`
+}
+
+// VerifyReport reads and checks all chunks in the blob against the digests
+// recorded in the TOC, and returns the report of the TOC digest and the chunks that
+// don't match. Unlike VerifyTOC, this doesn't stop at the first failure so the
+// corrupted regions of the blob can be located. The returned error is non-nil
+// only when the blob can't be walked.
+func (r *Reader) VerifyReport(tocDigest digest.Digest) (*VerificationReport, error) {
+	rep := &VerificationReport{
+		TOCDigest:   r.tocDigest,
+		TOCVerified: r.tocDigest == tocDigest,
+	}
+
+	// Layers without chunk entries can be verified by digests of regular files.
+	useRegDigest := true
+	for _, e := range r.toc.Entries {
+		if e.Type == "chunk" {
+			useRegDigest = false
+			break
+		}
+	}
+
+	seen := make(map[string]struct{})
+	for _, e := range r.toc.Entries {
+		if e.Type != "reg" || e.Size == 0 || e.Dedup != "" {
+			continue // deduplicated files are verified with the files storing the contents
+		}
+		if _, ok := seen[e.Name]; ok {
+			continue
+		}
+		seen[e.Name] = struct{}{}
+		fr, err := r.newFileReader(e.Name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open %q: %w", e.Name, err)
+		}
+		var mismatches []ChunkMismatch
+		for _, ce := range fr.ents {
+			if ce.Hole || ce.BaseChunk {
+				continue // holes and base chunks aren't stored in the blob
+			}
+			rep.Chunks++
+			want := ce.ChunkDigest
+			if want == "" && useRegDigest && len(fr.ents) == 1 {
+				want = e.Digest
+			}
+			if m := fr.verifyChunk(ce, want); m != nil {
+				mismatches = append(mismatches, *m)
+			}
+		}
+		if len(mismatches) > 0 {
+			rep.Files = append(rep.Files, FileVerificationReport{Name: e.Name, Chunks: mismatches})
+		}
+	}
+	return rep, nil
+}
+
+// verifyChunk checks the chunk against the digest and returns the mismatch or nil if
+// the chunk is verified.
+func (fr *fileReader) verifyChunk(ce *TOCEntry, want string) *ChunkMismatch {
+	m := &ChunkMismatch{
+		Offset:      ce.Offset,
+		ChunkOffset: ce.ChunkOffset,
+		ChunkSize:   ce.ChunkSize,
+		Want:        digest.Digest(want),
+	}
+	if want == "" {
+		m.Error = "no digest is recorded"
+		return m
+	}
+	dgst, err := ParseChunkDigest(want)
+	if err != nil {
+		m.Error = fmt.Sprintf("invalid digest: %v", err)
+		return m
+	}
+	v, err := ChunkDigestVerifier(dgst)
+	if err != nil {
+		m.Error = fmt.Sprintf("unsupported digest algorithm %q", dgst.Algorithm())
+		return m
+	}
+	w := io.Writer(v)
+	dgstr, err := ChunkDigester(dgst.Algorithm()) // reports the digest of the contents if available
+	if err == nil {
+		w = io.MultiWriter(v, dgstr.Hash())
+	}
+	if err := fr.copyChunk(w, ce); err != nil {
+		m.Error = fmt.Sprintf("failed to read chunk: %v", err)
+		return m
+	}
+	if !v.Verified() {
+		if dgstr != nil {
+			m.Got = dgstr.Digest()
+		} else {
+			m.Error = "digest mismatch"
+		}
+		return m
+	}
+	return nil
+}
+
+// copyChunk decompresses the chunk and writes its contents to w.
+func (fr *fileReader) copyChunk(w io.Writer, ce *TOCEntry) error {
+	sr := io.NewSectionReader(fr.r.sr, ce.Offset, ce.NextOffset()-ce.Offset)
+	dr, err := fr.r.decompressor.Reader(bufio.NewReader(sr))
+	if err != nil {
+		return err
+	}
+	defer dr.Close()
+	if n, err := io.CopyN(io.Discard, dr, ce.InnerOffset); err != nil || n != ce.InnerOffset {
+		return fmt.Errorf("discard of %d bytes != %v, %v", ce.InnerOffset, n, err)
+	}
+	if n, err := io.CopyN(w, dr, ce.ChunkSize); err != nil || n != ce.ChunkSize {
+		return fmt.Errorf("read of %d bytes != %v, %v", ce.ChunkSize, n, err)
+	}
+	return nil
+}
@@ -0,0 +1,199 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package estargz
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"maps"
+	"sync"
+
+	splittar "github.com/vbatts/tar-split/archive/tar"
+)
+
+// Scanner scans the contents of tar entries while they are converted (e.g. for malware or
+// secrets) so that security pipelines can gate the conversion without reading the layer
+// again. See WithScanners.
+type Scanner interface {
+	// Scan scans the tar entry of h whose contents are read from r. r is empty for entries
+	// other than regular files. Scan doesn't need to read r to the end. Scan is called
+	// concurrently for entries converted in parallel and must not modify h. Returning an
+	// error fails the conversion.
+	Scan(h *tar.Header, r io.Reader) (ScanVerdict, error)
+}
+
+// ScanVerdict is the result of scanning a tar entry by a Scanner.
+type ScanVerdict struct {
+	// Reject fails the conversion with ScanRejectedError.
+	Reject bool
+
+	// Reason optionally describes the finding (e.g. the name of the detected malware).
+	Reason string
+
+	// Annotations are optionally added to the converted layer (see ScanAnnotations).
+	Annotations map[string]string
+}
+
+func (v ScanVerdict) isZero() bool {
+	return !v.Reject && v.Reason == "" && len(v.Annotations) == 0
+}
+
+// ScanFinding is a verdict other than the zero value returned by a Scanner.
+type ScanFinding struct {
+	// Name is the name of the tar entry.
+	Name string
+
+	ScanVerdict
+}
+
+// ScanRejectedError is returned when a Scanner rejects a tar entry.
+type ScanRejectedError struct {
+	// Name is the name of the tar entry.
+	Name string
+
+	// Reason is the reason returned by the Scanner.
+	Reason string
+}
+
+func (e *ScanRejectedError) Error() string {
+	return fmt.Sprintf("%q is rejected by scanner: %s", e.Name, e.Reason)
+}
+
+// WithScanners option streams the contents of each tar entry to the scanners while the blob
+// is built so the layer is read only once. A verdict rejecting an entry fails the build with
+// ScanRejectedError. Other verdicts are recorded to the blob (see Blob.ScanFindings).
+func WithScanners(scanners ...Scanner) Option {
+	return func(o *options) error {
+		o.scanners = scanners
+		return nil
+	}
+}
+
+// ScanAnnotations merges the annotations of the findings. Annotations of later findings
+// take precedence.
+func ScanAnnotations(findings []ScanFinding) map[string]string {
+	var annotations map[string]string
+	for _, f := range findings {
+		if len(f.Annotations) > 0 && annotations == nil {
+			annotations = make(map[string]string)
+		}
+		maps.Copy(annotations, f.Annotations)
+	}
+	return annotations
+}
+
+// ScanFindings returns the findings of Writer.Scanners on the entries appended so far.
+func (w *Writer) ScanFindings() []ScanFinding {
+	return w.scanFindings
+}
+
+// entryScan streams the contents of a tar entry to the scanners, each of which reads them
+// in its own goroutine.
+type entryScan struct {
+	name     string
+	pws      []*io.PipeWriter
+	closed   []bool // true if the scanner stopped reading
+	verdicts []ScanVerdict
+	errs     []error
+	wg       sync.WaitGroup
+}
+
+func (w *Writer) startScan(h *splittar.Header) *entryScan {
+	s := &entryScan{
+		name:     cleanEntryName(h.Name),
+		closed:   make([]bool, len(w.Scanners)),
+		verdicts: make([]ScanVerdict, len(w.Scanners)),
+		errs:     make([]error, len(w.Scanners)),
+	}
+	for i, sc := range w.Scanners {
+		pr, pw := io.Pipe()
+		s.pws = append(s.pws, pw)
+		hdr := scanHeader(h) // the writer may modify h
+		s.wg.Go(func() {
+			s.verdicts[i], s.errs[i] = sc.Scan(hdr, pr)
+			pr.Close() // unblock writes of the contents that aren't read
+		})
+	}
+	return s
+}
+
+// scanHeader converts the header read by the writer to the one of archive/tar.
+func scanHeader(h *splittar.Header) *tar.Header {
+	return &tar.Header{
+		Typeflag:   h.Typeflag,
+		Name:       h.Name,
+		Linkname:   h.Linkname,
+		Size:       h.Size,
+		Mode:       h.Mode,
+		Uid:        h.Uid,
+		Gid:        h.Gid,
+		Uname:      h.Uname,
+		Gname:      h.Gname,
+		ModTime:    h.ModTime,
+		AccessTime: h.AccessTime,
+		ChangeTime: h.ChangeTime,
+		Devmajor:   h.Devmajor,
+		Devminor:   h.Devminor,
+		PAXRecords: maps.Clone(h.PAXRecords),
+		Format:     tar.Format(h.Format),
+	}
+}
+
+// Write passes p to the scanners. This never fails even if scanners stop reading.
+func (s *entryScan) Write(p []byte) (int, error) {
+	for i, pw := range s.pws {
+		if !s.closed[i] {
+			if _, err := pw.Write(p); err != nil {
+				s.closed[i] = true
+			}
+		}
+	}
+	return len(p), nil
+}
+
+// finish passes the rest of the contents in r to the scanners and waits for the verdicts.
+func (s *entryScan) finish(w *Writer, r io.Reader) error {
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		s.abort()
+		return fmt.Errorf("failed to read payload of %q: %w", s.name, err)
+	}
+	for _, pw := range s.pws {
+		pw.Close()
+	}
+	s.wg.Wait()
+	for i, v := range s.verdicts {
+		if err := s.errs[i]; err != nil {
+			return fmt.Errorf("failed to scan %q: %w", s.name, err)
+		}
+		if v.Reject {
+			return &ScanRejectedError{Name: s.name, Reason: v.Reason}
+		}
+		if !v.isZero() {
+			w.scanFindings = append(w.scanFindings, ScanFinding{Name: s.name, ScanVerdict: v})
+		}
+	}
+	return nil
+}
+
+// abort stops the scanners without waiting for the rest of the contents.
+func (s *entryScan) abort() {
+	for _, pw := range s.pws {
+		pw.CloseWithError(io.ErrUnexpectedEOF)
+	}
+	s.wg.Wait()
+}
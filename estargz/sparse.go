@@ -0,0 +1,156 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package estargz
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path"
+	"strconv"
+
+	"github.com/vbatts/tar-split/archive/tar"
+)
+
+// blockSize is the size of a block of tar.
+const blockSize = 512
+
+// minHoleSize is the minimal size of a chunk to be recorded as a hole.
+// Smaller chunks filled with zeros are stored in the blob as-is because the
+// sparse map of the tar entry costs more than compressing them.
+const minHoleSize = 4096
+
+// sparsePAXPrefix is a placeholder of "GNU.sparse." prefix of PAX records.
+// archive/tar drops PAX records with "GNU.sparse." prefix so we write them with this
+// placeholder and replace it after encoding the header. This has the same length as
+// the actual prefix so the length fields of the records remain valid.
+const sparsePAXPrefix = "GNU_sparse."
+
+// spoolPayload copies the regular file payload to a temporary file and reports which chunks
+// are holes (filled with zeros). The returned holes is nil if the payload contains no hole.
+// The caller must close and remove the returned file.
+func spoolPayload(r io.Reader, size, chunkSize int64) (_ *os.File, holes []bool, retErr error) {
+	f, err := os.CreateTemp("", "estargz-payload")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		if retErr != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+	var hasHole bool
+	buf := make([]byte, min(chunkSize, size))
+	for written := int64(0); written < size; {
+		b := buf[:min(chunkSize, size-written)]
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, nil, fmt.Errorf("failed to read payload: %w", err)
+		}
+		isHole := len(b) >= minHoleSize && isZero(b)
+		hasHole = hasHole || isHole
+		holes = append(holes, isHole)
+		if _, err := f.Write(b); err != nil {
+			return nil, nil, err
+		}
+		written += int64(len(b))
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, nil, err
+	}
+	if !hasHole {
+		holes = nil
+	}
+	return f, holes, nil
+}
+
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// writeSparseHeader writes the header of the regular file as a sparse file of PAX format 1.0.
+// The sparse map that follows the header is written as well so the caller needs to write
+// only the data of non-hole chunks and the padding. This returns the number of bytes of
+// the data of the tar entry written.
+func writeSparseHeader(w io.Writer, h *tar.Header, holes []bool, chunkSize int64) (int64, error) {
+	type fragment struct{ offset, length int64 }
+	var fragments []fragment
+	var dataSize int64
+	for i, isHole := range holes {
+		if isHole {
+			continue
+		}
+		off := int64(i) * chunkSize
+		length := min(chunkSize, h.Size-off)
+		if n := len(fragments); n > 0 && fragments[n-1].offset+fragments[n-1].length == off {
+			fragments[n-1].length += length
+		} else {
+			fragments = append(fragments, fragment{off, length})
+		}
+		dataSize += length
+	}
+	if n := len(fragments); n == 0 || fragments[n-1].offset+fragments[n-1].length < h.Size {
+		// Indicate the size of the file ending with a hole, as GNU tar does.
+		fragments = append(fragments, fragment{h.Size, 0})
+	}
+	var sparseMap []byte
+	sparseMap = append(strconv.AppendInt(sparseMap, int64(len(fragments)), 10), '\n')
+	for _, f := range fragments {
+		sparseMap = append(strconv.AppendInt(sparseMap, f.offset, 10), '\n')
+		sparseMap = append(strconv.AppendInt(sparseMap, f.length, 10), '\n')
+	}
+	if pad := len(sparseMap) % blockSize; pad > 0 {
+		sparseMap = append(sparseMap, make([]byte, blockSize-pad)...)
+	}
+
+	sh := *h
+	sh.PAXRecords = maps.Clone(h.PAXRecords)
+	if sh.PAXRecords == nil {
+		sh.PAXRecords = make(map[string]string)
+	}
+	dir, file := path.Split(h.Name)
+	sh.Name = path.Join(dir, "GNUSparseFile.0", file)
+	sh.Size = int64(len(sparseMap)) + dataSize
+	sh.Format = tar.FormatPAX
+	sh.PAXRecords[sparsePAXPrefix+"major"] = "1"
+	sh.PAXRecords[sparsePAXPrefix+"minor"] = "0"
+	sh.PAXRecords[sparsePAXPrefix+"name"] = h.Name
+	sh.PAXRecords[sparsePAXPrefix+"realsize"] = strconv.FormatInt(h.Size, 10)
+	var buf bytes.Buffer
+	if err := tar.NewWriter(&buf).WriteHeader(&sh); err != nil {
+		return 0, err
+	}
+	// Replace the placeholder of the keys of the records in the PAX header.
+	// Each record is formatted as "<length> <key>=<value>\n".
+	hdr := buf.Bytes()
+	records := hdr[blockSize : len(hdr)-blockSize]
+	copy(records, bytes.ReplaceAll(records, []byte(" "+sparsePAXPrefix), []byte(" GNU.sparse.")))
+	if _, err := w.Write(hdr); err != nil {
+		return 0, err
+	}
+	if _, err := w.Write(sparseMap); err != nil {
+		return 0, err
+	}
+	return sh.Size, nil
+}
@@ -0,0 +1,385 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package estargz
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// whiteoutPrefix is a filename prefix defined by the OCI image spec that indicates
+	// that the file is removed.
+	whiteoutPrefix = ".wh."
+
+	// whiteoutOpaqueDir is a filename defined by the OCI image spec that indicates that
+	// the parent directory is opaque.
+	whiteoutOpaqueDir = whiteoutPrefix + whiteoutPrefix + ".opq"
+)
+
+// Squash merges the passed eStargz layers into one eStargz blob. Layers must be ordered
+// from the lowest to the uppermost. Whiteouts in upper layers are applied to the contents
+// of lower layers. Whiteouts and opaque directory markers that can hide contents of layers
+// below the squashed ones are kept in the result.
+//
+// Each file keeps the chunk boundaries of its source layer. Prioritized files of all layers
+// are placed before the prefetch landmark of the result, in the order of the layers.
+// The compression algorithm of the result can be specified by WithCompression option.
+// Layers compressed with that algorithm or gzip can be passed.
+func Squash(layers []*io.SectionReader, opt ...Option) (_ *Blob, rErr error) {
+	var opts options
+	opts.compressionLevel = gzip.BestCompression // BestCompression by default
+	for _, o := range opt {
+		if err := o(&opts); err != nil {
+			return nil, err
+		}
+	}
+	if opts.compression == nil {
+		opts.compression = newGzipCompressionWithLevel(opts.compressionLevel)
+	}
+	if len(layers) == 0 {
+		return nil, fmt.Errorf("at least one layer must be passed")
+	}
+	ctx := opts.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	s := &squasher{entries: make(map[string]*squashEntry)}
+	for i, sr := range layers {
+		r, err := Open(sr, WithDecompressors(opts.compression))
+		if err != nil {
+			return nil, fmt.Errorf("failed to open layer %d: %w", i, err)
+		}
+		if err := s.add(r); err != nil {
+			return nil, fmt.Errorf("failed to squash layer %d: %w", i, err)
+		}
+	}
+
+	layerFiles := newTempFiles()
+	defer func() {
+		if rErr != nil {
+			if err := layerFiles.CleanupAll(); err != nil {
+				rErr = fmt.Errorf("failed to cleanup tmp files: %v: %w", err, rErr)
+			}
+		}
+		if cErr := ctx.Err(); cErr != nil {
+			rErr = fmt.Errorf("error from context %q: %w", cErr, rErr)
+		}
+	}()
+	esgzFile, err := layerFiles.TempFile("", "esgzdata")
+	if err != nil {
+		return nil, err
+	}
+	w := NewWriterWithCompressor(esgzFile, opts.compression)
+	w.MinChunkSize = opts.minChunkSize
+	w.SparseFiles = opts.sparseFiles
+	w.DedupFiles = opts.dedupFiles
+	w.AdaptiveCompression = opts.adaptiveCompression
+	w.needsOpenGzEntries = map[string]struct{}{
+		PrefetchLandmark:   {},
+		NoPrefetchLandmark: {},
+	}
+	for _, se := range s.sorted() {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		e, err := se.tarEntry()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get tar entry of %q: %w", se.name, err)
+		}
+		w.ChunkSize = opts.chunkSize
+		if se.chunkSize > 0 {
+			w.ChunkSize = int(se.chunkSize)
+		}
+		if err := w.AppendTar(readerFromEntries(e)); err != nil {
+			return nil, fmt.Errorf("failed to write %q: %w", se.name, err)
+		}
+	}
+	tocDgst, err := w.Close()
+	if err != nil {
+		return nil, err
+	}
+	blob, err := fileSectionReader(esgzFile)
+	if err != nil {
+		return nil, err
+	}
+	return newBlob(blob, &opts, w.toc, tocDgst, nil, layerFiles.CleanupAll), nil
+}
+
+// squasher merges entries of layers with applying whiteouts.
+type squasher struct {
+	entries     map[string]*squashEntry
+	seq         int
+	prioritized bool // true if any of layers has prioritized files
+}
+
+// squashEntry is an entry in the squashed layer.
+type squashEntry struct {
+	name        string
+	r           *Reader
+	e           *TOCEntry
+	seq         int   // order of the entry in the squashed layer
+	prioritized bool  // true if the entry is prioritized in the source layer
+	chunkSize   int64 // chunk size to keep the chunk boundaries of the source
+	synthetic   bool  // true if the entry isn't contained in any source layers
+	linked      bool  // true if the entry is a hardlink converted into the target file
+}
+
+func (s *squasher) add(r *Reader) error {
+	// Prioritized files are ones placed before the prefetch landmark.
+	var prioritized bool
+	for _, e := range r.toc.Entries {
+		if e.Name == PrefetchLandmark {
+			prioritized = true
+			break
+		}
+	}
+
+	// Whiteouts only hide contents in lower layers so apply them first.
+	for _, e := range r.toc.Entries {
+		if e.Type == "chunk" {
+			continue
+		}
+		dir, base := path.Split(e.Name)
+		dir = strings.TrimSuffix(dir, "/")
+		switch {
+		case base == whiteoutOpaqueDir:
+			s.removeChildren(dir)
+		case strings.HasPrefix(base, whiteoutPrefix):
+			s.remove(path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix)))
+		}
+	}
+
+	for _, e := range r.toc.Entries {
+		switch e.Name {
+		case PrefetchLandmark:
+			prioritized = false
+			s.prioritized = true
+			continue
+		case NoPrefetchLandmark:
+			continue
+		}
+		if IsLandmark(e.Name) {
+			continue // prefetch tiers of the source layers aren't kept
+		}
+		if e.Type == "chunk" {
+			continue
+		}
+		se := &squashEntry{
+			name:        e.Name,
+			r:           r,
+			e:           e,
+			prioritized: prioritized,
+		}
+		if chunks := r.chunks[e.Name]; e.Type == "reg" && len(chunks) > 1 {
+			se.chunkSize = chunks[0].ChunkSize
+		} else if e.Type == "reg" {
+			se.chunkSize = e.Size // not chunked; keep it as one chunk
+		}
+		s.put(se)
+	}
+	return nil
+}
+
+func (s *squasher) put(se *squashEntry) {
+	dir, base := path.Split(se.name)
+	dir = strings.TrimSuffix(dir, "/")
+	var needsOpaque bool
+	if !strings.HasPrefix(base, whiteoutPrefix) {
+		// This entry overrides the whiteout in the lower layer. If this is a directory,
+		// it must be opaque to keep hiding the contents below the squashed layers.
+		wh := path.Join(dir, whiteoutPrefix+base)
+		if _, ok := s.entries[wh]; ok {
+			delete(s.entries, wh)
+			needsOpaque = se.e.Type == "dir"
+		}
+	}
+	if old, ok := s.entries[se.name]; ok && old.e.Type == "dir" && se.e.Type == "dir" {
+		// Keep the position of the directory so it's placed before its children.
+		se.seq = old.seq
+	} else {
+		if ok && old.e.Type == "dir" {
+			s.removeChildren(se.name)
+		}
+		s.seq++
+		se.seq = s.seq
+	}
+	s.entries[se.name] = se
+	if needsOpaque {
+		opq := path.Join(se.name, whiteoutOpaqueDir)
+		s.seq++
+		s.entries[opq] = &squashEntry{
+			name:      opq,
+			e:         &TOCEntry{Name: opq, Type: "reg", Mode: 0644},
+			seq:       s.seq,
+			synthetic: true,
+		}
+	}
+}
+
+func (s *squasher) remove(name string) {
+	delete(s.entries, name)
+	s.removeChildren(name)
+}
+
+func (s *squasher) removeChildren(dir string) {
+	for name := range s.entries {
+		if dir == "" || strings.HasPrefix(name, dir+"/") {
+			if name != "" {
+				delete(s.entries, name)
+			}
+		}
+	}
+}
+
+// sorted returns the entries in the order to be written to the squashed layer.
+// Hardlinks whose target isn't available in the squashed layer are converted into
+// regular files. When several hardlinks of such a target remain, only the first one
+// stores the contents and the others are hardlinks to it.
+func (s *squasher) sorted() []*squashEntry {
+	var ents []*squashEntry
+	for _, se := range s.entries {
+		if se.e.Type == "hardlink" {
+			target, err := se.r.getSource(se.e)
+			if err != nil {
+				continue // the target doesn't exist in the source
+			}
+			if te, ok := s.entries[cleanEntryName(se.e.LinkName)]; !ok || te.e != target {
+				// The target is removed or replaced by the upper layer. Keep the contents.
+				se.e, se.linked = target, true
+				se.chunkSize = target.Size
+				if chunks := se.r.chunks[target.Name]; len(chunks) > 1 {
+					se.chunkSize = chunks[0].ChunkSize
+				}
+			} else {
+				// hardlink must be placed after the target
+				se.seq = max(se.seq, te.seq)
+				se.prioritized = se.prioritized && te.prioritized
+			}
+		}
+		ents = append(ents, se)
+	}
+	sort.SliceStable(ents, func(i, j int) bool {
+		if ents[i].prioritized != ents[j].prioritized {
+			return ents[i].prioritized
+		}
+		if ents[i].seq != ents[j].seq {
+			return ents[i].seq < ents[j].seq
+		}
+		return ents[i].e.Type != "hardlink" && ents[j].e.Type == "hardlink"
+	})
+	firstLinks := make(map[*TOCEntry]string) // target -> name of the first hardlink storing it
+	for _, se := range ents {
+		if !se.linked {
+			continue
+		}
+		if first, ok := firstLinks[se.e]; ok {
+			l := *se.e
+			l.Type, l.LinkName, l.Size = "hardlink", first, 0
+			se.e = &l
+		} else {
+			firstLinks[se.e] = se.name
+		}
+	}
+	landmark := NoPrefetchLandmark
+	if s.prioritized {
+		landmark = PrefetchLandmark
+	}
+	lm := &squashEntry{
+		name:      landmark,
+		e:         &TOCEntry{Name: landmark, Type: "reg", Size: int64(len([]byte{landmarkContents}))},
+		synthetic: true,
+	}
+	var pos int
+	for pos < len(ents) && ents[pos].prioritized {
+		pos++
+	}
+	return append(ents[:pos], append([]*squashEntry{lm}, ents[pos:]...)...)
+}
+
+// tarEntry returns the tar header and the payload of the entry.
+func (se *squashEntry) tarEntry() (*entry, error) {
+	e := se.e
+	h := &tar.Header{
+		Name:     se.name,
+		Mode:     e.Mode,
+		Uid:      e.UID,
+		Gid:      e.GID,
+		Uname:    e.Uname,
+		Gname:    e.Gname,
+		Linkname: e.LinkName,
+		Devmajor: int64(e.DevMajor),
+		Devminor: int64(e.DevMinor),
+	}
+	if e.ModTime3339 != "" {
+		t, err := time.Parse(time.RFC3339, e.ModTime3339)
+		if err != nil {
+			return nil, err
+		}
+		h.ModTime = t
+	}
+	if len(e.Xattrs) > 0 {
+		h.PAXRecords = make(map[string]string, len(e.Xattrs))
+		for k, v := range e.Xattrs {
+			h.PAXRecords["SCHILY.xattr."+k] = string(v)
+		}
+		h.Format = tar.FormatPAX
+	}
+	payload := io.ReadSeeker(bytes.NewReader(nil))
+	switch e.Type {
+	case "reg":
+		h.Typeflag = tar.TypeReg
+		h.Size = e.Size
+		switch {
+		case se.name == PrefetchLandmark || se.name == NoPrefetchLandmark:
+			payload = bytes.NewReader([]byte{landmarkContents})
+		case !se.synthetic && e.Size > 0:
+			sr, err := se.r.OpenFile(e.Name)
+			if err != nil {
+				return nil, err
+			}
+			payload = sr
+		}
+	case "dir":
+		h.Typeflag = tar.TypeDir
+		if h.Name == "" {
+			h.Name = "./"
+		}
+	case "symlink":
+		h.Typeflag = tar.TypeSymlink
+	case "hardlink":
+		h.Typeflag = tar.TypeLink
+	case "char":
+		h.Typeflag = tar.TypeChar
+	case "block":
+		h.Typeflag = tar.TypeBlock
+	case "fifo":
+		h.Typeflag = tar.TypeFifo
+	default:
+		return nil, fmt.Errorf("unsupported entry type %q", e.Type)
+	}
+	return &entry{header: h, payload: payload}, nil
+}
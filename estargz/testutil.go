@@ -193,7 +193,7 @@ func testBuild(t *TestRunner, controllers ...TestingControllerFactory) {
 							t.Run(tt.name+"-"+fmt.Sprintf("compression=%v,prefix=%q,src=%d,format=%s,minChunkSize=%d", newCL(), prefix, srcCompression, srcTarFormat, minChunkSize), func(t *TestRunner) {
 								tarBlob := buildTar(t, tt.in, prefix, srcTarFormat)
 								// Test divideEntries()
-								entries, err := sortEntries(tarBlob, nil, nil) // identical order
+								entries, err := sortEntries(tarBlob, nil, nil, nil) // identical order
 								if err != nil {
 									t.Fatalf("failed to parse tar: %v", err)
 								}
@@ -1122,7 +1122,7 @@ func parseStargz(sgz *io.SectionReader, controller TestingController) (decodedJT
 	if _, err := sgz.ReadAt(footer, sgz.Size()-fSize); err != nil {
 		return nil, 0, fmt.Errorf("error reading footer: %w", err)
 	}
-	_, tocOffset, _, err := controller.ParseFooter(footer[positive(int64(len(footer))-fSize):])
+	_, tocOffset, tocSize, err := controller.ParseFooter(footer[positive(int64(len(footer))-fSize):])
 	if err != nil {
 		return nil, 0, fmt.Errorf("failed to parse footer: %w", err)
 	}
@@ -1130,7 +1130,10 @@ func parseStargz(sgz *io.SectionReader, controller TestingController) (decodedJT
 	// Decode the TOC JSON
 	var tocReader io.Reader
 	if tocOffset >= 0 {
-		tocReader = io.NewSectionReader(sgz, tocOffset, sgz.Size()-tocOffset-fSize)
+		if tocSize <= 0 {
+			tocSize = sgz.Size() - tocOffset - fSize
+		}
+		tocReader = io.NewSectionReader(sgz, tocOffset, tocSize)
 	}
 	decodedJTOC, _, err = controller.ParseTOC(tocReader)
 	if err != nil {
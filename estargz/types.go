@@ -24,10 +24,13 @@ package estargz
 
 import (
 	"archive/tar"
+	"fmt"
 	"hash"
 	"io"
 	"os"
 	"path"
+	"strconv"
+	"strings"
 	"time"
 
 	digest "github.com/opencontainers/go-digest"
@@ -38,6 +41,17 @@ const (
 	// table of contents gzip stream.
 	TOCTarName = "stargz.index.json"
 
+	// PrefixTOCTarName is the name of the JSON file in the tar archive in the
+	// gzip stream at the beginning of the blob built with WithPrefixTOC option.
+	// This is a copy of the TOC JSON.
+	PrefixTOCTarName = "stargz.prefix.index.json"
+
+	// CompressedTOCTarName is the name of the zstd-compressed JSON file in the tar
+	// archive in the table of contents gzip stream of the blob built with
+	// WithCompressedTOC option. The footer of such blob has the subfield IDs
+	// SI1 = 'S', SI2 = 'Z' instead of 'S', 'G'.
+	CompressedTOCTarName = "stargz.index.json.zst"
+
 	// FooterSize is the number of bytes in the footer
 	//
 	// The footer is an empty gzip stream with no compression and an Extra
@@ -81,6 +95,11 @@ const (
 	// to the special annotation.
 	StoreUncompressedSizeAnnotation = "io.containers.estargz.uncompressed-size"
 
+	// PrefetchCoverageAnnotation is an annotation for an image layer and an image manifest.
+	// This stores the prefetch coverage (see PrefetchCoverage) of the layer, or the sum of
+	// the ones of the layers of the image, formatted as "<prefetch size>/<total size>".
+	PrefetchCoverageAnnotation = "containerd.io/snapshot/stargz/prefetch.coverage"
+
 	// PrefetchLandmark is a file entry which indicates the end position of
 	// prefetch in the stargz file.
 	PrefetchLandmark = ".prefetch.landmark"
@@ -89,13 +108,45 @@ const (
 	// occur in the stargz file.
 	NoPrefetchLandmark = ".no.prefetch.landmark"
 
+	// prefetchTierLandmarkPrefix is the prefix of file entries which indicate the end
+	// positions of prefetch tiers. See PrefetchTierLandmark.
+	prefetchTierLandmarkPrefix = PrefetchLandmark + ".tier"
+
 	landmarkContents = 0xf
+
+	// ChunkTypeZeros is the TOCEntry.ChunkType of the chunks whose contents are all zeros.
+	ChunkTypeZeros = "zeros"
 )
 
+// PrefetchTierLandmark returns the name of the file entry which indicates the end
+// position of the i-th (0-origin) prefetch tier in the stargz file. The last tier
+// doesn't have this landmark and ends at PrefetchLandmark.
+func PrefetchTierLandmark(i int) string {
+	return fmt.Sprintf("%s%d", prefetchTierLandmarkPrefix, i)
+}
+
+// IsLandmark returns true if the name is one of the landmark file entries.
+func IsLandmark(name string) bool {
+	if name == PrefetchLandmark || name == NoPrefetchLandmark {
+		return true
+	}
+	i, ok := strings.CutPrefix(name, prefetchTierLandmarkPrefix)
+	if !ok {
+		return false
+	}
+	_, err := strconv.Atoi(i)
+	return err == nil
+}
+
 // JTOC is the JSON-serialized table of contents index of the files in the stargz file.
 type JTOC struct {
 	Version int         `json:"version"`
 	Entries []*TOCEntry `json:"entries"`
+
+	// Base is the TOC digest of the base blob of a delta blob. Chunks marked
+	// as BaseChunk aren't stored in this blob but in the base blob.
+	// NOTE: This is a TOC property that old reader doesn't understand.
+	Base string `json:"base,omitempty"`
 }
 
 // TOCEntry is an entry in the stargz file's TOC (Table of Contents).
@@ -191,6 +242,43 @@ type TOCEntry struct {
 	// as "sha256:0123abcd...".
 	ChunkDigest string `json:"chunkDigest,omitempty"`
 
+	// ChunkType is the type of the chunk recorded by zstd:chunked blobs of
+	// containers/storage (e.g. produced by Buildah). ChunkTypeZeros indicates
+	// that the contents of the chunk are all zeros so the chunk is read as a hole.
+	// This package doesn't write this property.
+	ChunkType string `json:"chunkType,omitempty"`
+
+	// Hole is true if this "reg" or "chunk" entry is a hole of a sparse file.
+	// The contents of the hole are all zeros and aren't stored in the blob so
+	// Offset and InnerOffset are zero. The file is stored in the tar as a sparse
+	// file of PAX format 1.0.
+	// NOTE: This is a TOC property that old reader doesn't understand.
+	Hole bool `json:"hole,omitempty"`
+
+	// BaseChunk is true if this "reg" or "chunk" entry of a delta blob isn't
+	// stored in the blob but is identical to the chunk that has ChunkDigest in
+	// the base blob recorded in JTOC.Base. Offset and InnerOffset are zero. Like
+	// holes, the file is stored in the tar as a sparse file of PAX format 1.0.
+	// NOTE: This is a TOC property that old reader doesn't understand.
+	BaseChunk bool `json:"baseChunk,omitempty"`
+
+	// Dedup is the name of the preceding regular file that has the same
+	// contents as this "reg" entry. The contents of this file aren't stored in
+	// the blob but are read from the chunks of that file so this entry doesn't
+	// have "chunk" entries and Offset is zero. The file is stored in the tar as
+	// a sparse file of PAX format 1.0 that consists of a hole.
+	// NOTE: This is a TOC property that old reader doesn't understand.
+	Dedup string `json:"dedup,omitempty"`
+
+	// Uncompressed is true if the payload of this "reg" or "chunk" entry is
+	// stored in the compression framing without being compressed (e.g. stored
+	// blocks of deflate or raw blocks of zstd), which is written by
+	// Writer.AdaptiveCompression for incompressible payloads. Readers that
+	// support it (see RawDecompressor) read the payload by skipping the framing
+	// instead of decompressing it.
+	// NOTE: This is a TOC property that old reader doesn't understand.
+	Uncompressed bool `json:"uncompressed,omitempty"`
+
 	children map[string]*TOCEntry
 
 	// chunkTopIndex is index of the entry where Offset starts in the blob.
@@ -266,6 +354,39 @@ func (fi fileInfo) Mode() (m os.FileMode) {
 	return m
 }
 
+// RangeError is returned when a size or an offset recorded in the blob is negative
+// or exceeds the range of the blob or the file. Sizes and offsets are int64 so blobs
+// and files larger than 4GiB are supported as long as they are in the range.
+type RangeError struct {
+	// Name is the name of the entry. This is empty if the value is recorded
+	// in the footer.
+	Name string
+
+	// Field is the name of the property.
+	Field string
+
+	// Value is the recorded value.
+	Value int64
+
+	// Limit is the upper limit of the value.
+	Limit int64
+}
+
+func (e *RangeError) Error() string {
+	if e.Name == "" {
+		return fmt.Sprintf("%s %d is out of range [0, %d]", e.Field, e.Value, e.Limit)
+	}
+	return fmt.Sprintf("%s %d of %q is out of range [0, %d]", e.Field, e.Value, e.Name, e.Limit)
+}
+
+// checkRange returns a RangeError if v isn't in [0, limit].
+func checkRange(name, field string, v, limit int64) error {
+	if v < 0 || v > limit {
+		return &RangeError{Name: name, Field: field, Value: v, Limit: limit}
+	}
+	return nil
+}
+
 // TOCEntryVerifier holds verifiers that are usable for verifying chunks contained
 // in a eStargz blob.
 type TOCEntryVerifier interface {
@@ -303,6 +424,17 @@ type Compressor interface {
 	WriteTOCAndFooter(w io.Writer, off int64, toc *JTOC, diffHash hash.Hash) (tocDgst digest.Digest, err error)
 }
 
+// AdaptiveCompressor is a Compressor that can change the compression of each file
+// depending on the compressibility of the payload. See Writer.AdaptiveCompression.
+type AdaptiveCompressor interface {
+	Compressor
+
+	// WriterFor is like Writer but the returned writer compresses the payload
+	// of the compressibility c. Incompressible payloads are recorded in TOC as
+	// TOCEntry.Uncompressed so the writer should store them without compression.
+	WriterFor(w io.Writer, c Compressibility) (WriteFlushCloser, error)
+}
+
 // Decompressor represents the helper mothods to be used for parsing eStargz.
 type Decompressor interface {
 	// Reader returns ReadCloser to be used for decompressing file payload.
@@ -336,6 +468,18 @@ type Decompressor interface {
 	ParseTOC(r io.Reader) (toc *JTOC, tocDgst digest.Digest, err error)
 }
 
+// RawDecompressor is a Decompressor that can read the payload stored without compression
+// (see TOCEntry.Uncompressed) by skipping the framing of the compression.
+type RawDecompressor interface {
+	Decompressor
+
+	// RawReader returns ReadCloser reading the payload stored without compression in
+	// the stream. Reads fail with ErrCompressed when they encounter compressed data
+	// then the caller falls back to Reader. Checksums of the stream aren't verified
+	// so the payload must be verified by the digest of the chunk.
+	RawReader(r io.Reader) (io.ReadCloser, error)
+}
+
 type WriteFlushCloser interface {
 	io.WriteCloser
 	Flush() error
@@ -0,0 +1,181 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package estargz
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrCompressed is returned by the reader of RawDecompressor when the stream contains
+// compressed data.
+var ErrCompressed = errors.New("payload is compressed")
+
+const (
+	gzipFlagHCRC    = 1 << 1
+	gzipFlagExtra   = 1 << 2
+	gzipFlagName    = 1 << 3
+	gzipFlagComment = 1 << 4
+)
+
+// rawGzipReader reads the payload of a gzip stream that consists of stored blocks of
+// deflate. Stored blocks following stored blocks are byte-aligned so the header of each
+// block is a byte of BFINAL and BTYPE=00 followed by LEN and NLEN.
+type rawGzipReader struct {
+	r      *bufio.Reader
+	header bool  // true if the gzip header has been read
+	remain int64 // the bytes remaining in the current block
+	final  bool  // true if the current block is the last one
+}
+
+// NewRawGzipReader returns a reader of the payload of the gzip stream that is stored
+// without compression (e.g. written with gzip.NoCompression). Reads fail with ErrCompressed
+// if the stream contains compressed blocks. The checksum of the stream isn't verified.
+func NewRawGzipReader(r io.Reader) io.ReadCloser {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	return &rawGzipReader{r: br}
+}
+
+func (z *rawGzipReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	for z.remain == 0 {
+		if z.final {
+			return 0, io.EOF
+		}
+		if !z.header {
+			if err := z.readHeader(); err != nil {
+				return 0, err
+			}
+			z.header = true
+		}
+		b, err := z.r.ReadByte()
+		if err != nil {
+			return 0, noEOF(err)
+		}
+		if b&^1 != 0 {
+			return 0, ErrCompressed // not a stored block
+		}
+		var lens [4]byte
+		if _, err := io.ReadFull(z.r, lens[:]); err != nil {
+			return 0, noEOF(err)
+		}
+		l, nl := binary.LittleEndian.Uint16(lens[0:2]), binary.LittleEndian.Uint16(lens[2:4])
+		if l != ^nl {
+			return 0, fmt.Errorf("invalid length of stored block: %d (complement %d)", l, nl)
+		}
+		z.remain, z.final = int64(l), b&1 == 1
+	}
+	if int64(len(p)) > z.remain {
+		p = p[:z.remain]
+	}
+	n, err := z.r.Read(p)
+	z.remain -= int64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (z *rawGzipReader) readHeader() error {
+	var h [10]byte
+	if _, err := io.ReadFull(z.r, h[:]); err != nil {
+		return noEOF(err)
+	}
+	if h[0] != 0x1f || h[1] != 0x8b || h[2] != 8 {
+		return fmt.Errorf("invalid gzip header")
+	}
+	flg := h[3]
+	if flg&gzipFlagExtra != 0 {
+		var xlen [2]byte
+		if _, err := io.ReadFull(z.r, xlen[:]); err != nil {
+			return noEOF(err)
+		}
+		if _, err := z.r.Discard(int(binary.LittleEndian.Uint16(xlen[:]))); err != nil {
+			return noEOF(err)
+		}
+	}
+	for _, f := range []byte{gzipFlagName, gzipFlagComment} {
+		if flg&f != 0 {
+			if _, err := z.r.ReadBytes(0); err != nil {
+				return noEOF(err)
+			}
+		}
+	}
+	if flg&gzipFlagHCRC != 0 {
+		if _, err := z.r.Discard(2); err != nil {
+			return noEOF(err)
+		}
+	}
+	return nil
+}
+
+func (z *rawGzipReader) Close() error {
+	return nil
+}
+
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func (gz *GzipDecompressor) RawReader(r io.Reader) (io.ReadCloser, error) {
+	return NewRawGzipReader(r), nil
+}
+
+func (gz *LegacyGzipDecompressor) RawReader(r io.Reader) (io.ReadCloser, error) {
+	return NewRawGzipReader(r), nil
+}
+
+// payloadReader returns the reader of the payload of the stream of ent. If raw is true and
+// the payload is stored without compression, the reader skips the framing instead of
+// decompressing it and is *rawPayloadReader.
+func (r *Reader) payloadReader(ent *TOCEntry, sr io.Reader, raw bool) (io.ReadCloser, error) {
+	if rd, ok := r.decompressor.(RawDecompressor); ok && raw && ent.Uncompressed {
+		rr, err := rd.RawReader(sr)
+		if err != nil {
+			return nil, err
+		}
+		return &rawPayloadReader{ReadCloser: rr}, nil
+	}
+	return r.decompressor.Reader(sr)
+}
+
+// rawPayloadReader records whether the reader of RawDecompressor encountered compressed
+// data. Callers of the reader (e.g. the pre-reader of OpenFileWithPreReader) don't
+// necessarily return the error as is.
+type rawPayloadReader struct {
+	io.ReadCloser
+	compressed bool
+}
+
+func (r *rawPayloadReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if errors.Is(err, ErrCompressed) {
+		r.compressed = true
+	}
+	return n, err
+}
@@ -0,0 +1,122 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package estargz
+
+import (
+	"fmt"
+	"hash"
+	"slices"
+	"sync"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+// ChunkVerifier makes the verifiers of the contents of chunks for the digests of an
+// algorithm recorded in TOCs. This allows verifying chunks with implementations other than
+// the ones of go-digest (e.g. hardware-accelerated hashing) or with algorithms go-digest
+// doesn't support (e.g. "blake3"). See RegisterChunkVerifier.
+type ChunkVerifier interface {
+	// Verifier returns the verifier of the contents whose digest is d. ok is false if the
+	// verifier can't be used (e.g. the CPU lacks the instructions it needs), in which case
+	// the next verifier of the algorithm is used.
+	Verifier(d digest.Digest) (v digest.Verifier, ok bool)
+}
+
+// ChunkHasher is an optional interface of ChunkVerifier. Writers use it to record the
+// digests of the algorithm in TOCs, which allows building layers with algorithms go-digest
+// doesn't support.
+type ChunkHasher interface {
+	// Hash returns a new hash of the algorithm. ok is false if the hash can't be used, in
+	// which case the next verifier of the algorithm is used.
+	Hash() (h hash.Hash, ok bool)
+}
+
+var (
+	chunkVerifiers   = make(map[digest.Algorithm][]ChunkVerifier)
+	chunkVerifiersMu sync.RWMutex
+)
+
+// RegisterChunkVerifier registers the verifier of the digests of alg. Verifiers registered
+// later are tried first. If none of the verifiers of the algorithm can be used, the
+// implementation of go-digest is used (e.g. crypto/sha256 for "sha256"). This is usually
+// called in init functions.
+func RegisterChunkVerifier(alg digest.Algorithm, v ChunkVerifier) {
+	chunkVerifiersMu.Lock()
+	defer chunkVerifiersMu.Unlock()
+	chunkVerifiers[alg] = append(chunkVerifiers[alg], v)
+}
+
+func registeredChunkVerifiers(alg digest.Algorithm) []ChunkVerifier {
+	chunkVerifiersMu.RLock()
+	defer chunkVerifiersMu.RUnlock()
+	return chunkVerifiers[alg]
+}
+
+// ParseChunkDigest parses the digest of a chunk or a file recorded in a TOC. Digests of the
+// algorithms whose verifiers are registered are accepted as well as the ones go-digest
+// supports.
+func ParseChunkDigest(s string) (digest.Digest, error) {
+	d := digest.Digest(s)
+	if len(registeredChunkVerifiers(d.Algorithm())) == 0 {
+		return digest.Parse(s)
+	}
+	if !digest.DigestRegexpAnchored.MatchString(s) {
+		return "", digest.ErrDigestInvalidFormat
+	}
+	return d, nil
+}
+
+// ChunkDigestVerifier returns the verifier of the contents whose digest is d using the
+// registered verifiers of the algorithm, falling back to go-digest.
+func ChunkDigestVerifier(d digest.Digest) (digest.Verifier, error) {
+	vs := registeredChunkVerifiers(d.Algorithm())
+	for _, cv := range slices.Backward(vs) {
+		if v, ok := cv.Verifier(d); ok {
+			return v, nil
+		}
+	}
+	if !d.Algorithm().Available() {
+		return nil, fmt.Errorf("no verifier is available for %q: %w", d.Algorithm(), digest.ErrDigestUnsupported)
+	}
+	return d.Verifier(), nil
+}
+
+// ChunkDigester returns the digester of alg using the registered verifiers of the algorithm
+// implementing ChunkHasher, falling back to go-digest.
+func ChunkDigester(alg digest.Algorithm) (digest.Digester, error) {
+	vs := registeredChunkVerifiers(alg)
+	for _, cv := range slices.Backward(vs) {
+		if ch, ok := cv.(ChunkHasher); ok {
+			if h, ok := ch.Hash(); ok {
+				return &chunkDigester{alg: alg, h: h}, nil
+			}
+		}
+	}
+	if !alg.Available() {
+		return nil, fmt.Errorf("no digester is available for %q: %w", alg, digest.ErrDigestUnsupported)
+	}
+	return alg.Digester(), nil
+}
+
+type chunkDigester struct {
+	alg digest.Algorithm
+	h   hash.Hash
+}
+
+func (d *chunkDigester) Hash() hash.Hash { return d.h }
+
+func (d *chunkDigester) Digest() digest.Digest { return digest.NewDigest(d.alg, d.h) }
@@ -0,0 +1,144 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package zstdchunked
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+
+	"github.com/containerd/stargz-snapshotter/estargz"
+)
+
+const (
+	zstdBlockRaw      = 0
+	zstdBlockRLE      = 1
+	zstdSingleSegment = 1 << 5
+)
+
+// rawReader reads the payload of a zstd frame that consists of raw and RLE blocks, which
+// the fastest level writes for incompressible payloads.
+type rawReader struct {
+	r       *bufio.Reader
+	header  bool  // true if the frame header has been read
+	remain  int64 // the bytes remaining in the current block
+	rle     bool  // true if the current block repeats rleByte
+	rleByte byte
+	final   bool // true if the current block is the last one
+}
+
+// RawReader returns the reader of the payload of the zstd frame that is stored without
+// compression (see estargz.TOCEntry.Uncompressed). Reads fail with estargz.ErrCompressed if
+// the frame contains compressed blocks. The checksum of the frame isn't verified.
+func (zz *Decompressor) RawReader(r io.Reader) (io.ReadCloser, error) {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	return &rawReader{r: br}, nil
+}
+
+func (z *rawReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	for z.remain == 0 {
+		if z.final {
+			return 0, io.EOF
+		}
+		if !z.header {
+			if err := z.readHeader(); err != nil {
+				return 0, err
+			}
+			z.header = true
+		}
+		var h [3]byte
+		if _, err := io.ReadFull(z.r, h[:]); err != nil {
+			return 0, noEOF(err)
+		}
+		bh := uint32(h[0]) | uint32(h[1])<<8 | uint32(h[2])<<16
+		z.final, z.remain = bh&1 == 1, int64(bh>>3)
+		switch (bh >> 1) & 3 {
+		case zstdBlockRaw:
+			z.rle = false
+		case zstdBlockRLE:
+			b, err := z.r.ReadByte()
+			if err != nil {
+				return 0, noEOF(err)
+			}
+			z.rle, z.rleByte = true, b
+		default:
+			return 0, estargz.ErrCompressed
+		}
+	}
+	if int64(len(p)) > z.remain {
+		p = p[:z.remain]
+	}
+	if z.rle {
+		for i := range p {
+			p[i] = z.rleByte
+		}
+		z.remain -= int64(len(p))
+		return len(p), nil
+	}
+	n, err := z.r.Read(p)
+	z.remain -= int64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (z *rawReader) readHeader() error {
+	var magic [4]byte
+	if _, err := io.ReadFull(z.r, magic[:]); err != nil {
+		return noEOF(err)
+	}
+	if !bytes.Equal(magic[:], zstdFrameMagic) {
+		return estargz.ErrCompressed // e.g. skippable frames
+	}
+	fhd, err := z.r.ReadByte()
+	if err != nil {
+		return noEOF(err)
+	}
+	var size int
+	if fhd&zstdSingleSegment == 0 {
+		size++ // window descriptor
+	}
+	size += []int{0, 1, 2, 4}[fhd&3] // dictionary ID
+	switch fcs := fhd >> 6; {
+	case fcs == 0 && fhd&zstdSingleSegment != 0:
+		size++
+	case fcs > 0:
+		size += 1 << fcs
+	}
+	if _, err := z.r.Discard(size); err != nil {
+		return noEOF(err)
+	}
+	return nil
+}
+
+func (z *rawReader) Close() error {
+	return nil
+}
+
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
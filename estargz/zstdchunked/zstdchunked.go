@@ -24,6 +24,7 @@ import (
 	"fmt"
 	"hash"
 	"io"
+	"math"
 	"sync"
 
 	"github.com/containerd/stargz-snapshotter/estargz"
@@ -41,6 +42,11 @@ const (
 	// FooterSize is the size of the footer
 	FooterSize = 40
 
+	// TarSplitFooterSize is the size of the footer of the blobs that contain tar-split
+	// metadata in addition to the TOC (e.g. produced by containers/storage and Buildah).
+	// The footer additionally records the position of tar-split.
+	TarSplitFooterSize = 64
+
 	manifestTypeCRFS = 1
 )
 
@@ -52,12 +58,22 @@ var (
 
 type Decompressor struct{}
 
+// Reader returns the reader decompressing r. The decoders closed before are reused so reads
+// of many chunks don't allocate the decoder for each. The reader must not be used after
+// Close.
 func (zz *Decompressor) Reader(r io.Reader) (io.ReadCloser, error) {
-	decoder, err := zstd.NewReader(r)
-	if err != nil {
+	decoder, ok := decoderPool.Get().(*zstd.Decoder)
+	if !ok {
+		var err error
+		if decoder, err = zstd.NewReader(nil); err != nil {
+			return nil, err
+		}
+	}
+	if err := decoder.Reset(r); err != nil {
+		decoder.Close()
 		return nil, err
 	}
-	return &zstdReadCloser{decoder}, nil
+	return &zstdReadCloser{Decoder: decoder}, nil
 }
 
 func (zz *Decompressor) ParseTOC(r io.Reader) (toc *estargz.JTOC, tocDgst digest.Digest, err error) {
@@ -74,18 +90,49 @@ func (zz *Decompressor) ParseTOC(r io.Reader) (toc *estargz.JTOC, tocDgst digest
 	return toc, dgstr.Digest(), nil
 }
 
+// ParseFooter parses the footer. p can be longer than the footer so the footer of both of
+// FooterSize and TarSplitFooterSize are parsed from the last TarSplitFooterSize bytes of the
+// blob.
 func (zz *Decompressor) ParseFooter(p []byte) (blobPayloadSize, tocOffset, tocSize int64, err error) {
+	if len(p) < FooterSize {
+		return 0, 0, 0, fmt.Errorf("footer is too small; %d < %d", len(p), FooterSize)
+	}
+	p = footerOf(p)
 	offset := binary.LittleEndian.Uint64(p[0:8])
 	compressedLength := binary.LittleEndian.Uint64(p[8:16])
-	if !bytes.Equal(zstdChunkedFrameMagic, p[32:40]) {
+	if !bytes.Equal(zstdChunkedFrameMagic, p[len(p)-8:]) {
 		return 0, 0, 0, fmt.Errorf("invalid magic number")
 	}
+	if manifestType := binary.LittleEndian.Uint64(p[24:32]); manifestType != manifestTypeCRFS {
+		return 0, 0, 0, fmt.Errorf("unsupported manifest type %d", manifestType)
+	}
+	if offset > math.MaxInt64 {
+		return 0, 0, 0, &estargz.RangeError{Field: "tocOffset", Value: int64(offset), Limit: math.MaxInt64}
+	}
+	if compressedLength > math.MaxInt64 {
+		return 0, 0, 0, &estargz.RangeError{Field: "tocSize", Value: int64(compressedLength), Limit: math.MaxInt64}
+	}
 	// 8 is the size of the zstd skippable frame header + the frame size (see WriteTOCAndFooter)
 	return int64(offset - 8), int64(offset), int64(compressedLength), nil
 }
 
+// FooterSize returns the size of the larger footer supported by this decompressor.
+// See ParseFooter.
 func (zz *Decompressor) FooterSize() int64 {
-	return FooterSize
+	return TarSplitFooterSize
+}
+
+// footerOf returns the footer at the end of p. The footer of FooterSize is preceded by
+// the header of the skippable frame that has the size of the footer.
+func footerOf(p []byte) []byte {
+	if len(p) < TarSplitFooterSize {
+		return p[len(p)-FooterSize:]
+	}
+	hdr := p[len(p)-FooterSize-8 : len(p)-FooterSize]
+	if bytes.Equal(hdr[:4], skippableFrameMagic) && binary.LittleEndian.Uint32(hdr[4:]) == FooterSize {
+		return p[len(p)-FooterSize:]
+	}
+	return p[len(p)-TarSplitFooterSize:]
 }
 
 func (zz *Decompressor) DecompressTOC(r io.Reader) (tocJSON io.ReadCloser, err error) {
@@ -107,10 +154,26 @@ type reader struct {
 
 func (r *reader) Close() error { r.closeFunc(); return nil }
 
-type zstdReadCloser struct{ *zstd.Decoder }
+// decoderPool is the pool of the decoders reused among the reads of chunks.
+var decoderPool sync.Pool
 
+type zstdReadCloser struct {
+	*zstd.Decoder
+	closed bool
+}
+
+// Close returns the decoder to the pool after releasing the reference to the stream.
 func (z *zstdReadCloser) Close() error {
-	z.Decoder.Close()
+	if z.closed {
+		return nil
+	}
+	z.closed = true
+	if err := z.Decoder.Reset(nil); err != nil {
+		z.Decoder.Close()
+	} else {
+		decoderPool.Put(z.Decoder)
+	}
+	z.Decoder = nil
 	return nil
 }
 
@@ -118,32 +181,67 @@ type Compressor struct {
 	CompressionLevel zstd.EncoderLevel
 	Metadata         map[string]string
 
-	pool sync.Pool
+	// Concurrency is the number of goroutines used by each encoder.
+	// If zero, the default of the zstd library (GOMAXPROCS) is used.
+	Concurrency int
+
+	// WindowSize is the maximum window size of the encoder in bytes. This must be
+	// a power of two between zstd.MinWindowSize and zstd.MaxWindowSize.
+	// If zero, the default of the zstd library for the compression level is used.
+	WindowSize int
+
+	pool     sync.Pool
+	fastPool sync.Pool // encoders for poorly compressible payloads
+}
+
+func (zc *Compressor) encoderOptions() []zstd.EOption {
+	opts := []zstd.EOption{zstd.WithEncoderLevel(zc.CompressionLevel)}
+	if zc.Concurrency > 0 {
+		opts = append(opts, zstd.WithEncoderConcurrency(zc.Concurrency))
+	}
+	if zc.WindowSize > 0 {
+		opts = append(opts, zstd.WithWindowSize(zc.WindowSize))
+	}
+	return opts
 }
 
 func (zc *Compressor) Writer(w io.Writer) (estargz.WriteFlushCloser, error) {
-	if wc := zc.pool.Get(); wc != nil {
+	return newPoolEncoder(w, &zc.pool, zc.encoderOptions())
+}
+
+// WriterFor is like Writer but poorly compressible and incompressible payloads are
+// compressed with the fastest level. zstd doesn't have the level that stores the payload
+// without compression but the fastest level stores incompressible blocks as they are.
+func (zc *Compressor) WriterFor(w io.Writer, c estargz.Compressibility) (estargz.WriteFlushCloser, error) {
+	if c == estargz.Compressible || zc.CompressionLevel == zstd.SpeedFastest {
+		return zc.Writer(w)
+	}
+	return newPoolEncoder(w, &zc.fastPool, append(zc.encoderOptions(), zstd.WithEncoderLevel(zstd.SpeedFastest)))
+}
+
+func newPoolEncoder(w io.Writer, pool *sync.Pool, opts []zstd.EOption) (*poolEncoder, error) {
+	if wc := pool.Get(); wc != nil {
 		ec := wc.(*zstd.Encoder)
 		ec.Reset(w)
-		return &poolEncoder{ec, zc}, nil
+		return &poolEncoder{ec, pool}, nil
 	}
-	ec, err := zstd.NewWriter(w, zstd.WithEncoderLevel(zc.CompressionLevel), zstd.WithLowerEncoderMem(true))
+	ec, err := zstd.NewWriter(w, append(opts, zstd.WithLowerEncoderMem(true))...)
 	if err != nil {
 		return nil, err
 	}
-	return &poolEncoder{ec, zc}, nil
+	return &poolEncoder{ec, pool}, nil
 }
 
 type poolEncoder struct {
 	*zstd.Encoder
-	zc *Compressor
+	pool *sync.Pool
 }
 
 func (w *poolEncoder) Close() error {
 	if err := w.Encoder.Close(); err != nil {
 		return err
 	}
-	w.zc.pool.Put(w.Encoder)
+	w.pool.Put(w.Encoder)
 	return nil
 }
 
@@ -153,7 +251,7 @@ func (zc *Compressor) WriteTOCAndFooter(w io.Writer, off int64, toc *estargz.JTO
 		return "", err
 	}
 	buf := new(bytes.Buffer)
-	encoder, err := zstd.NewWriter(buf, zstd.WithEncoderLevel(zc.CompressionLevel))
+	encoder, err := zstd.NewWriter(buf, zc.encoderOptions()...)
 	if err != nil {
 		return "", err
 	}
@@ -164,7 +262,13 @@ func (zc *Compressor) WriteTOCAndFooter(w io.Writer, off int64, toc *estargz.JTO
 		return "", err
 	}
 	compressedTOC := buf.Bytes()
-	_, err = io.Copy(w, bytes.NewReader(appendSkippableFrameMagic(compressedTOC)))
+	if int64(len(compressedTOC)) > math.MaxUint32 {
+		// The size of a skippable frame is recorded as uint32.
+		return "", &estargz.RangeError{Field: "tocSize", Value: int64(len(compressedTOC)), Limit: math.MaxUint32}
+	}
+	if _, err := io.Copy(w, bytes.NewReader(appendSkippableFrameMagic(compressedTOC))); err != nil {
+		return "", err
+	}
 
 	// 8 is the size of the zstd skippable frame header + the frame size
 	tocOff := uint64(off) + 8
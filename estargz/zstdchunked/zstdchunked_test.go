@@ -19,13 +19,18 @@ package zstdchunked
 import (
 	"bytes"
 	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
 	"fmt"
 	"io"
+	"math/rand"
 	"slices"
 	"testing"
+	"time"
 
 	"github.com/containerd/stargz-snapshotter/estargz"
 	"github.com/klauspost/compress/zstd"
+	digest "github.com/opencontainers/go-digest"
 )
 
 // TestZstdChunked tests zstd:chunked
@@ -50,9 +55,27 @@ func TestZstdChunked(t *testing.T) {
 		zstdControllerWithLevel(zstd.SpeedDefault),
 		zstdControllerWithLevel(zstd.SpeedBetterCompression),
 		// zstdControllerWithLevel(zstd.SpeedBestCompression), // consumes too much memory to pass on CI
+		zstdControllerWithEncoderConfig(zstd.SpeedDefault, 4, 1<<20),
 	)
 }
 
+func zstdControllerWithEncoderConfig(compressionLevel zstd.EncoderLevel, concurrency, windowSize int) estargz.TestingControllerFactory {
+	return func() estargz.TestingController {
+		return &zstdController{&Compressor{
+			CompressionLevel: compressionLevel,
+			Concurrency:      concurrency,
+			WindowSize:       windowSize,
+		}, &Decompressor{}}
+	}
+}
+
+func TestInvalidWindowSize(t *testing.T) {
+	zc := &Compressor{CompressionLevel: zstd.SpeedDefault, WindowSize: 1000}
+	if _, err := zc.Writer(io.Discard); err == nil {
+		t.Fatalf("window size that isn't a power of two must be rejected")
+	}
+}
+
 func zstdControllerWithLevel(compressionLevel zstd.EncoderLevel) estargz.TestingControllerFactory {
 	return func() estargz.TestingController {
 		return &zstdController{&Compressor{CompressionLevel: compressionLevel}, &Decompressor{}}
@@ -65,6 +88,9 @@ type zstdController struct {
 }
 
 func (zc *zstdController) String() string {
+	if zc.Concurrency > 0 || zc.WindowSize > 0 {
+		return fmt.Sprintf("zstd_compression_level=%v,concurrency=%d,window_size=%d", zc.CompressionLevel, zc.Concurrency, zc.WindowSize)
+	}
 	return fmt.Sprintf("zstd_compression_level=%v", zc.CompressionLevel)
 }
 
@@ -77,10 +103,11 @@ func (zc *zstdController) TestStreams(t estargz.TestingT, b []byte, streams []in
 		return // nop
 	}
 
-	// We expect the last offset is footer offset.
+	// We expect the last offset is footer offset. The blob has the footer of FooterSize
+	// but the passed offset is based on FooterSize() that is the larger TarSplitFooterSize.
 	// 8 is the size of the zstd skippable frame header + the frame size (see WriteTOCAndFooter)
 	slices.Sort(streams)
-	streams[len(streams)-1] = streams[len(streams)-1] - 8
+	streams[len(streams)-1] = int64(len(b)) - FooterSize - 8
 	wants := map[int64]struct{}{}
 	for _, s := range streams {
 		wants[s] = struct{}{}
@@ -178,3 +205,212 @@ func checkZstdChunkedFooter(t *testing.T, off, size, cSize int64) {
 		t.Fatalf("ParseFooter(footerBytes(offset %d)) = size %d; want %d", off, gotSize, cSize)
 	}
 }
+
+// storageEntry is an entry of the TOC of zstd:chunked blobs produced by containers/storage.
+type storageEntry struct {
+	Type        string     `json:"type"`
+	Name        string     `json:"name"`
+	Mode        int64      `json:"mode,omitempty"`
+	Size        int64      `json:"size,omitempty"`
+	ModTime     *time.Time `json:"modtime,omitempty"`
+	AccessTime  *time.Time `json:"accesstime,omitempty"`
+	Digest      string     `json:"digest,omitempty"`
+	Offset      int64      `json:"offset,omitempty"`
+	EndOffset   int64      `json:"endOffset,omitempty"`
+	ChunkSize   int64      `json:"chunkSize,omitempty"`
+	ChunkOffset int64      `json:"chunkOffset,omitempty"`
+	ChunkDigest string     `json:"chunkDigest,omitempty"`
+	ChunkType   string     `json:"chunkType,omitempty"`
+}
+
+// TestStorageZstdChunked tests that blobs in the format of zstd:chunked of
+// containers/storage (with tar-split and zero chunks) can be read.
+func TestStorageZstdChunked(t *testing.T) {
+	modTime := time.Date(2024, 1, 2, 3, 4, 5, 123456789, time.UTC)
+	var blob bytes.Buffer
+	writeFrame := func(p []byte) (off, endOff int64) {
+		off = int64(blob.Len())
+		zw, err := zstd.NewWriter(&blob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := zw.Write(p); err != nil {
+			t.Fatal(err)
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return off, int64(blob.Len())
+	}
+	writeSkippableFrame := func(p []byte) (off int64) {
+		blob.Write(appendSkippableFrameMagic(p))
+		return int64(blob.Len() - len(p))
+	}
+	compress := func(p []byte) []byte {
+		var buf bytes.Buffer
+		zw, err := zstd.NewWriter(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := zw.Write(p); err != nil {
+			t.Fatal(err)
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	dgst := func(s string) string { return digest.FromString(s).String() }
+
+	aOff, aEnd := writeFrame([]byte("hello world"))
+	b0Off, _ := writeFrame([]byte("aaaa"))
+	zerosOff, _ := writeFrame([]byte("ZZZZ")) // must not be read
+	b2Off, b2End := writeFrame([]byte("cccc"))
+	manifest, err := json.Marshal(struct {
+		Version int            `json:"version"`
+		Entries []storageEntry `json:"entries"`
+	}{
+		Version: 1,
+		Entries: []storageEntry{
+			{Type: "dir", Name: "dir/", Mode: 0755, ModTime: &modTime, AccessTime: &modTime},
+			{Type: "reg", Name: "dir/a", Mode: 0644, Size: 11, ModTime: &modTime, Digest: dgst("hello world"),
+				Offset: aOff, EndOffset: aEnd, ChunkSize: 11, ChunkDigest: dgst("hello world")},
+			{Type: "reg", Name: "dir/b", Mode: 0644, Size: 12, ModTime: &modTime, Digest: dgst("aaaa\x00\x00\x00\x00cccc"),
+				Offset: b0Off, EndOffset: b2End, ChunkSize: 4, ChunkDigest: dgst("aaaa")},
+			{Type: "chunk", Name: "dir/b", Offset: zerosOff, ChunkOffset: 4, ChunkSize: 4,
+				ChunkDigest: dgst("\x00\x00\x00\x00"), ChunkType: estargz.ChunkTypeZeros},
+			{Type: "chunk", Name: "dir/b", Offset: b2Off, ChunkOffset: 8, ChunkSize: 4, ChunkDigest: dgst("cccc")},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressedManifest := compress(manifest)
+	manifestOff := writeSkippableFrame(compressedManifest)
+	compressedTarSplit := compress([]byte("dummy tar-split"))
+	tarSplitOff := writeSkippableFrame(compressedTarSplit)
+	footer := make([]byte, TarSplitFooterSize)
+	binary.LittleEndian.PutUint64(footer[0:], uint64(manifestOff))
+	binary.LittleEndian.PutUint64(footer[8:], uint64(len(compressedManifest)))
+	binary.LittleEndian.PutUint64(footer[16:], uint64(len(manifest)))
+	binary.LittleEndian.PutUint64(footer[24:], manifestTypeCRFS)
+	binary.LittleEndian.PutUint64(footer[32:], uint64(tarSplitOff))
+	binary.LittleEndian.PutUint64(footer[40:], uint64(len(compressedTarSplit)))
+	binary.LittleEndian.PutUint64(footer[48:], uint64(len("dummy tar-split")))
+	copy(footer[56:], zstdChunkedFrameMagic)
+	writeSkippableFrame(footer)
+
+	b := blob.Bytes()
+	r, err := estargz.Open(io.NewSectionReader(bytes.NewReader(b), 0, int64(len(b))),
+		estargz.WithDecompressors(new(Decompressor)))
+	if err != nil {
+		t.Fatalf("failed to open blob: %v", err)
+	}
+	if _, err := r.VerifyTOC(digest.FromBytes(manifest)); err != nil {
+		t.Fatalf("failed to verify TOC: %v", err)
+	}
+	for name, want := range map[string]string{
+		"dir/a": "hello world",
+		"dir/b": "aaaa\x00\x00\x00\x00cccc",
+	} {
+		e, ok := r.Lookup(name)
+		if !ok {
+			t.Fatalf("%q not found", name)
+		}
+		if !e.ModTime().Equal(modTime) {
+			t.Errorf("%q: modtime = %v; want %v", name, e.ModTime(), modTime)
+		}
+		sr, err := r.OpenFile(name)
+		if err != nil {
+			t.Fatalf("failed to open %q: %v", name, err)
+		}
+		got, err := io.ReadAll(sr)
+		if err != nil {
+			t.Fatalf("failed to read %q: %v", name, err)
+		}
+		if string(got) != want {
+			t.Errorf("%q: contents = %q; want %q", name, got, want)
+		}
+	}
+}
+
+func TestDecompressorReaderReuse(t *testing.T) {
+	var d Decompressor
+	for i, data := range []string{"first stream", "second stream", "partially read stream"} {
+		enc, err := zstd.NewWriter(nil)
+		if err != nil {
+			t.Fatalf("failed to make encoder: %v", err)
+		}
+		compressed := enc.EncodeAll([]byte(data), nil)
+		enc.Close()
+		zr, err := d.Reader(bytes.NewReader(compressed))
+		if err != nil {
+			t.Fatalf("failed to open stream %d: %v", i, err)
+		}
+		if i == 2 {
+			// The decoder of the stream closed before reaching the end is reusable.
+			p := make([]byte, 4)
+			if _, err := io.ReadFull(zr, p); err != nil || string(p) != data[:4] {
+				t.Errorf("stream %d = %q, %v; want %q", i, p, err, data[:4])
+			}
+		} else if got, err := io.ReadAll(zr); err != nil || string(got) != data {
+			t.Errorf("stream %d = %q, %v; want %q", i, got, err, data)
+		}
+		if err := zr.Close(); err != nil {
+			t.Errorf("failed to close stream %d: %v", i, err)
+		}
+		if err := zr.Close(); err != nil {
+			t.Errorf("closing stream %d twice must succeed: %v", i, err)
+		}
+	}
+	zr, err := d.Reader(bytes.NewReader([]byte("invalid")))
+	if err == nil {
+		if _, err = io.ReadAll(zr); err == nil {
+			t.Errorf("invalid stream must fail")
+		}
+		zr.Close()
+	}
+}
+
+func TestRawReader(t *testing.T) {
+	random := make([]byte, 300000) // more than a block
+	if _, err := rand.New(rand.NewSource(1)).Read(random); err != nil {
+		t.Fatalf("failed to read random bytes: %v", err)
+	}
+	encode := func(data []byte, level zstd.EncoderLevel) []byte {
+		enc, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(level))
+		if err != nil {
+			t.Fatalf("failed to make encoder: %v", err)
+		}
+		defer enc.Close()
+		return enc.EncodeAll(data, nil)
+	}
+	// A frame of a single segment with a RLE block of 5 bytes.
+	rle := append(slices.Clone(zstdFrameMagic), 0x20, 5, 5<<3|zstdBlockRLE<<1|1, 0, 0, 'a')
+	for _, tt := range []struct {
+		name  string
+		frame []byte
+		want  []byte
+		err   error
+	}{
+		{"raw", encode(random, zstd.SpeedFastest), random, nil},
+		{"rle", rle, []byte("aaaaa"), nil},
+		{"compressed", encode(bytes.Repeat([]byte("text"), 1000), zstd.SpeedFastest), nil, estargz.ErrCompressed},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var d Decompressor
+			zr, err := d.RawReader(bytes.NewReader(tt.frame))
+			if err != nil {
+				t.Fatalf("failed to open: %v", err)
+			}
+			defer zr.Close()
+			got, err := io.ReadAll(zr)
+			if err != tt.err {
+				t.Fatalf("err = %v; want %v", err, tt.err)
+			}
+			if tt.err == nil && !bytes.Equal(got, tt.want) {
+				t.Errorf("unexpected payload of %d bytes", len(got))
+			}
+		})
+	}
+}
@@ -0,0 +1,144 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package events defines the events of the snapshotter published to containerd's event
+// bus. Events are encoded as JSON so they can be consumed by existing event-driven tooling
+// (e.g. `ctr events`) without importing this package.
+package events
+
+import (
+	"context"
+	"time"
+
+	"github.com/containerd/containerd/v2/core/events"
+	"github.com/containerd/containerd/v2/pkg/namespaces"
+	"github.com/containerd/log"
+	"github.com/containerd/typeurl/v2"
+)
+
+const (
+	// TopicResolved is the topic of LayerResolved.
+	TopicResolved = "/snapshot/stargz/resolved"
+
+	// TopicPrefetchComplete is the topic of PrefetchComplete.
+	TopicPrefetchComplete = "/snapshot/stargz/prefetch-complete"
+
+	// TopicFullyFetched is the topic of FullyFetched.
+	TopicFullyFetched = "/snapshot/stargz/fully-fetched"
+
+	// TopicSealed is the topic of Sealed.
+	TopicSealed = "/snapshot/stargz/sealed"
+
+	// TopicDegraded is the topic of Degraded.
+	TopicDegraded = "/snapshot/stargz/degraded"
+
+	// TopicOutage is the topic of Outage.
+	TopicOutage = "/snapshot/stargz/outage"
+
+	// TopicPlainHTTP is the topic of PlainHTTP.
+	TopicPlainHTTP = "/snapshot/stargz/plain-http"
+
+	publishTimeout = 5 * time.Second
+)
+
+func init() {
+	const prefix = "github.com/containerd/stargz-snapshotter/events"
+	typeurl.Register(&LayerResolved{}, prefix, "LayerResolved")
+	typeurl.Register(&PrefetchComplete{}, prefix, "PrefetchComplete")
+	typeurl.Register(&FullyFetched{}, prefix, "FullyFetched")
+	typeurl.Register(&Sealed{}, prefix, "Sealed")
+	typeurl.Register(&Degraded{}, prefix, "Degraded")
+	typeurl.Register(&Outage{}, prefix, "Outage")
+	typeurl.Register(&PlainHTTP{}, prefix, "PlainHTTP")
+}
+
+// LayerResolved is published when the layer is resolved and mounted for lazy pulling.
+type LayerResolved struct {
+	Mountpoint string `json:"mountpoint"`
+	Ref        string `json:"ref"`
+	Digest     string `json:"digest"`
+	Size       int64  `json:"size"`
+}
+
+// PrefetchComplete is published when prefetch of the layer is completed.
+type PrefetchComplete struct {
+	Mountpoint string `json:"mountpoint"`
+	Digest     string `json:"digest"`
+	Error      string `json:"error,omitempty"`
+}
+
+// FullyFetched is published when all contents of the layer are fetched and cached by
+// the background fetcher.
+type FullyFetched struct {
+	Mountpoint string `json:"mountpoint"`
+	Digest     string `json:"digest"`
+	Size       int64  `json:"size"`
+}
+
+// Sealed is published when the remote snapshot is committed and becomes ready to be
+// used as a parent of other snapshots.
+type Sealed struct {
+	Key    string `json:"key"`
+	Name   string `json:"name"`
+	Parent string `json:"parent,omitempty"`
+}
+
+// Degraded is published when the layer can't be served from the registry (e.g. the
+// connection can't be refreshed). Contents not cached yet can't be read until recovered.
+type Degraded struct {
+	Mountpoint string `json:"mountpoint"`
+	Digest     string `json:"digest"`
+	Error      string `json:"error"`
+}
+
+// Outage is published when the registry serving the layer has been failing longer than the
+// outage threshold and only cached contents can be read (Unavailable is true), and when the
+// registry recovers (Unavailable is false). Since is when the registry started failing.
+type Outage struct {
+	Digest      string    `json:"digest"`
+	Unavailable bool      `json:"unavailable"`
+	Since       time.Time `json:"since"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// PlainHTTP is published as a warning when the snapshotter connects to a registry host
+// other than localhost with plain HTTP as allowed by the configuration.
+type PlainHTTP struct {
+	Host string `json:"host"`
+	Ref  string `json:"ref"`
+}
+
+// Publish publishes the event in background. The event is published to the namespace of
+// ctx or the default namespace. Publishing never blocks nor fails the caller. Errors are
+// only logged. Nothing is done if p is nil.
+func Publish(ctx context.Context, p events.Publisher, topic string, event events.Event) {
+	if p == nil {
+		return
+	}
+	ns, ok := namespaces.Namespace(ctx)
+	if !ok {
+		ns = namespaces.Default
+	}
+	// Event is published after the operation (e.g. Mount) returns so don't get canceled.
+	ctx = namespaces.WithNamespace(context.WithoutCancel(ctx), ns)
+	go func() {
+		ctx, cancel := context.WithTimeout(ctx, publishTimeout)
+		defer cancel()
+		if err := p.Publish(ctx, topic, event); err != nil {
+			log.G(ctx).WithError(err).Debugf("failed to publish event %q", topic)
+		}
+	}()
+}
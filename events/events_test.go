@@ -0,0 +1,95 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package events
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/v2/core/events"
+	"github.com/containerd/containerd/v2/pkg/namespaces"
+	"github.com/containerd/typeurl/v2"
+)
+
+type published struct {
+	namespace string
+	topic     string
+	event     events.Event
+}
+
+type testPublisher chan published
+
+func (p testPublisher) Publish(ctx context.Context, topic string, event events.Event) error {
+	ns, _ := namespaces.Namespace(ctx)
+	p <- published{ns, topic, event}
+	return nil
+}
+
+func TestPublish(t *testing.T) {
+	p := make(testPublisher, 1)
+	wait := func() published {
+		select {
+		case e := <-p:
+			return e
+		case <-time.After(10 * time.Second):
+			t.Fatalf("event isn't published")
+		}
+		return published{}
+	}
+
+	ev := &LayerResolved{Mountpoint: "/mnt", Ref: "example.com/foo:latest", Digest: "sha256:abc", Size: 10}
+	ctx, cancel := context.WithCancel(namespaces.WithNamespace(context.Background(), "test"))
+	cancel() // must be published even after the operation returns
+	Publish(ctx, p, TopicResolved, ev)
+	if got := wait(); got.namespace != "test" || got.topic != TopicResolved || got.event != ev {
+		t.Errorf("unexpected event %+v", got)
+	}
+
+	Publish(context.Background(), p, TopicDegraded, &Degraded{})
+	if got := wait(); got.namespace != namespaces.Default {
+		t.Errorf("namespace = %q; want %q", got.namespace, namespaces.Default)
+	}
+
+	// nil publisher is ignored
+	Publish(context.Background(), nil, TopicResolved, ev)
+}
+
+func TestMarshal(t *testing.T) {
+	for _, ev := range []any{
+		&LayerResolved{Mountpoint: "/mnt", Ref: "example.com/foo:latest", Digest: "sha256:abc", Size: 10},
+		&PrefetchComplete{Mountpoint: "/mnt", Digest: "sha256:abc", Error: "failed"},
+		&FullyFetched{Mountpoint: "/mnt", Digest: "sha256:abc", Size: 10},
+		&Sealed{Key: "key", Name: "name", Parent: "parent"},
+		&Degraded{Mountpoint: "/mnt", Digest: "sha256:abc", Error: "failed"},
+		&Outage{Digest: "sha256:abc", Unavailable: true, Since: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC), Error: "failed"},
+		&PlainHTTP{Host: "example.com", Ref: "example.com/foo:latest"},
+	} {
+		a, err := typeurl.MarshalAny(ev)
+		if err != nil {
+			t.Fatalf("failed to marshal %T: %v", ev, err)
+		}
+		got, err := typeurl.UnmarshalAny(a)
+		if err != nil {
+			t.Fatalf("failed to unmarshal %T: %v", ev, err)
+		}
+		if !reflect.DeepEqual(got, ev) {
+			t.Errorf("got %+v; want %+v", got, ev)
+		}
+	}
+}
@@ -0,0 +1,358 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package attestation produces signed in-toto statements recording the verification of
+// layers whose contents are fully fetched in background. A statement has the layer blob
+// as the subject and the TOC digest and the verification result as the predicate, and is
+// signed in a DSSE envelope so the attestation can be checked by anyone who has the public
+// key.
+package attestation
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+const (
+	// StatementType is the type of in-toto statements.
+	StatementType = "https://in-toto.io/Statement/v1"
+
+	// PredicateType is the type of the predicate recording the verification of a layer.
+	PredicateType = "https://github.com/containerd/stargz-snapshotter/attestation/layer-verification/v1"
+
+	// PayloadType is the payload type of DSSE envelopes of in-toto statements.
+	PayloadType = "application/vnd.in-toto+json"
+)
+
+// Result is the result of the verification of a layer.
+type Result string
+
+const (
+	// ResultVerified means all contents of the layer are fetched and verified with the TOC digest.
+	ResultVerified Result = "verified"
+
+	// ResultUnverified means all contents of the layer are fetched without verification
+	// (e.g. the verification is disabled).
+	ResultUnverified Result = "unverified"
+
+	// ResultFailed means the layer failed to be fetched or verified.
+	ResultFailed Result = "failed"
+)
+
+// Statement is an in-toto statement.
+type Statement struct {
+	Type          string    `json:"_type"`
+	Subject       []Subject `json:"subject"`
+	PredicateType string    `json:"predicateType"`
+	Predicate     Predicate `json:"predicate"`
+}
+
+// Subject is the artifact attested by the statement.
+type Subject struct {
+	Name   string            `json:"name"`
+	Digest map[string]string `json:"digest"`
+}
+
+// Predicate records the verification of a layer.
+type Predicate struct {
+	// Ref is the reference of the image the layer is pulled for.
+	Ref string `json:"ref,omitempty"`
+
+	// TOCDigest is the digest of the TOC of the layer.
+	TOCDigest string `json:"tocDigest"`
+
+	// Result is the result of the verification.
+	Result Result `json:"result"`
+
+	// Error is the error of the fetch or the verification if the result is ResultFailed.
+	Error string `json:"error,omitempty"`
+
+	// Node is the hostname of the node where the layer is fetched.
+	Node string `json:"node,omitempty"`
+
+	// Timestamp is the time when the fetch of the layer completed.
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Envelope is a DSSE envelope of a signed statement.
+type Envelope struct {
+	PayloadType string      `json:"payloadType"`
+	Payload     string      `json:"payload"`
+	Signatures  []Signature `json:"signatures"`
+}
+
+// Signature is a signature in a DSSE envelope.
+type Signature struct {
+	KeyID string `json:"keyid"`
+	Sig   string `json:"sig"`
+}
+
+// NewStatement returns the statement of the verification of the layer.
+func NewStatement(layer digest.Digest, p Predicate) *Statement {
+	return &Statement{
+		Type: StatementType,
+		Subject: []Subject{{
+			Name:   layer.String(),
+			Digest: map[string]string{layer.Algorithm().String(): layer.Encoded()},
+		}},
+		PredicateType: PredicateType,
+		Predicate:     p,
+	}
+}
+
+// Signer signs statements with a private key.
+type Signer struct {
+	key   crypto.Signer
+	keyID string
+}
+
+// LoadSigner reads a PEM-encoded PKCS #8 private key of Ed25519 or ECDSA from the file.
+func LoadSigner(keyFile string) (*Signer, error) {
+	b, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found in %q", keyFile)
+	}
+	k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key %q: %w", keyFile, err)
+	}
+	switch k := k.(type) {
+	case ed25519.PrivateKey:
+		return NewSigner(k)
+	case *ecdsa.PrivateKey:
+		return NewSigner(k)
+	default:
+		return nil, fmt.Errorf("unsupported private key type %T", k)
+	}
+}
+
+// NewSigner returns a signer with the Ed25519 or ECDSA key. The key ID is the hex-encoded
+// sha256 digest of the PKIX-encoded public key.
+func NewSigner(key crypto.Signer) (*Signer, error) {
+	pub, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		return nil, err
+	}
+	id := sha256.Sum256(pub)
+	return &Signer{key: key, keyID: hex.EncodeToString(id[:])}, nil
+}
+
+// Sign signs the statement and returns the envelope.
+func (s *Signer) Sign(st *Statement) (*Envelope, error) {
+	payload, err := json.Marshal(st)
+	if err != nil {
+		return nil, err
+	}
+	msg := pae(PayloadType, payload)
+	var sig []byte
+	if _, ok := s.key.(ed25519.PrivateKey); ok {
+		sig, err = s.key.Sign(rand.Reader, msg, crypto.Hash(0))
+	} else {
+		h := sha256.Sum256(msg)
+		sig, err = s.key.Sign(rand.Reader, h[:], crypto.SHA256)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign statement: %w", err)
+	}
+	return &Envelope{
+		PayloadType: PayloadType,
+		Payload:     base64.StdEncoding.EncodeToString(payload),
+		Signatures:  []Signature{{KeyID: s.keyID, Sig: base64.StdEncoding.EncodeToString(sig)}},
+	}, nil
+}
+
+// Verify checks that the envelope is signed with the Ed25519 or ECDSA public key and
+// returns the statement.
+func Verify(env *Envelope, pub crypto.PublicKey) (*Statement, error) {
+	if env.PayloadType != PayloadType {
+		return nil, fmt.Errorf("unexpected payload type %q", env.PayloadType)
+	}
+	payload, err := base64.StdEncoding.DecodeString(env.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("invalid payload: %w", err)
+	}
+	msg := pae(env.PayloadType, payload)
+	verified := false
+	for _, s := range env.Signatures {
+		sig, err := base64.StdEncoding.DecodeString(s.Sig)
+		if err != nil {
+			continue
+		}
+		switch pub := pub.(type) {
+		case ed25519.PublicKey:
+			verified = ed25519.Verify(pub, msg, sig)
+		case *ecdsa.PublicKey:
+			h := sha256.Sum256(msg)
+			verified = ecdsa.VerifyASN1(pub, h[:], sig)
+		default:
+			return nil, fmt.Errorf("unsupported public key type %T", pub)
+		}
+		if verified {
+			break
+		}
+	}
+	if !verified {
+		return nil, fmt.Errorf("no valid signature")
+	}
+	var st Statement
+	if err := json.Unmarshal(payload, &st); err != nil {
+		return nil, fmt.Errorf("invalid statement: %w", err)
+	}
+	return &st, nil
+}
+
+// pae is the pre-authentication encoding of DSSE.
+func pae(payloadType string, payload []byte) []byte {
+	return fmt.Appendf(nil, "DSSEv1 %d %s %d %s", len(payloadType), payloadType, len(payload), payload)
+}
+
+// Sink stores envelopes.
+type Sink interface {
+	// Put stores the envelope of the statement of the layer.
+	Put(ctx context.Context, layer digest.Digest, env *Envelope) error
+}
+
+// NewSink returns the sink at the location. An "http://" or "https://" URL is a sink
+// receiving envelopes with POST requests. Other locations are directories where envelopes
+// are written as "<algorithm>-<encoded layer digest>.intoto.json".
+func NewSink(location string) (Sink, error) {
+	if strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://") {
+		return &httpSink{url: location, client: http.DefaultClient}, nil
+	}
+	if err := os.MkdirAll(location, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create attestation directory: %w", err)
+	}
+	return dirSink(location), nil
+}
+
+type dirSink string
+
+func (d dirSink) Put(ctx context.Context, layer digest.Digest, env *Envelope) error {
+	b, err := json.Marshal(env)
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s-%s.intoto.json", layer.Algorithm(), layer.Encoded())
+	tmp, err := os.CreateTemp(string(d), name+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(string(d), name))
+}
+
+type httpSink struct {
+	url    string
+	client *http.Client
+}
+
+func (s *httpSink) Put(ctx context.Context, layer digest.Digest, env *Envelope) error {
+	b, err := json.Marshal(env)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status code %d from %q", resp.StatusCode, s.url)
+	}
+	return nil
+}
+
+// Attester signs statements of layers and puts them to the sink. A statement is produced
+// once per layer.
+type Attester struct {
+	signer *Signer
+	sink   Sink
+	node   string
+
+	attested sync.Map // layer digests already attested
+}
+
+// New returns an attester signing statements with the signer and putting them to the sink.
+func New(signer *Signer, sink Sink) *Attester {
+	node, _ := os.Hostname()
+	return &Attester{signer: signer, sink: sink, node: node}
+}
+
+// Attest produces the statement of the layer whose contents are fetched. fetchErr is the
+// error of the fetch. Nop if the layer has already been attested.
+func (a *Attester) Attest(ctx context.Context, layer digest.Digest, ref string, tocDigest digest.Digest, verified bool, fetchErr error) error {
+	if _, loaded := a.attested.LoadOrStore(layer, struct{}{}); loaded {
+		return nil
+	}
+	p := Predicate{
+		Ref:       ref,
+		TOCDigest: tocDigest.String(),
+		Result:    ResultVerified,
+		Node:      a.node,
+		Timestamp: time.Now().UTC(),
+	}
+	if fetchErr != nil {
+		p.Result, p.Error = ResultFailed, fetchErr.Error()
+	} else if !verified {
+		p.Result = ResultUnverified
+	}
+	env, err := a.signer.Sign(NewStatement(layer, p))
+	if err == nil {
+		err = a.sink.Put(ctx, layer, env)
+	}
+	if err != nil {
+		a.attested.Delete(layer) // allow retrying
+		return fmt.Errorf("failed to attest layer %s: %w", layer, err)
+	}
+	return nil
+}
@@ -0,0 +1,227 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package attestation
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+func TestSignAndVerify(t *testing.T) {
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layer := digest.FromString("layer")
+	for name, key := range map[string]crypto.Signer{"ed25519": edKey, "ecdsa": ecKey} {
+		t.Run(name, func(t *testing.T) {
+			// The key is loaded from the PEM file.
+			der, err := x509.MarshalPKCS8PrivateKey(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			keyFile := filepath.Join(t.TempDir(), "key.pem")
+			if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+				t.Fatal(err)
+			}
+			signer, err := LoadSigner(keyFile)
+			if err != nil {
+				t.Fatalf("failed to load signer: %v", err)
+			}
+			env, err := signer.Sign(NewStatement(layer, Predicate{TOCDigest: "sha256:toc", Result: ResultVerified}))
+			if err != nil {
+				t.Fatalf("failed to sign: %v", err)
+			}
+			st, err := Verify(env, key.Public())
+			if err != nil {
+				t.Fatalf("failed to verify: %v", err)
+			}
+			if st.Type != StatementType || st.PredicateType != PredicateType ||
+				len(st.Subject) != 1 || st.Subject[0].Digest["sha256"] != layer.Encoded() ||
+				st.Predicate.TOCDigest != "sha256:toc" || st.Predicate.Result != ResultVerified {
+				t.Errorf("unexpected statement: %+v", st)
+			}
+
+			// Tampered payload and other keys are rejected.
+			tampered := *env
+			tampered.Payload = env.Payload[:len(env.Payload)-4] + "AAAA"
+			if _, err := Verify(&tampered, key.Public()); err == nil {
+				t.Errorf("tampered envelope must be rejected")
+			}
+			otherPub, _, err := ed25519.GenerateKey(rand.Reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := Verify(env, otherPub); err == nil {
+				t.Errorf("envelope signed with another key must be rejected")
+			}
+		})
+	}
+}
+
+type recordSink struct {
+	mu   sync.Mutex
+	envs []*Envelope
+	err  error
+}
+
+func (s *recordSink) Put(ctx context.Context, layer digest.Digest, env *Envelope) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	s.envs = append(s.envs, env)
+	return nil
+}
+
+func TestAttester(t *testing.T) {
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := NewSigner(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	tocDigest := digest.FromString("toc")
+	tests := []struct {
+		name       string
+		verified   bool
+		fetchErr   error
+		wantResult Result
+	}{
+		{name: "verified", verified: true, wantResult: ResultVerified},
+		{name: "unverified", verified: false, wantResult: ResultUnverified},
+		{name: "failed", verified: true, fetchErr: errors.New("invalid chunk"), wantResult: ResultFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink := &recordSink{}
+			a := New(signer, sink)
+			layer := digest.FromString(tt.name)
+			for i := 0; i < 2; i++ {
+				if err := a.Attest(ctx, layer, "example.com/foo:latest", tocDigest, tt.verified, tt.fetchErr); err != nil {
+					t.Fatalf("failed to attest: %v", err)
+				}
+			}
+			if len(sink.envs) != 1 {
+				t.Fatalf("layer is attested %d times; want 1", len(sink.envs))
+			}
+			st, err := Verify(sink.envs[0], pub)
+			if err != nil {
+				t.Fatalf("failed to verify: %v", err)
+			}
+			p := st.Predicate
+			if p.Result != tt.wantResult || p.TOCDigest != tocDigest.String() || p.Ref != "example.com/foo:latest" || p.Timestamp.IsZero() {
+				t.Errorf("unexpected predicate: %+v", p)
+			}
+			if (tt.fetchErr != nil) != (p.Error != "") {
+				t.Errorf("unexpected error in predicate: %q", p.Error)
+			}
+		})
+	}
+
+	// The layer is attested again after the failure of the sink.
+	sink := &recordSink{err: errors.New("unavailable")}
+	a := New(signer, sink)
+	layer := digest.FromString("retry")
+	if err := a.Attest(ctx, layer, "", tocDigest, true, nil); err == nil {
+		t.Fatalf("failure of the sink must be returned")
+	}
+	sink.err = nil
+	if err := a.Attest(ctx, layer, "", tocDigest, true, nil); err != nil || len(sink.envs) != 1 {
+		t.Fatalf("failed to attest again: %v (%d)", err, len(sink.envs))
+	}
+}
+
+func TestSinks(t *testing.T) {
+	ctx := context.Background()
+	layer := digest.FromString("layer")
+	env := &Envelope{PayloadType: PayloadType, Payload: "e30=", Signatures: []Signature{{KeyID: "id", Sig: "c2ln"}}}
+
+	// Directory
+	dir := filepath.Join(t.TempDir(), "attestations")
+	s, err := NewSink(dir)
+	if err != nil {
+		t.Fatalf("failed to create directory sink: %v", err)
+	}
+	if err := s.Put(ctx, layer, env); err != nil {
+		t.Fatalf("failed to put to directory: %v", err)
+	}
+	b, err := os.ReadFile(filepath.Join(dir, "sha256-"+layer.Encoded()+".intoto.json"))
+	if err != nil {
+		t.Fatalf("envelope isn't written: %v", err)
+	}
+	var got Envelope
+	if err := json.Unmarshal(b, &got); err != nil || got.Payload != env.Payload || len(got.Signatures) != 1 {
+		t.Errorf("unexpected envelope %q: %v", string(b), err)
+	}
+	if ents, err := os.ReadDir(dir); err != nil || len(ents) != 1 {
+		t.Errorf("unexpected files in the directory: %v: %v", ents, err)
+	}
+
+	// HTTP
+	var received Envelope
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+	s, err = NewSink(srv.URL + "/attestations")
+	if err != nil {
+		t.Fatalf("failed to create HTTP sink: %v", err)
+	}
+	if err := s.Put(ctx, layer, env); err != nil {
+		t.Fatalf("failed to post: %v", err)
+	}
+	if received.Payload != env.Payload {
+		t.Errorf("unexpected envelope received: %+v", received)
+	}
+	srv.Config.Handler = http.NotFoundHandler()
+	if err := s.Put(ctx, layer, env); err == nil {
+		t.Errorf("error status must be returned")
+	}
+}
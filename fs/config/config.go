@@ -59,6 +59,22 @@ type Config struct {
 	// Default is 0 (disabled).
 	PrefetchAsyncSize int64 `toml:"prefetch_async_size" json:"prefetch_async_size"`
 
+	// PrefetchTierConcurrency is the maximum number of concurrent fetches for each prefetch tier
+	// of eStargz layers built with multiple prefetch tiers. Tiers are fetched in order and the i-th
+	// value applies to the i-th tier. The last value applies to the rest tiers. Zero means no limit.
+	// Concurrency is effective when PrefetchChunkSize > ChunkSize. Default is empty (no limit).
+	PrefetchTierConcurrency []int `toml:"prefetch_tier_concurrency" json:"prefetch_tier_concurrency"`
+
+	// PrefetchList enables prefetching the files listed in the prefetch list of the image
+	// published as an annotation of the image manifest or a referrer artifact of the manifest
+	// (see source.PrefetchList). Default is false.
+	PrefetchList bool `toml:"prefetch_list" json:"prefetch_list"`
+
+	// PrefetchDependencies enables prefetching the files the executables in the prefetched
+	// range of the layers need to run (the dynamic linker, shared libraries and script
+	// interpreters), looked up among the layers of the image. Default is false.
+	PrefetchDependencies bool `toml:"prefetch_dependencies" json:"prefetch_dependencies"`
+
 	// NoPrefetch disables prefetching. Default is false.
 	NoPrefetch bool `toml:"noprefetch" json:"noprefetch"`
 
@@ -83,15 +99,98 @@ type Config struct {
 	// LogFileAccess enables logging information on first access to each file. Default is false.
 	LogFileAccess bool `toml:"log_file_access" json:"log_file_access"`
 
+	// CaseInsensitiveLookup makes lookups of file names case-insensitive. Layers that contain
+	// names differing only in case fail to be mounted. Default is false.
+	CaseInsensitiveLookup bool `toml:"case_insensitive_lookup" json:"case_insensitive_lookup"`
+
+	// AsyncVerifyWorkers is the number of goroutines of each layer verifying chunks read on demand in
+	// background. Reads return chunks without waiting for the verification and a chunk failing the
+	// verification makes the next read of the chunk fail. Default is 0 (chunks are verified before
+	// returned).
+	AsyncVerifyWorkers int `toml:"async_verify_workers" json:"async_verify_workers"`
+
+	// VerifyCachedChunks makes the chunks read from the cache of other layers (i.e. chunks of
+	// the base layers of delta layers and chunks deduplicated among layers) verified against the
+	// chunk digest even if they have been verified when cached. Default is false (chunks cached
+	// under the digest they have been verified against aren't verified again).
+	VerifyCachedChunks bool `toml:"verify_cached_chunks" json:"verify_cached_chunks"`
+
+	// VerifyFileDigests makes the data of files returned to FUSE checked against the digest of
+	// the whole file recorded in the TOC once a file has been read from the head to the end.
+	// This catches errors in reassembling files from chunks, which the chunk digests can't.
+	// Default is false.
+	VerifyFileDigests bool `toml:"verify_file_digests" json:"verify_file_digests"`
+
+	// StrictEOF makes reads of files follow the contract of io.ReaderAt at the end of files and
+	// fail if the chunks of a file don't cover its size, instead of returning short reads.
+	// Default is false (reads return the bytes up to the end of the file without io.EOF).
+	StrictEOF bool `toml:"strict_eof" json:"strict_eof"`
+
+	// SubChunkFetchSize is the minimum size of chunks whose head is fetched for reads not
+	// covering the whole chunk, instead of the whole chunk. Chunks that must be verified are
+	// fetched this way only with AsyncVerifyWorkers. Default is 0 (whole chunks are fetched).
+	SubChunkFetchSize int64 `toml:"sub_chunk_fetch_size" json:"sub_chunk_fetch_size"`
+
+	// OpenFileCacheSize is the number of the files of each layer kept opened after they are
+	// opened so that files opened repeatedly (e.g. shared libraries) don't resolve the metadata
+	// of the file again. Default is 0 (files are resolved on each open).
+	OpenFileCacheSize int `toml:"open_file_cache_size" json:"open_file_cache_size"`
+
+	// AccessTraceSize is the number of the last chunks read from the files of the mounted layers
+	// recorded with the time of the read (e.g. to find the files the running containers need).
+	// Default is 0 (reads aren't recorded).
+	AccessTraceSize int `toml:"access_trace_size" json:"access_trace_size"`
+
 	// BlobConfig is config for layer blob management.
 	BlobConfig `toml:"blob" json:"blob"`
 
 	// DirectoryCacheConfig is config for directory-based cache.
 	DirectoryCacheConfig `toml:"directory_cache" json:"directory_cache"`
 
+	// ChunkSourceConfig is config for sources of chunks read on demand.
+	ChunkSourceConfig `toml:"chunk_source" json:"chunk_source"`
+
 	// FuseConfig is configurations for FUSE fs.
 	FuseConfig `toml:"fuse" json:"fuse"`
 
+	// ModelConfig is config for serving huge model files (e.g. weights of LLMs).
+	ModelConfig `toml:"model" json:"model"`
+
+	// FetchConcurrencyConfig is config for the limits of chunks fetched in parallel.
+	FetchConcurrencyConfig `toml:"fetch_concurrency" json:"fetch_concurrency"`
+
+	// ReadaheadConfig is config for reading ahead files read sequentially.
+	ReadaheadConfig `toml:"readahead" json:"readahead"`
+
+	// FilePriorityConfig is config for the order of files fetched in background.
+	FilePriorityConfig `toml:"file_priority" json:"file_priority"`
+
+	// BackgroundFetchConfig is config for throttling the fetch of layers in background.
+	BackgroundFetchConfig `toml:"background_fetch" json:"background_fetch"`
+
+	// CacheScrubConfig is config for verifying the cached chunks periodically.
+	CacheScrubConfig `toml:"cache_scrub" json:"cache_scrub"`
+
+	// EncryptionConfig is config for lazily pulling layers encrypted by ocicrypt.
+	EncryptionConfig `toml:"encryption" json:"encryption"`
+
+	// LayerFormatConfig is config for enabling layer formats.
+	LayerFormatConfig `toml:"layer_format" json:"layer_format"`
+
+	// AttestationConfig is config for attesting the verification of fully fetched layers.
+	AttestationConfig `toml:"attestation" json:"attestation"`
+
+	// Profiles are named sets of the prefetch, background fetch and cache params applied to
+	// the images selected by ProfileByImage. Profiles named as the built-in ones ("aggressive",
+	// "balanced" and "metadata-only") replace them. Default is empty.
+	Profiles map[string]ProfileConfig `toml:"profiles" json:"profiles"`
+
+	// ProfileByImage selects the profiles of the images whose references without the tag and
+	// the digest (e.g. "ghcr.io/org/app") match the glob patterns (path.Match). The longest
+	// matching pattern is used. The other images use the params of this config. Default is
+	// empty.
+	ProfileByImage map[string]string `toml:"profile_by_image" json:"profile_by_image"`
+
 	// ResolveResultEntry is a deprecated field.
 	ResolveResultEntry int `toml:"resolve_result_entry" json:"resolve_result_entry"` // deprecated
 }
@@ -112,6 +211,18 @@ type BlobConfig struct {
 	// FetchTimeoutSec is a timeout duration (in seconds) for fetching chunks from the registry. Default is 300.
 	FetchTimeoutSec int64 `toml:"fetching_timeout_sec" json:"fetching_tieout_sec"`
 
+	// ReadFetchTimeoutSec is a timeout duration (in seconds) for fetching chunks read on demand by
+	// the container. The deadline of the FUSE request is also respected. Default is FetchTimeoutSec.
+	ReadFetchTimeoutSec int64 `toml:"read_fetching_timeout_sec" json:"read_fetching_timeout_sec"`
+
+	// MetadataFetchTimeoutSec is a timeout duration (in seconds) for fetching the metadata (footer
+	// and TOC) of the layer when the layer is resolved. Default is FetchTimeoutSec.
+	MetadataFetchTimeoutSec int64 `toml:"metadata_fetching_timeout_sec" json:"metadata_fetching_timeout_sec"`
+
+	// PrefetchFetchTimeoutSec is a timeout duration (in seconds) for fetching chunks by prefetch
+	// and background fetch. Default is FetchTimeoutSec.
+	PrefetchFetchTimeoutSec int64 `toml:"prefetch_fetching_timeout_sec" json:"prefetch_fetching_timeout_sec"`
+
 	// ForceSingleRangeMode disables using of multiple ranges in a Range Request and always specifies one larger
 	// region that covers them. Default is false.
 	ForceSingleRangeMode bool `toml:"force_single_range_mode" json:"force_single_range_mode"`
@@ -131,6 +242,310 @@ type BlobConfig struct {
 
 	// MinWaitMSec is maximum delay (in seconds) for the next retrying after a request failure. Default is 30.
 	MaxWaitMSec int `toml:"max_wait_msec" json:"max_wait_msec"`
+
+	// MaxTransferResumes is a max number of times a transfer of a range broken mid-stream is
+	// resumed from the last chunk fully received and verified, instead of failing the fetch of the whole
+	// range. Negative value disables resuming. Default is 3.
+	MaxTransferResumes int `toml:"max_transfer_resumes" json:"max_transfer_resumes"`
+
+	// OutageThresholdSec is a duration (in seconds) of continuous fetch failures after which the
+	// registry is treated as unavailable. While unavailable, cached contents remain readable but reads
+	// of uncached contents fail immediately with EHOSTUNREACH instead of waiting for the fetch timeout.
+	// An event is published when the registry becomes unavailable and when it recovers.
+	// Default is 0 (disabled).
+	OutageThresholdSec int64 `toml:"outage_threshold_sec" json:"outage_threshold_sec"`
+
+	// OutageProbeIntervalSec is an interval (in seconds) to retry accessing the registry while it's
+	// treated as unavailable. Default is 10.
+	OutageProbeIntervalSec int64 `toml:"outage_probe_interval_sec" json:"outage_probe_interval_sec"`
+
+	// MaxConcurrentFetches is the maximum number of requests fetching the contents of layer
+	// blobs from remote registries in parallel, shared among layers. Waiting requests of
+	// on-demand reads and metadata are sent before the ones of prefetch and background fetch,
+	// which can't take the last slot. Default is 0 (unlimited).
+	MaxConcurrentFetches int `toml:"max_concurrent_fetches" json:"max_concurrent_fetches"`
+
+	// AdaptiveHostConcurrency limits the requests fetching layer blobs in flight to each host
+	// (e.g. a registry or the CDN it redirects to) and adapts the limit to the throughput of the
+	// host, learned limits being persisted across restarts. Default is false (requests to a host
+	// are limited only by MaxConcurrentFetches).
+	AdaptiveHostConcurrency bool `toml:"adaptive_host_concurrency" json:"adaptive_host_concurrency"`
+
+	// MaxHostConcurrency is the upper bound of the limit of AdaptiveHostConcurrency. Default
+	// is 32.
+	MaxHostConcurrency int `toml:"max_host_concurrency" json:"max_host_concurrency"`
+
+	// RenewBeforeExpirySec is a duration (in seconds) before the expiry of the access to the
+	// layer blob (the pre-signed URL the registry redirects to or the bearer token) at which
+	// the access is renewed in background, so the first read after an idle period doesn't wait
+	// for the authorization and the redirection. Default is 0 (renewed on the next read).
+	RenewBeforeExpirySec int64 `toml:"renew_before_expiry_sec" json:"renew_before_expiry_sec"`
+
+	// DisableForeignURLs disables fetching layers from the URLs listed in the layer descriptor
+	// (e.g. foreign layers of Windows images). If enabled, these layers are fetched from the registry.
+	// Default is false.
+	DisableForeignURLs bool `toml:"disable_foreign_urls" json:"disable_foreign_urls"`
+
+	// BandwidthLimit is the maximum bytes per second fetched from remote registries.
+	// Default is 0 (unlimited).
+	BandwidthLimit int64 `toml:"bandwidth_limit" json:"bandwidth_limit"`
+
+	// BackgroundBandwidthLimit is the maximum bytes per second fetched from remote registries
+	// by prefetch and background fetch, in addition to BandwidthLimit. Default is 0 (unlimited).
+	BackgroundBandwidthLimit int64 `toml:"background_bandwidth_limit" json:"background_bandwidth_limit"`
+
+	// HedgeDelayMSec is the delay after which a fetch from the registry host that hasn't responded
+	// is also issued to the next host serving the blob (e.g. the next mirror). The first successful
+	// response is used. Default is 0 (fetches are issued to one host).
+	HedgeDelayMSec int64 `toml:"hedge_delay_msec" json:"hedge_delay_msec"`
+}
+
+// ChunkSourceConfig is configuration for the sources of chunks that aren't in the local cache.
+type ChunkSourceConfig struct {
+	// Order is the order of sources tried for reading a chunk that isn't in the local cache.
+	// "blob" is the layer blob, fetched from the registry mirrors and the origin registry in the
+	// order of the hosts configuration. Other names refer to sources registered to the filesystem
+	// (e.g. peer nodes or a remote cache). Sources not listed aren't used. Default is all registered
+	// sources in the order of names followed by "blob".
+	Order []string `toml:"order" json:"order"`
+
+	// Retry is the retry policy of each source, keyed by the source name.
+	Retry map[string]ChunkSourceRetryConfig `toml:"retry" json:"retry"`
+
+	// DedupChunks makes reads of chunks that aren't in the local cache use the chunks with
+	// the same digest cached by other layers before trying the sources. This keeps an index
+	// of the digests of all cached chunks on memory. Default is false.
+	DedupChunks bool `toml:"dedup" json:"dedup"`
+}
+
+// ChunkSourceRetryConfig is configuration for retrying reads from a chunk source.
+type ChunkSourceRetryConfig struct {
+	// MaxRetries is a max number of retries of reading a chunk from the source. Default is 0.
+	MaxRetries int `toml:"max_retries" json:"max_retries"`
+
+	// RetryIntervalMSec is a delay (in milliseconds) before retrying. Default is 0.
+	RetryIntervalMSec int `toml:"retry_interval_msec" json:"retry_interval_msec"`
+
+	// MaxRetryIntervalMSec enables the exponential backoff of retries if larger than
+	// RetryIntervalMSec. The delay starts at RetryIntervalMSec and doubles on each retry up to
+	// this (in milliseconds), with a random jitter. Default is 0 (fixed delay).
+	MaxRetryIntervalMSec int `toml:"max_retry_interval_msec" json:"max_retry_interval_msec"`
+}
+
+// ModelConfig is configuration for the model serving mode tuned for huge model files.
+type ModelConfig struct {
+	// Enable enables the model serving mode. On cache miss of a model file, all chunks in
+	// the aligned unit containing the read are fetched in parallel and written to the disk
+	// cache. Default is false.
+	Enable bool `toml:"enable" json:"enable"`
+
+	// Patterns are glob patterns (path.Match) of the base names of model files.
+	// Default is "*.safetensors" and "*.gguf".
+	Patterns []string `toml:"patterns" json:"patterns"`
+
+	// FetchUnitSize is the size (in bytes) of the aligned unit fetched at once.
+	// Default is 33554432 (32MiB).
+	FetchUnitSize int64 `toml:"fetch_unit_size" json:"fetch_unit_size"`
+
+	// PrefetchIndex enables caching the indexes (headers) of safetensors and GGUF files
+	// when the layer is prefetched. Default is false.
+	PrefetchIndex bool `toml:"prefetch_index" json:"prefetch_index"`
+
+	// CancelOnClose cancels the fetch units of a model file when all of its handles are
+	// closed and it isn't opened again within CancelGraceMSec. Default is false.
+	CancelOnClose bool `toml:"cancel_on_close" json:"cancel_on_close"`
+
+	// CancelGraceMSec is the delay (in milliseconds) before canceling the fetch units of a
+	// closed model file. Default is 1000.
+	CancelGraceMSec int `toml:"cancel_grace_msec" json:"cancel_grace_msec"`
+}
+
+// FetchConcurrencyConfig is configuration for the limits of chunks fetched in parallel by the
+// fetch units of model files and the merge of files for passthrough. Higher limits hide the
+// latency of registries and lower limits bound the memory used for the chunks being fetched.
+type FetchConcurrencyConfig struct {
+	// Workers is the max number of chunks fetched in parallel by each layer. This also
+	// replaces the number of chunks of a model fetch unit fetched in parallel (8).
+	// Default is 0 (no limit).
+	Workers int `toml:"workers" json:"workers"`
+
+	// MaxInflightBytes is the max total size (in bytes) of chunks fetched in parallel by each
+	// layer. Default is 0 (no limit).
+	MaxInflightBytes int64 `toml:"max_inflight_bytes" json:"max_inflight_bytes"`
+
+	// GlobalWorkers is the max number of chunks fetched in parallel by all layers.
+	// Default is 0 (no limit).
+	GlobalWorkers int `toml:"global_workers" json:"global_workers"`
+
+	// GlobalMaxInflightBytes is the max total size (in bytes) of chunks fetched in parallel by
+	// all layers. Default is 0 (no limit).
+	GlobalMaxInflightBytes int64 `toml:"global_max_inflight_bytes" json:"global_max_inflight_bytes"`
+}
+
+// ReadaheadConfig is configuration for the adaptive readahead of files read sequentially.
+type ReadaheadConfig struct {
+	// Enable enables fetching the chunks following sequential reads of a file in background.
+	// The readahead window grows on each sequential read and is reset on random access.
+	// Default is false.
+	Enable bool `toml:"enable" json:"enable"`
+
+	// MaxWindowSize is the max size (in bytes) of the region read ahead of a file handle.
+	// Default is 4194304 (4MiB).
+	MaxWindowSize int64 `toml:"max_window_size" json:"max_window_size"`
+}
+
+// BackgroundFetchConfig is configuration for throttling the background fetch that caches the
+// entire contents of each layer, so it doesn't slow down reads of files by containers.
+type BackgroundFetchConfig struct {
+	// MaxConcurrentChunks is the max number of chunks of a layer cached in parallel.
+	// Default is 0 (GOMAXPROCS).
+	MaxConcurrentChunks int `toml:"max_concurrent_chunks" json:"max_concurrent_chunks"`
+
+	// BytesPerSec is the max bytes of chunks of a layer cached per second. See also
+	// BlobConfig.BackgroundBandwidthLimit that limits the fetch of all layers from registries.
+	// Default is 0 (unlimited).
+	BytesPerSec int64 `toml:"bytes_per_sec" json:"bytes_per_sec"`
+
+	// PauseReadLatencyMSec pauses the background fetch of a layer while reads of files of
+	// the layer that fetch contents take longer than this (in milliseconds).
+	// Default is 0 (never paused).
+	PauseReadLatencyMSec int64 `toml:"pause_read_latency_msec" json:"pause_read_latency_msec"`
+
+	// Paths limits the background fetch to the files whose paths in the layer match any of
+	// these glob patterns. "**" matches zero or more path elements (e.g. "/usr/bin/**").
+	// Other files are fetched on demand. Default is empty (all files).
+	Paths []string `toml:"paths" json:"paths"`
+
+	// Resume keeps the progress of the background fetch of each layer in its directory cache
+	// so the background fetch resumes from the cached chunks when the layer is mounted again
+	// after the snapshotter is restarted without cleaning up the mounts (e.g. on a crash or a
+	// reboot of the node). The directory caches left by the previous run are reused for the
+	// same layers. Default is false.
+	Resume bool `toml:"resume" json:"resume"`
+
+	// SkipVolumes skips the background fetch of the files under the volumes declared in the
+	// image config (VOLUME) and under TmpfsPaths. Containers usually get other filesystems
+	// mounted on these paths so the files are never read through the layer. The image config
+	// is fetched from the registry once per image. Default is false.
+	SkipVolumes bool `toml:"skip_volumes" json:"skip_volumes"`
+
+	// TmpfsPaths are the glob patterns of the paths where runtimes usually mount tmpfs (or
+	// other pseudo filesystems), skipped by SkipVolumes. Default is "dev", "proc", "run",
+	// "sys" and "tmp".
+	TmpfsPaths []string `toml:"tmpfs_paths" json:"tmpfs_paths"`
+
+	// SkipShadowed skips the background fetch of the files hidden by the upper layers of the
+	// image (i.e. deleted by whiteouts, under opaque directories or replaced by other files)
+	// because they are never visible in containers. The upper layers are the ones listed
+	// after the layer in the labels of the layer. Default is false.
+	SkipShadowed bool `toml:"skip_shadowed" json:"skip_shadowed"`
+}
+
+// ProfileConfig is a named set of params used instead of the ones of Config for the images
+// selected by Config.ProfileByImage. Params that aren't specified are the defaults, not the
+// values of Config. A layer shared among images uses the profile of the image that mounts it
+// first.
+type ProfileConfig struct {
+	// PrefetchSize is the size to prefetch layers without prefetch landmarks (see
+	// Config.PrefetchSize). Default is 0.
+	PrefetchSize int64 `toml:"prefetch_size" json:"prefetch_size"`
+
+	// NoPrefetch disables prefetch. Default is false.
+	NoPrefetch bool `toml:"noprefetch" json:"noprefetch"`
+
+	// PrefetchList prefetches the files listed in the prefetch lists of the images (see
+	// Config.PrefetchList). Default is false.
+	PrefetchList bool `toml:"prefetch_list" json:"prefetch_list"`
+
+	// PrefetchDependencies prefetches the dependencies of the prefetched executables (see
+	// Config.PrefetchDependencies). Default is false.
+	PrefetchDependencies bool `toml:"prefetch_dependencies" json:"prefetch_dependencies"`
+
+	// NoBackgroundFetch disables background fetch. Default is false.
+	NoBackgroundFetch bool `toml:"no_background_fetch" json:"no_background_fetch"`
+
+	// SkipVolumes skips the background fetch of the volumes of the images (see
+	// BackgroundFetchConfig.SkipVolumes). Default is false.
+	SkipVolumes bool `toml:"skip_volumes" json:"skip_volumes"`
+
+	// SkipShadowed skips the background fetch of the files hidden by upper layers (see
+	// BackgroundFetchConfig.SkipShadowed). Default is false.
+	SkipShadowed bool `toml:"skip_shadowed" json:"skip_shadowed"`
+
+	// CompressCache caches the layers compressed (see DirectoryCacheConfig.Compress).
+	// DirectoryCacheConfig.CompressByImage takes precedence. Default is false.
+	CompressCache bool `toml:"compress_cache" json:"compress_cache"`
+}
+
+// CacheScrubConfig is configuration for periodically verifying a sample of the cached chunks
+// of the mounted layers against the TOC, so chunks corrupted on the disk (e.g. by bit rot) are
+// removed from the cache and fetched again instead of being served to containers.
+type CacheScrubConfig struct {
+	// IntervalSec is the interval (in seconds) of scrubbing the caches. Default is 0 (disabled).
+	IntervalSec int64 `toml:"interval_sec" json:"interval_sec"`
+
+	// SampleChunks is the max number of the chunks of each layer picked at random and verified
+	// on each scrub. Default is 100.
+	SampleChunks int `toml:"sample_chunks" json:"sample_chunks"`
+}
+
+// FilePriorityConfig is configuration for prioritizing files in background fetch of layers
+// that don't record the files accessed at startup (i.e. layers without the prefetch landmark).
+type FilePriorityConfig struct {
+	// Enable enables fetching files in the descending order of the priority in background.
+	// Files of the same priority are fetched in the order in the layer. Default is false.
+	Enable bool `toml:"enable" json:"enable"`
+
+	// Patterns maps glob patterns (path.Match) of base names to the priorities. If a file
+	// matches multiple patterns, the highest priority is used. Files that match no pattern
+	// have the priority 0. Default is a table prioritizing shared libraries, scripts and
+	// config files (e.g. "*.so", "*.py", "*.json") and deprioritizing documents and static
+	// libraries (e.g. "*.md", "*.a").
+	Patterns map[string]int `toml:"patterns" json:"patterns"`
+
+	// Executable is the priority of files that have the executable bit and match no pattern.
+	// Default is the priority of shared libraries in the default table if Patterns is empty.
+	Executable int `toml:"executable" json:"executable"`
+}
+
+// LayerFormatConfig is configuration for disabling lazy pulling of layer formats (e.g. as a
+// policy or to work around bugs). Layers of disabled formats fail to be resolved with an
+// error naming the format, and containerd pulls them instead.
+type LayerFormatConfig struct {
+	// DisableZstdChunked disables lazy pulling of zstd:chunked layers. Default is false.
+	DisableZstdChunked bool `toml:"disable_zstdchunked" json:"disable_zstdchunked"`
+
+	// DisableExternalTOC disables lazy pulling of eStargz layers with the external TOC.
+	// Default is false.
+	DisableExternalTOC bool `toml:"disable_external_toc" json:"disable_external_toc"`
+
+	// EnableDeltaLayers enables lazy pulling of eStargz delta layers, whose chunks stored in
+	// the base layer are resolved from the cache of the base layer. This keeps an index of
+	// the digests of all cached chunks on memory. Default is false.
+	EnableDeltaLayers bool `toml:"enable_delta_layers" json:"enable_delta_layers"`
+}
+
+// AttestationConfig is configuration for producing signed in-toto statements recording the
+// layer digest, the TOC digest and the verification result of each mounted layer after its
+// contents are fully fetched in background.
+type AttestationConfig struct {
+	// Sink is where the statements are put. An "http://" or "https://" URL receives the DSSE
+	// envelopes of the statements with POST requests. Other values are directories where the
+	// envelopes are written as files. Default is empty (disabled).
+	Sink string `toml:"sink" json:"sink"`
+
+	// KeyFile is the PEM-encoded PKCS #8 private key (Ed25519 or ECDSA) to sign statements.
+	// This is required if Sink is specified.
+	KeyFile string `toml:"key_file" json:"key_file"`
+}
+
+// EncryptionConfig is configuration for decrypting layers encrypted by ocicrypt.
+type EncryptionConfig struct {
+	// DecryptionKeys are the keys to decrypt layers, in the format of the "--key" flag of
+	// ctr (e.g. "/path/to/private.pem", "/path/to/private.pem:password" or
+	// "provider:<name>"). Encrypted layers can't be lazily pulled if no key is specified.
+	// Default is empty.
+	DecryptionKeys []string `toml:"decryption_keys" json:"decryption_keys"`
 }
 
 // DirectoryCacheConfig is configuration for the disk-based cache.
@@ -150,6 +565,33 @@ type DirectoryCacheConfig struct {
 
 	// FadvDontNeed forcefully clean fscache pagecache for saving memory. Default is false.
 	FadvDontNeed bool `toml:"fadv_dontneed" json:"fadv_dontneed"`
+
+	// SeedDir is a cache directory synced from another node (e.g. with "ctr-remote cache sync").
+	// Contents of layers missed in the cache are read from this directory. Default is empty.
+	SeedDir string `toml:"seed_dir" json:"seed_dir"`
+
+	// WriteBackSize is the max bytes of cached data kept on memory until written to the cache
+	// directory in background. This keeps prefetch from stalling on slow disks. Default is 0 (disabled).
+	WriteBackSize int64 `toml:"write_back_size" json:"write_back_size"`
+
+	// IOUring reads cached contents with io_uring so that concurrent reads are submitted to the kernel
+	// in batches. Contents are read without io_uring if it's unavailable. Default is false.
+	IOUring bool `toml:"io_uring" json:"io_uring"`
+
+	// DirectIOSize is the minimal size of cached contents read with O_DIRECT, bypassing the page cache.
+	// Contents served through FUSE are already cached by the kernel so this avoids caching large chunks
+	// twice. Contents are read without O_DIRECT if the filesystem doesn't support it. Default is 0 (disabled).
+	DirectIOSize int64 `toml:"direct_io_size" json:"direct_io_size"`
+
+	// Compress caches the decompressed contents of layers compressed again with zstd, saving the
+	// disk at the cost of the CPU to decompress them on each read. FUSE passthrough isn't used
+	// for the layers cached compressed. Default is false.
+	Compress bool `toml:"compress" json:"compress"`
+
+	// CompressByImage overrides Compress for the images whose references without the tag and
+	// the digest (e.g. "ghcr.io/org/app") match the glob patterns (path.Match). The longest
+	// matching pattern is used. Default is empty.
+	CompressByImage map[string]bool `toml:"compress_by_image" json:"compress_by_image"`
 }
 
 // FuseConfig is configuration for FUSE fs.
@@ -168,4 +610,13 @@ type FuseConfig struct {
 
 	// MergeWorkerCount is the number of workers to merge chunks for passthrough mode. Default is 10.
 	MergeWorkerCount int `toml:"merge_worker_count" default:"10" json:"merge_worker_count"`
+
+	// MaxBatchBufferSize is the max size of the buffer (in bytes) of a batch of chunks merged for
+	// passthrough mode. Batches larger than this are split to bound the memory used for merging
+	// huge files on small nodes. Default is 0 (MergeBufferSize).
+	MaxBatchBufferSize int64 `toml:"max_batch_buffer_size" json:"max_batch_buffer_size"`
+
+	// MaxBatchBufferSizeByHost overrides MaxBatchBufferSize for the layers pulled from the
+	// registry hosts (e.g. "ghcr.io").
+	MaxBatchBufferSizeByHost map[string]int64 `toml:"max_batch_buffer_size_by_host" json:"max_batch_buffer_size_by_host"`
 }
@@ -0,0 +1,118 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package config
+
+import (
+	"fmt"
+	"path"
+)
+
+// BuiltinProfiles are the profiles available without defining them in Config.Profiles.
+var BuiltinProfiles = map[string]ProfileConfig{
+	// Fetches everything the images may read as early as possible.
+	"aggressive": {
+		PrefetchList:         true,
+		PrefetchDependencies: true,
+	},
+
+	// Prefetches the listed files and doesn't fetch files never read by containers in
+	// background.
+	"balanced": {
+		PrefetchList: true,
+		SkipVolumes:  true,
+		SkipShadowed: true,
+	},
+
+	// Fetches only the metadata (TOC) of the layers on mount and the contents on read.
+	"metadata-only": {
+		NoPrefetch:        true,
+		NoBackgroundFetch: true,
+	},
+}
+
+// ProfileMatcher selects the profiles of images by Config.ProfileByImage.
+type ProfileMatcher struct {
+	defaultProfile ProfileConfig
+	names          map[string]string // profile names keyed by the patterns
+	profiles       map[string]ProfileConfig
+}
+
+// NewProfileMatcher returns the matcher of the profiles of cfg. Images not selected by
+// ProfileByImage use the profile made of the params of cfg.
+func NewProfileMatcher(cfg Config) (*ProfileMatcher, error) {
+	m := &ProfileMatcher{
+		defaultProfile: ProfileConfig{
+			PrefetchSize:         cfg.PrefetchSize,
+			NoPrefetch:           cfg.NoPrefetch,
+			PrefetchList:         cfg.PrefetchList,
+			PrefetchDependencies: cfg.PrefetchDependencies,
+			NoBackgroundFetch:    cfg.NoBackgroundFetch,
+			SkipVolumes:          cfg.BackgroundFetchConfig.SkipVolumes,
+			SkipShadowed:         cfg.BackgroundFetchConfig.SkipShadowed,
+			CompressCache:        cfg.DirectoryCacheConfig.Compress,
+		},
+		names:    cfg.ProfileByImage,
+		profiles: make(map[string]ProfileConfig),
+	}
+	for p, name := range cfg.ProfileByImage {
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("invalid image pattern %q of profile: %w", p, err)
+		}
+		prof, ok := cfg.Profiles[name]
+		if !ok {
+			if prof, ok = BuiltinProfiles[name]; !ok {
+				return nil, fmt.Errorf("unknown profile %q for image pattern %q", name, p)
+			}
+		}
+		m.profiles[name] = prof
+	}
+	return m, nil
+}
+
+// Match returns the profile of the image of the locator (the reference without the tag and
+// the digest) and its name. The name is empty for the profile made of the params of Config.
+func (m *ProfileMatcher) Match(locator string) (name string, prof ProfileConfig) {
+	if m == nil {
+		return "", ProfileConfig{}
+	}
+	longest := -1
+	for p, n := range m.names {
+		if ok, _ := path.Match(p, locator); ok && len(p) > longest {
+			name, longest = n, len(p)
+		}
+	}
+	if name == "" {
+		return "", m.defaultProfile
+	}
+	return name, m.profiles[name]
+}
+
+// Any returns true if f returns true for any profile that the matcher can select.
+func (m *ProfileMatcher) Any(f func(ProfileConfig) bool) bool {
+	if m == nil {
+		return false
+	}
+	if f(m.defaultProfile) {
+		return true
+	}
+	for _, prof := range m.profiles {
+		if f(prof) {
+			return true
+		}
+	}
+	return false
+}
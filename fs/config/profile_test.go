@@ -0,0 +1,81 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package config
+
+import "testing"
+
+func TestProfileMatcher(t *testing.T) {
+	cfg := Config{
+		PrefetchSize: 100,
+		Profiles: map[string]ProfileConfig{
+			"custom":   {PrefetchSize: 10},
+			"balanced": {NoBackgroundFetch: true}, // replaces the built-in one
+		},
+		ProfileByImage: map[string]string{
+			"ghcr.io/org/*":    "metadata-only",
+			"ghcr.io/org/app":  "custom",
+			"ghcr.io/*/batch":  "aggressive",
+			"docker.io/*/*":    "balanced",
+			"registry.local/*": "custom",
+		},
+	}
+	cfg.DirectoryCacheConfig.Compress = true
+	m, err := NewProfileMatcher(cfg)
+	if err != nil {
+		t.Fatalf("failed to make matcher: %v", err)
+	}
+	for locator, want := range map[string]string{
+		"ghcr.io/org/db":           "metadata-only",
+		"ghcr.io/org/app":          "custom", // the longest pattern is used
+		"ghcr.io/team/batch":       "aggressive",
+		"docker.io/library/ubuntu": "balanced",
+		"quay.io/org/app":          "",
+	} {
+		name, prof := m.Match(locator)
+		if name != want {
+			t.Errorf("profile of %q = %q; want %q", locator, name, want)
+			continue
+		}
+		var wantProf ProfileConfig
+		switch name {
+		case "":
+			wantProf = ProfileConfig{PrefetchSize: 100, CompressCache: true}
+		case "custom", "balanced":
+			wantProf = cfg.Profiles[name]
+		default:
+			wantProf = BuiltinProfiles[name]
+		}
+		if prof != wantProf {
+			t.Errorf("profile %q of %q = %+v; want %+v", name, locator, prof, wantProf)
+		}
+	}
+	if !m.Any(func(p ProfileConfig) bool { return p.PrefetchDependencies }) {
+		t.Errorf("aggressive profile must be selectable")
+	}
+	if m.Any(func(p ProfileConfig) bool { return p.SkipShadowed }) {
+		t.Errorf("built-in balanced profile must be replaced")
+	}
+
+	for _, byImage := range []map[string]string{
+		{"[": "balanced"},
+		{"ghcr.io/*": "unknown"},
+	} {
+		if _, err := NewProfileMatcher(Config{ProfileByImage: byImage}); err == nil {
+			t.Errorf("profiles %v must be rejected", byImage)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package encryption provides on-demand decryption of layers encrypted by ocicrypt.
+//
+// ocicrypt encrypts the layer blob with AES-256 in CTR mode so the keystream of any
+// offset of the blob can be computed from the symmetric key and the nonce. This allows
+// decrypting arbitrary ranges (e.g. the footer, the TOC and the chunks of eStargz)
+// fetched from the registry without reading the entire blob. Note that the HMAC recorded
+// by ocicrypt covers the entire blob and can't be checked on partial reads. The integrity
+// of lazily read contents is ensured by the TOC digest and the chunk digests instead.
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/containers/ocicrypt"
+	"github.com/containers/ocicrypt/blockcipher"
+	"github.com/containers/ocicrypt/config"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	// AnnotationPrefix is the prefix of the annotations of encrypted layers.
+	AnnotationPrefix = "org.opencontainers.image.enc."
+
+	pubOptsAnnotation = AnnotationPrefix + "pubopts"
+	nonceOpt          = "nonce"
+)
+
+// IsEncrypted returns true if the layer has keys wrapped by ocicrypt.
+func IsEncrypted(desc ocispec.Descriptor) bool {
+	return len(ocicrypt.GetWrappedKeysMap(desc)) > 0
+}
+
+// Decrypter decrypts arbitrary ranges of a layer encrypted by ocicrypt.
+type Decrypter struct {
+	block cipher.Block
+	nonce []byte
+}
+
+// NewDecrypter unwraps the symmetric key of the layer with the keys in dc and returns the
+// decrypter of the layer.
+func NewDecrypter(dc *config.DecryptConfig, desc ocispec.Descriptor) (*Decrypter, error) {
+	if dc == nil {
+		return nil, errors.New("no decryption key is configured")
+	}
+	var pub blockcipher.PublicLayerBlockCipherOptions
+	if s, ok := desc.Annotations[pubOptsAnnotation]; ok {
+		b, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode public options: %w", err)
+		}
+		if err := json.Unmarshal(b, &pub); err != nil {
+			return nil, fmt.Errorf("failed to parse public options: %w", err)
+		}
+	}
+	if pub.CipherType != blockcipher.AES256CTR {
+		return nil, fmt.Errorf("unsupported cipher %q", pub.CipherType)
+	}
+	priv, err := unwrapKey(dc, desc)
+	if err != nil {
+		return nil, err
+	}
+	opts := blockcipher.LayerBlockCipherOptions{Public: pub, Private: *priv}
+	nonce, ok := opts.GetOpt(nonceOpt)
+	if !ok || len(nonce) != aes.BlockSize {
+		return nil, fmt.Errorf("invalid nonce of the layer")
+	}
+	if len(priv.SymmetricKey) != 32 {
+		return nil, fmt.Errorf("invalid key size %d", len(priv.SymmetricKey))
+	}
+	block, err := aes.NewCipher(priv.SymmetricKey)
+	if err != nil {
+		return nil, err
+	}
+	return &Decrypter{block: block, nonce: nonce}, nil
+}
+
+// unwrapKey tries the key wrappers recorded in the annotations and returns the private
+// options containing the symmetric key.
+func unwrapKey(dc *config.DecryptConfig, desc ocispec.Descriptor) (*blockcipher.PrivateLayerBlockCipherOptions, error) {
+	var errs []error
+	for scheme, b64s := range ocicrypt.GetWrappedKeysMap(desc) {
+		kw := ocicrypt.GetKeyWrapper(scheme)
+		if kw == nil || kw.NoPossibleKeys(dc.Parameters) {
+			continue
+		}
+		for _, b64 := range strings.Split(b64s, ",") {
+			wrapped, err := base64.StdEncoding.DecodeString(b64)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: failed to decode wrapped key: %w", scheme, err))
+				continue
+			}
+			optsData, err := kw.UnwrapKey(dc, wrapped)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", scheme, err))
+				continue
+			}
+			var priv blockcipher.PrivateLayerBlockCipherOptions
+			if err := json.Unmarshal(optsData, &priv); err != nil {
+				return nil, fmt.Errorf("failed to parse private options: %w", err)
+			}
+			return &priv, nil
+		}
+	}
+	if len(errs) == 0 {
+		return nil, errors.New("no key can be used for decrypting the layer")
+	}
+	return nil, fmt.Errorf("failed to unwrap the key of the layer: %w", errors.Join(errs...))
+}
+
+// Decrypt decrypts p in place. p is the contents of the encrypted blob at offset.
+func (d *Decrypter) Decrypt(p []byte, offset int64) {
+	if len(p) == 0 {
+		return
+	}
+	stream := cipher.NewCTR(d.block, counterAt(d.nonce, uint64(offset)/aes.BlockSize))
+	if skip := offset % aes.BlockSize; skip > 0 {
+		var discard [aes.BlockSize]byte
+		stream.XORKeyStream(discard[:skip], discard[:skip])
+	}
+	stream.XORKeyStream(p, p)
+}
+
+// counterAt returns the counter block of the n-th block of the stream. The counter is the
+// nonce incremented as a 128-bit big-endian integer, as done by cipher.NewCTR.
+func counterAt(nonce []byte, n uint64) []byte {
+	hi := binary.BigEndian.Uint64(nonce[:8])
+	lo := binary.BigEndian.Uint64(nonce[8:])
+	if lo+n < lo {
+		hi++
+	}
+	lo += n
+	iv := make([]byte, aes.BlockSize)
+	binary.BigEndian.PutUint64(iv[:8], hi)
+	binary.BigEndian.PutUint64(iv[8:], lo)
+	return iv
+}
@@ -0,0 +1,138 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package encryption
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"testing"
+
+	"github.com/containers/ocicrypt"
+	"github.com/containers/ocicrypt/config"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestDecrypt(t *testing.T) {
+	privKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKeyDER, err := x509.MarshalPKIXPublicKey(&privKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKey := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubKeyDER})
+	privKeyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privKey)})
+
+	plain := make([]byte, 100000)
+	if _, err := rand.Read(plain); err != nil {
+		t.Fatal(err)
+	}
+	desc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayerGzip,
+		Digest:    digest.FromBytes(plain),
+		Size:      int64(len(plain)),
+	}
+
+	cc, err := config.EncryptWithJwe([][]byte{pubKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	encR, fin, err := ocicrypt.EncryptLayer(cc.EncryptConfig, bytes.NewReader(plain), desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc, err := io.ReadAll(encR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	annotations, err := fin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	encDesc := ocispec.Descriptor{
+		MediaType:   desc.MediaType + "+encrypted",
+		Digest:      digest.FromBytes(enc),
+		Size:        int64(len(enc)),
+		Annotations: annotations,
+	}
+	if !IsEncrypted(encDesc) {
+		t.Fatalf("encrypted layer must be detected")
+	}
+	if IsEncrypted(desc) {
+		t.Fatalf("plain layer must not be detected as encrypted")
+	}
+
+	if _, err := NewDecrypter(nil, encDesc); err == nil {
+		t.Fatalf("decrypter must not be created without keys")
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherDC, err := config.DecryptWithPrivKeys([][]byte{pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(otherKey)})}, [][]byte{nil})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewDecrypter(otherDC.DecryptConfig, encDesc); err == nil {
+		t.Fatalf("decrypter must not be created with a wrong key")
+	}
+
+	dc, err := config.DecryptWithPrivKeys([][]byte{privKeyPEM}, [][]byte{nil})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := NewDecrypter(dc.DecryptConfig, encDesc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range []struct {
+		offset int64
+		size   int64
+	}{
+		{0, int64(len(enc))},
+		{0, 1},
+		{15, 2},
+		{16, 16},
+		{1000, 4097},
+		{99999, 1},
+		{12345, 54321},
+	} {
+		p := make([]byte, r.size)
+		copy(p, enc[r.offset:])
+		d.Decrypt(p, r.offset)
+		if !bytes.Equal(p, plain[r.offset:r.offset+r.size]) {
+			t.Errorf("unexpected contents at offset %d (size %d)", r.offset, r.size)
+		}
+	}
+}
+
+func TestCounterAt(t *testing.T) {
+	nonce := bytes.Repeat([]byte{0xff}, 16)
+	nonce[0] = 0
+	nonce[7] = 0
+	got := counterAt(nonce, 2)
+	want := []byte{0, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 1, 0, 0, 0, 0, 0, 0, 0, 1}
+	if !bytes.Equal(got, want) {
+		t.Errorf("counterAt = %x; want %x", got, want)
+	}
+}
@@ -39,24 +39,35 @@ package fs
 import (
 	"context"
 	"fmt"
+	"maps"
+	"path"
+	"slices"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	ctdevents "github.com/containerd/containerd/v2/core/events"
 	"github.com/containerd/containerd/v2/core/remotes/docker"
 	"github.com/containerd/containerd/v2/pkg/reference"
 	"github.com/containerd/log"
 	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/containerd/stargz-snapshotter/events"
+	"github.com/containerd/stargz-snapshotter/fs/attestation"
 	"github.com/containerd/stargz-snapshotter/fs/config"
 	"github.com/containerd/stargz-snapshotter/fs/layer"
+	"github.com/containerd/stargz-snapshotter/fs/metacopy"
 	commonmetrics "github.com/containerd/stargz-snapshotter/fs/metrics/common"
 	layermetrics "github.com/containerd/stargz-snapshotter/fs/metrics/layer"
+	"github.com/containerd/stargz-snapshotter/fs/reader"
 	"github.com/containerd/stargz-snapshotter/fs/remote"
 	"github.com/containerd/stargz-snapshotter/fs/source"
+	"github.com/containerd/stargz-snapshotter/fs/tuning"
 	"github.com/containerd/stargz-snapshotter/metadata"
 	memorymetadata "github.com/containerd/stargz-snapshotter/metadata/memory"
 	"github.com/containerd/stargz-snapshotter/snapshot"
 	"github.com/containerd/stargz-snapshotter/task"
+	"github.com/containerd/stargz-snapshotter/util/cacheutil"
 	metrics "github.com/docker/go-metrics"
 	fusefs "github.com/hanwen/go-fuse/v2/fs"
 	"github.com/hanwen/go-fuse/v2/fuse"
@@ -68,8 +79,26 @@ import (
 const (
 	defaultFuseTimeout    = time.Second
 	defaultMaxConcurrency = 2
+
+	// prefetchListTTL is the duration to reuse the prefetch list of an image among its layers.
+	prefetchListTTL = 10 * time.Minute
+
+	// prefetchListFetchTimeout is the timeout of fetching the prefetch list of an image.
+	prefetchListFetchTimeout = 30 * time.Second
+
+	// dependenciesTTL is the duration to share the dependencies of an image among its layers.
+	dependenciesTTL = 10 * time.Minute
+
+	// imageVolumesTTL is the duration to reuse the volumes of an image among its layers.
+	imageVolumesTTL = 10 * time.Minute
+
+	// imageConfigFetchTimeout is the timeout of fetching the config of an image.
+	imageConfigFetchTimeout = 30 * time.Second
 )
 
+// defaultTmpfsPaths are the paths where runtimes usually mount tmpfs and pseudo filesystems.
+var defaultTmpfsPaths = []string{"dev", "proc", "run", "sys", "tmp"}
+
 var (
 	nsLock = sync.Mutex{}
 
@@ -82,10 +111,20 @@ type Option func(*options)
 type options struct {
 	getSources              source.GetSources
 	resolveHandlers         map[string]remote.Handler
+	chunkSources            map[string]reader.ChunkSource
+	chunkTransformers       []layer.ChunkTransformerRegistration
+	readHooks               reader.ReadHooks
 	metadataStore           metadata.Store
 	metricsLogLevel         *log.Level
 	overlayOpaqueType       layer.OverlayOpaqueType
 	additionalDecompressors func(context.Context, source.RegistryHosts, reference.Spec, ocispec.Descriptor) []metadata.Decompressor
+	eventPublisher          ctdevents.Publisher
+	metacopyStore           string
+	tuner                   *tuning.Tuner
+	quiescer                *Quiescer
+	localityReporter        *LocalityReporter
+	mountRestarter          *MountRestarter
+	statusReporter          *StatusReporter
 }
 
 func WithGetSources(s source.GetSources) Option {
@@ -103,6 +142,35 @@ func WithResolveHandler(name string, handler remote.Handler) Option {
 	}
 }
 
+// WithChunkSource registers a source of chunks (e.g. peer nodes or a remote cache) tried
+// when a chunk isn't in the local cache. The order of sources is configured by the name.
+func WithChunkSource(name string, src reader.ChunkSource) Option {
+	return func(opts *options) {
+		if opts.chunkSources == nil {
+			opts.chunkSources = make(map[string]reader.ChunkSource)
+		}
+		opts.chunkSources[name] = src
+	}
+}
+
+// WithChunkTransformer registers a transformer of the chunks read from the blobs of the
+// layers (e.g. decryption, custom encodings or auditing). The layers are selected by the
+// media types and annotations of the registration. Transformers are applied in the order
+// of registration.
+func WithChunkTransformer(t layer.ChunkTransformerRegistration) Option {
+	return func(opts *options) {
+		opts.chunkTransformers = append(opts.chunkTransformers, t)
+	}
+}
+
+// WithReadHooks specifies the hooks called on reads of the files of the mounted layers (e.g.
+// for exporting metrics of the reads).
+func WithReadHooks(hooks reader.ReadHooks) Option {
+	return func(opts *options) {
+		opts.readHooks = hooks
+	}
+}
+
 func WithMetadataStore(metadataStore metadata.Store) Option {
 	return func(opts *options) {
 		opts.metadataStore = metadataStore
@@ -127,6 +195,33 @@ func WithAdditionalDecompressors(d func(context.Context, source.RegistryHosts, r
 	}
 }
 
+// WithEventPublisher specifies the publisher of the events of lazily pulled layers
+// (e.g. resolved, prefetch-complete). See the events package for the published events.
+func WithEventPublisher(p ctdevents.Publisher) Option {
+	return func(opts *options) {
+		opts.eventPublisher = p
+	}
+}
+
+// WithMetacopyStore enables generating the metadata-only lower of each fully fetched
+// layer next to the mountpoint (see metacopy.MetadataDir). The contents of the files are
+// stored in the data-only lower directory specified by store, which is shared among
+// layers. This requires background fetch to be enabled.
+func WithMetacopyStore(store string) Option {
+	return func(opts *options) {
+		opts.metacopyStore = store
+	}
+}
+
+// WithTuner specifies the tuner of the params of fetching layer contents so they can be
+// changed at runtime (e.g. through the admin API). The params of the tuner are
+// initialized with the configuration of the filesystem.
+func WithTuner(t *tuning.Tuner) Option {
+	return func(opts *options) {
+		opts.tuner = t
+	}
+}
+
 func NewFilesystem(root string, cfg config.Config, opts ...Option) (_ snapshot.FileSystem, err error) {
 	var fsOpts options
 	for _, o := range opts {
@@ -159,7 +254,26 @@ func NewFilesystem(root string, cfg config.Config, opts ...Option) (_ snapshot.F
 		})
 	}
 	tm := task.NewBackgroundTaskManager(maxConcurrency, 5*time.Second)
-	r, err := layer.NewResolver(root, tm, cfg, fsOpts.resolveHandlers, metadataStore, fsOpts.overlayOpaqueType, fsOpts.additionalDecompressors)
+	params := tuning.Params{
+		MaxConcurrency:           maxConcurrency,
+		PrefetchChunkSize:        cfg.PrefetchChunkSize,
+		BandwidthLimit:           cfg.BandwidthLimit,
+		BackgroundBandwidthLimit: cfg.BackgroundBandwidthLimit,
+	}
+	tuner := fsOpts.tuner
+	if tuner == nil {
+		tuner = tuning.New()
+	}
+	if _, err := tuner.Apply(params.Update()); err != nil {
+		return nil, fmt.Errorf("invalid fetch params: %w", err)
+	}
+	tuner.Watch(func(p tuning.Params) { tm.SetConcurrency(p.MaxConcurrency) })
+	r, err := layer.NewResolver(root, tm, cfg, fsOpts.resolveHandlers, metadataStore, fsOpts.overlayOpaqueType, fsOpts.additionalDecompressors,
+		layer.WithResolverTuner(tuner),
+		layer.WithResolverChunkSources(fsOpts.chunkSources),
+		layer.WithResolverChunkTransformers(fsOpts.chunkTransformers),
+		layer.WithResolverReadHooks(fsOpts.readHooks),
+	)
 	if err != nil {
 		return nil, fmt.Errorf("failed to setup resolver: %w", err)
 	}
@@ -180,30 +294,97 @@ func NewFilesystem(root string, cfg config.Config, opts ...Option) (_ snapshot.F
 		metricsCtr = layermetrics.NewLayerMetrics(ns)
 	}
 
-	return &filesystem{
+	profiles, err := config.NewProfileMatcher(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	var prefetchLists *cacheutil.TTLCache
+	if profiles.Any(func(p config.ProfileConfig) bool { return p.PrefetchList }) {
+		prefetchLists = cacheutil.NewTTLCache(prefetchListTTL)
+	}
+
+	var dependencies *cacheutil.TTLCache
+	if profiles.Any(func(p config.ProfileConfig) bool { return p.PrefetchDependencies }) {
+		dependencies = cacheutil.NewTTLCache(dependenciesTTL)
+	}
+
+	var imageVolumes *cacheutil.TTLCache
+	tmpfsPaths := cfg.BackgroundFetchConfig.TmpfsPaths
+	if profiles.Any(func(p config.ProfileConfig) bool { return p.SkipVolumes }) {
+		imageVolumes = cacheutil.NewTTLCache(imageVolumesTTL)
+		if len(tmpfsPaths) == 0 {
+			tmpfsPaths = defaultTmpfsPaths
+		}
+	}
+
+	var attester *attestation.Attester
+	if ac := cfg.AttestationConfig; ac.Sink != "" {
+		if ac.KeyFile == "" {
+			return nil, fmt.Errorf("key file must be specified for attestation")
+		}
+		signer, err := attestation.LoadSigner(ac.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load attestation key: %w", err)
+		}
+		sink, err := attestation.NewSink(ac.Sink)
+		if err != nil {
+			return nil, fmt.Errorf("failed to setup attestation sink: %w", err)
+		}
+		attester = attestation.New(signer, sink)
+	}
+
+	fs := &filesystem{
 		resolver:              r,
 		getSources:            getSources,
-		prefetchSize:          cfg.PrefetchSize,
-		noprefetch:            cfg.NoPrefetch,
-		noBackgroundFetch:     cfg.NoBackgroundFetch,
+		profiles:              profiles,
 		debug:                 cfg.Debug,
 		layer:                 make(map[string]layer.Layer),
+		labels:                make(map[string]map[string]string),
 		backgroundTaskManager: tm,
 		allowNoVerification:   cfg.AllowNoVerification,
 		disableVerification:   cfg.DisableVerification,
 		metricsController:     metricsCtr,
 		attrTimeout:           attrTimeout,
 		entryTimeout:          entryTimeout,
-	}, nil
+		eventPublisher:        fsOpts.eventPublisher,
+		metacopyStore:         fsOpts.metacopyStore,
+		prefetchLists:         prefetchLists,
+		dependencies:          dependencies,
+		imageVolumes:          imageVolumes,
+		tmpfsPaths:            tmpfsPaths,
+		attester:              attester,
+		statusReporter:        fsOpts.statusReporter,
+	}
+	r.SetOutageHandler(fs.publishOutage)
+	if fsOpts.quiescer != nil {
+		fsOpts.quiescer.set(fs)
+	}
+	if fsOpts.localityReporter != nil {
+		fsOpts.localityReporter.set(fs)
+	}
+	if fsOpts.mountRestarter != nil {
+		fsOpts.mountRestarter.set(fs)
+	}
+	if fsOpts.statusReporter != nil {
+		fsOpts.statusReporter.set(fs, root)
+	}
+	if sc := cfg.CacheScrubConfig; sc.IntervalSec > 0 {
+		samples := sc.SampleChunks
+		if samples <= 0 {
+			samples = defaultScrubSampleChunks
+		}
+		go fs.runCacheScrubber(time.Duration(sc.IntervalSec)*time.Second, samples)
+	}
+	return fs, nil
 }
 
 type filesystem struct {
 	resolver              *layer.Resolver
-	prefetchSize          int64
-	noprefetch            bool
-	noBackgroundFetch     bool
+	profiles              *config.ProfileMatcher
 	debug                 bool
 	layer                 map[string]layer.Layer
+	labels                map[string]map[string]string // labels of the layers keyed by the mountpoint
 	layerMu               sync.Mutex
 	backgroundTaskManager *task.BackgroundTaskManager
 	allowNoVerification   bool
@@ -212,6 +393,15 @@ type filesystem struct {
 	metricsController     *layermetrics.Controller
 	attrTimeout           time.Duration
 	entryTimeout          time.Duration
+	eventPublisher        ctdevents.Publisher
+	metacopyStore         string
+	tmpfsPaths            []string
+	images                map[digest.Digest]*mountedImage
+	prefetchLists         *cacheutil.TTLCache   // nil if prefetch lists are disabled
+	dependencies          *cacheutil.TTLCache   // nil if dependency prefetch is disabled
+	imageVolumes          *cacheutil.TTLCache   // nil if volumes aren't skipped by background fetch
+	attester              *attestation.Attester // nil if attestation is disabled
+	statusReporter        *StatusReporter       // nil if the status isn't reported
 }
 
 func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[string]string) (retErr error) {
@@ -224,6 +414,9 @@ func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[s
 	fs.backgroundTaskManager.DoPrioritizedTask()
 	defer fs.backgroundTaskManager.DonePrioritizedTask()
 	ctx = log.WithLogger(ctx, log.G(ctx).WithField("mountpoint", mountpoint))
+	defer func() {
+		fs.statusReporter.recordError("mount", mountpoint, "", retErr)
+	}()
 
 	// Get source information of this layer.
 	src, err := fs.getSources(labels)
@@ -233,10 +426,13 @@ func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[s
 		return fmt.Errorf("source must be passed")
 	}
 
-	defaultPrefetchSize := fs.prefetchSize
+	profileName, prof := fs.profiles.Match(src[0].Name.Locator)
+	if profileName != "" {
+		ctx = log.WithLogger(ctx, log.G(ctx).WithField("profile", profileName))
+	}
 	if psStr, ok := labels[config.TargetPrefetchSizeLabel]; ok {
 		if ps, err := strconv.ParseInt(psStr, 10, 64); err == nil {
-			defaultPrefetchSize = ps
+			prof.PrefetchSize = ps
 		}
 	}
 
@@ -244,14 +440,16 @@ func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[s
 	var (
 		resultChan = make(chan layer.Layer)
 		errChan    = make(chan error)
+		resolved   source.Source // the source the layer is resolved from; set before sending to resultChan
 	)
 	go func() {
 		rErr := fmt.Errorf("failed to resolve target")
 		for _, s := range src {
 			l, err := fs.resolver.Resolve(ctx, s.Hosts, s.Name, s.Target)
 			if err == nil {
+				resolved = s
 				resultChan <- l
-				fs.prefetch(ctx, l, defaultPrefetchSize, start)
+				fs.prefetch(ctx, mountpoint, l, s, prof, start)
 				return
 			}
 			rErr = fmt.Errorf("failed to resolve layer %q from %q: %v: %w", s.Target.Digest, s.Name, err, rErr)
@@ -270,7 +468,7 @@ func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[s
 				log.G(ctx).WithError(err).Debug("failed to pre-resolve")
 				return
 			}
-			fs.prefetch(ctx, l, defaultPrefetchSize, start)
+			fs.prefetch(ctx, "", l, preResolve, prof, start)
 
 			// Release this layer because this isn't target and we don't use it anymore here.
 			// However, this will remain on the resolver cache until eviction.
@@ -335,6 +533,8 @@ func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[s
 	// Register the mountpoint layer
 	fs.layerMu.Lock()
 	fs.layer[mountpoint] = l
+	fs.labels[mountpoint] = maps.Clone(labels)
+	fs.addImage(mountpoint, resolved)
 	fs.layerMu.Unlock()
 	fs.metricsController.Add(mountpoint, l)
 
@@ -358,7 +558,31 @@ func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[s
 	}
 
 	go server.Serve()
-	return server.WaitMount()
+	if err := server.WaitMount(); err != nil {
+		return err
+	}
+	events.Publish(ctx, fs.eventPublisher, events.TopicResolved, &events.LayerResolved{
+		Mountpoint: mountpoint,
+		Ref:        resolved.Name.String(),
+		Digest:     digest.String(),
+		Size:       l.Info().Size,
+	})
+	if fs.metacopyStore != "" && !prof.NoBackgroundFetch {
+		go func() {
+			// Avoids to get canceled by client.
+			ctx := log.WithLogger(context.Background(), log.G(ctx))
+			if err := fs.backgroundFetch(ctx, l, resolved, prof); err != nil {
+				log.G(ctx).WithError(err).Debug("skipped generating metadata-only lower")
+				return
+			}
+			if err := metacopy.Generate(mountpoint, metacopy.MetadataDir(mountpoint), fs.metacopyStore); err != nil {
+				log.G(ctx).WithError(err).Warn("failed to generate metadata-only lower")
+				return
+			}
+			log.G(ctx).Debug("generated metadata-only lower")
+		}()
+	}
+	return nil
 }
 
 func (fs *filesystem) Check(ctx context.Context, mountpoint string, labels map[string]string) error {
@@ -385,12 +609,22 @@ func (fs *filesystem) Check(ctx context.Context, mountpoint string, labels map[s
 		// Check the blob connectivity and try to refresh the connection on failure
 		if err := fs.check(ctx, l, labels); err != nil {
 			log.G(ctx).WithError(err).Warn("check failed")
+			fs.statusReporter.recordError("check", mountpoint, l.Info().Digest, err)
+			events.Publish(ctx, fs.eventPublisher, events.TopicDegraded, &events.Degraded{
+				Mountpoint: mountpoint,
+				Digest:     l.Info().Digest.String(),
+				Error:      err.Error(),
+			})
 			return err
 		}
 	}
 
 	// Wait for prefetch compeletion
-	if !fs.noprefetch {
+	var locator string
+	if src, err := fs.getSources(labels); err == nil && len(src) > 0 {
+		locator = src[0].Name.Locator
+	}
+	if _, prof := fs.profiles.Match(locator); !prof.NoPrefetch {
 		if err := l.WaitForPrefetchCompletion(); err != nil {
 			log.G(ctx).WithError(err).Warn("failed to sync with prefetch completion")
 		}
@@ -399,6 +633,20 @@ func (fs *filesystem) Check(ctx context.Context, mountpoint string, labels map[s
 	return nil
 }
 
+// publishOutage publishes the change of the availability of the registry serving the blob
+// of dgst. This is called once for each change.
+func (fs *filesystem) publishOutage(dgst digest.Digest, unavailable bool, since time.Time, err error) {
+	ev := &events.Outage{
+		Digest:      dgst.String(),
+		Unavailable: unavailable,
+		Since:       since,
+	}
+	if err != nil {
+		ev.Error = err.Error()
+	}
+	events.Publish(context.Background(), fs.eventPublisher, events.TopicOutage, ev)
+}
+
 func (fs *filesystem) check(ctx context.Context, l layer.Layer, labels map[string]string) error {
 	err := l.Check()
 	if err == nil {
@@ -407,6 +655,11 @@ func (fs *filesystem) check(ctx context.Context, l layer.Layer, labels map[strin
 	log.G(ctx).WithError(err).Warn("failed to connect to blob")
 
 	// Check failed. Try to refresh the connection with fresh source information
+	return fs.refresh(ctx, l, labels)
+}
+
+// refresh refreshes the connection of the layer with fresh source information.
+func (fs *filesystem) refresh(ctx context.Context, l layer.Layer, labels map[string]string) error {
 	src, err := fs.getSources(labels)
 	if err != nil {
 		return err
@@ -435,18 +688,9 @@ func (fs *filesystem) Unmount(ctx context.Context, mountpoint string) error {
 	if mountpoint == "" {
 		return fmt.Errorf("mount point must be specified")
 	}
-	fs.layerMu.Lock()
-	l, ok := fs.layer[mountpoint]
-	if !ok {
-		fs.layerMu.Unlock()
-		return fmt.Errorf("specified path %q isn't a mountpoint", mountpoint)
-	}
-	delete(fs.layer, mountpoint)      // unregisters the corresponding layer
-	if err := l.Close(); err != nil { // Cleanup associated resources
-		log.G(ctx).WithError(err).Warn("failed to release resources of the layer")
+	if err := fs.unregister(ctx, mountpoint); err != nil {
+		return err
 	}
-	fs.layerMu.Unlock()
-	fs.metricsController.Remove(mountpoint)
 
 	if err := unmount(mountpoint, 0); err != nil {
 		if err != unix.EBUSY {
@@ -462,6 +706,31 @@ func (fs *filesystem) Unmount(ctx context.Context, mountpoint string) error {
 	return nil
 }
 
+// Flush writes the data of the mounted layers kept in memory by the caches to the cache
+// directories so the layers can be resumed after restart.
+func (fs *filesystem) Flush(ctx context.Context) error {
+	return fs.resolver.Flush(ctx)
+}
+
+// unregister unregisters the layer mounted on mountpoint and releases its resources.
+func (fs *filesystem) unregister(ctx context.Context, mountpoint string) error {
+	fs.layerMu.Lock()
+	l, ok := fs.layer[mountpoint]
+	if !ok {
+		fs.layerMu.Unlock()
+		return fmt.Errorf("specified path %q isn't a mountpoint", mountpoint)
+	}
+	delete(fs.layer, mountpoint) // unregisters the corresponding layer
+	delete(fs.labels, mountpoint)
+	if err := l.Close(); err != nil { // Cleanup associated resources
+		log.G(ctx).WithError(err).Warn("failed to release resources of the layer")
+	}
+	fs.removeImage(mountpoint)
+	fs.layerMu.Unlock()
+	fs.metricsController.Remove(mountpoint)
+	return nil
+}
+
 func unmount(target string, flags int) error {
 	for {
 		if err := unix.Unmount(target, flags); err != unix.EINTR {
@@ -470,23 +739,247 @@ func unmount(target string, flags int) error {
 	}
 }
 
-func (fs *filesystem) prefetch(ctx context.Context, l layer.Layer, defaultPrefetchSize int64, start time.Time) {
+// prefetch starts prefetch and background fetch of the layer following the profile of the
+// image. Events are published only for the layer mounted on mountpoint (i.e. mountpoint
+// isn't empty).
+func (fs *filesystem) prefetch(ctx context.Context, mountpoint string, l layer.Layer, src source.Source, prof config.ProfileConfig, start time.Time) {
 	// Prefetch a layer. The first Check() for this layer waits for the prefetch completion.
-	if !fs.noprefetch {
-		go l.Prefetch(defaultPrefetchSize)
+	if !prof.NoPrefetch {
+		go func() {
+			if prof.PrefetchList {
+				if files := fs.prefetchFiles(ctx, src, l.Info().Digest); len(files) > 0 {
+					if err := l.PrefetchFiles(files); err != nil {
+						log.G(ctx).WithError(err).Warn("failed to prefetch files in prefetch list")
+					}
+				}
+			}
+			err := l.Prefetch(prof.PrefetchSize)
+			if mountpoint != "" {
+				fs.statusReporter.recordError("prefetch", mountpoint, l.Info().Digest, err)
+				ev := &events.PrefetchComplete{Mountpoint: mountpoint, Digest: l.Info().Digest.String()}
+				if err != nil {
+					ev.Error = err.Error()
+				}
+				events.Publish(ctx, fs.eventPublisher, events.TopicPrefetchComplete, ev)
+			}
+			if err == nil && prof.PrefetchDependencies {
+				fs.prefetchDependencies(ctx, src, l)
+			}
+		}()
 	}
 
 	// Fetch whole layer aggressively in background.
-	if !fs.noBackgroundFetch {
+	if !prof.NoBackgroundFetch {
 		go func() {
-			if err := l.BackgroundFetch(); err == nil {
+			err := fs.backgroundFetch(ctx, l, src, prof)
+			if mountpoint != "" {
+				fs.statusReporter.recordError("background_fetch", mountpoint, l.Info().Digest, err)
+			}
+			if fs.attester != nil && mountpoint != "" {
+				info := l.Info()
+				if aErr := fs.attester.Attest(ctx, info.Digest, src.Name.String(), info.TOCDigest, info.Verified, err); aErr != nil {
+					log.G(ctx).WithError(aErr).Warn("failed to attest layer")
+				}
+			}
+			if err == nil {
 				// write log record for the latency between mount start and last on demand fetch
 				commonmetrics.LogLatencyForLastOnDemandFetch(ctx, l.Info().Digest, start, l.Info().ReadTime)
+				if mountpoint != "" {
+					events.Publish(ctx, fs.eventPublisher, events.TopicFullyFetched, &events.FullyFetched{
+						Mountpoint: mountpoint,
+						Digest:     l.Info().Digest.String(),
+						Size:       l.Info().Size,
+					})
+				}
 			}
 		}()
 	}
 }
 
+// prefetchListEntry is the prefetch list of an image shared among the layers of the image.
+type prefetchListEntry struct {
+	once sync.Once
+	list *source.PrefetchList
+}
+
+// prefetchFiles returns the path patterns of the files of the layer listed in the prefetch
+// list of the image. The list is fetched once per image. Failures are logged and ignored
+// because the list is only a hint.
+func (fs *filesystem) prefetchFiles(ctx context.Context, src source.Source, layerDigest digest.Digest) []string {
+	if fs.prefetchLists == nil || src.ManifestDigest == "" {
+		return nil
+	}
+	v, done, _ := fs.prefetchLists.Add(src.ManifestDigest.String(), &prefetchListEntry{})
+	defer done(false)
+	e := v.(*prefetchListEntry)
+	e.once.Do(func() {
+		// Don't get canceled by the client of the mount that fetches the list.
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), prefetchListFetchTimeout)
+		defer cancel()
+		l, err := source.FetchPrefetchList(ctx, src)
+		if err != nil {
+			log.G(ctx).WithError(err).Warnf("failed to fetch prefetch list of %s", src.ManifestDigest)
+			return
+		}
+		e.list = l
+	})
+	return e.list.FilesOf(layerDigest)
+}
+
+// backgroundFetch fetches the layer of the image in background except the files that aren't
+// read through the layer in containers of the image, as enabled by the profile.
+func (fs *filesystem) backgroundFetch(ctx context.Context, l layer.Layer, src source.Source, prof config.ProfileConfig) error {
+	var (
+		skipPaths []string
+		uppers    []*layer.Shadows
+	)
+	if prof.SkipVolumes {
+		skipPaths = fs.backgroundFetchSkipPaths(ctx, src)
+	}
+	if prof.SkipShadowed {
+		uppers = fs.upperShadows(ctx, src, l.Info().Digest)
+	}
+	return l.BackgroundFetch(skipPaths, uppers)
+}
+
+// upperShadows returns the paths hidden by the layers upper than the layer in the image.
+// The upper layers are the layers after the layer in the manifest passed through the labels
+// (see source.FromDefaultLabels), which are resolved if they haven't been. Failures are
+// logged and ignored because the hidden files are fetched anyway.
+func (fs *filesystem) upperShadows(ctx context.Context, src source.Source, layerDigest digest.Digest) (uppers []*layer.Shadows) {
+	i := slices.IndexFunc(src.Manifest.Layers, func(desc ocispec.Descriptor) bool {
+		return desc.Digest == layerDigest
+	})
+	if i < 0 {
+		return nil
+	}
+	// Don't get canceled by the client of the mount that resolves the layers.
+	ctx = context.WithoutCancel(ctx)
+	for _, desc := range src.Manifest.Layers[i+1:] {
+		u, err := fs.resolver.Resolve(ctx, src.Hosts, src.Name, desc)
+		if err != nil {
+			log.G(ctx).WithError(err).Debugf("failed to resolve upper layer %s", desc.Digest)
+			continue
+		}
+		s, err := u.Shadows()
+		u.Done()
+		if err != nil {
+			log.G(ctx).WithError(err).Warnf("failed to get paths hidden by upper layer %s", desc.Digest)
+			continue
+		}
+		if s.Len() > 0 {
+			uppers = append(uppers, s)
+		}
+	}
+	return uppers
+}
+
+// imageVolumesEntry is the volumes of an image shared among the layers of the image.
+type imageVolumesEntry struct {
+	once    sync.Once
+	volumes []string
+}
+
+// backgroundFetchSkipPaths returns the path patterns of the files skipped by the background
+// fetch of the layers of the image: the volumes declared in the image config and the paths
+// where tmpfs is usually mounted. The image config is fetched once per image. Failures are
+// logged and ignored because the files are fetched anyway.
+func (fs *filesystem) backgroundFetchSkipPaths(ctx context.Context, src source.Source) []string {
+	if fs.imageVolumes == nil {
+		return nil
+	}
+	paths := slices.Clone(fs.tmpfsPaths)
+	if src.ManifestDigest == "" {
+		return paths
+	}
+	v, done, _ := fs.imageVolumes.Add(src.ManifestDigest.String(), &imageVolumesEntry{})
+	defer done(false)
+	e := v.(*imageVolumesEntry)
+	e.once.Do(func() {
+		// Don't get canceled by the client of the mount that fetches the config.
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), imageConfigFetchTimeout)
+		defer cancel()
+		config, err := source.FetchImageConfig(ctx, src)
+		if err != nil {
+			log.G(ctx).WithError(err).Warnf("failed to fetch image config of %s", src.ManifestDigest)
+			return
+		}
+		for v := range config.Config.Volumes {
+			if p := strings.Trim(path.Clean("/"+v), "/"); p != "" {
+				e.volumes = append(e.volumes, reader.EscapePathPattern(p))
+			}
+		}
+		slices.Sort(e.volumes)
+	})
+	return append(paths, e.volumes...)
+}
+
+// dependencyEntry is the state of the dependency prefetch of an image shared among the
+// layers of the image.
+type dependencyEntry struct {
+	mu     sync.Mutex
+	layers []layer.Layer
+	wanted []string            // dependencies not found in the layers requiring them
+	seen   map[string]struct{} // elements of wanted
+}
+
+// prefetchDependencies prefetches the dependencies of the executables prefetched from the
+// layer. Dependencies not in the layer are looked up in the other layers of the image and
+// the dependencies of the other layers are looked up in this layer as well, regardless of
+// the order the layers are prefetched.
+func (fs *filesystem) prefetchDependencies(ctx context.Context, src source.Source, l layer.Layer) {
+	if fs.dependencies == nil {
+		return
+	}
+	key := src.ManifestDigest.String()
+	if key == "" {
+		var layers []string
+		for _, desc := range src.Manifest.Layers {
+			layers = append(layers, desc.Digest.String())
+		}
+		key = digest.FromString(strings.Join(layers, ",")).String()
+	}
+	v, done, _ := fs.dependencies.Add(key, &dependencyEntry{seen: make(map[string]struct{})})
+	defer done(false)
+	e := v.(*dependencyEntry)
+
+	// Registering the layer and taking the wanted paths at once makes sure that the paths
+	// added by others are either taken here or asked to this layer by them.
+	e.mu.Lock()
+	e.layers = append(e.layers, l)
+	wanted := slices.Clone(e.wanted)
+	e.mu.Unlock()
+	missing, err := l.PrefetchDependencies(wanted)
+	if err != nil {
+		log.G(ctx).WithError(err).Warn("failed to prefetch dependencies")
+	}
+	for len(missing) > 0 {
+		var added []string
+		e.mu.Lock()
+		for _, p := range missing {
+			if _, ok := e.seen[p]; !ok {
+				e.seen[p] = struct{}{}
+				e.wanted = append(e.wanted, p)
+				added = append(added, p)
+			}
+		}
+		layers := slices.Clone(e.layers)
+		e.mu.Unlock()
+		missing = nil
+		if len(added) == 0 {
+			break
+		}
+		for _, o := range layers {
+			m, err := o.PrefetchDependencies(added)
+			if err != nil {
+				log.G(ctx).WithError(err).Debug("failed to prefetch dependencies in other layer")
+				continue
+			}
+			missing = append(missing, m...)
+		}
+	}
+}
+
 // neighboringLayers returns layer descriptors except the `target` layer in the specified manifest.
 func neighboringLayers(manifest ocispec.Manifest, target ocispec.Descriptor) (descs []ocispec.Descriptor) {
 	for _, desc := range manifest.Layers {
@@ -25,15 +25,20 @@ package fs
 import (
 	"context"
 	"fmt"
+	"slices"
 	"testing"
 	"time"
 
+	ctdevents "github.com/containerd/containerd/v2/core/events"
 	"github.com/containerd/containerd/v2/core/remotes/docker"
 	"github.com/containerd/containerd/v2/pkg/reference"
+	"github.com/containerd/stargz-snapshotter/events"
 	"github.com/containerd/stargz-snapshotter/fs/layer"
+	"github.com/containerd/stargz-snapshotter/fs/reader"
 	"github.com/containerd/stargz-snapshotter/fs/remote"
 	"github.com/containerd/stargz-snapshotter/fs/source"
 	"github.com/containerd/stargz-snapshotter/task"
+	"github.com/containerd/stargz-snapshotter/util/cacheutil"
 	fusefs "github.com/hanwen/go-fuse/v2/fs"
 	digest "github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
@@ -61,13 +66,50 @@ func TestCheck(t *testing.T) {
 	}
 }
 
+type testPublisher chan ctdevents.Event
+
+func (p testPublisher) Publish(ctx context.Context, topic string, event ctdevents.Event) error {
+	if topic == events.TopicOutage {
+		p <- event
+	}
+	return nil
+}
+
+func TestPublishOutage(t *testing.T) {
+	p := make(testPublisher, 1)
+	fs := &filesystem{eventPublisher: p}
+	dgst := digest.FromString("test")
+	since := time.Now()
+	for _, tt := range []struct {
+		unavailable bool
+		err         error
+		want        events.Outage
+	}{
+		{unavailable: true, err: fmt.Errorf("failed"), want: events.Outage{Digest: dgst.String(), Unavailable: true, Since: since, Error: "failed"}},
+		{want: events.Outage{Digest: dgst.String(), Since: since}},
+	} {
+		fs.publishOutage(dgst, tt.unavailable, since, tt.err)
+		select {
+		case ev := <-p:
+			if got := ev.(*events.Outage); *got != tt.want {
+				t.Errorf("event = %+v; want %+v", got, tt.want)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("event isn't published")
+		}
+	}
+}
+
 type breakableLayer struct {
 	success bool
+	digest  digest.Digest
+	scrubs  int
 }
 
 func (l *breakableLayer) Info() layer.Info {
 	return layer.Info{
-		Size: 1,
+		Digest: l.digest,
+		Size:   1,
 	}
 }
 func (l *breakableLayer) RootNode(uint32) (fusefs.InodeEmbedder, error) { return nil, nil }
@@ -78,7 +120,14 @@ func (l *breakableLayer) ReadAt([]byte, int64, ...remote.Option) (int, error) {
 	return 0, fmt.Errorf("fail")
 }
 func (l *breakableLayer) WaitForPrefetchCompletion() error { return fmt.Errorf("fail") }
-func (l *breakableLayer) BackgroundFetch() error           { return fmt.Errorf("fail") }
+func (l *breakableLayer) BackgroundFetch([]string, []*layer.Shadows) error {
+	return fmt.Errorf("fail")
+}
+func (l *breakableLayer) Shadows() (*layer.Shadows, error) { return nil, fmt.Errorf("fail") }
+func (l *breakableLayer) PrefetchFiles([]string) error     { return fmt.Errorf("fail") }
+func (l *breakableLayer) PrefetchDependencies([]string) ([]string, error) {
+	return nil, fmt.Errorf("fail")
+}
 func (l *breakableLayer) Check() error {
 	if !l.success {
 		return fmt.Errorf("failed")
@@ -91,5 +140,109 @@ func (l *breakableLayer) Refresh(ctx context.Context, hosts source.RegistryHosts
 	}
 	return nil
 }
+func (l *breakableLayer) Scrub(samples int) (reader.ScrubResult, error) {
+	l.scrubs++
+	if !l.success {
+		return reader.ScrubResult{}, fmt.Errorf("failed")
+	}
+	return reader.ScrubResult{Checked: samples, Corrupted: 1}, nil
+}
 func (l *breakableLayer) Done()        {}
 func (l *breakableLayer) Close() error { return nil }
+
+// depsLayer is a layer containing files with their dependencies.
+type depsLayer struct {
+	breakableLayer
+	execs   []string            // executables in the prefetched range
+	files   map[string][]string // dependencies of the files in the layer
+	fetched map[string]bool
+}
+
+func (l *depsLayer) PrefetchDependencies(paths []string) (missing []string, _ error) {
+	if l.fetched == nil {
+		l.fetched = make(map[string]bool)
+		for _, e := range l.execs {
+			paths = append(paths, l.files[e]...)
+		}
+	}
+	for len(paths) > 0 {
+		p := paths[0]
+		paths = paths[1:]
+		deps, ok := l.files[p]
+		if !ok {
+			missing = append(missing, p)
+			continue
+		}
+		if !l.fetched[p] {
+			l.fetched[p] = true
+			paths = append(paths, deps...)
+		}
+	}
+	return missing, nil
+}
+
+func TestPrefetchDependencies(t *testing.T) {
+	newLayers := func() (base, app *depsLayer) {
+		base = &depsLayer{files: map[string][]string{
+			"/lib/ld.so":      nil,
+			"/lib/libc.so":    {"/lib/ld.so"},
+			"/lib/libcrypto":  {"/lib/libc.so"},
+			"/usr/bin/python": {"/lib/ld.so", "/lib/libc.so"},
+		}}
+		app = &depsLayer{execs: []string{"/app/server", "/app/run.sh"}, files: map[string][]string{
+			"/app/server": {"/lib/ld.so", "/app/libssl"},
+			"/app/libssl": {"/lib/libcrypto"},
+			"/app/run.sh": {"/usr/bin/python"},
+			"/app/unused": {"/lib/unused"},
+		}}
+		return
+	}
+	src := source.Source{Manifest: ocispec.Manifest{Layers: []ocispec.Descriptor{
+		{Digest: digest.FromString("base")}, {Digest: digest.FromString("app")},
+	}}}
+	for _, order := range []string{"base-first", "app-first"} {
+		t.Run(order, func(t *testing.T) {
+			fs := &filesystem{dependencies: cacheutil.NewTTLCache(time.Minute)}
+			base, app := newLayers()
+			layers := []layer.Layer{base, app}
+			if order == "app-first" {
+				layers = []layer.Layer{app, base}
+			}
+			for _, l := range layers {
+				fs.prefetchDependencies(context.Background(), src, l)
+			}
+			for _, p := range []string{"/lib/ld.so", "/lib/libc.so", "/lib/libcrypto", "/usr/bin/python"} {
+				if !base.fetched[p] {
+					t.Errorf("%q isn't fetched from the base layer", p)
+				}
+			}
+			if !app.fetched["/app/libssl"] {
+				t.Errorf("library isn't fetched from the app layer")
+			}
+			if app.fetched["/app/unused"] {
+				t.Errorf("file not needed by the executables is fetched")
+			}
+		})
+	}
+}
+
+func TestBackgroundFetchSkipPaths(t *testing.T) {
+	src := source.Source{ManifestDigest: digest.FromString("manifest")}
+	fs := &filesystem{}
+	if got := fs.backgroundFetchSkipPaths(context.Background(), src); got != nil {
+		t.Errorf("skipped %v though volumes aren't skipped", got)
+	}
+
+	fs = &filesystem{imageVolumes: cacheutil.NewTTLCache(time.Minute), tmpfsPaths: []string{"tmp"}}
+	// Register the volumes of the image as if the config has been fetched.
+	e := &imageVolumesEntry{volumes: []string{"data"}}
+	e.once.Do(func() {})
+	_, done, _ := fs.imageVolumes.Add(src.ManifestDigest.String(), e)
+	defer done(false)
+	if got, want := fs.backgroundFetchSkipPaths(context.Background(), src), []string{"tmp", "data"}; !slices.Equal(got, want) {
+		t.Errorf("skipped paths = %v; want %v", got, want)
+	}
+	if got, want := fs.backgroundFetchSkipPaths(context.Background(), source.Source{}), []string{"tmp"}; !slices.Equal(got, want) {
+		t.Errorf("skipped paths of image without manifest digest = %v; want %v", got, want)
+	}
+}
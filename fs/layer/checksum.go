@@ -0,0 +1,85 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package layer
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/containerd/stargz-snapshotter/metadata"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// fileChecksum checks the data of a file returned to FUSE against the digest of the whole
+// file recorded in the TOC. The data is hashed only while the file is read from the head
+// without gaps. Reads of the ranges already hashed are ignored. The check is abandoned once
+// a read skips a range.
+type fileChecksum struct {
+	want digest.Digest
+	size int64
+
+	mu       sync.Mutex
+	digester digest.Digester // nil once finished or abandoned
+	next     int64           // offset of the first byte not hashed yet
+}
+
+// newFileChecksum returns a checksum of the file of size bytes read through ra. nil is
+// returned if ra doesn't report a valid digest of the file.
+func newFileChecksum(ra any, size int64) *fileChecksum {
+	fd, ok := ra.(metadata.FileDigester)
+	if !ok || size <= 0 {
+		return nil
+	}
+	want, err := digest.Parse(fd.FileDigest())
+	if err != nil || !want.Algorithm().Available() {
+		return nil
+	}
+	return &fileChecksum{
+		want:     want,
+		size:     size,
+		digester: want.Algorithm().Digester(),
+	}
+}
+
+// update hashes the data p read at offset. done is true if the whole file has been hashed
+// by this call. Then err is non-nil if the file doesn't match the digest.
+func (c *fileChecksum) update(p []byte, offset int64) (done bool, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.digester == nil {
+		return false, nil
+	}
+	end := offset + int64(len(p))
+	if offset > c.next {
+		c.digester = nil // a range is skipped
+		return false, nil
+	}
+	if end <= c.next {
+		return false, nil
+	}
+	c.digester.Hash().Write(p[c.next-offset:])
+	c.next = end
+	if c.next < c.size {
+		return false, nil
+	}
+	got := c.digester.Digest()
+	c.digester = nil
+	if c.next > c.size || got != c.want {
+		return true, fmt.Errorf("file of %d bytes returned as %d bytes of digest %q; want %q", c.size, c.next, got, c.want)
+	}
+	return true, nil
+}
@@ -0,0 +1,97 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package layer
+
+import (
+	"context"
+	"path"
+	"sync"
+
+	"github.com/containerd/log"
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/containerd/stargz-snapshotter/metadata"
+)
+
+// prefetchCoverage is the prefetch coverage of a layer verified against the TOC.
+type prefetchCoverage struct {
+	once     sync.Once
+	coverage *estargz.PrefetchCoverage // nil if unknown
+}
+
+// prefetchCoverage returns the prefetch coverage recorded to the annotation of the layer at
+// the conversion. nil is returned if the layer doesn't have the annotation or the annotation
+// doesn't match the TOC. The TOC is walked only once.
+func (l *layer) prefetchCoverage() *estargz.PrefetchCoverage {
+	l.coverage.once.Do(func() {
+		s, ok := l.desc.Annotations[estargz.PrefetchCoverageAnnotation]
+		if !ok {
+			return
+		}
+		ctx := log.WithLogger(context.Background(), log.G(context.Background()).WithField("digest", l.desc.Digest))
+		want, err := estargz.ParsePrefetchCoverage(s)
+		if err != nil {
+			log.G(ctx).WithError(err).Warn("invalid prefetch coverage annotation")
+			return
+		}
+		got, err := metadataPrefetchCoverage(l.verifiableReader.Metadata())
+		if err != nil {
+			log.G(ctx).WithError(err).Warn("failed to calculate prefetch coverage")
+			return
+		}
+		if got != want {
+			log.G(ctx).Warnf("prefetch coverage annotation %q doesn't match the TOC (%q)", want, got)
+			return
+		}
+		l.coverage.coverage = &got
+	})
+	return l.coverage.coverage
+}
+
+// metadataPrefetchCoverage calculates the prefetch coverage of the layer of the metadata in
+// the same way as estargz.Blob.PrefetchCoverage.
+func metadataPrefetchCoverage(r metadata.Reader) (c estargz.PrefetchCoverage, _ error) {
+	landmark := int64(-1) // nothing is prefetched without the landmark
+	if _, _, err := r.GetChild(r.RootID(), estargz.NoPrefetchLandmark); err != nil {
+		if id, _, err := r.GetChild(r.RootID(), estargz.PrefetchLandmark); err == nil {
+			if landmark, err = r.GetOffset(id); err != nil {
+				return c, err
+			}
+		}
+	}
+	seen := make(map[uint32]struct{}) // hardlinks are counted once
+	var err error
+	if wErr := walkPaths(r, r.RootID(), "/", 0, func(p string, id uint32, attr metadata.Attr) {
+		if err != nil || !attr.Mode.IsRegular() || (path.Dir(p) == "/" && estargz.IsLandmark(path.Base(p))) {
+			return
+		}
+		if _, ok := seen[id]; ok {
+			return
+		}
+		seen[id] = struct{}{}
+		c.TotalSize += attr.Size
+		if attr.Size == 0 {
+			return
+		}
+		var offset int64
+		if offset, err = r.GetOffset(id); err == nil && offset < landmark {
+			c.PrefetchSize += attr.Size
+		}
+	}); wErr != nil {
+		return c, wErr
+	}
+	return c, err
+}
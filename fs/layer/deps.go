@@ -0,0 +1,263 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package layer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/containerd/log"
+	"github.com/containerd/stargz-snapshotter/fs/reader"
+	"github.com/containerd/stargz-snapshotter/metadata"
+)
+
+const (
+	// maxDependencies is the maximum number of the paths looked up for the dependencies of
+	// the executables of a layer.
+	maxDependencies = 4096
+
+	// maxSymlinkHops is the maximum number of the symlinks followed to look up a path, the
+	// same as Linux.
+	maxSymlinkHops = 40
+
+	// maxWalkDepth is the maximum depth of the directories walked for executables.
+	maxWalkDepth = 256
+)
+
+// commandPaths is the directories commands run through env(1) are looked up in.
+var commandPaths = []string{"/usr/local/sbin", "/usr/local/bin", "/usr/sbin", "/usr/bin", "/sbin", "/bin"}
+
+// dependencies is the state of PrefetchDependencies of a layer.
+type dependencies struct {
+	mu      sync.Mutex
+	scanned bool            // the executables in the prefetched range have been parsed
+	seen    map[string]bool // paths already looked up and whether they are found
+}
+
+// PrefetchDependencies fetches and caches the files the executables in the prefetched range
+// of the layer need to run (i.e. the dynamic linker, the shared libraries and the script
+// interpreters), and the files of paths. The dependencies of the fetched files are fetched
+// as well. Paths of the dependencies not in this layer (e.g. in lower layers of the image)
+// are returned so they can be looked up in the other layers. Each path is looked up once
+// per layer. The contents are parsed only after Verify or SkipVerify is called; before
+// that, only the files of paths are fetched.
+func (l *layer) PrefetchDependencies(paths []string) (missing []string, _ error) {
+	if l.isClosed() {
+		return nil, fmt.Errorf("layer is already closed")
+	}
+	ctx := context.Background()
+	l.deps.mu.Lock()
+	defer l.deps.mu.Unlock()
+	if l.deps.seen == nil {
+		l.deps.seen = make(map[string]bool)
+	}
+
+	var wanted [][]string // each element is the candidates of a dependency in the preferred order
+	if r := l.r; r != nil && !l.deps.scanned {
+		l.deps.scanned = true
+		prefetched := l.prefetchedSize()
+		if err := walkPaths(r.Metadata(), r.Metadata().RootID(), "/", 0, func(p string, id uint32, attr metadata.Attr) {
+			if !attr.Mode.IsRegular() || attr.Mode&0o111 == 0 {
+				return
+			}
+			if offset, err := r.Metadata().GetOffset(id); err != nil || offset >= prefetched {
+				return
+			}
+			l.deps.seen[p] = true
+			wanted = append(wanted, l.parseDependencies(ctx, r, p, id, attr)...)
+		}); err != nil {
+			return nil, fmt.Errorf("failed to walk executables: %w", err)
+		}
+	}
+	for _, p := range paths {
+		wanted = append(wanted, []string{p})
+	}
+
+	for len(wanted) > 0 {
+		var (
+			patterns []string
+			fetched  = make(map[string]uint32)
+		)
+		for _, candidates := range wanted {
+			var unresolved []string
+			for _, c := range candidates {
+				c = path.Clean("/" + c)
+				if found, ok := l.deps.seen[c]; ok {
+					if found {
+						unresolved = nil // fetched for another dependency
+						break
+					}
+					continue // already returned as missing
+				}
+				if len(l.deps.seen) >= maxDependencies {
+					log.G(ctx).Warnf("too many dependencies in layer %v; stop fetching them", l.desc.Digest)
+					return missing, nil
+				}
+				id, resolved, ok := l.lookupPath(c)
+				l.deps.seen[c] = ok
+				if found, done := l.deps.seen[resolved]; done && resolved != c {
+					if found {
+						unresolved = nil
+						break
+					}
+					continue
+				}
+				l.deps.seen[resolved] = ok
+				if ok {
+					fetched[resolved] = id
+					patterns = append(patterns, reader.EscapePathPattern(resolved))
+					unresolved = nil
+					break
+				}
+				unresolved = append(unresolved, resolved)
+			}
+			missing = append(missing, unresolved...)
+		}
+		wanted = nil
+		if len(patterns) == 0 {
+			break
+		}
+		if err := l.PrefetchFiles(patterns); err != nil {
+			return missing, fmt.Errorf("failed to prefetch dependencies: %w", err)
+		}
+		if r := l.r; r != nil {
+			for p, id := range fetched {
+				if attr, err := r.Metadata().GetAttr(id); err == nil {
+					wanted = append(wanted, l.parseDependencies(ctx, r, p, id, attr)...)
+				}
+			}
+		}
+	}
+	return missing, nil
+}
+
+// parseDependencies returns the candidates of the paths of the dependencies of the file.
+func (l *layer) parseDependencies(ctx context.Context, r reader.Reader, p string, id uint32, attr metadata.Attr) (deps [][]string) {
+	ra, err := r.OpenFile(id)
+	if err != nil {
+		log.G(ctx).WithError(err).Debugf("failed to open %q for dependencies", p)
+		return nil
+	}
+	d, err := reader.ParseDependencies(ra, attr.Size)
+	if err != nil {
+		if !errors.Is(err, reader.ErrUnknownExecutableFormat) {
+			log.G(ctx).WithError(err).Debugf("failed to parse dependencies of %q", p)
+		}
+		return nil
+	}
+	if d.Interpreter != "" {
+		deps = append(deps, []string{d.Interpreter})
+	}
+	if d.Command != "" {
+		if strings.Contains(d.Command, "/") {
+			deps = append(deps, []string{d.Command})
+		} else {
+			var candidates []string
+			for _, dir := range commandPaths {
+				candidates = append(candidates, path.Join(dir, d.Command))
+			}
+			deps = append(deps, candidates)
+		}
+	}
+	var dirs []string
+	for _, dir := range d.LibraryPaths {
+		dir = strings.ReplaceAll(strings.ReplaceAll(dir, "${ORIGIN}", "$ORIGIN"), "$ORIGIN", path.Dir(p))
+		if path.IsAbs(dir) && !strings.Contains(dir, "$") {
+			dirs = append(dirs, dir)
+		}
+	}
+	dirs = append(dirs, d.DefaultLibraryPaths...)
+	for _, lib := range d.Libraries {
+		if strings.Contains(lib, "/") {
+			deps = append(deps, []string{lib})
+			continue
+		}
+		var candidates []string
+		for _, dir := range dirs {
+			candidates = append(candidates, path.Join(dir, lib))
+		}
+		deps = append(deps, candidates)
+	}
+	return deps
+}
+
+// lookupPath looks up the regular file of the absolute path in the layer following symlinks.
+// The path rewritten by the symlinks followed is returned as resolved, even if the file
+// isn't found, so it can be looked up in other layers.
+func (l *layer) lookupPath(p string) (id uint32, resolved string, ok bool) {
+	md := l.verifiableReader.Metadata()
+	for range maxSymlinkHops {
+		elems := strings.Split(strings.TrimPrefix(path.Clean("/"+p), "/"), "/")
+		id = md.RootID()
+		followed := false
+		for i, e := range elems {
+			cid, attr, err := md.GetChild(id, e)
+			if err != nil {
+				return 0, path.Clean("/" + p), false
+			}
+			if attr.Mode&os.ModeSymlink != 0 {
+				target := attr.LinkName
+				if !path.IsAbs(target) {
+					target = path.Join("/"+strings.Join(elems[:i], "/"), target)
+				}
+				p = path.Join(target, strings.Join(elems[i+1:], "/"))
+				followed = true
+				break
+			}
+			if i == len(elems)-1 && !attr.Mode.IsRegular() {
+				return 0, path.Clean("/" + p), false
+			}
+			id = cid
+		}
+		if !followed {
+			return id, path.Clean("/" + p), true
+		}
+	}
+	return 0, path.Clean("/" + p), false
+}
+
+// walkPaths calls f for each node under the directory with its absolute path.
+func walkPaths(r metadata.Reader, dirID uint32, dir string, depth int, f func(p string, id uint32, attr metadata.Attr)) error {
+	if depth > maxWalkDepth {
+		return fmt.Errorf("tree is too deep (depth:%d)", depth)
+	}
+	var err error
+	if forErr := r.ForeachChild(dirID, func(name string, id uint32, mode os.FileMode) bool {
+		p := path.Join(dir, name)
+		if mode.IsDir() {
+			if err = walkPaths(r, id, p, depth+1, f); err != nil {
+				return false
+			}
+			return true
+		}
+		attr, aErr := r.GetAttr(id)
+		if aErr != nil {
+			err = aErr
+			return false
+		}
+		f(p, id, attr)
+		return true
+	}); forErr != nil {
+		return forErr
+	}
+	return err
+}
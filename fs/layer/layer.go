@@ -25,27 +25,40 @@ package layer
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"math/rand/v2"
 	"os"
+	"path"
 	"path/filepath"
+	"slices"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/containerd/containerd/v2/pkg/reference"
 	"github.com/containerd/log"
 	"github.com/containerd/stargz-snapshotter/cache"
+	"github.com/containerd/stargz-snapshotter/errdefs"
 	"github.com/containerd/stargz-snapshotter/estargz"
+	esgzexternaltoc "github.com/containerd/stargz-snapshotter/estargz/externaltoc"
 	"github.com/containerd/stargz-snapshotter/estargz/zstdchunked"
 	"github.com/containerd/stargz-snapshotter/fs/config"
+	"github.com/containerd/stargz-snapshotter/fs/encryption"
 	commonmetrics "github.com/containerd/stargz-snapshotter/fs/metrics/common"
 	"github.com/containerd/stargz-snapshotter/fs/reader"
 	"github.com/containerd/stargz-snapshotter/fs/remote"
 	"github.com/containerd/stargz-snapshotter/fs/source"
+	"github.com/containerd/stargz-snapshotter/fs/tuning"
 	"github.com/containerd/stargz-snapshotter/metadata"
 	"github.com/containerd/stargz-snapshotter/task"
 	"github.com/containerd/stargz-snapshotter/util/cacheutil"
+	"github.com/containerd/stargz-snapshotter/util/iouring"
 	"github.com/containerd/stargz-snapshotter/util/namedmutex"
+	ocicryptconfig "github.com/containers/ocicrypt/config"
+	ocicrypthelpers "github.com/containers/ocicrypt/helpers"
 	fusefs "github.com/hanwen/go-fuse/v2/fs"
 	digest "github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
@@ -56,9 +69,46 @@ const (
 	defaultMaxLRUCacheEntry         = 10
 	defaultMaxCacheFds              = 10
 	defaultPrefetchTimeoutSec       = 10
+	defaultModelFetchUnitSize       = 32 << 20 // 32MiB
+	defaultModelCancelGraceMSec     = 1000
+	defaultReadaheadMaxWindowSize   = 4 << 20 // 4MiB
+	defaultIOUringEntries           = 256
 	memoryCacheType                 = "memory"
 )
 
+var defaultModelPatterns = []string{"*.safetensors", "*.gguf"}
+
+const (
+	highFilePriority = 10
+	lowFilePriority  = -10
+)
+
+// defaultFilePriorities prioritizes files likely to be read at startup (shared libraries,
+// scripts and config files) and deprioritizes files rarely read by applications.
+var defaultFilePriorities = map[string]int{
+	"*.so":     highFilePriority,
+	"*.so.*":   highFilePriority,
+	"*.py":     highFilePriority,
+	"*.pyc":    highFilePriority,
+	"*.js":     highFilePriority,
+	"*.jar":    highFilePriority,
+	"*.class":  highFilePriority,
+	"*.json":   highFilePriority,
+	"*.yaml":   highFilePriority,
+	"*.yml":    highFilePriority,
+	"*.conf":   highFilePriority,
+	"*.md":     lowFilePriority,
+	"*.rst":    lowFilePriority,
+	"*.txt":    lowFilePriority,
+	"*.html":   lowFilePriority,
+	"*.a":      lowFilePriority,
+	"*.h":      lowFilePriority,
+	"*.png":    lowFilePriority,
+	"*.jpg":    lowFilePriority,
+	"*.gz":     lowFilePriority,
+	"LICENSE*": lowFilePriority,
+}
+
 // passThroughConfig contains configuration for FUSE passthrough mode
 type passThroughConfig struct {
 	// enable indicates whether to enable FUSE passthrough mode
@@ -85,6 +135,10 @@ type Layer interface {
 	// Refresh refreshes the layer connection.
 	Refresh(ctx context.Context, hosts source.RegistryHosts, refspec reference.Spec, desc ocispec.Descriptor) error
 
+	// Scrub verifies up to samples cached chunks picked at random and removes the
+	// corrupted ones from the cache.
+	Scrub(samples int) (reader.ScrubResult, error)
+
 	// Verify verifies this layer using the passed TOC Digest.
 	// Nop if Verify() or SkipVerify() was already called.
 	Verify(tocDigest digest.Digest) (err error)
@@ -97,15 +151,33 @@ type Layer interface {
 	// the range indicated by these files is respected.
 	Prefetch(prefetchSize int64) error
 
+	// PrefetchFiles fetches and caches the files matching the path patterns. Paths are
+	// matched in the same way as the paths of BackgroundFetchConfig.
+	PrefetchFiles(patterns []string) error
+
+	// PrefetchDependencies fetches and caches the files the executables prefetched from this
+	// layer need to run (e.g. shared libraries and interpreters) and the files of the paths.
+	// The paths of the dependencies not found in this layer are returned.
+	PrefetchDependencies(paths []string) (missing []string, err error)
+
 	// ReadAt reads this layer.
 	ReadAt([]byte, int64, ...remote.Option) (int, error)
 
 	// WaitForPrefetchCompletion waits untils Prefetch completes.
 	WaitForPrefetchCompletion() error
 
-	// BackgroundFetch fetches the entire layer contents to the cache.
+	// BackgroundFetch fetches the entire layer contents to the cache except the files
+	// matching skipPaths (e.g. paths shadowed by volumes) and the files hidden by any of
+	// uppers (see Shadows), which are fetched on demand. Paths are matched in the same way
+	// as the paths of BackgroundFetchConfig.
 	// Fetching contents is done as a background task.
-	BackgroundFetch() error
+	// The fetch runs once and its result is returned to all callers. skipPaths and uppers
+	// of the first call are used.
+	BackgroundFetch(skipPaths []string, uppers []*Shadows) error
+
+	// Shadows returns the paths in lower layers that this layer hides with whiteouts,
+	// opaque directories and files.
+	Shadows() (*Shadows, error)
 
 	// Done releases the reference to this layer. The resources related to this layer will be
 	// discarded sooner or later. Queries after calling this function won't be serviced.
@@ -124,6 +196,11 @@ type Info struct {
 	PrefetchSize int64     // layer prefetch size in bytes
 	ReadTime     time.Time // last time the layer was read
 	TOCDigest    digest.Digest
+	Verified     bool // contents are verified with the TOC digest
+
+	// PrefetchCoverage is the prefetch coverage of the layer recorded at the conversion and
+	// verified against the TOC. nil if unknown.
+	PrefetchCoverage *estargz.PrefetchCoverage
 }
 
 // Resolver resolves the layer location and provieds the handler of that layer.
@@ -135,16 +212,75 @@ type Resolver struct {
 	layerCacheMu            sync.Mutex
 	blobCache               *cacheutil.TTLCache
 	blobCacheMu             sync.Mutex
+	sharedReaders           map[digest.Digest]*sharedReader
+	sharedReadersMu         sync.Mutex
+	chunkSources            []reader.Source
+	chunkTransformers       []ChunkTransformerRegistration
+	chunkIndex              *reader.ChunkIndex
+	fetchLimiter            *reader.FetchLimiter
+	accessTrace             *reader.AccessTrace
+	readHooks               reader.ReadHooks
+	modelMatch              func(name string) bool
+	compressCache           func(locator string) bool
+	resumableCaches         *resumableCaches // nil unless background fetch resumes
+	filePriority            func(name string, attr metadata.Attr) int
+	decryptConfig           *ocicryptconfig.DecryptConfig
 	backgroundTaskManager   *task.BackgroundTaskManager
 	resolveLock             *namedmutex.NamedMutex
 	config                  config.Config
 	metadataStore           metadata.Store
 	overlayOpaqueType       OverlayOpaqueType
 	additionalDecompressors func(context.Context, source.RegistryHosts, reference.Spec, ocispec.Descriptor) []metadata.Decompressor
+	ioURing                 *iouring.Ring
+}
+
+// ResolverOption is an option of NewResolver.
+type ResolverOption func(*resolverOptions)
+
+type resolverOptions struct {
+	tuner             *tuning.Tuner
+	chunkSources      map[string]reader.ChunkSource
+	chunkTransformers []ChunkTransformerRegistration
+	readHooks         reader.ReadHooks
+}
+
+// WithResolverTuner makes the params of fetching layer contents changed at runtime by the
+// tuner.
+func WithResolverTuner(t *tuning.Tuner) ResolverOption {
+	return func(opts *resolverOptions) {
+		opts.tuner = t
+	}
+}
+
+// WithResolverChunkSources specifies the sources of chunks tried when a chunk isn't in the
+// local cache, keyed by the names used in the configuration of the order of the sources.
+func WithResolverChunkSources(sources map[string]reader.ChunkSource) ResolverOption {
+	return func(opts *resolverOptions) {
+		opts.chunkSources = sources
+	}
+}
+
+// WithResolverChunkTransformers specifies the transformers of the chunks read from the
+// blobs of the layers.
+func WithResolverChunkTransformers(transformers []ChunkTransformerRegistration) ResolverOption {
+	return func(opts *resolverOptions) {
+		opts.chunkTransformers = transformers
+	}
+}
+
+// WithResolverReadHooks specifies the hooks called on reads of the files of the layers.
+func WithResolverReadHooks(hooks reader.ReadHooks) ResolverOption {
+	return func(opts *resolverOptions) {
+		opts.readHooks = hooks
+	}
 }
 
 // NewResolver returns a new layer resolver.
-func NewResolver(root string, backgroundTaskManager *task.BackgroundTaskManager, cfg config.Config, resolveHandlers map[string]remote.Handler, metadataStore metadata.Store, overlayOpaqueType OverlayOpaqueType, additionalDecompressors func(context.Context, source.RegistryHosts, reference.Spec, ocispec.Descriptor) []metadata.Decompressor) (*Resolver, error) {
+func NewResolver(root string, backgroundTaskManager *task.BackgroundTaskManager, cfg config.Config, resolveHandlers map[string]remote.Handler, metadataStore metadata.Store, overlayOpaqueType OverlayOpaqueType, additionalDecompressors func(context.Context, source.RegistryHosts, reference.Spec, ocispec.Descriptor) []metadata.Decompressor, opts ...ResolverOption) (*Resolver, error) {
+	var rOpts resolverOptions
+	for _, o := range opts {
+		o(&rOpts)
+	}
 	resolveResultEntryTTL := time.Duration(cfg.ResolveResultEntryTTLSec) * time.Second
 	if resolveResultEntryTTL == 0 {
 		resolveResultEntryTTL = defaultResolveResultEntryTTLSec * time.Second
@@ -177,15 +313,83 @@ func NewResolver(root string, backgroundTaskManager *task.BackgroundTaskManager,
 		log.L.WithField("key", key).Debugf("cleaned up blob")
 	}
 
+	sources, err := orderChunkSources(cfg.ChunkSourceConfig, rOpts.chunkSources)
+	if err != nil {
+		return nil, err
+	}
+
+	modelMatch, err := newModelMatcher(cfg.ModelConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	filePriority, err := newFilePriority(cfg.FilePriorityConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	compressCache, err := newCompressMatcher(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	var decryptConfig *ocicryptconfig.DecryptConfig
+	if keys := cfg.EncryptionConfig.DecryptionKeys; len(keys) > 0 {
+		cc, err := ocicrypthelpers.CreateDecryptCryptoConfig(keys, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load decryption keys: %w", err)
+		}
+		decryptConfig = cc.DecryptConfig
+	}
+
+	var chunkIndex *reader.ChunkIndex
+	if cfg.EnableDeltaLayers || cfg.DedupChunks {
+		chunkIndex = reader.NewChunkIndex()
+	}
+
+	var ioURing *iouring.Ring
+	if cfg.DirectoryCacheConfig.IOUring {
+		ioURing, err = iouring.New(defaultIOUringEntries)
+		if err != nil {
+			log.L.WithError(err).Warn("io_uring is unavailable; reading cached contents without io_uring")
+		}
+	}
+
 	if err := os.MkdirAll(root, 0700); err != nil {
 		return nil, err
 	}
 
+	var resumable *resumableCaches
+	if cfg.BackgroundFetchConfig.Resume && cfg.FSCacheType != memoryCacheType {
+		resumable, err = scanResumableCaches(filepath.Join(root, "fscache"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to find caches to resume: %w", err)
+		}
+	}
+
+	remoteResolver := remote.NewResolver(cfg.BlobConfig, resolveHandlers, rOpts.tuner)
+	if err := remoteResolver.PersistHostConcurrency(filepath.Join(root, "host-concurrency.json")); err != nil {
+		// Limits are learned again from the initial ones.
+		log.L.WithError(err).Warn("failed to load fetch concurrency of hosts")
+	}
+
 	return &Resolver{
 		rootDir:                 root,
-		resolver:                remote.NewResolver(cfg.BlobConfig, resolveHandlers),
+		resolver:                remoteResolver,
 		layerCache:              layerCache,
 		blobCache:               blobCache,
+		sharedReaders:           make(map[digest.Digest]*sharedReader),
+		chunkSources:            sources,
+		chunkTransformers:       rOpts.chunkTransformers,
+		chunkIndex:              chunkIndex,
+		fetchLimiter:            reader.NewFetchLimiter(cfg.GlobalWorkers, cfg.GlobalMaxInflightBytes),
+		accessTrace:             reader.NewAccessTrace(cfg.AccessTraceSize),
+		readHooks:               rOpts.readHooks,
+		modelMatch:              modelMatch,
+		compressCache:           compressCache,
+		resumableCaches:         resumable,
+		filePriority:            filePriority,
+		decryptConfig:           decryptConfig,
 		prefetchTimeout:         prefetchTimeout,
 		backgroundTaskManager:   backgroundTaskManager,
 		config:                  cfg,
@@ -193,12 +397,179 @@ func NewResolver(root string, backgroundTaskManager *task.BackgroundTaskManager,
 		metadataStore:           metadataStore,
 		overlayOpaqueType:       overlayOpaqueType,
 		additionalDecompressors: additionalDecompressors,
+		ioURing:                 ioURing,
 	}, nil
 }
 
-func newCache(root string, cacheType string, cfg config.Config) (cache.BlobCache, error) {
+// SetOutageHandler sets the handler called when the registry serving the blob of a layer
+// becomes unavailable and when it recovers. This must be called before layers are resolved.
+func (r *Resolver) SetOutageHandler(h remote.OutageHandler) {
+	r.resolver.SetOutageHandler(h)
+}
+
+// AccessTrace returns the trace of the chunks read from the files of the layers. nil is
+// returned if the trace is disabled.
+func (r *Resolver) AccessTrace() *reader.AccessTrace {
+	return r.accessTrace
+}
+
+// newModelMatcher returns the function to match the base names of model files or nil if
+// the model serving mode is disabled.
+func newModelMatcher(cfg config.ModelConfig) (func(name string) bool, error) {
+	if !cfg.Enable {
+		return nil, nil
+	}
+	patterns := cfg.Patterns
+	if len(patterns) == 0 {
+		patterns = defaultModelPatterns
+	}
+	for _, p := range patterns {
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("invalid model file pattern %q: %w", p, err)
+		}
+	}
+	return func(name string) bool {
+		for _, p := range patterns {
+			if ok, _ := path.Match(p, name); ok {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+// newCompressMatcher returns the function to tell whether the layers of the image of the
+// locator (the reference without the tag and the digest) are cached compressed. The
+// patterns of CompressByImage take precedence over the profile of the image.
+func newCompressMatcher(cfg config.Config) (func(locator string) bool, error) {
+	for p := range cfg.CompressByImage {
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("invalid image pattern %q of compressed cache: %w", p, err)
+		}
+	}
+	profiles, err := config.NewProfileMatcher(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return func(locator string) bool {
+		_, prof := profiles.Match(locator)
+		compress, longest := prof.CompressCache, -1
+		for p, c := range cfg.CompressByImage {
+			if ok, _ := path.Match(p, locator); ok && len(p) > longest {
+				compress, longest = c, len(p)
+			}
+		}
+		return compress
+	}, nil
+}
+
+// newFilePriority returns the function to get the priority of a file in background fetch
+// or nil if the prioritization is disabled.
+func newFilePriority(cfg config.FilePriorityConfig) (func(name string, attr metadata.Attr) int, error) {
+	if !cfg.Enable {
+		return nil, nil
+	}
+	patterns, executable := cfg.Patterns, cfg.Executable
+	if len(patterns) == 0 {
+		patterns = defaultFilePriorities
+		if executable == 0 {
+			executable = highFilePriority
+		}
+	}
+	for p := range patterns {
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("invalid file priority pattern %q: %w", p, err)
+		}
+	}
+	return func(name string, attr metadata.Attr) int {
+		var (
+			priority int
+			matched  bool
+		)
+		for p, pr := range patterns {
+			if ok, _ := path.Match(p, name); ok && (!matched || pr > priority) {
+				priority, matched = pr, true
+			}
+		}
+		if !matched && attr.Mode&0111 != 0 {
+			return executable
+		}
+		return priority
+	}, nil
+}
+
+// orderChunkSources returns the sources of chunks in the configured order.
+func orderChunkSources(cfg config.ChunkSourceConfig, registered map[string]reader.ChunkSource) ([]reader.Source, error) {
+	order := cfg.Order
+	if len(order) == 0 {
+		for name := range registered {
+			order = append(order, name)
+		}
+		sort.Strings(order)
+		order = append(order, reader.BlobSourceName)
+	}
+	var sources []reader.Source
+	seen := make(map[string]struct{})
+	for _, name := range order {
+		if _, ok := seen[name]; ok {
+			return nil, fmt.Errorf("chunk source %q is specified twice", name)
+		}
+		seen[name] = struct{}{}
+		s := reader.Source{Name: name}
+		if name != reader.BlobSourceName {
+			cs, ok := registered[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown chunk source %q", name)
+			}
+			s.ChunkSource = cs
+		}
+		if rc, ok := cfg.Retry[name]; ok {
+			s.MaxRetries = rc.MaxRetries
+			s.RetryInterval = time.Duration(rc.RetryIntervalMSec) * time.Millisecond
+			s.MaxRetryInterval = time.Duration(rc.MaxRetryIntervalMSec) * time.Millisecond
+		}
+		sources = append(sources, s)
+	}
+	return sources, nil
+}
+
+// ChunkTransformerRegistration is a transformer of the chunks of the layers of the media
+// types or with the annotations.
+type ChunkTransformerRegistration struct {
+	// Transformer transforms the chunks read from the blobs of the matching layers.
+	Transformer reader.ChunkTransformer
+
+	// MediaTypes are the media types of the layers to transform.
+	MediaTypes []string
+
+	// Annotations are the keys of the annotations of the layers to transform.
+	Annotations []string
+}
+
+// match returns true if the layer is of one of the media types or has one of the
+// annotations. The registration without media types and annotations matches all layers.
+func (t ChunkTransformerRegistration) match(desc ocispec.Descriptor) bool {
+	if len(t.MediaTypes) == 0 && len(t.Annotations) == 0 {
+		return true
+	}
+	if slices.Contains(t.MediaTypes, desc.MediaType) {
+		return true
+	}
+	for _, a := range t.Annotations {
+		if _, ok := desc.Annotations[a]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// newCache creates a cache. The directory cache is created on dir, or on a new directory
+// under root if dir is empty, and its directory is returned. If layer is specified, the
+// directory cache records the digest of the layer and uses the entries of the layer in the
+// seed directory. The directory cache reads the cached contents with ring unless it is nil.
+func newCache(root, dir string, cacheType string, cfg config.Config, layer digest.Digest, ring *iouring.Ring) (_ cache.BlobCache, cachePath string, _ error) {
 	if cacheType == memoryCacheType {
-		return cache.NewMemoryCache(), nil
+		return cache.NewMemoryCache(), "", nil
 	}
 
 	dcc := cfg.DirectoryCacheConfig
@@ -224,25 +595,43 @@ func newCache(root string, cacheType string, cfg config.Config) (cache.BlobCache
 	fCache.OnEvicted = func(key string, value any) {
 		value.(*os.File).Close()
 	}
-	// create a cache on an unique directory
-	if err := os.MkdirAll(root, 0700); err != nil {
-		return nil, err
+	cachePath = dir
+	if cachePath == "" {
+		// create a cache on an unique directory
+		if err := os.MkdirAll(root, 0700); err != nil {
+			return nil, "", err
+		}
+		var err error
+		cachePath, err = os.MkdirTemp(root, "")
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to initialize directory cache: %w", err)
+		}
 	}
-	cachePath, err := os.MkdirTemp(root, "")
-	if err != nil {
-		return nil, fmt.Errorf("failed to initialize directory cache: %w", err)
+	var seedDir string
+	if layer != "" {
+		if err := os.WriteFile(filepath.Join(cachePath, cache.LayerFileName), []byte(layer.String()), 0600); err != nil {
+			return nil, "", fmt.Errorf("failed to record layer of directory cache: %w", err)
+		}
+		if dcc.SeedDir != "" {
+			seedDir = cache.LayerDirectory(dcc.SeedDir, layer)
+		}
 	}
-	return cache.NewDirectoryCache(
+	c, err := cache.NewDirectoryCache(
 		cachePath,
 		cache.DirectoryCacheConfig{
-			SyncAdd:      dcc.SyncAdd,
-			DataCache:    dCache,
-			FdCache:      fCache,
-			BufPool:      bufPool,
-			Direct:       dcc.Direct,
-			FadvDontNeed: dcc.FadvDontNeed,
+			SyncAdd:       dcc.SyncAdd,
+			DataCache:     dCache,
+			FdCache:       fCache,
+			BufPool:       bufPool,
+			Direct:        dcc.Direct,
+			FadvDontNeed:  dcc.FadvDontNeed,
+			SeedDirectory: seedDir,
+			WriteBackSize: dcc.WriteBackSize,
+			IOUring:       ring,
+			DirectIOSize:  dcc.DirectIOSize,
 		},
 	)
+	return c, cachePath, err
 }
 
 // Resolve resolves a layer based on the passed layer blob information.
@@ -284,26 +673,127 @@ func (r *Resolver) Resolve(ctx context.Context, hosts source.RegistryHosts, refs
 			blobR.done(true)
 		}
 	}()
+	if encryption.IsEncrypted(desc) {
+		dec, err := encryption.NewDecrypter(r.decryptConfig, desc)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt the layer: %w", err)
+		}
+		blobR = &blobRef{&decryptedBlob{blobR.Blob, dec}, blobR.done}
+	}
+
+	// Get a reader for stargz archive.
+	// Each file's read operation is a prioritized task and all background tasks
+	// will be stopped during the execution so this can avoid being disturbed for
+	// NW traffic by background tasks.
+	br := &prioritizedBlobReader{r.backgroundTaskManager, blobR}
+	sr := io.NewSectionReader(br, 0, blobR.Size())
+
+	// Metadata (e.g. TOC) is read with the timeout of the metadata. This can be read
+	// in background after resolution so isn't canceled with ctx.
+	metaCtx := remote.WithFetchClass(context.WithoutCancel(ctx), remote.FetchClassMetadata)
+	metaSR := io.NewSectionReader(readerAtFunc(func(p []byte, offset int64) (int, error) {
+		return br.ReadAtContext(metaCtx, p, offset)
+	}), 0, blobR.Size())
+
+	// Layers of the same digest (e.g. referred by several images) share the metadata
+	// and the cache. Only the blob is resolved for each reference.
+	vr, release, err := r.cloneSharedReader(desc.Digest, sr)
+	if err != nil {
+		return nil, err
+	}
+	if vr == nil {
+		baseVR, err := r.newReader(ctx, metaSR, hosts, refspec, desc, esgzOpts...)
+		if err != nil {
+			return nil, err
+		}
+		vr, release, err = r.addSharedReader(desc.Digest, baseVR, sr)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Chunks are verified while they're streamed from the registry if the format supports it.
+	// Encrypted blobs aren't verified here because their contents are decrypted later.
+	if vb, ok := blobR.Blob.(remote.VerifiableBlob); ok {
+		if rv, ok := newRegionVerifier(vr.Metadata()); ok {
+			vb.SetRegionVerifier(rv)
+		}
+	}
+
+	// Combine layer information together and cache it.
+	l := newLayer(r, desc, blobR, vr, passThroughConfig{
+		enable:           r.config.PassThrough && !vr.CacheCompressed(),
+		mergeBufferSize:  r.batchBufferSize(refspec.Hostname()),
+		mergeWorkerCount: r.config.MergeWorkerCount,
+	}, r.config.LogFileAccess)
+	l.release = release
+	r.layerCacheMu.Lock()
+	cachedL, done2, added := r.layerCache.Add(name, l)
+	r.layerCacheMu.Unlock()
+	if !added {
+		l.close() // layer already exists in the cache. discrad this.
+	} else if margin := time.Duration(r.config.RenewBeforeExpirySec) * time.Second; margin > 0 {
+		go l.renewBlob(margin)
+	}
+
+	log.G(ctx).Debugf("resolved")
+	return &layerRef{cachedL.(*layer), done2}, nil
+}
 
-	fsCache, err := newCache(filepath.Join(r.rootDir, "fscache"), r.config.FSCacheType, r.config)
+// newRegionVerifier returns a verifier of the regions of the blob that checks chunks against
+// the digests in the metadata. ok is false if the metadata doesn't support it.
+func newRegionVerifier(md metadata.Reader) (_ remote.RegionVerifier, ok bool) {
+	mv, ok := md.(metadata.RangeVerifier)
+	if !ok {
+		return nil, false
+	}
+	return func(offset, size int64) (remote.StreamVerifier, bool) {
+		ranges := mv.VerifiableRanges(offset, size)
+		if len(ranges) == 0 {
+			return nil, false
+		}
+		spans := make([]remote.Span, len(ranges))
+		for i, cr := range ranges {
+			spans[i] = remote.Span{
+				Offset: cr.Offset,
+				Size:   cr.Size,
+				Verify: func(p []byte) error { return mv.VerifyRange(cr, p) },
+			}
+		}
+		return remote.NewSpanVerifier(offset, spans), true
+	}, true
+}
+
+// batchBufferSize returns the size of the buffer of a batch of chunks merged for passthrough
+// mode for the layers pulled from host.
+func (r *Resolver) batchBufferSize(host string) int64 {
+	size := r.config.MergeBufferSize
+	ceiling, ok := r.config.MaxBatchBufferSizeByHost[host]
+	if !ok {
+		ceiling = r.config.MaxBatchBufferSize
+	}
+	if ceiling > 0 && (size <= 0 || ceiling < size) {
+		size = ceiling
+	}
+	return size
+}
+
+// newReader parses the metadata of the layer and creates a reader with a new cache.
+func (r *Resolver) newReader(ctx context.Context, sr *io.SectionReader, hosts source.RegistryHosts, refspec reference.Spec, desc ocispec.Descriptor, esgzOpts ...metadata.Option) (_ *reader.VerifiableReader, retErr error) {
+	resumeDir := r.resumableCaches.take(desc.Digest)
+	fsCache, cachePath, err := newCache(filepath.Join(r.rootDir, "fscache"), resumeDir, r.config.FSCacheType, r.config, desc.Digest, r.ioURing)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create fs cache: %w", err)
 	}
+	if r.compressCache(refspec.Locator) {
+		fsCache = cache.NewCompressedCache(fsCache)
+	}
 	defer func() {
 		if retErr != nil {
 			fsCache.Close()
 		}
 	}()
 
-	// Get a reader for stargz archive.
-	// Each file's read operation is a prioritized task and all background tasks
-	// will be stopped during the execution so this can avoid being disturbed for
-	// NW traffic by background tasks.
-	sr := io.NewSectionReader(readerAtFunc(func(p []byte, offset int64) (n int, err error) {
-		r.backgroundTaskManager.DoPrioritizedTask()
-		defer r.backgroundTaskManager.DonePrioritizedTask()
-		return blobR.ReadAt(p, offset)
-	}), 0, blobR.Size())
 	// define telemetry hooks to measure latency metrics inside estargz package
 	telemetry := metadata.Telemetry{
 		GetFooterLatency: func(start time.Time) {
@@ -317,35 +807,215 @@ func (r *Resolver) Resolve(ctx context.Context, hosts source.RegistryHosts, refs
 		},
 	}
 
-	additionalDecompressors := []metadata.Decompressor{new(zstdchunked.Decompressor)}
+	var zstdchunkedDecompressor metadata.Decompressor = new(zstdchunked.Decompressor)
+	if r.config.DisableZstdChunked {
+		zstdchunkedDecompressor = &disabledDecompressor{zstdchunkedDecompressor, "zstd:chunked", "disable_zstdchunked"}
+	}
+	additionalDecompressors := []metadata.Decompressor{zstdchunkedDecompressor}
 	if r.additionalDecompressors != nil {
-		additionalDecompressors = append(additionalDecompressors, r.additionalDecompressors(ctx, hosts, refspec, desc)...)
+		for _, d := range r.additionalDecompressors(ctx, hosts, refspec, desc) {
+			if _, ok := d.(*esgzexternaltoc.GzipDecompressor); ok && r.config.DisableExternalTOC {
+				d = &disabledDecompressor{d, "eStargz with external TOC", "disable_external_toc"}
+			}
+			additionalDecompressors = append(additionalDecompressors, d)
+		}
+	}
+	metaOpts := append(esgzOpts, metadata.WithTelemetry(&telemetry), metadata.WithDecompressors(additionalDecompressors...))
+	if r.config.CaseInsensitiveLookup {
+		metaOpts = append(metaOpts, metadata.WithCaseInsensitiveLookup())
 	}
-	meta, err := r.metadataStore(sr,
-		append(esgzOpts, metadata.WithTelemetry(&telemetry), metadata.WithDecompressors(additionalDecompressors...))...)
+	meta, err := r.metadataStore(sr, metaOpts...)
 	if err != nil {
+		// Report only the disabled format instead of errors of all formats.
+		var fErr *FormatDisabledError
+		if errors.As(err, &fErr) {
+			return nil, fErr
+		}
 		return nil, err
 	}
-	vr, err := reader.NewReader(meta, fsCache, desc.Digest)
+	readerOpts := []reader.Option{reader.WithSources(r.chunkSources...)}
+	if r.resumableCaches != nil && cachePath != "" {
+		progress, err := openCacheProgress(cachePath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load progress of background fetch: %w", err)
+		}
+		if resumeDir != "" {
+			log.G(ctx).WithField("chunks", progress.size()).Infof("resuming cache of the previous run in %q", resumeDir)
+		}
+		readerOpts = append(readerOpts, reader.WithCacheProgress(progress))
+	}
+	var transformers []reader.ChunkTransformer
+	for _, t := range r.chunkTransformers {
+		if t.match(desc) {
+			transformers = append(transformers, t.Transformer)
+		}
+	}
+	if len(transformers) > 0 {
+		readerOpts = append(readerOpts, reader.WithChunkTransformers(transformers...))
+	}
+	if r.chunkIndex != nil {
+		readerOpts = append(readerOpts, reader.WithChunkIndex(r.chunkIndex))
+		if r.config.DedupChunks {
+			readerOpts = append(readerOpts, reader.WithChunkDedup())
+		}
+		if r.config.VerifyCachedChunks {
+			readerOpts = append(readerOpts, reader.WithVerifyCachedChunks())
+		}
+	}
+	if r.config.StrictEOF {
+		readerOpts = append(readerOpts, reader.WithStrictEOF())
+	}
+	if fc := r.config.FetchConcurrencyConfig; fc.Workers > 0 || fc.MaxInflightBytes > 0 {
+		readerOpts = append(readerOpts, reader.WithFetchConcurrency(fc.Workers, fc.MaxInflightBytes))
+	}
+	if r.fetchLimiter != nil {
+		readerOpts = append(readerOpts, reader.WithFetchLimiter(r.fetchLimiter))
+	}
+	if r.accessTrace != nil {
+		readerOpts = append(readerOpts, reader.WithAccessTrace(r.accessTrace))
+	}
+	if r.readHooks != nil {
+		readerOpts = append(readerOpts, reader.WithReadHooks(r.readHooks))
+	}
+	if rc := r.config.ReadaheadConfig; rc.Enable {
+		maxWindow := rc.MaxWindowSize
+		if maxWindow <= 0 {
+			maxWindow = defaultReadaheadMaxWindowSize
+		}
+		readerOpts = append(readerOpts, reader.WithReadahead(maxWindow))
+	}
+	if r.modelMatch != nil {
+		unitSize := r.config.ModelConfig.FetchUnitSize
+		if unitSize <= 0 {
+			unitSize = defaultModelFetchUnitSize
+		}
+		readerOpts = append(readerOpts, reader.WithModelFiles(r.modelMatch, unitSize))
+		if mc := r.config.ModelConfig; mc.CancelOnClose {
+			grace := defaultModelCancelGraceMSec
+			if mc.CancelGraceMSec > 0 {
+				grace = mc.CancelGraceMSec
+			}
+			readerOpts = append(readerOpts, reader.WithCancelOnClose(time.Duration(grace)*time.Millisecond))
+		}
+	}
+	if n := r.config.AsyncVerifyWorkers; n > 0 {
+		readerOpts = append(readerOpts, reader.WithAsyncVerify(n))
+	}
+	if n := r.config.SubChunkFetchSize; n > 0 {
+		readerOpts = append(readerOpts, reader.WithSubChunkFetch(n))
+	}
+	if n := r.config.OpenFileCacheSize; n > 0 {
+		readerOpts = append(readerOpts, reader.WithOpenFileCache(n))
+	}
+	vr, err := reader.NewReader(meta, fsCache, desc.Digest, readerOpts...)
 	if err != nil {
+		meta.Close()
 		return nil, fmt.Errorf("failed to read layer: %w", err)
 	}
+	if r.chunkIndex != nil {
+		// This waits for the metadata parsed in background so doesn't block the mount.
+		go func() {
+			if err := vr.RefBaseChunks(); err != nil {
+				log.G(ctx).WithError(err).Warn("failed to refer to chunks stored in the base layer")
+			}
+		}()
+	}
+	return vr, nil
+}
 
-	// Combine layer information together and cache it.
-	l := newLayer(r, desc, blobR, vr, passThroughConfig{
-		enable:           r.config.PassThrough,
-		mergeBufferSize:  r.config.MergeBufferSize,
-		mergeWorkerCount: r.config.MergeWorkerCount,
-	}, r.config.LogFileAccess)
-	r.layerCacheMu.Lock()
-	cachedL, done2, added := r.layerCache.Add(name, l)
-	r.layerCacheMu.Unlock()
-	if !added {
-		l.close() // layer already exists in the cache. discrad this.
+// sharedReader is a reader of a layer whose metadata and cache are shared by the layers
+// of the same digest.
+type sharedReader struct {
+	vr   *reader.VerifiableReader
+	refs int
+}
+
+// cloneSharedReader returns a clone of the shared reader of the specified digest. If no
+// layer of that digest is resolved, this returns nil. The returned func must be called
+// when the clone is no longer used.
+func (r *Resolver) cloneSharedReader(dgst digest.Digest, sr *io.SectionReader) (*reader.VerifiableReader, func(), error) {
+	r.sharedReadersMu.Lock()
+	defer r.sharedReadersMu.Unlock()
+	s, ok := r.sharedReaders[dgst]
+	if !ok {
+		return nil, nil, nil
+	}
+	vr, err := s.vr.Clone(sr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to clone reader: %w", err)
+	}
+	s.refs++
+	return vr, r.releaseSharedReaderFunc(dgst, s), nil
+}
+
+// addSharedReader registers vr as the shared reader of the specified digest and returns
+// its clone. If another reader of the same digest has been registered in the meantime,
+// vr is discarded and the registered one is used instead.
+func (r *Resolver) addSharedReader(dgst digest.Digest, vr *reader.VerifiableReader, sr *io.SectionReader) (*reader.VerifiableReader, func(), error) {
+	r.sharedReadersMu.Lock()
+	s, ok := r.sharedReaders[dgst]
+	if ok {
+		vr.Close()
+	} else {
+		s = &sharedReader{vr: vr}
+		r.sharedReaders[dgst] = s
 	}
+	r.sharedReadersMu.Unlock()
+	return r.cloneSharedReader(dgst, sr)
+}
 
-	log.G(ctx).Debugf("resolved")
-	return &layerRef{cachedL.(*layer), done2}, nil
+func (r *Resolver) releaseSharedReaderFunc(dgst digest.Digest, s *sharedReader) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			r.sharedReadersMu.Lock()
+			defer r.sharedReadersMu.Unlock()
+			if s.refs--; s.refs > 0 {
+				return
+			}
+			if r.sharedReaders[dgst] == s {
+				delete(r.sharedReaders, dgst)
+			}
+			if err := s.vr.Close(); err != nil {
+				log.L.WithField("digest", dgst).WithError(err).Warnf("failed to close shared reader")
+			}
+		})
+	}
+}
+
+// Flush writes the data kept in memory by the caches of the resolved layers (e.g. in
+// write-back mode) to the cache directories so they can be resumed after restart. This
+// returns when all of them are written or ctx is done.
+func (r *Resolver) Flush(ctx context.Context) error {
+	r.sharedReadersMu.Lock()
+	vrs := make(map[digest.Digest]*reader.VerifiableReader, len(r.sharedReaders))
+	for dgst, s := range r.sharedReaders {
+		vrs[dgst] = s.vr
+	}
+	r.sharedReadersMu.Unlock()
+
+	errCh := make(chan error, len(vrs))
+	for dgst, vr := range vrs {
+		go func() {
+			if err := vr.Flush(); err != nil {
+				errCh <- fmt.Errorf("failed to flush cache of layer %q: %w", dgst, err)
+				return
+			}
+			errCh <- nil
+		}()
+	}
+	var errs []error
+	for range vrs {
+		select {
+		case err := <-errCh:
+			if err != nil {
+				errs = append(errs, err)
+			}
+		case <-ctx.Done():
+			return errors.Join(append(errs, fmt.Errorf("failed to wait for flushing caches: %w", ctx.Err()))...)
+		}
+	}
+	return errors.Join(errs...)
 }
 
 // resolveBlob resolves a blob based on the passed layer blob information.
@@ -367,7 +1037,7 @@ func (r *Resolver) resolveBlob(ctx context.Context, hosts source.RegistryHosts,
 		r.blobCacheMu.Unlock()
 	}
 
-	httpCache, err := newCache(filepath.Join(r.rootDir, "httpcache"), r.config.HTTPCacheType, r.config)
+	httpCache, _, err := newCache(filepath.Join(r.rootDir, "httpcache"), "", r.config.HTTPCacheType, r.config, "", r.ioURing)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create http cache: %w", err)
 	}
@@ -405,6 +1075,7 @@ func newLayer(
 		blob:             blob,
 		verifiableReader: vr,
 		prefetchWaiter:   newWaiter(),
+		renewDone:        make(chan struct{}),
 		passThrough:      pth,
 		logFileAccess:    logFileAccess,
 	}
@@ -417,16 +1088,27 @@ type layer struct {
 	verifiableReader *reader.VerifiableReader
 	prefetchWaiter   *waiter
 
+	// release releases the metadata and the cache shared with other layers.
+	release func()
+
 	prefetchSize   int64
 	prefetchSizeMu sync.Mutex
 
-	r reader.Reader
+	r        reader.Reader
+	verified atomic.Bool
 
 	closed   bool
 	closedMu sync.Mutex
 
+	renewDone chan struct{} // closed when the layer is closed to stop renewBlob
+
+	deps     dependencies
+	coverage prefetchCoverage
+	shadows  shadowsState
+
 	prefetchOnce        sync.Once
 	backgroundFetchOnce sync.Once
+	backgroundFetchErr  error // result of the background fetch shared among callers
 	passThrough         passThroughConfig
 	logFileAccess       bool
 }
@@ -443,6 +1125,9 @@ func (l *layer) Info() Info {
 		PrefetchSize: l.prefetchedSize(),
 		ReadTime:     readTime,
 		TOCDigest:    l.verifiableReader.Metadata().TOCDigest(),
+		Verified:     l.verified.Load(),
+
+		PrefetchCoverage: l.prefetchCoverage(),
 	}
 }
 
@@ -460,6 +1145,13 @@ func (l *layer) Check() error {
 	return l.blob.Check()
 }
 
+func (l *layer) Scrub(samples int) (reader.ScrubResult, error) {
+	if l.isClosed() {
+		return reader.ScrubResult{}, fmt.Errorf("layer is already closed")
+	}
+	return l.verifiableReader.Scrub(samples)
+}
+
 func (l *layer) Refresh(ctx context.Context, hosts source.RegistryHosts, refspec reference.Spec, desc ocispec.Descriptor) error {
 	if l.isClosed() {
 		return fmt.Errorf("layer is already closed")
@@ -475,6 +1167,7 @@ func (l *layer) Verify(tocDigest digest.Digest) (err error) {
 		return nil
 	}
 	l.r, err = l.verifiableReader.VerifyTOC(tocDigest)
+	l.verified.Store(err == nil)
 	return
 }
 
@@ -511,7 +1204,14 @@ func (l *layer) prefetch(ctx context.Context, prefetchSize int64) error {
 	if l.isClosed() {
 		return fmt.Errorf("layer is already closed")
 	}
+	if l.resolver.modelMatch != nil && l.resolver.config.ModelConfig.PrefetchIndex && l.r != nil {
+		// Model indexes are small but needed first by model servers.
+		if err := reader.PrefetchModelIndexes(l.r, l.resolver.modelMatch); err != nil {
+			log.G(ctx).WithError(err).Warn("failed to prefetch model indexes")
+		}
+	}
 	rootID := l.verifiableReader.Metadata().RootID()
+	var tiers []int64 // end offsets of prefetch tiers
 	if _, _, err := l.verifiableReader.Metadata().GetChild(rootID, estargz.NoPrefetchLandmark); err == nil {
 		// do not prefetch this layer
 		return nil
@@ -522,10 +1222,14 @@ func (l *layer) prefetch(ctx context.Context, prefetchSize int64) error {
 		}
 		// override the prefetch size with optimized value
 		prefetchSize = offset
+		if tiers, err = l.prefetchTiers(); err != nil {
+			return err
+		}
 	} else if prefetchSize > l.blob.Size() {
 		// adjust prefetch size not to exceed the whole layer size
 		prefetchSize = l.blob.Size()
 	}
+	tiers = append(tiers, prefetchSize)
 
 	threshold := l.resolver.config.PrefetchAsyncSize
 	if threshold > 0 && prefetchSize > threshold {
@@ -537,9 +1241,61 @@ func (l *layer) prefetch(ctx context.Context, prefetchSize int64) error {
 		l.prefetchWaiter.done()
 	}
 
+	// Fetch tiers in order
+	var begin int64
+	for i, end := range tiers {
+		if err := l.prefetchRange(ctx, begin, end, l.prefetchTierConcurrency(i)); err != nil {
+			return err
+		}
+		begin = end
+		if i == 0 && len(tiers) > 1 {
+			// The first tier contains files needed to start the container. Allow
+			// container run while prefetching the rest tiers in background.
+			l.prefetchWaiter.done()
+		}
+	}
+
+	return nil
+}
+
+// prefetchTiers returns the end offsets of the prefetch tiers except the last one,
+// which ends at the prefetch landmark.
+func (l *layer) prefetchTiers() (tiers []int64, _ error) {
+	md := l.verifiableReader.Metadata()
+	for i := 0; ; i++ {
+		id, _, err := md.GetChild(md.RootID(), estargz.PrefetchTierLandmark(i))
+		if err != nil {
+			return tiers, nil
+		}
+		offset, err := md.GetOffset(id)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get offset of prefetch tier landmark %d: %w", i, err)
+		}
+		tiers = append(tiers, offset)
+	}
+}
+
+// prefetchTierConcurrency returns the maximum number of concurrent fetches for the i-th
+// prefetch tier.
+func (l *layer) prefetchTierConcurrency(i int) int {
+	c := l.resolver.config.PrefetchTierConcurrency
+	if len(c) == 0 {
+		return 0
+	}
+	return c[min(i, len(c)-1)]
+}
+
+// prefetchRange fetches and caches the range of the layer in [begin, end).
+func (l *layer) prefetchRange(ctx context.Context, begin, end int64, concurrency int) error {
+	if end <= begin {
+		return nil
+	}
+
 	// Fetch the target range
 	downloadStart := time.Now()
-	err := l.blob.Cache(0, prefetchSize)
+	err := l.blob.Cache(begin, end-begin,
+		remote.WithContext(remote.WithFetchClass(ctx, remote.FetchClassPrefetch)),
+		remote.WithConcurrency(concurrency))
 	commonmetrics.WriteLatencyLogValue(ctx, l.desc.Digest, commonmetrics.PrefetchDownload, downloadStart) // time to download prefetch data
 
 	if err != nil {
@@ -548,13 +1304,13 @@ func (l *layer) prefetch(ctx context.Context, prefetchSize int64) error {
 
 	// Set prefetch size for metrics after prefetch completed
 	l.prefetchSizeMu.Lock()
-	l.prefetchSize = prefetchSize
+	l.prefetchSize = end
 	l.prefetchSizeMu.Unlock()
 
 	// Cache uncompressed contents of the prefetched range
 	decompressStart := time.Now()
 	err = l.verifiableReader.Cache(reader.WithFilter(func(offset int64) bool {
-		return offset < prefetchSize // Cache only prefetch target
+		return begin <= offset && offset < end // Cache only prefetch target
 	}))
 	commonmetrics.WriteLatencyLogValue(ctx, l.desc.Digest, commonmetrics.PrefetchDecompress, decompressStart) // time to decompress prefetch data
 	if err != nil {
@@ -564,6 +1320,21 @@ func (l *layer) prefetch(ctx context.Context, prefetchSize int64) error {
 	return nil
 }
 
+func (l *layer) PrefetchFiles(patterns []string) error {
+	if l.isClosed() {
+		return fmt.Errorf("layer is already closed")
+	}
+	ctx := context.Background()
+	l.resolver.backgroundTaskManager.DoPrioritizedTask()
+	defer l.resolver.backgroundTaskManager.DonePrioritizedTask()
+	defer commonmetrics.WriteLatencyLogValue(ctx, l.desc.Digest, commonmetrics.PrefetchDecompress, time.Now())
+	fetchCtx := remote.WithFetchClass(ctx, remote.FetchClassPrefetch)
+	br := io.NewSectionReader(readerAtFunc(func(p []byte, offset int64) (int, error) {
+		return l.blob.ReadAt(p, offset, remote.WithContext(fetchCtx))
+	}), 0, l.blob.Size())
+	return l.verifiableReader.Cache(reader.WithReader(br), reader.WithPathFilter(patterns))
+}
+
 func (l *layer) WaitForPrefetchCompletion() error {
 	if l.isClosed() {
 		return fmt.Errorf("layer is already closed")
@@ -571,20 +1342,20 @@ func (l *layer) WaitForPrefetchCompletion() error {
 	return l.prefetchWaiter.wait(l.resolver.prefetchTimeout)
 }
 
-func (l *layer) BackgroundFetch() (err error) {
+func (l *layer) BackgroundFetch(skipPaths []string, uppers []*Shadows) error {
 	l.backgroundFetchOnce.Do(func() {
 		ctx := context.Background()
-		err = l.backgroundFetch(ctx)
-		if err != nil {
-			log.G(ctx).WithError(err).Warnf("failed to fetch whole layer=%v", l.desc.Digest)
+		l.backgroundFetchErr = l.backgroundFetch(ctx, skipPaths, uppers)
+		if l.backgroundFetchErr != nil {
+			log.G(ctx).WithError(l.backgroundFetchErr).Warnf("failed to fetch whole layer=%v", l.desc.Digest)
 			return
 		}
 		log.G(ctx).Debug("completed to fetch all layer data in background")
 	})
-	return
+	return l.backgroundFetchErr
 }
 
-func (l *layer) backgroundFetch(ctx context.Context) error {
+func (l *layer) backgroundFetch(ctx context.Context, skipPaths []string, uppers []*Shadows) error {
 	defer commonmetrics.WriteLatencyLogValue(ctx, l.desc.Digest, commonmetrics.BackgroundFetchTotal, time.Now())
 	if l.isClosed() {
 		return fmt.Errorf("layer is already closed")
@@ -593,20 +1364,56 @@ func (l *layer) backgroundFetch(ctx context.Context) error {
 		l.resolver.backgroundTaskManager.InvokeBackgroundTask(func(ctx context.Context) {
 			// Measuring the time to download background fetch data (in milliseconds)
 			defer commonmetrics.MeasureLatencyInMilliseconds(commonmetrics.BackgroundFetchDownload, l.Info().Digest, time.Now()) // time to download background fetch data
+			fetchCtx := remote.WithFetchClass(ctx, remote.FetchClassPrefetch)
 			retN, retErr = l.blob.ReadAt(
 				p,
 				offset,
-				remote.WithContext(ctx),              // Make cancellable
+				remote.WithContext(fetchCtx),         // Make cancellable
 				remote.WithCacheOpts(cache.Direct()), // Do not pollute mem cache
 			)
 		}, 120*time.Second)
 		return
 	}), 0, l.blob.Size())
 	defer commonmetrics.WriteLatencyLogValue(ctx, l.desc.Digest, commonmetrics.BackgroundFetchDecompress, time.Now()) // time to decompress background fetch data (in milliseconds)
-	return l.verifiableReader.Cache(
+	opts := []reader.CacheOption{
 		reader.WithReader(br),                // Read contents in background
 		reader.WithCacheOpts(cache.Direct()), // Do not pollute mem cache
-	)
+	}
+	if l.resolver.filePriority != nil && !l.hasPrefetchLandmark() {
+		// The layer doesn't record the files accessed at startup. Fetch the files
+		// likely to be accessed first.
+		opts = append(opts, reader.WithPriority(l.resolver.filePriority))
+	}
+	if bc := l.resolver.config.BackgroundFetchConfig; bc.BytesPerSec > 0 || bc.MaxConcurrentChunks > 0 {
+		opts = append(opts, reader.WithCacheRate(bc.BytesPerSec, bc.MaxConcurrentChunks))
+	}
+	if msec := l.resolver.config.BackgroundFetchConfig.PauseReadLatencyMSec; msec > 0 {
+		opts = append(opts, reader.WithPauseOnSlowReads(time.Duration(msec)*time.Millisecond))
+	}
+	if paths := l.resolver.config.BackgroundFetchConfig.Paths; len(paths) > 0 {
+		opts = append(opts, reader.WithPathFilter(paths))
+	}
+	if len(skipPaths) > 0 {
+		opts = append(opts, reader.WithPathExclusion(skipPaths))
+	}
+	if len(uppers) > 0 {
+		opts = append(opts, reader.WithPathSkip(func(p string) bool {
+			for _, s := range uppers {
+				if s.Hides(p) {
+					return true
+				}
+			}
+			return false
+		}))
+	}
+	return l.verifiableReader.Cache(opts...)
+}
+
+// hasPrefetchLandmark returns true if the layer is optimized with the files accessed at startup.
+func (l *layer) hasPrefetchLandmark() bool {
+	md := l.verifiableReader.Metadata()
+	_, _, err := md.GetChild(md.RootID(), estargz.PrefetchLandmark)
+	return err == nil
 }
 
 func (l *layerRef) Done() {
@@ -625,7 +1432,7 @@ func (l *layer) RootNode(baseInode uint32) (fusefs.InodeEmbedder, error) {
 	if l.r == nil {
 		return nil, fmt.Errorf("layer hasn't been verified yet")
 	}
-	return newNode(l.desc.Digest, l.r, l.blob, baseInode, l.resolver.overlayOpaqueType, l.passThrough, l.logFileAccess)
+	return newNode(l.desc.Digest, l.r, l.blob, baseInode, l.resolver.overlayOpaqueType, l.passThrough, l.logFileAccess, l.resolver.config.VerifyFileDigests)
 }
 
 func (l *layer) ReadAt(p []byte, offset int64, opts ...remote.Option) (int, error) {
@@ -639,7 +1446,11 @@ func (l *layer) close() error {
 		return nil
 	}
 	l.closed = true
+	close(l.renewDone)
 	defer l.blob.done(true) // Close reader first, then close the blob
+	if l.release != nil {
+		defer l.release()
+	}
 	l.verifiableReader.Close()
 	if l.r != nil {
 		return l.r.Close()
@@ -647,6 +1458,33 @@ func (l *layer) close() error {
 	return nil
 }
 
+// minBlobRenewInterval is the minimum interval of renewBlob checking the expiry of the access
+// to the blob, which prevents renewing repeatedly when the expiry can't be extended.
+const minBlobRenewInterval = 10 * time.Second
+
+// renewBlob renews the access to the blob in background before it expires, until the layer
+// is closed. Each renewal happens at a random time between margin and margin/2 before the
+// expiry so layers resolved together don't renew at once.
+func (l *layer) renewBlob(margin time.Duration) {
+	ctx := log.WithLogger(context.Background(), log.L.WithField("digest", l.desc.Digest))
+	for {
+		wait := margin / 2 // check again later if the expiry is unknown
+		if exp, ok := l.blob.Expiry(); ok {
+			wait = time.Until(exp) - margin + rand.N(margin/2+1)
+		}
+		t := time.NewTimer(max(wait, minBlobRenewInterval))
+		select {
+		case <-l.renewDone:
+			t.Stop()
+			return
+		case <-t.C:
+		}
+		if err := l.blob.Renew(ctx, margin); err != nil {
+			log.G(ctx).WithError(err).Warn("failed to renew access to the blob")
+		}
+	}
+}
+
 func (l *layer) isClosed() bool {
 	l.closedMu.Lock()
 	closed := l.closed
@@ -662,6 +1500,57 @@ type blobRef struct {
 	done func(bool)
 }
 
+// FormatDisabledError is returned when the layer is in a format disabled by the config.
+type FormatDisabledError struct {
+	// Format is the name of the format.
+	Format string
+
+	// Option is the config option disabling the format.
+	Option string
+}
+
+func (e *FormatDisabledError) Error() string {
+	return fmt.Sprintf("lazy pulling of %s layers is disabled by config (%s)", e.Format, e.Option)
+}
+
+// Kind returns errdefs.KindUnsupported.
+func (e *FormatDisabledError) Kind() errdefs.Kind {
+	return errdefs.KindUnsupported
+}
+
+// Is matches errdefs.ErrUnsupported.
+func (e *FormatDisabledError) Is(target error) bool {
+	return target == errdefs.ErrUnsupported
+}
+
+// disabledDecompressor recognizes the layer of the disabled format and fails with
+// FormatDisabledError.
+type disabledDecompressor struct {
+	metadata.Decompressor
+	format string
+	option string
+}
+
+func (d *disabledDecompressor) ParseFooter(p []byte) (blobPayloadSize, tocOffset, tocSize int64, err error) {
+	if _, _, _, err := d.Decompressor.ParseFooter(p); err != nil {
+		return 0, 0, 0, err
+	}
+	return 0, 0, 0, &FormatDisabledError{Format: d.format, Option: d.option}
+}
+
+// decryptedBlob is a blob encrypted by ocicrypt. Contents are fetched and cached as is
+// and decrypted on each read.
+type decryptedBlob struct {
+	remote.Blob
+	dec *encryption.Decrypter
+}
+
+func (b *decryptedBlob) ReadAt(p []byte, offset int64, opts ...remote.Option) (int, error) {
+	n, err := b.Blob.ReadAt(p, offset, opts...)
+	b.dec.Decrypt(p[:n], offset)
+	return n, err
+}
+
 // layerRef is a reference to the layer in the cache. Calling `Done` or `done` decreases the
 // reference counter of this blob in the underlying cache. When nobody refers to the layer in the
 // cache, resources bound to this layer will be discarded.
@@ -697,6 +1586,23 @@ func (w *waiter) wait(timeout time.Duration) error {
 	}
 }
 
+// prioritizedBlobReader reads the blob as a prioritized task. This implements
+// reader.ContextReaderAt to propagate the context of the read operation to the fetch.
+type prioritizedBlobReader struct {
+	tm   *task.BackgroundTaskManager
+	blob remote.Blob
+}
+
+func (r *prioritizedBlobReader) ReadAt(p []byte, offset int64) (int, error) {
+	return r.ReadAtContext(context.Background(), p, offset)
+}
+
+func (r *prioritizedBlobReader) ReadAtContext(ctx context.Context, p []byte, offset int64) (int, error) {
+	r.tm.DoPrioritizedTask()
+	defer r.tm.DonePrioritizedTask()
+	return r.blob.ReadAt(p, offset, remote.WithContext(ctx))
+}
+
 type readerAtFunc func([]byte, int64) (int, error)
 
 func (f readerAtFunc) ReadAt(p []byte, offset int64) (int, error) { return f(p, offset) }
@@ -23,10 +23,29 @@
 package layer
 
 import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
 	"testing"
 	"time"
 
+	"github.com/containerd/stargz-snapshotter/cache"
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/containerd/stargz-snapshotter/estargz/zstdchunked"
+	"github.com/containerd/stargz-snapshotter/fs/config"
+	"github.com/containerd/stargz-snapshotter/fs/reader"
+	"github.com/containerd/stargz-snapshotter/fs/remote"
+	"github.com/containerd/stargz-snapshotter/metadata"
 	memorymetadata "github.com/containerd/stargz-snapshotter/metadata/memory"
+	"github.com/containerd/stargz-snapshotter/task"
+	tutil "github.com/containerd/stargz-snapshotter/util/testutil"
+	"github.com/klauspost/compress/zstd"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
 func TestLayer(t *testing.T) {
@@ -74,3 +93,626 @@ func TestWaiter(t *testing.T) {
 		t.Errorf("wait time is too short: %v; want %v", doneTime.Sub(startTime), waitTime)
 	}
 }
+
+func TestOrderChunkSources(t *testing.T) {
+	peer, remoteCache := new(nopChunkSource), new(nopChunkSource)
+	registered := map[string]reader.ChunkSource{"peer": peer, "remote-cache": remoteCache}
+	tests := []struct {
+		name    string
+		cfg     config.ChunkSourceConfig
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "default",
+			want: []string{"peer", "remote-cache", reader.BlobSourceName},
+		},
+		{
+			name: "ordered",
+			cfg:  config.ChunkSourceConfig{Order: []string{"remote-cache", reader.BlobSourceName, "peer"}},
+			want: []string{"remote-cache", reader.BlobSourceName, "peer"},
+		},
+		{
+			name:    "unknown",
+			cfg:     config.ChunkSourceConfig{Order: []string{"unknown", reader.BlobSourceName}},
+			wantErr: true,
+		},
+		{
+			name:    "duplicated",
+			cfg:     config.ChunkSourceConfig{Order: []string{"peer", "peer"}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.cfg.Retry = map[string]config.ChunkSourceRetryConfig{"peer": {MaxRetries: 2, RetryIntervalMSec: 10, MaxRetryIntervalMSec: 80}}
+			sources, err := orderChunkSources(tt.cfg, registered)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("invalid configuration must be rejected")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to order sources: %v", err)
+			}
+			var names []string
+			for _, s := range sources {
+				names = append(names, s.Name)
+				if (s.Name == reader.BlobSourceName) != (s.ChunkSource == nil) {
+					t.Errorf("unexpected chunk source of %q", s.Name)
+				}
+				if s.Name == "peer" && (s.MaxRetries != 2 || s.RetryInterval != 10*time.Millisecond || s.MaxRetryInterval != 80*time.Millisecond) {
+					t.Errorf("retry policy of peer isn't applied: %+v", s)
+				}
+			}
+			if !slices.Equal(names, tt.want) {
+				t.Errorf("sources = %v; want %v", names, tt.want)
+			}
+		})
+	}
+}
+
+type nopChunkSource struct{}
+
+func (s *nopChunkSource) FetchChunk(ctx context.Context, chunk reader.Chunk, p []byte) error {
+	return reader.ErrChunkNotFound
+}
+
+func TestChunkTransformerMatch(t *testing.T) {
+	const custom = "application/vnd.example.layer.v1.tar+custom"
+	desc := ocispec.Descriptor{
+		MediaType:   custom,
+		Annotations: map[string]string{"org.example.audit": "true"},
+	}
+	tests := []struct {
+		name string
+		reg  ChunkTransformerRegistration
+		want bool
+	}{
+		{name: "all", want: true},
+		{name: "mediatype", reg: ChunkTransformerRegistration{MediaTypes: []string{ocispec.MediaTypeImageLayerGzip, custom}}, want: true},
+		{name: "annotation", reg: ChunkTransformerRegistration{Annotations: []string{"org.example.audit"}}, want: true},
+		{name: "other mediatype", reg: ChunkTransformerRegistration{MediaTypes: []string{ocispec.MediaTypeImageLayerGzip}}},
+		{name: "other annotation", reg: ChunkTransformerRegistration{Annotations: []string{"org.example.other"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.reg.match(desc); got != tt.want {
+				t.Errorf("match = %v; want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+type digestFile string
+
+func (d digestFile) FileDigest() string { return string(d) }
+
+func TestFileChecksum(t *testing.T) {
+	data := []byte("0123456789abcdefghij")
+	type read struct{ off, size int64 }
+	tests := []struct {
+		name     string
+		digest   string
+		reads    []read
+		wantDone bool
+		wantErr  bool
+	}{
+		{name: "sequential", reads: []read{{0, 8}, {8, 8}, {16, 8}}, wantDone: true},
+		{name: "reread", reads: []read{{0, 8}, {4, 8}, {0, 4}, {12, 8}}, wantDone: true},
+		{name: "gap", reads: []read{{0, 8}, {12, 8}}},
+		{name: "not_from_head", reads: []read{{4, 16}, {0, 4}}},
+		{name: "partial", reads: []read{{0, 8}}},
+		{name: "mismatch", digest: digest.FromString("other").String(), reads: []read{{0, 20}}, wantDone: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dgst := tt.digest
+			if dgst == "" {
+				dgst = digest.FromBytes(data).String()
+			}
+			c := newFileChecksum(digestFile(dgst), int64(len(data)))
+			if c == nil {
+				t.Fatalf("checksum must be created")
+			}
+			var done bool
+			var err error
+			for _, r := range tt.reads {
+				p := data[r.off:min(r.off+r.size, int64(len(data)))]
+				if d, e := c.update(p, r.off); d {
+					done, err = d, e
+				}
+			}
+			if done != tt.wantDone {
+				t.Errorf("done = %v; want %v", done, tt.wantDone)
+			}
+			if (err != nil) != tt.wantErr {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+	if c := newFileChecksum(digestFile(""), int64(len(data))); c != nil {
+		t.Errorf("checksum must not be created without digest")
+	}
+	if c := newFileChecksum(struct{}{}, int64(len(data))); c != nil {
+		t.Errorf("checksum must not be created for files without digest")
+	}
+}
+
+func TestFilePriority(t *testing.T) {
+	var (
+		reg  = metadata.Attr{Mode: 0644}
+		exec = metadata.Attr{Mode: 0755}
+	)
+	tests := []struct {
+		name    string
+		cfg     config.FilePriorityConfig
+		files   map[string]metadata.Attr
+		want    map[string]int
+		wantErr bool
+	}{
+		{
+			name:  "default",
+			cfg:   config.FilePriorityConfig{Enable: true},
+			files: map[string]metadata.Attr{"libc.so.6": reg, "main.py": reg, "README.md": reg, "bash": exec, "data": reg},
+			want:  map[string]int{"libc.so.6": highFilePriority, "main.py": highFilePriority, "README.md": lowFilePriority, "bash": highFilePriority, "data": 0},
+		},
+		{
+			name: "configured",
+			cfg: config.FilePriorityConfig{
+				Enable:     true,
+				Patterns:   map[string]int{"*.so": 1, "lib*": 5, "*.md": -1},
+				Executable: 3,
+			},
+			files: map[string]metadata.Attr{"libc.so": reg, "a.so": reg, "README.md": exec, "bash": exec, "main.py": reg},
+			want:  map[string]int{"libc.so": 5, "a.so": 1, "README.md": -1, "bash": 3, "main.py": 0},
+		},
+		{
+			name:    "invalid",
+			cfg:     config.FilePriorityConfig{Enable: true, Patterns: map[string]int{"[": 1}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			priority, err := newFilePriority(tt.cfg)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("invalid configuration must be rejected")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to create priority: %v", err)
+			}
+			for name, attr := range tt.files {
+				if got := priority(name, attr); got != tt.want[name] {
+					t.Errorf("priority of %q = %d; want %d", name, got, tt.want[name])
+				}
+			}
+		})
+	}
+	if priority, err := newFilePriority(config.FilePriorityConfig{}); err != nil || priority != nil {
+		t.Errorf("prioritization must be disabled by default: %v", err)
+	}
+}
+
+func TestDisabledFormat(t *testing.T) {
+	externalTOC := tutil.ExternalTOCGzipCompressionWithLevel(gzip.BestCompression)()
+	tests := []struct {
+		name         string
+		compression  tutil.Compression
+		decompressor metadata.Decompressor
+		option       string
+	}{
+		{
+			name:         "zstdchunked",
+			compression:  tutil.ZstdCompressionWithLevel(zstd.SpeedDefault)(),
+			decompressor: new(zstdchunked.Decompressor),
+			option:       "disable_zstdchunked",
+		},
+		{
+			name:         "externaltoc",
+			compression:  externalTOC,
+			decompressor: externalTOC,
+			option:       "disable_external_toc",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sr, _, err := tutil.BuildEStargz([]tutil.TarEntry{tutil.File("foo", "bar")},
+				tutil.WithEStargzOptions(estargz.WithCompression(tt.compression)))
+			if err != nil {
+				t.Fatalf("failed to build sample blob: %v", err)
+			}
+			d := &disabledDecompressor{tt.decompressor, tt.name, tt.option}
+			_, err = memorymetadata.NewReader(sr, metadata.WithDecompressors(d))
+			var fErr *FormatDisabledError
+			if !errors.As(err, &fErr) {
+				t.Fatalf("FormatDisabledError must be returned but got %v", err)
+			}
+			if fErr.Option != tt.option {
+				t.Errorf("option = %q; want %q", fErr.Option, tt.option)
+			}
+
+			// Other formats must not be affected.
+			gzsr, _, err := tutil.BuildEStargz([]tutil.TarEntry{tutil.File("foo", "bar")})
+			if err != nil {
+				t.Fatalf("failed to build sample blob: %v", err)
+			}
+			r, err := memorymetadata.NewReader(gzsr, metadata.WithDecompressors(d))
+			if err != nil {
+				t.Fatalf("failed to read eStargz blob: %v", err)
+			}
+			r.Close()
+		})
+	}
+}
+
+type tieredBlob struct {
+	*sampleBlob
+	l      *layer
+	ranges [][2]int64
+	waited []bool // true if the waiter has been released when the range is fetched
+}
+
+func (b *tieredBlob) Cache(offset int64, size int64, opts ...remote.Option) error {
+	b.ranges = append(b.ranges, [2]int64{offset, offset + size})
+	select {
+	case <-b.l.prefetchWaiter.doneCh:
+		b.waited = append(b.waited, true)
+	default:
+		b.waited = append(b.waited, false)
+	}
+	return nil
+}
+
+func TestPrefetchTiers(t *testing.T) {
+	sr, dgst, err := tutil.BuildEStargz([]tutil.TarEntry{
+		tutil.File("exec", sampleData1),
+		tutil.File("soon", sampleData2),
+		tutil.File("rest", sampleData1),
+		tutil.File("ondemand", sampleData2),
+	}, tutil.WithEStargzOptions(
+		estargz.WithChunkSize(sampleChunkSize),
+		estargz.WithPrefetchTiers([][]string{{"exec"}, {"soon"}, {"rest"}}),
+	))
+	if err != nil {
+		t.Fatalf("failed to build eStargz: %v", err)
+	}
+	mr, err := memorymetadata.NewReader(sr)
+	if err != nil {
+		t.Fatalf("failed to create metadata reader: %v", err)
+	}
+	defer mr.Close()
+	vr, err := reader.NewReader(mr, cache.NewMemoryCache(), digest.FromString(""))
+	if err != nil {
+		t.Fatalf("failed to create reader: %v", err)
+	}
+	blob := &tieredBlob{sampleBlob: newBlob(t, sr)}
+	l := newLayer(
+		&Resolver{
+			prefetchTimeout:       time.Second,
+			backgroundTaskManager: task.NewBackgroundTaskManager(10, 5*time.Second),
+			config:                config.Config{PrefetchTierConcurrency: []int{4, 1}},
+		},
+		ocispec.Descriptor{Digest: testStateLayerDigest},
+		&blobRef{blob, func(bool) {}},
+		vr,
+		passThroughConfig{},
+		false,
+	)
+	blob.l = l
+	if err := l.Verify(dgst); err != nil {
+		t.Fatalf("failed to verify reader: %v", err)
+	}
+	if err := l.Prefetch(0); err != nil {
+		t.Fatalf("failed to prefetch: %v", err)
+	}
+
+	var offsets []int64
+	for _, name := range []string{estargz.PrefetchTierLandmark(0), estargz.PrefetchTierLandmark(1), estargz.PrefetchLandmark} {
+		id, _, err := mr.GetChild(mr.RootID(), name)
+		if err != nil {
+			t.Fatalf("failed to get %q: %v", name, err)
+		}
+		off, err := mr.GetOffset(id)
+		if err != nil {
+			t.Fatalf("failed to get offset of %q: %v", name, err)
+		}
+		offsets = append(offsets, off)
+	}
+	want := [][2]int64{{0, offsets[0]}, {offsets[0], offsets[1]}, {offsets[1], offsets[2]}}
+	if !slices.Equal(blob.ranges, want) {
+		t.Errorf("prefetched ranges = %v; want %v", blob.ranges, want)
+	}
+	// Container can run after the first tier is prefetched.
+	if !slices.Equal(blob.waited, []bool{false, true, true}) {
+		t.Errorf("waiter must be released after the first tier: %v", blob.waited)
+	}
+	if got := l.prefetchedSize(); got != offsets[2] {
+		t.Errorf("prefetched size = %d; want %d", got, offsets[2])
+	}
+	for i, want := range []int{4, 1, 1} {
+		if got := l.prefetchTierConcurrency(i); got != want {
+			t.Errorf("concurrency of tier %d = %d; want %d", i, got, want)
+		}
+	}
+}
+
+func TestBatchBufferSize(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  config.FuseConfig
+		host string
+		want int64
+	}{
+		{
+			name: "default",
+			cfg:  config.FuseConfig{MergeBufferSize: 400},
+			want: 400,
+		},
+		{
+			name: "ceiling",
+			cfg:  config.FuseConfig{MergeBufferSize: 400, MaxBatchBufferSize: 100},
+			want: 100,
+		},
+		{
+			name: "ceiling_larger_than_merge_buffer",
+			cfg:  config.FuseConfig{MergeBufferSize: 400, MaxBatchBufferSize: 1000},
+			want: 400,
+		},
+		{
+			name: "host_override",
+			cfg: config.FuseConfig{MergeBufferSize: 400, MaxBatchBufferSize: 100,
+				MaxBatchBufferSizeByHost: map[string]int64{"ghcr.io": 200}},
+			host: "ghcr.io",
+			want: 200,
+		},
+		{
+			name: "other_host",
+			cfg: config.FuseConfig{MergeBufferSize: 400, MaxBatchBufferSize: 100,
+				MaxBatchBufferSizeByHost: map[string]int64{"ghcr.io": 200}},
+			host: "docker.io",
+			want: 100,
+		},
+		{
+			name: "host_override_disables_ceiling",
+			cfg: config.FuseConfig{MergeBufferSize: 400, MaxBatchBufferSize: 100,
+				MaxBatchBufferSizeByHost: map[string]int64{"ghcr.io": 0}},
+			host: "ghcr.io",
+			want: 400,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &Resolver{config: config.Config{FuseConfig: tt.cfg}}
+			if got := r.batchBufferSize(tt.host); got != tt.want {
+				t.Errorf("batch buffer size = %d; want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompressMatcher(t *testing.T) {
+	cfg := config.Config{DirectoryCacheConfig: config.DirectoryCacheConfig{
+		CompressByImage: map[string]bool{
+			"ghcr.io/org/*":       true,
+			"ghcr.io/org/db":      false,
+			"registry.local/*/ml": true,
+		},
+	}}
+	match, err := newCompressMatcher(cfg)
+	if err != nil {
+		t.Fatalf("failed to make matcher: %v", err)
+	}
+	for locator, want := range map[string]bool{
+		"ghcr.io/org/app":          true,
+		"ghcr.io/org/db":           false, // the longest pattern is used
+		"ghcr.io/other/app":        false,
+		"registry.local/team/ml":   true,
+		"docker.io/library/ubuntu": false,
+	} {
+		if got := match(locator); got != want {
+			t.Errorf("compress %q = %v; want %v", locator, got, want)
+		}
+	}
+
+	cfg.Compress = true
+	if match, _ := newCompressMatcher(cfg); !match("docker.io/library/ubuntu") || match("ghcr.io/org/db") {
+		t.Errorf("images not matching the patterns must follow Compress")
+	}
+
+	cfg.Profiles = map[string]config.ProfileConfig{"small": {CompressCache: true}}
+	cfg.ProfileByImage = map[string]string{"ghcr.io/*/*": "small"}
+	cfg.Compress = false
+	if match, _ := newCompressMatcher(cfg); !match("ghcr.io/other/app") || match("ghcr.io/org/db") {
+		t.Errorf("images not matching CompressByImage must follow the profile")
+	}
+
+	if _, err := newCompressMatcher(config.Config{DirectoryCacheConfig: config.DirectoryCacheConfig{CompressByImage: map[string]bool{"[": true}}}); err == nil {
+		t.Errorf("invalid pattern must be rejected")
+	}
+}
+
+func TestResumableCaches(t *testing.T) {
+	root := t.TempDir()
+	cfg := config.Config{DirectoryCacheConfig: config.DirectoryCacheConfig{SyncAdd: true}}
+	layerA, layerB := digest.FromString("a"), digest.FromString("b")
+	var dirsA []string
+	for range 2 {
+		_, dir, err := newCache(root, "", "", cfg, layerA, nil)
+		if err != nil {
+			t.Fatalf("failed to make cache: %v", err)
+		}
+		dirsA = append(dirsA, dir)
+	}
+	c, dirB, err := newCache(root, "", "", cfg, layerB, nil)
+	if err != nil {
+		t.Fatalf("failed to make cache: %v", err)
+	}
+	chunk := digest.FromString("chunk").Encoded()
+	w, err := c.Add(chunk)
+	if err != nil {
+		t.Fatalf("failed to add: %v", err)
+	}
+	if _, err := w.Write([]byte("data")); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	if err := w.Commit(); err != nil {
+		t.Fatalf("failed to commit: %v", err)
+	}
+	w.Close()
+	p, err := openCacheProgress(dirB)
+	if err != nil {
+		t.Fatalf("failed to open progress: %v", err)
+	}
+	if err := p.Add(chunk); err != nil {
+		t.Fatalf("failed to record progress: %v", err)
+	}
+	f, err := os.OpenFile(filepath.Join(dirB, progressFileName), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatalf("failed to open progress file: %v", err)
+	}
+	f.WriteString(chunk[:10]) // partially written on a crash
+	f.Close()
+	if err := os.Mkdir(filepath.Join(root, "unknown"), 0700); err != nil {
+		t.Fatalf("failed to make directory: %v", err)
+	}
+
+	// The caches are left without being closed as if the snapshotter crashed.
+	rc, err := scanResumableCaches(root)
+	if err != nil {
+		t.Fatalf("failed to scan caches: %v", err)
+	}
+	got := []string{rc.take(layerA), rc.take(layerA)}
+	slices.Sort(got)
+	slices.Sort(dirsA)
+	if !slices.Equal(got, dirsA) || rc.take(layerA) != "" {
+		t.Errorf("caches of layer A = %v; want %v once", got, dirsA)
+	}
+	if got := rc.take(layerB); got != dirB {
+		t.Fatalf("cache of layer B = %q; want %q", got, dirB)
+	}
+	if got := (*resumableCaches)(nil).take(layerB); got != "" {
+		t.Errorf("nil caches must return nothing: %q", got)
+	}
+
+	c, dir, err := newCache(root, dirB, "", cfg, layerB, nil)
+	if err != nil {
+		t.Fatalf("failed to reuse cache: %v", err)
+	}
+	defer c.Close()
+	if dir != dirB {
+		t.Errorf("cache is created on %q; want %q", dir, dirB)
+	}
+	if r, err := c.Get(chunk); err != nil {
+		t.Errorf("chunk of the previous run must be reused: %v", err)
+	} else {
+		r.Close()
+	}
+	p, err = openCacheProgress(dirB)
+	if err != nil {
+		t.Fatalf("failed to load progress: %v", err)
+	}
+	if !p.Done(chunk) || p.size() != 1 {
+		t.Errorf("progress must have only the recorded chunk (%d recorded)", p.size())
+	}
+}
+
+func TestFlush(t *testing.T) {
+	sr, _, err := tutil.BuildEStargz([]tutil.TarEntry{tutil.File("foo", sampleData1)})
+	if err != nil {
+		t.Fatalf("failed to build eStargz: %v", err)
+	}
+	mr, err := memorymetadata.NewReader(sr)
+	if err != nil {
+		t.Fatalf("failed to create metadata reader: %v", err)
+	}
+	dir := t.TempDir()
+	c, err := cache.NewDirectoryCache(dir, cache.DirectoryCacheConfig{Direct: true, WriteBackSize: 1 << 30})
+	if err != nil {
+		t.Fatalf("failed to make cache: %v", err)
+	}
+	vr, err := reader.NewReader(mr, c, digest.FromString(""))
+	if err != nil {
+		t.Fatalf("failed to create reader: %v", err)
+	}
+	defer vr.Close()
+	var keys []string
+	for i := range 100 {
+		key := digest.FromString(fmt.Sprintf("chunk-%d", i)).Encoded()
+		w, err := c.Add(key)
+		if err != nil {
+			t.Fatalf("failed to add: %v", err)
+		}
+		if _, err := w.Write(make([]byte, 64*1024)); err != nil {
+			t.Fatalf("failed to write: %v", err)
+		}
+		if err := w.Commit(); err != nil {
+			t.Fatalf("failed to commit: %v", err)
+		}
+		w.Close()
+		keys = append(keys, key)
+	}
+	r := &Resolver{sharedReaders: map[digest.Digest]*sharedReader{testStateLayerDigest: {vr: vr, refs: 1}}}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := r.Flush(ctx); err != nil {
+		t.Fatalf("failed to flush: %v", err)
+	}
+	// Everything is on the disk even if the process exits without closing the cache.
+	for _, key := range keys {
+		if _, err := os.Stat(filepath.Join(dir, key[:2], key)); err != nil {
+			t.Errorf("chunk %q isn't written: %v", key, err)
+		}
+	}
+}
+
+func TestShadows(t *testing.T) {
+	sr, _, err := tutil.BuildEStargz([]tutil.TarEntry{
+		tutil.Dir("etc/"),
+		tutil.File("etc/"+whiteoutPrefix+"passwd", ""),
+		tutil.File("etc/hosts", "127.0.0.1 localhost"),
+		tutil.Dir("var/"),
+		tutil.Dir("var/cache/"),
+		tutil.File("var/cache/"+whiteoutOpaqueDir, ""),
+		tutil.File("var/cache/new", "new"),
+		tutil.Dir("usr/"),
+		tutil.Symlink("usr/lib", "/lib"),
+		tutil.Dir("opt/"),
+	})
+	if err != nil {
+		t.Fatalf("failed to build eStargz: %v", err)
+	}
+	mr, err := memorymetadata.NewReader(sr)
+	if err != nil {
+		t.Fatalf("failed to create metadata reader: %v", err)
+	}
+	defer mr.Close()
+	s, err := shadowsOf(mr)
+	if err != nil {
+		t.Fatalf("failed to get shadows: %v", err)
+	}
+	for p, want := range map[string]bool{
+		"etc/passwd":         true,  // whiteout
+		"etc/hosts":          true,  // replaced
+		"etc/group":          false, // not in the upper layer
+		"etc":                false, // directories don't hide lower directories
+		"var/cache":          false, // opaque directory itself
+		"var/cache/old":      true,  // child of opaque directory
+		"var/cache/old/file": true,
+		"var/log/file":       false,
+		"usr/lib/libc.so":    true, // replaced by a symlink
+		"opt/app":            false,
+		"/etc/passwd":        true,
+	} {
+		if got := s.Hides(p); got != want {
+			t.Errorf("Hides(%q) = %v; want %v", p, got, want)
+		}
+	}
+	if s.Hides("") || (*Shadows)(nil).Hides("etc/passwd") {
+		t.Errorf("root or nil shadows must not hide paths")
+	}
+}
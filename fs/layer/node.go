@@ -40,6 +40,7 @@ import (
 
 	"github.com/containerd/log"
 	"github.com/containerd/stargz-snapshotter/cache"
+	"github.com/containerd/stargz-snapshotter/errdefs"
 	"github.com/containerd/stargz-snapshotter/estargz"
 	commonmetrics "github.com/containerd/stargz-snapshotter/fs/metrics/common"
 	"github.com/containerd/stargz-snapshotter/fs/reader"
@@ -79,26 +80,32 @@ var opaqueXattrs = map[OverlayOpaqueType][]string{
 	OverlayOpaqueUser:    {"user.overlay.opaque"},
 }
 
-func newNode(layerDgst digest.Digest, r reader.Reader, blob remote.Blob, baseInode uint32, opaque OverlayOpaqueType, pth passThroughConfig, logFileAccess bool) (fusefs.InodeEmbedder, error) {
+func newNode(layerDgst digest.Digest, r reader.Reader, blob remote.Blob, baseInode uint32, opaque OverlayOpaqueType, pth passThroughConfig, logFileAccess, verifyFileDigests bool) (fusefs.InodeEmbedder, error) {
 	rootID := r.Metadata().RootID()
 	rootAttr, err := r.Metadata().GetAttr(rootID)
 	if err != nil {
 		return nil, err
 	}
+	rootStats, err := r.Metadata().DirStats(rootID)
+	if err != nil {
+		return nil, err
+	}
 	opq, ok := opaqueXattrs[opaque]
 	if !ok {
 		return nil, fmt.Errorf("unknown overlay opaque type")
 	}
 	ffs := &fs{
-		r:             r,
-		layerDigest:   layerDgst,
-		baseInode:     baseInode,
-		rootID:        rootID,
-		opaqueXattrs:  opq,
-		passThrough:   pth,
-		logFileAccess: logFileAccess,
-	}
-	ffs.s = ffs.newState(layerDgst, blob)
+		r:                 r,
+		blob:              blob,
+		layerDigest:       layerDgst,
+		baseInode:         baseInode,
+		rootID:            rootID,
+		opaqueXattrs:      opq,
+		passThrough:       pth,
+		logFileAccess:     logFileAccess,
+		verifyFileDigests: verifyFileDigests,
+	}
+	ffs.s = ffs.newState(layerDgst, blob, rootStats)
 	return &node{
 		id:   rootID,
 		attr: rootAttr,
@@ -108,14 +115,16 @@ func newNode(layerDgst digest.Digest, r reader.Reader, blob remote.Blob, baseIno
 
 // fs contains global metadata used by nodes
 type fs struct {
-	r             reader.Reader
-	s             *state
-	layerDigest   digest.Digest
-	baseInode     uint32
-	rootID        uint32
-	opaqueXattrs  []string
-	passThrough   passThroughConfig
-	logFileAccess bool
+	r                 reader.Reader
+	blob              remote.Blob
+	s                 *state
+	layerDigest       digest.Digest
+	baseInode         uint32
+	rootID            uint32
+	opaqueXattrs      []string
+	passThrough       passThroughConfig
+	logFileAccess     bool
+	verifyFileDigests bool
 }
 
 func (fs *fs) inodeOfState() uint64 {
@@ -157,6 +166,8 @@ type node struct {
 	accessed uint32
 	attr     metadata.Attr
 
+	digestChecked atomic.Bool // the data returned for the file has been checked against its digest
+
 	ents       []fuse.DirEntry
 	entsCached bool
 	entsMu     sync.Mutex
@@ -212,7 +223,7 @@ func (n *node) readdir() ([]fuse.DirEntry, syscall.Errno) {
 		}
 
 		// We don't want to show prefetch landmarks in "/".
-		if isRoot && (name == estargz.PrefetchLandmark || name == estargz.NoPrefetchLandmark) {
+		if isRoot && estargz.IsLandmark(name) {
 			return true
 		}
 
@@ -284,7 +295,7 @@ func (n *node) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fu
 	isRoot := n.isRootNode()
 
 	// We don't want to show prefetch landmarks in "/".
-	if isRoot && (name == estargz.PrefetchLandmark || name == estargz.NoPrefetchLandmark) {
+	if isRoot && estargz.IsLandmark(name) {
 		return nil, syscall.ENOENT
 	}
 
@@ -375,7 +386,19 @@ func (n *node) Open(ctx context.Context, flags uint32) (fh fusefs.FileHandle, fu
 	ra, err := n.fs.r.OpenFile(n.id)
 	if err != nil {
 		n.fs.s.report(fmt.Errorf("node.Open: %v", err))
-		return nil, 0, syscall.EIO
+		return nil, 0, errdefs.Errno(err)
+	}
+
+	if !n.fs.blob.Available() {
+		// The registry is in outage. Only files that can be served from the cache are allowed.
+		if cc, ok := ra.(reader.CacheChecker); !ok || !cc.Cached() {
+			commonmetrics.IncOperationCount(commonmetrics.OnDemandRegistryUnavailableCount, n.fs.layerDigest)
+			n.fs.s.report(fmt.Errorf("node.Open: file %d isn't cached: %w", n.id, remote.ErrRegistryUnavailable))
+			if c, ok := ra.(io.Closer); ok {
+				c.Close()
+			}
+			return nil, 0, syscall.EHOSTUNREACH
+		}
 	}
 
 	n.logAccessOnce(ctx)
@@ -385,6 +408,9 @@ func (n *node) Open(ctx context.Context, flags uint32) (fh fusefs.FileHandle, fu
 		ra: ra,
 		fd: -1,
 	}
+	if n.fs.verifyFileDigests && !n.digestChecked.Load() {
+		f.checksum = newFileChecksum(ra, n.attr.Size)
+	}
 
 	if n.fs.passThrough.enable {
 		if getter, ok := ra.(reader.PassthroughFdGetter); ok {
@@ -479,6 +505,8 @@ type file struct {
 	ra io.ReaderAt
 	fd int
 	cr cache.Reader
+
+	checksum *fileChecksum // nil if the data isn't checked against the digest of the file
 }
 
 var _ = (fusefs.FileReader)((*file)(nil))
@@ -486,14 +514,45 @@ var _ = (fusefs.FileReader)((*file)(nil))
 func (f *file) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
 	defer commonmetrics.MeasureLatencyInMicroseconds(commonmetrics.ReadOnDemand, f.n.fs.layerDigest, time.Now()) // measure time for on-demand file reads (in microseconds)
 	defer commonmetrics.IncOperationCount(commonmetrics.OnDemandReadAccessCount, f.n.fs.layerDigest)             // increment the counter for on-demand file accesses
-	n, err := f.ra.ReadAt(dest, off)
+	var (
+		n   int
+		err error
+	)
+	if cra, ok := f.ra.(reader.ContextReaderAt); ok {
+		// Propagate the cancellation of the FUSE request (e.g. interrupted by the process)
+		n, err = cra.ReadAtContext(ctx, dest, off)
+	} else {
+		n, err = f.ra.ReadAt(dest, off)
+	}
 	if err != nil && err != io.EOF {
 		f.n.fs.s.report(fmt.Errorf("file.Read: %v", err))
-		return nil, syscall.EIO
+		if errors.Is(err, remote.ErrRegistryUnavailable) {
+			commonmetrics.IncOperationCount(commonmetrics.OnDemandRegistryUnavailableCount, f.n.fs.layerDigest)
+		}
+		// See the errno mapping table of errdefs.
+		return nil, errdefs.Errno(err)
+	}
+	if f.checksum != nil {
+		f.checkDigest(dest[:n], off)
 	}
 	return fuse.ReadResultData(dest[:n]), 0
 }
 
+// checkDigest records the result of the check of the data returned for the file against
+// the digest of the file once the whole file has been read.
+func (f *file) checkDigest(p []byte, off int64) {
+	done, err := f.checksum.update(p, off)
+	if !done || f.n.digestChecked.Swap(true) {
+		return
+	}
+	if err != nil {
+		commonmetrics.IncOperationCount(commonmetrics.FileDigestMismatchCount, f.n.fs.layerDigest)
+		f.n.fs.s.report(fmt.Errorf("file.Read: data of file %d doesn't match the digest in the TOC: %w", f.n.id, err))
+		return
+	}
+	commonmetrics.IncOperationCount(commonmetrics.FileDigestVerifiedCount, f.n.fs.layerDigest)
+}
+
 var _ = (fusefs.FileGetattrer)((*file)(nil))
 
 func (f *file) Getattr(ctx context.Context, out *fuse.AttrOut) syscall.Errno {
@@ -523,6 +582,13 @@ func (f *file) InitFd(fd int) {
 var _ = (fusefs.FileReleaser)((*file)(nil))
 
 func (f *file) Release(ctx context.Context) syscall.Errno {
+	// Speculative fetches of the file can be canceled once all handles are released.
+	if c, ok := f.ra.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			f.n.fs.s.report(fmt.Errorf("file.Release: failed to close file: %v", err))
+			return syscall.EIO
+		}
+	}
 	if f.cr != nil {
 		if err := f.cr.Close(); err != nil {
 			f.n.fs.s.report(fmt.Errorf("file.Release: failed to close cache reader: %v", err))
@@ -562,13 +628,15 @@ func (w *whiteout) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errn
 
 // newState provides new state directory node.
 // It creates statFile at the same time to give it stable inode number.
-func (fs *fs) newState(layerDigest digest.Digest, blob remote.Blob) *state {
+func (fs *fs) newState(layerDigest digest.Digest, blob remote.Blob, rootStats metadata.DirStats) *state {
 	return &state{
 		statFile: &statFile{
 			name: layerDigest.String() + ".json",
 			statJSON: statJSON{
-				Digest: layerDigest.String(),
-				Size:   blob.Size(),
+				Digest:    layerDigest.String(),
+				Size:      blob.Size(),
+				FilesSize: rootStats.Size,
+				Entries:   rootStats.Entries,
 			},
 			blob: blob,
 			fs:   fs,
@@ -637,6 +705,9 @@ type statJSON struct {
 	Size           int64   `json:"size"`
 	FetchedSize    int64   `json:"fetchedSize"`
 	FetchedPercent float64 `json:"fetchedPercent"` // Fetched / Size * 100.0
+	Unavailable    bool    `json:"unavailable,omitempty"`
+	FilesSize      int64   `json:"filesSize"` // total size of regular files in the layer
+	Entries        int64   `json:"entries"`   // number of files in the layer
 }
 
 // statFile is a file which contain something to be reported from this layer.
@@ -721,6 +792,7 @@ func (sf *statFile) attr(out *fuse.Attr) (fusefs.StableAttr, syscall.Errno) {
 func (sf *statFile) updateStatUnlocked() ([]byte, error) {
 	sf.statJSON.FetchedSize = sf.blob.FetchedSize()
 	sf.statJSON.FetchedPercent = float64(sf.statJSON.FetchedSize) / float64(sf.statJSON.Size) * 100.0
+	sf.statJSON.Unavailable = !sf.blob.Available()
 	j, err := json.Marshal(&sf.statJSON)
 	if err != nil {
 		return nil, err
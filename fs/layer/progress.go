@@ -0,0 +1,151 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package layer
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/containerd/stargz-snapshotter/cache"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// progressFileName is the name of the file in a directory cache that records the cache IDs
+// of the chunks cached by the background fetch, one per line.
+const progressFileName = "progress"
+
+// resumableCaches are the directory caches of layers left by the previous run of the
+// snapshotter. Each of them is reused by a layer of the same digest.
+type resumableCaches struct {
+	dirs map[digest.Digest][]string
+	mu   sync.Mutex
+}
+
+// scanResumableCaches finds the directory caches of layers under root.
+func scanResumableCaches(root string) (*resumableCaches, error) {
+	rc := &resumableCaches{dirs: make(map[digest.Digest][]string)}
+	ents, err := os.ReadDir(root)
+	if errors.Is(err, os.ErrNotExist) {
+		return rc, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for _, e := range ents {
+		if !e.IsDir() {
+			continue
+		}
+		dir := filepath.Join(root, e.Name())
+		b, err := os.ReadFile(filepath.Join(dir, cache.LayerFileName))
+		if err != nil {
+			continue // not a cache of a layer
+		}
+		dgst, err := digest.Parse(strings.TrimSpace(string(b)))
+		if err != nil {
+			continue
+		}
+		rc.dirs[dgst] = append(rc.dirs[dgst], dir)
+	}
+	return rc, nil
+}
+
+// take returns a directory cache of the layer left by the previous run, or "" if there is
+// none. Each directory is returned only once.
+func (rc *resumableCaches) take(dgst digest.Digest) string {
+	if rc == nil {
+		return ""
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	dirs := rc.dirs[dgst]
+	if len(dirs) == 0 {
+		return ""
+	}
+	dir := dirs[0]
+	if len(dirs) == 1 {
+		delete(rc.dirs, dgst)
+	} else {
+		rc.dirs[dgst] = dirs[1:]
+	}
+	// Contents being written when the previous run stopped are incomplete.
+	os.RemoveAll(filepath.Join(dir, "wip"))
+	return dir
+}
+
+// cacheProgress is reader.CacheProgress recorded in the progress file of a directory cache.
+type cacheProgress struct {
+	path string
+	done map[string]struct{}
+	mu   sync.Mutex
+}
+
+// openCacheProgress loads the progress recorded in the directory cache.
+func openCacheProgress(dir string) (*cacheProgress, error) {
+	p := &cacheProgress{path: filepath.Join(dir, progressFileName), done: make(map[string]struct{})}
+	f, err := os.Open(p.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return p, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if id := s.Text(); len(id) == 2*digest.SHA256.Size() {
+			p.done[id] = struct{}{} // the last line may be partially written
+		}
+	}
+	return p, s.Err()
+}
+
+func (p *cacheProgress) Done(cacheID string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, ok := p.done[cacheID]
+	return ok
+}
+
+func (p *cacheProgress) Add(cacheID string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.done[cacheID]; ok {
+		return nil
+	}
+	f, err := os.OpenFile(p.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(cacheID + "\n"); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	p.done[cacheID] = struct{}{}
+	return nil
+}
+
+// size returns the number of the chunks recorded.
+func (p *cacheProgress) size() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.done)
+}
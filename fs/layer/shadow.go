@@ -0,0 +1,106 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package layer
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/containerd/stargz-snapshotter/metadata"
+)
+
+// Shadows is the set of the paths in lower layers that a layer hides in the merged view of
+// the image: paths deleted by whiteouts, children of opaque directories and paths replaced
+// by files other than directories. The files under the hidden paths are hidden as well.
+// Paths are relative to the root of the layer.
+type Shadows struct {
+	paths  map[string]struct{} // hidden paths
+	opaque map[string]struct{} // directories whose children are hidden
+}
+
+// shadowsState is the Shadows of a layer computed once.
+type shadowsState struct {
+	once    sync.Once
+	shadows *Shadows
+	err     error
+}
+
+// Shadows returns the paths in lower layers that this layer hides. This is available after
+// the layer is resolved, before it's verified. The result is computed once.
+func (l *layer) Shadows() (*Shadows, error) {
+	if l.isClosed() {
+		return nil, fmt.Errorf("layer is already closed")
+	}
+	l.shadows.once.Do(func() {
+		l.shadows.shadows, l.shadows.err = shadowsOf(l.verifiableReader.Metadata())
+	})
+	return l.shadows.shadows, l.shadows.err
+}
+
+func shadowsOf(r metadata.Reader) (*Shadows, error) {
+	s := &Shadows{paths: make(map[string]struct{}), opaque: make(map[string]struct{})}
+	if err := walkPaths(r, r.RootID(), "/", 0, func(p string, _ uint32, _ metadata.Attr) {
+		dir, name := path.Split(strings.TrimPrefix(p, "/"))
+		dir = strings.TrimSuffix(dir, "/")
+		switch {
+		case name == whiteoutOpaqueDir:
+			s.opaque[dir] = struct{}{}
+		case strings.HasPrefix(name, whiteoutPrefix):
+			s.paths[path.Join(dir, strings.TrimPrefix(name, whiteoutPrefix))] = struct{}{}
+		default:
+			s.paths[path.Join(dir, name)] = struct{}{}
+		}
+	}); err != nil {
+		return nil, fmt.Errorf("failed to walk whiteouts: %w", err)
+	}
+	return s, nil
+}
+
+// Len returns the number of the hidden paths and the opaque directories.
+func (s *Shadows) Len() int {
+	if s == nil {
+		return 0
+	}
+	return len(s.paths) + len(s.opaque)
+}
+
+// Hides returns true if the path in a lower layer is hidden by the layer of s. p is
+// relative to the root of the layer.
+func (s *Shadows) Hides(p string) bool {
+	if s.Len() == 0 {
+		return false
+	}
+	p = strings.Trim(path.Clean("/"+p), "/")
+	if _, ok := s.paths[p]; ok {
+		return true
+	}
+	for i := len(p) - 1; i >= 0; i-- {
+		if p[i] != '/' {
+			continue
+		}
+		if _, ok := s.paths[p[:i]]; ok {
+			return true
+		}
+		if _, ok := s.opaque[p[:i]]; ok {
+			return true
+		}
+	}
+	_, ok := s.opaque[""] // the root is opaque
+	return ok && p != ""
+}
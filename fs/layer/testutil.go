@@ -37,6 +37,8 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"reflect"
+	"slices"
 	"strings"
 	"syscall"
 	"time"
@@ -138,6 +140,8 @@ func TestSuiteLayer(t *TestRunner, store metadata.Store) {
 		testNodeRead(t, store, lc)
 		testNodes(t, store, lc)
 	}
+	testPrefetchDependencies(t, store)
+	testPrefetchCoverage(t, store)
 }
 
 var testStateLayerDigest = digest.FromString("dummy")
@@ -341,6 +345,177 @@ func testPrefetch(t *TestRunner, factory metadata.Store, lc layerConfig) {
 	}
 }
 
+func testPrefetchCoverage(t *TestRunner, factory metadata.Store) {
+	a := strings.Repeat("a", 100)
+	in := []tutil.TarEntry{
+		tutil.Dir("app/"),
+		tutil.File("app/a", a),
+		tutil.File("app/b", strings.Repeat("b", 50)),
+		tutil.File("c", strings.Repeat("c", 200)),
+		tutil.Link("d", "c"),
+		tutil.File("e", ""),
+		tutil.File("f", a), // deduplicated with app/a
+	}
+	want := estargz.PrefetchCoverage{PrefetchSize: 200, TotalSize: 450}
+	tests := []struct {
+		name       string
+		annotation string
+		want       *estargz.PrefetchCoverage
+	}{
+		{name: "verified", annotation: want.String(), want: &want},
+		{name: "mismatch", annotation: "100/450"},
+		{name: "invalid", annotation: "invalid"},
+		{name: "no-annotation"},
+	}
+	for _, tt := range tests {
+		t.Run("testPrefetchCoverage-"+tt.name, func(t *TestRunner) {
+			sr, dgst, err := tutil.BuildEStargz(in, tutil.WithEStargzOptions(
+				estargz.WithPrioritizedFiles([]string{"app/", "app/a"}),
+				estargz.WithDedupFiles(),
+			))
+			if err != nil {
+				t.Fatalf("failed to build eStargz: %v", err)
+			}
+			mr, err := factory(sr)
+			if err != nil {
+				t.Fatalf("failed to create metadata reader: %v", err)
+			}
+			defer mr.Close()
+			vr, err := reader.NewReader(mr, cache.NewMemoryCache(), digest.FromString(""))
+			if err != nil {
+				t.Fatalf("failed to create reader: %v", err)
+			}
+			desc := ocispec.Descriptor{Digest: testStateLayerDigest}
+			if tt.annotation != "" {
+				desc.Annotations = map[string]string{estargz.PrefetchCoverageAnnotation: tt.annotation}
+			}
+			l := newLayer(&Resolver{}, desc, &blobRef{newBlob(t, sr), func(bool) {}}, vr, passThroughConfig{}, false)
+			if err := l.Verify(dgst); err != nil {
+				t.Fatalf("failed to verify reader: %v", err)
+			}
+			if got := l.Info().PrefetchCoverage; !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("coverage = %v; want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func testPrefetchDependencies(t *TestRunner, factory metadata.Store) {
+	exec := tutil.WithFileMode(0755)
+	in := []tutil.TarEntry{
+		tutil.Dir("app/"),
+		tutil.File("app/server", string(tutil.ELF("/lib64/ld-linux-x86-64.so.2", []string{"libfoo.so.1", "libc.so.6"}, "$ORIGIN/lib")), exec),
+		tutil.File("app/run.sh", "#!/usr/bin/env python3\n", exec),
+		tutil.Dir("app/lib/"),
+		tutil.File("app/lib/libfoo.so.1", string(tutil.ELF("", []string{"libbar.so.2"}, ""))),
+		tutil.Symlink("bin", "usr/bin"),
+		tutil.Symlink("lib64", "usr/lib64"),
+		tutil.Dir("usr/"),
+		tutil.Dir("usr/bin/"),
+		tutil.File("usr/bin/env", "env"),
+		tutil.Symlink("usr/bin/python3", "python3.11"),
+		tutil.File("usr/bin/python3.11", string(tutil.ELF("", []string{"libpython3.11.so.1.0"}, ""))),
+		tutil.File("usr/bin/unrelated", string(tutil.ELF("", []string{"libunrelated.so"}, "")), exec),
+		tutil.Dir("usr/lib64/"),
+		tutil.File("usr/lib64/ld-linux-x86-64.so.2", "ld.so"),
+		tutil.Dir("usr/lib/"),
+		tutil.Dir("usr/lib/x86_64-linux-gnu/"),
+		tutil.Symlink("usr/lib/x86_64-linux-gnu/libbar.so.2", "libbar.so.2.0.1"),
+		tutil.File("usr/lib/x86_64-linux-gnu/libbar.so.2.0.1", "bar"),
+	}
+	for srcCompressionName, srcCompression := range srcCompressions {
+		cl := srcCompression()
+		t.Run("testPrefetchDependencies-"+srcCompressionName, func(t *TestRunner) {
+			sr, dgst, err := tutil.BuildEStargz(in,
+				tutil.WithEStargzOptions(
+					estargz.WithPrioritizedFiles([]string{"app/", "app/server", "app/run.sh"}),
+					estargz.WithCompression(cl),
+				))
+			if err != nil {
+				t.Fatalf("failed to build eStargz: %v", err)
+			}
+			blob := newBlob(t, sr)
+			mr, err := factory(sr, metadata.WithDecompressors(cl))
+			if err != nil {
+				t.Fatalf("failed to create metadata reader: %v", err)
+			}
+			defer mr.Close()
+			vr, err := reader.NewReader(mr, cache.NewMemoryCache(), digest.FromString(""))
+			if err != nil {
+				t.Fatalf("failed to create reader: %v", err)
+			}
+			l := newLayer(
+				&Resolver{
+					prefetchTimeout:       time.Second,
+					backgroundTaskManager: task.NewBackgroundTaskManager(10, 5*time.Second),
+				},
+				ocispec.Descriptor{Digest: testStateLayerDigest},
+				&blobRef{blob, func(bool) {}},
+				vr,
+				passThroughConfig{},
+				false,
+			)
+			if err := l.Verify(dgst); err != nil {
+				t.Fatalf("failed to verify reader: %v", err)
+			}
+			if err := l.Prefetch(0); err != nil {
+				t.Fatalf("failed to prefetch: %v", err)
+			}
+			missing, err := l.PrefetchDependencies(nil)
+			if err != nil {
+				t.Fatalf("failed to prefetch dependencies: %v", err)
+			}
+			for _, p := range []string{"/usr/lib64/libc.so.6", "/usr/lib/x86_64-linux-gnu/libpython3.11.so.1.0"} {
+				if !slices.Contains(missing, p) {
+					t.Errorf("%q must be missing: %v", p, missing)
+				}
+			}
+			for _, p := range missing {
+				if strings.Contains(p, "libfoo") || strings.Contains(p, "libbar") || strings.Contains(p, "unrelated") {
+					t.Errorf("unexpected missing dependency %q", p)
+				}
+			}
+			isCached := func(file string) bool {
+				id, err := lookup(l.r.Metadata(), file)
+				if err != nil {
+					t.Fatalf("failed to lookup %q: %v", file, err)
+				}
+				attr, err := l.r.Metadata().GetAttr(id)
+				if err != nil {
+					t.Fatalf("failed to get attr of %q: %v", file, err)
+				}
+				ra, err := l.r.OpenFile(id)
+				if err != nil {
+					t.Fatalf("failed to open %q: %v", file, err)
+				}
+				blob.readCalled = false
+				if _, err := io.Copy(io.Discard, io.NewSectionReader(ra, 0, attr.Size)); err != nil {
+					t.Fatalf("failed to read %q: %v", file, err)
+				}
+				return !blob.readCalled
+			}
+			for _, file := range []string{"usr/lib64/ld-linux-x86-64.so.2", "app/lib/libfoo.so.1",
+				"usr/lib/x86_64-linux-gnu/libbar.so.2.0.1", "usr/bin/env", "usr/bin/python3.11"} {
+				if !isCached(file) {
+					t.Errorf("dependency %q isn't cached", file)
+				}
+			}
+
+			// Dependencies of other layers are looked up with their paths.
+			missing, err = l.PrefetchDependencies([]string{"/bin/unrelated", "/lib64/ld-linux-x86-64.so.2"})
+			if err != nil {
+				t.Fatalf("failed to prefetch dependencies: %v", err)
+			}
+			if !slices.Contains(missing, "/usr/lib64/libunrelated.so") {
+				t.Errorf("dependency of the requested file must be missing: %v", missing)
+			}
+			if slices.Contains(missing, "/usr/lib64/libc.so.6") {
+				t.Errorf("missing dependency must be returned only once: %v", missing)
+			}
+		})
+	}
+}
+
 func lookup(r metadata.Reader, name string) (uint32, error) {
 	name = strings.TrimPrefix(path.Clean("/"+name), "/")
 	if name == "" {
@@ -393,6 +568,7 @@ func (sb *sampleBlob) Authn(tr http.RoundTripper) (http.RoundTripper, error) { r
 func (sb *sampleBlob) Check() error                                          { return nil }
 func (sb *sampleBlob) Size() int64                                           { return sb.r.Size() }
 func (sb *sampleBlob) FetchedSize() int64                                    { return 0 }
+func (sb *sampleBlob) Available() bool                                       { return true }
 func (sb *sampleBlob) ReadAt(p []byte, offset int64, opts ...remote.Option) (int, error) {
 	if len(p) > 0 {
 		target := region{offset, offset + int64(len(p)) - 1}
@@ -438,7 +614,9 @@ func (sb *sampleBlob) Cache(offset int64, size int64, option ...remote.Option) e
 func (sb *sampleBlob) Refresh(ctx context.Context, hosts source.RegistryHosts, refspec reference.Spec, desc ocispec.Descriptor) error {
 	return nil
 }
-func (sb *sampleBlob) Close() error { return nil }
+func (sb *sampleBlob) Expiry() (time.Time, bool)                             { return time.Time{}, false }
+func (sb *sampleBlob) Renew(ctx context.Context, margin time.Duration) error { return nil }
+func (sb *sampleBlob) Close() error                                          { return nil }
 
 const (
 	sampleMiddleOffset = sampleChunkSize / 2
@@ -822,7 +1000,7 @@ func getRootNode(t TestingT, r metadata.Reader, opaque OverlayOpaqueType, tocDgs
 	if err != nil {
 		t.Fatalf("failed to verify reader: %v", err)
 	}
-	rootNode, err := newNode(testStateLayerDigest, rr, &testBlobState{10, 5}, 100, opaque, lc.passThroughConfig, false)
+	rootNode, err := newNode(testStateLayerDigest, rr, &testBlobState{10, 5}, 100, opaque, lc.passThroughConfig, false, false)
 	if err != nil {
 		t.Fatalf("failed to get root node: %v", err)
 	}
@@ -838,6 +1016,7 @@ type testBlobState struct {
 func (tb *testBlobState) Check() error       { return nil }
 func (tb *testBlobState) Size() int64        { return tb.size }
 func (tb *testBlobState) FetchedSize() int64 { return tb.fetchedSize }
+func (tb *testBlobState) Available() bool    { return true }
 func (tb *testBlobState) ReadAt(p []byte, offset int64, opts ...remote.Option) (int, error) {
 	return 0, nil
 }
@@ -845,7 +1024,9 @@ func (tb *testBlobState) Cache(offset int64, size int64, opts ...remote.Option)
 func (tb *testBlobState) Refresh(ctx context.Context, host source.RegistryHosts, refspec reference.Spec, desc ocispec.Descriptor) error {
 	return nil
 }
-func (tb *testBlobState) Close() error { return nil }
+func (tb *testBlobState) Expiry() (time.Time, bool)                             { return time.Time{}, false }
+func (tb *testBlobState) Renew(ctx context.Context, margin time.Duration) error { return nil }
+func (tb *testBlobState) Close() error                                          { return nil }
 
 type check func(TestingT, *node, cache.BlobCache, *calledReaderAt)
 
@@ -1113,6 +1294,10 @@ func hasStateFile(t TestingT, id string) check {
 			t.Errorf("expected error %q, got %q", wantErr.Error(), j.Error)
 			return
 		}
+		if j.FilesSize != 5 || j.Entries != 2 { // "test" and the landmark file
+			t.Errorf("unexpected aggregates: filesSize %d, entries %d", j.FilesSize, j.Entries)
+			return
+		}
 	}
 }
 
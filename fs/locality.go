@@ -0,0 +1,201 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/containerd/stargz-snapshotter/fs/source"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// LocalityReporter reports how much of the images mounted on the node is cached locally, so
+// schedulers can place pods on the nodes where their images are already warm. Images are
+// identified by the digest of the manifest passed from the labels of the layers (see
+// source.Source.ManifestDigest). Layers mounted without the manifest digest aren't reported.
+type LocalityReporter struct {
+	mu sync.Mutex
+	fs *filesystem
+}
+
+// NewLocalityReporter returns a LocalityReporter. Pass it to the filesystem with
+// WithLocalityReporter.
+func NewLocalityReporter() *LocalityReporter {
+	return &LocalityReporter{}
+}
+
+// WithLocalityReporter specifies the reporter of the cache locality of the images mounted
+// on the filesystem (e.g. served to schedulers).
+func WithLocalityReporter(r *LocalityReporter) Option {
+	return func(opts *options) {
+		opts.localityReporter = r
+	}
+}
+
+func (r *LocalityReporter) set(fs *filesystem) {
+	r.mu.Lock()
+	r.fs = fs
+	r.mu.Unlock()
+}
+
+// ImageLocality is the cache locality of an image.
+type ImageLocality struct {
+	// Digest is the digest of the image manifest.
+	Digest digest.Digest `json:"digest"`
+
+	// Refs are the references the image is mounted from.
+	Refs []string `json:"refs"`
+
+	// Size is the total size of the layers of the image known to the node.
+	Size int64 `json:"size"`
+
+	// CachedSize is the number of bytes of the layers cached on the node.
+	CachedSize int64 `json:"cached_size"`
+
+	// CachedRatio is CachedSize / Size, the fraction of the chunks of the image cached on
+	// the node weighted by their sizes. 0 if Size is 0.
+	CachedRatio float64 `json:"cached_ratio"`
+
+	// Layers are the layers of the image from the lowest one.
+	Layers []LayerLocality `json:"layers"`
+}
+
+// LayerLocality is the cache locality of a layer.
+type LayerLocality struct {
+	// Digest is the digest of the layer.
+	Digest digest.Digest `json:"digest"`
+
+	// Size is the size of the layer. 0 if the layer isn't mounted and its size is unknown.
+	Size int64 `json:"size"`
+
+	// CachedSize is the number of bytes of the layer cached on the node. 0 if the layer
+	// isn't mounted.
+	CachedSize int64 `json:"cached_size"`
+}
+
+// mountedImage is an image whose layers are mounted on the filesystem. It is guarded by
+// layerMu of the filesystem.
+type mountedImage struct {
+	refs        map[string]struct{}
+	layers      []digest.Digest // from the lowest layer
+	sizes       map[digest.Digest]int64
+	mountpoints map[string]struct{}
+}
+
+// Report returns the cache locality of the mounted images sorted by the digest. If images
+// are specified, only those are reported; the ones not mounted are omitted.
+func (r *LocalityReporter) Report(images ...digest.Digest) ([]ImageLocality, error) {
+	r.mu.Lock()
+	fs := r.fs
+	r.mu.Unlock()
+	if fs == nil {
+		return nil, fmt.Errorf("filesystem isn't ready")
+	}
+	return fs.imageLocalities(images), nil
+}
+
+func (fs *filesystem) imageLocalities(images []digest.Digest) []ImageLocality {
+	fs.layerMu.Lock()
+	defer fs.layerMu.Unlock()
+
+	wanted := make(map[digest.Digest]bool)
+	for _, d := range images {
+		wanted[d] = true
+	}
+	layers := make(map[digest.Digest]LayerLocality)
+	for _, l := range fs.layer {
+		info := l.Info()
+		layers[info.Digest] = LayerLocality{
+			Digest:     info.Digest,
+			Size:       info.Size,
+			CachedSize: min(info.FetchedSize, info.Size),
+		}
+	}
+	var res []ImageLocality
+	for dgst, img := range fs.images {
+		if len(wanted) > 0 && !wanted[dgst] {
+			continue
+		}
+		loc := ImageLocality{Digest: dgst}
+		for ref := range img.refs {
+			loc.Refs = append(loc.Refs, ref)
+		}
+		sort.Strings(loc.Refs)
+		for _, d := range img.layers {
+			l, ok := layers[d]
+			if !ok {
+				l = LayerLocality{Digest: d, Size: img.sizes[d]}
+			}
+			loc.Size += l.Size
+			loc.CachedSize += l.CachedSize
+			loc.Layers = append(loc.Layers, l)
+		}
+		if loc.Size > 0 {
+			loc.CachedRatio = float64(loc.CachedSize) / float64(loc.Size)
+		}
+		res = append(res, loc)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Digest < res[j].Digest })
+	return res
+}
+
+// addImage records the image of the layer mounted on the mountpoint. fs.layerMu must be
+// held.
+func (fs *filesystem) addImage(mountpoint string, src source.Source) {
+	if src.ManifestDigest == "" {
+		return
+	}
+	if fs.images == nil {
+		fs.images = make(map[digest.Digest]*mountedImage)
+	}
+	img, ok := fs.images[src.ManifestDigest]
+	if !ok {
+		img = &mountedImage{
+			refs:        make(map[string]struct{}),
+			sizes:       make(map[digest.Digest]int64),
+			mountpoints: make(map[string]struct{}),
+		}
+		fs.images[src.ManifestDigest] = img
+	}
+	img.refs[src.Name.String()] = struct{}{}
+	img.mountpoints[mountpoint] = struct{}{}
+
+	// The manifest passed through the labels contains the layer and the upper ones (see
+	// source.FromDefaultLabels), so the layers not recorded yet are lower than the recorded
+	// ones.
+	var added []digest.Digest
+	for _, desc := range src.Manifest.Layers {
+		if _, ok := img.sizes[desc.Digest]; !ok {
+			added = append(added, desc.Digest)
+		}
+		img.sizes[desc.Digest] = max(img.sizes[desc.Digest], desc.Size)
+	}
+	img.layers = append(added, img.layers...)
+}
+
+// removeImage removes the mountpoint from the images and forgets the images without
+// mountpoints. fs.layerMu must be held.
+func (fs *filesystem) removeImage(mountpoint string) {
+	for dgst, img := range fs.images {
+		delete(img.mountpoints, mountpoint)
+		if len(img.mountpoints) == 0 {
+			delete(fs.images, dgst)
+		}
+	}
+}
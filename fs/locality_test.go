@@ -0,0 +1,124 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/containerd/containerd/v2/pkg/reference"
+	"github.com/containerd/stargz-snapshotter/fs/layer"
+	"github.com/containerd/stargz-snapshotter/fs/source"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// cachedLayer is a layer partially cached on the node.
+type cachedLayer struct {
+	breakableLayer
+	info layer.Info
+}
+
+func (l *cachedLayer) Info() layer.Info { return l.info }
+
+func TestLocalityReport(t *testing.T) {
+	var (
+		base  = digest.FromString("base")
+		app   = digest.FromString("app")
+		other = digest.FromString("other")
+		img1  = digest.FromString("image1")
+		img2  = digest.FromString("image2")
+	)
+	src := func(ref string, manifest digest.Digest, layers ...digest.Digest) source.Source {
+		s := source.Source{Name: reference.Spec{Locator: ref, Object: "latest"}, ManifestDigest: manifest}
+		for _, l := range layers {
+			s.Manifest.Layers = append(s.Manifest.Layers, ocispec.Descriptor{Digest: l, Size: 1000})
+		}
+		return s
+	}
+	fs := &filesystem{layer: map[string]layer.Layer{
+		"/mnt/1": &cachedLayer{info: layer.Info{Digest: base, Size: 100, FetchedSize: 100}},
+		"/mnt/2": &cachedLayer{info: layer.Info{Digest: app, Size: 300, FetchedSize: 60}},
+		"/mnt/3": &cachedLayer{info: layer.Info{Digest: app, Size: 300, FetchedSize: 60}},
+		"/mnt/4": &cachedLayer{info: layer.Info{Digest: other, Size: 100}},
+	}}
+	// Layers of image1 are mounted from the lowest one and only the upper layer of image2
+	// is mounted because the lower one is shared with image1.
+	fs.addImage("/mnt/1", src("example.com/app", img1, base, app))
+	fs.addImage("/mnt/2", src("example.com/app", img1, app))
+	fs.addImage("/mnt/3", src("example.com/app2", img2, app, other))
+	fs.addImage("/mnt/4", src("example.com/app2", img2, other))
+	fs.addImage("/mnt/5", src("example.com/unknown", "", base))
+
+	r := NewLocalityReporter()
+	if _, err := r.Report(); err == nil {
+		t.Fatalf("reporting without the filesystem must fail")
+	}
+	r.set(fs)
+	got, err := r.Report()
+	if err != nil {
+		t.Fatalf("failed to report: %v", err)
+	}
+	image1 := ImageLocality{
+		Digest:      img1,
+		Refs:        []string{"example.com/app:latest"},
+		Size:        400,
+		CachedSize:  160,
+		CachedRatio: 0.4,
+		Layers: []LayerLocality{
+			{Digest: base, Size: 100, CachedSize: 100},
+			{Digest: app, Size: 300, CachedSize: 60},
+		},
+	}
+	image2 := ImageLocality{
+		Digest:      img2,
+		Refs:        []string{"example.com/app2:latest"},
+		Size:        400,
+		CachedSize:  60,
+		CachedRatio: 0.15,
+		Layers: []LayerLocality{
+			{Digest: app, Size: 300, CachedSize: 60},
+			{Digest: other, Size: 100, CachedSize: 0},
+		},
+	}
+	want := []ImageLocality{image1, image2}
+	if img1 > img2 {
+		want = []ImageLocality{image2, image1}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v; want %+v", got, want)
+	}
+
+	if got, _ := r.Report(img2); !reflect.DeepEqual(got, []ImageLocality{image2}) {
+		t.Errorf("got %+v; want only image2", got)
+	}
+
+	// The layers not mounted anymore are reported with the size in the manifest.
+	delete(fs.layer, "/mnt/4")
+	fs.removeImage("/mnt/4")
+	image2.Size, image2.CachedRatio = 1300, 60.0/1300
+	image2.Layers[1].Size = 1000
+	if got, _ := r.Report(img2); !reflect.DeepEqual(got, []ImageLocality{image2}) {
+		t.Errorf("got %+v; want %+v", got, image2)
+	}
+
+	delete(fs.layer, "/mnt/3")
+	fs.removeImage("/mnt/3")
+	if got, _ := r.Report(img2); len(got) != 0 {
+		t.Errorf("image without mounted layers must not be reported: %+v", got)
+	}
+}
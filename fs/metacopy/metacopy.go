@@ -0,0 +1,397 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package metacopy generates metadata-only lower directories of overlayfs from fully
+// fetched layers. A regular file in a metadata-only lower is an empty file with the
+// overlayfs "metacopy" and "redirect" xattrs pointing to the contents in a data-only
+// lower directory (the "store") shared among layers. The store has the same layout as
+// the object store of composefs ("<store>/xx/yyyy..." named by the sha256 digest of the
+// contents) so files with the same contents are shared across snapshots.
+//
+// Metadata-only lowers are mounted with the store as the data-only lower layer (e.g.
+// "lowerdir=meta2:meta1::store"), which requires Linux 6.5 or later and overlayfs
+// xattrs in the "trusted." namespace.
+package metacopy
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	digest "github.com/opencontainers/go-digest"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	metacopyXattr        = "trusted.overlay.metacopy"
+	redirectXattr        = "trusted.overlay.redirect"
+	overlayXattrPrefix   = "trusted.overlay."
+	overlayOpaqueXattr   = "trusted.overlay.opaque"
+	metadataDirName      = "meta"
+	storeLockFileName    = ".lock"
+	storeTempDirName     = ".tmp"
+	metadataTempDirInfix = "-tmp-"
+)
+
+// MetadataDir returns the directory of the metadata-only lower of the layer mounted on
+// mountpoint. This is placed next to the mountpoint so it's removed together with the
+// snapshot.
+func MetadataDir(mountpoint string) string {
+	return filepath.Join(filepath.Dir(mountpoint), metadataDirName)
+}
+
+// Exists returns true if the metadata-only lower has been generated in dir.
+func Exists(dir string) bool {
+	fi, err := os.Stat(dir)
+	return err == nil && fi.IsDir()
+}
+
+// ObjectPath returns the path of the contents of the digest in the store.
+func ObjectPath(store string, dgst digest.Digest) string {
+	e := dgst.Encoded()
+	return filepath.Join(store, e[:2], e[2:])
+}
+
+// Generate generates the metadata-only lower of the layer tree src (e.g. the mountpoint
+// of a layer) in dst and stores the contents of the regular files in the store. src must
+// be in the format of an overlayfs lower layer (e.g. whiteouts are character devices).
+// dst appears atomically so Exists(dst) returns true only after the generation completes.
+func Generate(src, dst, store string) (retErr error) {
+	unlock, err := lockStore(store, unix.LOCK_SH)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	tmp, err := os.MkdirTemp(filepath.Dir(dst), filepath.Base(dst)+metadataTempDirInfix)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if retErr != nil {
+			os.RemoveAll(tmp)
+		}
+	}()
+	g := &generator{store: store, links: make(map[inode]string)}
+	var dirs []string
+	if err := filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(tmp, rel)
+		if d.IsDir() {
+			dirs = append(dirs, rel)
+		}
+		return g.copyEntry(p, target, rel == ".")
+	}); err != nil {
+		return fmt.Errorf("failed to generate metadata of %q: %w", src, err)
+	}
+	// Modification times of directories are changed while their children are created.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		fi, err := os.Lstat(filepath.Join(src, dirs[i]))
+		if err != nil {
+			return err
+		}
+		if err := setTimes(filepath.Join(tmp, dirs[i]), fi); err != nil {
+			return err
+		}
+	}
+	return os.Rename(tmp, dst)
+}
+
+type inode struct {
+	dev, ino uint64
+}
+
+type generator struct {
+	store string
+	links map[inode]string // inode in the source -> path of the generated file
+}
+
+// copyEntry creates target that has the same metadata as the entry at p. Regular files
+// are created as metacopy files pointing to the contents in the store.
+func (g *generator) copyEntry(p, target string, isRoot bool) error {
+	fi, err := os.Lstat(p)
+	if err != nil {
+		return err
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fmt.Errorf("unsupported stat of %q", p)
+	}
+	switch mode := fi.Mode(); {
+	case isRoot:
+	case mode.IsDir():
+		if err := os.Mkdir(target, 0700); err != nil {
+			return err
+		}
+	case mode&os.ModeSymlink != 0:
+		link, err := os.Readlink(p)
+		if err != nil {
+			return err
+		}
+		if err := os.Symlink(link, target); err != nil {
+			return err
+		}
+	case mode.IsRegular():
+		ino := inode{uint64(st.Dev), st.Ino}
+		if l, ok := g.links[ino]; ok && st.Nlink > 1 {
+			return os.Link(l, target)
+		}
+		dgst, err := g.storeObject(p)
+		if err != nil {
+			return err
+		}
+		f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		err = f.Truncate(fi.Size())
+		if cErr := f.Close(); err == nil {
+			err = cErr
+		}
+		if err != nil {
+			return err
+		}
+		if err := unix.Lsetxattr(target, metacopyXattr, nil, 0); err != nil {
+			return fmt.Errorf("failed to set %q: %w", metacopyXattr, err)
+		}
+		e := dgst.Encoded()
+		if err := unix.Lsetxattr(target, redirectXattr, []byte("/"+e[:2]+"/"+e[2:]), 0); err != nil {
+			return fmt.Errorf("failed to set %q: %w", redirectXattr, err)
+		}
+		g.links[ino] = target
+	default:
+		// Device files, fifos and whiteouts
+		if err := unix.Mknod(target, uint32(st.Mode), int(st.Rdev)); err != nil {
+			return err
+		}
+	}
+	if err := os.Lchown(target, int(st.Uid), int(st.Gid)); err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSymlink == 0 {
+		if err := os.Chmod(target, fi.Mode()); err != nil {
+			return err
+		}
+	}
+	if err := copyXattrs(p, target); err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		return nil // set after the children are created
+	}
+	return setTimes(target, fi)
+}
+
+// storeObject stores the contents of the regular file p in the store and returns the
+// digest. The existing object is reused.
+func (g *generator) storeObject(p string) (_ digest.Digest, retErr error) {
+	r, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	tmpDir := filepath.Join(g.store, storeTempDirName)
+	if err := os.MkdirAll(tmpDir, 0700); err != nil {
+		return "", err
+	}
+	w, err := os.CreateTemp(tmpDir, "object-")
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if retErr != nil {
+			os.Remove(w.Name())
+		}
+	}()
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(w, h), r)
+	if cErr := w.Close(); err == nil {
+		err = cErr
+	}
+	if err != nil {
+		return "", err
+	}
+	dgst := digest.NewDigest(digest.SHA256, h)
+	obj := ObjectPath(g.store, dgst)
+	if _, err := os.Stat(obj); err == nil {
+		return dgst, os.Remove(w.Name())
+	}
+	if err := os.MkdirAll(filepath.Dir(obj), 0700); err != nil {
+		return "", err
+	}
+	if err := os.Chmod(w.Name(), 0444); err != nil {
+		return "", err
+	}
+	return dgst, os.Rename(w.Name(), obj)
+}
+
+// Prune removes the objects in the store that aren't referred to by any of the
+// metadata-only lowers in metaDirs and returns the number of the removed objects.
+// This must not be called while metadata-only lowers are generated in other directories
+// than metaDirs.
+func Prune(store string, metaDirs []string) (removed int, _ error) {
+	unlock, err := lockStore(store, unix.LOCK_EX)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+	used := make(map[string]struct{})
+	for _, dir := range metaDirs {
+		if err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+			if err != nil || !d.Type().IsRegular() {
+				return err
+			}
+			v, err := lgetxattr(p, redirectXattr)
+			if err != nil {
+				return nil // not a metacopy file
+			}
+			used[filepath.Join(store, filepath.FromSlash(string(v)))] = struct{}{}
+			return nil
+		}); err != nil {
+			return removed, fmt.Errorf("failed to scan %q: %w", dir, err)
+		}
+	}
+	// No generation is running so temporary objects are garbage.
+	if err := os.RemoveAll(filepath.Join(store, storeTempDirName)); err != nil {
+		return removed, err
+	}
+	dirs, err := os.ReadDir(store)
+	if err != nil {
+		return removed, err
+	}
+	for _, d := range dirs {
+		if !d.IsDir() || len(d.Name()) != 2 {
+			continue
+		}
+		objs, err := os.ReadDir(filepath.Join(store, d.Name()))
+		if err != nil {
+			return removed, err
+		}
+		for _, o := range objs {
+			p := filepath.Join(store, d.Name(), o.Name())
+			if _, ok := used[p]; ok {
+				continue
+			}
+			if err := os.Remove(p); err != nil {
+				return removed, err
+			}
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+// lockStore locks the store with flock(2) so objects aren't pruned while they are
+// generated.
+func lockStore(store string, how int) (unlock func(), _ error) {
+	if err := os.MkdirAll(store, 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(store, storeLockFileName), os.O_RDONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if err = unix.Flock(int(f.Fd()), how); err != unix.EINTR {
+			break
+		}
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to lock store: %w", err)
+	}
+	return func() { f.Close() }, nil
+}
+
+// copyXattrs copies the xattrs of src to dst. overlayfs xattrs other than the opaque
+// directory indicator are ignored because they would let the layer refer to arbitrary
+// objects in the store.
+func copyXattrs(src, dst string) error {
+	names, err := llistxattr(src)
+	if err != nil {
+		if errors.Is(err, unix.ENOTSUP) {
+			return nil
+		}
+		return err
+	}
+	for _, name := range names {
+		if strings.HasPrefix(name, overlayXattrPrefix) && name != overlayOpaqueXattr {
+			continue
+		}
+		v, err := lgetxattr(src, name)
+		if err != nil {
+			return err
+		}
+		if err := unix.Lsetxattr(dst, name, v, 0); err != nil {
+			return fmt.Errorf("failed to set xattr %q: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func llistxattr(p string) ([]string, error) {
+	for {
+		size, err := unix.Llistxattr(p, nil)
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return nil, nil
+		}
+		buf := make([]byte, size)
+		n, err := unix.Llistxattr(p, buf)
+		if err == unix.ERANGE {
+			continue // grown after the size was got
+		} else if err != nil {
+			return nil, err
+		}
+		return strings.Split(strings.TrimSuffix(string(buf[:n]), "\x00"), "\x00"), nil
+	}
+}
+
+func lgetxattr(p, name string) ([]byte, error) {
+	for {
+		size, err := unix.Lgetxattr(p, name, nil)
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size)
+		n, err := unix.Lgetxattr(p, name, buf)
+		if err == unix.ERANGE {
+			continue // grown after the size was got
+		} else if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+}
+
+func setTimes(p string, fi os.FileInfo) error {
+	st := fi.Sys().(*syscall.Stat_t)
+	ts := []unix.Timespec{unix.NsecToTimespec(syscall.TimespecToNsec(st.Atim)), unix.NsecToTimespec(fi.ModTime().UnixNano())}
+	return unix.UtimesNanoAt(unix.AT_FDCWD, p, ts, unix.AT_SYMLINK_NOFOLLOW)
+}
@@ -0,0 +1,136 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package metacopy
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/containerd/v2/pkg/testutil"
+	digest "github.com/opencontainers/go-digest"
+	"golang.org/x/sys/unix"
+)
+
+func TestGenerate(t *testing.T) {
+	testutil.RequiresRoot(t)
+
+	root := t.TempDir()
+	src, store := filepath.Join(root, "fs"), filepath.Join(root, "objects")
+	for _, dir := range []string{"a/b", "opaque"} {
+		if err := os.MkdirAll(filepath.Join(src, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := map[string]string{
+		"foo":   "foofoo",
+		"a/bar": "barbar",
+		"a/b/c": "foofoo", // same contents as "foo"
+	}
+	for name, contents := range files {
+		if err := os.WriteFile(filepath.Join(src, name), []byte(contents), 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Link(filepath.Join(src, "a/bar"), filepath.Join(src, "a/hardlink")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("foo", filepath.Join(src, "symlink")); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Mknod(filepath.Join(src, "whiteout"), unix.S_IFCHR, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Setxattr(filepath.Join(src, "opaque"), overlayOpaqueXattr, []byte("y"), 0); err != nil {
+		t.Skipf("trusted xattrs are unsupported: %v", err)
+	}
+	// overlayfs xattrs other than opaque must not be copied
+	if err := unix.Setxattr(filepath.Join(src, "a/bar"), redirectXattr, []byte("/malicious"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := MetadataDir(src)
+	if Exists(dst) {
+		t.Fatalf("metadata dir %q must not exist before generation", dst)
+	}
+	if err := Generate(src, dst, store); err != nil {
+		t.Fatalf("failed to generate: %v", err)
+	}
+	if !Exists(dst) {
+		t.Fatalf("metadata dir %q doesn't exist", dst)
+	}
+
+	for name, contents := range files {
+		p := filepath.Join(dst, name)
+		fi, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Size() != int64(len(contents)) || fi.Mode().Perm() != 0640 {
+			t.Errorf("%q: unexpected size %d or mode %v", name, fi.Size(), fi.Mode())
+		}
+		if _, err := lgetxattr(p, metacopyXattr); err != nil {
+			t.Errorf("%q: metacopy xattr isn't set: %v", name, err)
+		}
+		redirect, err := lgetxattr(p, redirectXattr)
+		if err != nil {
+			t.Fatalf("%q: redirect xattr isn't set: %v", name, err)
+		}
+		obj := ObjectPath(store, digest.FromString(contents))
+		if want := obj[len(store):]; string(redirect) != want {
+			t.Errorf("%q: redirect = %q; want %q", name, redirect, want)
+		}
+		data, err := os.ReadFile(obj)
+		if err != nil || string(data) != contents {
+			t.Errorf("%q: unexpected object contents %q (err: %v)", name, data, err)
+		}
+	}
+	var st1, st2 unix.Stat_t
+	if err := unix.Lstat(filepath.Join(dst, "a/bar"), &st1); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Lstat(filepath.Join(dst, "a/hardlink"), &st2); err != nil {
+		t.Fatal(err)
+	}
+	if st1.Ino != st2.Ino {
+		t.Errorf("hardlink isn't preserved")
+	}
+	if link, err := os.Readlink(filepath.Join(dst, "symlink")); err != nil || link != "foo" {
+		t.Errorf("unexpected symlink %q (err: %v)", link, err)
+	}
+	var wst unix.Stat_t
+	if err := unix.Lstat(filepath.Join(dst, "whiteout"), &wst); err != nil || wst.Mode&unix.S_IFMT != unix.S_IFCHR || wst.Rdev != 0 {
+		t.Errorf("whiteout isn't preserved (err: %v)", err)
+	}
+	if v, err := lgetxattr(filepath.Join(dst, "opaque"), overlayOpaqueXattr); err != nil || string(v) != "y" {
+		t.Errorf("opaque xattr isn't preserved %q (err: %v)", v, err)
+	}
+
+	// Objects not referred to by any metadata dirs are pruned.
+	if removed, err := Prune(store, []string{dst}); err != nil || removed != 0 {
+		t.Errorf("unexpected prune of referred objects: %d (err: %v)", removed, err)
+	}
+	if err := os.RemoveAll(filepath.Join(dst, "a")); err != nil {
+		t.Fatal(err)
+	}
+	if removed, err := Prune(store, []string{dst}); err != nil || removed != 1 {
+		t.Errorf("removed %d objects; want 1 (err: %v)", removed, err)
+	}
+	if _, err := os.Stat(ObjectPath(store, digest.FromString("foofoo"))); err != nil {
+		t.Errorf("referred object is pruned: %v", err)
+	}
+}
@@ -39,6 +39,21 @@ const (
 	// BytesServedKey is the key for any metric related to counting bytes served as the part of specific operation.
 	BytesServedKey = "bytes_served"
 
+	// ClockSkewKey is the key for the clock skew of registries against this node.
+	ClockSkewKey = "clock_skew_seconds"
+
+	// HostFetchConcurrencyKey is the key for the number of fetches allowed in flight to each host.
+	HostFetchConcurrencyKey = "host_fetch_concurrency"
+
+	// FileReadLatencyKeyMilliseconds is the key for the latency of reads of files in milliseconds.
+	FileReadLatencyKeyMilliseconds = "file_read_duration_milliseconds"
+
+	// FileReadBytesKey is the key for the number of bytes read from files.
+	FileReadBytesKey = "file_read_bytes"
+
+	// FileRemoteReadCountKey is the key for the count of reads of files fetching chunks.
+	FileRemoteReadCountKey = "file_remote_read_count"
+
 	// Keep namespace as stargz and subsystem as fs.
 	namespace = "stargz"
 	subsystem = "fs"
@@ -62,6 +77,27 @@ const (
 	OnDemandRemoteRegistryFetchCount = "on_demand_remote_registry_fetch_count"
 	OnDemandBytesServed              = "on_demand_bytes_served"
 	OnDemandBytesFetched             = "on_demand_bytes_fetched"
+	OnDemandRegistryUnavailableCount = "on_demand_registry_unavailable_count"
+
+	DedupChunkHitCount = "dedup_chunk_hit_count"
+	DedupBytesServed   = "dedup_bytes_served"
+
+	CachedChunkVerifySkipCount = "cached_chunk_verify_skip_count"
+
+	MergedReadHoleCount    = "merged_read_hole_count"
+	MergedReadOverlapCount = "merged_read_overlap_count"
+
+	FileDigestVerifiedCount = "file_digest_verified_count"
+	FileDigestMismatchCount = "file_digest_mismatch_count"
+
+	HedgedFetchCount    = "hedged_fetch_count"
+	HedgedFetchWinCount = "hedged_fetch_win_count"
+
+	ScrubbedChunkCount       = "scrubbed_chunk_count"
+	ScrubCorruptedChunkCount = "scrub_corrupted_chunk_count"
+
+	ResumedTransferCount      = "resumed_transfer_count"
+	ResumedTransferBytesSaved = "resumed_transfer_bytes_saved"
 
 	// logs metrics
 	PrefetchTotal             = "prefetch_total"
@@ -126,6 +162,63 @@ var (
 		},
 		[]string{"operation_type", "layer"},
 	)
+
+	// clockSkew reflects the clock skew of each registry host against this node, estimated
+	// from the Date headers of the responses.
+	clockSkew = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      ClockSkewKey,
+			Help:      "The clock skew in seconds of registries against this node, estimated from Date headers. Positive if the registry is ahead. Broken down by registry host.",
+		},
+		[]string{"host"},
+	)
+
+	// hostFetchConcurrency reflects the number of fetches allowed in flight to each host,
+	// adapted to the throughput of the host.
+	hostFetchConcurrency = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      HostFetchConcurrencyKey,
+			Help:      "The number of fetches of layer blobs allowed in flight to each host, adapted to the throughput of the host. Broken down by host.",
+		},
+		[]string{"host"},
+	)
+
+	// fileReadLatencyMilliseconds, fileReadBytes and fileRemoteReadCount are observed through
+	// the read hooks of the files (see fs/reader.ReadHooks).
+	fileReadLatencyMilliseconds = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      FileReadLatencyKeyMilliseconds,
+			Help:      "Latency in milliseconds of reads of files. Broken down by the source of the data (cache or remote) and layer sha.",
+			Buckets:   latencyBucketsMilliseconds,
+		},
+		[]string{"source", "layer"},
+	)
+
+	fileReadBytes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      FileReadBytesKey,
+			Help:      "The number of bytes read from files. Broken down by the source of the data (cache or remote) and layer sha.",
+		},
+		[]string{"source", "layer"},
+	)
+
+	fileRemoteReadCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      FileRemoteReadCountKey,
+			Help:      "The count of reads of files fetching chunks from remote. Broken down by layer sha and file path.",
+		},
+		[]string{"layer", "path"},
+	)
 )
 
 var register sync.Once
@@ -153,9 +246,15 @@ func Register(l log.Level) {
 		prometheus.MustRegister(operationLatencyMicroseconds)
 		prometheus.MustRegister(operationCount)
 		prometheus.MustRegister(bytesCount)
+		prometheus.MustRegister(clockSkew)
+		prometheus.MustRegister(hostFetchConcurrency)
+		prometheus.MustRegister(fileReadLatencyMilliseconds)
+		prometheus.MustRegister(fileReadBytes)
+		prometheus.MustRegister(fileRemoteReadCount)
 	})
 }
 
+
 // MeasureLatencyInMilliseconds wraps the labels attachment as well as calling Observe into a single method.
 // Right now we attach the operation and layer digest, so it's possible to see the breakdown for latency
 // by operation and individual layers.
@@ -184,6 +283,28 @@ func AddBytesCount(operation string, layer digest.Digest, bytes int64) {
 	bytesCount.WithLabelValues(operation, layer.String()).Add(float64(bytes))
 }
 
+// SetClockSkew records the clock skew of the registry host against this node.
+func SetClockSkew(host string, skew time.Duration) {
+	clockSkew.WithLabelValues(host).Set(skew.Seconds())
+}
+
+// SetHostFetchConcurrency records the number of fetches allowed in flight to the host.
+func SetHostFetchConcurrency(host string, n int) {
+	hostFetchConcurrency.WithLabelValues(host).Set(float64(n))
+}
+
+// ObserveFileRead records the latency and the number of bytes of a read of a file served
+// from the source (e.g. "cache" or "remote").
+func ObserveFileRead(source string, layer digest.Digest, bytes int, latency time.Duration) {
+	fileReadLatencyMilliseconds.WithLabelValues(source, layer.String()).Observe(float64(latency.Nanoseconds()) / 1e6)
+	fileReadBytes.WithLabelValues(source, layer.String()).Add(float64(bytes))
+}
+
+// IncFileRemoteReadCount counts a read of the file at path fetching chunks from remote.
+func IncFileRemoteReadCount(layer digest.Digest, path string) {
+	fileRemoteReadCount.WithLabelValues(layer.String(), path).Inc()
+}
+
 // WriteLatencyLogValue wraps writing the log info record for latency in milliseconds. The log record breaks down by operation and layer digest.
 func WriteLatencyLogValue(ctx context.Context, layer digest.Digest, operation string, start time.Time) {
 	ctx = log.WithLogger(ctx, log.G(ctx).WithField("metrics", "latency").WithField("operation", operation).WithField("layer_sha", layer.String()))
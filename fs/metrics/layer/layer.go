@@ -49,6 +49,23 @@ var layerMetrics = []*metric{
 			}
 		},
 	},
+	{
+		name: "layer_prefetch_coverage",
+		help: "Fraction of the size of the regular files of the layer the prioritized files constitute",
+		unit: metrics.Unit("ratio"),
+		vt:   prometheus.GaugeValue,
+		getValues: func(l layer.Layer) []value {
+			c := l.Info().PrefetchCoverage
+			if c == nil {
+				return nil
+			}
+			return []value{
+				{
+					v: c.Ratio(),
+				},
+			}
+		},
+	},
 	{
 		name: "layer_size",
 		help: "Total size of the layer",
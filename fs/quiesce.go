@@ -0,0 +1,150 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/containerd/log"
+	"github.com/containerd/stargz-snapshotter/fs/layer"
+	"github.com/containerd/stargz-snapshotter/fs/reader"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// Quiescer fetches the remaining contents of the files recently read from the mounted
+// layers, so the running containers keep working while the registry is unavailable (e.g.
+// under planned maintenance). The reads are taken from the access trace of the filesystem
+// (see AccessTraceSize of the config).
+type Quiescer struct {
+	mu sync.Mutex
+	fs *filesystem
+}
+
+// NewQuiescer returns a Quiescer. Pass it to the filesystem with WithQuiescer.
+func NewQuiescer() *Quiescer {
+	return &Quiescer{}
+}
+
+// WithQuiescer specifies the quiescer of the filesystem so the mounted layers can be
+// quiesced at runtime (e.g. through the admin API).
+func WithQuiescer(q *Quiescer) Option {
+	return func(opts *options) {
+		opts.quiescer = q
+	}
+}
+
+func (q *Quiescer) set(fs *filesystem) {
+	q.mu.Lock()
+	q.fs = fs
+	q.mu.Unlock()
+}
+
+// QuiesceResult is the result of quiescing a mounted layer.
+type QuiesceResult struct {
+	// Layer is the digest of the layer.
+	Layer digest.Digest `json:"layer"`
+
+	// Files is the number of the files read since the specified time.
+	Files int `json:"files"`
+
+	// FetchedSize is the number of bytes of the layer fetched for the files.
+	FetchedSize int64 `json:"fetched_size"`
+
+	// Error is the error of fetching the files.
+	Error string `json:"error,omitempty"`
+}
+
+// Quiesce fetches the remaining contents of the files read since the specified time from
+// the mounted layers. The results are sorted by the digest of the layer. Layers whose files
+// haven't been read aren't included.
+func (q *Quiescer) Quiesce(ctx context.Context, since time.Time) ([]QuiesceResult, error) {
+	q.mu.Lock()
+	fs := q.fs
+	q.mu.Unlock()
+	if fs == nil {
+		return nil, fmt.Errorf("filesystem isn't ready")
+	}
+	trace := fs.resolver.AccessTrace()
+	if trace == nil {
+		return nil, fmt.Errorf("access trace is disabled; set access_trace_size")
+	}
+	accesses, dropped := trace.Snapshot()
+	if dropped > 0 && len(accesses) > 0 && accesses[0].Time.After(since) {
+		log.G(ctx).Warnf("%d reads including ones after %v aren't recorded in the access trace; increase access_trace_size", dropped, since)
+	}
+	files := recentFiles(accesses, since)
+
+	fs.layerMu.Lock()
+	layers := make(map[digest.Digest]layer.Layer)
+	for _, l := range fs.layer {
+		if dgst := l.Info().Digest; len(files[dgst]) > 0 {
+			layers[dgst] = l
+		}
+	}
+	fs.layerMu.Unlock()
+	dgsts := make([]digest.Digest, 0, len(layers))
+	for dgst := range layers {
+		dgsts = append(dgsts, dgst)
+	}
+	sort.Slice(dgsts, func(i, j int) bool { return dgsts[i] < dgsts[j] })
+
+	var results []QuiesceResult
+	for _, dgst := range dgsts {
+		if err := ctx.Err(); err != nil {
+			return results, err
+		}
+		l := layers[dgst]
+		before := l.Info().FetchedSize
+		err := l.PrefetchFiles(files[dgst])
+		res := QuiesceResult{
+			Layer:       dgst,
+			Files:       len(files[dgst]),
+			FetchedSize: l.Info().FetchedSize - before,
+		}
+		if err != nil {
+			log.G(ctx).WithError(err).WithField("digest", dgst).Warn("failed to quiesce layer")
+			res.Error = err.Error()
+		}
+		results = append(results, res)
+	}
+	return results, nil
+}
+
+// recentFiles returns the patterns of the paths of the files read at or after since, keyed
+// by the digest of the layer. Each pattern matches only the path.
+func recentFiles(accesses []reader.Access, since time.Time) map[digest.Digest][]string {
+	seen := make(map[digest.Digest]map[string]struct{})
+	files := make(map[digest.Digest][]string)
+	for _, a := range accesses {
+		if a.Path == "" || a.Time.Before(since) {
+			continue
+		}
+		if seen[a.Layer] == nil {
+			seen[a.Layer] = make(map[string]struct{})
+		}
+		if _, ok := seen[a.Layer][a.Path]; ok {
+			continue
+		}
+		seen[a.Layer][a.Path] = struct{}{}
+		files[a.Layer] = append(files[a.Layer], reader.EscapePathPattern(a.Path))
+	}
+	return files
+}
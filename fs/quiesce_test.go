@@ -0,0 +1,57 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/containerd/stargz-snapshotter/fs/reader"
+	digest "github.com/opencontainers/go-digest"
+)
+
+func TestRecentFiles(t *testing.T) {
+	var (
+		now = time.Now()
+		l1  = digest.FromString("layer1")
+		l2  = digest.FromString("layer2")
+	)
+	accesses := []reader.Access{
+		{Time: now.Add(-time.Hour), Layer: l1, Path: "/old"},
+		{Time: now.Add(-time.Minute), Layer: l1, Path: "/usr/bin/app"},
+		{Time: now.Add(-time.Minute), Layer: l1, Path: "/usr/bin/app", Offset: 4096},
+		{Time: now, Layer: l1, Path: "/data/[a]*?.txt"},
+		{Time: now, Layer: l2, Path: "/usr/bin/app"},
+		{Time: now, Layer: l2, Path: ""}, // path isn't resolved
+	}
+	got := recentFiles(accesses, now.Add(-10*time.Minute))
+	want := map[digest.Digest][]string{
+		l1: {"/usr/bin/app", `/data/\[a]\*\?.txt`},
+		l2: {"/usr/bin/app"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v; want %v", got, want)
+	}
+}
+
+func TestQuiesceNotReady(t *testing.T) {
+	if _, err := NewQuiescer().Quiesce(context.Background(), time.Now()); err == nil {
+		t.Errorf("quiescing without the filesystem must fail")
+	}
+}
@@ -0,0 +1,392 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package reader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/containerd/log"
+	"github.com/containerd/stargz-snapshotter/cache"
+	commonmetrics "github.com/containerd/stargz-snapshotter/fs/metrics/common"
+	"github.com/containerd/stargz-snapshotter/metadata"
+)
+
+// ChunkIndex indexes chunks cached by readers by the chunk digest. This is shared among
+// the readers of layers so the chunks of delta layers (see estargz.WithDeltaBase) that are
+// stored in their base layers are resolved from the cache of the base layers, and chunks
+// cached for a layer are reused by the other layers having the same chunks (see
+// WithChunkDedup).
+//
+// Chunks are reference counted so closing a layer doesn't invalidate its chunks still in use
+// by other layers. A chunk is referenced by the reads in progress from the cache and by the
+// readers of delta layers whose chunks are stored in the base layer until they cache the
+// chunks by themselves. When the reader of a layer is closed, its chunks not referenced are
+// forgotten and the cache is kept open until the rest of them are released.
+type ChunkIndex struct {
+	m map[string][]*indexedChunk
+
+	// refs are the readers referring to the chunks of each digest cached by other layers.
+	refs map[string]map[*sharedResources]struct{}
+
+	// retired are the closed readers whose caches are kept for the referenced chunks.
+	retired map[*sharedResources]*retiredCache
+
+	mu sync.RWMutex
+}
+
+type indexedChunk struct {
+	owner    *sharedResources
+	cache    cache.BlobCache
+	cacheID  string
+	verified bool // verified against the digest when cached
+	reads    int  // reads in progress from the cache
+}
+
+// retiredCache is the cache of a closed reader kept open for the referenced chunks.
+type retiredCache struct {
+	chunks    int // chunks still in the index
+	closeFunc func() error
+}
+
+// NewChunkIndex returns an empty ChunkIndex.
+func NewChunkIndex() *ChunkIndex {
+	return &ChunkIndex{
+		m:       make(map[string][]*indexedChunk),
+		refs:    make(map[string]map[*sharedResources]struct{}),
+		retired: make(map[*sharedResources]*retiredCache),
+	}
+}
+
+// WithChunkIndex makes the reader record the cached chunks to idx and resolve the chunks
+// of the delta layer stored in its base layer from idx. idx should be shared among the
+// readers of layers.
+func WithChunkIndex(idx *ChunkIndex) Option {
+	return func(opts *options) {
+		opts.chunkIndex = idx
+	}
+}
+
+// WithChunkDedup makes the reader try the chunks with the same digest cached by other layers
+// in the chunk index (see WithChunkIndex) before fetching chunks from the sources. The
+// chunks from other layers are verified against the chunk digest unless they have been
+// verified when cached (see WithVerifyCachedChunks). This doesn't apply to prefetch and
+// background fetch, which read ranges of the layer blob at once.
+func WithChunkDedup() Option {
+	return func(opts *options) {
+		opts.chunkDedup = true
+	}
+}
+
+// WithVerifyCachedChunks makes the reader verify the chunks read from the chunk index (i.e.
+// the chunks of other layers used for WithChunkDedup and the chunks of the base layers of
+// delta layers) against the chunk digest even if they have been verified when cached. By
+// default, the verification of such chunks is skipped because the chunk index is keyed by
+// the digest the chunks have been verified against.
+func WithVerifyCachedChunks() Option {
+	return func(opts *options) {
+		opts.verifyCachedChunks = true
+	}
+}
+
+// add records that the chunk is cached in c with cacheID by the reader of owner. verified
+// is true if the chunk has been verified against the digest when cached.
+func (idx *ChunkIndex) add(chunkDigest string, owner *sharedResources, c cache.BlobCache, cacheID string, verified bool) {
+	if idx == nil || chunkDigest == "" {
+		return
+	}
+	idx.mu.Lock()
+	ents := idx.m[chunkDigest]
+	found := false
+	for _, e := range ents {
+		if e.owner == owner {
+			e.verified = e.verified || verified
+			found = true
+			break
+		}
+	}
+	if !found {
+		idx.m[chunkDigest] = append(ents, &indexedChunk{owner: owner, cache: c, cacheID: cacheID, verified: verified})
+	}
+	// The owner doesn't need the chunk of other layers anymore.
+	idx.unrefLocked(chunkDigest, owner)
+	closeFuncs := idx.collectLocked(chunkDigest)
+	idx.mu.Unlock()
+	closeRetired(closeFuncs)
+}
+
+// ref records that the reader of holder refers to the chunk of the digest cached by other
+// layers (e.g. the chunk of the delta layer stored in the base layer) until the holder caches
+// the chunk or is retired.
+func (idx *ChunkIndex) ref(chunkDigest string, holder *sharedResources) {
+	if idx == nil || chunkDigest == "" {
+		return
+	}
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	for _, e := range idx.m[chunkDigest] {
+		if e.owner == holder {
+			return // the holder has the chunk
+		}
+	}
+	if idx.refs[chunkDigest] == nil {
+		idx.refs[chunkDigest] = make(map[*sharedResources]struct{})
+	}
+	idx.refs[chunkDigest][holder] = struct{}{}
+}
+
+func (idx *ChunkIndex) unrefLocked(chunkDigest string, holder *sharedResources) {
+	if holders, ok := idx.refs[chunkDigest]; ok {
+		delete(holders, holder)
+		if len(holders) == 0 {
+			delete(idx.refs, chunkDigest)
+		}
+	}
+}
+
+// retire is called when the reader of owner is closed. The references of the reader are
+// released and the chunks cached by the reader are forgotten unless they are referenced by
+// other readers. The cache of the reader is closed with closeFunc when none of its chunks
+// remains in the index. closeFunc may be called before retire returns.
+func (idx *ChunkIndex) retire(owner *sharedResources, closeFunc func() error) error {
+	if idx == nil {
+		return closeFunc()
+	}
+	idx.mu.Lock()
+	var dgsts []string
+	for dgst, holders := range idx.refs {
+		if _, ok := holders[owner]; ok {
+			dgsts = append(dgsts, dgst)
+		}
+	}
+	for _, dgst := range dgsts {
+		idx.unrefLocked(dgst, owner)
+	}
+	rc := &retiredCache{closeFunc: closeFunc}
+	for dgst, ents := range idx.m {
+		for _, e := range ents {
+			if e.owner == owner {
+				rc.chunks++
+				dgsts = append(dgsts, dgst)
+			}
+		}
+	}
+	kept := rc.chunks > 0
+	if kept {
+		idx.retired[owner] = rc
+	}
+	var closeFuncs []func() error
+	for _, dgst := range dgsts {
+		closeFuncs = append(closeFuncs, idx.collectLocked(dgst)...)
+	}
+	if rc.chunks > 0 {
+		log.L.WithField("chunks", rc.chunks).Debugf("keeping cache of closed layer for the chunks referenced by other layers")
+	}
+	idx.mu.Unlock()
+	closeRetired(closeFuncs) // includes closeFunc if no chunk of the reader is in use
+	if !kept {
+		return closeFunc()
+	}
+	return nil
+}
+
+// collectLocked forgets the chunks of the digest cached by retired readers that aren't in
+// use anymore. A chunk of a retired reader is in use if it's being read, or if it's referenced
+// and no reader that isn't retired has the chunk. This returns the functions to close the
+// caches of the retired readers that don't have chunks in the index anymore.
+func (idx *ChunkIndex) collectLocked(chunkDigest string) (closeFuncs []func() error) {
+	ents := idx.m[chunkDigest]
+	live := false
+	for _, e := range ents {
+		if _, retired := idx.retired[e.owner]; !retired {
+			live = true
+			break
+		}
+	}
+	referenced := len(idx.refs[chunkDigest]) > 0 && !live
+	var remain []*indexedChunk
+	for _, e := range ents {
+		rc, retired := idx.retired[e.owner]
+		if !retired || e.reads > 0 || referenced {
+			remain = append(remain, e)
+			continue
+		}
+		if rc.chunks--; rc.chunks == 0 {
+			delete(idx.retired, e.owner)
+			closeFuncs = append(closeFuncs, rc.closeFunc)
+		}
+	}
+	if len(remain) == 0 {
+		delete(idx.m, chunkDigest)
+	} else {
+		idx.m[chunkDigest] = remain
+	}
+	return closeFuncs
+}
+
+func closeRetired(closeFuncs []func() error) {
+	for _, f := range closeFuncs {
+		if err := f(); err != nil {
+			log.L.WithError(err).Warn("failed to close cache of closed layer")
+		}
+	}
+}
+
+// RefBaseChunks refers to the chunks of the delta layer stored in the base layer so they
+// are kept in the cache of the base layer while this reader is open. This is a no-op unless
+// the reader uses the chunk index (see WithChunkIndex). The files are walked only if the
+// layer has chunks stored in the base layer, but this may block until the metadata is parsed
+// so callers are expected to call this in background.
+func (vr *VerifiableReader) RefBaseChunks() (retErr error) {
+	gr := vr.r
+	if gr.chunkIndex == nil {
+		return nil
+	}
+	r := gr.r
+	has, err := metadata.HasBaseChunks(r)
+	if err != nil {
+		return fmt.Errorf("failed to check base chunks: %w", err)
+	}
+	if !has {
+		return nil
+	}
+	// Keep the reader open while referring so the references are released when it's closed.
+	if !gr.shared.acquire() {
+		return nil
+	}
+	defer func() {
+		retErr = errors.Join(retErr, gr.shared.release())
+	}()
+	return walkCacheTargets(0, r.RootID(), "", r, func(int64) bool { return true }, nil, func(t cacheTarget) error {
+		fr, err := r.OpenFile(t.id)
+		if err != nil {
+			return err
+		}
+		var nr int64
+		for nr < t.attr.Size {
+			chunkOffset, chunkSize, chunkDigestStr, ok := fr.ChunkEntryForOffset(nr)
+			if !ok {
+				break
+			}
+			nr = chunkOffset + chunkSize
+			if isBaseChunk(fr, chunkOffset) {
+				gr.chunkIndex.ref(chunkDigestStr, gr.shared)
+			}
+		}
+		return nil
+	})
+}
+
+// has returns true if any layer has cached the chunk that has the digest.
+func (idx *ChunkIndex) has(chunkDigest string) bool {
+	if idx == nil || chunkDigest == "" {
+		return false
+	}
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	return len(idx.m[chunkDigest]) > 0
+}
+
+// FetchChunk reads the chunk that has the digest from the cache of any layer.
+// ErrChunkNotFound is returned if no layer has cached the chunk.
+func (idx *ChunkIndex) FetchChunk(ctx context.Context, chunk Chunk, p []byte) error {
+	_, err := idx.fetchChunk(chunk, p)
+	return err
+}
+
+// fetchChunk is the same as FetchChunk but also returns whether the chunk has been verified
+// against the digest when cached. Verified chunks are preferred.
+func (idx *ChunkIndex) fetchChunk(chunk Chunk, p []byte) (verified bool, _ error) {
+	if chunk.Digest == "" {
+		return false, ErrChunkNotFound
+	}
+	// The chunks are referenced while being read so the caches aren't closed.
+	idx.mu.Lock()
+	ents := make([]*indexedChunk, 0, len(idx.m[chunk.Digest]))
+	for _, e := range idx.m[chunk.Digest] {
+		e.reads++
+		if e.verified {
+			ents = append([]*indexedChunk{e}, ents...)
+		} else {
+			ents = append(ents, e)
+		}
+	}
+	idx.mu.Unlock()
+	defer func() {
+		idx.mu.Lock()
+		for _, e := range ents {
+			e.reads--
+		}
+		closeFuncs := idx.collectLocked(chunk.Digest)
+		idx.mu.Unlock()
+		closeRetired(closeFuncs)
+	}()
+	for _, e := range ents {
+		r, err := e.cache.Get(e.cacheID)
+		if err != nil {
+			continue // evicted from the cache
+		}
+		n, err := r.ReadAt(p, 0)
+		r.Close()
+		if (err == nil || err == io.EOF) && n == len(p) {
+			return e.verified, nil
+		}
+	}
+	return false, fmt.Errorf("chunk %q isn't cached by any layer: %w", chunk.Digest, ErrChunkNotFound)
+}
+
+// fetchIndexedChunk reads the chunk from the chunk index. The chunk is verified against the
+// digest unless it has been verified when cached and WithVerifyCachedChunks isn't specified.
+func (sf *file) fetchIndexedChunk(p []byte, chunkOffset int64, chunkDigestStr string) (int, error) {
+	verified, err := sf.gr.chunkIndex.fetchChunk(Chunk{
+		Layer:  sf.gr.layerSha,
+		ID:     sf.id,
+		Offset: chunkOffset,
+		Size:   int64(len(p)),
+		Digest: chunkDigestStr,
+	}, p)
+	if err != nil {
+		return 0, err
+	}
+	if verified && !sf.gr.verifyCachedChunks {
+		commonmetrics.IncOperationCount(commonmetrics.CachedChunkVerifySkipCount, sf.gr.layerSha)
+		return len(p), nil
+	}
+	if err := sf.gr.checkChunk(sf.id, p, chunkDigestStr); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// fetchDedupChunk reads the chunk from the cache of the layer that has the same chunk. This
+// returns false if no layer has cached the chunk.
+func (sf *file) fetchDedupChunk(ctx context.Context, p []byte, chunkOffset int64, chunkDigestStr string) (int, bool) {
+	if !sf.gr.chunkDedup || !sf.gr.chunkIndex.has(chunkDigestStr) {
+		return 0, false
+	}
+	n, err := sf.fetchIndexedChunk(p, chunkOffset, chunkDigestStr)
+	if err != nil {
+		log.G(ctx).WithError(err).Debugf("failed to read chunk at %d of file %d from other layers", chunkOffset, sf.id)
+		return 0, false
+	}
+	commonmetrics.IncOperationCount(commonmetrics.DedupChunkHitCount, sf.gr.layerSha)
+	commonmetrics.AddBytesCount(commonmetrics.DedupBytesServed, sf.gr.layerSha, int64(n))
+	return n, true
+}
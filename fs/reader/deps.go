@@ -0,0 +1,167 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package reader
+
+import (
+	"bytes"
+	"debug/elf"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+// ErrUnknownExecutableFormat is returned if the file is neither an ELF file nor a script
+// starting with "#!".
+var ErrUnknownExecutableFormat = errors.New("unknown executable format")
+
+// maxShebangSize is the maximum size of the "#!" line of scripts read for the interpreter.
+// Linux reads up to 256 bytes.
+const maxShebangSize = 256
+
+// Dependencies is the files an executable needs to run.
+type Dependencies struct {
+	// Interpreter is the path of the program interpreter of the ELF file (i.e. the dynamic
+	// linker) or the interpreter of the script. Empty if there is none.
+	Interpreter string
+
+	// Command is the name of the command the script runs through env(1) (e.g. "python3" of
+	// "#!/usr/bin/env python3"). It is looked up in PATH. Empty if there is none.
+	Command string
+
+	// Libraries are the sonames of the shared libraries the ELF file needs (DT_NEEDED).
+	Libraries []string
+
+	// LibraryPaths are the directories searched for the libraries before the default ones
+	// (DT_RUNPATH or DT_RPATH). "$ORIGIN" in the paths must be expanded by the caller.
+	LibraryPaths []string
+
+	// DefaultLibraryPaths are the default directories of the shared libraries for the
+	// architecture of the ELF file.
+	DefaultLibraryPaths []string
+}
+
+// ParseDependencies parses the ELF headers or the "#!" line of the executable and returns
+// the files it needs to run. ErrUnknownExecutableFormat is returned if the file is neither
+// an ELF file nor a script.
+func ParseDependencies(ra io.ReaderAt, size int64) (Dependencies, error) {
+	var magic [4]byte
+	if size < 2 {
+		return Dependencies{}, ErrUnknownExecutableFormat
+	}
+	n, err := ra.ReadAt(magic[:min(size, int64(len(magic)))], 0)
+	if err != nil && err != io.EOF {
+		return Dependencies{}, err
+	}
+	switch {
+	case n == len(magic) && string(magic[:]) == elf.ELFMAG:
+		return parseELFDependencies(io.NewSectionReader(ra, 0, size))
+	case string(magic[:2]) == "#!":
+		return parseScriptDependencies(ra, size)
+	}
+	return Dependencies{}, ErrUnknownExecutableFormat
+}
+
+func parseELFDependencies(sr *io.SectionReader) (Dependencies, error) {
+	f, err := elf.NewFile(sr)
+	if err != nil {
+		return Dependencies{}, fmt.Errorf("failed to parse ELF header: %w", err)
+	}
+	defer f.Close()
+	if f.Type != elf.ET_EXEC && f.Type != elf.ET_DYN {
+		return Dependencies{}, ErrUnknownExecutableFormat
+	}
+	var deps Dependencies
+	for _, p := range f.Progs {
+		if p.Type != elf.PT_INTERP {
+			continue
+		}
+		b, err := io.ReadAll(io.LimitReader(p.Open(), 4096))
+		if err != nil {
+			return Dependencies{}, fmt.Errorf("failed to read program interpreter: %w", err)
+		}
+		deps.Interpreter = string(bytes.TrimRight(b, "\x00"))
+	}
+	if deps.Libraries, err = f.DynString(elf.DT_NEEDED); err != nil {
+		return Dependencies{}, fmt.Errorf("failed to read needed libraries: %w", err)
+	}
+	runpath, err := f.DynString(elf.DT_RUNPATH)
+	if err != nil {
+		return Dependencies{}, fmt.Errorf("failed to read runpath: %w", err)
+	}
+	if len(runpath) == 0 {
+		// DT_RPATH is used only if DT_RUNPATH doesn't exist.
+		if runpath, err = f.DynString(elf.DT_RPATH); err != nil {
+			return Dependencies{}, fmt.Errorf("failed to read rpath: %w", err)
+		}
+	}
+	for _, r := range runpath {
+		for _, dir := range strings.Split(r, ":") {
+			if dir != "" {
+				deps.LibraryPaths = append(deps.LibraryPaths, dir)
+			}
+		}
+	}
+	deps.DefaultLibraryPaths = defaultLibraryPaths(f.Class, f.Machine)
+	return deps, nil
+}
+
+// defaultLibraryPaths returns the directories where the dynamic linker looks for shared
+// libraries by default, including the multiarch directories of Debian-based distributions.
+func defaultLibraryPaths(class elf.Class, machine elf.Machine) (dirs []string) {
+	triplet := map[elf.Machine]string{
+		elf.EM_X86_64:  "x86_64-linux-gnu",
+		elf.EM_386:     "i386-linux-gnu",
+		elf.EM_AARCH64: "aarch64-linux-gnu",
+		elf.EM_ARM:     "arm-linux-gnueabihf",
+		elf.EM_PPC64:   "powerpc64le-linux-gnu",
+		elf.EM_S390:    "s390x-linux-gnu",
+		elf.EM_RISCV:   "riscv64-linux-gnu",
+	}[machine]
+	if triplet != "" {
+		dirs = append(dirs, "/lib/"+triplet, "/usr/lib/"+triplet)
+	}
+	if class == elf.ELFCLASS64 {
+		dirs = append(dirs, "/lib64", "/usr/lib64")
+	}
+	return append(dirs, "/lib", "/usr/lib", "/usr/local/lib")
+}
+
+func parseScriptDependencies(ra io.ReaderAt, size int64) (Dependencies, error) {
+	b := make([]byte, min(size, maxShebangSize))
+	if _, err := ra.ReadAt(b, 0); err != nil && err != io.EOF {
+		return Dependencies{}, err
+	}
+	line, _, _ := bytes.Cut(b[2:], []byte("\n"))
+	fields := strings.Fields(string(line))
+	if len(fields) == 0 {
+		return Dependencies{}, ErrUnknownExecutableFormat
+	}
+	deps := Dependencies{Interpreter: fields[0]}
+	if path.Base(fields[0]) == "env" {
+		// Skip the options (e.g. "-S") and the environment variables passed to the command.
+		for _, f := range fields[1:] {
+			if strings.HasPrefix(f, "-") || strings.Contains(f, "=") {
+				continue
+			}
+			deps.Command = f
+			break
+		}
+	}
+	return deps, nil
+}
@@ -0,0 +1,60 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package reader
+
+import (
+	"fmt"
+	"io"
+)
+
+// WithStrictEOF makes reads of files follow the contract of io.ReaderAt at the end of files:
+//
+//   - A read straddling the end of the file returns the bytes up to the end with io.EOF.
+//   - A read at or past the end of the file (including any read of an empty file) returns
+//     0 with io.EOF.
+//   - A read with an empty buffer returns 0 with nil at any non-negative offset.
+//   - A read returning fewer bytes than requested before the end of the file (i.e. the chunks
+//     of the file don't cover its size) fails with io.ErrUnexpectedEOF instead of returning
+//     a short read.
+//
+// Holes of sparse files are read as zeros and reads at negative offsets fail in both modes.
+// By default, reads return the bytes up to the end of the file with nil and don't check that
+// the chunks cover the file.
+func WithStrictEOF() Option {
+	return func(opts *options) {
+		opts.strictEOF = true
+	}
+}
+
+// checkOffset returns an error if a read can't start at offset.
+func (sf *file) checkOffset(offset int64) error {
+	if offset < 0 {
+		return fmt.Errorf("invalid offset %d: negative offset", offset)
+	}
+	return nil
+}
+
+// readResult returns the result of a read of p at offset that has read n bytes.
+func (sf *file) readResult(p []byte, offset int64, n int) (int, error) {
+	if !sf.gr.strictEOF || n == len(p) {
+		return n, nil
+	}
+	if end := offset + int64(n); end < sf.size {
+		return n, fmt.Errorf("read %d bytes at %d of file of %d bytes: %w", n, offset, sf.size, io.ErrUnexpectedEOF)
+	}
+	return n, io.EOF
+}
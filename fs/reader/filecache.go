@@ -0,0 +1,88 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package reader
+
+import (
+	"sync"
+
+	"github.com/containerd/stargz-snapshotter/metadata"
+	"github.com/golang/groupcache/lru"
+)
+
+// WithOpenFileCache keeps up to size files opened by OpenFile so that files opened again
+// (e.g. shared libraries loaded by each process) don't resolve the metadata of the file
+// (e.g. the chunks of the file stored in the metadata store) again. Each handle returned by
+// OpenFile still has its own state (e.g. the readahead window). Default is 0 (disabled).
+func WithOpenFileCache(size int) Option {
+	return func(opts *options) {
+		opts.openFileCacheSize = size
+	}
+}
+
+// openedFile is the metadata of a file resolved by OpenFile, shared among the handles of
+// the file.
+type openedFile struct {
+	fr       metadata.File
+	size     int64
+	unitSize int64
+}
+
+// openFileCache is the LRU of the files opened through a reader. This isn't shared among
+// clones because the files read the blob of the reader.
+type openFileCache struct {
+	size int
+
+	mu    sync.Mutex
+	files *lru.Cache
+}
+
+func newOpenFileCache(size int) *openFileCache {
+	if size <= 0 {
+		return nil
+	}
+	return &openFileCache{size: size, files: lru.New(size)}
+}
+
+// clone returns an empty cache of the same size.
+func (c *openFileCache) clone() *openFileCache {
+	if c == nil {
+		return nil
+	}
+	return newOpenFileCache(c.size)
+}
+
+func (c *openFileCache) get(id uint32) (*openedFile, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f, ok := c.files.Get(id)
+	if !ok {
+		return nil, false
+	}
+	return f.(*openedFile), true
+}
+
+func (c *openFileCache) add(id uint32, f *openedFile) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.files.Add(id, f)
+}
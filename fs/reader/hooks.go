@@ -0,0 +1,104 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package reader
+
+import (
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+// ReadSource is where the data of a read of a file is served from.
+type ReadSource string
+
+const (
+	// ReadSourceCache means that all chunks of the read are served from the cache (or are
+	// holes of a sparse file).
+	ReadSourceCache ReadSource = "cache"
+
+	// ReadSourceRemote means that the read fetches some chunks from the layer blob or the
+	// chunk sources.
+	ReadSourceRemote ReadSource = "remote"
+)
+
+// ReadEvent describes a read of a file.
+type ReadEvent struct {
+	// Layer is the digest of the layer blob.
+	Layer digest.Digest
+
+	// Path is the absolute path of the file in the layer (e.g. "/a/b"). This is empty if
+	// the path can't be resolved.
+	Path string
+
+	// Offset is the offset of the read in the file.
+	Offset int64
+
+	// Size is the number of bytes requested.
+	Size int
+}
+
+// ReadStats is the result of a read of a file.
+type ReadStats struct {
+	// Bytes is the number of bytes read.
+	Bytes int
+
+	// Source is where the data is served from.
+	Source ReadSource
+
+	// Latency is the duration of the read.
+	Latency time.Duration
+
+	// Err is the error of the read.
+	Err error
+}
+
+// ReadHooks observes the reads of files (e.g. for exporting metrics). The hooks are called
+// synchronously on the read path so they must return quickly. They must be safe for
+// concurrent use because files are read in parallel. Reads of prefetch, background fetch
+// and readahead aren't observed.
+type ReadHooks interface {
+	// OnReadStart is called before a read of a file starts.
+	OnReadStart(ev ReadEvent)
+
+	// OnReadDone is called after the read finishes.
+	OnReadDone(ev ReadEvent, stats ReadStats)
+}
+
+// WithReadHooks specifies the hooks called on reads of files. By default, no hook is called.
+func WithReadHooks(hooks ReadHooks) Option {
+	return func(opts *options) {
+		opts.readHooks = hooks
+	}
+}
+
+// pathOf returns the path of the file in the layer. This is resolved on the first call.
+func (sf *file) pathOf() string {
+	sf.pathOnce.Do(func() {
+		sf.path, _ = sf.gr.r.PathOf(sf.id)
+	})
+	return sf.path
+}
+
+// readEvent returns the event of the read of size bytes at offset of the file.
+func (sf *file) readEvent(offset int64, size int) ReadEvent {
+	return ReadEvent{
+		Layer:  sf.gr.layerSha,
+		Path:   sf.pathOf(),
+		Offset: offset,
+		Size:   size,
+	}
+}
@@ -0,0 +1,117 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package reader
+
+import (
+	"context"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// FetchLimiter limits the chunks fetched in parallel (i.e. the fetch units of model files
+// and the merge of files for passthrough) by the number of fetches and the total size of
+// the chunks being fetched. This is shared among the readers of layers to limit the
+// fetches of the node.
+type FetchLimiter struct {
+	workers  *semaphore.Weighted
+	bytes    *semaphore.Weighted
+	maxBytes int64
+}
+
+// NewFetchLimiter returns a FetchLimiter that allows workers fetches of chunks whose total
+// size is up to maxInflightBytes at once. Zero or a negative value means no limit. Chunks
+// larger than maxInflightBytes are fetched one at a time.
+func NewFetchLimiter(workers int, maxInflightBytes int64) *FetchLimiter {
+	if workers <= 0 && maxInflightBytes <= 0 {
+		return nil
+	}
+	l := &FetchLimiter{maxBytes: maxInflightBytes}
+	if workers > 0 {
+		l.workers = semaphore.NewWeighted(int64(workers))
+	}
+	if maxInflightBytes > 0 {
+		l.bytes = semaphore.NewWeighted(maxInflightBytes)
+	}
+	return l
+}
+
+// WithFetchConcurrency limits the chunks fetched in parallel by the reader (and its clones)
+// to workers fetches and maxInflightBytes bytes. workers also replaces the default number
+// of chunks of a fetch unit of a model file fetched in parallel. Zero or a negative value
+// means the default (no limit of the layer).
+func WithFetchConcurrency(workers int, maxInflightBytes int64) Option {
+	return func(opts *options) {
+		opts.fetchWorkers = workers
+		opts.fetchMaxInflightBytes = maxInflightBytes
+	}
+}
+
+// WithFetchLimiter limits the chunks fetched in parallel by the reader with l in addition
+// to the limit of WithFetchConcurrency. l should be shared among the readers of layers.
+func WithFetchLimiter(l *FetchLimiter) Option {
+	return func(opts *options) {
+		opts.fetchLimiter = l
+	}
+}
+
+// acquire waits until a chunk of size can be fetched. The returned function must be called
+// when the fetch is done.
+func (l *FetchLimiter) acquire(ctx context.Context, size int64) (release func(), _ error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	if l.workers != nil {
+		if err := l.workers.Acquire(ctx, 1); err != nil {
+			return nil, err
+		}
+	}
+	n := min(size, l.maxBytes)
+	if l.bytes != nil {
+		if err := l.bytes.Acquire(ctx, n); err != nil {
+			if l.workers != nil {
+				l.workers.Release(1)
+			}
+			return nil, err
+		}
+	}
+	return func() {
+		if l.bytes != nil {
+			l.bytes.Release(n)
+		}
+		if l.workers != nil {
+			l.workers.Release(1)
+		}
+	}, nil
+}
+
+// acquireFetch waits until a chunk of size can be fetched under both of the limits of the
+// layer and the node.
+func (gr *reader) acquireFetch(ctx context.Context, size int64) (release func(), _ error) {
+	releaseLayer, err := gr.layerLimiter.acquire(ctx, size)
+	if err != nil {
+		return nil, err
+	}
+	releaseGlobal, err := gr.fetchLimiter.acquire(ctx, size)
+	if err != nil {
+		releaseLayer()
+		return nil, err
+	}
+	return func() {
+		releaseGlobal()
+		releaseLayer()
+	}, nil
+}
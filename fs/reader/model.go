@@ -0,0 +1,450 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package reader
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sync"
+
+	"github.com/containerd/stargz-snapshotter/cache"
+	"github.com/containerd/stargz-snapshotter/metadata"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/singleflight"
+)
+
+// modelFetchConcurrency is the default max number of chunks fetched in parallel for a
+// fetch unit of a model file.
+const modelFetchConcurrency = 8
+
+// ErrUnknownModelFormat is returned by ModelIndexSize when the file is neither safetensors
+// nor GGUF.
+var ErrUnknownModelFormat = errors.New("unknown model format")
+
+// WithModelFiles enables the model serving mode for the files whose base names match.
+// When a read of a model file misses the cache, all chunks in the fetchUnitSize-aligned
+// region containing the read are fetched in parallel and written to the disk cache
+// directly so that the following reads (e.g. page faults on the mmapped file) don't
+// access the remote blob and the region doesn't evict other data from the memory cache.
+func WithModelFiles(match func(name string) bool, fetchUnitSize int64) Option {
+	return func(opts *options) {
+		opts.modelMatch = match
+		opts.modelFetchUnitSize = fetchUnitSize
+	}
+}
+
+// modelFiles is the model files of a layer, shared among a reader and its clones.
+type modelFiles struct {
+	match    func(name string) bool
+	unitSize int64
+
+	idsOnce sync.Once
+	ids     map[uint32]struct{}
+
+	// fetches deduplicates concurrent fetches of the same unit.
+	fetches singleflight.Group
+}
+
+func newModelFiles(match func(name string) bool, unitSize int64) *modelFiles {
+	if match == nil || unitSize <= 0 {
+		return nil
+	}
+	return &modelFiles{match: match, unitSize: unitSize}
+}
+
+// fetchUnitSize returns the size of the fetch unit of the file or 0 if the file isn't a model file.
+func (m *modelFiles) fetchUnitSize(r metadata.Reader, id uint32) int64 {
+	if m == nil {
+		return 0
+	}
+	m.idsOnce.Do(func() {
+		m.ids = make(map[uint32]struct{})
+		// Failure of walking only disables the model serving mode for the unvisited files.
+		_ = walkFiles(r, r.RootID(), 0, func(name string, id uint32) {
+			if m.match(name) {
+				m.ids[id] = struct{}{}
+			}
+		})
+	})
+	if _, ok := m.ids[id]; !ok {
+		return 0
+	}
+	return m.unitSize
+}
+
+// walkFiles calls f for each regular file under the directory.
+func walkFiles(r metadata.Reader, dirID uint32, depth int, f func(name string, id uint32)) error {
+	if depth > maxWalkDepth {
+		return fmt.Errorf("tree is too deep (depth:%d)", depth)
+	}
+	var err error
+	if forErr := r.ForeachChild(dirID, func(name string, id uint32, mode os.FileMode) bool {
+		if mode.IsDir() {
+			if err = walkFiles(r, id, depth+1, f); err != nil {
+				return false
+			}
+		} else if mode.IsRegular() {
+			f(name, id)
+		}
+		return true
+	}); forErr != nil {
+		return forErr
+	}
+	return err
+}
+
+// fetchUnit fetches and caches the uncached chunks in the unit starting at unitOffset.
+// The fetch isn't bound to ctx of the read but to the handles of the file so canceling
+// the read (e.g. interrupted FUSE request) leaves the fetch running for the following
+// reads. ctx only stops waiting for it.
+func (sf *file) fetchUnit(ctx context.Context, unitOffset, unitSize int64) error {
+	key := fmt.Sprintf("%d-%d", sf.id, unitOffset)
+	for retried := false; ; retried = true {
+		ch := sf.gr.model.fetches.DoChan(key, func() (any, error) {
+			return nil, sf.fetchUnitChunks(unitOffset, unitSize)
+		})
+		select {
+		case res := <-ch:
+			// The fetch started by the handles closed before this file was opened
+			// is canceled. Fetch it again with this file.
+			if !retried && errors.Is(res.Err, context.Canceled) && sf.fetchCtx.Err() == nil {
+				continue
+			}
+			return res.Err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (sf *file) fetchUnitChunks(unitOffset, unitSize int64) error {
+	var chunks []chunkData
+	for offset := unitOffset; offset < unitOffset+unitSize; {
+		chunkOffset, chunkSize, chunkDigestStr, ok := sf.fr.ChunkEntryForOffset(offset)
+		if !ok || chunkSize <= 0 {
+			break
+		}
+		offset = chunkOffset + chunkSize
+		if isHole(sf.fr, chunkOffset) {
+			continue
+		}
+		if r, err := sf.gr.cache.Get(genID(sf.id, chunkOffset, chunkSize)); err == nil {
+			r.Close()
+			continue
+		}
+		chunks = append(chunks, chunkData{offset: chunkOffset, size: chunkSize, digestStr: chunkDigestStr})
+	}
+
+	concurrency := modelFetchConcurrency
+	if sf.gr.fetchWorkers > 0 {
+		concurrency = sf.gr.fetchWorkers
+	}
+	var eg errgroup.Group
+	eg.SetLimit(concurrency)
+	for _, c := range chunks {
+		eg.Go(func() error {
+			if err := sf.fetchCtx.Err(); err != nil {
+				return err // all handles of the file are closed
+			}
+			release, err := sf.gr.acquireFetch(sf.fetchCtx, c.size)
+			if err != nil {
+				return err
+			}
+			defer release()
+			b := sf.gr.bufPool.Get().(*bytes.Buffer)
+			defer sf.gr.putBuffer(b)
+			b.Reset()
+			b.Grow(int(c.size))
+			ip := b.Bytes()[:c.size]
+			_, verified, err := sf.fetchChunk(sf.fetchCtx, ip, c.offset, c.digestStr)
+			if err != nil {
+				return fmt.Errorf("failed to read chunk at offset %d: %w", c.offset, err)
+			}
+			if verified {
+				sf.gr.countFetch(ip)
+			} else if err := sf.gr.verifyOneChunk(sf.id, ip, c.digestStr); err != nil {
+				return err
+			}
+			// Write the chunk to the disk synchronously so it stays cached.
+			sf.gr.cacheData(ip, genID(sf.id, c.offset, c.size), cache.Direct())
+			sf.gr.indexChunk(c.digestStr, genID(sf.id, c.offset, c.size), verified || sf.gr.verify)
+			return nil
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		if ctxErr := sf.fetchCtx.Err(); ctxErr != nil {
+			return ctxErr // canceled by closing the file
+		}
+		return err
+	}
+	return nil
+}
+
+// PrefetchModelIndexes caches the indexes (headers) of the safetensors and GGUF files
+// whose base names match. Model loaders read the index first to locate tensors so
+// caching it in advance shortens the startup of model servers. Files in unknown
+// formats are ignored.
+func PrefetchModelIndexes(r Reader, match func(name string) bool) error {
+	var ids []uint32
+	if err := walkFiles(r.Metadata(), r.Metadata().RootID(), 0, func(name string, id uint32) {
+		if match(name) {
+			ids = append(ids, id)
+		}
+	}); err != nil {
+		return err
+	}
+	var errs []error
+	for _, id := range ids {
+		if err := prefetchModelIndex(r, id); err != nil && !errors.Is(err, ErrUnknownModelFormat) {
+			errs = append(errs, fmt.Errorf("failed to prefetch index of file %d: %w", id, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func prefetchModelIndex(r Reader, id uint32) error {
+	attr, err := r.Metadata().GetAttr(id)
+	if err != nil {
+		return err
+	}
+	ra, err := r.OpenFile(id)
+	if err != nil {
+		return err
+	}
+	n, err := ModelIndexSize(ra, attr.Size)
+	if err != nil {
+		return err
+	}
+	// Parsing reads only a part of the index. Read the remaining.
+	_, err = io.Copy(io.Discard, io.NewSectionReader(ra, 0, n))
+	return err
+}
+
+// ModelIndexSize returns the size of the index at the head of the safetensors or GGUF file.
+// The index contains the names, shapes and offsets of the tensors stored after it.
+// ErrUnknownModelFormat is returned if the file is in neither format.
+func ModelIndexSize(ra io.ReaderAt, size int64) (int64, error) {
+	var magic [8]byte
+	if size < int64(len(magic)) {
+		return 0, ErrUnknownModelFormat
+	}
+	if _, err := ra.ReadAt(magic[:], 0); err != nil {
+		return 0, err
+	}
+	if string(magic[:4]) == "GGUF" {
+		return ggufIndexSize(io.NewSectionReader(ra, 0, size))
+	}
+
+	// safetensors starts with the little-endian size of the JSON header.
+	hdrSize := binary.LittleEndian.Uint64(magic[:])
+	if hdrSize == 0 || hdrSize > uint64(size-8) {
+		return 0, ErrUnknownModelFormat
+	}
+	var b [1]byte
+	if _, err := ra.ReadAt(b[:], 8); err != nil {
+		return 0, err
+	}
+	if b[0] != '{' {
+		return 0, ErrUnknownModelFormat
+	}
+	return 8 + int64(hdrSize), nil
+}
+
+const (
+	ggufTypeUint8 = iota
+	ggufTypeInt8
+	ggufTypeUint16
+	ggufTypeInt16
+	ggufTypeUint32
+	ggufTypeInt32
+	ggufTypeFloat32
+	ggufTypeBool
+	ggufTypeString
+	ggufTypeArray
+	ggufTypeUint64
+	ggufTypeInt64
+	ggufTypeFloat64
+)
+
+const (
+	ggufDefaultAlignment = 32
+	ggufMaxArrayDepth    = 8
+)
+
+// ggufIndexSize parses the GGUF header, the metadata and the tensor infos and returns
+// the offset of the aligned tensor data.
+func ggufIndexSize(sr *io.SectionReader) (int64, error) {
+	g := &ggufReader{r: bufio.NewReader(sr), size: sr.Size()}
+	if _, err := g.bytes(4); err != nil { // magic
+		return 0, err
+	}
+	version := g.uint32()
+	if g.err == nil && version < 2 {
+		return 0, fmt.Errorf("unsupported GGUF version %d", version)
+	}
+	tensorCount := g.uint64()
+	kvCount := g.uint64()
+	alignment := uint64(ggufDefaultAlignment)
+	for i := uint64(0); i < kvCount && g.err == nil; i++ {
+		key := g.string()
+		typ := g.uint32()
+		if key == "general.alignment" && typ == ggufTypeUint32 {
+			if alignment = uint64(g.uint32()); alignment == 0 {
+				return 0, fmt.Errorf("invalid GGUF alignment 0")
+			}
+			continue
+		}
+		g.skipValue(typ, 0)
+	}
+	for i := uint64(0); i < tensorCount && g.err == nil; i++ {
+		g.string() // name
+		nDims := g.uint32()
+		g.skip(8 * uint64(nDims)) // dimensions
+		g.uint32()                // type
+		g.uint64()                // offset
+	}
+	if g.err != nil {
+		return 0, fmt.Errorf("failed to parse GGUF header: %w", g.err)
+	}
+	off := uint64(g.off)
+	if r := off % alignment; r != 0 {
+		off += alignment - r
+	}
+	if off > uint64(g.size) {
+		off = uint64(g.size)
+	}
+	return int64(off), nil
+}
+
+type ggufReader struct {
+	r    *bufio.Reader
+	off  int64
+	size int64
+	err  error
+}
+
+func (g *ggufReader) bytes(n uint64) ([]byte, error) {
+	if g.err != nil {
+		return nil, g.err
+	}
+	if n > uint64(g.size-g.off) {
+		g.err = fmt.Errorf("size %d at offset %d exceeds the file size %d", n, g.off, g.size)
+		return nil, g.err
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(g.r, b); err != nil {
+		g.err = err
+		return nil, err
+	}
+	g.off += int64(n)
+	return b, nil
+}
+
+func (g *ggufReader) skip(n uint64) {
+	if g.err != nil {
+		return
+	}
+	if n > uint64(g.size-g.off) {
+		g.err = fmt.Errorf("size %d at offset %d exceeds the file size %d", n, g.off, g.size)
+		return
+	}
+	if _, err := g.r.Discard(int(n)); err != nil {
+		g.err = err
+		return
+	}
+	g.off += int64(n)
+}
+
+func (g *ggufReader) uint32() uint32 {
+	b, err := g.bytes(4)
+	if err != nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(b)
+}
+
+func (g *ggufReader) uint64() uint64 {
+	b, err := g.bytes(8)
+	if err != nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint64(b)
+}
+
+func (g *ggufReader) string() string {
+	b, err := g.bytes(g.uint64())
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
+
+func (g *ggufReader) skipValue(typ uint32, depth int) {
+	if g.err != nil {
+		return
+	}
+	if size := ggufFixedSize(typ); size > 0 {
+		g.skip(size)
+		return
+	}
+	switch typ {
+	case ggufTypeString:
+		g.skip(g.uint64())
+	case ggufTypeArray:
+		if depth > ggufMaxArrayDepth {
+			g.err = fmt.Errorf("too deeply nested GGUF arrays")
+			return
+		}
+		elemTyp := g.uint32()
+		count := g.uint64()
+		if elemSize := ggufFixedSize(elemTyp); elemSize > 0 {
+			if count > math.MaxUint64/elemSize {
+				g.err = fmt.Errorf("too large GGUF array (count:%d)", count)
+				return
+			}
+			g.skip(count * elemSize)
+			return
+		}
+		for i := uint64(0); i < count && g.err == nil; i++ {
+			g.skipValue(elemTyp, depth+1)
+		}
+	default:
+		g.err = fmt.Errorf("unknown GGUF value type %d", typ)
+	}
+}
+
+// ggufFixedSize returns the size of the value of the type or 0 if the size isn't fixed.
+func ggufFixedSize(typ uint32) uint64 {
+	switch typ {
+	case ggufTypeUint8, ggufTypeInt8, ggufTypeBool:
+		return 1
+	case ggufTypeUint16, ggufTypeInt16:
+		return 2
+	case ggufTypeUint32, ggufTypeInt32, ggufTypeFloat32:
+		return 4
+	case ggufTypeUint64, ggufTypeInt64, ggufTypeFloat64:
+		return 8
+	}
+	return 0
+}
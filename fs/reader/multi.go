@@ -0,0 +1,170 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package reader
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"fmt"
+	"io"
+	"slices"
+
+	"github.com/containerd/log"
+)
+
+// maxCoalescedFetchSize is the max size of the adjacent chunks fetched from the blob at once
+// by ReadAtMulti.
+const maxCoalescedFetchSize = 16 << 20
+
+// Range is a range of a file read by ReadAtMulti.
+type Range struct {
+	// Offset is the offset of the range in the file.
+	Offset int64
+
+	// P is the buffer the range is read into. The size of the range is len(P).
+	P []byte
+
+	// N is the number of the bytes read into P. This is set by ReadAtMulti.
+	N int
+}
+
+// MultiReaderAt is implemented by the files of the reader that can read several ranges at
+// once (e.g. adjacent reads issued by the FUSE readahead).
+type MultiReaderAt interface {
+	ReadAtMulti(ctx context.Context, ranges []Range) error
+}
+
+// ReadAtMulti reads the ranges of the file. The chunks of the ranges missed in the cache are
+// fetched together: each run of adjacent chunks is fetched with one read of the layer blob and
+// decompressed and cached in one pass instead of being fetched chunk by chunk, which reduces
+// the number of the requests to the registry on sequential scans. Then each range is read
+// in the same way as ReadAtContext. The ranges are read in order and this returns the error of
+// the first range failed to be read (io.EOF if it is at the end of the file with
+// WithStrictEOF) leaving the following ranges unread.
+func (sf *file) ReadAtMulti(ctx context.Context, ranges []Range) error {
+	for _, r := range ranges {
+		if err := sf.checkOffset(r.Offset); err != nil {
+			return err
+		}
+	}
+	fetched := make(map[int64]bool)
+	if sf.canCoalesce() {
+		for _, run := range sf.missedRuns(ranges) {
+			// The chunks failed to be fetched here are fetched again by the reads.
+			if err := sf.fetchRun(ctx, run, fetched); err != nil {
+				log.G(ctx).WithError(err).Debugf("failed to fetch %d chunks at %d of file %d at once", len(run), run[0].offset, sf.id)
+				break
+			}
+		}
+	}
+	for i := range ranges {
+		n, err := sf.readAtContext(ctx, ranges[i].P, ranges[i].Offset, fetched)
+		ranges[i].N = n
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// canCoalesce returns true if the missed chunks of the file can be fetched from the blob
+// at once. Model files are already fetched in large units and the chunks are taken from
+// other sources first if configured.
+func (sf *file) canCoalesce() bool {
+	return sf.unitSize <= 0 && len(sf.gr.sources) > 0 && sf.gr.sources[0].ChunkSource == nil
+}
+
+// missedRuns returns the runs of the adjacent chunks of the ranges that need to be fetched
+// from the blob. Holes, chunks of the base layer and chunks in the cache are excluded.
+func (sf *file) missedRuns(ranges []Range) (runs [][]chunkData) {
+	var chunks []chunkData
+	seen := make(map[int64]bool)
+	for _, r := range ranges {
+		for offset := r.Offset; offset < r.Offset+int64(len(r.P)); {
+			chunkOffset, chunkSize, chunkDigestStr, ok := sf.fr.ChunkEntryForOffset(offset)
+			if !ok || chunkSize <= 0 {
+				break
+			}
+			offset = chunkOffset + chunkSize
+			if seen[chunkOffset] {
+				continue
+			}
+			seen[chunkOffset] = true
+			if isHole(sf.fr, chunkOffset) || isBaseChunk(sf.fr, chunkOffset) {
+				continue
+			}
+			if cr, err := sf.gr.cache.Get(genID(sf.id, chunkOffset, chunkSize)); err == nil {
+				cr.Close()
+				continue
+			}
+			chunks = append(chunks, chunkData{offset: chunkOffset, size: chunkSize, digestStr: chunkDigestStr})
+		}
+	}
+	slices.SortFunc(chunks, func(a, b chunkData) int {
+		return cmp.Compare(a.offset, b.offset)
+	})
+	var run []chunkData
+	var runSize int64
+	for _, c := range chunks {
+		if len(run) > 0 && (run[len(run)-1].offset+run[len(run)-1].size != c.offset || runSize+c.size > maxCoalescedFetchSize) {
+			runs = append(runs, run)
+			run, runSize = nil, 0
+		}
+		c.bufferPos = runSize
+		run = append(run, c)
+		runSize += c.size
+	}
+	if len(run) > 0 {
+		runs = append(runs, run)
+	}
+	return runs
+}
+
+// fetchRun fetches the run of the adjacent chunks with one read of the blob and caches them.
+// The offsets of the chunks cached are recorded to fetched.
+func (sf *file) fetchRun(ctx context.Context, run []chunkData, fetched map[int64]bool) error {
+	last := run[len(run)-1]
+	size := last.bufferPos + last.size
+	fr, err := sf.blobFile(ctx)
+	if err != nil {
+		return err
+	}
+	done := sf.gr.readLatency.start()
+	defer done()
+	b := sf.gr.bufPool.Get().(*bytes.Buffer)
+	defer sf.gr.putBuffer(b)
+	b.Reset()
+	b.Grow(int(size))
+	buf := b.Bytes()[:size]
+	if n, err := fr.ReadAt(buf, run[0].offset); err != nil && err != io.EOF {
+		return err
+	} else if int64(n) != size {
+		return fmt.Errorf("unexpected data size %d; want %d", n, size)
+	}
+	for _, c := range run {
+		ip := buf[c.bufferPos : c.bufferPos+c.size]
+		if err := sf.gr.transformChunk(ctx, sf.id, c.offset, ip, c.digestStr); err != nil {
+			return err
+		}
+		if err := sf.gr.verifyAndCache(sf.id, ip, c.digestStr, genID(sf.id, c.offset, c.size), false); err != nil {
+			return err
+		}
+		fetched[c.offset] = true
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package reader
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// WithCancelOnClose cancels the speculative fetches of a file (i.e. the fetch units of
+// model files) when all handles of the file are closed and the file isn't opened again
+// within grace. Short-lived processes that open and close many files then don't leave
+// downloads of data nobody reads. Handles are closed using io.Closer implemented by the
+// files returned by OpenFile. Files that are never closed keep their fetches running.
+func WithCancelOnClose(grace time.Duration) Option {
+	return func(opts *options) {
+		opts.cancelOnClose = true
+		opts.cancelGrace = grace
+	}
+}
+
+// openFiles tracks the open handles of the files of a layer, shared among a reader and
+// its clones.
+type openFiles struct {
+	grace time.Duration
+
+	mu    sync.Mutex
+	files map[uint32]*openFile
+}
+
+// openFile is a file with open handles or in the grace period after all of them are closed.
+type openFile struct {
+	refs   int
+	ctx    context.Context // canceled when the grace period ends
+	cancel context.CancelFunc
+	timer  *time.Timer // non-nil during the grace period
+}
+
+func newOpenFiles(enable bool, grace time.Duration) *openFiles {
+	if !enable {
+		return nil
+	}
+	return &openFiles{grace: grace, files: make(map[uint32]*openFile)}
+}
+
+// open adds a handle of the file and returns the context of the speculative fetches of
+// the file. The context is canceled after all handles are closed.
+func (o *openFiles) open(id uint32) context.Context {
+	if o == nil {
+		return context.Background()
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	f, ok := o.files[id]
+	if !ok {
+		f = &openFile{}
+		f.ctx, f.cancel = context.WithCancel(context.Background())
+		o.files[id] = f
+	}
+	if f.timer != nil {
+		// Reopened within the grace period. The timer that already fired sees that
+		// it's no longer the timer of the file.
+		f.timer.Stop()
+		f.timer = nil
+	}
+	f.refs++
+	return f.ctx
+}
+
+// close removes a handle of the file. When it's the last one, the speculative fetches
+// of the file are canceled after the grace period.
+func (o *openFiles) close(id uint32) {
+	if o == nil {
+		return
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	f, ok := o.files[id]
+	if !ok {
+		return
+	}
+	if f.refs--; f.refs > 0 {
+		return
+	}
+	if o.grace <= 0 {
+		o.expire(id, f)
+		return
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(o.grace, func() {
+		o.mu.Lock()
+		defer o.mu.Unlock()
+		if f.timer == timer { // not reopened
+			o.expire(id, f)
+		}
+	})
+	f.timer = timer
+}
+
+// expire cancels the speculative fetches of the file. o.mu must be held.
+func (o *openFiles) expire(id uint32, f *openFile) {
+	f.cancel()
+	delete(o.files, id)
+}
@@ -0,0 +1,181 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package reader
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// WithPathFilter makes Cache cache only the files whose paths in the layer match any of
+// the glob patterns. Patterns are matched by path.Match for each path element, and "**"
+// matches zero or more elements (e.g. "/usr/bin/**" matches all files under /usr/bin).
+// Directories where no file can match aren't walked. This is combined with WithFilter.
+func WithPathFilter(globs []string) CacheOption {
+	return func(opts *cacheOptions) {
+		opts.pathGlobs = globs
+	}
+}
+
+// WithPathExclusion makes Cache skip the files whose paths in the layer match any of the
+// glob patterns, which are matched in the same way as WithPathFilter. Files under matching
+// directories are skipped as well and these directories aren't walked. This is combined
+// with WithPathFilter.
+func WithPathExclusion(globs []string) CacheOption {
+	return func(opts *cacheOptions) {
+		opts.excludeGlobs = globs
+	}
+}
+
+// WithPathSkip makes Cache skip the files and the directories whose paths in the layer make
+// skip return true (e.g. paths hidden by upper layers). Files under skipped directories are
+// skipped as well. This is combined with WithPathFilter and WithPathExclusion.
+func WithPathSkip(skip func(p string) bool) CacheOption {
+	return func(opts *cacheOptions) {
+		opts.skip = skip
+	}
+}
+
+// EscapePathPattern escapes the characters of the path that are special in the patterns of
+// WithPathFilter so the returned pattern matches only the path.
+func EscapePathPattern(p string) string {
+	var b strings.Builder
+	for _, c := range p {
+		switch c {
+		case '*', '?', '[', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// pathFilter matches paths of files in the layer against glob patterns.
+type pathFilter struct {
+	patterns [][]string // elements of the patterns; empty matches all paths
+	excludes [][]string // elements of the patterns of the excluded paths
+	skip     func(p string) bool
+}
+
+func newPathFilter(globs, excludeGlobs []string, skip func(p string) bool) (*pathFilter, error) {
+	if len(globs) == 0 && len(excludeGlobs) == 0 && skip == nil {
+		return nil, nil
+	}
+	f := &pathFilter{skip: skip}
+	var err error
+	if f.patterns, err = splitPatterns(globs); err != nil {
+		return nil, err
+	}
+	if f.excludes, err = splitPatterns(excludeGlobs); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func splitPatterns(globs []string) (patterns [][]string, _ error) {
+	for _, g := range globs {
+		elems := splitPath(g)
+		for _, e := range elems {
+			if _, err := path.Match(e, ""); err != nil {
+				return nil, fmt.Errorf("invalid path pattern %q: %w", g, err)
+			}
+		}
+		patterns = append(patterns, elems)
+	}
+	return patterns, nil
+}
+
+// match returns true if the file path matches any of the patterns and isn't excluded.
+func (f *pathFilter) match(p string) bool {
+	return f.matchElems(splitPath(p), false)
+}
+
+// matchDir returns true if files under the directory can match any of the patterns and the
+// directory isn't excluded.
+func (f *pathFilter) matchDir(dir string) bool {
+	return f.matchElems(splitPath(dir), true)
+}
+
+func (f *pathFilter) matchElems(elems []string, prefix bool) bool {
+	if f == nil {
+		return true
+	}
+	if f.excluded(elems) {
+		return false
+	}
+	if f.skip != nil && f.skip(strings.Join(elems, "/")) {
+		return false
+	}
+	if len(f.patterns) == 0 {
+		return true
+	}
+	for _, p := range f.patterns {
+		if matchElems(p, elems, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// excluded returns true if the path or any of its parent directories matches the patterns
+// of the excluded paths.
+func (f *pathFilter) excluded(elems []string) bool {
+	for _, p := range f.excludes {
+		for i := 1; i <= len(elems); i++ {
+			if matchElems(p, elems[:i], false) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchElems matches the path elements against the pattern elements. If prefix is true,
+// this returns true if the path can be a prefix of a matching path.
+func matchElems(pattern, elems []string, prefix bool) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			if matchElems(pattern[1:], elems, prefix) {
+				return true
+			}
+			if len(elems) == 0 {
+				return prefix
+			}
+			elems = elems[1:] // "**" consumes an element
+			continue
+		}
+		if len(elems) == 0 {
+			return prefix
+		}
+		if ok, _ := path.Match(pattern[0], elems[0]); !ok {
+			return false
+		}
+		pattern, elems = pattern[1:], elems[1:]
+	}
+	return len(elems) == 0
+}
+
+// splitPath returns the elements of the path. The path is treated as relative to the root
+// of the layer.
+func splitPath(p string) []string {
+	p = strings.Trim(path.Clean("/"+p), "/")
+	if p == "" {
+		return nil
+	}
+	return strings.Split(p, "/")
+}
@@ -0,0 +1,70 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package reader
+
+import (
+	"github.com/containerd/log"
+)
+
+// CacheProgress records the chunks cached by VerifiableReader.Cache so a later Cache on the
+// same cache (e.g. after a restart of the snapshotter) resumes from them.
+type CacheProgress interface {
+	// Done returns true if the chunk of the cache ID has been recorded as cached.
+	Done(cacheID string) bool
+
+	// Add records the chunk of the cache ID as cached.
+	Add(cacheID string) error
+}
+
+// WithCacheProgress specifies the progress of Cache. Chunks recorded as cached are skipped
+// by Cache without being scheduled or throttled as long as they are still in the cache.
+// Chunks that aren't in the cache anymore (e.g. written asynchronously and lost on a crash)
+// are cached again.
+func WithCacheProgress(p CacheProgress) Option {
+	return func(opts *options) {
+		opts.cacheProgress = p
+	}
+}
+
+// cachedByProgress returns true if the chunk is recorded as cached and is still in the cache.
+func (gr *reader) cachedByProgress(id uint32, chunkOffset, chunkSize int64, chunkDigest string) bool {
+	if gr.cacheProgress == nil {
+		return false
+	}
+	cacheID := genID(id, chunkOffset, chunkSize)
+	if !gr.cacheProgress.Done(cacheID) {
+		return false
+	}
+	r, err := gr.cache.Get(cacheID)
+	if err != nil {
+		return false
+	}
+	r.Close()
+	gr.indexChunk(chunkDigest, cacheID, false) // may be cached before this reader verifies
+	return true
+}
+
+// recordCached records the chunk of the cache ID in the progress of Cache. Failing to record
+// only makes the next Cache check the chunk again.
+func (gr *reader) recordCached(cacheID string) {
+	if gr.cacheProgress == nil || gr.cacheProgress.Done(cacheID) {
+		return
+	}
+	if err := gr.cacheProgress.Add(cacheID); err != nil {
+		log.L.WithError(err).Debugf("failed to record progress of caching layer %v", gr.layerSha)
+	}
+}
@@ -0,0 +1,142 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package reader
+
+import (
+	"bytes"
+	"sync"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// WithReadahead enables adaptive readahead of files. When a file is read sequentially
+// through a handle, the chunks following the read are fetched and cached in background
+// so the next reads hit the cache. The readahead window starts at twice the size of the
+// read, doubles on each sequential read up to maxWindow bytes and is reset on random
+// access. Model files aren't read ahead because they are fetched in units.
+func WithReadahead(maxWindow int64) Option {
+	return func(opts *options) {
+		opts.readaheadMaxWindow = maxWindow
+	}
+}
+
+// readaheads deduplicates the chunks read ahead through the handles of the files of a
+// layer, shared among a reader and its clones.
+type readaheads struct {
+	maxWindow int64
+	fetches   singleflight.Group
+}
+
+func newReadaheads(maxWindow int64) *readaheads {
+	if maxWindow <= 0 {
+		return nil
+	}
+	return &readaheads{maxWindow: maxWindow}
+}
+
+// readahead is the state of the readahead of a file handle.
+type readahead struct {
+	mu      sync.Mutex
+	lastEnd int64 // end of the last read
+	window  int64 // 0 means the access isn't sequential
+	next    int64 // offset of the next chunk to read ahead
+	target  int64 // end of the region to read ahead
+	running bool  // a goroutine is reading ahead
+}
+
+// readahead updates the readahead window with the read of n bytes at offset and starts
+// reading ahead the chunks following the read if the access is sequential.
+func (sf *file) readahead(offset int64, n int) {
+	ras := sf.gr.readaheads
+	if ras == nil || sf.unitSize > 0 || n <= 0 {
+		return
+	}
+	ra := &sf.ra
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	end := offset + int64(n)
+	if offset != ra.lastEnd {
+		// Random access. Stop reading ahead.
+		ra.lastEnd, ra.window, ra.target = end, 0, 0
+		return
+	}
+	ra.lastEnd = end
+	ra.window = min(max(2*ra.window, 2*int64(n)), ras.maxWindow)
+	ra.next = max(ra.next, end)
+	if ra.target = end + ra.window; ra.next < ra.target && !ra.running {
+		ra.running = true
+		go sf.runReadahead()
+	}
+}
+
+// runReadahead fetches and caches the chunks in the readahead window until it reaches
+// the target or the access becomes random.
+func (sf *file) runReadahead() {
+	ra := &sf.ra
+	for {
+		ra.mu.Lock()
+		offset := ra.next
+		if offset >= ra.target {
+			ra.running = false
+			ra.mu.Unlock()
+			return
+		}
+		ra.mu.Unlock()
+
+		chunkOffset, chunkSize, chunkDigestStr, ok := sf.fr.ChunkEntryForOffset(offset)
+		if ok && chunkSize > 0 && !isHole(sf.fr, chunkOffset) {
+			ok = sf.readaheadChunk(chunkOffset, chunkSize, chunkDigestStr) == nil
+		}
+
+		ra.mu.Lock()
+		if !ok || chunkSize <= 0 {
+			// Reached the end of the file or failed. Following reads fetch chunks on demand.
+			ra.next, ra.running = ra.target, false
+			ra.mu.Unlock()
+			return
+		}
+		ra.next = max(ra.next, chunkOffset+chunkSize)
+		ra.mu.Unlock()
+	}
+}
+
+// readaheadChunk fetches and caches the chunk unless it's cached.
+func (sf *file) readaheadChunk(chunkOffset, chunkSize int64, chunkDigestStr string) error {
+	id := genID(sf.id, chunkOffset, chunkSize)
+	_, err, _ := sf.gr.readaheads.fetches.Do(id, func() (any, error) {
+		if r, err := sf.gr.cache.Get(id); err == nil {
+			r.Close()
+			return nil, nil
+		}
+		release, err := sf.gr.acquireFetch(sf.fetchCtx, chunkSize)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+		b := sf.gr.bufPool.Get().(*bytes.Buffer)
+		defer sf.gr.putBuffer(b)
+		b.Reset()
+		b.Grow(int(chunkSize))
+		ip := b.Bytes()[:chunkSize]
+		_, verified, err := sf.fetchChunk(sf.fetchCtx, ip, chunkOffset, chunkDigestStr)
+		if err != nil {
+			return nil, err
+		}
+		return nil, sf.gr.verifyAndCache(sf.id, ip, chunkDigestStr, id, verified)
+	})
+	return err
+}
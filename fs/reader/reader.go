@@ -31,11 +31,14 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path"
 	"runtime"
+	"slices"
 	"sort"
 	"sync"
 	"time"
 
+	"github.com/containerd/log"
 	"github.com/containerd/stargz-snapshotter/cache"
 	"github.com/containerd/stargz-snapshotter/estargz"
 	commonmetrics "github.com/containerd/stargz-snapshotter/fs/metrics/common"
@@ -58,6 +61,12 @@ type PassthroughFdGetter interface {
 	GetPassthroughFd(mergeBufferSize int64, mergeWorkerCount int) (uintptr, cache.Reader, error)
 }
 
+// CacheChecker is implemented by files that can report whether all of their
+// contents are available in the cache.
+type CacheChecker interface {
+	Cached() bool
+}
+
 // VerifiableReader produces a Reader with a given verifier.
 type VerifiableReader struct {
 	r *reader
@@ -108,6 +117,12 @@ func (vr *VerifiableReader) VerifyTOC(tocDigest digest.Digest) (Reader, error) {
 	return vr.r, nil
 }
 
+// CacheCompressed returns true if the contents are cached compressed (see
+// cache.NewCompressedCache). Such contents can't be read with FUSE passthrough.
+func (vr *VerifiableReader) CacheCompressed() bool {
+	return cache.IsCompressed(vr.r.cache)
+}
+
 func (vr *VerifiableReader) Metadata() metadata.Reader {
 	// TODO: this shouldn't be called before verified
 	return vr.r.r
@@ -139,17 +154,64 @@ func (vr *VerifiableReader) Cache(opts ...CacheOption) (err error) {
 	if cacheOpts.filter != nil {
 		filter = cacheOpts.filter
 	}
+	paths, err := newPathFilter(cacheOpts.pathGlobs, cacheOpts.excludeGlobs, cacheOpts.skip)
+	if err != nil {
+		return err
+	}
+
+	concurrency := runtime.GOMAXPROCS(0)
+	if cacheOpts.maxConcurrency > 0 {
+		concurrency = cacheOpts.maxConcurrency
+	}
+	throttle := newCacheThrottle(cacheOpts, gr.readLatency)
 
 	eg, egCtx := errgroup.WithContext(context.Background())
+	sem := semaphore.NewWeighted(int64(concurrency))
 	eg.Go(func() error {
-		return vr.cacheWithReader(egCtx,
-			0, eg, semaphore.NewWeighted(int64(runtime.GOMAXPROCS(0))),
-			rootID, r, filter, cacheOpts.cacheOpts...)
+		if cacheOpts.priority == nil {
+			return walkCacheTargets(0, rootID, "", r, filter, paths, func(t cacheTarget) error {
+				return vr.cacheFile(egCtx, eg, sem, throttle, r, t, cacheOpts.cacheOpts...)
+			})
+		}
+
+		// Cache files in the order of the priority. Files of the same priority are
+		// cached in the order of the blob.
+		var targets []cacheTarget
+		if err := walkCacheTargets(0, rootID, "", r, filter, paths, func(t cacheTarget) error {
+			t.priority = cacheOpts.priority(t.name, t.attr)
+			targets = append(targets, t)
+			return nil
+		}); err != nil {
+			return err
+		}
+		sort.SliceStable(targets, func(i, j int) bool {
+			if targets[i].priority != targets[j].priority {
+				return targets[i].priority > targets[j].priority
+			}
+			return targets[i].offset < targets[j].offset
+		})
+		for _, t := range targets {
+			if err := vr.cacheFile(egCtx, eg, sem, throttle, r, t, cacheOpts.cacheOpts...); err != nil {
+				return err
+			}
+		}
+		return nil
 	})
 	return eg.Wait()
 }
 
-func (vr *VerifiableReader) cacheWithReader(ctx context.Context, currentDepth int, eg *errgroup.Group, sem *semaphore.Weighted, dirID uint32, r metadata.Reader, filter func(int64) bool, opts ...cache.Option) (rErr error) {
+// cacheTarget is a regular file to be cached.
+type cacheTarget struct {
+	id       uint32
+	name     string
+	attr     metadata.Attr
+	offset   int64
+	priority int
+}
+
+// walkCacheTargets calls f for each regular file under the directory that needs to be cached.
+// dir is the path of the directory in the layer.
+func walkCacheTargets(currentDepth int, dirID uint32, dir string, r metadata.Reader, filter func(int64) bool, paths *pathFilter, f func(cacheTarget) error) (rErr error) {
 	if currentDepth > maxWalkDepth {
 		return fmt.Errorf("tree is too deep (depth:%d)", currentDepth)
 	}
@@ -169,7 +231,11 @@ func (vr *VerifiableReader) cacheWithReader(ctx context.Context, currentDepth in
 				return true
 			}
 
-			if err := vr.cacheWithReader(ctx, currentDepth+1, eg, sem, id, r, filter, opts...); err != nil {
+			if !paths.matchDir(path.Join(dir, name)) {
+				// No file under this directory needs to be cached
+				return true
+			}
+			if err := walkCacheTargets(currentDepth+1, id, path.Join(dir, name), r, filter, paths, f); err != nil {
 				rErr = err
 				return false
 			}
@@ -180,6 +246,9 @@ func (vr *VerifiableReader) cacheWithReader(ctx context.Context, currentDepth in
 		} else if dirID == rootID && name == estargz.TOCTarName {
 			// We don't need to cache TOC json file
 			return true
+		} else if !paths.match(path.Join(dir, name)) {
+			// This file isn't matched by the path patterns
+			return true
 		}
 
 		offset, err := r.GetOffset(id)
@@ -192,41 +261,60 @@ func (vr *VerifiableReader) cacheWithReader(ctx context.Context, currentDepth in
 			return true
 		}
 
-		fr, err := r.OpenFileWithPreReader(id, func(nid uint32, chunkOffset, chunkSize int64, chunkDigest string, r io.Reader) (retErr error) {
-			return vr.readAndCache(nid, r, chunkOffset, chunkSize, chunkDigest, opts...)
-		})
-		if err != nil {
+		if err := f(cacheTarget{id: id, name: name, attr: e, offset: offset}); err != nil {
 			rErr = err
 			return false
 		}
+		return true
+	})
 
-		var nr int64
-		for nr < e.Size {
-			chunkOffset, chunkSize, chunkDigestStr, ok := fr.ChunkEntryForOffset(nr)
-			if !ok {
-				break
-			}
-			nr += chunkSize
+	return
+}
 
-			if err := sem.Acquire(ctx, 1); err != nil {
-				rErr = err
-				return false
-			}
+// cacheFile caches all chunks of the file in parallel using eg.
+func (vr *VerifiableReader) cacheFile(ctx context.Context, eg *errgroup.Group, sem *semaphore.Weighted, throttle *cacheThrottle, r metadata.Reader, t cacheTarget, opts ...cache.Option) error {
+	id := t.id
+	fr, err := r.OpenFileWithPreReader(id, func(nid uint32, chunkOffset, chunkSize int64, chunkDigest string, r io.Reader) (retErr error) {
+		return vr.readAndCache(nid, r, chunkOffset, chunkSize, chunkDigest, opts...)
+	})
+	if err != nil {
+		return err
+	}
 
-			eg.Go(func() error {
-				defer sem.Release(1)
-				err := vr.readAndCache(id, io.NewSectionReader(fr, chunkOffset, chunkSize), chunkOffset, chunkSize, chunkDigestStr, opts...)
-				if err != nil {
-					return fmt.Errorf("failed to read %q (off:%d,size:%d): %w", name, chunkOffset, chunkSize, err)
-				}
-				return nil
-			})
+	var nr int64
+	for nr < t.attr.Size {
+		chunkOffset, chunkSize, chunkDigestStr, ok := fr.ChunkEntryForOffset(nr)
+		if !ok {
+			break
+		}
+		nr += chunkSize
+		if isHole(fr, chunkOffset) {
+			continue // holes don't need to be cached
+		}
+		if isBaseChunk(fr, chunkOffset) {
+			continue // base chunks are resolved from the base layer on demand
+		}
+		if vr.r.cachedByProgress(id, chunkOffset, chunkSize, chunkDigestStr) {
+			continue // cached by the previous Cache on this cache
 		}
 
-		return true
-	})
+		if err := throttle.wait(ctx, chunkSize); err != nil {
+			return err
+		}
+		if err := sem.Acquire(ctx, 1); err != nil {
+			return err
+		}
 
-	return
+		eg.Go(func() error {
+			defer sem.Release(1)
+			err := vr.readAndCache(id, io.NewSectionReader(fr, chunkOffset, chunkSize), chunkOffset, chunkSize, chunkDigestStr, opts...)
+			if err != nil {
+				return fmt.Errorf("failed to read %q (off:%d,size:%d): %w", t.name, chunkOffset, chunkSize, err)
+			}
+			return nil
+		})
+	}
+	return nil
 }
 
 func (vr *VerifiableReader) readAndCache(id uint32, fr io.Reader, chunkOffset, chunkSize int64, chunkDigest string, opts ...cache.Option) (retErr error) {
@@ -240,14 +328,28 @@ func (vr *VerifiableReader) readAndCache(id uint32, fr io.Reader, chunkOffset, c
 	cacheID := genID(id, chunkOffset, chunkSize)
 	if r, err := gr.cache.Get(cacheID); err == nil {
 		r.Close()
+		gr.indexChunk(chunkDigest, cacheID, false) // may be cached before this reader verifies
+		gr.recordCached(cacheID)
 		return nil
 	}
 
 	// missed cache, needs to fetch and add it to the cache
 	br := bufio.NewReaderSize(fr, int(chunkSize))
-	if _, err := br.Peek(int(chunkSize)); err != nil {
+	ip, err := br.Peek(int(chunkSize))
+	if err != nil {
 		return fmt.Errorf("cacheWithReader.peek: %v", err)
 	}
+	var src io.Reader = br
+	if len(gr.transformers) > 0 {
+		b := gr.bufPool.Get().(*bytes.Buffer)
+		defer gr.putBuffer(b)
+		b.Reset()
+		b.Write(ip)
+		if err := gr.transformChunk(context.Background(), id, chunkOffset, b.Bytes(), chunkDigest); err != nil {
+			return err
+		}
+		src = bytes.NewReader(b.Bytes())
+	}
 	w, err := gr.cache.Add(cacheID, opts...)
 	if err != nil {
 		return err
@@ -267,12 +369,12 @@ func (vr *VerifiableReader) readAndCache(id uint32, fr io.Reader, chunkOffset, c
 	if v != nil {
 		tee = io.Writer(v) // verification is required
 	}
-	if _, err := io.CopyN(w, io.TeeReader(br, tee), chunkSize); err != nil {
+	if _, err := io.CopyN(w, io.TeeReader(src, tee), chunkSize); err != nil {
 		w.Abort()
 		return fmt.Errorf("failed to cache file payload: %w", err)
 	}
 	if v != nil && !v.Verified() {
-		err := fmt.Errorf("invalid chunk")
+		err := ErrInvalidChunk
 		vr.prohibitVerifyFailureMu.RLock()
 		if vr.prohibitVerifyFailure {
 			vr.prohibitVerifyFailureMu.RUnlock()
@@ -283,7 +385,12 @@ func (vr *VerifiableReader) readAndCache(id uint32, fr io.Reader, chunkOffset, c
 		vr.prohibitVerifyFailureMu.RUnlock()
 	}
 
-	return w.Commit()
+	if err := w.Commit(); err != nil {
+		return err
+	}
+	gr.indexChunk(chunkDigest, cacheID, v != nil && v.Verified())
+	gr.recordCached(cacheID)
+	return nil
 }
 
 func (vr *VerifiableReader) Close() error {
@@ -296,6 +403,75 @@ func (vr *VerifiableReader) Close() error {
 	return vr.r.Close()
 }
 
+// Flush waits until the data of the layer kept in memory by the cache (e.g. in write-back
+// mode) is written to the cache directory.
+func (vr *VerifiableReader) Flush() error {
+	if f, ok := vr.r.cache.(cache.Flusher); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// Clone returns a VerifiableReader of the same layer that reads the blob from sr. The
+// returned reader shares the metadata and the cache with vr so the layer doesn't need to
+// be resolved again. sr must provide the same blob as vr. The returned reader needs to be
+// verified separately. The shared resources are released when vr and all of its clones are
+// closed.
+func (vr *VerifiableReader) Clone(sr *io.SectionReader) (*VerifiableReader, error) {
+	if vr.isClosed() {
+		return nil, fmt.Errorf("reader is already closed")
+	}
+	gr := vr.r
+	if !gr.shared.acquire() {
+		return nil, fmt.Errorf("reader is already closed")
+	}
+	r, err := gr.r.Clone(sr)
+	if err != nil {
+		gr.shared.release()
+		return nil, err
+	}
+	return &VerifiableReader{
+		r: &reader{
+			r:     r,
+			cache: gr.cache,
+			bufPool: sync.Pool{
+				New: func() any {
+					return new(bytes.Buffer)
+				},
+			},
+			layerSha:   gr.layerSha,
+			verifier:   digestVerifier,
+			sources:    gr.sources,
+			model:      gr.model,
+			chunkIndex: gr.chunkIndex,
+			chunkDedup: gr.chunkDedup,
+			openFiles:  gr.openFiles,
+			shared:     gr.shared,
+			sr:         sr,
+
+			openFileCache: gr.openFileCache.clone(),
+
+			verifyCachedChunks: gr.verifyCachedChunks,
+			strictEOF:          gr.strictEOF,
+
+			fetchWorkers: gr.fetchWorkers,
+			layerLimiter: gr.layerLimiter,
+			fetchLimiter: gr.fetchLimiter,
+			readaheads:   gr.readaheads,
+			readLatency:  gr.readLatency,
+
+			asyncVerifier: gr.asyncVerifier,
+			accessTrace:   gr.accessTrace,
+			readHooks:     gr.readHooks,
+
+			subChunkMinSize: gr.subChunkMinSize,
+			transformers:    gr.transformers,
+			cacheProgress:   gr.cacheProgress,
+		},
+		verifier: digestVerifier,
+	}, nil
+}
+
 func (vr *VerifiableReader) isClosed() bool {
 	vr.closedMu.Lock()
 	closed := vr.closed
@@ -306,7 +482,20 @@ func (vr *VerifiableReader) isClosed() bool {
 // NewReader creates a Reader based on the given stargz blob and cache implementation.
 // It returns VerifiableReader so the caller must provide a metadata.ChunkVerifier
 // to use for verifying file or chunk contained in this stargz blob.
-func NewReader(r metadata.Reader, cache cache.BlobCache, layerSha digest.Digest) (*VerifiableReader, error) {
+func NewReader(r metadata.Reader, cache cache.BlobCache, layerSha digest.Digest, opts ...Option) (*VerifiableReader, error) {
+	var rOpts options
+	for _, o := range opts {
+		o(&rOpts)
+	}
+	sources := rOpts.sources
+	if sources == nil {
+		sources = []Source{{Name: BlobSourceName}}
+	}
+	shared := &sharedResources{refs: 1}
+	shared.closeFunc = func() error {
+		// The cache is closed when the chunks referenced by other layers are released.
+		return errors.Join(rOpts.chunkIndex.retire(shared, cache.Close), r.Close())
+	}
 	vr := &reader{
 		r:     r,
 		cache: cache,
@@ -315,12 +504,64 @@ func NewReader(r metadata.Reader, cache cache.BlobCache, layerSha digest.Digest)
 				return new(bytes.Buffer)
 			},
 		},
-		layerSha: layerSha,
-		verifier: digestVerifier,
+		layerSha:   layerSha,
+		verifier:   digestVerifier,
+		sources:    sources,
+		model:      newModelFiles(rOpts.modelMatch, rOpts.modelFetchUnitSize),
+		chunkIndex: rOpts.chunkIndex,
+		chunkDedup: rOpts.chunkDedup && rOpts.chunkIndex != nil,
+		openFiles:  newOpenFiles(rOpts.cancelOnClose, rOpts.cancelGrace),
+		shared:     shared,
+
+		openFileCache: newOpenFileCache(rOpts.openFileCacheSize),
+
+		verifyCachedChunks: rOpts.verifyCachedChunks,
+		strictEOF:          rOpts.strictEOF,
+
+		fetchWorkers: rOpts.fetchWorkers,
+		layerLimiter: NewFetchLimiter(rOpts.fetchWorkers, rOpts.fetchMaxInflightBytes),
+		fetchLimiter: rOpts.fetchLimiter,
+		readaheads:   newReadaheads(rOpts.readaheadMaxWindow),
+		readLatency:  newReadLatency(),
+
+		asyncVerifier: newAsyncVerifier(rOpts.asyncVerifyWorkers),
+		accessTrace:   rOpts.accessTrace,
+		readHooks:     rOpts.readHooks,
+
+		subChunkMinSize: rOpts.subChunkMinSize,
+		transformers:    rOpts.transformers,
+		cacheProgress:   rOpts.cacheProgress,
 	}
 	return &VerifiableReader{r: vr, verifier: digestVerifier}, nil
 }
 
+// sharedResources is the metadata and the cache shared among a reader and its clones.
+// These are closed when all of the readers are closed.
+type sharedResources struct {
+	refs      int
+	refsMu    sync.Mutex
+	closeFunc func() error
+}
+
+func (s *sharedResources) acquire() bool {
+	s.refsMu.Lock()
+	defer s.refsMu.Unlock()
+	if s.refs == 0 {
+		return false
+	}
+	s.refs++
+	return true
+}
+
+func (s *sharedResources) release() error {
+	s.refsMu.Lock()
+	defer s.refsMu.Unlock()
+	if s.refs--; s.refs > 0 {
+		return nil
+	}
+	return s.closeFunc()
+}
+
 type reader struct {
 	r       metadata.Reader
 	cache   cache.BlobCache
@@ -336,6 +577,41 @@ type reader struct {
 
 	verify   bool
 	verifier func(uint32, string) (digest.Verifier, error)
+
+	sources    []Source
+	model      *modelFiles
+	chunkIndex *ChunkIndex // index of chunks shared among layers. nil if unused.
+	chunkDedup bool        // chunks cached by other layers are used.
+	openFiles  *openFiles  // nil if speculative fetches aren't canceled on close.
+	shared     *sharedResources
+
+	openFileCache *openFileCache // files opened recently. nil if disabled.
+
+	verifyCachedChunks bool // chunks verified when cached are verified again on reads from the chunk index.
+	strictEOF          bool // reads at the end of files follow the contract of io.ReaderAt.
+
+	sr *io.SectionReader // blob of the layer. nil if unknown.
+
+	// fetchWorkers is the number of chunks of a file fetched in parallel. 0 means the default.
+	fetchWorkers int
+	layerLimiter *FetchLimiter // limit of parallel fetches of the layer. nil if unlimited.
+	fetchLimiter *FetchLimiter // limit of parallel fetches shared among layers. nil if unlimited.
+
+	readaheads *readaheads // nil if readahead is disabled.
+
+	readLatency *readLatency // latency of reads fetching chunks, for pausing Cache.
+
+	asyncVerifier *asyncVerifier // nil if chunks are verified before returned.
+
+	accessTrace *AccessTrace // nil if reads aren't recorded.
+
+	readHooks ReadHooks // nil if reads aren't observed.
+
+	subChunkMinSize int64 // min size of chunks partially fetched. 0 means disabled.
+
+	transformers []ChunkTransformer // applied to chunks read from the layer blob
+
+	cacheProgress CacheProgress // chunks cached by Cache. nil if not recorded.
 }
 
 func (gr *reader) Metadata() metadata.Reader {
@@ -359,38 +635,60 @@ func (gr *reader) OpenFile(id uint32) (io.ReaderAt, error) {
 	if gr.isClosed() {
 		return nil, fmt.Errorf("reader is already closed")
 	}
-	var fr metadata.File
-	fr, err := gr.r.OpenFileWithPreReader(id, func(nid uint32, chunkOffset, chunkSize int64, chunkDigest string, r io.Reader) error {
-		// Check if it already exists in the cache
-		cacheID := genID(nid, chunkOffset, chunkSize)
-		if r, err := gr.cache.Get(cacheID); err == nil {
-			r.Close()
-			return nil
+	of, ok := gr.openFileCache.get(id)
+	if !ok {
+		fr, err := gr.r.OpenFileWithPreReader(id, gr.cacheNeighbor)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open file %d: %w", id, err)
 		}
-
-		// Read and cache
-		b := gr.bufPool.Get().(*bytes.Buffer)
-		b.Reset()
-		b.Grow(int(chunkSize))
-		ip := b.Bytes()[:chunkSize]
-		if _, err := io.ReadFull(r, ip); err != nil {
-			gr.putBuffer(b)
-			return err
+		var size int64
+		if gr.strictEOF {
+			attr, err := gr.r.GetAttr(id)
+			if err != nil {
+				return nil, fmt.Errorf("failed to get attributes of file %d: %w", id, err)
+			}
+			size = attr.Size
 		}
-		err := gr.verifyAndCache(nid, ip, chunkDigest, cacheID)
-		gr.putBuffer(b)
-		return err
-	})
-	if err != nil {
-		return nil, fmt.Errorf("failed to open file %d: %w", id, err)
+		of = &openedFile{fr: fr, size: size, unitSize: gr.model.fetchUnitSize(gr.r, id)}
+		gr.openFileCache.add(id, of)
 	}
 	return &file{
-		id: id,
-		fr: fr,
-		gr: gr,
+		id:       id,
+		fr:       of.fr,
+		gr:       gr,
+		size:     of.size,
+		unitSize: of.unitSize,
+		fetchCtx: gr.openFiles.open(id),
 	}, nil
 }
 
+// cacheNeighbor caches the chunk of the file read together with the target chunk.
+func (gr *reader) cacheNeighbor(nid uint32, chunkOffset, chunkSize int64, chunkDigest string, r io.Reader) error {
+	// Check if it already exists in the cache
+	cacheID := genID(nid, chunkOffset, chunkSize)
+	if r, err := gr.cache.Get(cacheID); err == nil {
+		r.Close()
+		return nil
+	}
+
+	// Read and cache
+	b := gr.bufPool.Get().(*bytes.Buffer)
+	b.Reset()
+	b.Grow(int(chunkSize))
+	ip := b.Bytes()[:chunkSize]
+	if _, err := io.ReadFull(r, ip); err != nil {
+		gr.putBuffer(b)
+		return err
+	}
+	if err := gr.transformChunk(context.Background(), nid, chunkOffset, ip, chunkDigest); err != nil {
+		gr.putBuffer(b)
+		return err
+	}
+	err := gr.verifyAndCache(nid, ip, chunkDigest, cacheID, false)
+	gr.putBuffer(b)
+	return err
+}
+
 func (gr *reader) Close() error {
 	gr.closedMu.Lock()
 	defer gr.closedMu.Unlock()
@@ -398,14 +696,7 @@ func (gr *reader) Close() error {
 		return nil
 	}
 	gr.closed = true
-	var errs []error
-	if err := gr.cache.Close(); err != nil {
-		errs = append(errs, err)
-	}
-	if err := gr.r.Close(); err != nil {
-		errs = append(errs, err)
-	}
-	return errors.Join(errs...)
+	return gr.shared.release()
 }
 
 func (gr *reader) isClosed() bool {
@@ -424,12 +715,100 @@ type file struct {
 	id uint32
 	fr metadata.File
 	gr *reader
+
+	// size is the size of the file. This is recorded only with WithStrictEOF.
+	size int64
+
+	// unitSize is the size of the aligned unit fetched at once on cache miss. 0 means
+	// fetching only the missed chunk.
+	unitSize int64
+
+	// fetchCtx is the context of the speculative fetches of the file (i.e. fetch units).
+	fetchCtx  context.Context
+	closeOnce sync.Once
+
+	ra readahead
+
+	// path is the path of the file recorded to the access trace and passed to the hooks.
+	path     string
+	pathOnce sync.Once
+}
+
+// Close releases the handle of the file. When all handles of the file are closed, the
+// speculative fetches of the file are canceled if WithCancelOnClose is specified.
+func (sf *file) Close() error {
+	sf.closeOnce.Do(func() {
+		sf.gr.openFiles.close(sf.id)
+	})
+	return nil
+}
+
+// FileDigest returns the digest of the whole file recorded in the TOC. An empty string is
+// returned if the metadata doesn't record it.
+func (sf *file) FileDigest() string {
+	if fd, ok := sf.fr.(metadata.FileDigester); ok {
+		return fd.FileDigest()
+	}
+	return ""
+}
+
+// Cached returns true if all chunks of this file exist in the cache so the
+// file can be read without accessing the remote blob.
+func (sf *file) Cached() bool {
+	var offset int64
+	for {
+		chunkOffset, chunkSize, _, ok := sf.fr.ChunkEntryForOffset(offset)
+		if !ok || chunkSize <= 0 {
+			return true
+		}
+		if isHole(sf.fr, chunkOffset) {
+			offset = chunkOffset + chunkSize
+			continue
+		}
+		r, err := sf.gr.cache.Get(genID(sf.id, chunkOffset, chunkSize))
+		if err != nil {
+			return false
+		}
+		r.Close()
+		offset = chunkOffset + chunkSize
+	}
 }
 
 // ReadAt reads chunks from the stargz file with trying to fetch as many chunks
 // as possible from the cache.
 func (sf *file) ReadAt(p []byte, offset int64) (int, error) {
+	return sf.ReadAtContext(context.Background(), p, offset)
+}
+
+// ReadAtContext is the same as ReadAt but chunks missed in the cache are fetched
+// with ctx so the deadline and cancellation of the operation (e.g. FUSE request)
+// are propagated to the fetch.
+func (sf *file) ReadAtContext(ctx context.Context, p []byte, offset int64) (int, error) {
+	return sf.readAtContext(ctx, p, offset, nil)
+}
+
+// readAtContext is ReadAtContext. fetched is the set of the offsets of the chunks that have
+// been fetched to the cache for this read by the caller so they aren't reported as served
+// from the cache.
+func (sf *file) readAtContext(ctx context.Context, p []byte, offset int64, fetched map[int64]bool) (n int, err error) {
+	if err := sf.checkOffset(offset); err != nil {
+		return 0, err
+	}
 	nr := 0
+	fetchedUnit := int64(-1)
+	var readDone func() // non-nil once the read fetches chunks
+	fetchedHit := false // true if chunks in fetched are read
+	if h := sf.gr.readHooks; h != nil {
+		ev := sf.readEvent(offset, len(p))
+		h.OnReadStart(ev)
+		defer func(start time.Time) {
+			src := ReadSourceCache
+			if readDone != nil || fetchedHit {
+				src = ReadSourceRemote
+			}
+			h.OnReadDone(ev, ReadStats{Bytes: n, Source: src, Latency: time.Since(start), Err: err})
+		}(time.Now())
+	}
 	for nr < len(p) {
 		chunkOffset, chunkSize, chunkDigestStr, ok := sf.fr.ChunkEntryForOffset(offset + int64(nr))
 		if !ok {
@@ -442,30 +821,72 @@ func (sf *file) ReadAt(p []byte, offset int64) (int, error) {
 			expectedSize = chunkSize - upperDiscard - lowerDiscard
 		)
 
+		// Holes of sparse files are filled with zeros without accessing the blob.
+		if isHole(sf.fr, chunkOffset) {
+			clear(p[nr : int64(nr)+expectedSize])
+			nr += int(expectedSize)
+			continue
+		}
+
+		// Fail if the chunk returned by the last read failed the verification.
+		if err := sf.gr.asyncVerifier.check(id); err != nil {
+			return 0, err
+		}
+
 		// Check if the content exists in the cache
 		if r, err := sf.gr.cache.Get(id); err == nil {
 			n, err := r.ReadAt(p[nr:int64(nr)+expectedSize], lowerDiscard)
 			if (err == nil || err == io.EOF) && int64(n) == expectedSize {
 				nr += n
 				r.Close()
+				// Chunks of the unit fetched by this read aren't served from the cache.
+				fromCache := (sf.unitSize <= 0 || chunkOffset/sf.unitSize != fetchedUnit) && !fetched[chunkOffset]
+				fetchedHit = fetchedHit || fetched[chunkOffset]
+				sf.traceAccess(chunkOffset, chunkSize, chunkDigestStr, fromCache)
 				continue
 			}
 			r.Close()
 		}
 
-		// We missed cache. Take it from underlying reader.
+		// We missed cache. Reads fetching chunks are tracked for pausing Cache.
+		if readDone == nil {
+			readDone = sf.gr.readLatency.start()
+			defer readDone()
+		}
+
+		// Model files are fetched in large aligned units so the following reads of
+		// the unit hit the cache. Fall back to fetching the chunk if it's still missed.
+		if sf.unitSize > 0 && chunkOffset/sf.unitSize != fetchedUnit {
+			fetchedUnit = chunkOffset / sf.unitSize
+			if err := sf.fetchUnit(ctx, fetchedUnit*sf.unitSize, sf.unitSize); err != nil {
+				return 0, fmt.Errorf("failed to fetch unit: %w", err)
+			}
+			continue
+		}
+
+		// Fetch only the head of a large chunk if the read doesn't need the rest.
+		if ok, err := sf.readSubChunk(ctx, p[nr:int64(nr)+expectedSize], chunkOffset, chunkSize, lowerDiscard, chunkDigestStr, id); err != nil {
+			return 0, err
+		} else if ok {
+			sf.traceAccess(chunkOffset, chunkSize, chunkDigestStr, false)
+			nr += int(expectedSize)
+			continue
+		}
+
+		// Take it from underlying reader.
 		// We read the whole chunk here and add it to the cache so that following
 		// reads against neighboring chunks can take the data without decmpression.
 		if lowerDiscard == 0 && upperDiscard == 0 {
 			// We can directly store the result to the given buffer
 			ip := p[nr : int64(nr)+chunkSize]
-			n, err := sf.fr.ReadAt(ip, chunkOffset)
-			if err != nil && err != io.EOF {
+			n, verified, err := sf.fetchChunk(ctx, ip, chunkOffset, chunkDigestStr)
+			if err != nil {
 				return 0, fmt.Errorf("failed to read data: %w", err)
 			}
-			if err := sf.gr.verifyAndCache(sf.id, ip, chunkDigestStr, id); err != nil {
+			if err := sf.gr.verifyAndCacheAsync(sf.id, ip, chunkDigestStr, id, verified); err != nil {
 				return 0, err
 			}
+			sf.traceAccess(chunkOffset, chunkSize, chunkDigestStr, false)
 			nr += n
 			continue
 		}
@@ -475,11 +896,12 @@ func (sf *file) ReadAt(p []byte, offset int64) (int, error) {
 		b.Reset()
 		b.Grow(int(chunkSize))
 		ip := b.Bytes()[:chunkSize]
-		if _, err := sf.fr.ReadAt(ip, chunkOffset); err != nil && err != io.EOF {
+		_, verified, err := sf.fetchChunk(ctx, ip, chunkOffset, chunkDigestStr)
+		if err != nil {
 			sf.gr.putBuffer(b)
 			return 0, fmt.Errorf("failed to read data: %w", err)
 		}
-		if err := sf.gr.verifyAndCache(sf.id, ip, chunkDigestStr, id); err != nil {
+		if err := sf.gr.verifyAndCacheAsync(sf.id, ip, chunkDigestStr, id, verified); err != nil {
 			sf.gr.putBuffer(b)
 			return 0, err
 		}
@@ -488,12 +910,27 @@ func (sf *file) ReadAt(p []byte, offset int64) (int, error) {
 		if int64(n) != expectedSize {
 			return 0, fmt.Errorf("unexpected final data size %d; want %d", n, expectedSize)
 		}
+		sf.traceAccess(chunkOffset, chunkSize, chunkDigestStr, false)
 		nr += n
 	}
 
 	commonmetrics.AddBytesCount(commonmetrics.OnDemandBytesServed, sf.gr.layerSha, int64(nr)) // measure the number of on demand bytes served
 
-	return nr, nil
+	sf.readahead(offset, nr)
+	return sf.readResult(p, offset, nr)
+}
+
+// isHole returns true if the chunk containing the offset is a hole of a sparse file.
+func isHole(fr metadata.File, offset int64) bool {
+	hc, ok := fr.(metadata.HoleChecker)
+	return ok && hc.IsHole(offset)
+}
+
+// isBaseChunk returns true if the chunk containing the offset is stored in the base layer
+// of the delta layer.
+func isBaseChunk(fr metadata.File, offset int64) bool {
+	bc, ok := fr.(metadata.BaseChunkChecker)
+	return ok && bc.IsBaseChunk(offset)
 }
 
 type chunkData struct {
@@ -539,7 +976,7 @@ func (sf *file) GetPassthroughFd(mergeBufferSize int64, mergeWorkerCount int) (u
 				return 0, nil, err
 			}
 		} else {
-			if err := sf.prefetchEntireFile(id, chunks, totalSize, mergeBufferSize, mergeWorkerCount); err != nil {
+			if err := sf.prefetchEntireFile(id, chunks, mergeBufferSize, mergeWorkerCount); err != nil {
 				return 0, nil, err
 			}
 		}
@@ -602,12 +1039,15 @@ func (sf *file) prefetchEntireFileSequential(entireCacheID string) error {
 			r.Close()
 		}
 
-		if _, err := sf.fr.ReadAt(ip, chunkOffset); err != nil && err != io.EOF {
+		_, verified, err := sf.fetchChunk(context.Background(), ip, chunkOffset, chunkDigestStr)
+		if err != nil {
 			sf.gr.putBuffer(b)
 			w.Abort()
 			return fmt.Errorf("failed to read data: %w", err)
 		}
-		if err := sf.gr.verifyOneChunk(sf.id, ip, chunkDigestStr); err != nil {
+		if verified {
+			sf.gr.countFetch(ip)
+		} else if err := sf.gr.verifyOneChunk(sf.id, ip, chunkDigestStr); err != nil {
 			sf.gr.putBuffer(b)
 			w.Abort()
 			return err
@@ -632,7 +1072,10 @@ type batchWorkerArgs struct {
 	readInfos   []chunkReadInfo
 }
 
-func (sf *file) prefetchEntireFile(entireCacheID string, chunks []chunkData, totalSize int64, bufferSize int64, workerCount int) error {
+// prefetchEntireFile fetches the chunks of the file in batches and caches the whole file as
+// entireCacheID. Chunks are split into batches at the chunk boundaries so each batch fits in a
+// buffer of bufferSize unless a single chunk is larger than that.
+func (sf *file) prefetchEntireFile(entireCacheID string, chunks []chunkData, bufferSize int64, workerCount int) error {
 
 	w, err := sf.gr.cache.Add(entireCacheID)
 	if err != nil {
@@ -640,31 +1083,16 @@ func (sf *file) prefetchEntireFile(entireCacheID string, chunks []chunkData, tot
 	}
 	defer w.Close()
 
-	batchCount := (totalSize + bufferSize - 1) / bufferSize
-
-	for batchIdx := range batchCount {
-		batchStart := batchIdx * bufferSize
-		batchEnd := min((batchIdx+1)*bufferSize, totalSize)
-
-		var batchChunks []chunkData
-		var batchOffset int64
-		for i := range chunks {
-			chunkStart := chunks[i].offset
-			chunkEnd := chunkStart + chunks[i].size
-
-			if chunkEnd <= batchStart {
-				continue
-			}
-			if chunkStart >= batchEnd {
-				break
-			}
-
-			chunks[i].bufferPos = batchOffset
-			batchOffset += chunks[i].size
-			batchChunks = append(batchChunks, chunks[i])
+	for start := 0; start < len(chunks); {
+		end := start
+		var batchSize int64
+		for end < len(chunks) && (end == start || batchSize+chunks[end].size <= bufferSize) {
+			chunks[end].bufferPos = batchSize
+			batchSize += chunks[end].size
+			end++
 		}
-
-		batchSize := batchEnd - batchStart
+		batchChunks := chunks[start:end]
+		start = end
 		buffer := make([]byte, batchSize)
 
 		eg := errgroup.Group{}
@@ -697,7 +1125,7 @@ func (sf *file) prefetchEntireFile(entireCacheID string, chunks []chunkData, tot
 			mergedReadInfos = append(mergedReadInfos, infos...)
 		}
 
-		if err := sf.checkHoles(mergedReadInfos, batchSize); err != nil {
+		if err := sf.refetchHoles(batchChunks, buffer, mergedReadInfos); err != nil {
 			w.Abort()
 			return fmt.Errorf("hole check failed: %w", err)
 		}
@@ -748,6 +1176,79 @@ func (sf *file) checkHoles(readInfos []chunkReadInfo, totalSize int64) error {
 	return nil
 }
 
+// findHoles returns the ranges of the buffer of totalSize bytes not covered by readInfos and
+// the number of the reads overlapping the previous reads.
+func findHoles(readInfos []chunkReadInfo, totalSize int64) (holes []chunkReadInfo, overlaps int) {
+	sort.Slice(readInfos, func(i, j int) bool {
+		return readInfos[i].offset < readInfos[j].offset
+	})
+	var end int64
+	for _, info := range readInfos {
+		if info.offset < end {
+			overlaps++
+		} else if info.offset > end {
+			holes = append(holes, chunkReadInfo{offset: end, size: info.offset - end})
+		}
+		end = max(end, info.offset+info.size)
+	}
+	if end < totalSize {
+		holes = append(holes, chunkReadInfo{offset: end, size: totalSize - end})
+	}
+	return holes, overlaps
+}
+
+// refetchHoles fetches again the chunks of the batch not read into the buffer as a whole
+// (e.g. because of short reads of the blob) instead of failing the batch. Holes and
+// overlapping reads are counted in the metrics and logged. Overlapping reads can't be fixed
+// by fetching again, so they fail the batch.
+func (sf *file) refetchHoles(chunks []chunkData, buffer []byte, readInfos []chunkReadInfo) error {
+	totalSize := int64(len(buffer))
+	holes, overlaps := findHoles(readInfos, totalSize)
+	if overlaps > 0 {
+		for range overlaps {
+			commonmetrics.IncOperationCount(commonmetrics.MergedReadOverlapCount, sf.gr.layerSha)
+		}
+		log.L.Warnf("%d overlapping reads detected in batch of file %d", overlaps, sf.id)
+		return sf.checkHoles(readInfos, totalSize)
+	}
+	if len(holes) == 0 {
+		return nil
+	}
+
+	var refetched []chunkReadInfo
+	for _, chunk := range chunks {
+		if !overlapsAny(chunk.bufferPos, chunk.size, holes) {
+			continue
+		}
+		log.L.WithField("offset", chunk.offset).WithField("size", chunk.size).WithField("digest", chunk.digestStr).
+			Warnf("hole detected in batch of file %d; fetching the chunk again", sf.id)
+		commonmetrics.IncOperationCount(commonmetrics.MergedReadHoleCount, sf.gr.layerSha)
+		n, err := sf.fetchBatchChunk(chunk, buffer[chunk.bufferPos:chunk.bufferPos+chunk.size])
+		if err != nil {
+			return err
+		}
+		refetched = append(refetched, chunkReadInfo{offset: chunk.bufferPos, size: int64(n)})
+	}
+	// Replace the previous reads of the chunks fetched again.
+	merged := refetched
+	for _, info := range readInfos {
+		if !slices.ContainsFunc(refetched, func(r chunkReadInfo) bool { return r.offset == info.offset }) {
+			merged = append(merged, info)
+		}
+	}
+	return sf.checkHoles(merged, totalSize)
+}
+
+// overlapsAny returns true if the range of size bytes at offset overlaps any of ranges.
+func overlapsAny(offset, size int64, ranges []chunkReadInfo) bool {
+	for _, r := range ranges {
+		if offset < r.offset+r.size && r.offset < offset+size {
+			return true
+		}
+	}
+	return false
+}
+
 func (sf *file) processBatchChunks(args *batchWorkerArgs) error {
 	var readInfos []chunkReadInfo
 
@@ -770,38 +1271,59 @@ func (sf *file) processBatchChunks(args *batchWorkerArgs) error {
 			}
 		}
 
-		n, err := sf.fr.ReadAt(bufStart, chunk.offset)
-		if err != nil && err != io.EOF {
-			return fmt.Errorf("failed to read data at offset %d: %w", chunk.offset, err)
+		n, err := sf.fetchBatchChunk(chunk, bufStart)
+		if err != nil {
+			return err
 		}
-
 		readInfos = append(readInfos, chunkReadInfo{
 			offset: chunk.bufferPos,
 			size:   int64(n),
 		})
-
-		if err := sf.gr.verifyOneChunk(sf.id, bufStart, chunk.digestStr); err != nil {
-			return fmt.Errorf("chunk verification failed at offset %d: %w", chunk.offset, err)
-		}
 	}
 
 	args.readInfos = readInfos
 	return nil
 }
 
+// fetchBatchChunk fetches the chunk of the batch into buf and returns the number of the
+// bytes read.
+func (sf *file) fetchBatchChunk(chunk chunkData, buf []byte) (int, error) {
+	release, err := sf.gr.acquireFetch(context.Background(), chunk.size)
+	if err != nil {
+		return 0, err
+	}
+	// Chunks are fetched through the sources so chunks of delta layers stored in the base
+	// layer and chunks cached by other layers are resolved as on reads.
+	n, verified, err := sf.fetchChunk(context.Background(), buf, chunk.offset, chunk.digestStr)
+	release()
+	if err != nil {
+		return 0, fmt.Errorf("failed to read data at offset %d: %w", chunk.offset, err)
+	}
+	if verified {
+		sf.gr.countFetch(buf)
+	} else if err := sf.gr.verifyOneChunk(sf.id, buf, chunk.digestStr); err != nil {
+		return 0, fmt.Errorf("chunk verification failed at offset %d: %w", chunk.offset, err)
+	}
+	return n, nil
+}
+
 func (gr *reader) verifyOneChunk(entryID uint32, ip []byte, chunkDigestStr string) error {
+	gr.countFetch(ip)
+	if err := gr.verifyChunk(entryID, ip, chunkDigestStr); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidChunk, err)
+	}
+	return nil
+}
+
+func (gr *reader) countFetch(ip []byte) {
 	// We can end up doing on demand registry fetch when aligning the chunk
 	commonmetrics.IncOperationCount(commonmetrics.OnDemandRemoteRegistryFetchCount, gr.layerSha)
 	commonmetrics.AddBytesCount(commonmetrics.OnDemandBytesFetched, gr.layerSha, int64(len(ip)))
 	gr.setLastReadTime(time.Now())
-	if err := gr.verifyChunk(entryID, ip, chunkDigestStr); err != nil {
-		return fmt.Errorf("invalid chunk: %w", err)
-	}
-	return nil
 }
 
-func (gr *reader) cacheData(ip []byte, cacheID string) {
-	if w, err := gr.cache.Add(cacheID); err == nil {
+func (gr *reader) cacheData(ip []byte, cacheID string, opts ...cache.Option) {
+	if w, err := gr.cache.Add(cacheID, opts...); err == nil {
 		if cn, err := w.Write(ip); err != nil || cn != len(ip) {
 			w.Abort()
 		} else {
@@ -811,27 +1333,42 @@ func (gr *reader) cacheData(ip []byte, cacheID string) {
 	}
 }
 
-func (gr *reader) verifyAndCache(entryID uint32, ip []byte, chunkDigestStr string, cacheID string) error {
-	if err := gr.verifyOneChunk(entryID, ip, chunkDigestStr); err != nil {
+// verifyAndCache verifies and caches the chunk. verified is true if the chunk has already
+// been verified (see fetchChunk).
+func (gr *reader) verifyAndCache(entryID uint32, ip []byte, chunkDigestStr string, cacheID string, verified bool) error {
+	if verified {
+		gr.countFetch(ip)
+	} else if err := gr.verifyOneChunk(entryID, ip, chunkDigestStr); err != nil {
 		return err
 	}
 	gr.cacheData(ip, cacheID)
+	gr.indexChunk(chunkDigestStr, cacheID, verified || gr.verify)
 	return nil
 }
 
+// indexChunk records the cached chunk to the chunk index so delta layers can use it.
+// verified is true if the chunk has been verified against the digest.
+func (gr *reader) indexChunk(chunkDigest string, cacheID string, verified bool) {
+	gr.chunkIndex.add(chunkDigest, gr.shared, gr.cache, cacheID, verified)
+}
+
 func (gr *reader) verifyChunk(id uint32, p []byte, chunkDigestStr string) error {
 	if !gr.verify {
 		return nil // verification is not required
 	}
+	return gr.checkChunk(id, p, chunkDigestStr)
+}
+
+func (gr *reader) checkChunk(id uint32, p []byte, chunkDigestStr string) error {
 	v, err := gr.verifier(id, chunkDigestStr)
 	if err != nil {
-		return fmt.Errorf("invalid chunk: %w", err)
+		return fmt.Errorf("%w: %w", ErrInvalidChunk, err)
 	}
 	if _, err := v.Write(p); err != nil {
-		return fmt.Errorf("invalid chunk: failed to write to verifier: %w", err)
+		return fmt.Errorf("%w: failed to write to verifier: %w", ErrInvalidChunk, err)
 	}
 	if !v.Verified() {
-		return fmt.Errorf("invalid chunk: not verified")
+		return fmt.Errorf("%w: not verified", ErrInvalidChunk)
 	}
 
 	return nil
@@ -852,9 +1389,17 @@ func positive(n int64) int64 {
 type CacheOption func(*cacheOptions)
 
 type cacheOptions struct {
-	cacheOpts []cache.Option
-	filter    func(int64) bool
-	reader    *io.SectionReader
+	cacheOpts    []cache.Option
+	filter       func(int64) bool
+	reader       *io.SectionReader
+	priority     func(name string, attr metadata.Attr) int
+	pathGlobs    []string
+	excludeGlobs []string
+	skip         func(p string) bool
+
+	bytesPerSec    int64
+	maxConcurrency int
+	pauseThreshold time.Duration
 }
 
 func WithCacheOpts(cacheOpts ...cache.Option) CacheOption {
@@ -875,10 +1420,25 @@ func WithReader(sr *io.SectionReader) CacheOption {
 	}
 }
 
+// WithPriority caches files in the descending order of the priority returned by the
+// function for the base name and the attributes of each file. Files of the same priority
+// are cached in the order in the blob.
+func WithPriority(priority func(name string, attr metadata.Attr) int) CacheOption {
+	return func(opts *cacheOptions) {
+		opts.priority = priority
+	}
+}
+
 func digestVerifier(id uint32, chunkDigestStr string) (digest.Verifier, error) {
-	chunkDigest, err := digest.Parse(chunkDigestStr)
+	chunkDigest, err := estargz.ParseChunkDigest(chunkDigestStr)
+	if errors.Is(err, digest.ErrDigestUnsupported) {
+		return nil, fmt.Errorf("%w: unsupported digest algorithm %q: %w", ErrInvalidChunk, digest.Digest(chunkDigestStr).Algorithm(), err)
+	} else if err != nil {
+		return nil, fmt.Errorf("%w: no digest is recorded(len=%d): %w", ErrInvalidChunk, len(chunkDigestStr), err)
+	}
+	v, err := estargz.ChunkDigestVerifier(chunkDigest)
 	if err != nil {
-		return nil, fmt.Errorf("invalid chunk: no digest is recorded(len=%d): %w", len(chunkDigestStr), err)
+		return nil, fmt.Errorf("%w: %w", ErrInvalidChunk, err)
 	}
-	return chunkDigest.Verifier(), nil
+	return v, nil
 }
@@ -24,6 +24,7 @@ package reader
 
 import (
 	"testing"
+	"time"
 
 	memorymetadata "github.com/containerd/stargz-snapshotter/metadata/memory"
 )
@@ -46,3 +47,24 @@ func TestReader(t *testing.T) {
 
 	TestSuiteReader(testRunner, memorymetadata.NewReader)
 }
+
+func TestRetryDelay(t *testing.T) {
+	s := Source{RetryInterval: 10 * time.Millisecond}
+	for n := 1; n <= 3; n++ {
+		if d := s.retryDelay(n); d != 10*time.Millisecond {
+			t.Errorf("fixed delay of retry %d = %v; want 10ms", n, d)
+		}
+	}
+	s.MaxRetryInterval = 50 * time.Millisecond
+	for n, want := range []time.Duration{0, 10, 20, 40, 50, 50} {
+		if n == 0 {
+			continue
+		}
+		want *= time.Millisecond
+		for i := 0; i < 10; i++ {
+			if d := s.retryDelay(n); d < want/2 || d > want {
+				t.Errorf("delay of retry %d = %v; want [%v, %v]", n, d, want/2, want)
+			}
+		}
+	}
+}
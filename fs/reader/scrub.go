@@ -0,0 +1,141 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package reader
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+
+	"github.com/containerd/log"
+	"github.com/containerd/stargz-snapshotter/cache"
+	commonmetrics "github.com/containerd/stargz-snapshotter/fs/metrics/common"
+)
+
+// ErrScrubUnsupported is returned by Scrub if the cache doesn't support removing chunks.
+var ErrScrubUnsupported = errors.New("cache doesn't support removing chunks")
+
+// ScrubResult is the result of scrubbing the cache of a layer.
+type ScrubResult struct {
+	// Checked is the number of the cached chunks verified.
+	Checked int
+
+	// Corrupted is the number of the cached chunks that failed the verification. They are
+	// removed from the cache.
+	Corrupted int
+}
+
+// scrubTarget is a chunk picked by Scrub.
+type scrubTarget struct {
+	id        uint32
+	offset    int64
+	size      int64
+	digestStr string
+}
+
+// Scrub picks up to samples chunks of the layer at random and verifies the cached ones
+// against the chunk digests recorded in the TOC, to protect long-running nodes from silent
+// corruption of the cache (e.g. bit rot of the disk). Corrupted chunks are removed from the
+// cache so they are fetched again on the next read. Holes, chunks of the base layer and
+// chunks without digests aren't verified. ErrScrubUnsupported is returned if the cache
+// doesn't implement cache.Remover.
+func (vr *VerifiableReader) Scrub(samples int) (res ScrubResult, _ error) {
+	if vr.isClosed() {
+		return res, fmt.Errorf("reader is already closed")
+	}
+	gr := vr.r
+	rm, ok := gr.cache.(cache.Remover)
+	if !ok {
+		return res, ErrScrubUnsupported
+	}
+	if samples <= 0 {
+		return res, nil
+	}
+
+	// Pick the chunks by reservoir sampling so the layer is walked only once.
+	var (
+		targets []scrubTarget
+		seen    int
+	)
+	paths, err := newPathFilter(nil, nil, nil)
+	if err != nil {
+		return res, err
+	}
+	r := gr.r
+	if err := walkCacheTargets(0, r.RootID(), "", r, func(int64) bool { return true }, paths, func(t cacheTarget) error {
+		fr, err := r.OpenFile(t.id)
+		if err != nil {
+			return fmt.Errorf("failed to open file %d: %w", t.id, err)
+		}
+		for offset := int64(0); offset < t.attr.Size; {
+			chunkOffset, chunkSize, chunkDigestStr, ok := fr.ChunkEntryForOffset(offset)
+			if !ok || chunkSize <= 0 {
+				break
+			}
+			offset = chunkOffset + chunkSize
+			if chunkDigestStr == "" || isHole(fr, chunkOffset) || isBaseChunk(fr, chunkOffset) {
+				continue
+			}
+			c := scrubTarget{id: t.id, offset: chunkOffset, size: chunkSize, digestStr: chunkDigestStr}
+			if seen++; len(targets) < samples {
+				targets = append(targets, c)
+			} else if i := rand.IntN(seen); i < samples {
+				targets[i] = c
+			}
+		}
+		return nil
+	}); err != nil {
+		return res, err
+	}
+
+	b := gr.bufPool.Get().(*bytes.Buffer)
+	defer gr.putBuffer(b)
+	for _, c := range targets {
+		cacheID := genID(c.id, c.offset, c.size)
+		cr, err := gr.cache.Get(cacheID)
+		if err != nil {
+			continue // not cached
+		}
+		b.Reset()
+		b.Grow(int(c.size))
+		p := b.Bytes()[:c.size]
+		n, err := cr.ReadAt(p, 0)
+		cr.Close()
+		res.Checked++
+		commonmetrics.IncOperationCount(commonmetrics.ScrubbedChunkCount, gr.layerSha)
+		if err == nil || err == io.EOF {
+			if int64(n) == c.size {
+				err = gr.checkChunk(c.id, p, c.digestStr)
+			} else {
+				err = fmt.Errorf("unexpected size %d; want %d", n, c.size)
+			}
+		}
+		if err == nil {
+			continue
+		}
+		res.Corrupted++
+		commonmetrics.IncOperationCount(commonmetrics.ScrubCorruptedChunkCount, gr.layerSha)
+		log.L.WithError(err).Warnf("cached chunk (file %d, offset %d, size %d) of layer %s is corrupted; removing it from the cache",
+			c.id, c.offset, c.size, gr.layerSha)
+		if err := rm.Remove(cacheID); err != nil {
+			return res, fmt.Errorf("failed to remove corrupted chunk: %w", err)
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,267 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package reader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"time"
+
+	"github.com/containerd/stargz-snapshotter/errdefs"
+	"github.com/containerd/stargz-snapshotter/metadata"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// BlobSourceName is the name of the source that reads chunks from the layer blob. The blob is
+// fetched from the registry mirrors and the origin registry in the order of the hosts configuration.
+const BlobSourceName = "blob"
+
+// ErrChunkNotFound is returned by ChunkSource when the source doesn't have the chunk.
+var ErrChunkNotFound = errdefs.New(errdefs.KindNotFound, "chunk not found")
+
+// ErrInvalidChunk is returned when the chunk doesn't match the chunk digest.
+var ErrInvalidChunk = errdefs.New(errdefs.KindCorrupted, "invalid chunk")
+
+// Chunk identifies a chunk of a layer.
+type Chunk struct {
+	// Layer is the digest of the layer blob.
+	Layer digest.Digest
+
+	// ID is the ID of the file in the layer. This is stable among nodes mounting the layer.
+	ID uint32
+
+	// Offset is the offset of the chunk in the file.
+	Offset int64
+
+	// Size is the size of the chunk.
+	Size int64
+
+	// Digest is the digest of the uncompressed chunk. This can be empty if the layer doesn't
+	// record the chunk digest.
+	Digest string
+}
+
+// ChunkSource provides uncompressed chunks of layers from outside of the layer blob
+// (e.g. peer nodes or a remote cache).
+type ChunkSource interface {
+	// FetchChunk reads the specified chunk into p. len(p) is the size of the chunk.
+	// ErrChunkNotFound should be returned if the source doesn't have the chunk.
+	FetchChunk(ctx context.Context, chunk Chunk, p []byte) error
+}
+
+// Source is a source of chunks tried when a chunk isn't in the local cache.
+type Source struct {
+	// Name is the name of the source.
+	Name string
+
+	// ChunkSource provides chunks. If nil, chunks are read from the layer blob.
+	ChunkSource ChunkSource
+
+	// MaxRetries is the max number of retries of reading a chunk from this source. Only
+	// failures that can succeed on retry (see errdefs.IsRetryable) are retried.
+	MaxRetries int
+
+	// RetryInterval is the delay before retrying.
+	RetryInterval time.Duration
+
+	// MaxRetryInterval enables the exponential backoff of retries if larger than
+	// RetryInterval. The delay starts at RetryInterval and doubles on each retry up to
+	// MaxRetryInterval, with a random jitter so reads failed together don't retry at once.
+	MaxRetryInterval time.Duration
+}
+
+// retryDelay returns the delay before the n-th retry (n >= 1).
+func (s Source) retryDelay(n int) time.Duration {
+	d := s.RetryInterval
+	if s.MaxRetryInterval <= d || d <= 0 {
+		return d
+	}
+	for i := 1; i < n && d < s.MaxRetryInterval; i++ {
+		d *= 2
+	}
+	d = min(d, s.MaxRetryInterval)
+	// Jitter in [d/2, d].
+	return d/2 + rand.N(d/2+1)
+}
+
+// Option is an option for NewReader.
+type Option func(*options)
+
+type options struct {
+	sources            []Source
+	modelMatch         func(name string) bool
+	modelFetchUnitSize int64
+	chunkIndex         *ChunkIndex
+	chunkDedup         bool
+	verifyCachedChunks bool
+	strictEOF          bool
+	cancelOnClose      bool
+	cancelGrace        time.Duration
+	openFileCacheSize  int
+
+	fetchWorkers          int
+	fetchMaxInflightBytes int64
+	fetchLimiter          *FetchLimiter
+
+	readaheadMaxWindow int64
+
+	asyncVerifyWorkers int
+
+	accessTrace *AccessTrace
+
+	readHooks ReadHooks
+
+	subChunkMinSize int64
+
+	transformers []ChunkTransformer
+
+	cacheProgress CacheProgress
+}
+
+// WithSources specifies the sources of chunks tried in order when a chunk isn't in the local
+// cache. By default, chunks are read only from the layer blob.
+func WithSources(sources ...Source) Option {
+	return func(opts *options) {
+		opts.sources = sources
+	}
+}
+
+// fetchChunk reads the chunk at chunkOffset of the file into p, trying the sources in order.
+// Chunks from sources other than the layer blob are used only when they match the chunk digest.
+// verified is true if the chunk doesn't need to be verified by the caller because it has
+// been verified against the chunk digest (or when cached, see WithVerifyCachedChunks).
+func (sf *file) fetchChunk(ctx context.Context, p []byte, chunkOffset int64, chunkDigestStr string) (_ int, verified bool, _ error) {
+	if isBaseChunk(sf.fr, chunkOffset) {
+		n, err := sf.fetchBaseChunk(ctx, p, chunkOffset, chunkDigestStr)
+		return n, err == nil, err
+	}
+	if n, ok := sf.fetchDedupChunk(ctx, p, chunkOffset, chunkDigestStr); ok {
+		return n, true, nil
+	}
+	var errs []error
+	for _, s := range sf.gr.sources {
+		for i := 0; i <= s.MaxRetries; i++ {
+			if d := s.retryDelay(i); i > 0 && d > 0 {
+				select {
+				case <-time.After(d):
+				case <-ctx.Done():
+					return 0, false, errors.Join(append(errs, ctx.Err())...)
+				}
+			}
+			n, err := sf.fetchChunkFrom(ctx, s, p, chunkOffset, chunkDigestStr)
+			if err == nil {
+				return n, s.ChunkSource != nil, nil
+			}
+			if ctx.Err() != nil {
+				return 0, false, err // the operation is canceled or timed out
+			}
+			errs = append(errs, fmt.Errorf("source %q: %w", s.Name, err))
+			if !errdefs.IsRetryable(err) {
+				break // e.g. the source doesn't have the chunk
+			}
+		}
+	}
+	if len(errs) == 0 {
+		return 0, false, fmt.Errorf("no source is available")
+	}
+	return 0, false, errors.Join(errs...)
+}
+
+// fetchBaseChunk reads the chunk of the delta layer that is stored in the base layer. The
+// chunk is taken from the cache of the base layer through the chunk index.
+func (sf *file) fetchBaseChunk(ctx context.Context, p []byte, chunkOffset int64, chunkDigestStr string) (int, error) {
+	if sf.gr.chunkIndex == nil {
+		return 0, fmt.Errorf("chunk at %d is stored in the base layer but chunk index is unavailable: %w", chunkOffset, ErrChunkNotFound)
+	}
+	n, err := sf.fetchIndexedChunk(p, chunkOffset, chunkDigestStr)
+	if err != nil {
+		return 0, fmt.Errorf("failed to resolve chunk at %d from the base layer: %w", chunkOffset, err)
+	}
+	return n, nil
+}
+
+func (sf *file) fetchChunkFrom(ctx context.Context, s Source, p []byte, chunkOffset int64, chunkDigestStr string) (int, error) {
+	if s.ChunkSource == nil {
+		fr, err := sf.blobFile(ctx)
+		if err != nil {
+			return 0, err
+		}
+		n, err := fr.ReadAt(p, chunkOffset)
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+		if err := sf.gr.transformChunk(ctx, sf.id, chunkOffset, p[:n], chunkDigestStr); err != nil {
+			return 0, err
+		}
+		return n, nil
+	}
+	if err := s.ChunkSource.FetchChunk(ctx, Chunk{
+		Layer:  sf.gr.layerSha,
+		ID:     sf.id,
+		Offset: chunkOffset,
+		Size:   int64(len(p)),
+		Digest: chunkDigestStr,
+	}, p); err != nil {
+		return 0, err
+	}
+	// Chunks from outside of the blob are always verified.
+	if err := sf.gr.checkChunk(sf.id, p, chunkDigestStr); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// ContextReaderAt is implemented by the reader of the layer blob that can read with the
+// context of the operation. If the section reader passed to VerifiableReader.Clone is
+// backed by ContextReaderAt, the deadline and cancellation of the context passed to
+// ReadAtContext of files are propagated to the fetch of the blob.
+type ContextReaderAt interface {
+	io.ReaderAt
+	ReadAtContext(ctx context.Context, p []byte, off int64) (int, error)
+}
+
+// contextReaderAt reads the ContextReaderAt with the bound context.
+type contextReaderAt struct {
+	r   ContextReaderAt
+	ctx context.Context
+}
+
+func (r *contextReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	return r.r.ReadAtContext(r.ctx, p, off)
+}
+
+// blobFile returns the reader of the file that reads the layer blob with ctx. The reader
+// opened in advance is used if ctx is never canceled or the blob can't read with ctx.
+func (sf *file) blobFile(ctx context.Context) (metadata.File, error) {
+	if ctx.Done() == nil || sf.gr.sr == nil {
+		return sf.fr, nil
+	}
+	base, off, n := sf.gr.sr.Outer()
+	cr, ok := base.(ContextReaderAt)
+	if !ok {
+		return sf.fr, nil
+	}
+	// Clones share the metadata so this is cheap compared to fetching the chunk.
+	r, err := sf.gr.r.Clone(io.NewSectionReader(&contextReaderAt{cr, ctx}, off, n))
+	if err != nil {
+		return nil, err
+	}
+	return r.OpenFileWithPreReader(sf.id, sf.gr.cacheNeighbor)
+}
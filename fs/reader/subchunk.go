@@ -0,0 +1,113 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package reader
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+)
+
+// WithSubChunkFetch makes reads of chunks of minChunkSize bytes or larger fetch only the head
+// of the chunk up to the end of the read from the layer blob, instead of the whole chunk. A
+// compressed chunk (a gzip member or a zstd frame) can only be decompressed from its start so
+// the compressed bytes are fetched as far as the decompression needs to reach the end of the
+// read. This doesn't apply to chunks that must be verified before returned because the chunk
+// digest covers the whole chunk, unless WithAsyncVerify is specified. Then, the whole chunk is
+// fetched, verified and cached in background. By default (minChunkSize <= 0), whole chunks
+// are fetched.
+func WithSubChunkFetch(minChunkSize int64) Option {
+	return func(opts *options) {
+		opts.subChunkMinSize = minChunkSize
+	}
+}
+
+// readSubChunk reads the range of the chunk into p by fetching the head of the chunk up to
+// the end of the range. This returns false if the chunk must be fetched as a whole.
+func (sf *file) readSubChunk(ctx context.Context, p []byte, chunkOffset, chunkSize, lowerDiscard int64, chunkDigestStr string, cacheID string) (bool, error) {
+	gr := sf.gr
+	headSize := lowerDiscard + int64(len(p))
+	if gr.subChunkMinSize <= 0 || chunkSize < gr.subChunkMinSize || headSize >= chunkSize ||
+		isBaseChunk(sf.fr, chunkOffset) || len(gr.sources) == 0 || gr.sources[0].ChunkSource != nil ||
+		len(gr.transformers) > 0 || (gr.chunkDedup && gr.chunkIndex.has(chunkDigestStr)) {
+		return false, nil
+	}
+	av := gr.asyncVerifier
+	if gr.verify {
+		if av == nil || !av.start(cacheID) {
+			return false, nil
+		}
+		// Keep the cache open until the chunk is cached.
+		if !gr.shared.acquire() {
+			av.finish(cacheID, nil)
+			return false, nil
+		}
+	}
+
+	b := gr.bufPool.Get().(*bytes.Buffer)
+	b.Reset()
+	b.Grow(int(headSize))
+	ip := b.Bytes()[:headSize]
+	fr, err := sf.blobFile(ctx)
+	if err == nil {
+		var n int
+		if n, err = fr.ReadAt(ip, chunkOffset); err == nil && int64(n) != headSize {
+			err = fmt.Errorf("unexpected size of the head of the chunk %d; want %d", n, headSize)
+		}
+	}
+	if err != nil {
+		gr.putBuffer(b)
+		if gr.verify {
+			gr.shared.release()
+			av.finish(cacheID, nil)
+		}
+		return true, fmt.Errorf("failed to read the head of the chunk: %w", err)
+	}
+	gr.countFetch(ip)
+	copy(p, ip[lowerDiscard:])
+	gr.putBuffer(b)
+	if gr.verify {
+		go sf.verifyWholeChunk(chunkOffset, chunkSize, chunkDigestStr, cacheID)
+	}
+	return true, nil
+}
+
+// verifyWholeChunk fetches, verifies and caches the chunk whose head has been returned
+// without verification. The next read of the chunk fails if the verification fails. If the
+// chunk can't be fetched, the next read fetches the chunk again.
+func (sf *file) verifyWholeChunk(chunkOffset, chunkSize int64, chunkDigestStr string, cacheID string) {
+	gr := sf.gr
+	defer gr.shared.release()
+	b := gr.bufPool.Get().(*bytes.Buffer)
+	b.Reset()
+	b.Grow(int(chunkSize))
+	ip := b.Bytes()[:chunkSize]
+	var err error
+	if _, verified, fErr := sf.fetchChunk(sf.fetchCtx, ip, chunkOffset, chunkDigestStr); fErr == nil {
+		if !verified {
+			err = gr.verifyChunk(sf.id, ip, chunkDigestStr)
+		}
+		if err == nil {
+			gr.cacheData(ip, cacheID)
+			gr.indexChunk(chunkDigestStr, cacheID, verified || gr.verify)
+		} else {
+			err = fmt.Errorf("%w: %w", ErrInvalidChunk, err)
+		}
+	}
+	gr.putBuffer(b)
+	gr.asyncVerifier.finish(cacheID, err)
+}
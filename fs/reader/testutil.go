@@ -25,18 +25,24 @@ package reader
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"maps"
 	"os"
 	"path"
 	"path/filepath"
+	"runtime"
 	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/containerd/stargz-snapshotter/cache"
+	"github.com/containerd/stargz-snapshotter/errdefs"
 	"github.com/containerd/stargz-snapshotter/estargz"
 	"github.com/containerd/stargz-snapshotter/metadata"
 	tutil "github.com/containerd/stargz-snapshotter/util/testutil"
@@ -97,7 +103,37 @@ func TestSuiteReader(t *TestRunner, store metadata.Store) {
 	testCacheVerify(t, store)
 	testFailReader(t, store)
 	testPreReader(t, store)
+	testSparseFileReadAt(t, store)
+	testReadAtEOF(t, store)
+	testCloneReader(t, store)
+	testContextReader(t, store)
+	testChunkSources(t, store)
+	testDeltaLayers(t, store)
+	testPassthroughDeltaLayers(t, store)
+	testChunkDedup(t, store)
+	testDigestAlgorithms(t, store)
+	testModelFiles(t, store)
+	testCancelOnClose(t, store)
+	testOpenFileCache(t, store)
+	testFetchConcurrency(t, store)
+	testReadahead(t, store)
+	testAsyncVerify(t, store)
+	testAccessTrace(t, store)
+	testReadHooks(t, store)
+	testReadAtMulti(t, store)
+	testScrub(t, store)
+	testCompressedCache(t, store)
+	testSubChunkFetch(t, store)
+	testCachePriority(t, store)
+	testCacheThrottle(t, store)
+	testCachePathFilter(t, store)
+	testCacheProgress(t, store)
+	testChunkTransformers(t, store)
+	testModelIndexSize(t)
+	testParseDependencies(t)
 	testProcessBatchChunks(t)
+	testRefetchHoles(t)
+	testPrefetchEntireFileBatches(t, store)
 }
 
 func testFileReadAt(t *TestRunner, factory metadata.Store) {
@@ -227,6 +263,201 @@ func testFileReadAt(t *TestRunner, factory metadata.Store) {
 	}
 }
 
+func testSparseFileReadAt(t *TestRunner, factory metadata.Store) {
+	const chunkSize = 4096
+	hole := string(make([]byte, chunkSize))
+	contents := strings.Repeat("a", chunkSize) + hole + hole + strings.Repeat("b", chunkSize) + hole + "c"
+	holes := []region{
+		{chunkSize, 2*chunkSize - 1},
+		{2 * chunkSize, 3*chunkSize - 1},
+		{4 * chunkSize, 5*chunkSize - 1},
+	}
+	for srcCompressionName, srcCompression := range srcCompressions {
+		srcCompression := srcCompression()
+		t.Run("sparse_file_"+srcCompressionName, func(t *TestRunner) {
+			sr, dgst, err := tutil.BuildEStargz([]tutil.TarEntry{
+				tutil.File("test", contents),
+			}, tutil.WithEStargzOptions(estargz.WithChunkSize(chunkSize), estargz.WithCompression(srcCompression), estargz.WithSparseFiles()))
+			if err != nil {
+				t.Fatalf("failed to build sample estargz: %v", err)
+			}
+			mr, err := factory(sr, metadata.WithDecompressors(srcCompression))
+			if err != nil {
+				t.Fatalf("failed to create reader: %v", err)
+			}
+			vr, err := NewReader(mr, cache.NewMemoryCache(), digest.FromString(""))
+			if err != nil {
+				mr.Close()
+				t.Fatalf("failed to make new reader: %v", err)
+			}
+			defer vr.Close()
+			r, err := vr.VerifyTOC(dgst)
+			if err != nil {
+				t.Fatalf("failed to verify TOC: %v", err)
+			}
+			id, _, err := r.Metadata().GetChild(r.Metadata().RootID(), "test")
+			if err != nil {
+				t.Fatalf("failed to get file: %v", err)
+			}
+			ra, err := r.OpenFile(id)
+			if err != nil {
+				t.Fatalf("failed to open file: %v", err)
+			}
+			f := ra.(*file)
+			f.fr = &holeCheckFile{newExceptFile(t, f.fr, holes...), f.fr.(metadata.HoleChecker)}
+
+			// Read across the boundaries of chunks and holes
+			for _, off := range []int64{0, chunkSize / 2, 3*chunkSize - 5, 4*chunkSize + 5} {
+				got := make([]byte, min(2*chunkSize, int64(len(contents))-off))
+				n, err := f.ReadAt(got, off)
+				if err != nil && err != io.EOF {
+					t.Fatalf("failed to read at %d: %v", off, err)
+				}
+				if want := contents[off : off+int64(len(got))]; string(got[:n]) != want {
+					t.Errorf("unexpected data at %d (size=%d)", off, n)
+				}
+			}
+			for _, reg := range holes {
+				if _, err := f.gr.cache.Get(genID(f.id, reg.b, reg.e-reg.b+1)); err == nil {
+					t.Errorf("hole (%d, %d) must not be cached", reg.b, reg.e)
+				}
+			}
+			if !f.Cached() {
+				t.Errorf("file must be cached except holes")
+			}
+		})
+	}
+}
+
+// testReadAtEOF checks the results of reads at the end of files, of empty files and of
+// holes of sparse files with and without WithStrictEOF.
+func testReadAtEOF(t *TestRunner, factory metadata.Store) {
+	const chunkSize = 8
+	data := "0123456789abcdefghij"
+	hole := string(make([]byte, chunkSize))
+	sparse := strings.Repeat("a", chunkSize) + hole + "b"
+	contents := map[string]string{"empty": "", "data": data, "sparse": sparse}
+	tests := []struct {
+		name   string
+		file   string
+		offset int64
+		size   int
+
+		// truncate makes the chunks of the file end at the offset.
+		truncate int64
+
+		wantData string
+		wantErr  error // error wanted with WithStrictEOF. nil is wanted by default.
+		wantFail bool  // the read fails in both modes.
+	}{
+		{name: "whole", file: "data", offset: 0, size: len(data), wantData: data},
+		{name: "inner", file: "data", offset: 3, size: 10, wantData: data[3:13]},
+		{name: "straddling_eof", file: "data", offset: 15, size: 10, wantData: data[15:], wantErr: io.EOF},
+		{name: "straddling_eof_at_chunk", file: "data", offset: chunkSize, size: 20, wantData: data[chunkSize:], wantErr: io.EOF},
+		{name: "at_eof", file: "data", offset: int64(len(data)), size: 4, wantErr: io.EOF},
+		{name: "past_eof", file: "data", offset: 100, size: 4, wantErr: io.EOF},
+		{name: "empty_buffer", file: "data", offset: 3, size: 0},
+		{name: "empty_buffer_at_eof", file: "data", offset: int64(len(data)), size: 0},
+		{name: "empty_file", file: "empty", offset: 0, size: 4, wantErr: io.EOF},
+		{name: "empty_file_empty_buffer", file: "empty", offset: 0, size: 0},
+		{name: "negative_offset", file: "data", offset: -1, size: 4, wantFail: true},
+		{name: "hole", file: "sparse", offset: chunkSize + 2, size: 4, wantData: hole[:4]},
+		{name: "hole_straddling_eof", file: "sparse", offset: chunkSize + 2, size: 2 * chunkSize, wantData: sparse[chunkSize+2:], wantErr: io.EOF},
+		{name: "missing_chunks", file: "data", offset: 3, size: 10, truncate: chunkSize, wantData: data[3:chunkSize], wantErr: io.ErrUnexpectedEOF},
+	}
+	for srcCompressionName, srcCompression := range srcCompressions {
+		srcCompression := srcCompression()
+		for _, strict := range []bool{false, true} {
+			t.Run(fmt.Sprintf("read_at_eof_strict=%v_%s", strict, srcCompressionName), func(t *TestRunner) {
+				var entries []tutil.TarEntry
+				for _, name := range []string{"empty", "data", "sparse"} {
+					entries = append(entries, tutil.File(name, contents[name]))
+				}
+				sr, dgst, err := tutil.BuildEStargz(entries,
+					tutil.WithEStargzOptions(estargz.WithChunkSize(chunkSize), estargz.WithCompression(srcCompression), estargz.WithSparseFiles()))
+				if err != nil {
+					t.Fatalf("failed to build sample estargz: %v", err)
+				}
+				mr, err := factory(sr, metadata.WithDecompressors(srcCompression))
+				if err != nil {
+					t.Fatalf("failed to create reader: %v", err)
+				}
+				var opts []Option
+				if strict {
+					opts = append(opts, WithStrictEOF())
+				}
+				vr, err := NewReader(mr, cache.NewMemoryCache(), digest.FromString(""), opts...)
+				if err != nil {
+					mr.Close()
+					t.Fatalf("failed to make new reader: %v", err)
+				}
+				defer vr.Close()
+				r, err := vr.VerifyTOC(dgst)
+				if err != nil {
+					t.Fatalf("failed to verify TOC: %v", err)
+				}
+				for _, tt := range tests {
+					id, _, err := r.Metadata().GetChild(r.Metadata().RootID(), tt.file)
+					if err != nil {
+						t.Fatalf("failed to get %q: %v", tt.file, err)
+					}
+					ra, err := r.OpenFile(id)
+					if err != nil {
+						t.Fatalf("failed to open %q: %v", tt.file, err)
+					}
+					if tt.truncate > 0 {
+						f := ra.(*file)
+						f.fr = &truncatedFile{f.fr, tt.truncate}
+					}
+					p := make([]byte, tt.size)
+					n, err := ra.ReadAt(p, tt.offset)
+					if tt.wantFail {
+						if err == nil {
+							t.Errorf("%s: read must fail", tt.name)
+						}
+						if n != 0 {
+							t.Errorf("%s: read %d bytes; want 0", tt.name, n)
+						}
+						continue
+					}
+					switch {
+					case !strict && err != nil:
+						t.Errorf("%s: unexpected error: %v", tt.name, err)
+					case strict && tt.wantErr == nil && err != nil:
+						t.Errorf("%s: unexpected error: %v", tt.name, err)
+					case strict && tt.wantErr != nil && !errors.Is(err, tt.wantErr):
+						t.Errorf("%s: error %v; want %v", tt.name, err, tt.wantErr)
+					case strict && tt.wantErr == io.EOF && err != io.EOF:
+						t.Errorf("%s: error %v must be io.EOF itself", tt.name, err)
+					}
+					if got := string(p[:n]); got != tt.wantData {
+						t.Errorf("%s: read %q; want %q", tt.name, got, tt.wantData)
+					}
+				}
+			})
+		}
+	}
+}
+
+// truncatedFile is a metadata.File whose chunks end at the offset.
+type truncatedFile struct {
+	metadata.File
+	end int64
+}
+
+func (f *truncatedFile) ChunkEntryForOffset(offset int64) (int64, int64, string, bool) {
+	if offset >= f.end {
+		return 0, 0, "", false
+	}
+	return f.File.ChunkEntryForOffset(offset)
+}
+
+// holeCheckFile is a metadata.File that also reports holes.
+type holeCheckFile struct {
+	metadata.File
+	metadata.HoleChecker
+}
+
 func newExceptFile(t TestingT, fr metadata.File, except ...region) metadata.File {
 	er := exceptFile{fr: fr, t: t}
 	er.except = map[region]bool{}
@@ -449,150 +680,2652 @@ func (f *failIDVerifier) verifier(id uint32, chunkDigest string) (digest.Verifie
 	return &testVerifier{success}, nil
 }
 
-type testVerifier struct {
-	success bool
+type testVerifier struct {
+	success bool
+}
+
+func (bv *testVerifier) Write(p []byte) (n int, err error) {
+	return len(p), nil
+}
+
+func (bv *testVerifier) Verified() bool {
+	return bv.success
+}
+
+func checkError(wantFail bool, err error) error {
+	if wantFail && err == nil {
+		return fmt.Errorf("wanted to fail but succeeded")
+	} else if !wantFail && err != nil {
+		return fmt.Errorf("wanted to succeed verification but failed: %w", err)
+	}
+	return nil
+}
+
+func prepareMap(mr metadata.Reader, id uint32, p string) (off2id map[int64]uint32, id2path map[uint32]string, _ error) {
+	attr, err := mr.GetAttr(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	id2path = map[uint32]string{id: p}
+	off2id = make(map[int64]uint32)
+	if attr.Mode.IsRegular() {
+		off, err := mr.GetOffset(id)
+		if err != nil {
+			return nil, nil, err
+		}
+		off2id[off] = id
+	}
+	var retErr error
+	mr.ForeachChild(id, func(name string, id uint32, mode os.FileMode) bool {
+		o2i, i2p, err := prepareMap(mr, id, path.Join(p, name))
+		if err != nil {
+			retErr = err
+			return false
+		}
+		maps.Copy(off2id, o2i)
+		maps.Copy(id2path, i2p)
+		return true
+	})
+	if retErr != nil {
+		return nil, nil, retErr
+	}
+	return off2id, id2path, nil
+}
+
+func testFailReader(t *TestRunner, factory metadata.Store) {
+	testFileName := "test"
+	for srcCompressionName, srcCompression := range srcCompressions {
+		srcCompression := srcCompression()
+		t.Run(fmt.Sprintf("%v", srcCompressionName), func(t *TestRunner) {
+			for _, rs := range []bool{true, false} {
+				for _, vs := range []bool{true, false} {
+					stargzFile, tocDigest, err := tutil.BuildEStargz([]tutil.TarEntry{
+						tutil.File(testFileName, sampleData1),
+					}, tutil.WithEStargzOptions(estargz.WithChunkSize(sampleChunkSize), estargz.WithCompression(srcCompression)))
+					if err != nil {
+						t.Fatalf("failed to build sample estargz")
+					}
+
+					br := &breakReaderAt{
+						ReaderAt: stargzFile,
+						success:  true,
+					}
+					bev := &testChunkVerifier{true}
+					mcache := cache.NewMemoryCache()
+					mr, err := factory(io.NewSectionReader(br, 0, stargzFile.Size()), metadata.WithDecompressors(srcCompression))
+					if err != nil {
+						t.Fatalf("failed to prepare metadata reader")
+					}
+					defer mr.Close()
+					vr, err := NewReader(mr, mcache, digest.FromString(""))
+					if err != nil {
+						t.Fatalf("failed to make new reader: %v", err)
+					}
+					defer vr.Close()
+					vr.verifier = bev.verifier
+					vr.r.verifier = bev.verifier
+					gr, err := vr.VerifyTOC(tocDigest)
+					if err != nil {
+						t.Fatalf("failed to verify TOC: %v", err)
+					}
+
+					notexist := uint32(0)
+					found := false
+					for i := range uint32(1000000) {
+						if _, err := gr.Metadata().GetAttr(i); err != nil {
+							notexist, found = i, true
+							break
+						}
+					}
+					if !found {
+						t.Fatalf("free ID not found")
+					}
+
+					// tests for opening non-existing file
+					_, err = gr.OpenFile(notexist)
+					if err == nil {
+						t.Errorf("succeeded to open file but wanted to fail")
+						return
+					}
+
+					// tests failure behaviour of a file read
+					tid, _, err := gr.Metadata().GetChild(gr.Metadata().RootID(), testFileName)
+					if err != nil {
+						t.Errorf("failed to get %q: %v", testFileName, err)
+						return
+					}
+					fr, err := gr.OpenFile(tid)
+					if err != nil {
+						t.Errorf("failed to open file but wanted to succeed: %v", err)
+						return
+					}
+
+					mcache.(*cache.MemoryCache).Membuf = map[string]*bytes.Buffer{}
+					br.success = rs
+					bev.success = vs
+
+					// tests for reading file
+					p := make([]byte, len(sampleData1))
+					n, err := fr.ReadAt(p, 0)
+					if rs && vs {
+						if err != nil || n != len(sampleData1) || !bytes.Equal([]byte(sampleData1), p) {
+							t.Errorf("failed to read data but wanted to succeed: %v", err)
+							return
+						}
+					} else {
+						if err == nil {
+							t.Errorf("succeeded to read data but wanted to fail (reader:%v,verify:%v)", rs, vs)
+							return
+						}
+					}
+				}
+			}
+		})
+	}
+}
+
+func testCloneReader(t *TestRunner, factory metadata.Store) {
+	testFileName := "test"
+	for srcCompressionName, srcCompression := range srcCompressions {
+		srcCompression := srcCompression()
+		t.Run("clone_"+srcCompressionName, func(t *TestRunner) {
+			stargzFile, tocDigest, err := tutil.BuildEStargz([]tutil.TarEntry{
+				tutil.File(testFileName, sampleData1),
+			}, tutil.WithEStargzOptions(estargz.WithChunkSize(sampleChunkSize), estargz.WithCompression(srcCompression)))
+			if err != nil {
+				t.Fatalf("failed to build sample estargz")
+			}
+			mcache := &closeCountCache{BlobCache: cache.NewMemoryCache()}
+			mr, err := factory(stargzFile, metadata.WithDecompressors(srcCompression))
+			if err != nil {
+				t.Fatalf("failed to prepare metadata reader")
+			}
+			vr, err := NewReader(mr, mcache, digest.FromString(""))
+			if err != nil {
+				t.Fatalf("failed to make new reader: %v", err)
+			}
+			cra := &calledReaderAt{ReaderAt: stargzFile}
+			cvr, err := vr.Clone(io.NewSectionReader(cra, 0, stargzFile.Size()))
+			if err != nil {
+				t.Fatalf("failed to clone reader: %v", err)
+			}
+
+			// The shared resources must be available until all readers are closed.
+			if err := vr.Close(); err != nil {
+				t.Fatalf("failed to close reader: %v", err)
+			}
+			if mcache.closed != 0 {
+				t.Fatalf("cache is closed while the clone is in use")
+			}
+			if _, err := vr.Clone(io.NewSectionReader(stargzFile, 0, stargzFile.Size())); err == nil {
+				t.Fatalf("closed reader must not be cloned")
+			}
+			gr, err := cvr.VerifyTOC(tocDigest)
+			if err != nil {
+				t.Fatalf("failed to verify TOC of the clone: %v", err)
+			}
+			tid, err := lookup(gr.(*reader), testFileName)
+			if err != nil {
+				t.Fatalf("failed to get %q: %v", testFileName, err)
+			}
+			fr, err := gr.OpenFile(tid)
+			if err != nil {
+				t.Fatalf("failed to open file: %v", err)
+			}
+			p := make([]byte, len(sampleData1))
+			if n, err := fr.ReadAt(p, 0); (err != nil && err != io.EOF) || n != len(p) || !bytes.Equal([]byte(sampleData1), p) {
+				t.Fatalf("failed to read data from the clone: %v", err)
+			}
+			if len(cra.called) == 0 {
+				t.Fatalf("the clone must read the blob from the passed reader")
+			}
+
+			if err := cvr.Close(); err != nil {
+				t.Fatalf("failed to close the clone: %v", err)
+			}
+			if mcache.closed != 1 {
+				t.Fatalf("cache must be closed once after all readers are closed; closed %d times", mcache.closed)
+			}
+		})
+	}
+}
+
+type ctxKey struct{}
+
+// contextRecorder is a ContextReaderAt that records the contexts of reads.
+type contextRecorder struct {
+	io.ReaderAt
+	mu   sync.Mutex
+	ctxs []context.Context
+}
+
+func (r *contextRecorder) ReadAtContext(ctx context.Context, p []byte, off int64) (int, error) {
+	r.mu.Lock()
+	r.ctxs = append(r.ctxs, ctx)
+	r.mu.Unlock()
+	return r.ReadAt(p, off)
+}
+
+func testContextReader(t *TestRunner, factory metadata.Store) {
+	testFileName := "test"
+	for srcCompressionName, srcCompression := range srcCompressions {
+		srcCompression := srcCompression()
+		t.Run("context_reader_"+srcCompressionName, func(t *TestRunner) {
+			stargzFile, tocDigest, err := tutil.BuildEStargz([]tutil.TarEntry{
+				tutil.File(testFileName, sampleData1),
+			}, tutil.WithEStargzOptions(estargz.WithChunkSize(sampleChunkSize), estargz.WithCompression(srcCompression)))
+			if err != nil {
+				t.Fatalf("failed to build sample estargz")
+			}
+			mr, err := factory(stargzFile, metadata.WithDecompressors(srcCompression))
+			if err != nil {
+				t.Fatalf("failed to prepare metadata reader")
+			}
+			vr, err := NewReader(mr, cache.NewMemoryCache(), digest.FromString(""))
+			if err != nil {
+				t.Fatalf("failed to make new reader: %v", err)
+			}
+			defer vr.Close()
+			rec := &contextRecorder{ReaderAt: stargzFile}
+			cvr, err := vr.Clone(io.NewSectionReader(rec, 0, stargzFile.Size()))
+			if err != nil {
+				t.Fatalf("failed to clone reader: %v", err)
+			}
+			defer cvr.Close()
+			gr, err := cvr.VerifyTOC(tocDigest)
+			if err != nil {
+				t.Fatalf("failed to verify TOC of the clone: %v", err)
+			}
+			tid, err := lookup(gr.(*reader), testFileName)
+			if err != nil {
+				t.Fatalf("failed to get %q: %v", testFileName, err)
+			}
+			fr, err := gr.OpenFile(tid)
+			if err != nil {
+				t.Fatalf("failed to open file: %v", err)
+			}
+			cfr, ok := fr.(ContextReaderAt)
+			if !ok {
+				t.Fatalf("file must be ContextReaderAt")
+			}
+			ctx, cancel := context.WithCancel(context.WithValue(context.Background(), ctxKey{}, "req"))
+			defer cancel()
+			p := make([]byte, len(sampleData1))
+			if n, err := cfr.ReadAtContext(ctx, p, 0); (err != nil && err != io.EOF) || n != len(p) || !bytes.Equal([]byte(sampleData1), p) {
+				t.Fatalf("failed to read data with context: %v", err)
+			}
+			rec.mu.Lock()
+			defer rec.mu.Unlock()
+			if len(rec.ctxs) == 0 {
+				t.Fatalf("the blob must be read with the context")
+			}
+			for _, c := range rec.ctxs {
+				if c.Value(ctxKey{}) != "req" {
+					t.Fatalf("context of the read operation must be propagated to the blob")
+				}
+			}
+		})
+	}
+}
+
+func testDigestAlgorithms(t *TestRunner, factory metadata.Store) {
+	testFileName := "test"
+	for _, alg := range []digest.Algorithm{digest.SHA384, digest.SHA512} {
+		t.Run("digest_algorithm_"+string(alg), func(t *TestRunner) {
+			stargzFile, tocDigest, err := tutil.BuildEStargz([]tutil.TarEntry{
+				tutil.File(testFileName, sampleData1),
+			}, tutil.WithEStargzOptions(estargz.WithChunkSize(sampleChunkSize), estargz.WithDigestAlgorithm(alg)))
+			if err != nil {
+				t.Fatalf("failed to build sample estargz: %v", err)
+			}
+			mr, err := factory(stargzFile)
+			if err != nil {
+				t.Fatalf("failed to prepare metadata reader: %v", err)
+			}
+			vr, err := NewReader(mr, cache.NewMemoryCache(), digest.FromString(""))
+			if err != nil {
+				mr.Close()
+				t.Fatalf("failed to make new reader: %v", err)
+			}
+			defer vr.Close()
+			gr, err := vr.VerifyTOC(tocDigest)
+			if err != nil {
+				t.Fatalf("failed to verify TOC: %v", err)
+			}
+			tid, err := lookup(gr.(*reader), testFileName)
+			if err != nil {
+				t.Fatalf("failed to get %q: %v", testFileName, err)
+			}
+			fr, err := gr.OpenFile(tid)
+			if err != nil {
+				t.Fatalf("failed to open file: %v", err)
+			}
+			f := fr.(*file)
+			for off := int64(0); off < int64(len(sampleData1)); off += sampleChunkSize {
+				_, _, dgst, ok := f.fr.ChunkEntryForOffset(off)
+				if !ok {
+					t.Fatalf("chunk at %d not found", off)
+				}
+				if d, err := digest.Parse(dgst); err != nil || d.Algorithm() != alg {
+					t.Fatalf("chunk digest %q must be %v: %v", dgst, alg, err)
+				}
+			}
+			p := make([]byte, len(sampleData1))
+			if n, err := fr.ReadAt(p, 0); (err != nil && err != io.EOF) || n != len(p) || !bytes.Equal([]byte(sampleData1), p) {
+				t.Fatalf("failed to read data: %v", err)
+			}
+		})
+	}
+}
+
+func testChunkSources(t *TestRunner, factory metadata.Store) {
+	testFileName := "test"
+	tests := []struct {
+		name         string
+		sources      func(peer ChunkSource) []Source
+		peer         *testChunkSource
+		blobFailures int
+		fromBlob     bool
+		wantCalls    int
+		wantErr      bool
+	}{
+		{
+			name: "peer-first",
+			sources: func(peer ChunkSource) []Source {
+				return []Source{{Name: "peer", ChunkSource: peer}, {Name: BlobSourceName}}
+			},
+			peer:      &testChunkSource{data: []byte(sampleData1)},
+			wantCalls: 1,
+		},
+		{
+			name: "peer-not-found",
+			sources: func(peer ChunkSource) []Source {
+				return []Source{{Name: "peer", ChunkSource: peer, MaxRetries: 3}, {Name: BlobSourceName}}
+			},
+			peer:      &testChunkSource{},
+			fromBlob:  true,
+			wantCalls: 1,
+		},
+		{
+			name: "peer-invalid-data",
+			sources: func(peer ChunkSource) []Source {
+				return []Source{{Name: "peer", ChunkSource: peer}, {Name: BlobSourceName}}
+			},
+			peer:      &testChunkSource{data: []byte(strings.Repeat("x", len(sampleData1)))},
+			fromBlob:  true,
+			wantCalls: 1,
+		},
+		{
+			name: "peer-retry",
+			sources: func(peer ChunkSource) []Source {
+				return []Source{{Name: "peer", ChunkSource: peer, MaxRetries: 1}, {Name: BlobSourceName}}
+			},
+			peer:      &testChunkSource{data: []byte(sampleData1), failures: 1},
+			wantCalls: 2,
+		},
+		{
+			name: "peer-not-retryable",
+			sources: func(peer ChunkSource) []Source {
+				return []Source{{Name: "peer", ChunkSource: peer, MaxRetries: 3}, {Name: BlobSourceName}}
+			},
+			peer:      &testChunkSource{data: []byte(sampleData1), failures: 3, failErr: errdefs.ErrUnauthorized},
+			fromBlob:  true,
+			wantCalls: 1,
+		},
+		{
+			name: "peer-retry-backoff",
+			sources: func(peer ChunkSource) []Source {
+				return []Source{{Name: "peer", ChunkSource: peer, MaxRetries: 3, RetryInterval: time.Millisecond, MaxRetryInterval: 4 * time.Millisecond}}
+			},
+			peer:      &testChunkSource{data: []byte(sampleData1), failures: 3},
+			wantCalls: 4,
+		},
+		{
+			name: "blob-retry",
+			sources: func(peer ChunkSource) []Source {
+				return []Source{{Name: BlobSourceName, MaxRetries: 2, RetryInterval: time.Millisecond, MaxRetryInterval: 4 * time.Millisecond}}
+			},
+			peer:         &testChunkSource{},
+			blobFailures: 2,
+			fromBlob:     true,
+		},
+		{
+			name: "blob-retry-exhausted",
+			sources: func(peer ChunkSource) []Source {
+				return []Source{{Name: BlobSourceName, MaxRetries: 1, RetryInterval: time.Millisecond}}
+			},
+			peer:         &testChunkSource{},
+			blobFailures: 2,
+			wantErr:      true,
+		},
+		{
+			name: "blob-first",
+			sources: func(peer ChunkSource) []Source {
+				return []Source{{Name: BlobSourceName}, {Name: "peer", ChunkSource: peer}}
+			},
+			peer:      &testChunkSource{data: []byte(sampleData1)},
+			fromBlob:  true,
+			wantCalls: 0,
+		},
+		{
+			name: "peer-only",
+			sources: func(peer ChunkSource) []Source {
+				return []Source{{Name: "peer", ChunkSource: peer}}
+			},
+			peer:      &testChunkSource{},
+			wantErr:   true,
+			wantCalls: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run("chunk_sources_"+tt.name, func(t *TestRunner) {
+			stargzFile, tocDigest, err := tutil.BuildEStargz([]tutil.TarEntry{
+				tutil.File(testFileName, sampleData1),
+			}, tutil.WithEStargzOptions(estargz.WithChunkSize(len(sampleData1))))
+			if err != nil {
+				t.Fatalf("failed to build sample estargz")
+			}
+			cra := &calledReaderAt{ReaderAt: stargzFile}
+			mr, err := factory(io.NewSectionReader(cra, 0, stargzFile.Size()))
+			if err != nil {
+				t.Fatalf("failed to prepare metadata reader")
+			}
+			vr, err := NewReader(mr, cache.NewMemoryCache(), digest.FromString(""), WithSources(tt.sources(tt.peer)...))
+			if err != nil {
+				t.Fatalf("failed to make new reader: %v", err)
+			}
+			defer vr.Close()
+			gr, err := vr.VerifyTOC(tocDigest)
+			if err != nil {
+				t.Fatalf("failed to verify TOC: %v", err)
+			}
+			tid, err := lookup(gr.(*reader), testFileName)
+			if err != nil {
+				t.Fatalf("failed to get %q: %v", testFileName, err)
+			}
+			fr, err := gr.OpenFile(tid)
+			if err != nil {
+				t.Fatalf("failed to open file: %v", err)
+			}
+			cra.called = nil
+			cra.failures = tt.blobFailures
+			p := make([]byte, len(sampleData1))
+			n, err := fr.ReadAt(p, 0)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("reading must fail when no source has the chunk")
+				}
+				return
+			}
+			if (err != nil && err != io.EOF) || n != len(p) || !bytes.Equal([]byte(sampleData1), p) {
+				t.Fatalf("failed to read data: %v", err)
+			}
+			if fromBlob := len(cra.called) > 0; fromBlob != tt.fromBlob {
+				t.Errorf("read from blob = %v; want %v", fromBlob, tt.fromBlob)
+			}
+			if tt.peer.called != tt.wantCalls {
+				t.Errorf("peer is called %d times; want %d", tt.peer.called, tt.wantCalls)
+			}
+			if c := tt.peer.chunk; tt.peer.called > 0 && (c.ID != tid || c.Offset != 0 || c.Size != int64(len(sampleData1)) || c.Digest == "") {
+				t.Errorf("unexpected chunk requested to the peer: %+v", c)
+			}
+		})
+	}
+}
+
+func testDeltaLayers(t *TestRunner, factory metadata.Store) {
+	const chunkSize = 4096
+	testFileName := "test"
+	baseContents := strings.Repeat("a", chunkSize) + strings.Repeat("b", chunkSize)
+	deltaContents := strings.Repeat("a", chunkSize) + strings.Repeat("c", chunkSize)
+	tests := []struct {
+		name      string
+		readBase  bool
+		closeBase bool
+		// closeBaseAfterDelta closes the base layer after the delta layer is opened, which
+		// refers to the chunks of the base layer.
+		closeBaseAfterDelta bool
+		noIndex             bool
+		wantErr             bool
+	}{
+		{name: "resolved", readBase: true},
+		{name: "base-not-cached", wantErr: true},
+		{name: "base-closed", readBase: true, closeBase: true, wantErr: true},
+		{name: "base-closed-after-delta", readBase: true, closeBaseAfterDelta: true},
+		{name: "no-index", readBase: true, noIndex: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run("delta_layers_"+tt.name, func(t *TestRunner) {
+			idx := NewChunkIndex()
+			var baseCache *closeRecordCache
+			openFile := func(sr *io.SectionReader, tocDigest digest.Digest, opts ...Option) (*VerifiableReader, io.ReaderAt) {
+				mr, err := factory(sr)
+				if err != nil {
+					t.Fatalf("failed to prepare metadata reader: %v", err)
+				}
+				c := &closeRecordCache{BlobCache: cache.NewMemoryCache()}
+				if baseCache == nil {
+					baseCache = c
+				}
+				vr, err := NewReader(mr, c, digest.FromString(""), opts...)
+				if err != nil {
+					t.Fatalf("failed to make new reader: %v", err)
+				}
+				if err := vr.RefBaseChunks(); err != nil {
+					t.Fatalf("failed to refer to base chunks: %v", err)
+				}
+				gr, err := vr.VerifyTOC(tocDigest)
+				if err != nil {
+					t.Fatalf("failed to verify TOC: %v", err)
+				}
+				tid, err := lookup(gr.(*reader), testFileName)
+				if err != nil {
+					t.Fatalf("failed to get %q: %v", testFileName, err)
+				}
+				fr, err := gr.OpenFile(tid)
+				if err != nil {
+					t.Fatalf("failed to open file: %v", err)
+				}
+				return vr, fr
+			}
+
+			baseFile, baseTOCDigest, err := tutil.BuildEStargz([]tutil.TarEntry{
+				tutil.File(testFileName, baseContents),
+			}, tutil.WithEStargzOptions(estargz.WithChunkSize(chunkSize)))
+			if err != nil {
+				t.Fatalf("failed to build base estargz: %v", err)
+			}
+			base, err := estargz.Open(baseFile)
+			if err != nil {
+				t.Fatalf("failed to open base estargz: %v", err)
+			}
+			deltaFile, deltaTOCDigest, err := tutil.BuildEStargz([]tutil.TarEntry{
+				tutil.File(testFileName, deltaContents),
+			}, tutil.WithEStargzOptions(estargz.WithChunkSize(chunkSize), estargz.WithDeltaBase(base)))
+			if err != nil {
+				t.Fatalf("failed to build delta estargz: %v", err)
+			}
+
+			baseVR, baseFR := openFile(baseFile, baseTOCDigest, WithChunkIndex(idx))
+			defer baseVR.Close()
+			checkHasBaseChunks(t, baseVR, false)
+			if tt.readBase {
+				p := make([]byte, len(baseContents))
+				if n, err := baseFR.ReadAt(p, 0); (err != nil && err != io.EOF) || n != len(p) {
+					t.Fatalf("failed to read base: %v", err)
+				}
+			}
+			if tt.closeBase {
+				baseVR.Close()
+			}
+
+			var opts []Option
+			if !tt.noIndex {
+				opts = append(opts, WithChunkIndex(idx))
+			}
+			cra := &calledReaderAt{ReaderAt: deltaFile}
+			deltaVR, deltaFR := openFile(io.NewSectionReader(cra, 0, deltaFile.Size()), deltaTOCDigest, opts...)
+			defer deltaVR.Close()
+			checkHasBaseChunks(t, deltaVR, true)
+			if tt.closeBaseAfterDelta {
+				baseVR.Close()
+				if baseCache.isClosed() {
+					t.Fatalf("cache of the base layer must be kept for the delta layer")
+				}
+				defer func() {
+					deltaVR.Close()
+					if !baseCache.isClosed() {
+						t.Errorf("cache of the base layer must be closed after the delta layer is closed")
+					}
+				}()
+			}
+			cra.called = nil
+			p := make([]byte, chunkSize)
+			n, err := deltaFR.ReadAt(p, 0)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("reading base chunk must fail")
+				}
+				if !errors.Is(err, ErrChunkNotFound) {
+					t.Errorf("error = %v; want %v", err, ErrChunkNotFound)
+				}
+				return
+			}
+			if (err != nil && err != io.EOF) || n != len(p) || string(p) != deltaContents[:chunkSize] {
+				t.Fatalf("failed to read base chunk: %v", err)
+			}
+			if len(cra.called) > 0 {
+				t.Errorf("base chunk must not be read from the delta blob: %v", cra.called)
+			}
+			p = make([]byte, len(deltaContents))
+			if n, err := deltaFR.ReadAt(p, 0); (err != nil && err != io.EOF) || n != len(p) || string(p) != deltaContents {
+				t.Fatalf("failed to read delta layer: %v", err)
+			}
+		})
+	}
+}
+
+func checkHasBaseChunks(t TestingT, vr *VerifiableReader, want bool) {
+	has, err := metadata.HasBaseChunks(vr.Metadata())
+	if err != nil {
+		t.Fatalf("failed to check base chunks: %v", err)
+	}
+	if has != want {
+		t.Errorf("HasBaseChunks() = %v; want %v", has, want)
+	}
+}
+
+// testPassthroughDeltaLayers checks that files of delta layers taken over by FUSE passthrough
+// are assembled with the chunks stored in the base layer.
+func testPassthroughDeltaLayers(t *TestRunner, factory metadata.Store) {
+	const chunkSize = 4096
+	testFileName := "test"
+	baseContents := strings.Repeat("a", chunkSize) + strings.Repeat("b", chunkSize)
+	deltaContents := strings.Repeat("a", chunkSize) + strings.Repeat("c", chunkSize)
+	for _, tt := range []struct {
+		name            string
+		mergeBufferSize int64
+	}{
+		{name: "batch", mergeBufferSize: 4 * chunkSize},
+		{name: "sequential", mergeBufferSize: chunkSize / 2}, // chunks larger than the buffer
+	} {
+		t.Run("passthrough_delta_layers_"+tt.name, func(t *TestRunner) {
+			idx := NewChunkIndex()
+			openFile := func(sr *io.SectionReader, tocDigest digest.Digest, c cache.BlobCache) (*VerifiableReader, *file) {
+				mr, err := factory(sr)
+				if err != nil {
+					t.Fatalf("failed to prepare metadata reader: %v", err)
+				}
+				vr, err := NewReader(mr, c, digest.FromString(""), WithChunkIndex(idx))
+				if err != nil {
+					t.Fatalf("failed to make new reader: %v", err)
+				}
+				gr, err := vr.VerifyTOC(tocDigest)
+				if err != nil {
+					t.Fatalf("failed to verify TOC: %v", err)
+				}
+				tid, err := lookup(gr.(*reader), testFileName)
+				if err != nil {
+					t.Fatalf("failed to get %q: %v", testFileName, err)
+				}
+				fr, err := gr.OpenFile(tid)
+				if err != nil {
+					t.Fatalf("failed to open file: %v", err)
+				}
+				return vr, fr.(*file)
+			}
+
+			baseFile, baseTOCDigest, err := tutil.BuildEStargz([]tutil.TarEntry{
+				tutil.File(testFileName, baseContents),
+			}, tutil.WithEStargzOptions(estargz.WithChunkSize(chunkSize)))
+			if err != nil {
+				t.Fatalf("failed to build base estargz: %v", err)
+			}
+			base, err := estargz.Open(baseFile)
+			if err != nil {
+				t.Fatalf("failed to open base estargz: %v", err)
+			}
+			deltaFile, deltaTOCDigest, err := tutil.BuildEStargz([]tutil.TarEntry{
+				tutil.File(testFileName, deltaContents),
+			}, tutil.WithEStargzOptions(estargz.WithChunkSize(chunkSize), estargz.WithDeltaBase(base)))
+			if err != nil {
+				t.Fatalf("failed to build delta estargz: %v", err)
+			}
+
+			baseVR, baseFR := openFile(baseFile, baseTOCDigest, cache.NewMemoryCache())
+			defer baseVR.Close()
+			p := make([]byte, len(baseContents))
+			if n, err := baseFR.ReadAt(p, 0); (err != nil && err != io.EOF) || n != len(p) {
+				t.Fatalf("failed to read base: %v", err)
+			}
+
+			dir, err := os.MkdirTemp("", "passthrough-delta")
+			if err != nil {
+				t.Fatalf("failed to make cache dir: %v", err)
+			}
+			t.Cleanup(func() { os.RemoveAll(dir) })
+			dc, err := cache.NewDirectoryCache(dir, cache.DirectoryCacheConfig{SyncAdd: true, Direct: true})
+			if err != nil {
+				t.Fatalf("failed to make directory cache: %v", err)
+			}
+			cra := &calledReaderAt{ReaderAt: deltaFile}
+			deltaVR, deltaFR := openFile(io.NewSectionReader(cra, 0, deltaFile.Size()), deltaTOCDigest, dc)
+			defer deltaVR.Close()
+			cra.called = nil
+			_, cr, err := deltaFR.GetPassthroughFd(tt.mergeBufferSize, 2)
+			if err != nil {
+				t.Fatalf("failed to get passthrough fd: %v", err)
+			}
+			defer cr.Close()
+			got := make([]byte, len(deltaContents))
+			if n, err := cr.ReadAt(got, 0); (err != nil && err != io.EOF) || n != len(got) || string(got) != deltaContents {
+				t.Fatalf("unexpected contents of the passthrough file: %q, %v", longBytesView(got[:n]), err)
+			}
+			// Only the second chunk is stored in the delta blob.
+			if len(cra.called) != 1 {
+				t.Errorf("base chunk must not be read from the delta blob: %v", cra.called)
+			}
+		})
+	}
+}
+
+func testChunkDedup(t *TestRunner, factory metadata.Store) {
+	const chunkSize = 4096
+	shared := strings.Repeat("a", chunkSize) + strings.Repeat("b", chunkSize)
+	tests := []struct {
+		name         string
+		noDedup      bool
+		corrupted    bool // the chunks cached by the other layer don't match the digests
+		tampered     bool // the cache of the other layer is modified after the chunks are verified
+		verifyCached bool
+		wantFetched  bool
+		wantTampered bool
+	}{
+		{name: "hit"},
+		{name: "disabled", noDedup: true, wantFetched: true},
+		{name: "corrupted", corrupted: true, wantFetched: true},
+		// The verification of the chunks verified when cached is skipped.
+		{name: "tampered", tampered: true, wantTampered: true},
+		{name: "tampered_verify_cached", tampered: true, verifyCached: true, wantFetched: true},
+	}
+	for _, tt := range tests {
+		t.Run("chunk_dedup_"+tt.name, func(t *TestRunner) {
+			idx := NewChunkIndex()
+			aCache := cache.NewMemoryCache()
+			openFile := func(sr *io.SectionReader, tocDigest digest.Digest, layer, name string, opts ...Option) (*VerifiableReader, io.ReaderAt) {
+				mr, err := factory(sr)
+				if err != nil {
+					t.Fatalf("failed to prepare metadata reader: %v", err)
+				}
+				vr, err := NewReader(mr, aCache, digest.FromString(layer), opts...)
+				if err != nil {
+					t.Fatalf("failed to make new reader: %v", err)
+				}
+				var gr Reader
+				if tt.corrupted && layer == "a" {
+					gr = vr.SkipVerify()
+				} else if gr, err = vr.VerifyTOC(tocDigest); err != nil {
+					t.Fatalf("failed to verify TOC: %v", err)
+				}
+				id, err := lookup(gr.(*reader), name)
+				if err != nil {
+					t.Fatalf("failed to get %q: %v", name, err)
+				}
+				fr, err := gr.OpenFile(id)
+				if err != nil {
+					t.Fatalf("failed to open file: %v", err)
+				}
+				return vr, fr
+			}
+
+			aFile, aTOCDigest, err := tutil.BuildEStargz([]tutil.TarEntry{
+				tutil.File("a", shared),
+			}, tutil.WithEStargzOptions(estargz.WithChunkSize(chunkSize)))
+			if err != nil {
+				t.Fatalf("failed to build estargz: %v", err)
+			}
+			// The layers are compressed differently but have the same uncompressed chunks.
+			bCompression := srcCompressions["zstd-fastest"]()
+			bFile, bTOCDigest, err := tutil.BuildEStargz([]tutil.TarEntry{
+				tutil.File("other", "other"),
+				tutil.File("b", shared),
+			}, tutil.WithEStargzOptions(estargz.WithChunkSize(chunkSize), estargz.WithCompression(bCompression)))
+			if err != nil {
+				t.Fatalf("failed to build estargz: %v", err)
+			}
+
+			aOpts := []Option{WithChunkIndex(idx)}
+			if tt.corrupted {
+				aOpts = append(aOpts, WithChunkTransformers(&upperTransformer{}))
+			}
+			aVR, aFR := openFile(aFile, aTOCDigest, "a", "a", aOpts...)
+			defer aVR.Close()
+			p := make([]byte, len(shared))
+			if n, err := aFR.ReadAt(p, 0); (err != nil && err != io.EOF) || n != len(p) {
+				t.Fatalf("failed to read layer a: %v", err)
+			}
+			if tt.tampered {
+				for _, b := range aCache.(*cache.MemoryCache).Membuf {
+					copy(b.Bytes(), bytes.ToUpper(b.Bytes()))
+				}
+			}
+
+			bOpts := []Option{WithChunkIndex(idx)}
+			if !tt.noDedup {
+				bOpts = append(bOpts, WithChunkDedup())
+			}
+			if tt.verifyCached {
+				bOpts = append(bOpts, WithVerifyCachedChunks())
+			}
+			cra := &calledReaderAt{ReaderAt: bFile}
+			bMR, err := factory(io.NewSectionReader(cra, 0, bFile.Size()), metadata.WithDecompressors(bCompression))
+			if err != nil {
+				t.Fatalf("failed to prepare metadata reader: %v", err)
+			}
+			bVR, err := NewReader(bMR, cache.NewMemoryCache(), digest.FromString("b"), bOpts...)
+			if err != nil {
+				t.Fatalf("failed to make new reader: %v", err)
+			}
+			defer bVR.Close()
+			bR, err := bVR.VerifyTOC(bTOCDigest)
+			if err != nil {
+				t.Fatalf("failed to verify TOC: %v", err)
+			}
+			bID, err := lookup(bR.(*reader), "b")
+			if err != nil {
+				t.Fatalf("failed to get b: %v", err)
+			}
+			bFR, err := bR.OpenFile(bID)
+			if err != nil {
+				t.Fatalf("failed to open b: %v", err)
+			}
+			cra.called = nil
+			p = make([]byte, len(shared))
+			want := shared
+			if tt.wantTampered {
+				want = strings.ToUpper(shared)
+			}
+			if n, err := bFR.ReadAt(p, 0); (err != nil && err != io.EOF) || n != len(p) || string(p) != want {
+				t.Fatalf("failed to read layer b: %v", err)
+			}
+			if fetched := len(cra.called) > 0; fetched != tt.wantFetched {
+				t.Errorf("fetched from the blob = %v; want %v", fetched, tt.wantFetched)
+			}
+		})
+	}
+}
+
+func testModelFiles(t *TestRunner, factory metadata.Store) {
+	const (
+		chunkSize = 16
+		unitSize  = 64
+		modelName = "model.safetensors"
+		otherName = "other.bin"
+	)
+	hdr := `{"a":{"dtype":"U8","shape":[200],"data_offsets":[0,200]}}`
+	model := binary.LittleEndian.AppendUint64(nil, uint64(len(hdr)))
+	model = append(model, hdr...)
+	indexSize := int64(len(model))
+	model = append(model, bytes.Repeat([]byte("m"), 200)...)
+	other := strings.Repeat("o", 200)
+	for srcCompressionName, srcCompression := range srcCompressions {
+		srcCompression := srcCompression()
+		t.Run("model_files_"+srcCompressionName, func(t *TestRunner) {
+			stargzFile, tocDigest, err := tutil.BuildEStargz([]tutil.TarEntry{
+				tutil.Dir("models/"),
+				tutil.File("models/"+modelName, string(model)),
+				tutil.File(otherName, other),
+			}, tutil.WithEStargzOptions(estargz.WithChunkSize(chunkSize), estargz.WithCompression(srcCompression)))
+			if err != nil {
+				t.Fatalf("failed to build sample estargz: %v", err)
+			}
+			mr, err := factory(stargzFile, metadata.WithDecompressors(srcCompression))
+			if err != nil {
+				t.Fatalf("failed to prepare metadata reader: %v", err)
+			}
+			match := func(name string) bool { return strings.HasSuffix(name, ".safetensors") }
+			vr, err := NewReader(mr, cache.NewMemoryCache(), digest.FromString(""), WithModelFiles(match, unitSize))
+			if err != nil {
+				t.Fatalf("failed to make new reader: %v", err)
+			}
+			defer vr.Close()
+			r, err := vr.VerifyTOC(tocDigest)
+			if err != nil {
+				t.Fatalf("failed to verify TOC: %v", err)
+			}
+			gr := r.(*reader)
+			cachedChunks := func(id uint32, size int64) (cached []int64) {
+				for off := int64(0); off < size; off += chunkSize {
+					if cr, err := gr.cache.Get(genID(id, off, min(chunkSize, size-off))); err == nil {
+						cr.Close()
+						cached = append(cached, off)
+					}
+				}
+				return
+			}
+			for _, tt := range []struct {
+				name       string
+				data       []byte
+				wantCached []int64
+			}{
+				{"models/" + modelName, model, []int64{64, 80, 96, 112}},
+				{otherName, []byte(other), []int64{64}},
+			} {
+				id, err := lookup(gr, tt.name)
+				if err != nil {
+					t.Fatalf("failed to lookup %q: %v", tt.name, err)
+				}
+				fr, err := gr.OpenFile(id)
+				if err != nil {
+					t.Fatalf("failed to open %q: %v", tt.name, err)
+				}
+				p := make([]byte, 4)
+				if n, err := fr.ReadAt(p, 70); err != nil || n != len(p) || !bytes.Equal(p, tt.data[70:74]) {
+					t.Fatalf("failed to read %q: %v (n=%d, data=%q)", tt.name, err, n, p)
+				}
+				if got := cachedChunks(id, int64(len(tt.data))); !slices.Equal(got, tt.wantCached) {
+					t.Errorf("cached chunks of %q = %v; want %v", tt.name, got, tt.wantCached)
+				}
+			}
+
+			// Indexes are cached by prefetch.
+			id, err := lookup(gr, "models/"+modelName)
+			if err != nil {
+				t.Fatalf("failed to lookup model: %v", err)
+			}
+			if err := PrefetchModelIndexes(gr, match); err != nil {
+				t.Fatalf("failed to prefetch model indexes: %v", err)
+			}
+			cached := cachedChunks(id, int64(len(model)))
+			for off := int64(0); off < indexSize; off += chunkSize {
+				if !slices.Contains(cached, off) {
+					t.Errorf("chunk at %d of the index isn't cached: %v", off, cached)
+				}
+			}
+		})
+	}
+}
+
+func testCancelOnClose(t *TestRunner, factory metadata.Store) {
+	const (
+		chunkSize = 16
+		unitSize  = 64
+		modelName = "model.safetensors"
+	)
+	for srcCompressionName, srcCompression := range srcCompressions {
+		srcCompression := srcCompression()
+		t.Run("cancel_on_close_"+srcCompressionName, func(t *TestRunner) {
+			stargzFile, tocDigest, err := tutil.BuildEStargz([]tutil.TarEntry{
+				tutil.File(modelName, strings.Repeat("m", 200)),
+			}, tutil.WithEStargzOptions(estargz.WithChunkSize(chunkSize), estargz.WithCompression(srcCompression)))
+			if err != nil {
+				t.Fatalf("failed to build sample estargz: %v", err)
+			}
+			mr, err := factory(stargzFile, metadata.WithDecompressors(srcCompression))
+			if err != nil {
+				t.Fatalf("failed to prepare metadata reader: %v", err)
+			}
+			src := &blockingChunkSource{started: make(chan struct{}, unitSize/chunkSize), canceled: make(chan struct{}, unitSize/chunkSize)}
+			match := func(name string) bool { return name == modelName }
+			vr, err := NewReader(mr, cache.NewMemoryCache(), digest.FromString(""),
+				WithModelFiles(match, unitSize),
+				WithSources(Source{Name: "blocking", ChunkSource: src}),
+				WithCancelOnClose(time.Hour))
+			if err != nil {
+				t.Fatalf("failed to make new reader: %v", err)
+			}
+			defer vr.Close()
+			r, err := vr.VerifyTOC(tocDigest)
+			if err != nil {
+				t.Fatalf("failed to verify TOC: %v", err)
+			}
+			gr := r.(*reader)
+			id, err := lookup(gr, modelName)
+			if err != nil {
+				t.Fatalf("failed to lookup model: %v", err)
+			}
+			open := func() *file {
+				ra, err := gr.OpenFile(id)
+				if err != nil {
+					t.Fatalf("failed to open model: %v", err)
+				}
+				return ra.(*file)
+			}
+
+			// Canceling the read doesn't cancel the fetch unit.
+			f1, f2 := open(), open()
+			ctx, cancel := context.WithCancel(context.Background())
+			errCh := make(chan error)
+			go func() {
+				_, err := f1.ReadAtContext(ctx, make([]byte, 4), 0)
+				errCh <- err
+			}()
+			<-src.started
+			cancel()
+			if err := <-errCh; !errors.Is(err, context.Canceled) {
+				t.Fatalf("read must be canceled but got %v", err)
+			}
+
+			// The fetch continues while a handle is open or within the grace period.
+			f1.Close()
+			f2.Close()
+			f3 := open()
+			if f3.fetchCtx != f1.fetchCtx {
+				t.Errorf("file reopened within the grace period must share the fetches")
+			}
+			select {
+			case <-src.canceled:
+				t.Fatalf("fetch must not be canceled while the file is open")
+			case <-time.After(100 * time.Millisecond):
+			}
+
+			// The fetch is canceled after the grace period following the last close.
+			f3.Close()
+			gr.openFiles.mu.Lock()
+			timer := gr.openFiles.files[id].timer
+			gr.openFiles.mu.Unlock()
+			if timer == nil || !timer.Reset(0) {
+				t.Fatalf("grace period must be running")
+			}
+			select {
+			case <-src.canceled:
+			case <-time.After(10 * time.Second):
+				t.Fatalf("fetch must be canceled after all handles are closed")
+			}
+			if f4 := open(); f4.fetchCtx.Err() != nil {
+				t.Errorf("file opened after cancellation must be fetched with a new context")
+			}
+		})
+	}
+}
+
+// openCountReader counts the files opened through the metadata reader.
+type openCountReader struct {
+	metadata.Reader
+	opened atomic.Int64
+}
+
+func (r *openCountReader) OpenFileWithPreReader(id uint32, preRead func(id uint32, chunkOffset, chunkSize int64, chunkDigest string, r io.Reader) error) (metadata.File, error) {
+	r.opened.Add(1)
+	return r.Reader.OpenFileWithPreReader(id, preRead)
+}
+
+func testOpenFileCache(t *TestRunner, factory metadata.Store) {
+	contents := map[string]string{"a": "aaaa", "b": "bbbb", "c": "cccc"}
+	for srcCompressionName, srcCompression := range srcCompressions {
+		srcCompression := srcCompression()
+		t.Run("open_file_cache_"+srcCompressionName, func(t *TestRunner) {
+			stargzFile, tocDigest, err := tutil.BuildEStargz([]tutil.TarEntry{
+				tutil.File("a", contents["a"]),
+				tutil.File("b", contents["b"]),
+				tutil.File("c", contents["c"]),
+			}, tutil.WithEStargzOptions(estargz.WithCompression(srcCompression)))
+			if err != nil {
+				t.Fatalf("failed to build sample estargz: %v", err)
+			}
+			mr, err := factory(stargzFile, metadata.WithDecompressors(srcCompression))
+			if err != nil {
+				t.Fatalf("failed to prepare metadata reader: %v", err)
+			}
+			cr := &openCountReader{Reader: mr}
+			vr, err := NewReader(cr, cache.NewMemoryCache(), digest.FromString(""), WithOpenFileCache(2))
+			if err != nil {
+				t.Fatalf("failed to make new reader: %v", err)
+			}
+			defer vr.Close()
+			r, err := vr.VerifyTOC(tocDigest)
+			if err != nil {
+				t.Fatalf("failed to verify TOC: %v", err)
+			}
+			gr := r.(*reader)
+			open := func(name string, wantOpened int64) *file {
+				id, err := lookup(gr, name)
+				if err != nil {
+					t.Fatalf("failed to lookup %q: %v", name, err)
+				}
+				ra, err := gr.OpenFile(id)
+				if err != nil {
+					t.Fatalf("failed to open %q: %v", name, err)
+				}
+				p := make([]byte, len(contents[name]))
+				if n, err := ra.ReadAt(p, 0); n != len(p) || string(p) != contents[name] {
+					t.Fatalf("unexpected contents of %q: %q, %v", name, p[:n], err)
+				}
+				if got := cr.opened.Load(); got != wantOpened {
+					t.Errorf("after opening %q, files opened in metadata = %d; want %d", name, got, wantOpened)
+				}
+				return ra.(*file)
+			}
+
+			// Handles of the cached file have their own states.
+			fa1, fa2 := open("a", 1), open("a", 1)
+			if fa1 == fa2 || fa1.fr != fa2.fr {
+				t.Errorf("handles must share the metadata of the file but not the states")
+			}
+			open("b", 2)
+			open("a", 2)
+			open("c", 3) // evicts "b"
+			open("a", 3)
+			open("b", 4)
+		})
+	}
+}
+
+func testFetchConcurrency(t *TestRunner, factory metadata.Store) {
+	const (
+		chunkSize = 16
+		unitSize  = 256
+		modelName = "model.safetensors"
+	)
+	data := strings.Repeat("m", unitSize)
+	for _, tt := range []struct {
+		name         string
+		opts         []Option
+		wantWorkers  int
+		wantInflight int64
+	}{
+		{
+			name:        "layer_workers",
+			opts:        []Option{WithFetchConcurrency(2, 0)},
+			wantWorkers: 2,
+		},
+		{
+			name:         "layer_bytes",
+			opts:         []Option{WithFetchConcurrency(0, 3*chunkSize)},
+			wantInflight: 3 * chunkSize,
+		},
+		{
+			name:        "global_workers",
+			opts:        []Option{WithFetchLimiter(NewFetchLimiter(1, 0))},
+			wantWorkers: 1,
+		},
+		{
+			// Chunks larger than the limit are fetched one at a time.
+			name:         "global_bytes_smaller_than_chunk",
+			opts:         []Option{WithFetchConcurrency(4, 0), WithFetchLimiter(NewFetchLimiter(0, chunkSize/2))},
+			wantWorkers:  1,
+			wantInflight: chunkSize,
+		},
+	} {
+		t.Run("fetch_concurrency_"+tt.name, func(t *TestRunner) {
+			stargzFile, tocDigest, err := tutil.BuildEStargz([]tutil.TarEntry{
+				tutil.File(modelName, data),
+			}, tutil.WithEStargzOptions(estargz.WithChunkSize(chunkSize)))
+			if err != nil {
+				t.Fatalf("failed to build sample estargz: %v", err)
+			}
+			mr, err := factory(stargzFile)
+			if err != nil {
+				t.Fatalf("failed to prepare metadata reader: %v", err)
+			}
+			src := &countingChunkSource{data: []byte(data)}
+			match := func(name string) bool { return name == modelName }
+			vr, err := NewReader(mr, cache.NewMemoryCache(), digest.FromString(""), append([]Option{
+				WithModelFiles(match, unitSize),
+				WithSources(Source{Name: "counting", ChunkSource: src}),
+			}, tt.opts...)...)
+			if err != nil {
+				t.Fatalf("failed to make new reader: %v", err)
+			}
+			defer vr.Close()
+			r, err := vr.VerifyTOC(tocDigest)
+			if err != nil {
+				t.Fatalf("failed to verify TOC: %v", err)
+			}
+			gr := r.(*reader)
+			id, err := lookup(gr, modelName)
+			if err != nil {
+				t.Fatalf("failed to lookup model: %v", err)
+			}
+			ra, err := gr.OpenFile(id)
+			if err != nil {
+				t.Fatalf("failed to open model: %v", err)
+			}
+			p := make([]byte, unitSize)
+			if n, err := ra.ReadAt(p, 0); err != nil || n != unitSize || string(p) != data {
+				t.Fatalf("failed to read model: %v (n=%d)", err, n)
+			}
+			if src.called != unitSize/chunkSize {
+				t.Errorf("fetched %d chunks; want %d", src.called, unitSize/chunkSize)
+			}
+			if tt.wantWorkers > 0 && src.maxWorkers > tt.wantWorkers {
+				t.Errorf("max parallel fetches = %d; want <= %d", src.maxWorkers, tt.wantWorkers)
+			}
+			if tt.wantInflight > 0 && src.maxInflight > tt.wantInflight {
+				t.Errorf("max in-flight bytes = %d; want <= %d", src.maxInflight, tt.wantInflight)
+			}
+		})
+	}
+}
+
+func testReadahead(t *TestRunner, factory metadata.Store) {
+	const (
+		chunkSize = 16
+		fileSize  = 64 * chunkSize
+		maxWindow = 8 * chunkSize
+	)
+	data := strings.Repeat("0123456789abcdef", fileSize/16)
+	for srcCompressionName, srcCompression := range srcCompressions {
+		srcCompression := srcCompression()
+		t.Run("readahead_"+srcCompressionName, func(t *TestRunner) {
+			stargzFile, tocDigest, err := tutil.BuildEStargz([]tutil.TarEntry{
+				tutil.File("file", data),
+			}, tutil.WithEStargzOptions(estargz.WithChunkSize(chunkSize), estargz.WithCompression(srcCompression)))
+			if err != nil {
+				t.Fatalf("failed to build sample estargz: %v", err)
+			}
+			mr, err := factory(stargzFile, metadata.WithDecompressors(srcCompression))
+			if err != nil {
+				t.Fatalf("failed to prepare metadata reader: %v", err)
+			}
+			vr, err := NewReader(mr, cache.NewMemoryCache(), digest.FromString(""), WithReadahead(maxWindow))
+			if err != nil {
+				t.Fatalf("failed to make new reader: %v", err)
+			}
+			defer vr.Close()
+			r, err := vr.VerifyTOC(tocDigest)
+			if err != nil {
+				t.Fatalf("failed to verify TOC: %v", err)
+			}
+			gr := r.(*reader)
+			id, err := lookup(gr, "file")
+			if err != nil {
+				t.Fatalf("failed to lookup file: %v", err)
+			}
+			ra, err := gr.OpenFile(id)
+			if err != nil {
+				t.Fatalf("failed to open file: %v", err)
+			}
+			f := ra.(*file)
+			// cachedUntil waits for the readahead and returns the end of the chunks cached
+			// continuously from offset.
+			cachedUntil := func(offset int64) int64 {
+				for {
+					f.ra.mu.Lock()
+					running := f.ra.running
+					f.ra.mu.Unlock()
+					if !running {
+						break
+					}
+					time.Sleep(time.Millisecond)
+				}
+				for ; offset < fileSize; offset += chunkSize {
+					cr, err := gr.cache.Get(genID(id, offset, chunkSize))
+					if err != nil {
+						break
+					}
+					cr.Close()
+				}
+				return offset
+			}
+			read := func(offset int64) {
+				p := make([]byte, chunkSize)
+				if n, err := f.ReadAt(p, offset); err != nil || n != chunkSize || string(p) != data[offset:offset+chunkSize] {
+					t.Fatalf("failed to read at %d: %v (n=%d)", offset, err, n)
+				}
+			}
+
+			// The window grows on sequential reads.
+			for _, tt := range []struct {
+				offset int64
+				want   int64 // end of the chunks cached
+			}{
+				{0, 3 * chunkSize},  // window = 2 chunks
+				{16, 6 * chunkSize}, // window = 4 chunks
+				{32, 11 * chunkSize},
+				{48, 12 * chunkSize}, // window is capped at 8 chunks
+			} {
+				read(tt.offset)
+				if got := cachedUntil(0); got != tt.want {
+					t.Errorf("after reading at %d, cached until %d; want %d", tt.offset, got, tt.want)
+				}
+			}
+
+			// Random access resets the window.
+			read(40 * chunkSize)
+			if got := cachedUntil(40 * chunkSize); got != 41*chunkSize {
+				t.Errorf("random read must not be read ahead but cached until %d", got)
+			}
+			read(41 * chunkSize)
+			if got := cachedUntil(40 * chunkSize); got != 44*chunkSize {
+				t.Errorf("window must restart from twice the read but cached until %d", got)
+			}
+		})
+	}
+}
+
+func testSubChunkFetch(t *TestRunner, factory metadata.Store) {
+	const chunkSize = 4 << 20
+	randomData, err := tutil.RandomBytes(chunkSize * 2)
+	if err != nil {
+		t.Fatalf("failed rand.Read: %v", err)
+	}
+	data := string(randomData)
+	for srcCompressionName, srcCompression := range srcCompressions {
+		srcCompression := srcCompression()
+		t.Run("sub_chunk_fetch_"+srcCompressionName, func(t *TestRunner) {
+			stargzFile, tocDigest, err := tutil.BuildEStargz([]tutil.TarEntry{
+				tutil.File("file", data),
+			}, tutil.WithEStargzOptions(estargz.WithChunkSize(chunkSize), estargz.WithCompression(srcCompression)))
+			if err != nil {
+				t.Fatalf("failed to build sample estargz: %v", err)
+			}
+			open := func(verify bool, opts ...Option) (*reader, *calledReaderAt, uint32, *testChunkVerifier) {
+				cra := &calledReaderAt{ReaderAt: stargzFile}
+				mr, err := factory(io.NewSectionReader(cra, 0, stargzFile.Size()), metadata.WithDecompressors(srcCompression))
+				if err != nil {
+					t.Fatalf("failed to prepare metadata reader: %v", err)
+				}
+				vr, err := NewReader(mr, cache.NewMemoryCache(), digest.FromString(""), append(opts, WithSubChunkFetch(chunkSize))...)
+				if err != nil {
+					t.Fatalf("failed to make new reader: %v", err)
+				}
+				t.Cleanup(func() { vr.Close() })
+				bev := &testChunkVerifier{true}
+				vr.verifier = bev.verifier
+				vr.r.verifier = bev.verifier
+				r := vr.SkipVerify()
+				if verify {
+					if r, err = vr.VerifyTOC(tocDigest); err != nil {
+						t.Fatalf("failed to verify TOC: %v", err)
+					}
+				}
+				gr := r.(*reader)
+				id, err := lookup(gr, "file")
+				if err != nil {
+					t.Fatalf("failed to lookup file: %v", err)
+				}
+				cra.read = 0
+				return gr, cra, id, bev
+			}
+			read := func(gr *reader, id uint32, offset int64, size int) error {
+				ra, err := gr.OpenFile(id)
+				if err != nil {
+					t.Fatalf("failed to open file: %v", err)
+				}
+				p := make([]byte, size)
+				n, err := ra.ReadAt(p, offset)
+				if err != nil {
+					return err
+				}
+				if n != size || string(p) != data[offset:offset+int64(size)] {
+					t.Fatalf("unexpected data at %d (n=%d)", offset, n)
+				}
+				return nil
+			}
+			cached := func(gr *reader, id uint32, chunkOffset int64) bool {
+				cr, err := gr.cache.Get(genID(id, chunkOffset, chunkSize))
+				if err != nil {
+					return false
+				}
+				cr.Close()
+				return true
+			}
+			wait := func(gr *reader) {
+				gr.asyncVerifier.mu.Lock()
+				var pending []chan struct{}
+				for _, done := range gr.asyncVerifier.pending {
+					pending = append(pending, done)
+				}
+				gr.asyncVerifier.mu.Unlock()
+				for _, done := range pending {
+					<-done
+				}
+			}
+
+			// Without verification, only the head of the chunk is fetched.
+			gr, cra, id, _ := open(false)
+			if err := read(gr, id, chunkSize+100, 4096); err != nil {
+				t.Fatalf("failed to read: %v", err)
+			}
+			if cra.read >= chunkSize*3/4 {
+				t.Errorf("fetched %d bytes for reading the head of a chunk of %d bytes", cra.read, chunkSize)
+			}
+			if cached(gr, id, chunkSize) {
+				t.Errorf("head of the chunk must not be cached")
+			}
+
+			// Chunks that must be verified are fetched as a whole.
+			gr, _, id, _ = open(true)
+			if err := read(gr, id, 100, 4096); err != nil {
+				t.Fatalf("failed to read: %v", err)
+			}
+			if !cached(gr, id, 0) {
+				t.Errorf("verified chunk must be cached")
+			}
+
+			// With asynchronous verification, the whole chunk is verified and cached in
+			// background.
+			gr, _, id, bev := open(true, WithAsyncVerify(1))
+			if err := read(gr, id, 100, 4096); err != nil {
+				t.Fatalf("failed to read: %v", err)
+			}
+			wait(gr)
+			if !cached(gr, id, 0) {
+				t.Errorf("chunk must be cached once verified")
+			}
+			bev.success = false
+			if err := read(gr, id, chunkSize+100, 4096); err != nil {
+				t.Fatalf("failed to read: %v", err)
+			}
+			wait(gr)
+			if cached(gr, id, chunkSize) {
+				t.Errorf("chunk failed the verification must not be cached")
+			}
+			if err := read(gr, id, chunkSize+100, 4096); !errors.Is(err, ErrInvalidChunk) {
+				t.Errorf("read after the verification failure must fail: %v", err)
+			}
+		})
+	}
+}
+
+func testAccessTrace(t *TestRunner, factory metadata.Store) {
+	const chunkSize = 16
+	data := strings.Repeat("0123456789abcdef", 4)
+	for srcCompressionName, srcCompression := range srcCompressions {
+		srcCompression := srcCompression()
+		t.Run("access_trace_"+srcCompressionName, func(t *TestRunner) {
+			stargzFile, tocDigest, err := tutil.BuildEStargz([]tutil.TarEntry{
+				tutil.Dir("dir/"),
+				tutil.File("dir/a", data),
+				tutil.File("b", data),
+			}, tutil.WithEStargzOptions(estargz.WithChunkSize(chunkSize), estargz.WithCompression(srcCompression)))
+			if err != nil {
+				t.Fatalf("failed to build sample estargz: %v", err)
+			}
+			mr, err := factory(stargzFile, metadata.WithDecompressors(srcCompression))
+			if err != nil {
+				t.Fatalf("failed to prepare metadata reader: %v", err)
+			}
+			layerSha := digest.FromString("layer")
+			trace := NewAccessTrace(3)
+			vr, err := NewReader(mr, cache.NewMemoryCache(), layerSha, WithAccessTrace(trace))
+			if err != nil {
+				t.Fatalf("failed to make new reader: %v", err)
+			}
+			defer vr.Close()
+			r, err := vr.VerifyTOC(tocDigest)
+			if err != nil {
+				t.Fatalf("failed to verify TOC: %v", err)
+			}
+			gr := r.(*reader)
+			read := func(name string, offset int64, size int) {
+				id, err := lookup(gr, name)
+				if err != nil {
+					t.Fatalf("failed to lookup %q: %v", name, err)
+				}
+				ra, err := gr.OpenFile(id)
+				if err != nil {
+					t.Fatalf("failed to open %q: %v", name, err)
+				}
+				p := make([]byte, size)
+				if n, err := ra.ReadAt(p, offset); err != nil || n != size {
+					t.Fatalf("failed to read %q: %v (n=%d)", name, err, n)
+				}
+			}
+			check := func(wantDropped uint64, want ...Access) {
+				got, dropped := trace.Snapshot()
+				if dropped != wantDropped {
+					t.Errorf("dropped = %d; want %d", dropped, wantDropped)
+				}
+				if len(got) != len(want) {
+					t.Fatalf("got %d records; want %d: %+v", len(got), len(want), got)
+				}
+				for i, a := range got {
+					if a.Time.IsZero() || a.Layer != layerSha || a.Digest == "" {
+						t.Errorf("record %d lacks fields: %+v", i, a)
+					}
+					if a.Path != want[i].Path || a.Offset != want[i].Offset || a.Size != want[i].Size || a.Cached != want[i].Cached {
+						t.Errorf("record %d = %+v; want %+v", i, a, want[i])
+					}
+				}
+			}
+
+			// A read across two chunks is recorded per chunk.
+			read("dir/a", 8, chunkSize)
+			check(0,
+				Access{Path: "/dir/a", Offset: 0, Size: chunkSize},
+				Access{Path: "/dir/a", Offset: chunkSize, Size: chunkSize},
+			)
+
+			// Reads of the clone are recorded to the same trace and the oldest record is
+			// overwritten.
+			cvr, err := vr.Clone(stargzFile)
+			if err != nil {
+				t.Fatalf("failed to clone reader: %v", err)
+			}
+			defer cvr.Close()
+			gr = cvr.SkipVerify().(*reader)
+			read("dir/a", 0, 4)
+			read("b", chunkSize*3, chunkSize)
+			check(1,
+				Access{Path: "/dir/a", Offset: chunkSize, Size: chunkSize},
+				Access{Path: "/dir/a", Offset: 0, Size: chunkSize, Cached: true},
+				Access{Path: "/b", Offset: chunkSize * 3, Size: chunkSize},
+			)
+			if total := trace.Total(); total != 4 {
+				t.Errorf("total = %d; want 4", total)
+			}
+
+			trace.Reset()
+			check(0)
+		})
+	}
+}
+
+// recordingHooks records the events of reads.
+type recordingHooks struct {
+	mu     sync.Mutex
+	starts []ReadEvent
+	dones  []ReadStats
+}
+
+func (h *recordingHooks) OnReadStart(ev ReadEvent) {
+	h.mu.Lock()
+	h.starts = append(h.starts, ev)
+	h.mu.Unlock()
+}
+
+func (h *recordingHooks) OnReadDone(ev ReadEvent, stats ReadStats) {
+	h.mu.Lock()
+	h.dones = append(h.dones, stats)
+	h.mu.Unlock()
+}
+
+func testReadHooks(t *TestRunner, factory metadata.Store) {
+	const chunkSize = 16
+	data := strings.Repeat("0123456789abcdef", 4)
+	for srcCompressionName, srcCompression := range srcCompressions {
+		srcCompression := srcCompression()
+		t.Run("read_hooks_"+srcCompressionName, func(t *TestRunner) {
+			stargzFile, tocDigest, err := tutil.BuildEStargz([]tutil.TarEntry{
+				tutil.Dir("dir/"),
+				tutil.File("dir/a", data),
+			}, tutil.WithEStargzOptions(estargz.WithChunkSize(chunkSize), estargz.WithCompression(srcCompression)))
+			if err != nil {
+				t.Fatalf("failed to build sample estargz: %v", err)
+			}
+			mr, err := factory(stargzFile, metadata.WithDecompressors(srcCompression))
+			if err != nil {
+				t.Fatalf("failed to prepare metadata reader: %v", err)
+			}
+			layerSha := digest.FromString("layer")
+			hooks := &recordingHooks{}
+			vr, err := NewReader(mr, cache.NewMemoryCache(), layerSha, WithReadHooks(hooks))
+			if err != nil {
+				t.Fatalf("failed to make new reader: %v", err)
+			}
+			defer vr.Close()
+			r, err := vr.VerifyTOC(tocDigest)
+			if err != nil {
+				t.Fatalf("failed to verify TOC: %v", err)
+			}
+			gr := r.(*reader)
+			id, err := lookup(gr, "dir/a")
+			if err != nil {
+				t.Fatalf("failed to lookup: %v", err)
+			}
+			ra, err := gr.OpenFile(id)
+			if err != nil {
+				t.Fatalf("failed to open: %v", err)
+			}
+			p := make([]byte, chunkSize)
+			for i, want := range []ReadSource{ReadSourceRemote, ReadSourceCache} {
+				if n, err := ra.ReadAt(p, 8); err != nil || n != chunkSize {
+					t.Fatalf("failed to read: %v (n=%d)", err, n)
+				}
+				hooks.mu.Lock()
+				if len(hooks.starts) != i+1 || len(hooks.dones) != i+1 {
+					t.Fatalf("hooks called %d/%d times; want %d", len(hooks.starts), len(hooks.dones), i+1)
+				}
+				ev, stats := hooks.starts[i], hooks.dones[i]
+				hooks.mu.Unlock()
+				if ev.Layer != layerSha || ev.Path != "/dir/a" || ev.Offset != 8 || ev.Size != chunkSize {
+					t.Errorf("read %d: unexpected event %+v", i, ev)
+				}
+				if stats.Bytes != chunkSize || stats.Source != want || stats.Err != nil || stats.Latency <= 0 {
+					t.Errorf("read %d: stats = %+v; want %d bytes from %q", i, stats, chunkSize, want)
+				}
+			}
+		})
+	}
+}
+
+func testReadAtMulti(t *TestRunner, factory metadata.Store) {
+	const (
+		chunkSize = 16
+		fileSize  = 8 * chunkSize
+	)
+	data := strings.Repeat("0123456789abcdef", fileSize/16)
+	for _, tt := range []struct {
+		name      string
+		ranges    [][2]int64 // offset and size of the ranges
+		cached    []int64    // offsets of the chunks cached in advance
+		wantReads int        // number of the reads of the blob
+	}{
+		{
+			name:      "adjacent",
+			ranges:    [][2]int64{{0, 32}, {32, 32}, {64, 32}, {96, 32}},
+			wantReads: 1,
+		},
+		{
+			name:      "unaligned_and_overlapping",
+			ranges:    [][2]int64{{8, 20}, {20, 30}, {50, 40}},
+			wantReads: 1,
+		},
+		{
+			name:      "with_gap",
+			ranges:    [][2]int64{{0, 32}, {80, 32}},
+			wantReads: 2,
+		},
+		{
+			name:      "split_by_cached_chunk",
+			ranges:    [][2]int64{{0, 64}},
+			cached:    []int64{32},
+			wantReads: 2,
+		},
+		{
+			name:      "all_cached",
+			ranges:    [][2]int64{{0, 16}, {16, 16}},
+			cached:    []int64{0, 16},
+			wantReads: 0,
+		},
+	} {
+		for srcCompressionName, srcCompression := range srcCompressions {
+			srcCompression := srcCompression()
+			t.Run("read_at_multi_"+tt.name+"_"+srcCompressionName, func(t *TestRunner) {
+				stargzFile, tocDigest, err := tutil.BuildEStargz([]tutil.TarEntry{
+					tutil.File("file", data),
+				}, tutil.WithEStargzOptions(estargz.WithChunkSize(chunkSize), estargz.WithCompression(srcCompression)))
+				if err != nil {
+					t.Fatalf("failed to build sample estargz: %v", err)
+				}
+				cra := &calledReaderAt{ReaderAt: stargzFile}
+				mr, err := factory(io.NewSectionReader(cra, 0, stargzFile.Size()), metadata.WithDecompressors(srcCompression))
+				if err != nil {
+					t.Fatalf("failed to prepare metadata reader: %v", err)
+				}
+				vr, err := NewReader(mr, cache.NewMemoryCache(), digest.FromString(""))
+				if err != nil {
+					t.Fatalf("failed to make new reader: %v", err)
+				}
+				defer vr.Close()
+				r, err := vr.VerifyTOC(tocDigest)
+				if err != nil {
+					t.Fatalf("failed to verify TOC: %v", err)
+				}
+				gr := r.(*reader)
+				id, err := lookup(gr, "file")
+				if err != nil {
+					t.Fatalf("failed to lookup file: %v", err)
+				}
+				ra, err := gr.OpenFile(id)
+				if err != nil {
+					t.Fatalf("failed to open file: %v", err)
+				}
+				for _, off := range tt.cached {
+					if n, err := ra.ReadAt(make([]byte, chunkSize), off); err != nil || n != chunkSize {
+						t.Fatalf("failed to cache chunk at %d: %v (n=%d)", off, err, n)
+					}
+				}
+				cra.called = nil
+				ranges := make([]Range, len(tt.ranges))
+				for i, rg := range tt.ranges {
+					ranges[i] = Range{Offset: rg[0], P: make([]byte, rg[1])}
+				}
+				if err := ra.(MultiReaderAt).ReadAtMulti(context.Background(), ranges); err != nil {
+					t.Fatalf("failed to read ranges: %v", err)
+				}
+				for i, rg := range ranges {
+					if rg.N != len(rg.P) || string(rg.P) != data[rg.Offset:rg.Offset+int64(len(rg.P))] {
+						t.Errorf("range %d: read %d bytes %q; want %q", i, rg.N, string(rg.P[:rg.N]), data[rg.Offset:rg.Offset+int64(len(rg.P))])
+					}
+				}
+				if len(cra.called) != tt.wantReads {
+					t.Errorf("blob is read %d times at %v; want %d", len(cra.called), cra.called, tt.wantReads)
+				}
+				for _, rg := range tt.ranges {
+					for off := rg[0] / chunkSize * chunkSize; off < rg[0]+rg[1]; off += chunkSize {
+						cr, err := gr.cache.Get(genID(id, off, chunkSize))
+						if err != nil {
+							t.Errorf("chunk at %d isn't cached: %v", off, err)
+							continue
+						}
+						cr.Close()
+					}
+				}
+			})
+		}
+	}
+}
+
+func testScrub(t *TestRunner, factory metadata.Store) {
+	const (
+		chunkSize = 16
+		fileSize  = 4 * chunkSize
+	)
+	data := strings.Repeat("0123456789abcdef", fileSize/16)
+	for srcCompressionName, srcCompression := range srcCompressions {
+		srcCompression := srcCompression()
+		t.Run("scrub_"+srcCompressionName, func(t *TestRunner) {
+			stargzFile, tocDigest, err := tutil.BuildEStargz([]tutil.TarEntry{
+				tutil.File("file", data),
+			}, tutil.WithEStargzOptions(estargz.WithChunkSize(chunkSize), estargz.WithCompression(srcCompression)))
+			if err != nil {
+				t.Fatalf("failed to build sample estargz: %v", err)
+			}
+			mr, err := factory(stargzFile, metadata.WithDecompressors(srcCompression))
+			if err != nil {
+				t.Fatalf("failed to prepare metadata reader: %v", err)
+			}
+			mc := cache.NewMemoryCache().(*cache.MemoryCache)
+			vr, err := NewReader(mr, mc, digest.FromString(""))
+			if err != nil {
+				t.Fatalf("failed to make new reader: %v", err)
+			}
+			defer vr.Close()
+			r, err := vr.VerifyTOC(tocDigest)
+			if err != nil {
+				t.Fatalf("failed to verify TOC: %v", err)
+			}
+			gr := r.(*reader)
+			id, err := lookup(gr, "file")
+			if err != nil {
+				t.Fatalf("failed to lookup file: %v", err)
+			}
+			ra, err := gr.OpenFile(id)
+			if err != nil {
+				t.Fatalf("failed to open file: %v", err)
+			}
+			// Only the first 3 chunks are cached.
+			if n, err := ra.ReadAt(make([]byte, 3*chunkSize), 0); err != nil || n != 3*chunkSize {
+				t.Fatalf("failed to read file: %v (n=%d)", err, n)
+			}
+			corruptedID := genID(id, chunkSize, chunkSize)
+			mc.Membuf[corruptedID].Bytes()[0] ^= 0xff
+
+			res, err := vr.Scrub(100)
+			if err != nil {
+				t.Fatalf("failed to scrub: %v", err)
+			}
+			if res != (ScrubResult{Checked: 3, Corrupted: 1}) {
+				t.Errorf("result = %+v; want 3 checked and 1 corrupted", res)
+			}
+			if _, err := mc.Get(corruptedID); err == nil {
+				t.Errorf("corrupted chunk must be removed")
+			}
+			p := make([]byte, fileSize)
+			if n, err := ra.ReadAt(p, 0); (err != nil && err != io.EOF) || n != fileSize || string(p) != data {
+				t.Errorf("failed to read file after scrub: %q (n=%d, err=%v)", string(p[:n]), n, err)
+			}
+			// Samples may include chunks not cached (e.g. of the landmark file).
+			if res, err := vr.Scrub(2); err != nil || res.Checked > 2 || res.Corrupted != 0 {
+				t.Errorf("scrubbing 2 samples = %+v, %v; want up to 2 checked", res, err)
+			}
+		})
+	}
+
+	// The cache must support removing chunks.
+	stargzFile, tocDigest, err := tutil.BuildEStargz([]tutil.TarEntry{tutil.File("file", data)})
+	if err != nil {
+		t.Fatalf("failed to build sample estargz: %v", err)
+	}
+	mr, err := factory(stargzFile)
+	if err != nil {
+		t.Fatalf("failed to prepare metadata reader: %v", err)
+	}
+	vr, err := NewReader(mr, struct{ cache.BlobCache }{cache.NewMemoryCache()}, digest.FromString(""))
+	if err != nil {
+		t.Fatalf("failed to make new reader: %v", err)
+	}
+	defer vr.Close()
+	if _, err := vr.VerifyTOC(tocDigest); err != nil {
+		t.Fatalf("failed to verify TOC: %v", err)
+	}
+	if _, err := vr.Scrub(1); !errors.Is(err, ErrScrubUnsupported) {
+		t.Errorf("scrub = %v; want %v", err, ErrScrubUnsupported)
+	}
+}
+
+// testCompressedCache checks that files are read through the cache storing the chunks
+// compressed and that the chunks are stored compressed.
+func testCompressedCache(t *TestRunner, factory metadata.Store) {
+	const chunkSize = 64
+	data := strings.Repeat("0123456789abcdef", 4*chunkSize/16)
+	for srcCompressionName, srcCompression := range srcCompressions {
+		srcCompression := srcCompression()
+		t.Run("compressed_cache_"+srcCompressionName, func(t *TestRunner) {
+			stargzFile, tocDigest, err := tutil.BuildEStargz([]tutil.TarEntry{
+				tutil.File("file", data),
+			}, tutil.WithEStargzOptions(estargz.WithChunkSize(chunkSize), estargz.WithCompression(srcCompression)))
+			if err != nil {
+				t.Fatalf("failed to build sample estargz: %v", err)
+			}
+			mr, err := factory(stargzFile, metadata.WithDecompressors(srcCompression))
+			if err != nil {
+				t.Fatalf("failed to prepare metadata reader: %v", err)
+			}
+			mc := cache.NewMemoryCache().(*cache.MemoryCache)
+			vr, err := NewReader(mr, cache.NewCompressedCache(mc), digest.FromString(""))
+			if err != nil {
+				t.Fatalf("failed to make new reader: %v", err)
+			}
+			defer vr.Close()
+			if !vr.CacheCompressed() {
+				t.Errorf("cache must be reported as compressed")
+			}
+			r, err := vr.VerifyTOC(tocDigest)
+			if err != nil {
+				t.Fatalf("failed to verify TOC: %v", err)
+			}
+			gr := r.(*reader)
+			id, err := lookup(gr, "file")
+			if err != nil {
+				t.Fatalf("failed to lookup file: %v", err)
+			}
+			ra, err := gr.OpenFile(id)
+			if err != nil {
+				t.Fatalf("failed to open file: %v", err)
+			}
+			// The second read is served from the cache.
+			for i := 0; i < 2; i++ {
+				p := make([]byte, len(data))
+				if n, err := ra.ReadAt(p, 0); (err != nil && err != io.EOF) || n != len(data) || string(p) != data {
+					t.Fatalf("failed to read file (%d): %q (n=%d, err=%v)", i, string(p[:n]), n, err)
+				}
+			}
+			if !ra.(*file).Cached() {
+				t.Errorf("file must be cached")
+			}
+			stored, ok := mc.Membuf[genID(id, 0, chunkSize)]
+			if !ok {
+				t.Fatalf("first chunk isn't cached")
+			}
+			if stored.Len() >= chunkSize || strings.Contains(stored.String(), data[:chunkSize]) {
+				t.Errorf("chunk must be stored compressed: %q", stored.String())
+			}
+		})
+	}
+}
+
+func testAsyncVerify(t *TestRunner, factory metadata.Store) {
+	const chunkSize = 16
+	data := strings.Repeat("0123456789abcdef", 4)
+	for srcCompressionName, srcCompression := range srcCompressions {
+		srcCompression := srcCompression()
+		t.Run("async_verify_"+srcCompressionName, func(t *TestRunner) {
+			stargzFile, tocDigest, err := tutil.BuildEStargz([]tutil.TarEntry{
+				tutil.File("file", data),
+			}, tutil.WithEStargzOptions(estargz.WithChunkSize(chunkSize), estargz.WithCompression(srcCompression)))
+			if err != nil {
+				t.Fatalf("failed to build sample estargz: %v", err)
+			}
+			mr, err := factory(stargzFile, metadata.WithDecompressors(srcCompression))
+			if err != nil {
+				t.Fatalf("failed to prepare metadata reader: %v", err)
+			}
+			vr, err := NewReader(mr, cache.NewMemoryCache(), digest.FromString(""), WithAsyncVerify(1))
+			if err != nil {
+				t.Fatalf("failed to make new reader: %v", err)
+			}
+			defer vr.Close()
+			bev := &testChunkVerifier{false}
+			vr.verifier = bev.verifier
+			vr.r.verifier = bev.verifier
+			r, err := vr.VerifyTOC(tocDigest)
+			if err != nil {
+				t.Fatalf("failed to verify TOC: %v", err)
+			}
+			gr := r.(*reader)
+			id, err := lookup(gr, "file")
+			if err != nil {
+				t.Fatalf("failed to lookup file: %v", err)
+			}
+			ra, err := gr.OpenFile(id)
+			if err != nil {
+				t.Fatalf("failed to open file: %v", err)
+			}
+			wait := func() {
+				gr.asyncVerifier.mu.Lock()
+				var pending []chan struct{}
+				for _, done := range gr.asyncVerifier.pending {
+					pending = append(pending, done)
+				}
+				gr.asyncVerifier.mu.Unlock()
+				for _, done := range pending {
+					<-done
+				}
+			}
+			cached := func() bool {
+				cr, err := gr.cache.Get(genID(id, 0, chunkSize))
+				if err != nil {
+					return false
+				}
+				cr.Close()
+				return true
+			}
+			p := make([]byte, chunkSize)
+
+			// The chunk failing the verification is returned but not cached, and the next
+			// read fails.
+			if n, err := ra.ReadAt(p, 0); err != nil || n != chunkSize || string(p) != data[:chunkSize] {
+				t.Fatalf("failed to read: %v (n=%d)", err, n)
+			}
+			wait()
+			if cached() {
+				t.Errorf("chunk failed the verification must not be cached")
+			}
+			if _, err := ra.ReadAt(p, 0); !errors.Is(err, errdefs.ErrCorrupted) {
+				t.Errorf("read after the verification failure must fail as corrupted: %v", err)
+			}
+
+			// The chunk is fetched again and cached once verified.
+			bev.success = true
+			if n, err := ra.ReadAt(p, 0); err != nil || n != chunkSize || string(p) != data[:chunkSize] {
+				t.Fatalf("failed to read: %v (n=%d)", err, n)
+			}
+			wait()
+			if !cached() {
+				t.Errorf("verified chunk must be cached")
+			}
+		})
+	}
+}
+
+// countingChunkSource records the max number and the max total size of chunks fetched
+// in parallel.
+type countingChunkSource struct {
+	data []byte
+
+	mu          sync.Mutex
+	called      int
+	workers     int
+	inflight    int64
+	maxWorkers  int
+	maxInflight int64
+}
+
+func (s *countingChunkSource) FetchChunk(ctx context.Context, chunk Chunk, p []byte) error {
+	s.mu.Lock()
+	s.called++
+	s.workers++
+	s.inflight += chunk.Size
+	s.maxWorkers = max(s.maxWorkers, s.workers)
+	s.maxInflight = max(s.maxInflight, s.inflight)
+	s.mu.Unlock()
+
+	time.Sleep(10 * time.Millisecond) // let other fetches run in parallel
+	copy(p, s.data[chunk.Offset:])
+
+	s.mu.Lock()
+	s.workers--
+	s.inflight -= chunk.Size
+	s.mu.Unlock()
+	return nil
+}
+
+// blockingChunkSource blocks fetching chunks until the context is canceled.
+type blockingChunkSource struct {
+	started  chan struct{}
+	canceled chan struct{}
+}
+
+func (s *blockingChunkSource) FetchChunk(ctx context.Context, chunk Chunk, p []byte) error {
+	s.started <- struct{}{}
+	<-ctx.Done()
+	s.canceled <- struct{}{}
+	return ctx.Err()
+}
+
+func testCachePriority(t *TestRunner, factory metadata.Store) {
+	files := []string{"a.md", "b.so", "c", "d.so", "e.md"}
+	priority := func(name string, attr metadata.Attr) int {
+		switch path.Ext(name) {
+		case ".so":
+			return 1
+		case ".md":
+			return -1
+		}
+		return 0
+	}
+	tests := []struct {
+		name     string
+		priority func(string, metadata.Attr) int
+		want     []string
+	}{
+		{"same-priority", func(string, metadata.Attr) int { return 0 }, files}, // order in the blob
+		{"prioritized", priority, []string{"b.so", "d.so", "c", "a.md", "e.md"}},
+	}
+	for _, tt := range tests {
+		t.Run("cache_priority_"+tt.name, func(t *TestRunner) {
+			var entries []tutil.TarEntry
+			for _, f := range files {
+				entries = append(entries, tutil.File(f, f))
+			}
+			stargzFile, tocDigest, err := tutil.BuildEStargz(entries)
+			if err != nil {
+				t.Fatalf("failed to build sample estargz: %v", err)
+			}
+			mr, err := factory(stargzFile)
+			if err != nil {
+				t.Fatalf("failed to prepare metadata reader: %v", err)
+			}
+			rc := &recordCache{BlobCache: cache.NewMemoryCache()}
+			vr, err := NewReader(mr, rc, digest.FromString(""))
+			if err != nil {
+				t.Fatalf("failed to make new reader: %v", err)
+			}
+			defer vr.Close()
+			if _, err := vr.VerifyTOC(tocDigest); err != nil {
+				t.Fatalf("failed to verify TOC: %v", err)
+			}
+			id2name := make(map[string]string)
+			for _, f := range files {
+				id, err := lookup(vr.r, f)
+				if err != nil {
+					t.Fatalf("failed to lookup %q: %v", f, err)
+				}
+				id2name[genID(id, 0, int64(len(f)))] = f
+			}
+
+			// Cache chunks one by one to record the order.
+			defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(1))
+			if err := vr.Cache(WithPriority(tt.priority)); err != nil {
+				t.Fatalf("failed to cache: %v", err)
+			}
+			var got []string
+			for _, key := range rc.added {
+				if name, ok := id2name[key]; ok {
+					got = append(got, name)
+				}
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("cached order = %v; want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func testCacheThrottle(t *TestRunner, factory metadata.Store) {
+	const fileSize = 1000
+	files := []string{"a", "b", "c", "d"}
+	prepare := func(t *TestRunner) (*VerifiableReader, *recordCache) {
+		var entries []tutil.TarEntry
+		for _, f := range files {
+			entries = append(entries, tutil.File(f, strings.Repeat(f, fileSize)))
+		}
+		stargzFile, tocDigest, err := tutil.BuildEStargz(entries)
+		if err != nil {
+			t.Fatalf("failed to build sample estargz: %v", err)
+		}
+		mr, err := factory(stargzFile)
+		if err != nil {
+			t.Fatalf("failed to prepare metadata reader: %v", err)
+		}
+		rc := &recordCache{BlobCache: cache.NewMemoryCache()}
+		vr, err := NewReader(mr, rc, digest.FromString(""))
+		if err != nil {
+			t.Fatalf("failed to make new reader: %v", err)
+		}
+		if _, err := vr.VerifyTOC(tocDigest); err != nil {
+			t.Fatalf("failed to verify TOC: %v", err)
+		}
+		return vr, rc
+	}
+	added := func(rc *recordCache) int {
+		rc.addedMu.Lock()
+		defer rc.addedMu.Unlock()
+		return len(rc.added)
+	}
+
+	t.Run("cache_throttle_rate", func(t *TestRunner) {
+		vr, rc := prepare(t)
+		defer vr.Close()
+		// The first half is cached within the burst and the rest waits for a second.
+		start := time.Now()
+		if err := vr.Cache(WithCacheRate(fileSize*int64(len(files))/2, 1)); err != nil {
+			t.Fatalf("failed to cache: %v", err)
+		}
+		if elapsed := time.Since(start); elapsed < 900*time.Millisecond {
+			t.Errorf("cache finished in %v; want throttled", elapsed)
+		}
+		if n := added(rc); n < len(files) { // the landmark is cached as well
+			t.Errorf("cached only %d chunks; want %d files", n, len(files))
+		}
+	})
+
+	t.Run("cache_throttle_pause", func(t *TestRunner) {
+		vr, rc := prepare(t)
+		defer vr.Close()
+		const threshold = 10 * time.Millisecond
+		readDone := vr.r.readLatency.start() // a foreground read fetching chunks
+		time.Sleep(2 * threshold)
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- vr.Cache(WithPauseOnSlowReads(threshold))
+		}()
+		time.Sleep(100 * time.Millisecond)
+		if n := added(rc); n != 0 {
+			t.Errorf("cached %d chunks during a slow read", n)
+		}
+		readDone()
+		select {
+		case err := <-errCh:
+			if err != nil {
+				t.Fatalf("failed to cache: %v", err)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("cache isn't resumed after the slow read")
+		}
+		if n := added(rc); n < len(files) { // the landmark is cached as well
+			t.Errorf("cached only %d chunks; want %d files", n, len(files))
+		}
+	})
+}
+
+func testCachePathFilter(t *TestRunner, factory metadata.Store) {
+	files := []string{"usr/bin/sh", "usr/bin/sub/ls", "usr/lib/libc.so", "app/main", "app/data/db", "README"}
+	tests := []struct {
+		name     string
+		globs    []string
+		want     []string
+		wantErr  bool
+		excludes []string
+		skips    []string
+	}{
+		{"all", nil, files, false, nil, nil},
+		{"recursive", []string{"/usr/bin/**"}, []string{"usr/bin/sh", "usr/bin/sub/ls"}, false, nil, nil},
+		{"direct-children", []string{"app/*"}, []string{"app/main"}, false, nil, nil},
+		{"multiple", []string{"/usr/bin/*", "/app/**"}, []string{"usr/bin/sh", "app/main", "app/data/db"}, false, nil, nil},
+		{"middle", []string{"/usr/**/*.so"}, []string{"usr/lib/libc.so"}, false, nil, nil},
+		{"root-file", []string{"README"}, []string{"README"}, false, nil, nil},
+		{"no-match", []string{"/opt/**"}, nil, false, nil, nil},
+		{"invalid", []string{"/usr/[bin"}, nil, true, nil, nil},
+		{name: "exclude", excludes: []string{"/app/data/**"}, want: []string{"usr/bin/sh", "usr/bin/sub/ls", "usr/lib/libc.so", "app/main", "README"}},
+		{name: "exclude-dir", excludes: []string{"usr/bin"}, want: []string{"usr/lib/libc.so", "app/main", "app/data/db", "README"}},
+		{name: "exclude-filtered", globs: []string{"/usr/**"}, excludes: []string{"/usr/bin/sub/**"}, want: []string{"usr/bin/sh", "usr/lib/libc.so"}},
+		{name: "exclude-invalid", excludes: []string{"/usr/[bin"}, wantErr: true},
+		{name: "skip", skips: []string{"usr/bin", "app/main"}, want: []string{"usr/lib/libc.so", "app/data/db", "README"}},
+		{name: "skip-filtered", globs: []string{"/app/**"}, skips: []string{"app/data"}, want: []string{"app/main"}},
+	}
+	for _, tt := range tests {
+		t.Run("cache_path_filter_"+tt.name, func(t *TestRunner) {
+			entries := []tutil.TarEntry{
+				tutil.Dir("usr/"), tutil.Dir("usr/bin/"), tutil.Dir("usr/bin/sub/"), tutil.Dir("usr/lib/"),
+				tutil.Dir("app/"), tutil.Dir("app/data/"),
+			}
+			for _, f := range files {
+				entries = append(entries, tutil.File(f, f))
+			}
+			stargzFile, tocDigest, err := tutil.BuildEStargz(entries)
+			if err != nil {
+				t.Fatalf("failed to build sample estargz: %v", err)
+			}
+			mr, err := factory(stargzFile)
+			if err != nil {
+				t.Fatalf("failed to prepare metadata reader: %v", err)
+			}
+			rc := &recordCache{BlobCache: cache.NewMemoryCache()}
+			vr, err := NewReader(mr, rc, digest.FromString(""))
+			if err != nil {
+				t.Fatalf("failed to make new reader: %v", err)
+			}
+			defer vr.Close()
+			if _, err := vr.VerifyTOC(tocDigest); err != nil {
+				t.Fatalf("failed to verify TOC: %v", err)
+			}
+			id2name := make(map[string]string)
+			for _, f := range files {
+				id, err := lookup(vr.r, f)
+				if err != nil {
+					t.Fatalf("failed to lookup %q: %v", f, err)
+				}
+				id2name[genID(id, 0, int64(len(f)))] = f
+			}
+			opts := []CacheOption{WithPathFilter(tt.globs), WithPathExclusion(tt.excludes)}
+			if tt.skips != nil {
+				opts = append(opts, WithPathSkip(func(p string) bool { return slices.Contains(tt.skips, p) }))
+			}
+			err = vr.Cache(opts...)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("cache must fail with invalid patterns")
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("failed to cache: %v", err)
+			}
+			var got []string
+			for _, key := range rc.added {
+				if name, ok := id2name[key]; ok {
+					got = append(got, name)
+				}
+			}
+			slices.Sort(got)
+			want := slices.Sorted(slices.Values(tt.want))
+			if !slices.Equal(got, want) {
+				t.Errorf("cached files = %v; want %v", got, want)
+			}
+		})
+	}
+}
+
+func testCacheProgress(t *TestRunner, factory metadata.Store) {
+	files := []string{"a", "b", "c", "d", "e"}
+	const content = "0123456789"
+	var entries []tutil.TarEntry
+	for _, f := range files {
+		entries = append(entries, tutil.File(f, content))
+	}
+	stargzFile, tocDigest, err := tutil.BuildEStargz(entries)
+	if err != nil {
+		t.Fatalf("failed to build sample estargz: %v", err)
+	}
+	mc := cache.NewMemoryCache()
+	progress := &memoryCacheProgress{done: make(map[string]struct{})}
+	newReader := func(c cache.BlobCache) *VerifiableReader {
+		mr, err := factory(stargzFile)
+		if err != nil {
+			t.Fatalf("failed to prepare metadata reader: %v", err)
+		}
+		vr, err := NewReader(mr, c, digest.FromString(""), WithCacheProgress(progress))
+		if err != nil {
+			t.Fatalf("failed to make new reader: %v", err)
+		}
+		if _, err := vr.VerifyTOC(tocDigest); err != nil {
+			t.Fatalf("failed to verify TOC: %v", err)
+		}
+		return vr
+	}
+
+	vr := newReader(mc)
+	if err := vr.Cache(); err != nil {
+		t.Fatalf("failed to cache: %v", err)
+	}
+	ids := make(map[string]string)
+	for _, f := range files {
+		id, err := lookup(vr.r, f)
+		if err != nil {
+			t.Fatalf("failed to lookup %q: %v", f, err)
+		}
+		cacheID := genID(id, 0, int64(len(content)))
+		if !progress.Done(cacheID) {
+			t.Errorf("%q isn't recorded as cached", f)
+		}
+		ids[f] = cacheID
+	}
+	vr.Close() // the memory cache keeps the contents
+
+	// Chunks recorded as cached are skipped without being throttled. Chunks lost from the
+	// cache are cached again.
+	if err := mc.(*cache.MemoryCache).Remove(ids["e"]); err != nil {
+		t.Fatalf("failed to remove chunk: %v", err)
+	}
+	rc := &recordCache{BlobCache: mc}
+	vr = newReader(rc)
+	defer vr.Close()
+	start := time.Now()
+	if err := vr.Cache(WithCacheRate(int64(len(content)), 1)); err != nil {
+		t.Fatalf("failed to cache: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("recorded chunks must not be throttled: took %v", elapsed)
+	}
+	if !slices.Equal(rc.added, []string{ids["e"]}) {
+		t.Errorf("cached %v; want only the lost chunk %v", rc.added, ids["e"])
+	}
+}
+
+type memoryCacheProgress struct {
+	done map[string]struct{}
+	mu   sync.Mutex
+}
+
+func (p *memoryCacheProgress) Done(cacheID string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, ok := p.done[cacheID]
+	return ok
+}
+
+func (p *memoryCacheProgress) Add(cacheID string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done[cacheID] = struct{}{}
+	return nil
+}
+
+type closeRecordCache struct {
+	cache.BlobCache
+	closed atomic.Bool
+}
+
+func (c *closeRecordCache) Close() error {
+	c.closed.Store(true)
+	return c.BlobCache.Close()
+}
+
+func (c *closeRecordCache) isClosed() bool {
+	return c.closed.Load()
+}
+
+type recordCache struct {
+	cache.BlobCache
+	added   []string
+	addedMu sync.Mutex
 }
 
-func (bv *testVerifier) Write(p []byte) (n int, err error) {
-	return len(p), nil
+func (c *recordCache) Add(key string, opts ...cache.Option) (cache.Writer, error) {
+	c.addedMu.Lock()
+	c.added = append(c.added, key)
+	c.addedMu.Unlock()
+	return c.BlobCache.Add(key, opts...)
 }
 
-func (bv *testVerifier) Verified() bool {
-	return bv.success
+// upperTransformer converts chunks to upper case and records the transformed chunks.
+type upperTransformer struct {
+	mu      sync.Mutex
+	chunks  []Chunk
+	noop    bool  // only records chunks
+	failure error // returned by TransformChunk if non-nil
 }
 
-func checkError(wantFail bool, err error) error {
-	if wantFail && err == nil {
-		return fmt.Errorf("wanted to fail but succeeded")
-	} else if !wantFail && err != nil {
-		return fmt.Errorf("wanted to succeed verification but failed: %w", err)
+func (u *upperTransformer) TransformChunk(ctx context.Context, chunk Chunk, p []byte) error {
+	u.mu.Lock()
+	u.chunks = append(u.chunks, chunk)
+	u.mu.Unlock()
+	if u.failure != nil {
+		return u.failure
+	}
+	if !u.noop {
+		copy(p, bytes.ToUpper(p))
 	}
 	return nil
 }
 
-func prepareMap(mr metadata.Reader, id uint32, p string) (off2id map[int64]uint32, id2path map[uint32]string, _ error) {
-	attr, err := mr.GetAttr(id)
-	if err != nil {
-		return nil, nil, err
-	}
-	id2path = map[uint32]string{id: p}
-	off2id = make(map[int64]uint32)
-	if attr.Mode.IsRegular() {
-		off, err := mr.GetOffset(id)
-		if err != nil {
-			return nil, nil, err
-		}
-		off2id[off] = id
-	}
-	var retErr error
-	mr.ForeachChild(id, func(name string, id uint32, mode os.FileMode) bool {
-		o2i, i2p, err := prepareMap(mr, id, path.Join(p, name))
-		if err != nil {
-			retErr = err
-			return false
+func (u *upperTransformer) transformed(id uint32) (n int) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for _, c := range u.chunks {
+		if c.ID == id {
+			n++
 		}
-		maps.Copy(off2id, o2i)
-		maps.Copy(id2path, i2p)
-		return true
-	})
-	if retErr != nil {
-		return nil, nil, retErr
 	}
-	return off2id, id2path, nil
+	return n
 }
 
-func testFailReader(t *TestRunner, factory metadata.Store) {
-	testFileName := "test"
+func testChunkTransformers(t *TestRunner, factory metadata.Store) {
+	const chunkSize = 16
+	data := strings.Repeat("0123456789abcdef", 4)
 	for srcCompressionName, srcCompression := range srcCompressions {
 		srcCompression := srcCompression()
-		t.Run(fmt.Sprintf("%v", srcCompressionName), func(t *TestRunner) {
-			for _, rs := range []bool{true, false} {
-				for _, vs := range []bool{true, false} {
-					stargzFile, tocDigest, err := tutil.BuildEStargz([]tutil.TarEntry{
-						tutil.File(testFileName, sampleData1),
-					}, tutil.WithEStargzOptions(estargz.WithChunkSize(sampleChunkSize), estargz.WithCompression(srcCompression)))
-					if err != nil {
-						t.Fatalf("failed to build sample estargz")
-					}
+		stargzFile, tocDigest, err := tutil.BuildEStargz([]tutil.TarEntry{
+			tutil.File("a", data),
+			tutil.File("b", data),
+		}, tutil.WithEStargzOptions(estargz.WithChunkSize(chunkSize), estargz.WithCompression(srcCompression)))
+		if err != nil {
+			t.Fatalf("failed to build sample estargz: %v", err)
+		}
+		newReader := func(t TestingT, tr ChunkTransformer, verify bool) (*VerifiableReader, *reader) {
+			mr, err := factory(stargzFile, metadata.WithDecompressors(srcCompression))
+			if err != nil {
+				t.Fatalf("failed to prepare metadata reader: %v", err)
+			}
+			layerSha := digest.FromString("layer")
+			vr, err := NewReader(mr, cache.NewMemoryCache(), layerSha, WithChunkTransformers(tr))
+			if err != nil {
+				t.Fatalf("failed to make new reader: %v", err)
+			}
+			if !verify {
+				return vr, vr.SkipVerify().(*reader)
+			}
+			r, err := vr.VerifyTOC(tocDigest)
+			if err != nil {
+				t.Fatalf("failed to verify TOC: %v", err)
+			}
+			return vr, r.(*reader)
+		}
+		read := func(t TestingT, gr *reader, name string) (uint32, string, error) {
+			id, err := lookup(gr, name)
+			if err != nil {
+				t.Fatalf("failed to lookup %q: %v", name, err)
+			}
+			ra, err := gr.OpenFile(id)
+			if err != nil {
+				t.Fatalf("failed to open %q: %v", name, err)
+			}
+			p := make([]byte, len(data))
+			n, err := ra.ReadAt(p, 0)
+			return id, string(p[:n]), err
+		}
 
-					br := &breakReaderAt{
-						ReaderAt: stargzFile,
-						success:  true,
-					}
-					bev := &testChunkVerifier{true}
-					mcache := cache.NewMemoryCache()
-					mr, err := factory(io.NewSectionReader(br, 0, stargzFile.Size()), metadata.WithDecompressors(srcCompression))
-					if err != nil {
-						t.Fatalf("failed to prepare metadata reader")
-					}
-					defer mr.Close()
-					vr, err := NewReader(mr, mcache, digest.FromString(""))
-					if err != nil {
-						t.Fatalf("failed to make new reader: %v", err)
-					}
-					defer vr.Close()
-					vr.verifier = bev.verifier
-					vr.r.verifier = bev.verifier
-					gr, err := vr.VerifyTOC(tocDigest)
-					if err != nil {
-						t.Fatalf("failed to verify TOC: %v", err)
-					}
+		t.Run("chunk_transformers_audit_"+srcCompressionName, func(t *TestRunner) {
+			tr := &upperTransformer{noop: true}
+			vr, gr := newReader(t, tr, true)
+			defer vr.Close()
+			id, got, err := read(t, gr, "a")
+			if err != nil || got != data {
+				t.Fatalf("failed to read: %q, %v", got, err)
+			}
+			var offsets []int64
+			for _, c := range tr.chunks {
+				if c.ID != id {
+					continue
+				}
+				if c.Layer != digest.FromString("layer") || c.Size != chunkSize || c.Digest == "" {
+					t.Errorf("unexpected chunk %+v", c)
+				}
+				offsets = append(offsets, c.Offset)
+			}
+			slices.Sort(offsets)
+			if want := []int64{0, 16, 32, 48}; !slices.Equal(offsets, want) {
+				t.Errorf("transformed chunks at %v; want %v", offsets, want)
+			}
 
-					notexist := uint32(0)
-					found := false
-					for i := range uint32(1000000) {
-						if _, err := gr.Metadata().GetAttr(i); err != nil {
-							notexist, found = i, true
-							break
-						}
-					}
-					if !found {
-						t.Fatalf("free ID not found")
-					}
+			// Chunks read from the cache aren't transformed again.
+			n := tr.transformed(id)
+			if _, got, err := read(t, gr, "a"); err != nil || got != data {
+				t.Fatalf("failed to read: %q, %v", got, err)
+			}
+			if tr.transformed(id) != n {
+				t.Errorf("cached chunks are transformed again")
+			}
+		})
 
-					// tests for opening non-existing file
-					_, err = gr.OpenFile(notexist)
-					if err == nil {
-						t.Errorf("succeeded to open file but wanted to fail")
-						return
-					}
+		t.Run("chunk_transformers_read_"+srcCompressionName, func(t *TestRunner) {
+			vr, gr := newReader(t, &upperTransformer{}, false)
+			defer vr.Close()
+			if _, got, err := read(t, gr, "a"); err != nil || got != strings.ToUpper(data) {
+				t.Errorf("read %q, %v; want %q", got, err, strings.ToUpper(data))
+			}
+		})
 
-					// tests failure behaviour of a file read
-					tid, _, err := gr.Metadata().GetChild(gr.Metadata().RootID(), testFileName)
-					if err != nil {
-						t.Errorf("failed to get %q: %v", testFileName, err)
-						return
-					}
-					fr, err := gr.OpenFile(tid)
-					if err != nil {
-						t.Errorf("failed to open file but wanted to succeed: %v", err)
-						return
-					}
+		t.Run("chunk_transformers_cache_"+srcCompressionName, func(t *TestRunner) {
+			tr := &upperTransformer{}
+			vr, gr := newReader(t, tr, false)
+			defer vr.Close()
+			if err := vr.Cache(); err != nil {
+				t.Fatalf("failed to cache: %v", err)
+			}
+			n := len(tr.chunks)
+			if _, got, err := read(t, gr, "b"); err != nil || got != strings.ToUpper(data) {
+				t.Errorf("read %q, %v; want %q", got, err, strings.ToUpper(data))
+			}
+			if len(tr.chunks) != n {
+				t.Errorf("chunks aren't transformed by Cache")
+			}
+		})
 
-					mcache.(*cache.MemoryCache).Membuf = map[string]*bytes.Buffer{}
-					br.success = rs
-					bev.success = vs
+		t.Run("chunk_transformers_verify_"+srcCompressionName, func(t *TestRunner) {
+			// Digests are checked against the transformed chunks.
+			vr, gr := newReader(t, &upperTransformer{}, true)
+			defer vr.Close()
+			if _, _, err := read(t, gr, "a"); !errors.Is(err, ErrInvalidChunk) {
+				t.Errorf("read must fail with invalid chunk: %v", err)
+			}
+		})
 
-					// tests for reading file
-					p := make([]byte, len(sampleData1))
-					n, err := fr.ReadAt(p, 0)
-					if rs && vs {
-						if err != nil || n != len(sampleData1) || !bytes.Equal([]byte(sampleData1), p) {
-							t.Errorf("failed to read data but wanted to succeed: %v", err)
-							return
-						}
-					} else {
-						if err == nil {
-							t.Errorf("succeeded to read data but wanted to fail (reader:%v,verify:%v)", rs, vs)
-							return
-						}
-					}
+		t.Run("chunk_transformers_failure_"+srcCompressionName, func(t *TestRunner) {
+			failure := errors.New("denied")
+			vr, gr := newReader(t, &upperTransformer{failure: failure}, true)
+			defer vr.Close()
+			if _, _, err := read(t, gr, "a"); !errors.Is(err, failure) {
+				t.Errorf("read must fail with the error of the transformer: %v", err)
+			}
+		})
+	}
+}
+
+func testModelIndexSize(t *TestRunner) {
+	ggufString := func(b []byte, s string) []byte {
+		return append(binary.LittleEndian.AppendUint64(b, uint64(len(s))), s...)
+	}
+	gguf := func(alignment uint32) []byte {
+		b := []byte("GGUF")
+		b = binary.LittleEndian.AppendUint32(b, 3)
+		b = binary.LittleEndian.AppendUint64(b, 1) // tensors
+		b = binary.LittleEndian.AppendUint64(b, 3) // kvs
+		b = ggufString(b, "general.name")
+		b = binary.LittleEndian.AppendUint32(b, ggufTypeString)
+		b = ggufString(b, "test")
+		b = ggufString(b, "tokenizer.tokens")
+		b = binary.LittleEndian.AppendUint32(b, ggufTypeArray)
+		b = binary.LittleEndian.AppendUint32(b, ggufTypeString)
+		b = binary.LittleEndian.AppendUint64(b, 2)
+		b = ggufString(ggufString(b, "a"), "bc")
+		b = ggufString(b, "general.alignment")
+		b = binary.LittleEndian.AppendUint32(b, ggufTypeUint32)
+		b = binary.LittleEndian.AppendUint32(b, alignment)
+		b = ggufString(b, "weight")
+		b = binary.LittleEndian.AppendUint32(b, 2) // dims
+		b = binary.LittleEndian.AppendUint64(b, 4)
+		b = binary.LittleEndian.AppendUint64(b, 4)
+		b = binary.LittleEndian.AppendUint32(b, 0) // type
+		b = binary.LittleEndian.AppendUint64(b, 0) // offset
+		return b
+	}
+	safetensors := binary.LittleEndian.AppendUint64(nil, 2)
+	safetensors = append(safetensors, "{}"...)
+	tests := []struct {
+		name     string
+		data     []byte
+		wantSize int64
+		wantErr  error
+	}{
+		{"gguf", append(gguf(64), make([]byte, 256)...), 256, nil},
+		{"gguf-default-alignment", append(gguf(32), make([]byte, 256)...), 224, nil},
+		{"gguf-truncated", gguf(32)[:40], 0, nil},
+		{"safetensors", append(safetensors, make([]byte, 16)...), 10, nil},
+		{"unknown", []byte("0123456789abcdef"), 0, ErrUnknownModelFormat},
+		{"short", []byte("GG"), 0, ErrUnknownModelFormat},
+	}
+	for _, tt := range tests {
+		t.Run("model_index_size_"+tt.name, func(t *TestRunner) {
+			got, err := ModelIndexSize(bytes.NewReader(tt.data), int64(len(tt.data)))
+			if tt.wantSize == 0 {
+				if err == nil {
+					t.Fatalf("parsing must fail but got size %d", got)
 				}
+				if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+					t.Fatalf("unexpected error %v; want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to get index size: %v", err)
+			}
+			if got != tt.wantSize {
+				t.Errorf("index size = %d; want %d", got, tt.wantSize)
+			}
+		})
+	}
+}
+
+func testParseDependencies(t *TestRunner) {
+	x8664Paths := []string{"/lib/x86_64-linux-gnu", "/usr/lib/x86_64-linux-gnu", "/lib64", "/usr/lib64", "/lib", "/usr/lib", "/usr/local/lib"}
+	tests := []struct {
+		name    string
+		data    []byte
+		want    Dependencies
+		wantErr error
+	}{
+		{
+			name: "elf",
+			data: tutil.ELF("/lib64/ld-linux-x86-64.so.2", []string{"libssl.so.3", "libc.so.6"}, "$ORIGIN/../lib:/opt/lib"),
+			want: Dependencies{
+				Interpreter:         "/lib64/ld-linux-x86-64.so.2",
+				Libraries:           []string{"libssl.so.3", "libc.so.6"},
+				LibraryPaths:        []string{"$ORIGIN/../lib", "/opt/lib"},
+				DefaultLibraryPaths: x8664Paths,
+			},
+		},
+		{
+			name: "elf-static",
+			data: tutil.ELF("", nil, ""),
+			want: Dependencies{DefaultLibraryPaths: x8664Paths},
+		},
+		{
+			name: "script",
+			data: []byte("#!/bin/sh -e\necho hello\n"),
+			want: Dependencies{Interpreter: "/bin/sh"},
+		},
+		{
+			name: "script-env",
+			data: []byte("#! /usr/bin/env -S LANG=C python3 -u\n"),
+			want: Dependencies{Interpreter: "/usr/bin/env", Command: "python3"},
+		},
+		{
+			name:    "script-empty",
+			data:    []byte("#!\n"),
+			wantErr: ErrUnknownExecutableFormat,
+		},
+		{
+			name:    "text",
+			data:    []byte("hello"),
+			wantErr: ErrUnknownExecutableFormat,
+		},
+		{
+			name:    "short",
+			data:    []byte("#"),
+			wantErr: ErrUnknownExecutableFormat,
+		},
+	}
+	for _, tt := range tests {
+		t.Run("parse_dependencies_"+tt.name, func(t *TestRunner) {
+			got, err := ParseDependencies(bytes.NewReader(tt.data), int64(len(tt.data)))
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("unexpected error %v; want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to parse dependencies: %v", err)
+			}
+			if got.Interpreter != tt.want.Interpreter || got.Command != tt.want.Command ||
+				!slices.Equal(got.Libraries, tt.want.Libraries) ||
+				!slices.Equal(got.LibraryPaths, tt.want.LibraryPaths) ||
+				!slices.Equal(got.DefaultLibraryPaths, tt.want.DefaultLibraryPaths) {
+				t.Errorf("dependencies = %+v; want %+v", got, tt.want)
 			}
 		})
 	}
 }
 
+type testChunkSource struct {
+	data     []byte
+	failures int
+	failErr  error // error of the failures. errdefs.ErrUnavailable is used by default.
+	called   int
+	chunk    Chunk
+}
+
+func (s *testChunkSource) FetchChunk(ctx context.Context, chunk Chunk, p []byte) error {
+	s.called++
+	s.chunk = chunk
+	if s.data == nil {
+		return ErrChunkNotFound
+	}
+	if s.called <= s.failures {
+		if s.failErr != nil {
+			return s.failErr
+		}
+		return fmt.Errorf("temporary failure: %w", errdefs.ErrUnavailable)
+	}
+	copy(p, s.data[chunk.Offset:])
+	return nil
+}
+
+type closeCountCache struct {
+	cache.BlobCache
+	closed int
+}
+
+func (c *closeCountCache) Close() error {
+	c.closed++
+	return c.BlobCache.Close()
+}
+
 type breakReaderAt struct {
 	io.ReaderAt
 	success bool
@@ -703,7 +3436,7 @@ func testPreReader(t *TestRunner, factory metadata.Store) {
 				if err != nil {
 					t.Fatalf("failed to build sample eStargz: %v", err)
 				}
-				testR := &calledReaderAt{esgz, nil}
+				testR := &calledReaderAt{ReaderAt: esgz}
 				mr, err := factory(io.NewSectionReader(testR, 0, esgz.Size()), metadata.WithDecompressors(srcCompression))
 				if err != nil {
 					t.Fatalf("failed to create new reader: %v", err)
@@ -830,11 +3563,18 @@ func lookup(r *reader, name string) (uint32, error) {
 
 type calledReaderAt struct {
 	io.ReaderAt
-	called []int64
+	called   []int64
+	read     int64 // total bytes requested
+	failures int   // number of the following reads failing
 }
 
 func (r *calledReaderAt) ReadAt(p []byte, off int64) (int, error) {
 	r.called = append(r.called, off)
+	r.read += int64(len(p))
+	if r.failures > 0 {
+		r.failures--
+		return 0, fmt.Errorf("temporary failure: %w", errdefs.ErrUnavailable)
+	}
 	return r.ReaderAt.ReadAt(p, off)
 }
 
@@ -856,7 +3596,8 @@ func makeMockFile(id uint32) *file {
 	mockFile := &mockFile{}
 
 	gr := &reader{
-		cache: mockCache,
+		cache:   mockCache,
+		sources: []Source{{Name: BlobSourceName}},
 	}
 
 	return &file{
@@ -1027,3 +3768,160 @@ func testProcessBatchChunks(t *TestRunner) {
 		})
 	}
 }
+
+// shortReadFile is a metadata.File whose first reads at the offsets return half of the
+// requested bytes. Reads at the offsets return half of the bytes forever if persistent.
+type shortReadFile struct {
+	mockFile
+	persistent bool
+
+	mu    sync.Mutex
+	reads map[int64]int
+}
+
+func (f *shortReadFile) ReadAt(p []byte, offset int64) (int, error) {
+	f.mu.Lock()
+	f.reads[offset]++
+	n := f.reads[offset]
+	f.mu.Unlock()
+	for i := range p {
+		p[i] = byte(offset + int64(i))
+	}
+	if n == 1 || f.persistent {
+		return len(p) / 2, io.EOF
+	}
+	return len(p), nil
+}
+
+func testPrefetchEntireFileBatches(t *TestRunner, factory metadata.Store) {
+	const (
+		chunkSize = 16
+		fileSize  = 6*chunkSize + 4
+	)
+	data := strings.Repeat("0123456789abcdef", 7)[:fileSize]
+	for _, bufferSize := range []int64{chunkSize, 40, 1000} {
+		t.Run(fmt.Sprintf("prefetch_entire_file_buffer_%d", bufferSize), func(t *TestRunner) {
+			stargzFile, tocDigest, err := tutil.BuildEStargz([]tutil.TarEntry{
+				tutil.File("file", data),
+			}, tutil.WithEStargzOptions(estargz.WithChunkSize(chunkSize)))
+			if err != nil {
+				t.Fatalf("failed to build sample estargz: %v", err)
+			}
+			mr, err := factory(stargzFile)
+			if err != nil {
+				t.Fatalf("failed to prepare metadata reader: %v", err)
+			}
+			vr, err := NewReader(mr, cache.NewMemoryCache(), digest.FromString(""))
+			if err != nil {
+				t.Fatalf("failed to make new reader: %v", err)
+			}
+			defer vr.Close()
+			r, err := vr.VerifyTOC(tocDigest)
+			if err != nil {
+				t.Fatalf("failed to verify TOC: %v", err)
+			}
+			gr := r.(*reader)
+			id, err := lookup(gr, "file")
+			if err != nil {
+				t.Fatalf("failed to lookup file: %v", err)
+			}
+			ra, err := gr.OpenFile(id)
+			if err != nil {
+				t.Fatalf("failed to open file: %v", err)
+			}
+			sf := ra.(*file)
+			var chunks []chunkData
+			for offset := int64(0); ; {
+				chunkOffset, size, digestStr, ok := sf.fr.ChunkEntryForOffset(offset)
+				if !ok {
+					break
+				}
+				chunks = append(chunks, chunkData{offset: chunkOffset, size: size, digestStr: digestStr})
+				offset = chunkOffset + size
+			}
+			// Batches are split at the chunk boundaries even if the buffer isn't aligned to the chunks.
+			entireID := genID(id, 0, fileSize)
+			if err := sf.prefetchEntireFile(entireID, chunks, bufferSize, 3); err != nil {
+				t.Fatalf("failed to prefetch file: %v", err)
+			}
+			cr, err := gr.cache.Get(entireID)
+			if err != nil {
+				t.Fatalf("file isn't cached: %v", err)
+			}
+			defer cr.Close()
+			p := make([]byte, fileSize+1)
+			if n, err := cr.ReadAt(p, 0); (err != nil && err != io.EOF) || n != fileSize || string(p[:n]) != data {
+				t.Errorf("cached %q (n=%d, err=%v); want %q", string(p[:n]), n, err, data)
+			}
+		})
+	}
+}
+
+func testRefetchHoles(t *TestRunner) {
+	const (
+		chunkSize   = 1024
+		totalChunks = 10
+		workerCount = 3
+	)
+	for _, tc := range []struct {
+		name       string
+		persistent bool
+		overlap    bool
+		wantErr    bool
+	}{
+		{name: "refetch"},
+		{name: "persistent_short_reads", persistent: true, wantErr: true},
+		{name: "overlapping_reads", overlap: true, wantErr: true},
+	} {
+		t.Run("refetch_holes_"+tc.name, func(t *TestRunner) {
+			sf := makeMockFile(1)
+			fr := &shortReadFile{persistent: tc.persistent, reads: make(map[int64]int)}
+			sf.fr = fr
+			var chunks []chunkData
+			for i := range int64(totalChunks) {
+				chunks = append(chunks, chunkData{
+					offset:    i * chunkSize,
+					size:      chunkSize,
+					bufferPos: i * chunkSize,
+				})
+			}
+			buffer := make([]byte, chunkSize*totalChunks)
+			var readInfos []chunkReadInfo
+			for i := range workerCount {
+				args := &batchWorkerArgs{
+					workerID:    i,
+					chunks:      chunks,
+					buffer:      buffer,
+					workerCount: workerCount,
+				}
+				if err := sf.processBatchChunks(args); err != nil {
+					t.Fatalf("processBatchChunks failed: %v", err)
+				}
+				readInfos = append(readInfos, args.readInfos...)
+			}
+			if tc.overlap {
+				readInfos = append(readInfos, chunkReadInfo{offset: chunkSize / 2, size: chunkSize})
+			}
+			err := sf.refetchHoles(chunks, buffer, readInfos)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("holes must be detected")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to fetch holes again: %v", err)
+			}
+			for i, b := range buffer {
+				if b != byte(i) {
+					t.Fatalf("unexpected byte %d at %d", b, i)
+				}
+			}
+			for _, c := range chunks {
+				if n := fr.reads[c.offset]; n != 2 {
+					t.Errorf("chunk at %d is read %d times; want 2", c.offset, n)
+				}
+			}
+		})
+	}
+}
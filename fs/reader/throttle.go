@@ -0,0 +1,142 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package reader
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	// slowReadCooldown is how long Cache keeps pausing after the last slow read.
+	slowReadCooldown = time.Second
+
+	// slowReadPollInterval is the interval to check whether Cache can resume.
+	slowReadPollInterval = 50 * time.Millisecond
+)
+
+// WithCacheRate throttles Cache so that it caches up to bytesPerSec bytes of chunks per
+// second and fetches up to maxConcurrency chunks at once. Zero or a negative value means
+// no limit of the rate and the default concurrency (GOMAXPROCS).
+func WithCacheRate(bytesPerSec int64, maxConcurrency int) CacheOption {
+	return func(opts *cacheOptions) {
+		opts.bytesPerSec = bytesPerSec
+		opts.maxConcurrency = maxConcurrency
+	}
+}
+
+// WithPauseOnSlowReads pauses Cache while reads of files of the reader that fetch chunks
+// (i.e. foreground reads missing the cache) take longer than threshold, so caching in
+// background doesn't take the bandwidth from them. Cache resumes when such reads finish
+// within threshold or no read is slow for a while.
+func WithPauseOnSlowReads(threshold time.Duration) CacheOption {
+	return func(opts *cacheOptions) {
+		opts.pauseThreshold = threshold
+	}
+}
+
+// readLatency tracks the latency of the reads of files that fetch chunks, shared among
+// a reader and its clones.
+type readLatency struct {
+	mu       sync.Mutex
+	inflight map[*time.Time]struct{} // start times of the reads in progress
+	last     time.Duration           // latency of the last finished read
+	lastEnd  time.Time
+}
+
+func newReadLatency() *readLatency {
+	return &readLatency{inflight: make(map[*time.Time]struct{})}
+}
+
+// start records the start of a read. The returned function must be called when the read
+// finishes.
+func (l *readLatency) start() (done func()) {
+	if l == nil {
+		return func() {}
+	}
+	start := time.Now()
+	l.mu.Lock()
+	l.inflight[&start] = struct{}{}
+	l.mu.Unlock()
+	return func() {
+		end := time.Now()
+		l.mu.Lock()
+		delete(l.inflight, &start)
+		l.last, l.lastEnd = end.Sub(start), end
+		l.mu.Unlock()
+	}
+}
+
+// slow returns true if a read in progress or recently finished is slower than threshold.
+func (l *readLatency) slow(threshold time.Duration) bool {
+	if l == nil {
+		return false
+	}
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for start := range l.inflight {
+		if now.Sub(*start) > threshold {
+			return true
+		}
+	}
+	return l.last > threshold && now.Sub(l.lastEnd) < slowReadCooldown
+}
+
+// cacheThrottle throttles caching chunks by Cache.
+type cacheThrottle struct {
+	limiter        *rate.Limiter
+	latency        *readLatency
+	pauseThreshold time.Duration
+}
+
+func newCacheThrottle(opts cacheOptions, latency *readLatency) *cacheThrottle {
+	t := &cacheThrottle{latency: latency, pauseThreshold: opts.pauseThreshold}
+	if opts.bytesPerSec > 0 {
+		t.limiter = rate.NewLimiter(rate.Limit(opts.bytesPerSec), int(min(opts.bytesPerSec, math.MaxInt)))
+	}
+	return t
+}
+
+// wait waits until a chunk of size can be cached.
+func (t *cacheThrottle) wait(ctx context.Context, size int64) error {
+	if t.pauseThreshold > 0 {
+		for t.latency.slow(t.pauseThreshold) {
+			select {
+			case <-time.After(slowReadPollInterval):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+	if t.limiter == nil {
+		return nil
+	}
+	for size > 0 {
+		// Chunks larger than the burst are waited for in pieces.
+		n := min(size, int64(t.limiter.Burst()))
+		if err := t.limiter.WaitN(ctx, int(n)); err != nil {
+			return err
+		}
+		size -= n
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package reader
+
+import (
+	"sync"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+// Access is a read of a chunk of a file recorded by AccessTrace.
+type Access struct {
+	// Time is the time when the chunk is read.
+	Time time.Time
+
+	// Layer is the digest of the layer blob.
+	Layer digest.Digest
+
+	// ID is the ID of the file in the layer.
+	ID uint32
+
+	// Path is the absolute path of the file in the layer (e.g. "/a/b"). This is empty if
+	// the path can't be resolved.
+	Path string
+
+	// Offset is the offset of the chunk in the file.
+	Offset int64
+
+	// Size is the size of the chunk.
+	Size int64
+
+	// Digest is the digest of the uncompressed chunk. This can be empty if the layer doesn't
+	// record the chunk digest.
+	Digest string
+
+	// Cached is true if the chunk is served from the cache without fetching.
+	Cached bool
+}
+
+// AccessTrace records the chunks read from the files of layers in a ring buffer. The
+// oldest records are overwritten when the buffer is full. AccessTrace can be shared among
+// readers of several layers (e.g. all layers of a container) and is safe for concurrent use.
+type AccessTrace struct {
+	mu      sync.Mutex
+	buf     []Access
+	next    int    // index in buf of the next record
+	total   uint64 // number of records since the last reset
+	dropped uint64 // number of records overwritten since the last reset
+}
+
+// NewAccessTrace returns AccessTrace keeping the last size records. nil is returned if
+// size <= 0.
+func NewAccessTrace(size int) *AccessTrace {
+	if size <= 0 {
+		return nil
+	}
+	return &AccessTrace{buf: make([]Access, 0, size)}
+}
+
+// WithAccessTrace records the chunks read from files to the trace. Reads of prefetch,
+// background fetch and readahead aren't recorded but the following reads of their chunks
+// are recorded as cached. By default, reads aren't recorded.
+func WithAccessTrace(trace *AccessTrace) Option {
+	return func(opts *options) {
+		opts.accessTrace = trace
+	}
+}
+
+func (t *AccessTrace) record(a Access) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.buf) < cap(t.buf) {
+		t.buf = append(t.buf, a)
+	} else {
+		t.buf[t.next] = a
+		t.dropped++
+	}
+	t.next = (t.next + 1) % cap(t.buf)
+	t.total++
+}
+
+// Snapshot returns the recorded accesses from the oldest to the newest. The number of
+// records overwritten in the buffer since the last reset is also returned.
+func (t *AccessTrace) Snapshot() (accesses []Access, dropped uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	accesses = make([]Access, 0, len(t.buf))
+	if len(t.buf) == cap(t.buf) {
+		accesses = append(accesses, t.buf[t.next:]...)
+		accesses = append(accesses, t.buf[:t.next]...)
+	} else {
+		accesses = append(accesses, t.buf...)
+	}
+	return accesses, t.dropped
+}
+
+// Reset forgets all records.
+func (t *AccessTrace) Reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.buf = t.buf[:0]
+	t.next, t.total, t.dropped = 0, 0, 0
+}
+
+// Total returns the number of the accesses recorded since the last reset including the
+// overwritten ones.
+func (t *AccessTrace) Total() uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.total
+}
+
+// traceAccess records the read of the chunk of the file if the access trace is enabled.
+func (sf *file) traceAccess(chunkOffset, chunkSize int64, chunkDigestStr string, cached bool) {
+	if sf.gr.accessTrace == nil {
+		return
+	}
+	sf.gr.accessTrace.record(Access{
+		Time:   time.Now(),
+		Layer:  sf.gr.layerSha,
+		ID:     sf.id,
+		Path:   sf.pathOf(),
+		Offset: chunkOffset,
+		Size:   chunkSize,
+		Digest: chunkDigestStr,
+		Cached: cached,
+	})
+}
@@ -0,0 +1,57 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package reader
+
+import (
+	"context"
+	"fmt"
+)
+
+// ChunkTransformer transforms chunks read from the layer blob before they are verified and
+// cached (e.g. decryption, custom encodings or auditing). The chunk digests are checked
+// against the transformed chunks. Chunks read from the cache and from ChunkSource are
+// already transformed so they aren't passed to the transformer.
+type ChunkTransformer interface {
+	// TransformChunk transforms the chunk in p in place. len(p) is the size of the chunk.
+	// Returning an error fails the read of the chunk.
+	TransformChunk(ctx context.Context, chunk Chunk, p []byte) error
+}
+
+// WithChunkTransformers specifies the transformers applied in order to chunks read from the
+// layer blob. Reads of chunks to be transformed always fetch the whole chunk (see
+// WithSubChunkFetch).
+func WithChunkTransformers(transformers ...ChunkTransformer) Option {
+	return func(opts *options) {
+		opts.transformers = transformers
+	}
+}
+
+// transformChunk applies the transformers to the chunk of the file read from the layer blob.
+func (gr *reader) transformChunk(ctx context.Context, id uint32, chunkOffset int64, p []byte, chunkDigest string) error {
+	for _, t := range gr.transformers {
+		if err := t.TransformChunk(ctx, Chunk{
+			Layer:  gr.layerSha,
+			ID:     id,
+			Offset: chunkOffset,
+			Size:   int64(len(p)),
+			Digest: chunkDigest,
+		}, p); err != nil {
+			return fmt.Errorf("failed to transform chunk at %d of file %d: %w", chunkOffset, id, err)
+		}
+	}
+	return nil
+}
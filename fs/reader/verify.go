@@ -0,0 +1,136 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package reader
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+)
+
+// WithAsyncVerify makes reads return chunks fetched on demand without waiting for the
+// verification of the chunks. The chunks are verified by up to workers goroutines shared
+// among the reader and its clones, and cached once verified. A chunk failing the
+// verification isn't cached and the next read of the chunk fails. Chunks are verified
+// before being returned while all workers are busy. By default (workers <= 0), all chunks
+// are verified before being returned.
+func WithAsyncVerify(workers int) Option {
+	return func(opts *options) {
+		opts.asyncVerifyWorkers = workers
+	}
+}
+
+// asyncVerifier tracks the chunks verified in background.
+type asyncVerifier struct {
+	workers chan struct{}
+
+	mu      sync.Mutex
+	pending map[string]chan struct{} // closed when the chunk of the cache ID is verified
+	failed  map[string]error         // errors of the chunks failed the verification
+}
+
+func newAsyncVerifier(workers int) *asyncVerifier {
+	if workers <= 0 {
+		return nil
+	}
+	return &asyncVerifier{
+		workers: make(chan struct{}, workers),
+		pending: make(map[string]chan struct{}),
+		failed:  make(map[string]error),
+	}
+}
+
+// check waits for the verification of the chunk and returns the error if the chunk failed
+// the verification. The error is returned only once so the chunk is fetched again by the
+// following reads.
+func (av *asyncVerifier) check(cacheID string) error {
+	if av == nil {
+		return nil
+	}
+	av.mu.Lock()
+	done, ok := av.pending[cacheID]
+	av.mu.Unlock()
+	if ok {
+		<-done
+	}
+	av.mu.Lock()
+	defer av.mu.Unlock()
+	err := av.failed[cacheID]
+	delete(av.failed, cacheID)
+	return err
+}
+
+// start marks the chunk as being verified. This returns false if no worker is available
+// or the chunk is already being verified.
+func (av *asyncVerifier) start(cacheID string) bool {
+	select {
+	case av.workers <- struct{}{}:
+	default:
+		return false
+	}
+	av.mu.Lock()
+	defer av.mu.Unlock()
+	if _, ok := av.pending[cacheID]; ok {
+		<-av.workers
+		return false
+	}
+	av.pending[cacheID] = make(chan struct{})
+	return true
+}
+
+func (av *asyncVerifier) finish(cacheID string, err error) {
+	av.mu.Lock()
+	if err != nil {
+		av.failed[cacheID] = err
+	}
+	close(av.pending[cacheID])
+	delete(av.pending, cacheID)
+	av.mu.Unlock()
+	<-av.workers
+}
+
+// verifyAndCacheAsync verifies and caches the chunk in background if asynchronous
+// verification is enabled and a worker is available. Otherwise, this is the same as
+// verifyAndCache. ip can be reused after this returns.
+func (gr *reader) verifyAndCacheAsync(entryID uint32, ip []byte, chunkDigestStr string, cacheID string, verified bool) error {
+	av := gr.asyncVerifier
+	if av == nil || !gr.verify || verified || !av.start(cacheID) {
+		return gr.verifyAndCache(entryID, ip, chunkDigestStr, cacheID, verified)
+	}
+	// Keep the cache open until the chunk is cached.
+	if !gr.shared.acquire() {
+		av.finish(cacheID, nil)
+		return gr.verifyAndCache(entryID, ip, chunkDigestStr, cacheID, verified)
+	}
+	gr.countFetch(ip)
+	b := gr.bufPool.Get().(*bytes.Buffer)
+	b.Reset()
+	b.Write(ip)
+	go func() {
+		defer gr.shared.release()
+		err := gr.verifyChunk(entryID, b.Bytes(), chunkDigestStr)
+		if err == nil {
+			gr.cacheData(b.Bytes(), cacheID)
+			gr.indexChunk(chunkDigestStr, cacheID, gr.verify)
+		} else {
+			err = fmt.Errorf("%w: %w", ErrInvalidChunk, err)
+		}
+		gr.putBuffer(b)
+		av.finish(cacheID, err)
+	}()
+	return nil
+}
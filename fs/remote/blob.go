@@ -23,9 +23,12 @@
 package remote
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"net/url"
 	"regexp"
 	"sort"
 	"strings"
@@ -33,8 +36,13 @@ import (
 	"time"
 
 	"github.com/containerd/containerd/v2/pkg/reference"
+	"github.com/containerd/log"
 	"github.com/containerd/stargz-snapshotter/cache"
+	"github.com/containerd/stargz-snapshotter/errdefs"
+	commonmetrics "github.com/containerd/stargz-snapshotter/fs/metrics/common"
 	"github.com/containerd/stargz-snapshotter/fs/source"
+	"github.com/containerd/stargz-snapshotter/fs/tuning"
+	digest "github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"golang.org/x/sync/errgroup"
 	"golang.org/x/sync/singleflight"
@@ -42,19 +50,31 @@ import (
 
 var contentRangeRegexp = regexp.MustCompile(`bytes ([0-9]+)-([0-9]+)/([0-9]+|\\*)`)
 
+// ErrRegistryUnavailable is returned when the blob needs to fetch contents from the registry
+// but the registry has been failing longer than the configured outage threshold.
+var ErrRegistryUnavailable = errdefs.New(errdefs.KindUnavailable, "registry is unavailable")
+
+// ErrDigestMismatch is returned when the contents fetched from the remote don't match the
+// expected digest.
+var ErrDigestMismatch = errdefs.New(errdefs.KindCorrupted, "digest mismatch")
+
 type Blob interface {
 	Check() error
 	Size() int64
 	FetchedSize() int64
+	Available() bool
 	ReadAt(p []byte, offset int64, opts ...Option) (int, error)
 	Cache(offset int64, size int64, opts ...Option) error
 	Refresh(ctx context.Context, host source.RegistryHosts, refspec reference.Spec, desc ocispec.Descriptor) error
+	Expiry() (time.Time, bool)
+	Renew(ctx context.Context, margin time.Duration) error
 	Close() error
 }
 
 type blob struct {
 	fetcher   fetcher
 	fetcherMu sync.Mutex
+	renewMu   sync.Mutex
 
 	size              int64
 	chunkSize         int64
@@ -63,7 +83,7 @@ type blob struct {
 	lastCheck         time.Time
 	lastCheckMu       sync.Mutex
 	checkInterval     time.Duration
-	fetchTimeout      time.Duration
+	fetchTimeouts     fetchTimeouts
 
 	fetchedRegionSet    regionSet
 	fetchedRegionSetMu  sync.Mutex
@@ -72,23 +92,35 @@ type blob struct {
 
 	resolver *Resolver
 
+	verifier   RegionVerifier
+	verifierMu sync.Mutex
+
+	outageThreshold     time.Duration
+	outageProbeInterval time.Duration
+	failingSince        time.Time
+	lastProbe           time.Time
+	unavailable         bool
+	outageMu            sync.Mutex
+
 	closed   bool
 	closedMu sync.Mutex
 }
 
 func makeBlob(fetcher fetcher, size int64, chunkSize int64, prefetchChunkSize int64,
 	blobCache cache.BlobCache, lastCheck time.Time, checkInterval time.Duration,
-	r *Resolver, fetchTimeout time.Duration) *blob {
+	r *Resolver, fetchTimeouts fetchTimeouts, outageThreshold time.Duration, outageProbeInterval time.Duration) *blob {
 	return &blob{
-		fetcher:           fetcher,
-		size:              size,
-		chunkSize:         chunkSize,
-		prefetchChunkSize: prefetchChunkSize,
-		cache:             blobCache,
-		lastCheck:         lastCheck,
-		checkInterval:     checkInterval,
-		resolver:          r,
-		fetchTimeout:      fetchTimeout,
+		fetcher:             fetcher,
+		size:                size,
+		chunkSize:           chunkSize,
+		prefetchChunkSize:   prefetchChunkSize,
+		cache:               blobCache,
+		lastCheck:           lastCheck,
+		checkInterval:       checkInterval,
+		resolver:            r,
+		fetchTimeouts:       fetchTimeouts,
+		outageThreshold:     outageThreshold,
+		outageProbeInterval: outageProbeInterval,
 	}
 }
 
@@ -158,10 +190,80 @@ func (b *blob) Check() error {
 		b.lastCheck = now
 		b.lastCheckMu.Unlock()
 	}
+	b.recordAccess(err)
 
 	return err
 }
 
+// Available returns false if the registry has been failing longer than the outage threshold.
+// Contents already in the cache can still be read while the blob is unavailable.
+func (b *blob) Available() bool {
+	b.outageMu.Lock()
+	defer b.outageMu.Unlock()
+	return !b.unavailable
+}
+
+// checkOutage returns ErrRegistryUnavailable if the registry is treated as unavailable.
+// Once per probe interval, the caller is allowed to access the registry to detect the recovery.
+func (b *blob) checkOutage() error {
+	if b.outageThreshold <= 0 {
+		return nil
+	}
+	b.outageMu.Lock()
+	defer b.outageMu.Unlock()
+	if !b.unavailable {
+		return nil
+	}
+	now := time.Now()
+	if now.Sub(b.lastProbe) < b.outageProbeInterval {
+		return fmt.Errorf("failing since %v: %w", b.failingSince, ErrRegistryUnavailable)
+	}
+	b.lastProbe = now
+	return nil
+}
+
+// recordAccess updates the availability of the registry based on the result of an access to it.
+func (b *blob) recordAccess(err error) {
+	if b.outageThreshold <= 0 {
+		return
+	}
+	if errors.Is(err, context.Canceled) {
+		// cancelled by the caller; this doesn't tell anything about the registry.
+		return
+	}
+	b.outageMu.Lock()
+	now := time.Now()
+	since := b.failingSince
+	changed := false
+	if err == nil {
+		if b.unavailable {
+			log.L.Infof("registry is available again after outage since %v", b.failingSince)
+			changed = true
+		}
+		b.failingSince = time.Time{}
+		b.unavailable = false
+	} else {
+		if b.failingSince.IsZero() {
+			b.failingSince = now
+		}
+		since = b.failingSince
+		if !b.unavailable && now.Sub(b.failingSince) >= b.outageThreshold {
+			log.L.WithError(err).Warnf("registry has been failing since %v; serving cached contents only", b.failingSince)
+			b.unavailable = true
+			b.lastProbe = now
+			changed = true
+		}
+	}
+	unavailable := b.unavailable
+	b.outageMu.Unlock()
+
+	// The handler is called once for each change of the availability, outside of the lock
+	// so it can query the blob.
+	if changed && b.resolver != nil && b.resolver.outageHandler != nil {
+		b.resolver.outageHandler(layerDigest(b.getFetcher()), unavailable, since, err)
+	}
+}
+
 func (b *blob) Size() int64 {
 	return b.size
 }
@@ -216,13 +318,17 @@ func (b *blob) Cache(offset int64, size int64, opts ...Option) error {
 	fr := b.fetcher
 	b.fetcherMu.Unlock()
 
-	if b.prefetchChunkSize <= b.chunkSize {
+	prefetchChunkSize := b.getPrefetchChunkSize()
+	if prefetchChunkSize <= b.chunkSize {
 		return b.cacheAt(offset, size, fr, &cacheOpts)
 	}
 
 	eg, _ := errgroup.WithContext(context.Background())
+	if cacheOpts.concurrency > 0 {
+		eg.SetLimit(cacheOpts.concurrency)
+	}
 
-	fetchSize := b.chunkSize * (b.prefetchChunkSize / b.chunkSize)
+	fetchSize := b.chunkSize * (prefetchChunkSize / b.chunkSize)
 
 	end := offset + size
 	for i := offset; i < end; i += fetchSize {
@@ -315,7 +421,7 @@ func (b *blob) readFromCache(chunk region, dest []byte, offset int64, fr fetcher
 
 // fetchRegions fetches all specified chunks from remote blob and puts it in the local cache.
 // It must be called from within fetchRange and need to ensure that it is inside the singleflight `Do` operation.
-func (b *blob) fetchRegions(allData map[region]io.Writer, fetched map[region]bool, opts *options) error {
+func (b *blob) fetchRegions(allData map[region]io.Writer, fetched map[region]bool, opts *options) (retErr error) {
 	if len(allData) == 0 {
 		return nil
 	}
@@ -329,12 +435,125 @@ func (b *blob) fetchRegions(allData map[region]io.Writer, fetched map[region]boo
 		fetched[reg] = false
 	}
 
-	fetchCtx, cancel := context.WithTimeout(context.Background(), b.fetchTimeout)
-	defer cancel()
+	if err := b.checkOutage(); err != nil {
+		return err
+	}
+
+	// Deadline and cancellation of the caller (e.g. FUSE request) are propagated to the
+	// fetch, in addition to the timeout of the class of the operation.
+	ctx := context.Background()
 	if opts.ctx != nil {
-		fetchCtx = opts.ctx
+		ctx = opts.ctx
 	}
-	mr, err := fr.fetch(fetchCtx, req, true)
+	class := fetchClassFromContext(ctx)
+	fetchCtx, cancel := context.WithTimeout(ctx, b.fetchTimeouts.of(class))
+	defer cancel()
+	release, err := b.getScheduler().acquire(fetchCtx, priorityOf(class))
+	if err != nil {
+		return err
+	}
+	defer release()
+	releaseHost, err := b.getHostLimiter().acquire(fetchCtx, fetcherHost(fr))
+	if err != nil {
+		return err
+	}
+	var fetchedBytes int64
+	defer func() { releaseHost(fetchedBytes, retErr) }()
+	for resumes := 0; ; resumes++ {
+		err := b.fetchRegionsOnce(fetchCtx, fr, req, allData, fetched, opts)
+		var be *brokenTransferError
+		if err == nil {
+			break
+		} else if !errors.As(err, &be) || !errdefs.IsRetryable(err) || resumes >= b.getMaxTransferResumes() || fetchCtx.Err() != nil {
+			return err
+		}
+
+		// Resume the transfer from the chunks not cached yet. Chunks fully received (and
+		// verified, if the blob has the region verifier) are already cached so they aren't
+		// fetched again.
+		req = req[:0]
+		var saved int64
+		for reg := range allData {
+			if fetched[reg] {
+				saved += reg.size()
+				continue
+			}
+			if bw, ok := allData[reg].(*bytesWriter); ok {
+				bw.current = 0 // the chunk is written again from the beginning
+			}
+			req = append(req, reg)
+		}
+		if len(req) == 0 {
+			break
+		}
+		dgst := layerDigest(fr)
+		commonmetrics.IncOperationCount(commonmetrics.ResumedTransferCount, dgst)
+		commonmetrics.AddBytesCount(commonmetrics.ResumedTransferBytesSaved, dgst, saved)
+		log.G(ctx).WithError(err).Debugf("transfer of %d regions broken; resuming %d regions", len(allData), len(req))
+	}
+
+	// Check all chunks are fetched
+	var unfetched []region
+	for c, b := range fetched {
+		if !b {
+			unfetched = append(unfetched, c)
+		}
+	}
+	if unfetched != nil {
+		return fmt.Errorf("failed to fetch region %v", unfetched)
+	}
+	for reg := range allData {
+		fetchedBytes += reg.size()
+	}
+
+	return nil
+}
+
+// brokenTransferError is returned by fetchRegionsOnce when the transfer of the response
+// is broken mid-stream (e.g. the connection is reset). Such transfers can be resumed unless
+// the kind of the cause isn't retryable.
+type brokenTransferError struct {
+	err error
+}
+
+// newBrokenTransferError returns the error of the transfer broken by err. The error is
+// errdefs.KindUnavailable unless err has the kind.
+func newBrokenTransferError(err error) *brokenTransferError {
+	if errdefs.KindOf(err) == errdefs.KindUnknown {
+		err = errdefs.WithKind(err, errdefs.KindUnavailable)
+	}
+	return &brokenTransferError{err}
+}
+
+func (e *brokenTransferError) Error() string {
+	return fmt.Sprintf("transfer is broken: %v", e.err)
+}
+
+func (e *brokenTransferError) Unwrap() error {
+	return e.err
+}
+
+// transferReader records the error of reading the response to tell the broken transfer apart
+// from the failures of caching and verifying the chunks.
+type transferReader struct {
+	r   io.Reader
+	err error
+}
+
+func (tr *transferReader) Read(p []byte) (int, error) {
+	n, err := tr.r.Read(p)
+	if err != nil {
+		tr.err = err
+	}
+	return n, err
+}
+
+// fetchRegionsOnce issues a request of the regions and caches the chunks in the response.
+// The chunks fully received and verified are recorded to fetched so the transfer can be
+// resumed from the remaining ones if it's broken mid-stream.
+func (b *blob) fetchRegionsOnce(ctx context.Context, fr fetcher, req []region, allData map[region]io.Writer, fetched map[region]bool, opts *options) error {
+	mr, err := fr.fetch(ctx, req, true)
+	b.recordAccess(err)
 	if err != nil {
 		return err
 	}
@@ -347,37 +566,106 @@ func (b *blob) fetchRegions(allData map[region]io.Writer, fetched map[region]boo
 
 	// chunk and cache responsed data. Regions must be aligned by chunk size.
 	// TODO: Reorganize remoteData to make it be aligned by chunk size
+	class := fetchClassFromContext(ctx)
 	for {
 		reg, p, err := mr.Next()
 		if err == io.EOF {
 			break
 		} else if err != nil {
-			return fmt.Errorf("failed to read multipart resp: %w", err)
+			return newBrokenTransferError(fmt.Errorf("failed to read multipart resp: %w", err))
 		}
-		if err := b.walkChunks(reg, func(chunk region) (retErr error) {
-			if err := b.cacheChunkData(chunk, p, fr, allData, fetched, opts); err != nil {
-				return err
+		tr := &transferReader{r: b.getTuner().Reader(ctx, p, class == FetchClassPrefetch)}
+		var err2 error
+		if v, ok := b.verifyRegion(reg, opts); ok {
+			err2 = b.cacheVerifiedChunks(reg, tr, v, fr, allData, fetched, opts)
+		} else {
+			err2 = b.walkChunks(reg, func(chunk region) error {
+				return b.cacheChunkData(chunk, tr, fr, allData, fetched, opts)
+			})
+		}
+		if err2 != nil {
+			err2 = fmt.Errorf("failed to get chunks: %w", err2)
+			if tr.err != nil && !errors.Is(err2, ErrDigestMismatch) {
+				return newBrokenTransferError(err2)
 			}
-			return nil
-		}); err != nil {
-			return fmt.Errorf("failed to get chunks: %w", err)
+			return err2
 		}
 	}
+	return nil
+}
 
-	// Check all chunks are fetched
-	var unfetched []region
-	for c, b := range fetched {
-		if !b {
-			unfetched = append(unfetched, c)
+// verifyRegion returns the verifier of the region of the response if the contents are
+// verified.
+func (b *blob) verifyRegion(reg region, opts *options) (StreamVerifier, bool) {
+	rv := b.getRegionVerifier(opts)
+	if rv == nil {
+		return nil, false
+	}
+	return rv(reg.b, min(reg.e+1, b.size)-reg.b)
+}
+
+// cacheVerifiedChunks caches the chunks of the region read from r after the verifier
+// verifies them. Chunks not verified yet are kept on memory.
+func (b *blob) cacheVerifiedChunks(reg region, r io.Reader, v StreamVerifier, fr fetcher, allData map[region]io.Writer, fetched map[region]bool, opts *options) error {
+	type pendingChunk struct {
+		chunk region
+		p     []byte
+	}
+	var pending []pendingChunk
+	if err := b.walkChunks(reg, func(chunk region) error {
+		p := make([]byte, chunk.size())
+		if _, err := io.ReadFull(io.TeeReader(r, v), p); err != nil {
+			return fmt.Errorf("failed to read chunk (%d, %d): %w", chunk.b, chunk.e, err)
+		}
+		pending = append(pending, pendingChunk{chunk, p})
+		for len(pending) > 0 && pending[0].chunk.e < v.Verified() {
+			if err := b.cacheChunkData(pending[0].chunk, bytes.NewReader(pending[0].p), fr, allData, fetched, opts); err != nil {
+				return err
+			}
+			pending = pending[1:]
 		}
+		return nil
+	}); err != nil {
+		return err
 	}
-	if unfetched != nil {
-		return fmt.Errorf("failed to fetch region %v", unfetched)
+	if len(pending) > 0 {
+		return fmt.Errorf("chunks from %d aren't verified", pending[0].chunk.b)
 	}
-
 	return nil
 }
 
+// layerDigest returns the digest of the blob fetched by the fetcher or empty if unknown.
+func layerDigest(fr fetcher) digest.Digest {
+	switch f := fr.(type) {
+	case *httpFetcher:
+		return f.digest
+	case *hedgedFetcher:
+		return f.primary.digest
+	}
+	return ""
+}
+
+// fetcherHost returns the host the fetcher sends requests to (e.g. the CDN the registry
+// redirects to). An empty string is returned if the fetcher doesn't use HTTP.
+func fetcherHost(fr fetcher) string {
+	var hf *httpFetcher
+	switch f := fr.(type) {
+	case *httpFetcher:
+		hf = f
+	case *hedgedFetcher:
+		hf = f.primary
+	default:
+		return ""
+	}
+	hf.urlMu.Lock()
+	defer hf.urlMu.Unlock()
+	u, err := url.Parse(hf.url)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
+
 // fetchRange fetches all specified chunks from local cache and remote blob.
 func (b *blob) fetchRange(allData map[region]io.Writer, opts *options) error {
 	if len(allData) == 0 {
@@ -436,6 +724,62 @@ func (b *blob) copyFetchedChunks(reg region, allData map[region]io.Writer, opts
 
 // getFetcher safely gets the current fetcher
 // Fetcher can be suddenly updated so we take and use the snapshot of it for consistency.
+// getTuner returns the tuner of the params or nil if they aren't tuned at runtime.
+func (b *blob) getTuner() *tuning.Tuner {
+	if b.resolver == nil {
+		return nil
+	}
+	return b.resolver.tuner
+}
+
+// getHostLimiter returns the limiter of fetches to each host or nil if they aren't limited.
+func (b *blob) getHostLimiter() *hostLimiter {
+	if b.resolver == nil {
+		return nil
+	}
+	return b.resolver.hosts
+}
+
+// getScheduler returns the scheduler of fetches or nil if fetches aren't scheduled.
+func (b *blob) getScheduler() *fetchScheduler {
+	if b.resolver == nil {
+		return nil
+	}
+	return b.resolver.scheduler
+}
+
+// getMaxTransferResumes returns the max number of times a broken transfer is resumed.
+func (b *blob) getMaxTransferResumes() int {
+	if b.resolver == nil {
+		return 0
+	}
+	return b.resolver.blobConfig.MaxTransferResumes
+}
+
+func (b *blob) getPrefetchChunkSize() int64 {
+	if t := b.getTuner(); t != nil {
+		return t.Params().PrefetchChunkSize
+	}
+	return b.prefetchChunkSize
+}
+
+// SetRegionVerifier sets the verifier of the contents fetched from the remote used unless
+// WithRegionVerifier is specified.
+func (b *blob) SetRegionVerifier(v RegionVerifier) {
+	b.verifierMu.Lock()
+	b.verifier = v
+	b.verifierMu.Unlock()
+}
+
+func (b *blob) getRegionVerifier(opts *options) RegionVerifier {
+	if opts.verifier != nil {
+		return opts.verifier
+	}
+	b.verifierMu.Lock()
+	defer b.verifierMu.Unlock()
+	return b.verifier
+}
+
 func (b *blob) getFetcher() fetcher {
 	b.fetcherMu.Lock()
 	defer b.fetcherMu.Unlock()
@@ -24,21 +24,28 @@ package remote
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"mime"
 	"mime/multipart"
 	"net/http"
 	"net/textproto"
+	"reflect"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
+	"testing/iotest"
 	"time"
 
 	"github.com/containerd/stargz-snapshotter/cache"
+	"github.com/containerd/stargz-snapshotter/errdefs"
+	"github.com/containerd/stargz-snapshotter/fs/config"
+	digest "github.com/opencontainers/go-digest"
 )
 
 const (
@@ -277,6 +284,364 @@ func TestFailReadAt(t *testing.T) {
 	checkBrokenHeader(t, false) // with prohibiting multi range
 }
 
+func TestFetchTimeoutClass(t *testing.T) {
+	cfg := config.BlobConfig{
+		FetchTimeoutSec:         100,
+		MetadataFetchTimeoutSec: 200,
+		PrefetchFetchTimeoutSec: 300,
+	}
+	var deadline time.Time
+	contents := bytes.Repeat([]byte(sampleData1), 10)
+	tr := multiRoundTripper(t, contents)
+	b := makeTestBlob(t, int64(len(contents)), sampleChunkSize, defaultPrefetchChunkSize, func(req *http.Request) *http.Response {
+		deadline, _ = req.Context().Deadline()
+		return tr(req)
+	})
+	b.fetchTimeouts = newFetchTimeouts(cfg)
+
+	shortCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	tests := []struct {
+		name string
+		ctx  context.Context
+		want time.Duration
+	}{
+		{"default", context.Background(), 100 * time.Second},
+		{"read", WithFetchClass(context.Background(), FetchClassRead), 100 * time.Second},
+		{"metadata", WithFetchClass(context.Background(), FetchClassMetadata), 200 * time.Second},
+		{"prefetch", WithFetchClass(context.Background(), FetchClassPrefetch), 300 * time.Second},
+		{"caller_deadline", WithFetchClass(shortCtx, FetchClassPrefetch), 0},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Now()
+			p := make([]byte, sampleChunkSize)
+			if _, err := b.ReadAt(p, int64(i)*sampleChunkSize, WithContext(tt.ctx)); err != nil {
+				t.Fatalf("failed to read: %v", err)
+			}
+			if d, ok := tt.ctx.Deadline(); ok {
+				if !deadline.Equal(d) {
+					t.Errorf("deadline = %v; want the caller's deadline %v", deadline, d)
+				}
+			} else if deadline.Before(start.Add(tt.want)) || deadline.After(time.Now().Add(tt.want)) {
+				t.Errorf("timeout = %v; want %v", deadline.Sub(start), tt.want)
+			}
+		})
+	}
+}
+
+func TestRegistryOutage(t *testing.T) {
+	var (
+		failing = true
+		tr      = multiRoundTripper(t, []byte(sampleData1))
+		fn      = RoundTripFunc(func(req *http.Request) *http.Response {
+			if failing {
+				return failRoundTripper()(req)
+			}
+			return tr(req)
+		})
+		r        = makeTestBlob(t, int64(len(sampleData1)), sampleChunkSize, defaultPrefetchChunkSize, fn)
+		respData = make([]byte, sampleChunkSize)
+	)
+	r.outageThreshold = time.Nanosecond
+	r.outageProbeInterval = time.Hour
+	type outage struct {
+		dgst        digest.Digest
+		unavailable bool
+		failed      bool
+	}
+	var outages []outage
+	r.fetcher.(*httpFetcher).digest = digest.FromString(sampleData1)
+	r.resolver.SetOutageHandler(func(dgst digest.Digest, unavailable bool, since time.Time, err error) {
+		if since.IsZero() {
+			t.Errorf("start of the outage must be reported")
+		}
+		outages = append(outages, outage{dgst, unavailable, err != nil})
+	})
+
+	// Cache the first chunk before the outage.
+	failing = false
+	if _, err := r.ReadAt(respData, 0); err != nil {
+		t.Fatalf("failed to read the first chunk: %v", err)
+	}
+
+	// Registry continues failing longer than the threshold.
+	failing = true
+	for range 2 {
+		if _, err := r.ReadAt(respData, sampleChunkSize); err == nil {
+			t.Fatalf("must be fail during registry outage")
+		}
+	}
+	if r.Available() {
+		t.Fatalf("blob must be unavailable during registry outage")
+	}
+	if _, err := r.ReadAt(respData, sampleChunkSize); !errors.Is(err, ErrRegistryUnavailable) {
+		t.Fatalf("uncached read must fail with ErrRegistryUnavailable but err=%v", err)
+	}
+	if _, err := r.ReadAt(respData, 0); err != nil {
+		t.Fatalf("cached read must succeed during outage: %v", err)
+	}
+
+	// Registry recovers. The next probe succeeds and the blob becomes available again.
+	failing = false
+	r.outageProbeInterval = 0
+	if _, err := r.ReadAt(respData, sampleChunkSize); err != nil {
+		t.Fatalf("read must succeed after recovery: %v", err)
+	}
+	if !r.Available() {
+		t.Fatalf("blob must be available after recovery")
+	}
+
+	// The handler is notified once for each change of the availability.
+	wantOutages := []outage{
+		{digest.FromString(sampleData1), true, true},
+		{digest.FromString(sampleData1), false, false},
+	}
+	if !reflect.DeepEqual(outages, wantOutages) {
+		t.Errorf("outages = %+v; want %+v", outages, wantOutages)
+	}
+}
+
+// sampleRegionVerifier returns a RegionVerifier checking sampleData1 in spans across the chunks.
+func sampleRegionVerifier() RegionVerifier {
+	var spans []Span
+	for _, s := range [][2]int64{{1, 4}, {5, 3}, {8, 2}} {
+		want := sampleData1[s[0] : s[0]+s[1]]
+		spans = append(spans, Span{Offset: s[0], Size: s[1], Verify: func(p []byte) error {
+			if string(p) != want {
+				return fmt.Errorf("got %q; want %q", p, want)
+			}
+			return nil
+		}})
+	}
+	return func(offset, size int64) (StreamVerifier, bool) {
+		var in []Span
+		for _, s := range spans {
+			if s.Offset >= offset && s.Offset+s.Size <= offset+size {
+				in = append(in, s)
+			}
+		}
+		return NewSpanVerifier(offset, in), true
+	}
+}
+
+func TestDigestMismatch(t *testing.T) {
+	verifier := sampleRegionVerifier()
+	cached := func(r *blob, b, e int64) bool {
+		cr, err := r.cache.Get(r.fetcher.genID(region{b, e}))
+		if err != nil {
+			return false
+		}
+		cr.Close()
+		return true
+	}
+	broken := []byte(sampleData1)
+	broken[6] = 'x' // the second span is broken
+	for _, allowMulti := range []bool{true, false} {
+		for _, setToBlob := range []bool{true, false} {
+			r := makeTestBlob(t, int64(len(sampleData1)), sampleChunkSize, defaultPrefetchChunkSize, multiRoundTripper(t, broken, allowMultiRange(allowMulti)))
+			var opts []Option
+			if setToBlob {
+				r.SetRegionVerifier(verifier)
+			} else {
+				opts = append(opts, WithRegionVerifier(verifier))
+			}
+			respData := make([]byte, len(sampleData1))
+			if _, err := r.ReadAt(respData, 0, opts...); !errors.Is(err, ErrDigestMismatch) {
+				t.Errorf("must fail with ErrDigestMismatch but err=%v (allowMultiRange=%v)", err, allowMulti)
+			}
+			// Chunks containing the broken span aren't cached.
+			if cached(r, 3, 5) || cached(r, 6, 8) {
+				t.Errorf("broken chunks must not be cached (allowMultiRange=%v)", allowMulti)
+			}
+			if allowMulti {
+				// The first chunk is verified by the first span before the broken one and
+				// the fetch is aborted before the last chunk.
+				if !cached(r, 0, 2) || cached(r, 9, 9) {
+					t.Errorf("only chunks verified before the broken span must be cached")
+				}
+			}
+		}
+
+		// Contents are cached after they are verified.
+		r := makeTestBlob(t, int64(len(sampleData1)), sampleChunkSize, defaultPrefetchChunkSize, multiRoundTripper(t, []byte(sampleData1), allowMultiRange(allowMulti)))
+		r.SetRegionVerifier(verifier)
+		respData := make([]byte, len(sampleData1))
+		if _, err := r.ReadAt(respData, 0); err != nil {
+			t.Fatalf("failed to read verified contents: %v (allowMultiRange=%v)", err, allowMulti)
+		}
+		if string(respData) != sampleData1 {
+			t.Errorf("read %q; want %q", respData, sampleData1)
+		}
+		for _, c := range []region{{0, 2}, {3, 5}, {6, 8}, {9, 9}} {
+			if !cached(r, c.b, c.e) {
+				t.Errorf("chunk %v must be cached (allowMultiRange=%v)", c, allowMulti)
+			}
+		}
+	}
+
+	// Registry serves a blob different from the one we want.
+	tr := multiRoundTripper(t, []byte(sampleData1))
+	for _, tt := range []struct {
+		header  string
+		wantErr bool
+	}{
+		{header: digest.FromString(sampleData1).String()},
+		{header: ""},
+		{header: digest.FromString("foo").String(), wantErr: true},
+	} {
+		r := makeTestBlob(t, int64(len(sampleData1)), sampleChunkSize, defaultPrefetchChunkSize, func(req *http.Request) *http.Response {
+			res := tr(req)
+			if tt.header != "" {
+				res.Header.Set("Docker-Content-Digest", tt.header)
+			}
+			return res
+		})
+		r.fetcher.(*httpFetcher).digest = digest.FromString(sampleData1)
+		respData := make([]byte, len(sampleData1))
+		_, err := r.ReadAt(respData, 0)
+		if tt.wantErr && !errors.Is(err, ErrDigestMismatch) {
+			t.Errorf("must fail with ErrDigestMismatch for %q but err=%v", tt.header, err)
+		} else if !tt.wantErr && err != nil {
+			t.Errorf("failed to read with %q: %v", tt.header, err)
+		}
+	}
+}
+
+func TestResumeBrokenTransfer(t *testing.T) {
+	const breakAt = 5 // in the middle of the second chunk
+	for _, tt := range []struct {
+		name         string
+		maxResumes   int
+		breaks       int
+		breakErr     error
+		wantRequests int
+		wantErr      bool
+	}{
+		{name: "resumed", maxResumes: 1, breaks: 1, wantRequests: 2},
+		{name: "not_retryable", maxResumes: 1, breaks: 1, breakErr: fmt.Errorf("denied: %w", errdefs.ErrUnauthorized), wantRequests: 1, wantErr: true},
+		{name: "disabled", maxResumes: -1, breaks: 1, wantRequests: 1, wantErr: true},
+		{name: "too_many_breaks", maxResumes: 2, breaks: 10, wantRequests: 3, wantErr: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				ranges []string
+				mu     sync.Mutex
+			)
+			breakBody := func(r io.ReadCloser) io.ReadCloser {
+				mu.Lock()
+				defer mu.Unlock()
+				if len(ranges) > tt.breaks {
+					return r
+				}
+				breakErr := tt.breakErr
+				if breakErr == nil {
+					breakErr = errors.New("connection reset")
+				}
+				return io.NopCloser(io.MultiReader(io.LimitReader(r, breakAt), iotest.ErrReader(breakErr)))
+			}
+			tr := multiRoundTripper(t, []byte(sampleData1), bodyConverter(breakBody))
+			r := makeTestBlob(t, int64(len(sampleData1)), sampleChunkSize, defaultPrefetchChunkSize, func(req *http.Request) *http.Response {
+				mu.Lock()
+				ranges = append(ranges, req.Header.Get("Range"))
+				mu.Unlock()
+				return tr(req)
+			})
+			r.resolver = &Resolver{blobConfig: config.BlobConfig{MaxTransferResumes: tt.maxResumes}}
+			respData := make([]byte, len(sampleData1))
+			_, err := r.ReadAt(respData, 0)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("must fail")
+				}
+			} else if err != nil {
+				t.Errorf("failed to read: %v", err)
+			} else if string(respData) != sampleData1 {
+				t.Errorf("read %q; want %q", string(respData), sampleData1)
+			}
+			if len(ranges) != tt.wantRequests {
+				t.Fatalf("%d requests issued; want %d: %v", len(ranges), tt.wantRequests, ranges)
+			}
+			// The chunk received before the break isn't fetched again.
+			for _, rng := range ranges[1:] {
+				for _, part := range strings.Split(strings.TrimPrefix(rng, rangeHeaderPrefix), ",") {
+					if begin, _ := parseRangeString(t, part); begin < sampleChunkSize {
+						t.Errorf("first chunk is fetched again: %q", rng)
+					}
+				}
+			}
+			if _, err := r.cache.Get(r.fetcher.genID(region{0, sampleChunkSize - 1})); err != nil {
+				t.Errorf("chunk received before the break must be cached: %v", err)
+			}
+			// Chunks broken in the middle aren't cached partially.
+			for b := int64(0); b < int64(len(sampleData1)); b += sampleChunkSize {
+				e := b + sampleChunkSize - 1
+				if e >= int64(len(sampleData1)) {
+					e = int64(len(sampleData1)) - 1
+				}
+				cr, err := r.cache.Get(r.fetcher.genID(region{b, e}))
+				if err != nil {
+					if !tt.wantErr {
+						t.Errorf("chunk (%d, %d) must be cached: %v", b, e, err)
+					}
+					continue
+				}
+				got := make([]byte, e-b+1)
+				n, err := cr.ReadAt(got, 0)
+				cr.Close()
+				if (err != nil && err != io.EOF) || string(got[:n]) != sampleData1[b:e+1] {
+					t.Errorf("chunk (%d, %d) is cached as %q; want %q: %v", b, e, string(got[:n]), sampleData1[b:e+1], err)
+				}
+			}
+			if tt.maxResumes < 0 {
+				b := floor(breakAt, sampleChunkSize)
+				if _, err := r.cache.Get(r.fetcher.genID(region{b, b + sampleChunkSize - 1})); err == nil {
+					t.Errorf("chunk broken in the middle must not be cached")
+				}
+			}
+		})
+	}
+}
+
+func TestResumeFromVerifiedChunk(t *testing.T) {
+	// The transfer is broken after the second chunk is received but before the span
+	// overlapping it is verified.
+	const breakAt = 2 * sampleChunkSize
+	var (
+		ranges []string
+		mu     sync.Mutex
+	)
+	breakBody := func(r io.ReadCloser) io.ReadCloser {
+		mu.Lock()
+		defer mu.Unlock()
+		if len(ranges) > 1 {
+			return r
+		}
+		return io.NopCloser(io.MultiReader(io.LimitReader(r, breakAt), iotest.ErrReader(errors.New("connection reset"))))
+	}
+	tr := multiRoundTripper(t, []byte(sampleData1), bodyConverter(breakBody))
+	r := makeTestBlob(t, int64(len(sampleData1)), sampleChunkSize, defaultPrefetchChunkSize, func(req *http.Request) *http.Response {
+		mu.Lock()
+		ranges = append(ranges, req.Header.Get("Range"))
+		mu.Unlock()
+		return tr(req)
+	})
+	r.resolver = &Resolver{blobConfig: config.BlobConfig{MaxTransferResumes: 1}}
+	r.SetRegionVerifier(sampleRegionVerifier())
+	respData := make([]byte, len(sampleData1))
+	if _, err := r.ReadAt(respData, 0); err != nil {
+		t.Fatalf("failed to read: %v", err)
+	} else if string(respData) != sampleData1 {
+		t.Errorf("read %q; want %q", string(respData), sampleData1)
+	}
+	// The first chunk is verified before the break but the second one isn't, so the
+	// transfer is resumed from the second chunk.
+	want := []string{rangeHeaderPrefix + "0-9", rangeHeaderPrefix + "3-9"}
+	if !reflect.DeepEqual(ranges, want) {
+		t.Errorf("requested ranges %v; want %v", ranges, want)
+	}
+}
+
 func checkBrokenBody(t *testing.T, allowMultiRange bool) {
 	respData := make([]byte, len(sampleData1))
 	r := makeTestBlob(t, int64(len(sampleData1)), sampleChunkSize, defaultPrefetchChunkSize, brokenBodyRoundTripper(t, []byte(sampleData1), allowMultiRange))
@@ -576,7 +941,9 @@ func makeTestBlob(t *testing.T, size int64, chunkSize int64, prefetchChunkSize i
 		lastCheck,
 		checkInterval,
 		&Resolver{},
-		time.Duration(defaultFetchTimeoutSec)*time.Second)
+		newFetchTimeouts(config.BlobConfig{FetchTimeoutSec: defaultFetchTimeoutSec}),
+		0,
+		time.Duration(defaultOutageProbeIntervalSec)*time.Second)
 }
 
 func TestCheckInterval(t *testing.T) {
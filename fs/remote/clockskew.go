@@ -0,0 +1,146 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package remote
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	commonmetrics "github.com/containerd/stargz-snapshotter/fs/metrics/common"
+)
+
+const (
+	// minClockSkew is the smallest skew taken into account. Date headers have the resolution
+	// of a second so smaller skews can't be told from the latency.
+	minClockSkew = 2 * time.Second
+
+	// tokenRefreshMargin is how long before the expiry in the clock of the registry bearer
+	// tokens are refreshed, so tokens don't expire while requests are in flight.
+	tokenRefreshMargin = 10 * time.Second
+)
+
+// clockSkews tracks the clock skew of registry hosts against this node, estimated from the
+// Date headers of their responses. Skewed nodes would otherwise keep sending bearer tokens
+// that the registry considers expired.
+type clockSkews struct {
+	mu    sync.Mutex
+	skews map[string]time.Duration // host -> clock of the host minus clock of this node
+}
+
+func newClockSkews() *clockSkews {
+	return &clockSkews{skews: make(map[string]time.Duration)}
+}
+
+// observe updates the skew of the host of the request with the Date header of the response.
+// sent and received are the times the request was sent and the response was received.
+func (s *clockSkews) observe(resp *http.Response, sent, received time.Time) {
+	if s == nil || resp.Request == nil {
+		return
+	}
+	date, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		return
+	}
+	// The header is truncated to the second and generated between sent and received.
+	skew := date.Add(time.Second / 2).Sub(sent.Add(received.Sub(sent) / 2))
+	if skew.Abs() < minClockSkew+received.Sub(sent) {
+		skew = 0
+	}
+	host := resp.Request.URL.Host
+	s.mu.Lock()
+	prev, ok := s.skews[host]
+	s.skews[host] = skew
+	s.mu.Unlock()
+	if !ok || prev != skew {
+		commonmetrics.SetClockSkew(host, skew)
+	}
+}
+
+// now returns the current time in the clock of the host.
+func (s *clockSkews) now(host string) time.Time {
+	now := time.Now()
+	if s == nil {
+		return now
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return now.Add(s.skews[host])
+}
+
+// local converts the time in the clock of the host to the clock of this node.
+func (s *clockSkews) local(host string, t time.Time) time.Time {
+	if s == nil {
+		return t
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return t.Add(-s.skews[host])
+}
+
+// bearerTokenExpiry returns the expiry recorded in the bearer token of the Authorization
+// header. ok is false unless the token is a JWT with the "exp" claim.
+func bearerTokenExpiry(header http.Header) (_ time.Time, ok bool) {
+	scheme, token, found := strings.Cut(header.Get("Authorization"), " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") {
+		return time.Time{}, false
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}, false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return time.Time{}, false
+	}
+	var claims struct {
+		Exp *json.Number `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Exp == nil {
+		return time.Time{}, false
+	}
+	exp, err := claims.Exp.Float64()
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(exp), 0), true
+}
+
+// invalidTokenResponse returns the response that makes docker.Authorizer discard the cached
+// token of the request and fetch a new one with the bearer challenge. ok is false if the
+// challenge isn't a bearer one.
+func invalidTokenResponse(req *http.Request, challenge []string) (_ *http.Response, ok bool) {
+	header := http.Header{}
+	for _, c := range challenge {
+		if scheme, _, _ := strings.Cut(c, " "); strings.EqualFold(scheme, "Bearer") {
+			if !strings.Contains(c, "error=") {
+				c += `,error="invalid_token"`
+			}
+			ok = true
+		}
+		header.Add("WWW-Authenticate", c)
+	}
+	return &http.Response{
+		StatusCode: http.StatusUnauthorized,
+		Status:     http.StatusText(http.StatusUnauthorized),
+		Header:     header,
+		Request:    req,
+	}, ok
+}
@@ -0,0 +1,188 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package remote
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/v2/core/remotes/docker"
+)
+
+func TestClockSkewObserve(t *testing.T) {
+	tests := []struct {
+		name   string
+		offset time.Duration
+		want   time.Duration // 0 means no skew
+	}{
+		{name: "no-skew", offset: 0},
+		{name: "small", offset: time.Second},
+		{name: "ahead", offset: time.Hour, want: time.Hour},
+		{name: "behind", offset: -time.Hour, want: -time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newClockSkews()
+			req, _ := http.NewRequest("GET", "https://registry.example.com/v2/", nil)
+			now := time.Now()
+			s.observe(&http.Response{
+				Header:  http.Header{"Date": {now.Add(tt.offset).UTC().Format(http.TimeFormat)}},
+				Request: req,
+			}, now, now)
+			if got := s.now("registry.example.com").Sub(time.Now()); (got - tt.want).Abs() > time.Second {
+				t.Errorf("skew = %v; want %v", got, tt.want)
+			}
+			if got := s.now("other.example.com").Sub(time.Now()); got.Abs() > time.Second {
+				t.Errorf("skew of other host = %v; want 0", got)
+			}
+		})
+	}
+}
+
+func TestBearerTokenExpiry(t *testing.T) {
+	exp := time.Unix(1700000000, 0)
+	tests := []struct {
+		name   string
+		header string
+		want   time.Time
+		wantOK bool
+	}{
+		{name: "jwt", header: "Bearer " + testJWT(exp), want: exp, wantOK: true},
+		{name: "lowercase-scheme", header: "bearer " + testJWT(exp), want: exp, wantOK: true},
+		{name: "no-exp", header: "Bearer " + testJWTPayload(`{"sub":"foo"}`)},
+		{name: "opaque", header: "Bearer opaque-token"},
+		{name: "basic", header: "Basic dXNlcjpwYXNz"},
+		{name: "none"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := http.Header{}
+			if tt.header != "" {
+				h.Set("Authorization", tt.header)
+			}
+			got, ok := bearerTokenExpiry(h)
+			if ok != tt.wantOK || !got.Equal(tt.want) {
+				t.Errorf("expiry = %v, %v; want %v, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+// TestTransportClockSkew checks that tokens expired in the clock of the registry are
+// refreshed although docker.Authorizer caches tokens without expires_in forever.
+func TestTransportClockSkew(t *testing.T) {
+	reg := &skewedRegistry{offset: time.Hour, lifetime: time.Minute}
+	auth := docker.NewDockerAuthorizer(docker.WithAuthClient(&http.Client{Transport: reg}))
+	tr := &transport{inner: reg, auth: auth, scope: "repository:foo:pull", clocks: newClockSkews()}
+	get := func() {
+		t.Helper()
+		req, err := http.NewRequestWithContext(context.Background(), "GET", "https://registry.example.com/v2/foo/blobs/sha256:abc", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("failed to request: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("unexpected status %v", resp.Status)
+		}
+	}
+
+	get() // authorized with the first token
+	if reg.tokens != 1 {
+		t.Fatalf("issued %d tokens; want 1", reg.tokens)
+	}
+
+	// The token expires in the clock of the registry. The first 401 makes a new token.
+	reg.advance(65 * time.Second)
+	get()
+	if reg.tokens != 2 || reg.unauthorized != 2 {
+		t.Errorf("issued %d tokens with %d 401s; want 2 tokens with 2 401s", reg.tokens, reg.unauthorized)
+	}
+
+	// The token is refreshed before it expires in the clock of the registry.
+	reg.advance(52 * time.Second)
+	get() // the token expires within the margin in the updated skew
+	if reg.tokens != 2 {
+		t.Errorf("issued %d tokens before the skew is updated; want 2", reg.tokens)
+	}
+	get()
+	if reg.tokens != 3 || reg.unauthorized != 2 {
+		t.Errorf("issued %d tokens with %d 401s; want 3 tokens with 2 401s", reg.tokens, reg.unauthorized)
+	}
+}
+
+// skewedRegistry serves a registry and its token server whose clock is skewed by offset.
+// Tokens are JWTs expiring after lifetime without expires_in.
+type skewedRegistry struct {
+	mu           sync.Mutex
+	offset       time.Duration
+	lifetime     time.Duration
+	tokens       int
+	unauthorized int
+}
+
+func (r *skewedRegistry) advance(d time.Duration) {
+	r.mu.Lock()
+	r.offset += d
+	r.mu.Unlock()
+}
+
+func (r *skewedRegistry) RoundTrip(req *http.Request) (*http.Response, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now().Add(r.offset)
+	header := http.Header{"Date": {now.UTC().Format(http.TimeFormat)}}
+	respond := func(code int, body string) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: code,
+			Status:     http.StatusText(code),
+			Header:     header,
+			Body:       io.NopCloser(strings.NewReader(body)),
+			Request:    req,
+		}, nil
+	}
+	if req.URL.Host == "auth.example.com" {
+		r.tokens++
+		header.Set("Content-Type", "application/json")
+		return respond(http.StatusOK, fmt.Sprintf(`{"token":%q}`, testJWT(now.Add(r.lifetime))))
+	}
+	if exp, ok := bearerTokenExpiry(req.Header); !ok || !exp.After(now) {
+		r.unauthorized++
+		header.Set("WWW-Authenticate", `Bearer realm="https://auth.example.com/token",service="registry.example.com",scope="repository:foo:pull"`)
+		return respond(http.StatusUnauthorized, "")
+	}
+	return respond(http.StatusOK, "")
+}
+
+func testJWT(exp time.Time) string {
+	return testJWTPayload(fmt.Sprintf(`{"exp":%d}`, exp.Unix()))
+}
+
+func testJWTPayload(payload string) string {
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString([]byte(`{"alg":"none"}`)) + "." + enc.EncodeToString([]byte(payload)) + ".sig"
+}
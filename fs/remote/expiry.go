@@ -0,0 +1,165 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package remote
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	neturl "net/url"
+	"strconv"
+	"time"
+)
+
+// expiringFetcher is a fetcher whose access to the blob expires (e.g. pre-signed URLs the
+// registry redirects to and bearer tokens).
+type expiringFetcher interface {
+	// expiry returns when the access to the blob expires in the clock of this node. ok is
+	// false if the access doesn't expire or the expiry is unknown.
+	expiry() (exp time.Time, ok bool)
+
+	// renew renews the access to the blob. Bearer tokens expiring within margin are refreshed.
+	renew(ctx context.Context, margin time.Duration) error
+}
+
+// Expiry returns when the access to the blob expires (e.g. the pre-signed URL the registry
+// redirected to or the bearer token). ok is false if the access doesn't expire or the expiry
+// is unknown.
+func (b *blob) Expiry() (time.Time, bool) {
+	if ef, ok := b.getFetcher().(expiringFetcher); ok {
+		return ef.expiry()
+	}
+	return time.Time{}, false
+}
+
+// Renew renews the access to the blob if it expires within margin, so the next read doesn't
+// wait for the authorization and the redirection.
+func (b *blob) Renew(ctx context.Context, margin time.Duration) error {
+	if b.isClosed() {
+		return fmt.Errorf("blob is already closed")
+	}
+	ef, ok := b.getFetcher().(expiringFetcher)
+	if !ok {
+		return nil
+	}
+	b.renewMu.Lock()
+	defer b.renewMu.Unlock()
+	if exp, ok := ef.expiry(); !ok || time.Until(exp) > margin {
+		return nil // renewed by others
+	}
+	if err := ef.renew(ctx, margin); err != nil {
+		return err
+	}
+	b.lastCheckMu.Lock()
+	b.lastCheck = time.Now()
+	b.lastCheckMu.Unlock()
+	return nil
+}
+
+func (f *httpFetcher) expiry() (exp time.Time, ok bool) {
+	f.urlMu.Lock()
+	exp = f.urlExpiry
+	f.urlMu.Unlock()
+	if tr, isTr := f.tr.(*transport); isTr {
+		if tExp, tOk := tr.tokenExpiry(); tOk && (exp.IsZero() || tExp.Before(exp)) {
+			exp = tExp
+		}
+	}
+	return exp, !exp.IsZero()
+}
+
+func (f *httpFetcher) renew(ctx context.Context, margin time.Duration) error {
+	return f.refreshURL(withTokenRefreshMargin(ctx, margin))
+}
+
+type tokenRefreshMarginKey struct{}
+
+// withTokenRefreshMargin makes requests with the context refresh bearer tokens expiring
+// within margin in the clock of the registry.
+func withTokenRefreshMargin(ctx context.Context, margin time.Duration) context.Context {
+	return context.WithValue(ctx, tokenRefreshMarginKey{}, margin)
+}
+
+func tokenRefreshMarginFromContext(ctx context.Context) time.Duration {
+	if m, ok := ctx.Value(tokenRefreshMarginKey{}).(time.Duration); ok && m > tokenRefreshMargin {
+		return m
+	}
+	return tokenRefreshMargin
+}
+
+// urlExpiry returns the expiry of the pre-signed URL in the clock of this node. Zero is
+// returned if the URL isn't pre-signed.
+func urlExpiry(rawURL string, tr http.RoundTripper) time.Time {
+	exp, ok := presignedURLExpiry(rawURL)
+	if !ok {
+		return time.Time{}
+	}
+	if t, ok := tr.(*transport); ok {
+		if u, err := neturl.Parse(rawURL); err == nil {
+			exp = t.clocks.local(u.Host, exp)
+		}
+	}
+	return exp
+}
+
+// presignedURLExpiry returns the expiry recorded in the query of the pre-signed URL of an
+// object storage (e.g. Amazon S3, Google Cloud Storage, Azure Blob Storage and CloudFront).
+// The expiry is in the clock of the object storage. ok is false if the URL isn't pre-signed.
+func presignedURLExpiry(rawURL string) (_ time.Time, ok bool) {
+	u, err := neturl.Parse(rawURL)
+	if err != nil {
+		return time.Time{}, false
+	}
+	q := u.Query()
+
+	// Signature Version 4 of S3 and V4 signing of GCS
+	for _, prefix := range []string{"X-Amz-", "X-Goog-"} {
+		date, expires := q.Get(prefix+"Date"), q.Get(prefix+"Expires")
+		if date == "" || expires == "" {
+			continue
+		}
+		t, err := time.Parse("20060102T150405Z", date)
+		if err != nil {
+			return time.Time{}, false
+		}
+		sec, err := strconv.ParseInt(expires, 10, 64)
+		if err != nil {
+			return time.Time{}, false
+		}
+		return t.Add(time.Duration(sec) * time.Second), true
+	}
+
+	// Signature Version 2 of S3, V2 signing of GCS and CloudFront
+	if expires := q.Get("Expires"); expires != "" {
+		sec, err := strconv.ParseInt(expires, 10, 64)
+		if err != nil {
+			return time.Time{}, false
+		}
+		return time.Unix(sec, 0), true
+	}
+
+	// Shared access signature of Azure Blob Storage
+	if se := q.Get("se"); se != "" && q.Get("sig") != "" {
+		t, err := time.Parse(time.RFC3339, se)
+		if err != nil {
+			return time.Time{}, false
+		}
+		return t, true
+	}
+
+	return time.Time{}, false
+}
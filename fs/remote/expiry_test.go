@@ -0,0 +1,165 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package remote
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/v2/core/remotes/docker"
+)
+
+func TestPresignedURLExpiry(t *testing.T) {
+	tests := []struct {
+		name   string
+		url    string
+		want   time.Time
+		wantOK bool
+	}{
+		{
+			name:   "s3-v4",
+			url:    "https://bucket.s3.amazonaws.com/blob?X-Amz-Algorithm=AWS4-HMAC-SHA256&X-Amz-Date=20240102T030405Z&X-Amz-Expires=1200&X-Amz-Signature=abc",
+			want:   time.Date(2024, 1, 2, 3, 24, 5, 0, time.UTC),
+			wantOK: true,
+		},
+		{
+			name:   "gcs-v4",
+			url:    "https://storage.googleapis.com/bucket/blob?X-Goog-Date=20240102T030405Z&X-Goog-Expires=60&X-Goog-Signature=abc",
+			want:   time.Date(2024, 1, 2, 3, 5, 5, 0, time.UTC),
+			wantOK: true,
+		},
+		{
+			name:   "cloudfront",
+			url:    "https://d111111abcdef8.cloudfront.net/blob?Expires=1704164645&Signature=abc&Key-Pair-Id=K",
+			want:   time.Unix(1704164645, 0),
+			wantOK: true,
+		},
+		{
+			name:   "azure-sas",
+			url:    "https://account.blob.core.windows.net/c/blob?sv=2022-11-02&se=2024-01-02T03%3A04%3A05Z&sr=b&sp=r&sig=abc",
+			want:   time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+			wantOK: true,
+		},
+		{
+			name: "registry",
+			url:  "https://registry.example.com/v2/foo/blobs/sha256:abc",
+		},
+		{
+			name: "invalid-date",
+			url:  "https://bucket.s3.amazonaws.com/blob?X-Amz-Date=yesterday&X-Amz-Expires=1200",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := presignedURLExpiry(tt.url)
+			if ok != tt.wantOK || !got.Equal(tt.want) {
+				t.Errorf("got (%v, %v); want (%v, %v)", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+// TestRenewPresignedURL checks that the blob redirects again for a new pre-signed URL only
+// when the URL expires within the margin.
+func TestRenewPresignedURL(t *testing.T) {
+	const lifetime = 10 * time.Minute
+	var redirects int
+	tr := RoundTripFunc(func(req *http.Request) *http.Response {
+		header := http.Header{}
+		code := http.StatusPartialContent
+		if req.URL.Host == "registry.example.com" {
+			redirects++
+			date := time.Now().UTC().Format("20060102T150405Z")
+			header.Set("Location", fmt.Sprintf("https://bucket.example.com/blob?X-Amz-Date=%s&X-Amz-Expires=%d&n=%d",
+				date, int(lifetime.Seconds()), redirects))
+			code = http.StatusTemporaryRedirect
+		}
+		return &http.Response{StatusCode: code, Header: header, Body: io.NopCloser(strings.NewReader("")), Request: req}
+	})
+	blobURL := "https://registry.example.com/v2/foo/blobs/sha256:abc"
+	url, _, err := redirect(context.Background(), blobURL, tr, 0, nil)
+	if err != nil {
+		t.Fatalf("failed to redirect: %v", err)
+	}
+	b := &blob{fetcher: &httpFetcher{url: url, urlExpiry: urlExpiry(url, tr), tr: tr, blobURL: blobURL}}
+
+	exp, ok := b.Expiry()
+	if !ok || exp.Before(time.Now().Add(lifetime-time.Minute)) || exp.After(time.Now().Add(lifetime)) {
+		t.Fatalf("unexpected expiry (%v, %v); want about %v later", exp, ok, lifetime)
+	}
+	if err := b.Renew(context.Background(), time.Minute); err != nil {
+		t.Fatalf("failed to renew: %v", err)
+	}
+	if redirects != 1 {
+		t.Errorf("renewed the URL not expiring within the margin (%d redirects)", redirects)
+	}
+	if err := b.Renew(context.Background(), lifetime+time.Minute); err != nil {
+		t.Fatalf("failed to renew: %v", err)
+	}
+	if redirects != 2 {
+		t.Errorf("URL expiring within the margin must be renewed (%d redirects)", redirects)
+	}
+	if got := b.getFetcher().(*httpFetcher).url; !strings.HasSuffix(got, "n=2") {
+		t.Errorf("URL isn't updated: %q", got)
+	}
+}
+
+// TestRenewBearerToken checks that the bearer token expiring within the margin is refreshed
+// by the renewal.
+func TestRenewBearerToken(t *testing.T) {
+	reg := &skewedRegistry{lifetime: 5 * time.Minute}
+	auth := docker.NewDockerAuthorizer(docker.WithAuthClient(&http.Client{Transport: reg}))
+	tr := &transport{inner: reg, auth: auth, scope: "repository:foo:pull", clocks: newClockSkews()}
+	blobURL := "https://registry.example.com/v2/foo/blobs/sha256:abc"
+	b := &blob{fetcher: &httpFetcher{url: blobURL, tr: tr, blobURL: blobURL}}
+	if _, ok := b.Expiry(); ok {
+		t.Fatalf("expiry must be unknown before authorized")
+	}
+	if err := b.fetcher.check(); err != nil {
+		t.Fatalf("failed to check: %v", err)
+	}
+	if _, ok := b.Expiry(); !ok {
+		t.Fatalf("expiry of the token must be known")
+	}
+	exp := tr.tokenExp
+	if reg.tokens != 1 {
+		t.Fatalf("issued %d tokens; want 1", reg.tokens)
+	}
+
+	if err := b.Renew(context.Background(), time.Minute); err != nil {
+		t.Fatalf("failed to renew: %v", err)
+	}
+	if reg.tokens != 1 {
+		t.Errorf("token not expiring within the margin must not be refreshed (%d tokens)", reg.tokens)
+	}
+
+	reg.advance(2 * time.Second) // issue a token differing from the previous one
+	if err := b.Renew(context.Background(), 10*time.Minute); err != nil {
+		t.Fatalf("failed to renew: %v", err)
+	}
+	if reg.tokens != 2 || reg.unauthorized != 1 {
+		t.Errorf("issued %d tokens with %d 401s; want 2 tokens with 1 401", reg.tokens, reg.unauthorized)
+	}
+	if !tr.tokenExp.After(exp) {
+		t.Errorf("expiry of the token isn't extended: %v; previously %v", tr.tokenExp, exp)
+	}
+}
@@ -0,0 +1,150 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package remote
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	commonmetrics "github.com/containerd/stargz-snapshotter/fs/metrics/common"
+)
+
+// hedgedFetcher fetches regions from the primary host and, if the primary host doesn't
+// respond within delay, also from the secondary host (e.g. the next mirror). The first
+// successful response is used and the other request is canceled. The secondary host is
+// tried immediately if the primary host fails earlier.
+type hedgedFetcher struct {
+	primary   *httpFetcher
+	secondary *httpFetcher
+	delay     time.Duration
+}
+
+type hedgedResult struct {
+	mr        multipartReadCloser
+	err       error
+	secondary bool
+}
+
+func (f *hedgedFetcher) fetch(ctx context.Context, rs []region, retry bool) (multipartReadCloser, error) {
+	results := make(chan hedgedResult, 2)
+	var cancels [2]context.CancelFunc
+	start := func(fr *httpFetcher, secondary bool) {
+		// Each request has its own context so the body of the winner can be read after the
+		// other is canceled.
+		fctx, cancel := context.WithCancel(ctx)
+		cancels[boolIndex(secondary)] = cancel
+		go func() {
+			mr, err := fr.fetch(fctx, rs, retry)
+			results <- hedgedResult{mr, err, secondary}
+		}()
+	}
+	start(f.primary, false)
+	pending := 1
+
+	timer := time.NewTimer(f.delay)
+	defer timer.Stop()
+	hedge := timer.C
+	var errs []error
+	for {
+		select {
+		case <-hedge:
+			hedge = nil
+			commonmetrics.IncOperationCount(commonmetrics.HedgedFetchCount, f.primary.digest)
+			start(f.secondary, true)
+			pending++
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				if res.secondary {
+					commonmetrics.IncOperationCount(commonmetrics.HedgedFetchWinCount, f.primary.digest)
+				}
+				if pending > 0 {
+					cancels[boolIndex(!res.secondary)]()
+					go discardHedgedResult(results)
+				}
+				return &cancelReadCloser{res.mr, cancels[boolIndex(res.secondary)]}, nil
+			}
+			cancels[boolIndex(res.secondary)]()
+			errs = append(errs, res.err)
+			if hedge != nil {
+				// The primary host failed before the delay. Try the secondary now.
+				hedge = nil
+				start(f.secondary, true)
+				pending++
+			} else if pending == 0 {
+				return nil, errors.Join(errs...)
+			}
+		}
+	}
+}
+
+// discardHedgedResult closes the response of the canceled request if it has succeeded.
+func discardHedgedResult(results <-chan hedgedResult) {
+	if res := <-results; res.err == nil {
+		res.mr.Close()
+	}
+}
+
+func boolIndex(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// check succeeds if either host serves the blob.
+func (f *hedgedFetcher) check() error {
+	err := f.primary.check()
+	if err == nil {
+		return nil
+	}
+	if err2 := f.secondary.check(); err2 != nil {
+		return errors.Join(err, err2)
+	}
+	return nil
+}
+
+// genID returns the ID of the region on the primary host. Both hosts serve the same blob.
+func (f *hedgedFetcher) genID(reg region) string {
+	return f.primary.genID(reg)
+}
+
+// expiry returns the earlier expiry of the access to the hosts.
+func (f *hedgedFetcher) expiry() (exp time.Time, ok bool) {
+	exp, ok = f.primary.expiry()
+	if exp2, ok2 := f.secondary.expiry(); ok2 && (!ok || exp2.Before(exp)) {
+		exp, ok = exp2, true
+	}
+	return exp, ok
+}
+
+func (f *hedgedFetcher) renew(ctx context.Context, margin time.Duration) error {
+	return errors.Join(f.primary.renew(ctx, margin), f.secondary.renew(ctx, margin))
+}
+
+// cancelReadCloser cancels the context of the request when the response is closed.
+type cancelReadCloser struct {
+	multipartReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelReadCloser) Close() error {
+	err := c.multipartReadCloser.Close()
+	c.cancel()
+	return err
+}
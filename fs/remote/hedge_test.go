@@ -0,0 +1,150 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package remote
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// hostRoundTripper serves the body after the delay unless the request is canceled. It fails
+// if fail is true.
+type hostRoundTripper struct {
+	body     string
+	delay    time.Duration
+	fail     bool
+	calls    atomic.Int32
+	canceled atomic.Int32
+}
+
+func (h *hostRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	h.calls.Add(1)
+	select {
+	case <-time.After(h.delay):
+	case <-req.Context().Done():
+		h.canceled.Add(1)
+		return nil, req.Context().Err()
+	}
+	if h.fail {
+		return &http.Response{
+			StatusCode: http.StatusServiceUnavailable,
+			Header:     make(http.Header),
+			Body:       io.NopCloser(bytes.NewReader(nil)),
+		}, nil
+	}
+	header := make(http.Header)
+	header.Set("Content-Range", fmt.Sprintf("bytes 0-%d/%d", len(h.body)-1, len(h.body)))
+	header.Set("Content-Type", "application/octet-stream")
+	return &http.Response{
+		StatusCode: http.StatusPartialContent,
+		Header:     header,
+		Body:       io.NopCloser(bytes.NewReader([]byte(h.body))),
+	}, nil
+}
+
+func TestHedgedFetch(t *testing.T) {
+	const delay = 50 * time.Millisecond
+	tests := []struct {
+		name          string
+		primary       *hostRoundTripper
+		secondary     *hostRoundTripper
+		wantBody      string
+		wantSecondary bool // the secondary host is requested
+		wantCanceled  bool // the primary host is canceled
+		wantErr       bool
+	}{
+		{
+			name:      "primary_fast",
+			primary:   &hostRoundTripper{body: "primary"},
+			secondary: &hostRoundTripper{body: "secondary"},
+			wantBody:  "primary",
+		},
+		{
+			name:          "primary_slow",
+			primary:       &hostRoundTripper{body: "primary", delay: 10 * time.Second},
+			secondary:     &hostRoundTripper{body: "secondary"},
+			wantBody:      "secondary",
+			wantSecondary: true,
+			wantCanceled:  true,
+		},
+		{
+			name:          "primary_fails",
+			primary:       &hostRoundTripper{fail: true},
+			secondary:     &hostRoundTripper{body: "secondary", delay: delay / 5},
+			wantBody:      "secondary",
+			wantSecondary: true,
+		},
+		{
+			name:          "both_fail",
+			primary:       &hostRoundTripper{fail: true},
+			secondary:     &hostRoundTripper{fail: true},
+			wantSecondary: true,
+			wantErr:       true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &hedgedFetcher{
+				primary:   &httpFetcher{url: "https://primary/blob", tr: tt.primary},
+				secondary: &httpFetcher{url: "https://secondary/blob", tr: tt.secondary},
+				delay:     delay,
+			}
+			mr, err := f.fetch(context.Background(), []region{{0, 6}}, false)
+			if tt.wantErr {
+				if err == nil {
+					mr.Close()
+					t.Fatalf("fetch must fail")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to fetch: %v", err)
+			}
+			_, r, err := mr.Next()
+			if err != nil {
+				t.Fatalf("failed to get part: %v", err)
+			}
+			got, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatalf("failed to read part: %v", err)
+			}
+			mr.Close()
+			if string(got) != tt.wantBody {
+				t.Errorf("fetched %q; want %q", got, tt.wantBody)
+			}
+			if got := tt.secondary.calls.Load() > 0; got != tt.wantSecondary {
+				t.Errorf("secondary requested = %v; want %v", got, tt.wantSecondary)
+			}
+			if tt.wantCanceled {
+				// The canceled request is discarded in background.
+				deadline := time.Now().Add(5 * time.Second)
+				for tt.primary.canceled.Load() == 0 && time.Now().Before(deadline) {
+					time.Sleep(time.Millisecond)
+				}
+				if tt.primary.canceled.Load() == 0 {
+					t.Errorf("slow request must be canceled")
+				}
+			}
+		})
+	}
+}
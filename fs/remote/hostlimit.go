@@ -0,0 +1,289 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package remote
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/containerd/log"
+	commonmetrics "github.com/containerd/stargz-snapshotter/fs/metrics/common"
+)
+
+const (
+	defaultMaxHostConcurrency = 32
+
+	// initialHostConcurrency is the limit of a host not measured yet.
+	initialHostConcurrency = 4
+
+	// hostConcurrencyWindow is the minimum duration of the window in which the throughput of
+	// a host is measured.
+	hostConcurrencyWindow = time.Second
+
+	// hostConcurrencyGain is the ratio the throughput must improve by to raise the limit again.
+	hostConcurrencyGain = 1.1
+
+	// hostConcurrencyCollapse is the ratio to the best throughput below which the throughput
+	// is considered collapsed by too many requests.
+	hostConcurrencyCollapse = 0.7
+
+	// hostConcurrencyReprobe is how long the limit that collapsed the throughput isn't tried
+	// again.
+	hostConcurrencyReprobe = 5 * time.Minute
+)
+
+// hostLimiter limits the fetches in flight to each host (e.g. a registry or the CDN serving
+// the blobs) and adapts the limit to the throughput of the host. The limit is raised while
+// the throughput improves and lowered when the throughput collapses or fetches fail, so
+// hosts that slow down under parallel Range requests get fewer of them than the ones that
+// scale. Learned limits are optionally persisted so they survive restarts.
+type hostLimiter struct {
+	max int
+	now func() time.Time
+
+	mu    sync.Mutex
+	hosts map[string]*hostLimit
+
+	path   string // file the limits are persisted to. empty if not persisted.
+	saveMu sync.Mutex
+}
+
+// hostLimit is the state of the limit of a host.
+type hostLimit struct {
+	limit    int
+	inflight int
+	waiting  []chan struct{} // closed when the fetch can start
+
+	// The throughput is measured in windows of at least hostConcurrencyWindow and as many
+	// fetches as the limit. Windows where the limit isn't reached don't tell whether the
+	// host can serve more requests and are discarded.
+	start     time.Time // start of the window. zero if no window is running.
+	bytes     int64
+	fetches   int
+	saturated bool // the limit was reached in the window
+
+	best      float64 // best throughput (bytes/sec) measured since the last collapse
+	bestLimit int     // limit the best throughput was measured with
+
+	ceiling      int       // limit that collapsed the throughput. 0 if none.
+	ceilingUntil time.Time // time until the ceiling isn't tried again
+}
+
+// newHostLimiter returns a limiter allowing up to max fetches in flight to each host. nil
+// is returned if enable is false.
+func newHostLimiter(enable bool, max int) *hostLimiter {
+	if !enable {
+		return nil
+	}
+	if max <= 0 {
+		max = defaultMaxHostConcurrency
+	}
+	return &hostLimiter{max: max, now: time.Now, hosts: make(map[string]*hostLimit)}
+}
+
+// persist loads the limits learned previously from path and saves the limits to it when
+// they change.
+func (l *hostLimiter) persist(path string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.path = path
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var limits map[string]int
+	if err := json.Unmarshal(data, &limits); err != nil {
+		return fmt.Errorf("failed to parse %q: %w", path, err)
+	}
+	for host, n := range limits {
+		if _, ok := l.hosts[host]; !ok {
+			l.hosts[host] = &hostLimit{limit: min(max(n, 1), l.max)}
+			commonmetrics.SetHostFetchConcurrency(host, l.hosts[host].limit)
+		}
+	}
+	return nil
+}
+
+// acquire waits until a fetch from the host can start. The returned function must be
+// called with the bytes fetched and the result when the fetch is done.
+func (l *hostLimiter) acquire(ctx context.Context, host string) (release func(n int64, err error), _ error) {
+	if l == nil || host == "" {
+		return func(int64, error) {}, nil
+	}
+	l.mu.Lock()
+	h, ok := l.hosts[host]
+	if !ok {
+		h = &hostLimit{limit: min(initialHostConcurrency, l.max)}
+		l.hosts[host] = h
+		commonmetrics.SetHostFetchConcurrency(host, h.limit)
+	}
+	release = func(n int64, err error) { l.release(host, h, n, err) }
+	if h.start.IsZero() {
+		h.start = l.now()
+	}
+	if len(h.waiting) == 0 && h.inflight < h.limit {
+		h.inflight++
+		h.saturated = h.saturated || h.inflight >= h.limit
+		l.mu.Unlock()
+		return release, nil
+	}
+	h.saturated = true
+	ch := make(chan struct{})
+	h.waiting = append(h.waiting, ch)
+	l.mu.Unlock()
+
+	select {
+	case <-ch:
+		return release, nil
+	case <-ctx.Done():
+		l.mu.Lock()
+		for i, w := range h.waiting {
+			if w == ch {
+				h.waiting = append(h.waiting[:i], h.waiting[i+1:]...)
+				l.mu.Unlock()
+				return nil, ctx.Err()
+			}
+		}
+		l.mu.Unlock()
+		release(0, ctx.Err()) // dispatched while canceled
+		return nil, ctx.Err()
+	}
+}
+
+func (l *hostLimiter) release(host string, h *hostLimit, n int64, err error) {
+	l.mu.Lock()
+	h.inflight--
+	changed := l.adapt(h, n, err)
+	for len(h.waiting) > 0 && h.inflight < h.limit {
+		close(h.waiting[0])
+		h.waiting = h.waiting[1:]
+		h.inflight++
+	}
+	limit := h.limit
+	l.mu.Unlock()
+	if changed {
+		commonmetrics.SetHostFetchConcurrency(host, limit)
+		l.save()
+	}
+}
+
+// adapt updates the limit of the host with the result of a fetch. l.mu must be held. true
+// is returned if the limit is changed.
+func (l *hostLimiter) adapt(h *hostLimit, n int64, err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false // canceled by the caller
+	}
+	if err != nil {
+		// Failures (including timeouts) under parallel requests are a sign of overload.
+		prev := h.limit
+		h.limit = max(h.limit/2, 1)
+		h.resetWindow()
+		h.best, h.bestLimit = 0, 0
+		return h.limit != prev
+	}
+	h.bytes += n
+	h.fetches++
+	elapsed := l.now().Sub(h.start)
+	if elapsed < hostConcurrencyWindow || h.fetches < h.limit {
+		return false
+	}
+	saturated := h.saturated
+	tput := float64(h.bytes) / elapsed.Seconds()
+	h.resetWindow()
+	if !saturated {
+		return false
+	}
+	prev, now := h.limit, l.now()
+	if h.ceiling != 0 && now.After(h.ceilingUntil) {
+		// The host may scale better now. Measure again from this limit.
+		h.ceiling, h.best, h.bestLimit = 0, 0, 0
+	}
+	switch {
+	case tput >= h.best*hostConcurrencyGain:
+		// More requests improved the throughput. Try one more unless it collapsed recently.
+		h.best, h.bestLimit = tput, h.limit
+		if h.ceiling == 0 || h.limit+1 < h.ceiling {
+			h.limit = min(h.limit+1, l.max)
+		}
+	case tput < h.best*hostConcurrencyCollapse:
+		// The throughput collapsed. Go back below the limit and measure again.
+		h.ceiling, h.ceilingUntil = h.limit, now.Add(hostConcurrencyReprobe)
+		h.limit = max(min(h.bestLimit, h.limit-1), 1)
+		h.best, h.bestLimit = 0, 0
+	}
+	return h.limit != prev
+}
+
+func (h *hostLimit) resetWindow() {
+	h.start, h.bytes, h.fetches, h.saturated = time.Time{}, 0, 0, false
+}
+
+// limits returns the current limits of the hosts.
+func (l *hostLimiter) limits() map[string]int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	limits := make(map[string]int, len(l.hosts))
+	for host, h := range l.hosts {
+		limits[host] = h.limit
+	}
+	return limits
+}
+
+// save writes the limits to the file if they are persisted.
+func (l *hostLimiter) save() {
+	l.mu.Lock()
+	path := l.path
+	l.mu.Unlock()
+	if path == "" {
+		return
+	}
+	l.saveMu.Lock()
+	defer l.saveMu.Unlock()
+	limits := l.limits() // the latest limits are written by the last save
+	if err := writeHostLimits(path, limits); err != nil {
+		// Limits are learned again after restart.
+		log.L.WithError(err).Warnf("failed to save fetch concurrency of hosts to %q", path)
+	}
+}
+
+func writeHostLimits(path string, limits map[string]int) error {
+	data, err := json.Marshal(limits)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
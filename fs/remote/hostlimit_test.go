@@ -0,0 +1,164 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package remote
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testHost = "registry.example.com"
+
+// fakeClock is the clock of hostLimiter advanced by tests.
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) now() time.Time { return c.t }
+
+func newTestHostLimiter(max int) (*hostLimiter, *fakeClock) {
+	clock := &fakeClock{t: time.Unix(1700000000, 0)}
+	l := newHostLimiter(true, max)
+	l.now = clock.now
+	return l, clock
+}
+
+// runWindow runs as many fetches in parallel as the limit for a second against a host
+// whose total throughput with n requests in flight is tput(n).
+func runWindow(t *testing.T, l *hostLimiter, clock *fakeClock, tput func(n int) int64) {
+	t.Helper()
+	n := l.limits()[testHost]
+	if n == 0 {
+		n = initialHostConcurrency
+	}
+	var releases []func(int64, error)
+	for range n {
+		release, err := l.acquire(context.Background(), testHost)
+		if err != nil {
+			t.Fatalf("failed to acquire: %v", err)
+		}
+		releases = append(releases, release)
+	}
+	clock.t = clock.t.Add(time.Second)
+	for _, release := range releases {
+		release(tput(n)/int64(n), nil)
+	}
+}
+
+func TestHostLimiterAdapts(t *testing.T) {
+	l, clock := newTestHostLimiter(0)
+	// The throughput scales up to 6 requests and collapses beyond.
+	tput := func(n int) int64 {
+		if n > 6 {
+			return 200
+		}
+		return int64(n) * 100
+	}
+	var limits []int
+	for range 7 {
+		runWindow(t, l, clock, tput)
+		limits = append(limits, l.limits()[testHost])
+	}
+	want := []int{5, 6, 7, 6, 6, 6, 6} // 7 collapsed the throughput and isn't tried again
+	for i := range want {
+		if limits[i] != want[i] {
+			t.Fatalf("limits = %v; want %v", limits, want)
+		}
+	}
+
+	// The collapsed limit is tried again later.
+	clock.t = clock.t.Add(hostConcurrencyReprobe)
+	runWindow(t, l, clock, tput)
+	if got := l.limits()[testHost]; got != 7 {
+		t.Errorf("limit after the reprobe interval = %d; want 7", got)
+	}
+
+	// Failures halve the limit.
+	release, err := l.acquire(context.Background(), testHost)
+	if err != nil {
+		t.Fatalf("failed to acquire: %v", err)
+	}
+	release(0, errors.New("connection reset"))
+	if got := l.limits()[testHost]; got != 3 {
+		t.Errorf("limit after failure = %d; want 3", got)
+	}
+}
+
+func TestHostLimiterLimitsInflight(t *testing.T) {
+	l, _ := newTestHostLimiter(0)
+	var releases []func(int64, error)
+	for range initialHostConcurrency {
+		release, err := l.acquire(context.Background(), testHost)
+		if err != nil {
+			t.Fatalf("failed to acquire: %v", err)
+		}
+		releases = append(releases, release)
+	}
+	// Other hosts aren't limited by this host.
+	if release, err := l.acquire(context.Background(), "other.example.com"); err != nil {
+		t.Fatalf("failed to acquire other host: %v", err)
+	} else {
+		release(0, context.Canceled)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := l.acquire(ctx, testHost); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("fetch beyond the limit must wait: %v", err)
+	}
+	started := make(chan struct{})
+	go func() {
+		release, err := l.acquire(context.Background(), testHost)
+		if err == nil {
+			release(0, context.Canceled)
+		}
+		close(started)
+	}()
+	releases[0](0, context.Canceled)
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("waiting fetch must start after release")
+	}
+}
+
+func TestHostLimiterPersist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "host-concurrency.json")
+	l, clock := newTestHostLimiter(0)
+	if err := l.persist(path); err != nil {
+		t.Fatalf("failed to load: %v", err)
+	}
+	runWindow(t, l, clock, func(n int) int64 { return int64(n) * 100 })
+	runWindow(t, l, clock, func(n int) int64 { return int64(n) * 100 })
+
+	restarted, _ := newTestHostLimiter(0)
+	if err := restarted.persist(path); err != nil {
+		t.Fatalf("failed to load: %v", err)
+	}
+	if got := restarted.limits()[testHost]; got != initialHostConcurrency+2 {
+		t.Errorf("limit loaded after restart = %d; want %d", got, initialHostConcurrency+2)
+	}
+
+	// The limit is bounded by the max of the restarted limiter.
+	bounded, _ := newTestHostLimiter(5)
+	if err := bounded.persist(path); err != nil {
+		t.Fatalf("failed to load: %v", err)
+	}
+	if got := bounded.limits()[testHost]; got != 5 {
+		t.Errorf("limit loaded with max 5 = %d", got)
+	}
+}
@@ -0,0 +1,381 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package objectstorage provides a remote.Handler that serves eStargz layers stored in
+// object storages (Amazon S3 and Google Cloud Storage) from URLs of the layer descriptor.
+// This enables to lazily mount layers in registry-less pipelines.
+//
+// The following URL schemes are supported.
+//
+//   - s3://<bucket>/<key> : Amazon S3 and S3-compatible object storages
+//   - gs://<bucket>/<object> : Google Cloud Storage
+package objectstorage
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/containerd/log"
+	"github.com/containerd/stargz-snapshotter/fs/remote"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	defaultS3Region    = "us-east-1"
+	defaultGCSEndpoint = "https://storage.googleapis.com"
+
+	// s3CredentialHost is the host used for querying the credential of AWS S3 to the keychain.
+	s3CredentialHost = "s3.amazonaws.com"
+
+	checkTimeout = 30 * time.Second
+
+	// emptyPayloadHash is the SHA256 of the empty request body.
+	emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// Credential returns the credential of the object storage specified by the host.
+// For S3, username is the access key ID and secret is the secret access key.
+// For GCS, secret is the OAuth2 access token and username is ignored.
+// Empty username and secret mean anonymous access.
+type Credential func(host string) (username, secret string, err error)
+
+// S3Credential returns the credential of S3 specified by the host. sessionToken is the session
+// token of temporary security credentials (e.g. of AWS STS) and is empty for long-term ones.
+// Empty accessKey and secretKey mean no credential is provided.
+type S3Credential func(host string) (accessKey, secretKey, sessionToken string, err error)
+
+// EnvS3Credential is a S3Credential that provides the credential specified by the environment
+// variables AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN.
+func EnvS3Credential(host string) (accessKey, secretKey, sessionToken string, err error) {
+	return os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"), os.Getenv("AWS_SESSION_TOKEN"), nil
+}
+
+// Config is the configuration of the object storage handler.
+type Config struct {
+	// S3Region is the region of S3 buckets. Defaults to "us-east-1".
+	S3Region string
+
+	// S3Endpoint is the endpoint URL of S3-compatible object storage (e.g. "https://minio.example.com:9000").
+	// Path-style URLs are used with this endpoint. If empty, AWS S3 is used with virtual-hosted style URLs.
+	S3Endpoint string
+
+	// GCSEndpoint is the endpoint URL of Google Cloud Storage. Defaults to "https://storage.googleapis.com".
+	GCSEndpoint string
+
+	// S3Credential optionally provides the credential of S3 including the session token. It's
+	// queried before the credentials passed to NewResolveHandler.
+	S3Credential S3Credential
+}
+
+// NewResolveHandler returns a handler that serves layers from object storages.
+// Credentials are queried to creds by the host of the endpoint ("s3.amazonaws.com" for AWS S3 and
+// "storage.googleapis.com" for GCS).
+func NewResolveHandler(cfg Config, creds ...Credential) *ResolveHandler {
+	if cfg.S3Region == "" {
+		cfg.S3Region = defaultS3Region
+	}
+	if cfg.GCSEndpoint == "" {
+		cfg.GCSEndpoint = defaultGCSEndpoint
+	}
+	return &ResolveHandler{
+		cfg:    cfg,
+		creds:  creds,
+		client: &http.Client{Transport: http.DefaultTransport.(*http.Transport).Clone()},
+	}
+}
+
+// ResolveHandler is a remote.Handler that serves layers from object storages.
+type ResolveHandler struct {
+	cfg    Config
+	creds  []Credential
+	client *http.Client
+}
+
+// Handle returns a fetcher of the first available object storage URL in the URLs of the descriptor.
+func (h *ResolveHandler) Handle(ctx context.Context, desc ocispec.Descriptor) (remote.Fetcher, int64, error) {
+	var errs []error
+	for _, u := range desc.URLs {
+		f, err := h.newFetcher(u)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if f == nil {
+			continue // not an object storage URL
+		}
+		size, err := f.getSize(ctx)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to get size of %q: %w", u, err))
+			continue
+		}
+		if desc.Size > 0 && desc.Size != size {
+			errs = append(errs, fmt.Errorf("size of %q mismatch: %d(object) != %d(descriptor)", u, size, desc.Size))
+			continue
+		}
+		log.G(ctx).WithField("url", u).WithField("digest", desc.Digest).Debugf("contents is provided by object storage")
+		return f, size, nil
+	}
+	if len(errs) == 0 {
+		return nil, 0, fmt.Errorf("no object storage URL for %v", desc.Digest)
+	}
+	return nil, 0, errors.Join(errs...)
+}
+
+func (h *ResolveHandler) newFetcher(rawURL string) (*fetcher, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "s3" && u.Scheme != "gs" {
+		return nil, nil
+	}
+	bucket, key := u.Host, strings.TrimPrefix(u.Path, "/")
+	if bucket == "" || key == "" {
+		return nil, fmt.Errorf("invalid object storage URL %q: bucket and object must be specified", rawURL)
+	}
+	f := &fetcher{url: rawURL, client: h.client}
+	switch u.Scheme {
+	case "s3":
+		endpoint := h.cfg.S3Endpoint
+		credHost := s3CredentialHost
+		if endpoint == "" {
+			// virtual-hosted style
+			f.objectURL = fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", bucket, h.cfg.S3Region, uriEncode(key))
+		} else {
+			// path style
+			eu, err := url.Parse(endpoint)
+			if err != nil {
+				return nil, fmt.Errorf("invalid S3 endpoint %q: %w", endpoint, err)
+			}
+			credHost = eu.Host
+			f.objectURL = fmt.Sprintf("%s/%s/%s", strings.TrimSuffix(endpoint, "/"), bucket, uriEncode(key))
+		}
+		region := h.cfg.S3Region
+		f.authorize = func(req *http.Request) error {
+			accessKey, secretKey, sessionToken, err := h.s3Credential(credHost)
+			if err != nil || (accessKey == "" && secretKey == "") {
+				return err
+			}
+			signV4(req, accessKey, secretKey, sessionToken, region, time.Now())
+			return nil
+		}
+	case "gs":
+		eu, err := url.Parse(h.cfg.GCSEndpoint)
+		if err != nil {
+			return nil, fmt.Errorf("invalid GCS endpoint %q: %w", h.cfg.GCSEndpoint, err)
+		}
+		f.objectURL = fmt.Sprintf("%s/%s/%s", strings.TrimSuffix(h.cfg.GCSEndpoint, "/"), bucket, uriEncode(key))
+		f.authorize = func(req *http.Request) error {
+			_, token, err := h.credential(eu.Host)
+			if err != nil || token == "" {
+				return err
+			}
+			req.Header.Set("Authorization", "Bearer "+token)
+			return nil
+		}
+	}
+	return f, nil
+}
+
+func (h *ResolveHandler) s3Credential(host string) (string, string, string, error) {
+	if h.cfg.S3Credential != nil {
+		if accessKey, secretKey, sessionToken, err := h.cfg.S3Credential(host); err != nil {
+			return "", "", "", err
+		} else if accessKey != "" || secretKey != "" {
+			return accessKey, secretKey, sessionToken, nil
+		}
+	}
+	accessKey, secretKey, err := h.credential(host)
+	return accessKey, secretKey, "", err
+}
+
+func (h *ResolveHandler) credential(host string) (string, string, error) {
+	for _, f := range h.creds {
+		if username, secret, err := f(host); err != nil {
+			return "", "", err
+		} else if username != "" || secret != "" {
+			return username, secret, nil
+		}
+	}
+	return "", "", nil
+}
+
+type fetcher struct {
+	url       string // original URL of the layer (s3:// or gs://)
+	objectURL string // HTTP URL of the object
+	authorize func(req *http.Request) error
+	client    *http.Client
+}
+
+func (f *fetcher) Fetch(ctx context.Context, off int64, size int64) (io.ReadCloser, error) {
+	req, err := f.newRequest(ctx, http.MethodGet, fmt.Sprintf("bytes=%d-%d", off, off+size-1))
+	if err != nil {
+		return nil, err
+	}
+	res, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	switch res.StatusCode {
+	case http.StatusPartialContent:
+		return res.Body, nil
+	case http.StatusOK:
+		// The storage returned the whole object. Extract the requested range.
+		if _, err := io.CopyN(io.Discard, res.Body, off); err != nil {
+			res.Body.Close()
+			return nil, err
+		}
+		return &readCloser{io.LimitReader(res.Body, size), res.Body.Close}, nil
+	}
+	res.Body.Close()
+	return nil, fmt.Errorf("unexpected status code on fetching %q: %v", f.url, res.Status)
+}
+
+func (f *fetcher) Check() error {
+	ctx, cancel := context.WithTimeout(context.Background(), checkTimeout)
+	defer cancel()
+	_, err := f.getSize(ctx)
+	return err
+}
+
+func (f *fetcher) GenID(off int64, size int64) string {
+	sum := sha256.Sum256(fmt.Appendf(nil, "%s-%d-%d", f.url, off, size))
+	return fmt.Sprintf("%x", sum)
+}
+
+func (f *fetcher) getSize(ctx context.Context) (int64, error) {
+	req, err := f.newRequest(ctx, http.MethodHead, "")
+	if err != nil {
+		return 0, err
+	}
+	res, err := f.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("unexpected status code on checking %q: %v", f.url, res.Status)
+	}
+	if res.ContentLength < 0 {
+		return 0, fmt.Errorf("unknown size of %q", f.url)
+	}
+	return res.ContentLength, nil
+}
+
+func (f *fetcher) newRequest(ctx context.Context, method, rangeHeader string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, f.objectURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if rangeHeader != "" {
+		req.Header.Set("Range", rangeHeader)
+	}
+	if err := f.authorize(req); err != nil {
+		return nil, fmt.Errorf("failed to authorize request to %q: %w", f.url, err)
+	}
+	return req, nil
+}
+
+type readCloser struct {
+	io.Reader
+	closeFunc func() error
+}
+
+func (rc *readCloser) Close() error {
+	return rc.closeFunc()
+}
+
+// signV4 signs the request with AWS Signature Version 4.
+// The request must not have a body. sessionToken is sent (and signed) if not empty.
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+func signV4(req *http.Request, accessKey, secretKey, sessionToken, region string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", emptyPayloadHash)
+	if sessionToken != "" {
+		req.Header.Set("x-amz-security-token", sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	var names []string
+	for k := range headers {
+		if k == "host" || k == "range" || strings.HasPrefix(k, "x-amz-") {
+			names = append(names, k)
+		}
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.Query().Encode(),
+		canonicalHeaders.String(),
+		signedHeaders,
+		emptyPayloadHash,
+	}, "\n")
+
+	scope := date + "/" + region + "/s3/aws4_request"
+	crSum := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(crSum[:])
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// uriEncode encodes the object key. Unreserved characters and "/" are kept as-is.
+func uriEncode(key string) string {
+	var b strings.Builder
+	for _, c := range []byte(key) {
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -34,6 +34,7 @@ import (
 	"mime"
 	"mime/multipart"
 	"net/http"
+	neturl "net/url"
 	"path"
 	"strconv"
 	"strings"
@@ -42,12 +43,14 @@ import (
 
 	"github.com/containerd/containerd/v2/core/remotes/docker"
 	"github.com/containerd/containerd/v2/pkg/reference"
-	"github.com/containerd/errdefs"
+	ctderrdefs "github.com/containerd/errdefs"
 	"github.com/containerd/log"
 	"github.com/containerd/stargz-snapshotter/cache"
+	"github.com/containerd/stargz-snapshotter/errdefs"
 	"github.com/containerd/stargz-snapshotter/fs/config"
 	commonmetrics "github.com/containerd/stargz-snapshotter/fs/metrics/common"
 	"github.com/containerd/stargz-snapshotter/fs/source"
+	"github.com/containerd/stargz-snapshotter/fs/tuning"
 	rhttp "github.com/hashicorp/go-retryablehttp"
 	digest "github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
@@ -58,12 +61,16 @@ const (
 	defaultValidIntervalSec = 60
 	defaultFetchTimeoutSec  = 300
 
+	defaultOutageProbeIntervalSec = 10
+
 	defaultMaxRetries  = 5
 	defaultMinWaitMSec = 30
 	defaultMaxWaitMSec = 300000
+
+	defaultMaxTransferResumes = 3
 )
 
-func NewResolver(cfg config.BlobConfig, handlers map[string]Handler) *Resolver {
+func NewResolver(cfg config.BlobConfig, handlers map[string]Handler, tuner *tuning.Tuner) *Resolver {
 	if cfg.ChunkSize == 0 { // zero means "use default chunk size"
 		cfg.ChunkSize = defaultChunkSize
 	}
@@ -85,16 +92,54 @@ func NewResolver(cfg config.BlobConfig, handlers map[string]Handler) *Resolver {
 	if cfg.MaxWaitMSec == 0 {
 		cfg.MaxWaitMSec = defaultMaxWaitMSec
 	}
+	if cfg.OutageProbeIntervalSec == 0 {
+		cfg.OutageProbeIntervalSec = defaultOutageProbeIntervalSec
+	}
+	if cfg.MaxTransferResumes == 0 {
+		cfg.MaxTransferResumes = defaultMaxTransferResumes
+	}
 
 	return &Resolver{
 		blobConfig: cfg,
 		handlers:   handlers,
+		tuner:      tuner,
+		clocks:     newClockSkews(),
+		scheduler:  newFetchScheduler(cfg.MaxConcurrentFetches),
+		hosts:      newHostLimiter(cfg.AdaptiveHostConcurrency, cfg.MaxHostConcurrency),
 	}
 }
 
 type Resolver struct {
 	blobConfig config.BlobConfig
 	handlers   map[string]Handler
+	tuner      *tuning.Tuner   // nil if the params aren't tuned at runtime
+	clocks     *clockSkews     // clock skews of registries shared among fetchers
+	scheduler  *fetchScheduler // scheduler of fetches shared among blobs. nil if unlimited.
+	hosts      *hostLimiter    // limits of fetches to each host. nil if not adapted.
+
+	outageHandler OutageHandler // nil if outages aren't notified.
+}
+
+// OutageHandler is called when the registry serving the blob of dgst has been failing longer
+// than OutageThresholdSec and the blob becomes unavailable, and when it becomes available
+// again. since is when the registry started failing. err is the last failure when the blob
+// becomes unavailable and nil when it recovers.
+type OutageHandler func(dgst digest.Digest, unavailable bool, since time.Time, err error)
+
+// SetOutageHandler sets the handler called when the availability of blobs changes. This must
+// be called before blobs are resolved.
+func (r *Resolver) SetOutageHandler(h OutageHandler) {
+	r.outageHandler = h
+}
+
+// PersistHostConcurrency loads the limits of fetches to hosts learned with
+// AdaptiveHostConcurrency from the file at path and saves the limits to it when they change.
+// This is a no-op if AdaptiveHostConcurrency is disabled.
+func (r *Resolver) PersistHostConcurrency(path string) error {
+	if r.hosts == nil {
+		return nil
+	}
+	return r.hosts.persist(path)
 }
 
 type fetcher interface {
@@ -117,18 +162,22 @@ func (r *Resolver) Resolve(ctx context.Context, hosts source.RegistryHosts, refs
 		time.Now(),
 		time.Duration(blobConfig.ValidInterval)*time.Second,
 		r,
-		time.Duration(blobConfig.FetchTimeoutSec)*time.Second), nil
+		newFetchTimeouts(*blobConfig),
+		time.Duration(blobConfig.OutageThresholdSec)*time.Second,
+		time.Duration(blobConfig.OutageProbeIntervalSec)*time.Second), nil
 }
 
 func (r *Resolver) resolveFetcher(ctx context.Context, hosts source.RegistryHosts, refspec reference.Spec, desc ocispec.Descriptor) (f fetcher, size int64, err error) {
 	blobConfig := &r.blobConfig
 	fc := &fetcherConfig{
-		hosts:      hosts,
-		refspec:    refspec,
-		desc:       desc,
-		maxRetries: blobConfig.MaxRetries,
-		minWait:    time.Duration(blobConfig.MinWaitMSec) * time.Millisecond,
-		maxWait:    time.Duration(blobConfig.MaxWaitMSec) * time.Millisecond,
+		hosts:       hosts,
+		refspec:     refspec,
+		desc:        desc,
+		maxRetries:  blobConfig.MaxRetries,
+		minWait:     time.Duration(blobConfig.MinWaitMSec) * time.Millisecond,
+		maxWait:     time.Duration(blobConfig.MaxWaitMSec) * time.Millisecond,
+		foreignURLs: !blobConfig.DisableForeignURLs,
+		clocks:      r.clocks,
 	}
 	var errs []error
 	for name, p := range r.handlers {
@@ -146,14 +195,27 @@ func (r *Resolver) resolveFetcher(ctx context.Context, hosts source.RegistryHost
 	handlersErr := errors.Join(errs...)
 
 	log.G(ctx).WithError(handlersErr).WithField("ref", refspec.String()).WithField("digest", desc.Digest).Debugf("using default handler")
-	hf, size, err := newHTTPFetcher(ctx, fc)
+	n := 1
+	if blobConfig.HedgeDelayMSec > 0 {
+		n = 2 // the second host is used for hedging fetches
+	}
+	hfs, size, err := newHTTPFetchers(ctx, fc, n)
 	if err != nil {
 		return nil, 0, err
 	}
 	if blobConfig.ForceSingleRangeMode {
-		hf.singleRangeMode()
+		for _, hf := range hfs {
+			hf.singleRangeMode()
+		}
+	}
+	if len(hfs) < 2 {
+		return hfs[0], size, nil
 	}
-	return hf, size, err
+	return &hedgedFetcher{
+		primary:   hfs[0],
+		secondary: hfs[1],
+		delay:     time.Duration(blobConfig.HedgeDelayMSec) * time.Millisecond,
+	}, size, nil
 }
 
 type fetcherConfig struct {
@@ -163,6 +225,12 @@ type fetcherConfig struct {
 	maxRetries int
 	minWait    time.Duration
 	maxWait    time.Duration
+
+	// foreignURLs allows fetching the blob from the URLs of the descriptor.
+	foreignURLs bool
+
+	// clocks tracks the clock skews of registries. nil if unused.
+	clocks *clockSkews
 }
 
 func jitter(duration time.Duration) time.Duration {
@@ -187,9 +255,15 @@ func backoffStrategy(min, max time.Duration, attemptNum int, resp *http.Response
 
 // retryStrategy extends retryablehttp's DefaultRetryPolicy to debug log the error when retrying
 // DefaultRetryPolicy retries whenever err is non-nil (except for some url errors) or if returned
-// status code is 429 or 5xx (except 501)
+// status code is 429 or 5xx (except 501). Errors and status codes are also retried according to
+// their kinds (see errdefs.IsRetryable), e.g. 408 is retried as a timeout.
 func retryStrategy(ctx context.Context, resp *http.Response, err error) (bool, error) {
 	retry, err2 := rhttp.DefaultRetryPolicy(ctx, resp, err)
+	if err != nil && errdefs.KindOf(err) != errdefs.KindUnknown {
+		retry = retry && errdefs.IsRetryable(err)
+	} else if err == nil && resp != nil && ctx.Err() == nil && errdefs.KindOfHTTPStatus(resp.StatusCode).Retryable() {
+		retry = true
+	}
 	if retry {
 		log.G(ctx).WithError(err).Debugf("Retrying request")
 	}
@@ -197,6 +271,16 @@ func retryStrategy(ctx context.Context, resp *http.Response, err error) (bool, e
 }
 
 func newHTTPFetcher(ctx context.Context, fc *fetcherConfig) (*httpFetcher, int64, error) {
+	hfs, size, err := newHTTPFetchers(ctx, fc, 1)
+	if err != nil {
+		return nil, 0, err
+	}
+	return hfs[0], size, nil
+}
+
+// newHTTPFetchers returns the fetchers of up to n hosts serving the blob, in the order of the
+// hosts. The blob served from the foreign URLs has only one fetcher.
+func newHTTPFetchers(ctx context.Context, fc *fetcherConfig, n int) ([]*httpFetcher, int64, error) {
 	reghosts, err := fc.hosts(fc.refspec)
 	if err != nil {
 		return nil, 0, err
@@ -211,9 +295,36 @@ func newHTTPFetcher(ctx context.Context, fc *fetcherConfig) (*httpFetcher, int64
 		return nil, 0, err
 	}
 
+	// Foreign layers (e.g. base layers of Windows images) are served from the URLs listed in
+	// the descriptor instead of the registry. Try them first and fall back to the registry.
+	if fc.foreignURLs && len(desc.URLs) > 0 {
+		var tr http.RoundTripper = http.DefaultTransport
+		var timeout time.Duration
+		if len(reghosts) > 0 {
+			// Registry credentials and headers must not be sent to the foreign URLs.
+			tr, timeout = hostTransport(reghosts[0], fc)
+		}
+		for _, u := range desc.URLs {
+			f, size, err := newURLFetcher(ctx, u, tr, timeout, digest)
+			if err != nil {
+				log.G(ctx).WithError(err).WithField("url", u).WithField("digest", digest).
+					Debugf("failed to resolve foreign URL")
+				continue // Try another
+			}
+			return []*httpFetcher{f}, size, nil
+		}
+	}
+
 	// Try to create fetcher until succeeded
 	rErr := fmt.Errorf("failed to resolve")
+	var (
+		fetchers []*httpFetcher
+		blobSize int64
+	)
 	for _, host := range reghosts {
+		if len(fetchers) >= n {
+			break
+		}
 		if host.Host == "" || strings.Contains(host.Host, "/") {
 			rErr = fmt.Errorf("invalid destination (host %q, ref:%q, digest:%q): %w", host.Host, fc.refspec, digest, rErr)
 			continue // Try another
@@ -221,23 +332,13 @@ func newHTTPFetcher(ctx context.Context, fc *fetcherConfig) (*httpFetcher, int64
 		}
 
 		// Prepare transport with authorization functionality
-		tr := host.Client.Transport
-
-		timeout := host.Client.Timeout
-		if rt, ok := tr.(*rhttp.RoundTripper); ok {
-			rt.Client.RetryMax = fc.maxRetries
-			rt.Client.RetryWaitMin = fc.minWait
-			rt.Client.RetryWaitMax = fc.maxWait
-			rt.Client.Backoff = backoffStrategy
-			rt.Client.CheckRetry = retryStrategy
-			timeout = rt.Client.HTTPClient.Timeout
-		}
-
+		tr, timeout := hostTransport(host, fc)
 		if host.Authorizer != nil {
 			tr = &transport{
-				inner: tr,
-				auth:  host.Authorizer,
-				scope: pullScope,
+				inner:  tr,
+				auth:   host.Authorizer,
+				scope:  pullScope,
+				clocks: fc.clocks,
 			}
 		}
 
@@ -262,38 +363,106 @@ func newHTTPFetcher(ctx context.Context, fc *fetcherConfig) (*httpFetcher, int64
 			rErr = fmt.Errorf("failed to get size (host %q, ref:%q, digest:%q): %v: %w", host.Host, fc.refspec, digest, err, rErr)
 			continue // Try another
 		}
+		if len(fetchers) > 0 && size != blobSize {
+			rErr = fmt.Errorf("unexpected size %d (host %q, ref:%q, digest:%q); want %d: %w", size, host.Host, fc.refspec, digest, blobSize, rErr)
+			continue // Try another
+		}
 
 		// Hit one destination
-		return &httpFetcher{
+		fetchers = append(fetchers, &httpFetcher{
 			url:       url,
+			urlExpiry: urlExpiry(url, tr),
 			tr:        tr,
 			blobURL:   blobURL,
 			digest:    digest,
 			timeout:   timeout,
 			header:    header,
 			orgHeader: host.Header,
-		}, size, nil
+		})
+		blobSize = size
+	}
+	if len(fetchers) > 0 {
+		return fetchers, blobSize, nil
 	}
 
 	return nil, 0, fmt.Errorf("cannot resolve layer: %w", rErr)
 }
 
+// hostTransport returns the transport and the timeout of the host, configured with the retry
+// policy. The returned transport doesn't authorize requests.
+func hostTransport(host docker.RegistryHost, fc *fetcherConfig) (http.RoundTripper, time.Duration) {
+	tr := host.Client.Transport
+	timeout := host.Client.Timeout
+	if rt, ok := tr.(*rhttp.RoundTripper); ok {
+		rt.Client.RetryMax = fc.maxRetries
+		rt.Client.RetryWaitMin = fc.minWait
+		rt.Client.RetryWaitMax = fc.maxWait
+		rt.Client.Backoff = backoffStrategy
+		rt.Client.CheckRetry = retryStrategy
+		timeout = rt.Client.HTTPClient.Timeout
+	}
+	return tr, timeout
+}
+
+// newURLFetcher returns a fetcher of the blob served at the URL listed in the descriptor.
+// Only http and https URLs are supported.
+func newURLFetcher(ctx context.Context, blobURL string, tr http.RoundTripper, timeout time.Duration, dgst digest.Digest) (*httpFetcher, int64, error) {
+	u, err := neturl.Parse(blobURL)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to parse URL: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, 0, fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	url, header, err := redirect(ctx, blobURL, tr, timeout, nil)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to redirect: %w", err)
+	}
+	start := time.Now() // start time before getting layer header
+	size, err := getSize(ctx, url, tr, timeout, header)
+	commonmetrics.MeasureLatencyInMilliseconds(commonmetrics.StargzHeaderGet, dgst, start) // time to get layer header
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to get size: %w", err)
+	}
+	return &httpFetcher{
+		url:       url,
+		urlExpiry: urlExpiry(url, tr),
+		tr:        tr,
+		blobURL:   blobURL,
+		digest:    dgst,
+		timeout:   timeout,
+		header:    header,
+	}, size, nil
+}
+
 type transport struct {
-	inner http.RoundTripper
-	auth  docker.Authorizer
-	scope string
+	inner  http.RoundTripper
+	auth   docker.Authorizer
+	scope  string
+	clocks *clockSkews
+
+	mu         sync.Mutex
+	challenge  []string  // WWW-Authenticate headers of the last 401 response
+	staleToken string    // Authorization header already refreshed for its expiry
+	tokenExp   time.Time // expiry of the last bearer token in the clock of tokenHost
+	tokenHost  string
 }
 
 func (tr *transport) RoundTrip(req *http.Request) (*http.Response, error) {
 	ctx := docker.WithScope(req.Context(), tr.scope)
 	roundTrip := func(req *http.Request) (*http.Response, error) {
 		// authorize the request using docker.Authorizer
-		if err := tr.auth.Authorize(ctx, req); err != nil {
+		if err := tr.authorize(ctx, req); err != nil {
 			return nil, err
 		}
 
 		// send the request
-		return tr.inner.RoundTrip(req)
+		sent := time.Now()
+		resp, err := tr.inner.RoundTrip(req)
+		if err == nil {
+			tr.clocks.observe(resp, sent, time.Now())
+		}
+		return resp, err
 	}
 
 	resp, err := roundTrip(req)
@@ -305,9 +474,24 @@ func (tr *transport) RoundTrip(req *http.Request) (*http.Response, error) {
 	if resp.StatusCode == http.StatusUnauthorized {
 		log.G(ctx).Infof("Received status code: %v. Refreshing creds...", resp.Status)
 
+		challenge := resp.Header.Values("WWW-Authenticate")
+		tr.mu.Lock()
+		tr.challenge = challenge
+		tr.mu.Unlock()
+		responses := []*http.Response{resp}
+		if tr.tokenExpiring(req, 0) {
+			// docker.Authorizer reuses the cached token unless the registry tells it's
+			// invalid. Make it fetch a new one because the token has expired in the clock
+			// of the registry.
+			if r, ok := invalidTokenResponse(req, challenge); ok {
+				log.G(ctx).Infof("Bearer token has expired in the clock of %q. Fetching a new one...", req.URL.Host)
+				responses = []*http.Response{r}
+			}
+		}
+
 		// prepare authorization for the target host using docker.Authorizer
-		if err := tr.auth.AddResponses(ctx, []*http.Response{resp}); err != nil {
-			if errdefs.IsNotImplemented(err) {
+		if err := tr.auth.AddResponses(ctx, responses); err != nil {
+			if ctderrdefs.IsNotImplemented(err) {
 				return resp, nil
 			}
 			return nil, err
@@ -320,6 +504,66 @@ func (tr *transport) RoundTrip(req *http.Request) (*http.Response, error) {
 	return resp, nil
 }
 
+// authorize authorizes the request. The bearer token is refreshed in advance if it expires
+// soon in the clock of the registry, which can be skewed from the clock of this node.
+func (tr *transport) authorize(ctx context.Context, req *http.Request) error {
+	if err := tr.auth.Authorize(ctx, req); err != nil {
+		return err
+	}
+	if tr.tokenExpiring(req, tokenRefreshMarginFromContext(ctx)) {
+		if err := tr.refreshToken(ctx, req); err != nil {
+			return err
+		}
+	}
+	if exp, ok := bearerTokenExpiry(req.Header); ok {
+		tr.mu.Lock()
+		tr.tokenExp, tr.tokenHost = exp, req.URL.Host
+		tr.mu.Unlock()
+	}
+	return nil
+}
+
+// refreshToken fetches a new bearer token and authorizes the request with it.
+func (tr *transport) refreshToken(ctx context.Context, req *http.Request) error {
+	token := req.Header.Get("Authorization")
+	tr.mu.Lock()
+	challenge := tr.challenge
+	refreshed := tr.staleToken == token
+	tr.staleToken = token
+	tr.mu.Unlock()
+	if refreshed {
+		return nil // the token server returned the same token. Use it until the registry rejects it.
+	}
+	resp, ok := invalidTokenResponse(req, challenge)
+	if !ok {
+		return nil // no bearer challenge to refresh the token with
+	}
+	log.G(ctx).Debugf("Refreshing bearer token expiring in the clock of %q", req.URL.Host)
+	if err := tr.auth.AddResponses(ctx, []*http.Response{resp}); err != nil {
+		return fmt.Errorf("failed to refresh bearer token: %w", err)
+	}
+	req.Header.Del("Authorization")
+	return tr.auth.Authorize(ctx, req)
+}
+
+// tokenExpiry returns the expiry of the last bearer token in the clock of this node.
+func (tr *transport) tokenExpiry() (time.Time, bool) {
+	tr.mu.Lock()
+	exp, host := tr.tokenExp, tr.tokenHost
+	tr.mu.Unlock()
+	if exp.IsZero() {
+		return time.Time{}, false
+	}
+	return tr.clocks.local(host, exp), true
+}
+
+// tokenExpiring returns true if the bearer token of the request expires within margin in
+// the clock of the registry.
+func (tr *transport) tokenExpiring(req *http.Request, margin time.Duration) bool {
+	exp, ok := bearerTokenExpiry(req.Header)
+	return ok && !exp.After(tr.clocks.now(req.URL.Host).Add(margin))
+}
+
 func redirect(ctx context.Context, blobURL string, tr http.RoundTripper, timeout time.Duration, header http.Header) (url string, withHeader http.Header, err error) {
 	if timeout > 0 {
 		var cancel context.CancelFunc
@@ -417,6 +661,7 @@ func getSize(ctx context.Context, url string, tr http.RoundTripper, timeout time
 
 type httpFetcher struct {
 	url           string
+	urlExpiry     time.Time // zero if the URL isn't pre-signed
 	urlMu         sync.Mutex
 	tr            http.RoundTripper
 	blobURL       string
@@ -482,6 +727,14 @@ func (f *httpFetcher) fetch(ctx context.Context, rs []region, retry bool) (multi
 	if err != nil {
 		return nil, err
 	}
+	if res.StatusCode == http.StatusOK || res.StatusCode == http.StatusPartialContent {
+		// Registries can tell the digest of the blob they serve. Abort before
+		// reading the body if it isn't the blob we want.
+		if dgst := res.Header.Get("Docker-Content-Digest"); dgst != "" && dgst != f.digest.String() {
+			res.Body.Close()
+			return nil, fmt.Errorf("registry served blob %q; want %q: %w", dgst, f.digest, ErrDigestMismatch)
+		}
+	}
 	if res.StatusCode == http.StatusOK {
 		// We are getting the whole blob in one part (= status 200)
 		size, err := strconv.ParseInt(res.Header.Get("Content-Length"), 10, 64)
@@ -521,7 +774,7 @@ func (f *httpFetcher) fetch(ctx context.Context, rs []region, retry bool) (multi
 		return f.fetch(ctx, rs, false) // retries with the single range mode
 	}
 
-	return nil, fmt.Errorf("unexpected status code: %v", res.Status)
+	return nil, errdefs.WithKind(fmt.Errorf("unexpected status code: %v", res.Status), errdefs.KindOfHTTPStatus(res.StatusCode))
 }
 
 func (f *httpFetcher) check() error {
@@ -567,7 +820,7 @@ func (f *httpFetcher) check() error {
 		return fmt.Errorf("failed to refresh URL on status %v", res.Status)
 	}
 
-	return fmt.Errorf("unexpected status code %v", res.StatusCode)
+	return errdefs.WithKind(fmt.Errorf("unexpected status code %v", res.StatusCode), errdefs.KindOfHTTPStatus(res.StatusCode))
 }
 
 func (f *httpFetcher) refreshURL(ctx context.Context) error {
@@ -575,8 +828,10 @@ func (f *httpFetcher) refreshURL(ctx context.Context) error {
 	if err != nil {
 		return err
 	}
+	exp := urlExpiry(newURL, f.tr)
 	f.urlMu.Lock()
 	f.url = newURL
+	f.urlExpiry = exp
 	f.header = headers
 	f.urlMu.Unlock()
 	return nil
@@ -671,8 +926,10 @@ func parseRange(header string) (region, int64, error) {
 type Option func(*options)
 
 type options struct {
-	ctx       context.Context
-	cacheOpts []cache.Option
+	ctx         context.Context
+	cacheOpts   []cache.Option
+	verifier    RegionVerifier
+	concurrency int
 }
 
 func WithContext(ctx context.Context) Option {
@@ -681,12 +938,92 @@ func WithContext(ctx context.Context) Option {
 	}
 }
 
+// WithRegionVerifier verifies the fetched ranges while the contents are streamed from the
+// remote, instead of the verifier set to the blob with SetRegionVerifier. Contents are cached
+// only after they are verified. On mismatch, the fetch is aborted without caching the
+// unverified contents and the remaining contents of the response.
+func WithRegionVerifier(v RegionVerifier) Option {
+	return func(opts *options) {
+		opts.verifier = v
+	}
+}
+
 func WithCacheOpts(cacheOpts ...cache.Option) Option {
 	return func(opts *options) {
 		opts.cacheOpts = cacheOpts
 	}
 }
 
+// FetchClass is the class of the operation that fetches the blob. The timeout of the fetch
+// is chosen by the class.
+type FetchClass int
+
+const (
+	// FetchClassRead is the class of on-demand reads of file contents. This is the default.
+	FetchClassRead FetchClass = iota
+
+	// FetchClassMetadata is the class of reads of the metadata of the layer (e.g. footer and TOC).
+	FetchClassMetadata
+
+	// FetchClassPrefetch is the class of prefetch and background fetch.
+	FetchClassPrefetch
+)
+
+type fetchClassKey struct{}
+
+// WithFetchClass returns a context which makes fetches performed with it (passed by WithContext)
+// use the timeout of the class.
+func WithFetchClass(ctx context.Context, class FetchClass) context.Context {
+	return context.WithValue(ctx, fetchClassKey{}, class)
+}
+
+func fetchClassFromContext(ctx context.Context) FetchClass {
+	if class, ok := ctx.Value(fetchClassKey{}).(FetchClass); ok {
+		return class
+	}
+	return FetchClassRead
+}
+
+// fetchTimeouts holds the timeout of fetches of each class.
+type fetchTimeouts struct {
+	read     time.Duration
+	metadata time.Duration
+	prefetch time.Duration
+}
+
+func newFetchTimeouts(cfg config.BlobConfig) fetchTimeouts {
+	sec := func(s int64) time.Duration {
+		if s == 0 {
+			s = cfg.FetchTimeoutSec // zero means "use the common timeout"
+		}
+		return time.Duration(s) * time.Second
+	}
+	return fetchTimeouts{
+		read:     sec(cfg.ReadFetchTimeoutSec),
+		metadata: sec(cfg.MetadataFetchTimeoutSec),
+		prefetch: sec(cfg.PrefetchFetchTimeoutSec),
+	}
+}
+
+func (t fetchTimeouts) of(class FetchClass) time.Duration {
+	switch class {
+	case FetchClassMetadata:
+		return t.metadata
+	case FetchClassPrefetch:
+		return t.prefetch
+	default:
+		return t.read
+	}
+}
+
+// WithConcurrency limits the number of concurrent fetches issued by Blob.Cache.
+// Zero or negative means no limit.
+func WithConcurrency(n int) Option {
+	return func(opts *options) {
+		opts.concurrency = n
+	}
+}
+
 type remoteFetcher struct {
 	r Fetcher
 }
@@ -35,6 +35,7 @@ import (
 
 	"github.com/containerd/containerd/v2/core/remotes/docker"
 	"github.com/containerd/containerd/v2/pkg/reference"
+	"github.com/containerd/stargz-snapshotter/errdefs"
 	"github.com/containerd/stargz-snapshotter/fs/source"
 	rhttp "github.com/hashicorp/go-retryablehttp"
 	digest "github.com/opencontainers/go-digest"
@@ -294,6 +295,120 @@ func TestMirror(t *testing.T) {
 	}
 }
 
+func TestForeignURLs(t *testing.T) {
+	ref := "dummyexample.com/library/test"
+	refspec, err := reference.Parse(ref)
+	if err != nil {
+		t.Fatalf("failed to prepare dummy reference: %v", err)
+	}
+	var (
+		blobDigest = digest.FromString("dummy")
+		refHost    = refspec.Hostname()
+	)
+
+	tests := []struct {
+		name     string
+		hosts    func(t *testing.T) source.RegistryHosts
+		urls     []string
+		disable  bool
+		wantHost string
+	}{
+		{
+			name: "foreign-url",
+			hosts: hostsConfig(
+				&sampleRoundTripper{okURLs: []string{`.*`}},
+			),
+			urls:     []string{"https://foreignexample.com/layer.tar.gz"},
+			wantHost: "foreignexample.com",
+		},
+		{
+			name: "invalid-foreign-url",
+			hosts: hostsConfig(
+				&sampleRoundTripper{
+					withCode: map[string]int{
+						"foreignexample1.com": http.StatusNotFound,
+					},
+					okURLs: []string{"foreignexample2.com", refHost},
+				},
+			),
+			urls: []string{
+				"https://foreignexample1.com/layer.tar.gz",
+				"https://foreignexample2.com/layer.tar.gz",
+			},
+			wantHost: "foreignexample2.com",
+		},
+		{
+			name: "invalid-all-foreign-url",
+			hosts: hostsConfig(
+				&sampleRoundTripper{
+					withCode: map[string]int{
+						"foreignexample.com": http.StatusNotFound,
+					},
+					okURLs: []string{refHost},
+				},
+			),
+			urls:     []string{"https://foreignexample.com/layer.tar.gz"},
+			wantHost: refHost,
+		},
+		{
+			name: "unsupported-scheme",
+			hosts: hostsConfig(
+				&sampleRoundTripper{okURLs: []string{`.*`}},
+			),
+			urls:     []string{"s3://foreignexample.com/layer.tar.gz"},
+			wantHost: refHost,
+		},
+		{
+			name: "disabled",
+			hosts: hostsConfig(
+				&sampleRoundTripper{okURLs: []string{`.*`}},
+			),
+			urls:     []string{"https://foreignexample.com/layer.tar.gz"},
+			disable:  true,
+			wantHost: refHost,
+		},
+		{
+			name: "no-registry-headers",
+			hosts: hostsConfig(
+				&sampleRoundTripper{
+					okURLs: []string{`.*`},
+					wantHeaders: map[string]http.Header{
+						"mirrorexample.com": http.Header(map[string][]string{
+							"test-a-key": {"a-value"},
+						}),
+					},
+				},
+				hostWithHeaders("mirrorexample.com", map[string][]string{
+					"test-a-key": {"a-value"},
+				}),
+			),
+			urls:     []string{"https://foreignexample.com/layer.tar.gz"},
+			wantHost: "foreignexample.com",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fetcher, _, err := newHTTPFetcher(context.Background(), &fetcherConfig{
+				hosts:       tt.hosts(t),
+				refspec:     refspec,
+				desc:        ocispec.Descriptor{Digest: blobDigest, URLs: tt.urls},
+				foreignURLs: !tt.disable,
+			})
+			if err != nil {
+				t.Fatalf("failed to resolve reference: %v", err)
+			}
+			checkFetcherURL(t, fetcher, tt.wantHost)
+
+			// Test refreshURL()
+			if err := fetcher.refreshURL(context.TODO()); err != nil {
+				t.Fatalf("failed to refresh URL: %v", err)
+			}
+			checkFetcherURL(t, fetcher, tt.wantHost)
+		})
+	}
+}
+
 func checkFetcherURL(t *testing.T, f *httpFetcher, wantHost string) {
 	nurl, err := url.Parse(f.url)
 	if err != nil {
@@ -459,6 +574,34 @@ func TestRetry(t *testing.T) {
 	}
 }
 
+func TestRetryStrategy(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		code  int
+		err   error
+		retry bool
+	}{
+		{name: "ok", code: http.StatusOK},
+		{name: "unavailable", code: http.StatusServiceUnavailable, retry: true},
+		{name: "request-timeout", code: http.StatusRequestTimeout, retry: true},
+		{name: "not-found", code: http.StatusNotFound},
+		{name: "not-implemented", code: http.StatusNotImplemented},
+		{name: "unknown-error", err: fmt.Errorf("dummy error"), retry: true},
+		{name: "timeout-error", err: fmt.Errorf("dummy: %w", errdefs.ErrTimeout), retry: true},
+		{name: "unauthorized-error", err: fmt.Errorf("dummy: %w", errdefs.ErrUnauthorized)},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var resp *http.Response
+			if tt.err == nil {
+				resp = &http.Response{StatusCode: tt.code, Header: make(http.Header)}
+			}
+			if retry, _ := retryStrategy(context.Background(), resp, tt.err); retry != tt.retry {
+				t.Errorf("retry = %v; want %v", retry, tt.retry)
+			}
+		})
+	}
+}
+
 type retryRoundTripper struct {
 	retryCount int
 }
@@ -0,0 +1,142 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package remote
+
+import (
+	"context"
+	"sync"
+)
+
+// fetchPriority is the priority of a fetch in fetchScheduler.
+type fetchPriority int
+
+const (
+	// priorityForeground is the priority of fetches a container is waiting for (i.e. on-demand
+	// reads and the metadata of layers being mounted).
+	priorityForeground fetchPriority = iota
+
+	// priorityBackground is the priority of prefetch and background fetch.
+	priorityBackground
+
+	numFetchPriorities
+)
+
+func priorityOf(class FetchClass) fetchPriority {
+	if class == FetchClassPrefetch {
+		return priorityBackground
+	}
+	return priorityForeground
+}
+
+// fetchScheduler limits the fetches of blobs in flight, shared among the blobs of the
+// resolver. Waiting foreground fetches are started before any waiting background fetch, and
+// background fetches can't take the last slot so foreground fetches aren't blocked behind
+// background fetches occupying all slots.
+type fetchScheduler struct {
+	max           int // maximum fetches in flight
+	maxBackground int // maximum background fetches in flight
+
+	mu       sync.Mutex
+	inflight [numFetchPriorities]int
+	waiting  [numFetchPriorities][]chan struct{} // closed when the fetch can start
+}
+
+// newFetchScheduler returns a scheduler allowing n fetches in flight. nil is returned if
+// n <= 0 (unlimited).
+func newFetchScheduler(n int) *fetchScheduler {
+	if n <= 0 {
+		return nil
+	}
+	return &fetchScheduler{max: n, maxBackground: max(n-1, 1)}
+}
+
+// acquire waits until a fetch of the priority can start. The returned function must be
+// called when the fetch is done.
+func (s *fetchScheduler) acquire(ctx context.Context, p fetchPriority) (release func(), _ error) {
+	if s == nil {
+		return func() {}, nil
+	}
+	release = func() { s.release(p) }
+	s.mu.Lock()
+	if s.waitingLen(p) == 0 && s.available(p) {
+		s.inflight[p]++
+		s.mu.Unlock()
+		return release, nil
+	}
+	ch := make(chan struct{})
+	s.waiting[p] = append(s.waiting[p], ch)
+	s.mu.Unlock()
+
+	select {
+	case <-ch:
+		return release, nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		for i, w := range s.waiting[p] {
+			if w == ch {
+				s.waiting[p] = append(s.waiting[p][:i], s.waiting[p][i+1:]...)
+				s.mu.Unlock()
+				return nil, ctx.Err()
+			}
+		}
+		s.mu.Unlock()
+		release() // dispatched while canceled
+		return nil, ctx.Err()
+	}
+}
+
+func (s *fetchScheduler) release(p fetchPriority) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.inflight[p]--
+	s.dispatch()
+}
+
+// dispatch starts the waiting fetches in the order of the priority as long as slots are
+// available. Background fetches don't start while foreground fetches are waiting.
+func (s *fetchScheduler) dispatch() {
+	for p := range numFetchPriorities {
+		for len(s.waiting[p]) > 0 && s.available(p) {
+			ch := s.waiting[p][0]
+			s.waiting[p] = s.waiting[p][1:]
+			s.inflight[p]++
+			close(ch)
+		}
+		if len(s.waiting[p]) > 0 {
+			return
+		}
+	}
+}
+
+// waitingLen returns the number of the waiting fetches served before a new fetch of p.
+func (s *fetchScheduler) waitingLen(p fetchPriority) (n int) {
+	for q := range p + 1 {
+		n += len(s.waiting[q])
+	}
+	return n
+}
+
+func (s *fetchScheduler) available(p fetchPriority) bool {
+	total := 0
+	for _, n := range s.inflight {
+		total += n
+	}
+	if total >= s.max {
+		return false
+	}
+	return p == priorityForeground || s.inflight[priorityBackground] < s.maxBackground
+}
@@ -0,0 +1,124 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package remote
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// acquireAsync acquires a slot in background and returns the channel receiving the
+// release function once acquired.
+func acquireAsync(s *fetchScheduler, ctx context.Context, p fetchPriority) <-chan func() {
+	ch := make(chan func(), 1)
+	go func() {
+		release, err := s.acquire(ctx, p)
+		if err != nil {
+			close(ch)
+			return
+		}
+		ch <- release
+	}()
+	return ch
+}
+
+func mustWait(t *testing.T, ch <-chan func(), name string) {
+	t.Helper()
+	select {
+	case <-ch:
+		t.Fatalf("%s must wait", name)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func mustStart(t *testing.T, ch <-chan func(), name string) func() {
+	t.Helper()
+	select {
+	case release, ok := <-ch:
+		if !ok {
+			t.Fatalf("%s failed", name)
+		}
+		return release
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%s must start", name)
+	}
+	return nil
+}
+
+func TestFetchSchedulerReservesForeground(t *testing.T) {
+	ctx := context.Background()
+	s := newFetchScheduler(2)
+	releaseBg1 := mustStart(t, acquireAsync(s, ctx, priorityBackground), "first background")
+	bg2 := acquireAsync(s, ctx, priorityBackground)
+	mustWait(t, bg2, "background taking the last slot")
+	releaseFg := mustStart(t, acquireAsync(s, ctx, priorityForeground), "foreground")
+	releaseFg()
+	mustWait(t, bg2, "background taking the last slot")
+	releaseBg1()
+	mustStart(t, bg2, "second background")()
+}
+
+func TestFetchSchedulerPriority(t *testing.T) {
+	ctx := context.Background()
+	s := newFetchScheduler(1)
+	release := mustStart(t, acquireAsync(s, ctx, priorityForeground), "first foreground")
+	bg := acquireAsync(s, ctx, priorityBackground)
+	mustWait(t, bg, "background")
+	fg := acquireAsync(s, ctx, priorityForeground)
+	mustWait(t, fg, "second foreground")
+
+	release()
+	releaseFg := mustStart(t, fg, "foreground queued after background")
+	mustWait(t, bg, "background while foreground is in flight")
+	releaseFg()
+	mustStart(t, bg, "background")()
+}
+
+func TestFetchSchedulerCancel(t *testing.T) {
+	s := newFetchScheduler(1)
+	release, err := s.acquire(context.Background(), priorityForeground)
+	if err != nil {
+		t.Fatalf("failed to acquire: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := s.acquire(ctx, priorityForeground); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("waiting fetch must fail with the context: %v", err)
+	}
+	release()
+
+	// The canceled fetch doesn't hold the slot.
+	release, err = s.acquire(context.Background(), priorityBackground)
+	if err != nil {
+		t.Fatalf("failed to acquire: %v", err)
+	}
+	release()
+	if n := s.inflight[priorityForeground] + s.inflight[priorityBackground]; n != 0 {
+		t.Errorf("%d fetches in flight after all released", n)
+	}
+}
+
+func TestFetchSchedulerUnlimited(t *testing.T) {
+	s := newFetchScheduler(0)
+	for range 10 {
+		if _, err := s.acquire(context.Background(), priorityBackground); err != nil {
+			t.Fatalf("failed to acquire: %v", err)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package remote
+
+import (
+	"fmt"
+	"io"
+)
+
+// StreamVerifier verifies the contents of a range of the blob while they are streamed from
+// the remote. Write fails with ErrDigestMismatch as soon as the contents don't match.
+type StreamVerifier interface {
+	io.Writer
+
+	// Verified returns the offset in the blob until which the written contents are
+	// verified or aren't covered by the verification. Contents after that offset can't
+	// be used until more contents are written.
+	Verified() int64
+}
+
+// RegionVerifier returns the verifier of size bytes of the blob at offset. ok is false if
+// the range can't be verified.
+type RegionVerifier func(offset, size int64) (v StreamVerifier, ok bool)
+
+// VerifiableBlob is implemented by blobs that verify the contents fetched from the remote
+// with the verifier of the layer by default.
+type VerifiableBlob interface {
+	SetRegionVerifier(v RegionVerifier)
+}
+
+// Span is a span of the blob verified at once.
+type Span struct {
+	Offset int64
+	Size   int64
+
+	// Verify checks the contents of the span.
+	Verify func(p []byte) error
+}
+
+// NewSpanVerifier returns the StreamVerifier of the contents of the blob written from offset.
+// Each span is verified when all of its contents are written. Spans must be sorted by the
+// offset, must not overlap and must start at or after offset.
+func NewSpanVerifier(offset int64, spans []Span) StreamVerifier {
+	return &spanVerifier{off: offset, spans: spans}
+}
+
+type spanVerifier struct {
+	off   int64  // offset of the contents written next
+	spans []Span // spans not verified yet
+	buf   []byte // contents of spans[0] written so far
+	err   error
+}
+
+func (v *spanVerifier) Write(p []byte) (int, error) {
+	if v.err != nil {
+		return 0, v.err
+	}
+	n := len(p)
+	for len(p) > 0 && len(v.spans) > 0 {
+		s := v.spans[0]
+		if v.off < s.Offset {
+			l := min(int64(len(p)), s.Offset-v.off)
+			p, v.off = p[l:], v.off+l
+			continue
+		}
+		l := min(int64(len(p)), s.Offset+s.Size-v.off)
+		v.buf = append(v.buf, p[:l]...)
+		p, v.off = p[l:], v.off+l
+		if v.off < s.Offset+s.Size {
+			continue
+		}
+		if err := s.Verify(v.buf); err != nil {
+			v.err = fmt.Errorf("range (%d, %d) isn't verified: %v: %w", s.Offset, s.Offset+s.Size-1, err, ErrDigestMismatch)
+			return 0, v.err
+		}
+		v.buf, v.spans = v.buf[:0], v.spans[1:]
+	}
+	v.off += int64(len(p))
+	return n, nil
+}
+
+func (v *spanVerifier) Verified() int64 {
+	if len(v.spans) > 0 && v.off > v.spans[0].Offset {
+		return v.spans[0].Offset
+	}
+	return v.off
+}
@@ -0,0 +1,122 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/containerd/log"
+	digest "github.com/opencontainers/go-digest"
+	"golang.org/x/sys/unix"
+)
+
+// MountRestarter restarts serving a single mounted layer without touching the other mounts,
+// to recover the layer from a wedge (e.g. a stuck connection or a broken cache) in
+// production.
+type MountRestarter struct {
+	mu        sync.Mutex
+	fs        *filesystem
+	restartMu sync.Mutex // serializes restarts
+}
+
+// NewMountRestarter returns a MountRestarter. Pass it to the filesystem with
+// WithMountRestarter.
+func NewMountRestarter() *MountRestarter {
+	return &MountRestarter{}
+}
+
+// WithMountRestarter specifies the restarter of the filesystem so the mounted layers can be
+// restarted at runtime (e.g. through the admin API).
+func WithMountRestarter(r *MountRestarter) Option {
+	return func(opts *options) {
+		opts.mountRestarter = r
+	}
+}
+
+func (r *MountRestarter) set(fs *filesystem) {
+	r.mu.Lock()
+	r.fs = fs
+	r.mu.Unlock()
+}
+
+// RestartResult is the result of restarting a mounted layer.
+type RestartResult struct {
+	// Mountpoint is the mountpoint of the layer.
+	Mountpoint string `json:"mountpoint"`
+
+	// Layer is the digest of the layer serving the mountpoint after the restart.
+	Layer digest.Digest `json:"layer"`
+
+	// Remounted is true if the FUSE session has been re-established with a new reader and
+	// cache of the layer. Otherwise, the mountpoint is in use and only the connection to the
+	// registry has been refreshed.
+	Remounted bool `json:"remounted"`
+}
+
+// Restart restarts serving the layer mounted on mountpoint. If the mountpoint isn't in use,
+// this unmounts it, drops the caches of the layer (unless they are shared with other mounts
+// of the same layer) and mounts the layer again with a new reader and FUSE session. If the
+// mountpoint is in use (e.g. it is a lower of a running container), the FUSE session can't
+// be re-established so this refreshes the connection of the layer to the registry in place.
+// If mounting the layer again fails, the mountpoint is left unmounted.
+func (r *MountRestarter) Restart(ctx context.Context, mountpoint string) (RestartResult, error) {
+	r.mu.Lock()
+	fs := r.fs
+	r.mu.Unlock()
+	if fs == nil {
+		return RestartResult{}, fmt.Errorf("filesystem isn't ready")
+	}
+	r.restartMu.Lock()
+	defer r.restartMu.Unlock()
+	ctx = log.WithLogger(ctx, log.G(ctx).WithField("mountpoint", mountpoint))
+
+	fs.layerMu.Lock()
+	l, ok := fs.layer[mountpoint]
+	labels := fs.labels[mountpoint]
+	fs.layerMu.Unlock()
+	if !ok {
+		return RestartResult{}, fmt.Errorf("specified path %q isn't a mountpoint", mountpoint)
+	}
+	res := RestartResult{Mountpoint: mountpoint, Layer: l.Info().Digest}
+
+	if err := unmount(mountpoint, 0); err != nil {
+		if err != unix.EBUSY {
+			return res, fmt.Errorf("failed to unmount %q: %w", mountpoint, err)
+		}
+		log.G(ctx).WithError(err).Info("mountpoint is in use; refreshing the connection of the layer")
+		if err := fs.refresh(ctx, l, labels); err != nil {
+			return res, fmt.Errorf("failed to refresh the layer: %w", err)
+		}
+		return res, nil
+	}
+	if err := fs.unregister(ctx, mountpoint); err != nil {
+		return res, err
+	}
+	log.G(ctx).Info("unmounted; mounting the layer again")
+	if err := fs.Mount(ctx, mountpoint, labels); err != nil {
+		return res, fmt.Errorf("failed to mount the layer again: %w", err)
+	}
+	fs.layerMu.Lock()
+	if l, ok := fs.layer[mountpoint]; ok {
+		res.Layer = l.Info().Digest
+	}
+	fs.layerMu.Unlock()
+	res.Remounted = true
+	return res, nil
+}
@@ -0,0 +1,53 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"testing"
+
+	"github.com/containerd/stargz-snapshotter/fs/layer"
+)
+
+func TestRestartNotReady(t *testing.T) {
+	if _, err := NewMountRestarter().Restart(context.Background(), "/mnt"); err == nil {
+		t.Errorf("restarting without the filesystem must fail")
+	}
+}
+
+func TestRestartKeepsOtherMounts(t *testing.T) {
+	target, other := t.TempDir(), t.TempDir()
+	fs := &filesystem{
+		layer: map[string]layer.Layer{
+			target: &breakableLayer{},
+			other:  &breakableLayer{},
+		},
+		labels: map[string]map[string]string{},
+	}
+	r := NewMountRestarter()
+	r.set(fs)
+	if _, err := r.Restart(context.Background(), "/not/mounted"); err == nil {
+		t.Errorf("restarting an unknown mountpoint must fail")
+	}
+	// The directory isn't actually mounted so unmounting it fails.
+	if _, err := r.Restart(context.Background(), target); err == nil {
+		t.Errorf("restarting a directory not mounted must fail")
+	}
+	if len(fs.layer) != 2 {
+		t.Errorf("failed restart must keep the mounts; got %d mounts", len(fs.layer))
+	}
+}
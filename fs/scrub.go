@@ -0,0 +1,67 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/containerd/log"
+	"github.com/containerd/stargz-snapshotter/fs/layer"
+	"github.com/containerd/stargz-snapshotter/fs/reader"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// defaultScrubSampleChunks is the default number of the chunks of each layer verified on each
+// scrub of the caches.
+const defaultScrubSampleChunks = 100
+
+// runCacheScrubber scrubs the caches of the mounted layers every interval.
+func (fs *filesystem) runCacheScrubber(interval time.Duration, samples int) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		fs.scrubCaches(context.Background(), samples)
+	}
+}
+
+// scrubCaches verifies up to samples cached chunks of each mounted layer and removes the
+// corrupted ones from the caches. Layers mounted on several mountpoints are scrubbed once.
+func (fs *filesystem) scrubCaches(ctx context.Context, samples int) (res reader.ScrubResult) {
+	layers := make(map[digest.Digest]layer.Layer)
+	fs.layerMu.Lock()
+	for _, l := range fs.layer {
+		layers[l.Info().Digest] = l
+	}
+	fs.layerMu.Unlock()
+	for dgst, l := range layers {
+		lres, err := l.Scrub(samples)
+		res.Checked += lres.Checked
+		res.Corrupted += lres.Corrupted
+		if errors.Is(err, reader.ErrScrubUnsupported) {
+			continue
+		} else if err != nil {
+			log.G(ctx).WithError(err).WithField("layer", dgst).Warn("failed to scrub the cache of the layer")
+			continue
+		}
+		if lres.Corrupted > 0 {
+			log.G(ctx).WithField("layer", dgst).Warnf("removed %d corrupted chunks of %d chunks checked from the cache", lres.Corrupted, lres.Checked)
+		}
+	}
+	return res
+}
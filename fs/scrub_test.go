@@ -0,0 +1,48 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"testing"
+
+	"github.com/containerd/stargz-snapshotter/fs/layer"
+	"github.com/containerd/stargz-snapshotter/fs/reader"
+	digest "github.com/opencontainers/go-digest"
+)
+
+func TestScrubCaches(t *testing.T) {
+	shared := &breakableLayer{success: true, digest: digest.FromString("shared")}
+	broken := &breakableLayer{digest: digest.FromString("broken")}
+	fs := &filesystem{
+		layer: map[string]layer.Layer{
+			"a": shared,
+			"b": shared, // the same layer mounted twice
+			"c": broken,
+		},
+	}
+	res := fs.scrubCaches(context.Background(), 10)
+	if res != (reader.ScrubResult{Checked: 10, Corrupted: 1}) {
+		t.Errorf("result = %+v; want 10 checked and 1 corrupted", res)
+	}
+	if shared.scrubs != 1 {
+		t.Errorf("layer mounted twice is scrubbed %d times; want 1", shared.scrubs)
+	}
+	if broken.scrubs != 1 {
+		t.Errorf("layer failing to be scrubbed must be tried once; got %d", broken.scrubs)
+	}
+}
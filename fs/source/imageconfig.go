@@ -0,0 +1,41 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package source
+
+import (
+	"context"
+	"fmt"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// FetchImageConfig fetches the config of the image containing the source blob. nil is
+// returned if the digest of the image manifest isn't known.
+func FetchImageConfig(ctx context.Context, src Source) (*ocispec.Image, error) {
+	if src.ManifestDigest == "" {
+		return nil, nil
+	}
+	fetcher, manifest, err := fetchManifest(ctx, src)
+	if err != nil {
+		return nil, err
+	}
+	var config ocispec.Image
+	if err := fetchJSON(ctx, fetcher, manifest.Config.Digest, manifest.Config.MediaType, &config); err != nil {
+		return nil, fmt.Errorf("failed to fetch image config %s: %w", manifest.Config.Digest, err)
+	}
+	return &config, nil
+}
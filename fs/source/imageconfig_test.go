@@ -0,0 +1,82 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package source
+
+import (
+	"context"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/containerd/containerd/v2/core/remotes/docker"
+	"github.com/containerd/containerd/v2/pkg/reference"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestFetchImageConfig(t *testing.T) {
+	r := &testRegistry{
+		blobs:     make(map[digest.Digest][]byte),
+		referrers: make(map[digest.Digest][]ocispec.Descriptor),
+	}
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := ocispec.Image{
+		Config: ocispec.ImageConfig{
+			Volumes: map[string]struct{}{"/data": {}, "/var/lib/db": {}},
+		},
+	}
+	configDigest, configBytes := r.add(t, config)
+	manifestDigest, _ := r.add(t, ocispec.Manifest{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    ocispec.Descriptor{MediaType: ocispec.MediaTypeImageConfig, Digest: configDigest, Size: int64(len(configBytes))},
+	})
+	refspec, err := reference.Parse(u.Host + "/test/img:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := Source{
+		Hosts: func(reference.Spec) ([]docker.RegistryHost, error) {
+			return []docker.RegistryHost{{
+				Client:       srv.Client(),
+				Host:         u.Host,
+				Scheme:       "http",
+				Path:         "/v2",
+				Capabilities: docker.HostCapabilityPull | docker.HostCapabilityResolve,
+			}}, nil
+		},
+		Name:           refspec,
+		ManifestDigest: manifestDigest,
+	}
+	got, err := FetchImageConfig(context.Background(), src)
+	if err != nil {
+		t.Fatalf("failed to fetch image config: %v", err)
+	}
+	if !reflect.DeepEqual(got, &config) {
+		t.Errorf("unexpected image config %+v; want %+v", got, config)
+	}
+
+	src.ManifestDigest = ""
+	if got, err := FetchImageConfig(context.Background(), src); err != nil || got != nil {
+		t.Errorf("image config = %+v, %v; want nil without the manifest digest", got, err)
+	}
+}
@@ -0,0 +1,163 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package source
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/containerd/containerd/v2/core/remotes"
+	"github.com/containerd/containerd/v2/core/remotes/docker"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	// PrefetchListAnnotation is an annotation of image manifests which contains the digest
+	// of the prefetch list stored as a blob in the repository of the image.
+	PrefetchListAnnotation = "containerd.io/snapshot/stargz/prefetch.list"
+
+	// PrefetchListMediaType is the media type of the prefetch list. This is also the artifact
+	// type of the referrer artifacts of image manifests which contain the prefetch list as
+	// the first layer. The prefetch list can be published by either of the annotation or
+	// the referrer, which allows adding it to images without rebuilding them.
+	PrefetchListMediaType = "application/vnd.containerd.stargz.prefetch.v1+json"
+
+	// maxPrefetchListSize is the max size of the prefetch list and the manifests fetched to
+	// look it up. This also limits the size of the image config.
+	maxPrefetchListSize = 4 << 20
+)
+
+// PrefetchList is the list of files of an image to prefetch when the layers are mounted.
+// Paths are the patterns of the paths in the layers (e.g. "usr/bin/app", "etc/**").
+// "**" matches any number of directories.
+type PrefetchList struct {
+	// Files are path patterns matched against the files of all layers of the image.
+	Files []string `json:"files,omitempty"`
+
+	// Layers are path patterns matched against the files of the layers keyed by the digests.
+	Layers map[digest.Digest][]string `json:"layers,omitempty"`
+}
+
+// FilesOf returns the path patterns of the files to prefetch in the layer.
+func (l *PrefetchList) FilesOf(layer digest.Digest) []string {
+	if l == nil {
+		return nil
+	}
+	files := append([]string{}, l.Files...)
+	return append(files, l.Layers[layer]...)
+}
+
+// FetchPrefetchList fetches the prefetch list of the image containing the source blob.
+// The list is looked up in the annotation of the image manifest first and then in the
+// referrers of the manifest. nil is returned if the image doesn't have the prefetch list.
+func FetchPrefetchList(ctx context.Context, src Source) (*PrefetchList, error) {
+	if src.ManifestDigest == "" {
+		return nil, nil
+	}
+	fetcher, manifest, err := fetchManifest(ctx, src)
+	if err != nil {
+		return nil, err
+	}
+	if d, ok := manifest.Annotations[PrefetchListAnnotation]; ok {
+		dgst, err := digest.Parse(d)
+		if err != nil {
+			return nil, fmt.Errorf("invalid digest of prefetch list %q: %w", d, err)
+		}
+		return fetchPrefetchList(ctx, fetcher, dgst)
+	}
+
+	rf, ok := fetcher.(remotes.ReferrersFetcher)
+	if !ok {
+		return nil, nil
+	}
+	referrers, err := rf.FetchReferrers(ctx, src.ManifestDigest, remotes.WithReferrerArtifactTypes(PrefetchListMediaType))
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch referrers of %s: %w", src.ManifestDigest, err)
+	}
+	for _, desc := range referrers {
+		if desc.ArtifactType != PrefetchListMediaType {
+			continue // the registry doesn't support filtering
+		}
+		var artifact ocispec.Manifest
+		if err := fetchJSON(ctx, fetcher, desc.Digest, desc.MediaType, &artifact); err != nil {
+			return nil, fmt.Errorf("failed to fetch prefetch list artifact %s: %w", desc.Digest, err)
+		}
+		if len(artifact.Layers) == 0 {
+			return nil, fmt.Errorf("prefetch list artifact %s has no layer", desc.Digest)
+		}
+		return fetchPrefetchList(ctx, fetcher, artifact.Layers[0].Digest)
+	}
+	return nil, nil
+}
+
+func fetchPrefetchList(ctx context.Context, fetcher remotes.Fetcher, dgst digest.Digest) (*PrefetchList, error) {
+	var l PrefetchList
+	if err := fetchJSON(ctx, fetcher, dgst, PrefetchListMediaType, &l); err != nil {
+		return nil, fmt.Errorf("failed to fetch prefetch list %s: %w", dgst, err)
+	}
+	return &l, nil
+}
+
+// fetchManifest fetches the image manifest containing the source blob and returns it with
+// the fetcher of the repository of the image.
+func fetchManifest(ctx context.Context, src Source) (remotes.Fetcher, *ocispec.Manifest, error) {
+	resolver := docker.NewResolver(docker.ResolverOptions{
+		Hosts: func(host string) ([]docker.RegistryHost, error) {
+			if host != src.Name.Hostname() {
+				return nil, fmt.Errorf("unexpected host %q for image ref %q", host, src.Name.String())
+			}
+			return src.Hosts(src.Name)
+		},
+	})
+	fetcher, err := resolver.Fetcher(ctx, src.Name.String())
+	if err != nil {
+		return nil, nil, err
+	}
+	var manifest ocispec.Manifest
+	if err := fetchJSON(ctx, fetcher, src.ManifestDigest, ocispec.MediaTypeImageManifest, &manifest); err != nil {
+		return nil, nil, fmt.Errorf("failed to fetch manifest %s: %w", src.ManifestDigest, err)
+	}
+	return fetcher, &manifest, nil
+}
+
+// fetchJSON fetches the blob or the manifest of the digest and decodes it as JSON after
+// verifying the digest.
+func fetchJSON(ctx context.Context, fetcher remotes.Fetcher, dgst digest.Digest, mediaType string, v any) error {
+	df, ok := fetcher.(remotes.FetcherByDigest)
+	if !ok {
+		return fmt.Errorf("fetcher doesn't support fetching by digest")
+	}
+	rc, _, err := df.FetchByDigest(ctx, dgst, remotes.WithMediaType(mediaType))
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	b, err := io.ReadAll(io.LimitReader(rc, maxPrefetchListSize+1))
+	if err != nil {
+		return err
+	}
+	if len(b) > maxPrefetchListSize {
+		return fmt.Errorf("size exceeds %d bytes", maxPrefetchListSize)
+	}
+	if got := digest.FromBytes(b); got != dgst {
+		return fmt.Errorf("unexpected digest %s", got)
+	}
+	return json.Unmarshal(b, v)
+}
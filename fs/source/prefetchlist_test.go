@@ -0,0 +1,181 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package source
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/containerd/containerd/v2/core/remotes/docker"
+	"github.com/containerd/containerd/v2/pkg/reference"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// testRegistry serves blobs, manifests and referrers of the repository "test/img".
+type testRegistry struct {
+	blobs     map[digest.Digest][]byte
+	referrers map[digest.Digest][]ocispec.Descriptor
+}
+
+func (r *testRegistry) add(t *testing.T, v any) (digest.Digest, []byte) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("failed to marshal: %v", err)
+	}
+	dgst := digest.FromBytes(b)
+	r.blobs[dgst] = b
+	return dgst, b
+}
+
+func (r *testRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	p := strings.TrimPrefix(req.URL.Path, "/v2/test/img/")
+	kind, d, ok := strings.Cut(p, "/")
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	dgst := digest.Digest(d)
+	switch kind {
+	case "blobs", "manifests":
+		b, ok := r.blobs[dgst]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Docker-Content-Digest", dgst.String())
+		w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+		if req.Method == http.MethodGet {
+			w.Write(b)
+		}
+	case "referrers":
+		var filtered []ocispec.Descriptor
+		for _, desc := range r.referrers[dgst] {
+			if at := req.URL.Query().Get("artifactType"); at == "" || at == desc.ArtifactType {
+				filtered = append(filtered, desc)
+			}
+		}
+		b, _ := json.Marshal(ocispec.Index{MediaType: ocispec.MediaTypeImageIndex, Manifests: filtered})
+		w.Header().Set("Content-Type", ocispec.MediaTypeImageIndex)
+		w.Write(b)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestFetchPrefetchList(t *testing.T) {
+	list := PrefetchList{
+		Files:  []string{"usr/bin/app"},
+		Layers: map[digest.Digest][]string{"sha256:aaaa": {"etc/**"}},
+	}
+	tests := []struct {
+		name    string
+		publish func(t *testing.T, r *testRegistry, manifest *ocispec.Manifest) (manifestDigest digest.Digest)
+		want    *PrefetchList
+	}{
+		{
+			name: "annotation",
+			publish: func(t *testing.T, r *testRegistry, manifest *ocispec.Manifest) digest.Digest {
+				listDigest, _ := r.add(t, list)
+				manifest.Annotations = map[string]string{PrefetchListAnnotation: listDigest.String()}
+				dgst, _ := r.add(t, manifest)
+				return dgst
+			},
+			want: &list,
+		},
+		{
+			name: "referrer",
+			publish: func(t *testing.T, r *testRegistry, manifest *ocispec.Manifest) digest.Digest {
+				dgst, _ := r.add(t, manifest)
+				listDigest, listBytes := r.add(t, list)
+				artifact := ocispec.Manifest{
+					MediaType:    ocispec.MediaTypeImageManifest,
+					ArtifactType: PrefetchListMediaType,
+					Config:       ocispec.DescriptorEmptyJSON,
+					Layers: []ocispec.Descriptor{
+						{MediaType: PrefetchListMediaType, Digest: listDigest, Size: int64(len(listBytes))},
+					},
+					Subject: &ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: dgst},
+				}
+				artifactDigest, artifactBytes := r.add(t, artifact)
+				r.referrers[dgst] = []ocispec.Descriptor{
+					{MediaType: ocispec.MediaTypeImageManifest, ArtifactType: "application/vnd.example.sbom", Digest: "sha256:bbbb"},
+					{MediaType: ocispec.MediaTypeImageManifest, ArtifactType: PrefetchListMediaType, Digest: artifactDigest, Size: int64(len(artifactBytes))},
+				}
+				return dgst
+			},
+			want: &list,
+		},
+		{
+			name: "none",
+			publish: func(t *testing.T, r *testRegistry, manifest *ocispec.Manifest) digest.Digest {
+				dgst, _ := r.add(t, manifest)
+				return dgst
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &testRegistry{
+				blobs:     make(map[digest.Digest][]byte),
+				referrers: make(map[digest.Digest][]ocispec.Descriptor),
+			}
+			srv := httptest.NewServer(r)
+			defer srv.Close()
+			u, err := url.Parse(srv.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			manifest := ocispec.Manifest{MediaType: ocispec.MediaTypeImageManifest}
+			manifestDigest := tt.publish(t, r, &manifest)
+			refspec, err := reference.Parse(u.Host + "/test/img:latest")
+			if err != nil {
+				t.Fatal(err)
+			}
+			src := Source{
+				Hosts: func(reference.Spec) ([]docker.RegistryHost, error) {
+					return []docker.RegistryHost{{
+						Client:       srv.Client(),
+						Host:         u.Host,
+						Scheme:       "http",
+						Path:         "/v2",
+						Capabilities: docker.HostCapabilityPull | docker.HostCapabilityResolve | docker.HostCapabilityReferrers,
+					}}, nil
+				},
+				Name:           refspec,
+				ManifestDigest: manifestDigest,
+			}
+			got, err := FetchPrefetchList(context.Background(), src)
+			if err != nil {
+				t.Fatalf("failed to fetch prefetch list: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("unexpected prefetch list %+v; want %+v", got, tt.want)
+			}
+			if want := []string{"usr/bin/app", "etc/**"}; tt.want != nil && !reflect.DeepEqual(got.FilesOf("sha256:aaaa"), want) {
+				t.Errorf("unexpected files %v; want %v", got.FilesOf("sha256:aaaa"), want)
+			}
+		})
+	}
+}
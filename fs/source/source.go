@@ -58,6 +58,10 @@ type Source struct {
 	// the manifest.
 	// Currently, only layer digests (Manifest.Layers.Digest) will be used.
 	Manifest ocispec.Manifest
+
+	// ManifestDigest is the digest of the image manifest which contains the blob.
+	// This is used for looking up the prefetch list of the image. Empty if unknown.
+	ManifestDigest digest.Digest
 }
 
 const (
@@ -75,9 +79,27 @@ const (
 	// urls of the layer descriptor.
 	targetImageURLsLabelPrefix = "containerd.io/snapshot/remote/urls."
 
+	// targetManifestLabel is a label which contains the digest of the image manifest.
+	targetManifestLabel = "containerd.io/snapshot/remote/stargz.manifest"
+
 	// targetURsLLabel is a label which contains layer URL. This is only used to pass URL from containerd
 	// to snapshotter.
 	targetURLsLabel = "containerd.io/snapshot/remote/urls"
+
+	// targetEncryptionLabelPrefix is a label prefix which passes the annotations of encrypted
+	// layers (e.g. wrapped keys) to the snapshotter. The original annotation key follows the prefix.
+	targetEncryptionLabelPrefix = "containerd.io/snapshot/remote/stargz.enc/"
+
+	// targetMediaTypeLabel is a label which contains the media type of the layer.
+	targetMediaTypeLabel = "containerd.io/snapshot/remote/stargz.mediatype"
+
+	// targetAnnotationLabelPrefix is a label prefix which passes the annotations of layers to
+	// the snapshotter (e.g. for selecting chunk transformers). The original annotation key
+	// follows the prefix.
+	targetAnnotationLabelPrefix = "containerd.io/snapshot/remote/stargz.annotation/"
+
+	// encryptionAnnotationPrefix is the prefix of the annotations of layers encrypted by ocicrypt.
+	encryptionAnnotationPrefix = "org.opencontainers.image.enc."
 )
 
 // FromDefaultLabels returns a function for converting snapshot labels to
@@ -121,19 +143,29 @@ func FromDefaultLabels(hosts RegistryHosts) GetSources {
 		}
 
 		targetDesc := ocispec.Descriptor{
+			MediaType:   labels[targetMediaTypeLabel],
 			Digest:      target,
-			Annotations: labels,
+			Annotations: withLayerAnnotations(labels),
 		}
 		if targetURLs, ok := labels[targetURLsLabel]; ok {
 			targetDesc.URLs = append(targetDesc.URLs, strings.Split(targetURLs, ",")...)
 		}
 
+		var manifestDigest digest.Digest
+		if m, ok := labels[targetManifestLabel]; ok {
+			manifestDigest, err = digest.Parse(m)
+			if err != nil {
+				return nil, err
+			}
+		}
+
 		return []Source{
 			{
-				Hosts:    hosts,
-				Name:     refspec,
-				Target:   targetDesc,
-				Manifest: ocispec.Manifest{Layers: append([]ocispec.Descriptor{targetDesc}, neighboringLayers...)},
+				Hosts:          hosts,
+				Name:           refspec,
+				Target:         targetDesc,
+				Manifest:       ocispec.Manifest{Layers: append([]ocispec.Descriptor{targetDesc}, neighboringLayers...)},
+				ManifestDigest: manifestDigest,
 			},
 		}, nil
 	}
@@ -160,6 +192,8 @@ func AppendDefaultLabelsHandlerWrapper(ref string, prefetchSize int64) func(f im
 						}
 						c.Annotations[targetRefLabel] = ref
 						c.Annotations[targetDigestLabel] = c.Digest.String()
+						c.Annotations[targetManifestLabel] = desc.Digest.String()
+						c.Annotations[targetMediaTypeLabel] = c.MediaType
 						var layers string
 						for i, l := range children[i:] {
 							if images.IsLayerType(l.MediaType) {
@@ -181,6 +215,9 @@ func AppendDefaultLabelsHandlerWrapper(ref string, prefetchSize int64) func(f im
 
 						// store URL in annotation to let containerd to pass it to the snapshotter
 						c.Annotations[targetURLsLabel] = appendWithValidation(targetURLsLabel, c.URLs)
+
+						appendEncryptionLabels(c.Annotations)
+						appendAnnotationLabels(c.Annotations)
 					}
 				}
 			}
@@ -201,6 +238,68 @@ func appendWithValidation(key string, values []string) string {
 	return strings.TrimSuffix(v, ",")
 }
 
+// appendEncryptionLabels copies the annotations of the encrypted layer to the labels passed
+// to the snapshotter. Annotations that hit the size limitation of labels are skipped. The
+// snapshotter can't decrypt the layer in that case and containerd falls back to pulling it.
+func appendEncryptionLabels(annotations map[string]string) {
+	for k, v := range annotations {
+		if !strings.HasPrefix(k, encryptionAnnotationPrefix) {
+			continue
+		}
+		key := targetEncryptionLabelPrefix + k
+		if err := labels.Validate(key, v); err != nil {
+			continue
+		}
+		annotations[key] = v
+	}
+}
+
+// appendAnnotationLabels copies the annotations of the layer to the labels passed to the
+// snapshotter. The labels (prefixed by "containerd.io/"), the annotations of encryption
+// (see appendEncryptionLabels) and annotations that hit the size limitation of labels are
+// skipped.
+func appendAnnotationLabels(annotations map[string]string) {
+	var keys []string
+	for k := range annotations {
+		if !strings.HasPrefix(k, "containerd.io/") && !strings.HasPrefix(k, encryptionAnnotationPrefix) {
+			keys = append(keys, k)
+		}
+	}
+	for _, k := range keys {
+		key := targetAnnotationLabelPrefix + k
+		if err := labels.Validate(key, annotations[k]); err != nil {
+			continue
+		}
+		annotations[key] = annotations[k]
+	}
+}
+
+// withLayerAnnotations returns the labels with the annotations of the layer restored from
+// the labels added by appendEncryptionLabels and appendAnnotationLabels.
+func withLayerAnnotations(labels map[string]string) map[string]string {
+	var annotations map[string]string
+	for k, v := range labels {
+		orig, ok := strings.CutPrefix(k, targetEncryptionLabelPrefix)
+		if !ok {
+			orig, ok = strings.CutPrefix(k, targetAnnotationLabelPrefix)
+		}
+		if !ok {
+			continue
+		}
+		if annotations == nil {
+			annotations = make(map[string]string, len(labels))
+			for k, v := range labels {
+				annotations[k] = v
+			}
+		}
+		annotations[orig] = v
+	}
+	if annotations == nil {
+		return labels
+	}
+	return annotations
+}
+
 // TODO: switch to "github.com/containerd/containerd/pkg/snapshotters" once all tools using
 //
 //	stargz-snapshotter (e.g. k3s) move to containerd version where that pkg is available.
@@ -235,6 +334,17 @@ func AppendExtraLabelsHandler(prefetchSize int64, wrapper func(images.Handler) i
 						c.Annotations[config.TargetPrefetchSizeLabel] = fmt.Sprintf("%d", prefetchSize)
 					}
 
+					if _, ok := c.Annotations[targetManifestLabel]; !ok { // nop if this key is already set
+						c.Annotations[targetManifestLabel] = desc.Digest.String()
+					}
+
+					if _, ok := c.Annotations[targetMediaTypeLabel]; !ok { // nop if this key is already set
+						c.Annotations[targetMediaTypeLabel] = c.MediaType
+					}
+
+					appendEncryptionLabels(c.Annotations)
+					appendAnnotationLabels(c.Annotations)
+
 					// Store URLs of the neighbouring layer as well.
 					nlayers, ok := c.Annotations[targetImageLayersLabelContainerd]
 					if !ok {
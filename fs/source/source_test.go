@@ -0,0 +1,61 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package source
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLayerAnnotationLabels(t *testing.T) {
+	annotations := map[string]string{
+		"org.example.audit":                     "true",
+		encryptionAnnotationPrefix + "keys.jwe": "key",
+		"containerd.io/snapshot/ref":            "sha256:abc",
+		"org.example.large":                     strings.Repeat("a", 5000),
+	}
+	appendEncryptionLabels(annotations)
+	appendAnnotationLabels(annotations)
+
+	if _, ok := annotations[targetAnnotationLabelPrefix+"containerd.io/snapshot/ref"]; ok {
+		t.Errorf("labels must not be copied")
+	}
+	if _, ok := annotations[targetAnnotationLabelPrefix+encryptionAnnotationPrefix+"keys.jwe"]; ok {
+		t.Errorf("encryption annotations must not be copied twice")
+	}
+	if _, ok := annotations[targetAnnotationLabelPrefix+"org.example.large"]; ok {
+		t.Errorf("annotations exceeding the size limitation must be skipped")
+	}
+
+	// Only the labels are passed to the snapshotter.
+	passed := make(map[string]string)
+	for k, v := range annotations {
+		if strings.HasPrefix(k, "containerd.io/") {
+			passed[k] = v
+		}
+	}
+	restored := withLayerAnnotations(passed)
+	for k, want := range map[string]string{
+		"org.example.audit":                     "true",
+		encryptionAnnotationPrefix + "keys.jwe": "key",
+		"containerd.io/snapshot/ref":            "sha256:abc",
+	} {
+		if got := restored[k]; got != want {
+			t.Errorf("annotation %q = %q; want %q", k, got, want)
+		}
+	}
+}
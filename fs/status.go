@@ -0,0 +1,289 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// statusSampleInterval is the interval of sampling the throughput of fetching layers.
+	statusSampleInterval = 5 * time.Second
+
+	// maxThroughputSamples is the number of the throughput samples kept (10 minutes).
+	maxThroughputSamples = 120
+
+	// maxRecentErrors is the number of the recent errors kept.
+	maxRecentErrors = 50
+)
+
+// StatusReporter reports the status of the filesystem on the node (mounts, fetch progress of
+// the layers, cache usage, recent errors and the throughput of fetching layers) for operators
+// without a metrics stack (e.g. on edge boxes).
+type StatusReporter struct {
+	mu         sync.Mutex
+	fs         *filesystem
+	root       string
+	errors     []ErrorStatus // ring buffer of the recent errors
+	nextError  int
+	throughput []ThroughputSample
+	lastFetch  map[digest.Digest]int64 // fetched size of each layer on the last sample
+	lastSample time.Time
+}
+
+// NewStatusReporter returns a StatusReporter. Pass it to the filesystem with
+// WithStatusReporter.
+func NewStatusReporter() *StatusReporter {
+	return &StatusReporter{}
+}
+
+// WithStatusReporter specifies the reporter of the status of the filesystem (e.g. served on
+// the debug endpoint).
+func WithStatusReporter(r *StatusReporter) Option {
+	return func(opts *options) {
+		opts.statusReporter = r
+	}
+}
+
+func (r *StatusReporter) set(fs *filesystem, root string) {
+	r.mu.Lock()
+	r.fs = fs
+	r.root = root
+	r.mu.Unlock()
+	go r.runSampler(statusSampleInterval)
+}
+
+// NodeStatus is the status of the filesystem on the node.
+type NodeStatus struct {
+	// Time is the time the status is taken.
+	Time time.Time `json:"time"`
+
+	// Mounts are the layers mounted on the node sorted by the mountpoint.
+	Mounts []MountStatus `json:"mounts"`
+
+	// Cache is the usage of the cache.
+	Cache CacheUsage `json:"cache"`
+
+	// RecentErrors are the recent errors from the newest one.
+	RecentErrors []ErrorStatus `json:"recent_errors"`
+
+	// Throughput is the throughput of fetching the layers from the oldest sample.
+	Throughput []ThroughputSample `json:"throughput"`
+}
+
+// MountStatus is the status of a mounted layer.
+type MountStatus struct {
+	// Mountpoint is the mountpoint of the layer.
+	Mountpoint string `json:"mountpoint"`
+
+	// Refs are the references of the images the layer is mounted for. Empty if the layer is
+	// mounted without the manifest digest.
+	Refs []string `json:"refs,omitempty"`
+
+	// Digest is the digest of the layer.
+	Digest digest.Digest `json:"digest"`
+
+	// Size is the size of the layer.
+	Size int64 `json:"size"`
+
+	// FetchedSize is the number of bytes of the layer fetched and cached.
+	FetchedSize int64 `json:"fetched_size"`
+
+	// PrefetchSize is the size of the prefetched part of the layer.
+	PrefetchSize int64 `json:"prefetch_size"`
+
+	// Verified is true if the contents of the layer are verified with the TOC digest.
+	Verified bool `json:"verified"`
+
+	// ReadTime is the last time the layer was read.
+	ReadTime time.Time `json:"read_time"`
+}
+
+// CacheUsage is the usage of the cache of the node.
+type CacheUsage struct {
+	// CachedSize is the number of bytes of the mounted layers cached. Layers mounted on
+	// several mountpoints are counted once.
+	CachedSize int64 `json:"cached_size"`
+
+	// LayerSize is the total size of the mounted layers. Layers mounted on several
+	// mountpoints are counted once.
+	LayerSize int64 `json:"layer_size"`
+
+	// DiskTotal is the size of the filesystem of the root directory of the snapshotter.
+	DiskTotal uint64 `json:"disk_total"`
+
+	// DiskFree is the number of bytes available on the filesystem of the root directory.
+	DiskFree uint64 `json:"disk_free"`
+}
+
+// ErrorStatus is an error of an operation of a layer.
+type ErrorStatus struct {
+	// Time is the time the error happened.
+	Time time.Time `json:"time"`
+
+	// Operation is the operation failed (e.g. "mount", "check", "prefetch").
+	Operation string `json:"operation"`
+
+	// Mountpoint is the mountpoint of the layer.
+	Mountpoint string `json:"mountpoint"`
+
+	// Digest is the digest of the layer. Empty if the layer isn't resolved.
+	Digest digest.Digest `json:"digest,omitempty"`
+
+	// Error is the message of the error.
+	Error string `json:"error"`
+}
+
+// ThroughputSample is the throughput of fetching layers over a sampling interval.
+type ThroughputSample struct {
+	// Time is the end of the sampling interval.
+	Time time.Time `json:"time"`
+
+	// BytesPerSec is the number of bytes of the mounted layers fetched per second.
+	BytesPerSec float64 `json:"bytes_per_sec"`
+}
+
+// Status returns the status of the filesystem.
+func (r *StatusReporter) Status() (NodeStatus, error) {
+	r.mu.Lock()
+	fs, root := r.fs, r.root
+	r.mu.Unlock()
+	if fs == nil {
+		return NodeStatus{}, fmt.Errorf("filesystem isn't ready")
+	}
+	st := NodeStatus{Time: time.Now()}
+	st.Mounts, st.Cache = fs.mountStatuses()
+	var sfs unix.Statfs_t
+	if root != "" && unix.Statfs(root, &sfs) == nil {
+		st.Cache.DiskTotal = sfs.Blocks * uint64(sfs.Bsize)
+		st.Cache.DiskFree = sfs.Bavail * uint64(sfs.Bsize)
+	}
+
+	r.mu.Lock()
+	for i := range len(r.errors) {
+		st.RecentErrors = append(st.RecentErrors, r.errors[(r.nextError-1-i+len(r.errors))%len(r.errors)])
+	}
+	st.Throughput = append(st.Throughput, r.throughput...)
+	r.mu.Unlock()
+	return st, nil
+}
+
+// mountStatuses returns the statuses of the mounted layers and the usage of the cache by them.
+func (fs *filesystem) mountStatuses() (mounts []MountStatus, usage CacheUsage) {
+	fs.layerMu.Lock()
+	defer fs.layerMu.Unlock()
+	counted := make(map[digest.Digest]bool)
+	for mp, l := range fs.layer {
+		info := l.Info()
+		m := MountStatus{
+			Mountpoint:   mp,
+			Digest:       info.Digest,
+			Size:         info.Size,
+			FetchedSize:  min(info.FetchedSize, info.Size),
+			PrefetchSize: info.PrefetchSize,
+			Verified:     info.Verified,
+			ReadTime:     info.ReadTime,
+		}
+		for _, img := range fs.images {
+			if _, ok := img.mountpoints[mp]; ok {
+				for ref := range img.refs {
+					m.Refs = append(m.Refs, ref)
+				}
+			}
+		}
+		sort.Strings(m.Refs)
+		mounts = append(mounts, m)
+		if !counted[info.Digest] {
+			counted[info.Digest] = true
+			usage.CachedSize += m.FetchedSize
+			usage.LayerSize += m.Size
+		}
+	}
+	sort.Slice(mounts, func(i, j int) bool { return mounts[i].Mountpoint < mounts[j].Mountpoint })
+	return mounts, usage
+}
+
+// recordError records the error of the operation of the layer mounted on the mountpoint.
+// This is a nop if r is nil.
+func (r *StatusReporter) recordError(op, mountpoint string, dgst digest.Digest, err error) {
+	if r == nil || err == nil {
+		return
+	}
+	e := ErrorStatus{
+		Time:       time.Now(),
+		Operation:  op,
+		Mountpoint: mountpoint,
+		Digest:     dgst,
+		Error:      err.Error(),
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.errors) < maxRecentErrors {
+		r.errors = append(r.errors, e)
+	} else {
+		r.errors[r.nextError] = e
+	}
+	r.nextError = (r.nextError + 1) % maxRecentErrors
+}
+
+// runSampler samples the throughput of fetching the mounted layers every interval.
+func (r *StatusReporter) runSampler(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		r.sample(now)
+	}
+}
+
+// sample records the throughput since the last sample, computed from the growth of the
+// fetched size of the layers mounted on both samples.
+func (r *StatusReporter) sample(now time.Time) {
+	r.mu.Lock()
+	fs := r.fs
+	r.mu.Unlock()
+	mounts, _ := fs.mountStatuses()
+	fetched := make(map[digest.Digest]int64)
+	for _, m := range mounts {
+		fetched[m.Digest] = m.FetchedSize
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.lastSample.IsZero() {
+		var total int64
+		for dgst, size := range fetched {
+			if last, ok := r.lastFetch[dgst]; ok && size > last {
+				total += size - last
+			}
+		}
+		var rate float64
+		if d := now.Sub(r.lastSample).Seconds(); d > 0 {
+			rate = float64(total) / d
+		}
+		r.throughput = append(r.throughput, ThroughputSample{Time: now, BytesPerSec: rate})
+		if len(r.throughput) > maxThroughputSamples {
+			r.throughput = r.throughput[len(r.throughput)-maxThroughputSamples:]
+		}
+	}
+	r.lastFetch, r.lastSample = fetched, now
+}
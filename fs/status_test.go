@@ -0,0 +1,107 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/v2/pkg/reference"
+	"github.com/containerd/stargz-snapshotter/fs/layer"
+	"github.com/containerd/stargz-snapshotter/fs/source"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestStatusReport(t *testing.T) {
+	var (
+		base = digest.FromString("base")
+		app  = digest.FromString("app")
+		img  = digest.FromString("image")
+	)
+	appLayer := &cachedLayer{info: layer.Info{Digest: app, Size: 300, FetchedSize: 60, Verified: true}}
+	fs := &filesystem{layer: map[string]layer.Layer{
+		"/mnt/1": &cachedLayer{info: layer.Info{Digest: base, Size: 100, FetchedSize: 100}},
+		"/mnt/2": appLayer,
+		"/mnt/3": appLayer,
+	}}
+	s := source.Source{Name: reference.Spec{Locator: "example.com/app", Object: "latest"}, ManifestDigest: img}
+	s.Manifest.Layers = []ocispec.Descriptor{{Digest: base, Size: 100}, {Digest: app, Size: 300}}
+	fs.addImage("/mnt/1", s)
+
+	r := NewStatusReporter()
+	if _, err := r.Status(); err == nil {
+		t.Fatalf("reporting without the filesystem must fail")
+	}
+	r.fs, r.root = fs, t.TempDir()
+	got, err := r.Status()
+	if err != nil {
+		t.Fatalf("failed to report: %v", err)
+	}
+	wantMounts := []MountStatus{
+		{Mountpoint: "/mnt/1", Refs: []string{"example.com/app:latest"}, Digest: base, Size: 100, FetchedSize: 100},
+		{Mountpoint: "/mnt/2", Digest: app, Size: 300, FetchedSize: 60, Verified: true},
+		{Mountpoint: "/mnt/3", Digest: app, Size: 300, FetchedSize: 60, Verified: true},
+	}
+	if !reflect.DeepEqual(got.Mounts, wantMounts) {
+		t.Errorf("mounts = %+v; want %+v", got.Mounts, wantMounts)
+	}
+	// The layer mounted twice is counted once.
+	if got.Cache.CachedSize != 160 || got.Cache.LayerSize != 400 {
+		t.Errorf("cache usage = %+v; want cached 160 of 400", got.Cache)
+	}
+	if got.Cache.DiskTotal == 0 || got.Cache.DiskFree > got.Cache.DiskTotal {
+		t.Errorf("unexpected disk usage %+v", got.Cache)
+	}
+
+	// Only the latest errors are kept from the newest one.
+	var nilReporter *StatusReporter
+	nilReporter.recordError("mount", "/mnt/1", "", fmt.Errorf("ignored"))
+	r.recordError("mount", "/mnt/1", "", nil)
+	for i := range maxRecentErrors + 2 {
+		r.recordError("check", "/mnt/2", app, fmt.Errorf("error %d", i))
+	}
+	got, _ = r.Status()
+	if len(got.RecentErrors) != maxRecentErrors {
+		t.Fatalf("%d errors are reported; want %d", len(got.RecentErrors), maxRecentErrors)
+	}
+	if first, last := got.RecentErrors[0], got.RecentErrors[maxRecentErrors-1]; first.Error != fmt.Sprintf("error %d", maxRecentErrors+1) ||
+		last.Error != "error 2" || first.Operation != "check" || first.Digest != app {
+		t.Errorf("unexpected errors: newest %+v, oldest %+v", first, last)
+	}
+
+	// Throughput is computed from the growth of the fetched size of the layers mounted on
+	// both samples.
+	now := time.Now()
+	r.sample(now)
+	appLayer.info.FetchedSize = 160
+	fs.layer["/mnt/4"] = &cachedLayer{info: layer.Info{Digest: digest.FromString("new"), Size: 1000, FetchedSize: 1000}}
+	r.sample(now.Add(2 * time.Second))
+	got, _ = r.Status()
+	want := []ThroughputSample{{Time: now.Add(2 * time.Second), BytesPerSec: 50}}
+	if !reflect.DeepEqual(got.Throughput, want) {
+		t.Errorf("throughput = %+v; want %+v", got.Throughput, want)
+	}
+	for i := range maxThroughputSamples + 1 {
+		r.sample(now.Add(time.Duration(i+3) * time.Second))
+	}
+	if got, _ := r.Status(); len(got.Throughput) != maxThroughputSamples {
+		t.Errorf("%d samples are kept; want %d", len(got.Throughput), maxThroughputSamples)
+	}
+}
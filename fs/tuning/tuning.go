@@ -0,0 +1,220 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package tuning holds the parameters of fetching layer contents that can be changed
+// while the snapshotter is running (e.g. to throttle it during incidents) without
+// restarting it or editing the configuration file.
+package tuning
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	minBurst = 4 * 1024
+	maxBurst = 1024 * 1024
+)
+
+// Params are the parameters of fetching layer contents.
+type Params struct {
+	// MaxConcurrency is the max number of concurrent background tasks for fetching
+	// layer contents. This must be positive.
+	MaxConcurrency int64 `json:"max_concurrency"`
+
+	// PrefetchChunkSize is the maximum bytes transferred per http GET during prefetch.
+	// 0 fetches prefetched bytes as a single http GET.
+	PrefetchChunkSize int64 `json:"prefetch_chunk_size"`
+
+	// BandwidthLimit is the maximum bytes per second fetched from remote registries.
+	// 0 means unlimited.
+	BandwidthLimit int64 `json:"bandwidth_limit"`
+
+	// BackgroundBandwidthLimit is the maximum bytes per second fetched by prefetch and
+	// background fetch, in addition to BandwidthLimit. 0 means unlimited.
+	BackgroundBandwidthLimit int64 `json:"background_bandwidth_limit"`
+}
+
+// Update returns the update that sets all fields to p.
+func (p Params) Update() Update {
+	return Update{
+		MaxConcurrency:           &p.MaxConcurrency,
+		PrefetchChunkSize:        &p.PrefetchChunkSize,
+		BandwidthLimit:           &p.BandwidthLimit,
+		BackgroundBandwidthLimit: &p.BackgroundBandwidthLimit,
+	}
+}
+
+// Update is a partial update of Params. Nil fields are left unchanged.
+type Update struct {
+	MaxConcurrency           *int64 `json:"max_concurrency,omitempty"`
+	PrefetchChunkSize        *int64 `json:"prefetch_chunk_size,omitempty"`
+	BandwidthLimit           *int64 `json:"bandwidth_limit,omitempty"`
+	BackgroundBandwidthLimit *int64 `json:"background_bandwidth_limit,omitempty"`
+}
+
+// Tuner holds the current Params and applies them to the components fetching layer
+// contents. Methods of a nil Tuner are no-op.
+type Tuner struct {
+	params   Params
+	watchers []func(Params)
+	mu       sync.Mutex
+
+	bandwidth           *rate.Limiter
+	backgroundBandwidth *rate.Limiter
+}
+
+// New returns a Tuner. The params are zero until the initial params are applied (e.g.
+// by the filesystem using it).
+func New() *Tuner {
+	return &Tuner{
+		bandwidth:           rate.NewLimiter(rate.Inf, 0),
+		backgroundBandwidth: rate.NewLimiter(rate.Inf, 0),
+	}
+}
+
+// Params returns the current params.
+func (t *Tuner) Params() Params {
+	if t == nil {
+		return Params{}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.params
+}
+
+// Apply updates the params and notifies the watchers. The updated params are returned.
+func (t *Tuner) Apply(u Update) (Params, error) {
+	if t == nil {
+		return Params{}, fmt.Errorf("tuning isn't available")
+	}
+	t.mu.Lock()
+	p := t.params
+	if u.MaxConcurrency != nil {
+		p.MaxConcurrency = *u.MaxConcurrency
+	}
+	if u.PrefetchChunkSize != nil {
+		p.PrefetchChunkSize = *u.PrefetchChunkSize
+	}
+	if u.BandwidthLimit != nil {
+		p.BandwidthLimit = *u.BandwidthLimit
+	}
+	if u.BackgroundBandwidthLimit != nil {
+		p.BackgroundBandwidthLimit = *u.BackgroundBandwidthLimit
+	}
+	if err := validate(p); err != nil {
+		t.mu.Unlock()
+		return Params{}, err
+	}
+	t.set(p)
+	watchers := append([]func(Params){}, t.watchers...)
+	t.mu.Unlock()
+
+	for _, f := range watchers {
+		f(p)
+	}
+	return p, nil
+}
+
+// Watch registers a function called with the new params every time they are updated.
+func (t *Tuner) Watch(f func(Params)) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.watchers = append(t.watchers, f)
+	t.mu.Unlock()
+}
+
+// Reader returns a reader that reads r within the bandwidth limits. Reads of background
+// fetches are limited by BackgroundBandwidthLimit as well. Waiting for the bandwidth
+// respects the deadline and cancellation of ctx.
+func (t *Tuner) Reader(ctx context.Context, r io.Reader, background bool) io.Reader {
+	if t == nil {
+		return r
+	}
+	limiters := []*rate.Limiter{t.bandwidth}
+	if background {
+		limiters = append(limiters, t.backgroundBandwidth)
+	}
+	return &limitedReader{ctx: ctx, r: r, limiters: limiters}
+}
+
+func (t *Tuner) set(p Params) {
+	t.params = p
+	setLimit(t.bandwidth, p.BandwidthLimit)
+	setLimit(t.backgroundBandwidth, p.BackgroundBandwidthLimit)
+}
+
+func validate(p Params) error {
+	switch {
+	case p.MaxConcurrency <= 0:
+		return fmt.Errorf("max_concurrency must be positive but got %d", p.MaxConcurrency)
+	case p.PrefetchChunkSize < 0:
+		return fmt.Errorf("prefetch_chunk_size must not be negative but got %d", p.PrefetchChunkSize)
+	case p.BandwidthLimit < 0:
+		return fmt.Errorf("bandwidth_limit must not be negative but got %d", p.BandwidthLimit)
+	case p.BackgroundBandwidthLimit < 0:
+		return fmt.Errorf("background_bandwidth_limit must not be negative but got %d", p.BackgroundBandwidthLimit)
+	}
+	return nil
+}
+
+func setLimit(l *rate.Limiter, bytesPerSec int64) {
+	if bytesPerSec == 0 {
+		l.SetLimit(rate.Inf)
+		return
+	}
+	l.SetLimit(rate.Limit(bytesPerSec))
+	l.SetBurst(int(min(max(bytesPerSec, minBurst), maxBurst)))
+}
+
+type limitedReader struct {
+	ctx      context.Context
+	r        io.Reader
+	limiters []*rate.Limiter
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	burst := -1
+	for _, l := range lr.limiters {
+		if l.Limit() != rate.Inf && (burst < 0 || l.Burst() < burst) {
+			burst = l.Burst()
+		}
+	}
+	if burst < 0 {
+		return lr.r.Read(p) // unlimited
+	}
+	if len(p) > burst {
+		p = p[:burst]
+	}
+	n, err := lr.r.Read(p)
+	if n > 0 {
+		for _, l := range lr.limiters {
+			if l.Limit() == rate.Inf {
+				continue
+			}
+			if wErr := l.WaitN(lr.ctx, min(n, l.Burst())); wErr != nil {
+				return n, fmt.Errorf("failed to wait for bandwidth: %w", wErr)
+			}
+		}
+	}
+	return n, err
+}
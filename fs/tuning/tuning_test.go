@@ -0,0 +1,91 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package tuning
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestApply(t *testing.T) {
+	tuner := New()
+	if _, err := tuner.Apply(Params{MaxConcurrency: 2}.Update()); err != nil {
+		t.Fatal(err)
+	}
+	var notified []Params
+	tuner.Watch(func(p Params) { notified = append(notified, p) })
+
+	one, negative := int64(1), int64(-1)
+	p, err := tuner.Apply(Update{MaxConcurrency: &one})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Params{MaxConcurrency: 1}); p != want || tuner.Params() != want {
+		t.Errorf("params = %+v; want %+v", p, want)
+	}
+	if _, err := tuner.Apply(Update{BandwidthLimit: &negative}); err == nil {
+		t.Errorf("invalid update must fail")
+	}
+	if tuner.Params().BandwidthLimit != 0 {
+		t.Errorf("invalid update must not be applied")
+	}
+	if len(notified) != 1 || notified[0].MaxConcurrency != 1 {
+		t.Errorf("unexpected notifications %+v", notified)
+	}
+	zero := int64(0)
+	if _, err := tuner.Apply(Update{MaxConcurrency: &zero}); err == nil {
+		t.Errorf("zero concurrency must be invalid")
+	}
+}
+
+func TestReader(t *testing.T) {
+	const limit = 100 * 1024
+	data := bytes.Repeat([]byte("a"), 3*limit)
+	tests := []struct {
+		name       string
+		params     Params
+		background bool
+		limited    bool
+	}{
+		{name: "unlimited", params: Params{MaxConcurrency: 1, BackgroundBandwidthLimit: limit}},
+		{name: "limited", params: Params{MaxConcurrency: 1, BandwidthLimit: limit}, limited: true},
+		{name: "background", params: Params{MaxConcurrency: 1, BackgroundBandwidthLimit: limit}, background: true, limited: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tuner := New()
+			if _, err := tuner.Apply(tt.params.Update()); err != nil {
+				t.Fatal(err)
+			}
+			start := time.Now()
+			got, err := io.ReadAll(tuner.Reader(context.Background(), bytes.NewReader(data), tt.background))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatalf("unexpected data")
+			}
+			// The first burst is read immediately so reading 3*limit bytes takes about 2 secs.
+			if elapsed := time.Since(start); tt.limited != (elapsed > time.Second) {
+				t.Errorf("read in %v; limited=%v", elapsed, tt.limited)
+			}
+		})
+	}
+}
@@ -27,6 +27,7 @@ import (
 	"os/signal"
 	"path/filepath"
 	"syscall"
+	"time"
 
 	"github.com/containerd/log"
 	"github.com/sirupsen/logrus"
@@ -37,6 +38,9 @@ import (
 	"github.com/containerd/stargz-snapshotter/version"
 )
 
+// shutdownFlushTimeout bounds the time to write the cached data on exit.
+const shutdownFlushTimeout = 10 * time.Second
+
 var (
 	versionFlag   bool
 	fuseStoreAddr string
@@ -216,6 +220,12 @@ func runFuseManager(ctx context.Context) error {
 	}
 
 	server.Stop()
+	// The mounts are left to the next FUSE manager so write the cached data to be resumed.
+	flushCtx, cancel := context.WithTimeout(ctx, shutdownFlushTimeout)
+	if err := fm.Flush(flushCtx); err != nil {
+		log.G(ctx).WithError(err).Warn("failed to flush caches")
+	}
+	cancel()
 	if err = fm.Close(ctx); err != nil {
 		return fmt.Errorf("failed to close fuse manager: %w", err)
 	}
@@ -19,6 +19,7 @@ package fusemanager
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"os"
@@ -322,6 +323,30 @@ func (fm *Server) Unmount(ctx context.Context, req *pb.UnmountRequest) (*pb.Resp
 	return &pb.Response{}, nil
 }
 
+// Flush writes the data of the mounted layers kept in memory to the disk so the layers
+// can be resumed by the next FUSE manager.
+func (fm *Server) Flush(ctx context.Context) error {
+	fm.lock.RLock()
+	defer fm.lock.RUnlock()
+	fss := make(map[snapshot.FileSystem]struct{})
+	if fm.curFs != nil {
+		fss[fm.curFs] = struct{}{}
+	}
+	fm.fsMap.Range(func(_, obj any) bool {
+		fss[obj.(snapshot.FileSystem)] = struct{}{}
+		return true
+	})
+	var errs []error
+	for fs := range fss {
+		if f, ok := fs.(snapshot.Flusher); ok {
+			if err := f.Flush(ctx); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
 func (fm *Server) Close(ctx context.Context) error {
 	fm.lock.Lock()
 	defer fm.lock.Unlock()
@@ -0,0 +1,159 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package memory
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/containerd/stargz-snapshotter/estargz/zstdchunked"
+	"github.com/containerd/stargz-snapshotter/metadata"
+	"github.com/containerd/stargz-snapshotter/util/testutil"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Blobs are pulled from untrusted registries so parsing malformed blobs must fail
+// with an error instead of panicking. Run these targets with "go test -fuzz".
+
+// fuzzDecompressors are the decompressors used for parsing blobs in the fuzz targets.
+func fuzzDecompressors() []metadata.Decompressor {
+	return []metadata.Decompressor{
+		new(estargz.GzipDecompressor),
+		new(estargz.LegacyGzipDecompressor),
+		new(zstdchunked.Decompressor),
+	}
+}
+
+// addSeedBlobs adds valid eStargz and zstd:chunked blobs to the corpus. part returns the
+// bytes of the blob added to the corpus.
+func addSeedBlobs(f *testing.F, part func(f *testing.F, blob []byte, d estargz.Decompressor) []byte) {
+	ents := []testutil.TarEntry{
+		testutil.Dir("foo/", testutil.WithDirXattrs(map[string]string{"user.foo": "bar"})),
+		testutil.File("foo/small", "hello"),
+		testutil.File("foo/large", strings.Repeat("abcd", 1000)),
+		testutil.File("foo/empty", ""),
+		testutil.Symlink("foo/link", "small"),
+		testutil.Link("foo/hardlink", "foo/small"),
+		testutil.Chardev("dev", 1, 2),
+		testutil.Fifo("fifo"),
+	}
+	for _, cf := range []testutil.CompressionFactory{
+		testutil.GzipCompressionWithLevel(gzip.BestSpeed),
+		testutil.ZstdCompressionWithLevel(zstd.SpeedFastest),
+	} {
+		c := cf()
+		sr, _, err := testutil.BuildEStargz(ents, testutil.WithEStargzOptions(
+			estargz.WithCompression(c),
+			estargz.WithChunkSize(1000),
+			estargz.WithPrioritizedFiles([]string{"foo/small"}),
+		))
+		if err != nil {
+			f.Fatalf("failed to build seed blob: %v", err)
+		}
+		blob, err := io.ReadAll(sr)
+		if err != nil {
+			f.Fatalf("failed to read seed blob: %v", err)
+		}
+		f.Add(part(f, blob, c))
+	}
+}
+
+// tocOf returns the compressed TOC of the blob.
+func tocOf(f *testing.F, blob []byte, d estargz.Decompressor) []byte {
+	fSize := d.FooterSize()
+	if int64(len(blob)) < fSize {
+		fSize = int64(len(blob))
+	}
+	_, tocOffset, tocSize, err := d.ParseFooter(blob[int64(len(blob))-fSize:])
+	if err != nil {
+		f.Fatalf("failed to parse footer of seed blob: %v", err)
+	}
+	if tocSize <= 0 {
+		tocSize = int64(len(blob)) - tocOffset - fSize
+	}
+	return blob[tocOffset : tocOffset+tocSize]
+}
+
+// FuzzNewReader tests that the reader doesn't panic on arbitrary blobs and on reading
+// the files of blobs successfully parsed.
+func FuzzNewReader(f *testing.F) {
+	addSeedBlobs(f, func(_ *testing.F, blob []byte, _ estargz.Decompressor) []byte { return blob })
+	f.Fuzz(func(t *testing.T, blob []byte) {
+		r, err := NewReader(io.NewSectionReader(bytes.NewReader(blob), 0, int64(len(blob))),
+			metadata.WithDecompressors(fuzzDecompressors()...))
+		if err != nil {
+			return
+		}
+		defer r.Close()
+		walk(r, r.RootID(), 0)
+	})
+}
+
+// walk reads the attributes and the head of the contents of all files under the directory.
+func walk(r metadata.Reader, id uint32, depth int) {
+	if depth > 100 {
+		return
+	}
+	r.ForeachChild(id, func(name string, cid uint32, mode os.FileMode) bool {
+		if _, err := r.GetAttr(cid); err != nil {
+			return true
+		}
+		if mode.IsDir() {
+			walk(r, cid, depth+1)
+			return true
+		}
+		if f, err := r.OpenFile(cid); err == nil {
+			f.ReadAt(make([]byte, 4096), 0)
+			f.ChunkEntryForOffset(0)
+		}
+		return true
+	})
+}
+
+// FuzzParseFooter tests that parsing footers doesn't panic.
+func FuzzParseFooter(f *testing.F) {
+	addSeedBlobs(f, func(_ *testing.F, blob []byte, d estargz.Decompressor) []byte {
+		return blob[max(0, int64(len(blob))-d.FooterSize()):]
+	})
+	f.Fuzz(func(t *testing.T, footer []byte) {
+		for _, d := range fuzzDecompressors() {
+			if int64(len(footer)) > d.FooterSize() {
+				continue
+			}
+			d.ParseFooter(footer)
+		}
+	})
+}
+
+// FuzzParseTOC tests that decompressing and decoding TOCs doesn't panic.
+func FuzzParseTOC(f *testing.F) {
+	addSeedBlobs(f, tocOf)
+	f.Fuzz(func(t *testing.T, toc []byte) {
+		for _, d := range fuzzDecompressors() {
+			d.ParseTOC(bytes.NewReader(toc))
+			if rc, err := d.DecompressTOC(bytes.NewReader(toc)); err == nil {
+				io.Copy(io.Discard, io.LimitReader(rc, 1<<20))
+				rc.Close()
+			}
+		}
+	})
+}
@@ -21,6 +21,8 @@ import (
 	"io"
 	"math"
 	"os"
+	"path"
+	"sort"
 	"time"
 
 	"github.com/containerd/stargz-snapshotter/estargz"
@@ -34,12 +36,14 @@ type reader struct {
 
 	idMap     map[uint32]*estargz.TOCEntry
 	idOfEntry map[string]uint32
+	folded    map[uint32]map[string]uint32 // non-nil in case-insensitive lookup mode
+	dirStats  map[uint32]metadata.DirStats
 
 	estargzOpts []estargz.OpenOption
 }
 
-func newReader(er *estargz.Reader, rootID uint32, idMap map[uint32]*estargz.TOCEntry, idOfEntry map[string]uint32, estargzOpts []estargz.OpenOption) *reader {
-	return &reader{r: er, rootID: rootID, idMap: idMap, idOfEntry: idOfEntry, estargzOpts: estargzOpts}
+func newReader(er *estargz.Reader, rootID uint32, idMap map[uint32]*estargz.TOCEntry, idOfEntry map[string]uint32, folded map[uint32]map[string]uint32, dirStats map[uint32]metadata.DirStats, estargzOpts []estargz.OpenOption) *reader {
+	return &reader{r: er, rootID: rootID, idMap: idMap, idOfEntry: idOfEntry, folded: folded, dirStats: dirStats, estargzOpts: estargzOpts}
 }
 
 func NewReader(sr *io.SectionReader, opts ...metadata.Option) (metadata.Reader, error) {
@@ -78,10 +82,69 @@ func NewReader(sr *io.SectionReader, opts ...metadata.Option) (metadata.Reader,
 	if err != nil {
 		return nil, err
 	}
-	r := newReader(er, rootID, idMap, idOfEntry, erOpts)
+	var folded map[uint32]map[string]uint32
+	if rOpts.CaseInsensitive {
+		if folded, err = foldChildren(idMap, idOfEntry); err != nil {
+			return nil, err
+		}
+	}
+	r := newReader(er, rootID, idMap, idOfEntry, folded, dirStatsOf(root, idOfEntry), erOpts)
 	return r, nil
 }
 
+// dirStatsOf returns the aggregates of each directory under the root.
+func dirStatsOf(root *estargz.TOCEntry, idOfEntry map[string]uint32) map[uint32]metadata.DirStats {
+	stats := make(map[uint32]metadata.DirStats)
+	var walk func(dir string, e *estargz.TOCEntry) metadata.DirStats
+	walk = func(dir string, e *estargz.TOCEntry) (s metadata.DirStats) {
+		e.ForeachChild(func(baseName string, ent *estargz.TOCEntry) bool {
+			s.Entries++
+			name := path.Join(dir, baseName)
+			switch {
+			case ent.Type == "dir":
+				cs := walk(name, ent)
+				s.Size += cs.Size
+				s.Entries += cs.Entries
+			case ent.Type == "reg" && ent.Name == name:
+				s.Size += ent.Size // hardlinks are counted at the first name
+			}
+			return true
+		})
+		stats[idOfEntry[e.Name]] = s
+		return s
+	}
+	walk("", root)
+	return stats
+}
+
+// foldChildren returns the index of the children of each directory keyed by the case-folded names.
+func foldChildren(idMap map[uint32]*estargz.TOCEntry, idOfEntry map[string]uint32) (map[uint32]map[string]uint32, error) {
+	folded := make(map[uint32]map[string]uint32)
+	for id, e := range idMap {
+		if e.Type != "dir" {
+			continue
+		}
+		children := make(map[string]uint32)
+		names := make(map[string]string)
+		var err error
+		e.ForeachChild(func(baseName string, ent *estargz.TOCEntry) bool {
+			key := metadata.FoldName(baseName)
+			if other, ok := names[key]; ok {
+				err = fmt.Errorf("%q and %q in %q: %w", other, baseName, e.Name, metadata.ErrCaseConflict)
+				return false
+			}
+			names[key] = baseName
+			children[key] = idOfEntry[ent.Name]
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+		folded[id] = children
+	}
+	return folded, nil
+}
+
 // assignIDs assigns an to each TOC item and returns a mapping from ID to entry and vice-versa.
 func assignIDs(er *estargz.Reader, e *estargz.TOCEntry) (rootID uint32, idMap map[uint32]*estargz.TOCEntry, idOfEntry map[string]uint32, err error) {
 	idMap = make(map[uint32]*estargz.TOCEntry)
@@ -113,12 +176,20 @@ func assignIDs(er *estargz.Reader, e *estargz.TOCEntry) (rootID uint32, idMap ma
 			idOfEntry[e.Name] = id
 		}
 
-		e.ForeachChild(func(_ string, ent *estargz.TOCEntry) bool {
-			_, err = mapChildren(ent)
-			return err == nil
+		// Children are visited in the order of names so that the same layer always gets
+		// the same IDs (and inode numbers) regardless of the node where it's mounted.
+		var names []string
+		children := make(map[string]*estargz.TOCEntry)
+		e.ForeachChild(func(baseName string, ent *estargz.TOCEntry) bool {
+			names = append(names, baseName)
+			children[baseName] = ent
+			return true
 		})
-		if err != nil {
-			return 0, err
+		sort.Strings(names)
+		for _, name := range names {
+			if _, err := mapChildren(children[name]); err != nil {
+				return 0, err
+			}
 		}
 		return id, nil
 	}
@@ -139,6 +210,18 @@ func (r *reader) TOCDigest() digest.Digest {
 	return r.r.TOCDigest()
 }
 
+func (r *reader) HasBaseChunks() (bool, error) {
+	return r.r.HasBaseChunks(), nil
+}
+
+func (r *reader) VerifiableRanges(offset, size int64) []estargz.CompressedRange {
+	return r.r.VerifiableRanges(offset, size)
+}
+
+func (r *reader) VerifyRange(cr estargz.CompressedRange, p []byte) error {
+	return r.r.VerifyRange(cr, p)
+}
+
 func (r *reader) GetOffset(id uint32) (offset int64, err error) {
 	e, ok := r.idMap[id]
 	if !ok {
@@ -165,6 +248,12 @@ func (r *reader) GetChild(pid uint32, base string) (id uint32, attr metadata.Att
 		return
 	}
 	child, ok := e.LookupChild(base)
+	if !ok && r.folded != nil {
+		var fid uint32
+		if fid, ok = r.folded[pid][metadata.FoldName(base)]; ok {
+			child = r.idMap[fid]
+		}
+	}
 	if !ok {
 		err = fmt.Errorf("child %q of entry %d not found", base, pid)
 		return
@@ -196,6 +285,47 @@ func (r *reader) ForeachChild(id uint32, f func(name string, id uint32, mode os.
 	return err
 }
 
+func (r *reader) GetParent(id uint32) (pid uint32, err error) {
+	e, ok := r.idMap[id]
+	if !ok {
+		return 0, fmt.Errorf("entry %d not found", id)
+	}
+	if id == r.rootID {
+		return r.rootID, nil
+	}
+	dir := path.Dir(e.Name)
+	if dir == "." {
+		return r.rootID, nil
+	}
+	pid, ok = r.idOfEntry[dir]
+	if !ok {
+		return 0, fmt.Errorf("id of parent entry %q not found", dir)
+	}
+	return pid, nil
+}
+
+func (r *reader) PathOf(id uint32) (string, error) {
+	e, ok := r.idMap[id]
+	if !ok {
+		return "", fmt.Errorf("entry %d not found", id)
+	}
+	if id == r.rootID {
+		return "/", nil
+	}
+	return "/" + e.Name, nil
+}
+
+func (r *reader) DirStats(id uint32) (metadata.DirStats, error) {
+	e, ok := r.idMap[id]
+	if !ok {
+		return metadata.DirStats{}, fmt.Errorf("entry %d not found", id)
+	}
+	if e.Type != "dir" {
+		return metadata.DirStats{}, fmt.Errorf("entry %d isn't a directory", id)
+	}
+	return r.dirStats[id], nil
+}
+
 func (r *reader) OpenFile(id uint32) (metadata.File, error) {
 	e, ok := r.idMap[id]
 	if !ok {
@@ -227,12 +357,9 @@ func (r *reader) OpenFileWithPreReader(id uint32, preRead func(id uint32, chunkO
 }
 
 func (r *reader) Clone(sr *io.SectionReader) (metadata.Reader, error) {
-	er, err := estargz.Open(sr, r.estargzOpts...)
-	if err != nil {
-		return nil, err
-	}
-
-	return newReader(er, r.rootID, r.idMap, r.idOfEntry, r.estargzOpts), nil
+	// The parsed TOC is shared with the cloned reader. Entries aren't modified after
+	// the reader is created.
+	return newReader(r.r.Clone(sr), r.rootID, r.idMap, r.idOfEntry, r.folded, r.dirStats, r.estargzOpts), nil
 }
 
 func (r *reader) Close() error {
@@ -259,6 +386,20 @@ func (r *file) ChunkEntryForOffset(offset int64) (off int64, size int64, dgst st
 	return e.ChunkOffset, e.ChunkSize, dgst, true
 }
 
+func (r *file) FileDigest() string {
+	return r.e.Digest
+}
+
+func (r *file) IsHole(offset int64) bool {
+	e, ok := r.r.r.ChunkEntryForOffset(r.e.Name, offset)
+	return ok && e.Hole
+}
+
+func (r *file) IsBaseChunk(offset int64) bool {
+	e, ok := r.r.r.ChunkEntryForOffset(r.e.Name, offset)
+	return ok && e.BaseChunk
+}
+
 func (r *file) ReadAt(p []byte, off int64) (n int, err error) {
 	return r.sr.ReadAt(p, off)
 }
@@ -19,8 +19,10 @@ package metadata
 import (
 	"io"
 	"os"
+	"strings"
 	"time"
 
+	"github.com/containerd/stargz-snapshotter/errdefs"
 	"github.com/containerd/stargz-snapshotter/estargz"
 	digest "github.com/opencontainers/go-digest"
 )
@@ -58,6 +60,18 @@ type Attr struct {
 	NumLink int
 }
 
+// DirStats is the aggregates of the nodes under a directory, computed when the reader is
+// created so that they are available without walking the tree.
+type DirStats struct {
+	// Size is the total logical size of the regular files under the directory including
+	// subdirectories. A file with several names is counted only at its first name in the TOC.
+	Size int64
+
+	// Entries is the number of the names under the directory including subdirectories and
+	// the names under them.
+	Entries int64
+}
+
 // Store reads the provided eStargz blob and creates a metadata reader.
 type Store func(sr *io.SectionReader, opts ...Option) (Reader, error)
 
@@ -70,6 +84,19 @@ type Reader interface {
 	GetAttr(id uint32) (attr Attr, err error)
 	GetChild(pid uint32, base string) (id uint32, attr Attr, err error)
 	ForeachChild(id uint32, f func(name string, id uint32, mode os.FileMode) bool) error
+
+	// GetParent returns the ID of the directory containing the node. A node with
+	// several names (i.e. a hardlinked file) belongs to the directory of its first
+	// name in the TOC. The parent of the root is the root.
+	GetParent(id uint32) (pid uint32, err error)
+
+	// PathOf returns the absolute path of the node in the filesystem (e.g. "/a/b").
+	// The first name in the TOC is used for a node with several names.
+	PathOf(id uint32) (string, error)
+
+	// DirStats returns the aggregates of the nodes under the directory.
+	DirStats(id uint32) (DirStats, error)
+
 	OpenFile(id uint32) (File, error)
 	OpenFileWithPreReader(id uint32, preRead func(id uint32, chunkOffset, chunkSize int64, chunkDigest string, r io.Reader) error) (File, error)
 
@@ -82,6 +109,59 @@ type File interface {
 	ReadAt(p []byte, off int64) (n int, err error)
 }
 
+// HoleChecker is an optional interface of File that reports holes of sparse files.
+// Holes are filled with zeros and aren't stored in the blob.
+type HoleChecker interface {
+	// IsHole returns true if the chunk containing the offset is a hole.
+	IsHole(offset int64) bool
+}
+
+// BaseChunkChecker is an optional interface of File that reports chunks of a delta blob
+// stored in its base blob. These chunks need to be resolved from the base blob.
+type BaseChunkChecker interface {
+	// IsBaseChunk returns true if the chunk containing the offset is stored in the base blob.
+	IsBaseChunk(offset int64) bool
+}
+
+// FileDigester is an optional interface of File that reports the digest of the whole
+// contents of the file recorded in the TOC.
+type FileDigester interface {
+	// FileDigest returns the digest of the file. An empty string is returned if the TOC
+	// doesn't record it.
+	FileDigest() string
+}
+
+// BaseChunksReporter is an optional interface of Reader that reports whether the blob is a
+// delta blob that has chunks stored in its base blob (see BaseChunkChecker).
+type BaseChunksReporter interface {
+	// HasBaseChunks returns true if the blob has chunks stored in its base blob. This is
+	// recorded when the TOC is parsed so callers can skip walking the files of the other
+	// blobs.
+	HasBaseChunks() (bool, error)
+}
+
+// HasBaseChunks returns true if the blob of the reader has chunks stored in its base blob.
+// false is returned if the reader doesn't implement BaseChunksReporter.
+func HasBaseChunks(r Reader) (bool, error) {
+	if br, ok := r.(BaseChunksReporter); ok {
+		return br.HasBaseChunks()
+	}
+	return false, nil
+}
+
+// RangeVerifier is an optional interface of Reader that verifies ranges of the blob
+// against the digests of the chunks recorded in the TOC, so the contents of the blob can be
+// verified while they are fetched.
+type RangeVerifier interface {
+	// VerifiableRanges returns the ranges wholly contained in size bytes at offset of the
+	// blob that can be verified with VerifyRange, sorted by the offset.
+	VerifiableRanges(offset, size int64) []estargz.CompressedRange
+
+	// VerifyRange checks p, the compressed data of the range, against the digests of the
+	// chunks in it.
+	VerifyRange(r estargz.CompressedRange, p []byte) error
+}
+
 type Decompressor interface {
 	estargz.Decompressor
 
@@ -93,10 +173,15 @@ type Decompressor interface {
 	DecompressTOC(io.Reader) (tocJSON io.ReadCloser, err error)
 }
 
+// ErrCaseConflict is returned by readers in the case-insensitive lookup mode when a
+// directory contains names that differ only in case.
+var ErrCaseConflict = errdefs.New(errdefs.KindInvalid, "names conflict in case-insensitive lookup")
+
 type Options struct {
-	TOCOffset     int64
-	Telemetry     *Telemetry
-	Decompressors []Decompressor
+	TOCOffset       int64
+	Telemetry       *Telemetry
+	Decompressors   []Decompressor
+	CaseInsensitive bool
 }
 
 // Option is an option to configure the behaviour of reader.
@@ -127,6 +212,22 @@ func WithDecompressors(decompressors ...Decompressor) Option {
 	}
 }
 
+// WithCaseInsensitiveLookup option makes GetChild fall back to matching the name
+// case-insensitively when no child has the exact name. This is useful for exporting
+// the filesystem to case-insensitive consumers (e.g. SMB clients).
+// The reader fails with ErrCaseConflict if a directory contains names that differ only in case.
+func WithCaseInsensitiveLookup() Option {
+	return func(o *Options) error {
+		o.CaseInsensitive = true
+		return nil
+	}
+}
+
+// FoldName returns the case-folded form of the name that is used for the case-insensitive lookup.
+func FoldName(name string) string {
+	return strings.ToUpper(name)
+}
+
 // A func which takes start time and records the diff
 type MeasureLatencyHook func(time.Time)
 
@@ -98,6 +98,7 @@ func TestReader(t *TestRunner, factory ReaderFactory) {
 		name         string
 		chunkSize    int
 		minChunkSize int
+		dedupFiles   bool
 		in           []tutil.TarEntry
 		want         []check
 	}{
@@ -155,6 +156,14 @@ func TestReader(t *TestRunner, factory ReaderFactory) {
 				hasFile("foo/bar/xxxx", "x", 1),
 				hasFile("foo/bar/yyy", "yyy", 3),
 				hasFile("foo/a/1/2", "1111111111", 10),
+				hasPath("", "/", ""),
+				hasPath("foo", "/foo", ""),
+				hasPath("foo/bar/xxxx", "/foo/bar/xxxx", "foo/bar"),
+				hasPath("foo/a/1/2", "/foo/a/1/2", "foo/a/1"),
+				hasDirStats("foo", 22, 7),
+				hasDirStats("foo/bar", 12, 3),
+				hasDirStats("foo/a", 10, 2),
+				hasDirStats("foo/a/1", 10, 1),
 			},
 		},
 		{
@@ -187,6 +196,15 @@ func TestReader(t *TestRunner, factory ReaderFactory) {
 				hasNumLink("foo", 3),     // parent dir + 2 links
 				hasNumLink("barlink", 2), // parent dir + 1 link
 				hasNumLink("bar", 3),     // parent + "." + child's ".."
+
+				// Hardlinked files are at their first names.
+				hasPath("bar/foolink2", "/foo", ""),
+				hasPath("barlink", "/bar/1/baz.txt", "bar/1"),
+				hasPath("foosym", "/foosym", ""),
+
+				// Hardlinked files are counted at their first names.
+				hasDirStats("bar", 8, 4),
+				hasDirStats("bar/1", 8, 1),
 			},
 		},
 		{
@@ -309,6 +327,32 @@ func TestReader(t *TestRunner, factory ReaderFactory) {
 				hasFileContentsOffset("foo3", int64(len(data64KB)-1), data64KB[len(data64KB)-1:]),
 			},
 		},
+		{
+			name:         "dedup_files",
+			minChunkSize: 8000,
+			chunkSize:    32000,
+			dedupFiles:   true,
+			in: []tutil.TarEntry{
+				tutil.File("foo1", data64KB),
+				tutil.File("foo2", "bb"),
+				tutil.Dir("bar/"),
+				tutil.File("bar/foo1", data64KB, tutil.WithFileMode(0600)),
+				tutil.File("bar/foo2", "bb", tutil.WithFileOwner(1000, 1000)),
+			},
+			want: []check{
+				numOfNodes(7), // root dir, prefetch landmark, foo1, foo2, dir, foo1, foo2
+				hasFile("foo1", data64KB, int64(len(data64KB))),
+				hasFile("bar/foo1", data64KB, int64(len(data64KB))),
+				hasFile("bar/foo2", "bb", 2),
+				hasMode("bar/foo1", 0600),
+				hasOwner("bar/foo2", 1000, 1000),
+				numOfChunks("bar/foo1", 2),
+				hasFileContentsOffset("bar/foo1", 1, data64KB[1:]),
+				hasFileContentsOffset("bar/foo1", int64(len(data64KB)/2), data64KB[len(data64KB)/2:]),
+				hasFileContentsOffset("bar/foo2", 1, "b"),
+				hasDirStats("bar", int64(len(data64KB))+2, 2),
+			},
+		},
 	}
 	for _, tt := range tests {
 		for _, prefix := range allowedPrefix {
@@ -327,6 +371,9 @@ func TestReader(t *TestRunner, factory ReaderFactory) {
 						t.Logf("minChunkSize = %d", tt.minChunkSize)
 						opts = append(opts, tutil.WithEStargzOptions(estargz.WithMinChunkSize(tt.minChunkSize)))
 					}
+					if tt.dedupFiles {
+						opts = append(opts, tutil.WithEStargzOptions(estargz.WithDedupFiles()))
+					}
 					esgz, _, err := tutil.BuildEStargz(tt.in, opts...)
 					if err != nil {
 						t.Fatalf("failed to build sample eStargz: %v", err)
@@ -429,6 +476,98 @@ func TestReader(t *TestRunner, factory ReaderFactory) {
 			}
 			t.Fatal("file -> ID mappings did not match between original and cloned reader")
 		}
+		if cr.TOCDigest() != r.TOCDigest() {
+			t.Fatalf("TOC digest of cloned reader = %q; want %q", cr.TOCDigest(), r.TOCDigest())
+		}
+
+		// Another reader of the same layer (e.g. on another node) must assign the same IDs.
+		r2, err := factory(esgz)
+		if err != nil {
+			t.Fatalf("failed to create new reader: %v", err)
+		}
+		defer r2.Close()
+		fileMap2, err := mapEntries(r2, r2.RootID(), nil)
+		if err != nil {
+			t.Fatalf("could not map files in another reader: %s", err)
+		}
+		if !reflect.DeepEqual(fileMap, fileMap2) {
+			t.Fatalf("file -> ID mappings did not match between readers: %v, %v", fileMap, fileMap2)
+		}
+	})
+
+	t.Run("case-insensitive-lookup", func(t *TestRunner) {
+		esgz, _, err := tutil.BuildEStargz([]tutil.TarEntry{
+			tutil.Dir("Foo/"),
+			tutil.File("Foo/Bar.txt", "bar"),
+			tutil.File("baz", "baz"),
+		})
+		if err != nil {
+			t.Fatalf("failed to build sample eStargz: %v", err)
+		}
+		r, err := factory(esgz, metadata.WithCaseInsensitiveLookup())
+		if err != nil {
+			t.Fatalf("failed to create new reader: %v", err)
+		}
+		defer r.Close()
+		for _, name := range []string{"Foo/Bar.txt", "foo/bar.txt", "FOO/BAR.TXT", "BAZ"} {
+			if _, err := lookup(r, name); err != nil {
+				t.Errorf("failed to lookup %q: %v", name, err)
+			}
+		}
+		if _, err := lookup(r, "foo/baz"); err == nil {
+			t.Errorf("foo/baz must not be found")
+		}
+		exactID, err := lookup(r, "Foo/Bar.txt")
+		if err != nil {
+			t.Fatalf("failed to lookup: %v", err)
+		}
+		if id, err := lookup(r, "foo/BAR.txt"); err != nil || id != exactID {
+			t.Errorf("foo/BAR.txt = %d, %v; want %d", id, err, exactID)
+		}
+
+		// Names that differ only in case conflict.
+		esgz, _, err = tutil.BuildEStargz([]tutil.TarEntry{
+			tutil.File("foo", "foo"),
+			tutil.File("FOO", "FOO"),
+		})
+		if err != nil {
+			t.Fatalf("failed to build sample eStargz: %v", err)
+		}
+		cr, err := factory(esgz, metadata.WithCaseInsensitiveLookup())
+		if err == nil {
+			// The error can be reported after the initialization completes.
+			_, _, err = cr.GetChild(cr.RootID(), "foo")
+			cr.Close()
+		}
+		if !errors.Is(err, metadata.ErrCaseConflict) {
+			t.Errorf("must fail with ErrCaseConflict but err=%v", err)
+		}
+	})
+
+	t.Run("compressed-toc", func(t *TestRunner) {
+		esgz, tocDgst, err := tutil.BuildEStargz([]tutil.TarEntry{
+			tutil.Dir("foo/"),
+			tutil.File("foo/bar.txt", "bar"),
+			tutil.File("baz", "bazbaz"),
+		}, tutil.WithEStargzOptions(estargz.WithCompressedTOC()))
+		if err != nil {
+			t.Fatalf("failed to build sample eStargz: %v", err)
+		}
+		r, err := factory(esgz)
+		if err != nil {
+			t.Fatalf("failed to create new reader: %v", err)
+		}
+		defer r.Close()
+		if r.TOCDigest() != tocDgst {
+			t.Errorf("TOC digest = %q; want %q", r.TOCDigest(), tocDgst)
+		}
+		for _, want := range []check{
+			numOfNodes(5), // root dir + prefetch landmark + 1 dir + 2 files
+			hasFile("foo/bar.txt", "bar", 3),
+			hasFile("baz", "bazbaz", 6),
+		} {
+			want(t, r)
+		}
 	})
 }
 
@@ -550,6 +689,37 @@ func linkName(name string, linkName string) check {
 	}
 }
 
+func hasPath(name, wantPath, wantParent string) check {
+	return func(t TestingT, r TestableReader) {
+		id, err := lookup(r, name)
+		if err != nil {
+			t.Errorf("failed to lookup %q: %v", name, err)
+			return
+		}
+		p, err := r.PathOf(id)
+		if err != nil {
+			t.Errorf("failed to get path of %q: %v", name, err)
+			return
+		}
+		if p != wantPath {
+			t.Errorf("unexpected path of %q: %q want %q", name, p, wantPath)
+		}
+		pid, err := r.GetParent(id)
+		if err != nil {
+			t.Errorf("failed to get parent of %q: %v", name, err)
+			return
+		}
+		wantPID, err := lookup(r, wantParent)
+		if err != nil {
+			t.Errorf("failed to lookup %q: %v", wantParent, err)
+			return
+		}
+		if pid != wantPID {
+			t.Errorf("unexpected parent of %q: %d want %d", name, pid, wantPID)
+		}
+	}
+}
+
 func hasNumLink(name string, numLink int) check {
 	return func(t TestingT, r TestableReader) {
 		id, err := lookup(r, name)
@@ -569,6 +739,24 @@ func hasNumLink(name string, numLink int) check {
 	}
 }
 
+func hasDirStats(name string, size, entries int64) check {
+	return func(t TestingT, r TestableReader) {
+		id, err := lookup(r, name)
+		if err != nil {
+			t.Errorf("failed to lookup %q: %v", name, err)
+			return
+		}
+		s, err := r.DirStats(id)
+		if err != nil {
+			t.Errorf("failed to get stats of %q: %v", name, err)
+			return
+		}
+		if s.Size != size || s.Entries != entries {
+			t.Errorf("unexpected stats of %q: %+v want size %d, entries %d", name, s, size, entries)
+		}
+	}
+}
+
 func hasDirChildren(name string, children ...string) check {
 	return func(t TestingT, r TestableReader) {
 		id, err := lookup(r, name)
@@ -703,6 +891,12 @@ func hasFile(name, content string, size int64) check {
 			t.Errorf("unexpected content of %q: %q want %q", name, longBytesView(data), longBytesView([]byte(content)))
 			return
 		}
+		if fd, ok := sr.(metadata.FileDigester); ok {
+			if got, want := fd.FileDigest(), digest.FromString(content).String(); got != want {
+				t.Errorf("unexpected digest of %q: %q want %q", name, got, want)
+				return
+			}
+		}
 	}
 }
 
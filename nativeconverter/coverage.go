@@ -0,0 +1,89 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package nativeconverter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/containerd/containerd/v2/core/content"
+	"github.com/containerd/containerd/v2/core/images"
+	"github.com/containerd/stargz-snapshotter/estargz"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// PrefetchCoverageHook is converter.ConvertHookFunc recording the sum of the prefetch
+// coverages of the layers (estargz.PrefetchCoverageAnnotation) to the annotations of the
+// converted OCI manifests and their descriptors, so the coverage of the image is known without
+// reading the layers. Manifests having layers without the coverage (e.g. layers not converted
+// into eStargz) and Docker manifests, which don't support annotations, are kept as is.
+func PrefetchCoverageHook(ctx context.Context, cs content.Store, orgDesc ocispec.Descriptor, newDesc *ocispec.Descriptor) (*ocispec.Descriptor, error) {
+	if !images.IsManifestType(orgDesc.MediaType) {
+		return nil, nil
+	}
+	desc := orgDesc
+	if newDesc != nil {
+		desc = *newDesc
+	}
+	info, err := cs.Info(ctx, desc.Digest)
+	if err != nil {
+		return nil, err
+	}
+	b, err := content.ReadBlob(ctx, cs, desc)
+	if err != nil {
+		return nil, err
+	}
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(b, &manifest); err != nil {
+		return nil, err
+	}
+	if images.IsDockerType(manifest.MediaType) || len(manifest.Layers) == 0 {
+		return nil, nil
+	}
+	var coverage estargz.PrefetchCoverage
+	for _, l := range manifest.Layers {
+		c, err := estargz.ParsePrefetchCoverage(l.Annotations[estargz.PrefetchCoverageAnnotation])
+		if err != nil {
+			return nil, nil // the coverage of the image is unknown
+		}
+		coverage = coverage.Add(c)
+	}
+	if manifest.Annotations == nil {
+		manifest.Annotations = make(map[string]string)
+	}
+	manifest.Annotations[estargz.PrefetchCoverageAnnotation] = coverage.String()
+	mb, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, err
+	}
+	dgst := digest.FromBytes(mb)
+	ref := fmt.Sprintf("converter-prefetch-coverage-%s", dgst)
+	if err := content.WriteBlob(ctx, cs, ref, bytes.NewReader(mb), ocispec.Descriptor{Digest: dgst, Size: int64(len(mb))}, content.WithLabels(info.Labels)); err != nil {
+		return nil, fmt.Errorf("failed to write manifest: %w", err)
+	}
+	res := desc
+	res.Digest, res.Size = dgst, int64(len(mb))
+	res.Annotations = make(map[string]string, len(desc.Annotations)+1)
+	for k, v := range desc.Annotations {
+		res.Annotations[k] = v
+	}
+	res.Annotations[estargz.PrefetchCoverageAnnotation] = coverage.String()
+	return &res, nil
+}
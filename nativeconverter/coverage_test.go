@@ -0,0 +1,119 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package nativeconverter_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/containerd/containerd/v2/core/content"
+	"github.com/containerd/containerd/v2/core/images/converter"
+	"github.com/containerd/containerd/v2/plugins/content/local"
+	"github.com/containerd/platforms"
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/containerd/stargz-snapshotter/nativeconverter"
+	estargzconvert "github.com/containerd/stargz-snapshotter/nativeconverter/estargz"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestPrefetchCoverageHook(t *testing.T) {
+	ctx := context.Background()
+	cs, err := local.NewStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeJSON := func(mediaType string, v any) ocispec.Descriptor {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		desc := ocispec.Descriptor{MediaType: mediaType, Digest: digest.FromBytes(b), Size: int64(len(b))}
+		if err := content.WriteBlob(ctx, cs, desc.Digest.String(), bytes.NewReader(b), desc); err != nil {
+			t.Fatal(err)
+		}
+		return desc
+	}
+	writeLayer := func(name string, size int) (ocispec.Descriptor, digest.Digest) {
+		var tb bytes.Buffer
+		tw := tar.NewWriter(&tb)
+		if err := tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(size)}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(bytes.Repeat([]byte("a"), size)); err != nil {
+			t.Fatal(err)
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		gw := gzip.NewWriter(&buf)
+		if _, err := gw.Write(tb.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+		if err := gw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		desc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayerGzip, Digest: digest.FromBytes(buf.Bytes()), Size: int64(buf.Len())}
+		if err := content.WriteBlob(ctx, cs, desc.Digest.String(), bytes.NewReader(buf.Bytes()), desc); err != nil {
+			t.Fatal(err)
+		}
+		return desc, digest.FromBytes(tb.Bytes())
+	}
+	foo, fooDiffID := writeLayer("foo", 300)
+	bar, barDiffID := writeLayer("bar", 100)
+	config := writeJSON(ocispec.MediaTypeImageConfig, ocispec.Image{
+		Platform: platforms.DefaultSpec(),
+		RootFS:   ocispec.RootFS{Type: "layers", DiffIDs: []digest.Digest{fooDiffID, barDiffID}},
+	})
+	manifest := ocispec.Manifest{MediaType: ocispec.MediaTypeImageManifest, Config: config, Layers: []ocispec.Descriptor{foo, bar}}
+	manifest.SchemaVersion = 2
+	mdesc := writeJSON(ocispec.MediaTypeImageManifest, manifest)
+
+	layerConvert := estargzconvert.LayerConvertWithLayerAndCommonOptsFunc(map[digest.Digest][]estargz.Option{
+		foo.Digest: {estargz.WithPrioritizedFiles([]string{"foo"})},
+	})
+	convert := converter.IndexConvertFuncWithHook(layerConvert, true, platforms.All, converter.ConvertHooks{PostConvertHook: nativeconverter.PrefetchCoverageHook})
+	newDesc, err := convert(ctx, cs, mdesc)
+	if err != nil {
+		t.Fatalf("failed to convert: %v", err)
+	}
+	want := estargz.PrefetchCoverage{PrefetchSize: 300, TotalSize: 400}.String()
+	if got := newDesc.Annotations[estargz.PrefetchCoverageAnnotation]; got != want {
+		t.Errorf("coverage of descriptor = %q; want %q", got, want)
+	}
+	b, err := content.ReadBlob(ctx, cs, *newDesc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var converted ocispec.Manifest
+	if err := json.Unmarshal(b, &converted); err != nil {
+		t.Fatal(err)
+	}
+	if got := converted.Annotations[estargz.PrefetchCoverageAnnotation]; got != want {
+		t.Errorf("coverage of manifest = %q; want %q", got, want)
+	}
+	for i, want := range []string{"300/300", "0/100"} {
+		if got := converted.Layers[i].Annotations[estargz.PrefetchCoverageAnnotation]; got != want {
+			t.Errorf("coverage of layer %d = %q; want %q", i, got, want)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package encryption
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/containerd/containerd/v2/core/content"
+	"github.com/containerd/containerd/v2/core/images"
+	"github.com/containerd/containerd/v2/core/images/converter"
+	"github.com/containerd/errdefs"
+	"github.com/containers/ocicrypt"
+	encconfig "github.com/containers/ocicrypt/config"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const encryptedSuffix = "+encrypted"
+
+// LayerConvertFunc returns a converter which converts the layer with convertFunc (if not nil)
+// and encrypts the result with ocicrypt. The encrypted layer is compatible with other
+// ocicrypt-based tools (e.g. ctr, skopeo). Annotations of the converted layer (e.g.
+// "containerd.io/snapshot/stargz/toc.digest") are preserved so eStargz layers can still
+// be lazily pulled by the snapshotter configured with the decryption key.
+//
+// Should be used in conjunction with WithDockerToOCI() for the same reason as the eStargz
+// converter.
+func LayerConvertFunc(ec *encconfig.EncryptConfig, convertFunc converter.ConvertFunc) converter.ConvertFunc {
+	return func(ctx context.Context, cs content.Store, desc ocispec.Descriptor) (*ocispec.Descriptor, error) {
+		if convertFunc != nil {
+			newDesc, err := convertFunc(ctx, cs, desc)
+			if err != nil {
+				return nil, err
+			}
+			if newDesc != nil {
+				desc = *newDesc
+			}
+		}
+		if !images.IsLayerType(desc.MediaType) || strings.HasSuffix(desc.MediaType, encryptedSuffix) {
+			// No conversion. No need to return an error here.
+			return nil, nil
+		}
+		info, err := cs.Info(ctx, desc.Digest)
+		if err != nil {
+			return nil, err
+		}
+
+		ra, err := cs.ReaderAt(ctx, desc)
+		if err != nil {
+			return nil, err
+		}
+		defer ra.Close()
+		encR, fin, err := ocicrypt.EncryptLayer(ec, io.NewSectionReader(ra, 0, desc.Size), desc)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encrypt layer %s: %w", desc.Digest, err)
+		}
+		ref := fmt.Sprintf("convert-encrypted-from-%s", desc.Digest)
+		w, err := content.OpenWriter(ctx, cs, content.WithRef(ref))
+		if err != nil {
+			return nil, err
+		}
+		defer w.Close()
+
+		// Reset the writing position
+		// Old writer possibly remains without aborted
+		// (e.g. conversion interrupted by a signal)
+		if err := w.Truncate(0); err != nil {
+			return nil, err
+		}
+
+		n, err := io.Copy(w, encR)
+		if err != nil {
+			return nil, err
+		}
+
+		// The diffID label is kept because the uncompressed contents are unchanged.
+		if err = w.Commit(ctx, n, "", content.WithLabels(info.Labels)); err != nil && !errdefs.IsAlreadyExists(err) {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		encAnnotations, err := fin()
+		if err != nil {
+			return nil, err
+		}
+
+		newDesc := desc
+		newDesc.MediaType += encryptedSuffix
+		newDesc.Digest = w.Digest()
+		newDesc.Size = n
+		newDesc.Annotations = make(map[string]string, len(desc.Annotations)+len(encAnnotations))
+		for k, v := range desc.Annotations {
+			newDesc.Annotations[k] = v
+		}
+		for k, v := range encAnnotations {
+			newDesc.Annotations[k] = v
+		}
+		return &newDesc, nil
+	}
+}
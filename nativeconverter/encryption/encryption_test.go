@@ -0,0 +1,150 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package encryption
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"testing"
+
+	"github.com/containerd/containerd/v2/core/content"
+	"github.com/containerd/containerd/v2/plugins/content/local"
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/containerd/stargz-snapshotter/fs/encryption"
+	estargzconvert "github.com/containerd/stargz-snapshotter/nativeconverter/estargz"
+	encconfig "github.com/containers/ocicrypt/config"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// TestLayerConvertFunc tests that an eStargz layer encrypted by the converter can be
+// decrypted at arbitrary offsets and its TOC can be verified.
+func TestLayerConvertFunc(t *testing.T) {
+	ctx := context.Background()
+	cs, err := local.NewStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	contents := bytes.Repeat([]byte("foo"), 10000)
+	if err := tw.WriteHeader(&tar.Header{Name: "foo", Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(contents))}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write(contents); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	desc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayerGzip,
+		Digest:    digest.FromBytes(buf.Bytes()),
+		Size:      int64(buf.Len()),
+	}
+	if err := content.WriteBlob(ctx, cs, "test-layer", bytes.NewReader(buf.Bytes()), desc); err != nil {
+		t.Fatal(err)
+	}
+
+	privKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKeyDER, err := x509.MarshalPKIXPublicKey(&privKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc, err := encconfig.EncryptWithJwe([][]byte{pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubKeyDER})})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newDesc, err := LayerConvertFunc(cc.EncryptConfig, estargzconvert.LayerConvertFunc())(ctx, cs, desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newDesc == nil {
+		t.Fatal("layer isn't converted")
+	}
+	if want := ocispec.MediaTypeImageLayerGzip + "+encrypted"; newDesc.MediaType != want {
+		t.Errorf("media type = %q; want %q", newDesc.MediaType, want)
+	}
+	tocDgst, err := digest.Parse(newDesc.Annotations[estargz.TOCJSONDigestAnnotation])
+	if err != nil {
+		t.Fatalf("TOC digest annotation must be preserved: %v", err)
+	}
+	if !encryption.IsEncrypted(*newDesc) {
+		t.Fatal("converted layer must be encrypted")
+	}
+
+	dc, err := encconfig.DecryptWithPrivKeys([][]byte{pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privKey)})}, [][]byte{nil})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec, err := encryption.NewDecrypter(dc.DecryptConfig, *newDesc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ra, err := cs.ReaderAt(ctx, *newDesc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ra.Close()
+	r, err := estargz.Open(io.NewSectionReader(readerAtFunc(func(p []byte, offset int64) (int, error) {
+		n, err := ra.ReadAt(p, offset)
+		dec.Decrypt(p[:n], offset)
+		return n, err
+	}), 0, newDesc.Size))
+	if err != nil {
+		t.Fatalf("failed to open decrypted eStargz: %v", err)
+	}
+	if _, err := r.VerifyTOC(tocDgst); err != nil {
+		t.Fatalf("failed to verify TOC: %v", err)
+	}
+	fr, err := r.OpenFile("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(contents))
+	if _, err := fr.ReadAt(got, 0); err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, contents) {
+		t.Errorf("unexpected contents of the decrypted file")
+	}
+
+	// Encrypted layers are left as is.
+	if d, err := LayerConvertFunc(cc.EncryptConfig, nil)(ctx, cs, *newDesc); err != nil || d != nil {
+		t.Errorf("encrypted layer must not be converted: %v, %v", d, err)
+	}
+}
+
+type readerAtFunc func([]byte, int64) (int, error)
+
+func (f readerAtFunc) ReadAt(p []byte, offset int64) (int, error) { return f(p, offset) }
@@ -20,6 +20,7 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"maps"
 
 	"github.com/containerd/containerd/v2/core/content"
 	"github.com/containerd/containerd/v2/core/images"
@@ -28,6 +29,7 @@ import (
 	"github.com/containerd/containerd/v2/pkg/labels"
 	"github.com/containerd/errdefs"
 	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/containerd/stargz-snapshotter/nativeconverter"
 	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 )
@@ -80,7 +82,7 @@ func LayerConvertFunc(opts ...estargz.Option) converter.ConvertFunc {
 		}
 		defer ra.Close()
 		sr := io.NewSectionReader(ra, 0, desc.Size)
-		blob, err := estargz.Build(sr, append(opts, estargz.WithContext(ctx))...)
+		blob, err := estargz.Build(sr, append(opts, nativeconverter.BuildOptions(ctx, desc)...)...)
 		if err != nil {
 			return nil, err
 		}
@@ -134,6 +136,8 @@ func LayerConvertFunc(opts ...estargz.Option) converter.ConvertFunc {
 			return nil, err
 		}
 		newDesc.Annotations[estargz.StoreUncompressedSizeAnnotation] = fmt.Sprintf("%d", uncompressedSize)
+		newDesc.Annotations[estargz.PrefetchCoverageAnnotation] = blob.PrefetchCoverage().String()
+		maps.Copy(newDesc.Annotations, estargz.ScanAnnotations(blob.ScanFindings()))
 		return &newDesc, nil
 	}
 }
@@ -14,5 +14,37 @@
    limitations under the License.
 */
 
-// Package nativeconverter requires this empty file to pass golangci-lint
+// Package nativeconverter contains the layer converters of containerd for the lazily
+// pullable formats, and the helpers shared among them.
 package nativeconverter
+
+import (
+	"context"
+
+	"github.com/containerd/stargz-snapshotter/estargz"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ProgressFunc receives the progress of building the layer desc.
+type ProgressFunc func(desc ocispec.Descriptor, p estargz.Progress)
+
+type progressKey struct{}
+
+// WithProgress returns a context that makes the layer converters of the sub-packages
+// report the progress of building each layer to f. Layers can be converted in parallel
+// so f must be safe for concurrent use. Conversions are canceled by canceling the
+// context passed to the converters.
+func WithProgress(ctx context.Context, f ProgressFunc) context.Context {
+	return context.WithValue(ctx, progressKey{}, f)
+}
+
+// BuildOptions returns the options of estargz.Build for converting the layer desc with
+// ctx. The build stops when ctx is canceled and reports the progress to the function
+// specified by WithProgress.
+func BuildOptions(ctx context.Context, desc ocispec.Descriptor) []estargz.Option {
+	opts := []estargz.Option{estargz.WithContext(ctx)}
+	if f, ok := ctx.Value(progressKey{}).(ProgressFunc); ok && f != nil {
+		opts = append(opts, estargz.WithProgress(func(p estargz.Progress) { f(desc, p) }))
+	}
+	return opts
+}
@@ -0,0 +1,111 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package nativeconverter
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/containerd/containerd/v2/core/content"
+	"github.com/containerd/containerd/v2/core/images"
+	"github.com/containerd/containerd/v2/core/images/converter"
+	"github.com/containerd/containerd/v2/core/images/converter/uncompress"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/sync/errgroup"
+)
+
+// Variants converts each layer into several variants (e.g. eStargz and zstd:chunked) at
+// once. When a layer is converted by the ConvertFunc of any variant, the layer is
+// decompressed only once and all variants are built from the uncompressed layer in
+// parallel. The results are kept so the ConvertFuncs of the other variants return them
+// without converting the layer again. This allows converting an image into the images of
+// all variants (e.g. by calling converter.Convert for each variant) in a single pass over
+// the layers of the source image.
+type Variants struct {
+	funcs []converter.ConvertFunc
+
+	mu      sync.Mutex
+	results map[digest.Digest]*variantsResult
+}
+
+type variantsResult struct {
+	once  sync.Once
+	descs []*ocispec.Descriptor
+	err   error
+}
+
+// NewVariants returns Variants building the layers with the ConvertFuncs of the variants.
+// The ConvertFuncs must accept uncompressed layers.
+func NewVariants(funcs ...converter.ConvertFunc) *Variants {
+	return &Variants{funcs: funcs, results: make(map[digest.Digest]*variantsResult)}
+}
+
+// LayerConvertFunc returns the ConvertFunc of the i-th variant passed to NewVariants.
+func (v *Variants) LayerConvertFunc(i int) converter.ConvertFunc {
+	return func(ctx context.Context, cs content.Store, desc ocispec.Descriptor) (*ocispec.Descriptor, error) {
+		if i < 0 || i >= len(v.funcs) {
+			return nil, fmt.Errorf("unknown variant %d", i)
+		}
+		if !images.IsLayerType(desc.MediaType) {
+			// No conversion. No need to return an error here.
+			return nil, nil
+		}
+		v.mu.Lock()
+		r, ok := v.results[desc.Digest]
+		if !ok {
+			r = new(variantsResult)
+			v.results[desc.Digest] = r
+		}
+		v.mu.Unlock()
+		r.once.Do(func() {
+			r.descs, r.err = v.convert(ctx, cs, desc)
+		})
+		if r.err != nil {
+			return nil, r.err
+		}
+		return r.descs[i], nil
+	}
+}
+
+func (v *Variants) convert(ctx context.Context, cs content.Store, desc ocispec.Descriptor) ([]*ocispec.Descriptor, error) {
+	uncompressedDesc := &desc
+	if !uncompress.IsUncompressedType(desc.MediaType) {
+		var err error
+		uncompressedDesc, err = uncompress.LayerConvertFunc(ctx, cs, desc)
+		if err != nil {
+			return nil, err
+		}
+		if uncompressedDesc == nil {
+			return nil, fmt.Errorf("unexpectedly got the same blob after decompression (%s, %q)", desc.Digest, desc.MediaType)
+		}
+	}
+	descs := make([]*ocispec.Descriptor, len(v.funcs))
+	eg, egCtx := errgroup.WithContext(ctx)
+	for i, f := range v.funcs {
+		eg.Go(func() error {
+			newDesc, err := f(egCtx, cs, *uncompressedDesc)
+			descs[i] = newDesc // nil keeps the original layer
+			return err
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		return nil, err
+	}
+	return descs, nil
+}
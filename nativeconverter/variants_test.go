@@ -0,0 +1,99 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package nativeconverter_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"sync/atomic"
+	"testing"
+
+	"github.com/containerd/containerd/v2/core/content"
+	"github.com/containerd/containerd/v2/core/images/converter"
+	"github.com/containerd/containerd/v2/plugins/content/local"
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/containerd/stargz-snapshotter/nativeconverter"
+	estargzconvert "github.com/containerd/stargz-snapshotter/nativeconverter/estargz"
+	zstdchunkedconvert "github.com/containerd/stargz-snapshotter/nativeconverter/zstdchunked"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// TestVariants tests that a layer is converted into eStargz and zstd:chunked at once.
+func TestVariants(t *testing.T) {
+	ctx := context.Background()
+	cs, err := local.NewStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	contents := bytes.Repeat([]byte("foo"), 10000)
+	if err := tw.WriteHeader(&tar.Header{Name: "foo", Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(contents))}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write(contents); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	desc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayerGzip,
+		Digest:    digest.FromBytes(buf.Bytes()),
+		Size:      int64(buf.Len()),
+	}
+	if err := content.WriteBlob(ctx, cs, "test-layer", bytes.NewReader(buf.Bytes()), desc); err != nil {
+		t.Fatal(err)
+	}
+
+	var calls atomic.Int32
+	counted := func(f converter.ConvertFunc) converter.ConvertFunc {
+		return func(ctx context.Context, cs content.Store, desc ocispec.Descriptor) (*ocispec.Descriptor, error) {
+			calls.Add(1)
+			return f(ctx, cs, desc)
+		}
+	}
+	variants := nativeconverter.NewVariants(
+		counted(estargzconvert.LayerConvertFunc()),
+		counted(zstdchunkedconvert.LayerConvertFunc()),
+	)
+	for i, wantMediaType := range []string{ocispec.MediaTypeImageLayerGzip, ocispec.MediaTypeImageLayerZstd} {
+		for j := 0; j < 2; j++ {
+			newDesc, err := variants.LayerConvertFunc(i)(ctx, cs, desc)
+			if err != nil {
+				t.Fatalf("failed to convert variant %d: %v", i, err)
+			}
+			if newDesc == nil || newDesc.MediaType != wantMediaType || newDesc.Annotations[estargz.TOCJSONDigestAnnotation] == "" {
+				t.Fatalf("unexpected descriptor of variant %d: %+v", i, newDesc)
+			}
+			if _, err := cs.Info(ctx, newDesc.Digest); err != nil {
+				t.Errorf("converted blob of variant %d isn't stored: %v", i, err)
+			}
+		}
+	}
+	if n := calls.Load(); n != 2 {
+		t.Errorf("layer is converted %d times; want 2", n)
+	}
+}
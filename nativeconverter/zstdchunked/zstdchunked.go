@@ -20,6 +20,7 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"maps"
 
 	"github.com/containerd/containerd/v2/core/content"
 	"github.com/containerd/containerd/v2/core/images"
@@ -30,6 +31,7 @@ import (
 	"github.com/containerd/log"
 	"github.com/containerd/stargz-snapshotter/estargz"
 	"github.com/containerd/stargz-snapshotter/estargz/zstdchunked"
+	"github.com/containerd/stargz-snapshotter/nativeconverter"
 	"github.com/klauspost/compress/zstd"
 	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
@@ -83,6 +85,37 @@ func LayerConvertWithLayerOptsFuncWithCompressionLevel(compressionLevel zstd.Enc
 	}
 }
 
+// EncoderConfig is the configuration of the zstd encoder used for conversion.
+type EncoderConfig struct {
+	// CompressionLevel is the compression level of zstd.
+	CompressionLevel zstd.EncoderLevel
+
+	// Concurrency is the number of goroutines used by each encoder.
+	// If zero, the default of the zstd library is used.
+	Concurrency int
+
+	// WindowSize is the maximum window size of the encoder in bytes.
+	// If zero, the default of the zstd library is used.
+	WindowSize int
+}
+
+// LayerConvertWithLayerOptsFuncWithEncoderConfig converts legacy tar.gz layers into zstd:chunked layers.
+// This function allows to specify the configuration of the zstd encoder.
+//
+// This changes Docker MediaType to OCI MediaType so this should be used in
+// conjunction with WithDockerToOCI().
+// See LayerConvertWithLayerOptsFuncWithCompressionLevel for more details. The difference between
+// this function and LayerConvertWithLayerOptsFuncWithCompressionLevel is that this allows to
+// configure the encoder in addition to the compression level.
+func LayerConvertWithLayerOptsFuncWithEncoderConfig(config EncoderConfig, opts map[digest.Digest][]estargz.Option) converter.ConvertFunc {
+	if opts == nil {
+		return LayerConvertFuncWithEncoderConfig(config)
+	}
+	return func(ctx context.Context, cs content.Store, desc ocispec.Descriptor) (*ocispec.Descriptor, error) {
+		return LayerConvertFuncWithEncoderConfig(config, opts[desc.Digest]...)(ctx, cs, desc)
+	}
+}
+
 // LayerConvertFuncWithCompressionLevel converts legacy tar.gz layers into zstd:chunked layers with
 // the specified compression level.
 //
@@ -91,6 +124,18 @@ func LayerConvertWithLayerOptsFuncWithCompressionLevel(compressionLevel zstd.Enc
 // See LayerConvertFunc for more details. The difference between this function and
 // LayerConvertFunc is that this allows configuring the compression level.
 func LayerConvertFuncWithCompressionLevel(compressionLevel zstd.EncoderLevel, opts ...estargz.Option) converter.ConvertFunc {
+	return LayerConvertFuncWithEncoderConfig(EncoderConfig{CompressionLevel: compressionLevel}, opts...)
+}
+
+// LayerConvertFuncWithEncoderConfig converts legacy tar.gz layers into zstd:chunked layers with
+// the specified configuration of the zstd encoder.
+//
+// This changes Docker MediaType to OCI MediaType so this should be used in
+// conjunction with WithDockerToOCI().
+// See LayerConvertFunc for more details. The difference between this function and
+// LayerConvertFunc is that this allows configuring the encoder (e.g. the compression level
+// and the number of goroutines used for compression).
+func LayerConvertFuncWithEncoderConfig(config EncoderConfig, opts ...estargz.Option) converter.ConvertFunc {
 	return func(ctx context.Context, cs content.Store, desc ocispec.Descriptor) (*ocispec.Descriptor, error) {
 		if !images.IsLayerType(desc.MediaType) {
 			// No conversion. No need to return an error here.
@@ -129,11 +174,13 @@ func LayerConvertFuncWithCompressionLevel(compressionLevel zstd.EncoderLevel, op
 		opts = append(opts, estargz.WithCompression(&zstdCompression{
 			new(zstdchunked.Decompressor),
 			&zstdchunked.Compressor{
-				CompressionLevel: compressionLevel,
+				CompressionLevel: config.CompressionLevel,
 				Metadata:         metadata,
+				Concurrency:      config.Concurrency,
+				WindowSize:       config.WindowSize,
 			},
 		}))
-		blob, err := estargz.Build(uncompressedSR, append(opts, estargz.WithContext(ctx))...)
+		blob, err := estargz.Build(uncompressedSR, append(opts, nativeconverter.BuildOptions(ctx, desc)...)...)
 		if err != nil {
 			return nil, err
 		}
@@ -184,6 +231,8 @@ func LayerConvertFuncWithCompressionLevel(compressionLevel zstd.EncoderLevel, op
 			return nil, err
 		}
 		newDesc.Annotations[estargz.StoreUncompressedSizeAnnotation] = fmt.Sprintf("%d", uncompressedSize)
+		newDesc.Annotations[estargz.PrefetchCoverageAnnotation] = blob.PrefetchCoverage().String()
+		maps.Copy(newDesc.Annotations, estargz.ScanAnnotations(blob.ScanFindings()))
 		if p, ok := metadata[zstdchunked.ManifestChecksumAnnotation]; ok {
 			newDesc.Annotations[zstdchunked.ManifestChecksumAnnotation] = p
 		}
@@ -36,6 +36,15 @@ type Config struct {
 
 	// SnapshotterConfig is snapshotter-related config.
 	SnapshotterConfig `toml:"snapshotter" json:"snapshotter"`
+
+	// ObjectStorageConfig is config for serving layers from object storages.
+	ObjectStorageConfig `toml:"object_storage" json:"object_storage"`
+
+	// EventsConfig is config for publishing events to containerd.
+	EventsConfig `toml:"events" json:"events"`
+
+	// ReadMetricsConfig is config for exporting the metrics of reads of files.
+	ReadMetricsConfig `toml:"read_metrics" json:"read_metrics"`
 }
 
 // KubeconfigKeychainConfig is config for kubeconfig-based keychain.
@@ -63,6 +72,50 @@ type CRIKeychainConfig struct {
 // ResolverConfig is config for resolving registries.
 type ResolverConfig resolver.Config
 
+// ObjectStorageConfig is config for serving layers from object storages (s3:// and gs:// URLs
+// of layer descriptors). Credentials are provided by the keychain.
+type ObjectStorageConfig struct {
+	// Enable enables lazy pulling from object storages.
+	Enable bool `toml:"enable" json:"enable"`
+
+	// S3Region is the region of S3 buckets. Defaults to "us-east-1".
+	S3Region string `toml:"s3_region" json:"s3_region"`
+
+	// S3Endpoint is the endpoint URL of S3-compatible object storage. AWS S3 is used if empty.
+	S3Endpoint string `toml:"s3_endpoint" json:"s3_endpoint"`
+
+	// GCSEndpoint is the endpoint URL of Google Cloud Storage. Defaults to "https://storage.googleapis.com".
+	GCSEndpoint string `toml:"gcs_endpoint" json:"gcs_endpoint"`
+
+	// S3EnvCredential makes S3 credentials (including the session token of temporary security
+	// credentials) be read from the environment variables AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY
+	// and AWS_SESSION_TOKEN before querying the keychain.
+	S3EnvCredential bool `toml:"s3_env_credential" json:"s3_env_credential"`
+}
+
+// EventsConfig is config for publishing the events of lazily pulled layers and remote
+// snapshots (e.g. "/snapshot/stargz/resolved") to containerd's event service.
+type EventsConfig struct {
+	// Enable enables publishing events.
+	Enable bool `toml:"enable" json:"enable"`
+
+	// Address is the address of containerd's GRPC server. Defaults to "/run/containerd/containerd.sock".
+	// This isn't used when the snapshotter runs as a containerd's builtin plugin.
+	Address string `toml:"address" json:"address"`
+}
+
+// ReadMetricsConfig is config for exporting the latency, the bytes and the source (cache or
+// remote) of reads of files to Prometheus, so operators can see which files cause remote
+// fetches. This is ignored if Prometheus metrics are disabled (no_prometheus).
+type ReadMetricsConfig struct {
+	// Enable enables the metrics of reads of files.
+	Enable bool `toml:"enable" json:"enable"`
+
+	// MaxPaths is the max number of file paths whose remote reads are counted separately.
+	// Remote reads of the other files are counted with the path "other". Default is 1000.
+	MaxPaths int `toml:"max_paths" json:"max_paths"`
+}
+
 // SnapshotterConfig is snapshotter-related config.
 type SnapshotterConfig struct {
 	// AllowInvalidMountsOnRestart allows that there are snapshot mounts that cannot access to the
@@ -70,4 +123,16 @@ type SnapshotterConfig struct {
 	// NOTE: User needs to manually remove the snapshots from containerd's metadata store using
 	//       ctr (e.g. `ctr snapshot rm`).
 	AllowInvalidMountsOnRestart bool `toml:"allow_invalid_mounts_on_restart" json:"allow_invalid_mounts_on_restart"`
+
+	// WriteLayerRedirect makes the snapshotter compose the overlay of writable snapshots by
+	// itself and return a single bind mount, for runtimes that can't assemble overlay mounts.
+	// The value is the location of the writable layer: "directory" (the snapshotter's root)
+	// or "tmpfs". Default is empty (disabled).
+	WriteLayerRedirect string `toml:"write_layer_redirect" json:"write_layer_redirect"`
+
+	// DataOnlyLower makes the snapshotter generate a metadata-only lower of each fully
+	// fetched layer and compose overlays with them on top of a data-only lower layer that
+	// stores the file contents once among layers. This requires Linux 6.5 or later and
+	// overlayfs xattrs in the "trusted." namespace. Default is false.
+	DataOnlyLower bool `toml:"data_only_lower" json:"data_only_lower"`
 }
@@ -24,6 +24,7 @@ import (
 	"path/filepath"
 	"time"
 
+	"github.com/containerd/containerd/v2/core/events"
 	"github.com/containerd/containerd/v2/defaults"
 	"github.com/containerd/containerd/v2/pkg/dialer"
 	ctdplugins "github.com/containerd/containerd/v2/plugins"
@@ -61,6 +62,9 @@ func RegisterPlugin() {
 		Type:   ctdplugins.SnapshotPlugin,
 		ID:     "stargz",
 		Config: &Config{},
+		Requires: []plugin.Type{
+			ctdplugins.EventPlugin,
+		},
 		InitFn: func(ic *plugin.InitContext) (any, error) {
 			ic.Meta.Platforms = append(ic.Meta.Platforms, platforms.DefaultSpec())
 			ctx := ic.Context
@@ -126,10 +130,25 @@ func RegisterPlugin() {
 				credsFuncs = append(credsFuncs, criCreds)
 			}
 
+			opts := []service.Option{
+				service.WithCustomRegistryHosts(resolver.RegistryHostsFromCRIConfig(ctx, config.Registry, credsFuncs...)),
+			}
+			if config.EventsConfig.Enable {
+				// Publish events to the exchange of this containerd.
+				ep, err := ic.GetSingle(ctdplugins.EventPlugin)
+				if err != nil {
+					return nil, err
+				}
+				publisher, ok := ep.(events.Publisher)
+				if !ok {
+					return nil, fmt.Errorf("unexpected event plugin %T", ep)
+				}
+				opts = append(opts, service.WithEventPublisher(publisher))
+			}
+
 			// TODO(ktock): print warn if old configuration is specified.
 			// TODO(ktock): should we respect old configuration?
-			return service.NewStargzSnapshotterService(ctx, root, &config.Config,
-				service.WithCustomRegistryHosts(resolver.RegistryHostsFromCRIConfig(ctx, config.Registry, credsFuncs...)))
+			return service.NewStargzSnapshotterService(ctx, root, &config.Config, opts...)
 		},
 	})
 }
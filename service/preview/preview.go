@@ -0,0 +1,658 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package preview serves a read-only HTTP API to browse the files of eStargz images
+// without pulling them. Only the TOCs of the layers are fetched from the registry so
+// listing directories and getting attributes of files are cheap. Contents of files are
+// served only when enabled.
+//
+// The API has the following endpoints. All of them take the image reference ("ref")
+// and the absolute path in the image ("path") as query parameters.
+//
+//   - GET /ls returns the entries of the directory as a JSON array of Entry.
+//   - GET /stat returns the Entry of the file including the extended attributes.
+//   - GET /file returns the contents of the regular file (if Config.FileContents is true).
+//   - GET /du returns the Usage of the directory.
+//
+// The files of the layers are merged as overlayfs does (i.e. whiteouts and opaque
+// directories are respected).
+package preview
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd/v2/core/remotes/docker"
+	"github.com/containerd/containerd/v2/pkg/reference"
+	"github.com/containerd/log"
+	"github.com/containerd/platforms"
+	"github.com/containerd/stargz-snapshotter/cache"
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/containerd/stargz-snapshotter/estargz/zstdchunked"
+	fsconfig "github.com/containerd/stargz-snapshotter/fs/config"
+	"github.com/containerd/stargz-snapshotter/fs/remote"
+	"github.com/containerd/stargz-snapshotter/fs/source"
+	"github.com/containerd/stargz-snapshotter/metadata"
+	"github.com/containerd/stargz-snapshotter/metadata/memory"
+	"github.com/containerd/stargz-snapshotter/util/cacheutil"
+	"github.com/containerd/stargz-snapshotter/util/containerdutil"
+	"github.com/containerd/stargz-snapshotter/util/namedmutex"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	defaultMaxImages = 10
+
+	whiteoutPrefix    = ".wh."
+	whiteoutOpaqueDir = whiteoutPrefix + whiteoutPrefix + ".opq"
+
+	// maxPathDepth is the max number of the components of the path.
+	maxPathDepth = 1000
+)
+
+// Config is the configuration of the preview API.
+type Config struct {
+	// Address is a Unix domain socket address where the API is served. The API is disabled
+	// if empty.
+	Address string `toml:"address" json:"address"`
+
+	// FileContents enables serving the contents of files. Contents are fetched from the
+	// registry on each request and kept in memory until the image is evicted. Default is false.
+	FileContents bool `toml:"file_contents" json:"file_contents"`
+
+	// MaxImages is the max number of images whose TOCs are kept in memory. Default is 10.
+	MaxImages int `toml:"max_images" json:"max_images"`
+}
+
+// Entry is a file in the image.
+type Entry struct {
+	// Name is the base name of the file.
+	Name string `json:"name"`
+
+	// Type is the type of the file ("dir", "reg", "symlink", "char", "block", "fifo" or "socket").
+	Type string `json:"type"`
+
+	// Mode is the permission and mode bits of the file (e.g. "-rwxr-xr-x").
+	Mode string `json:"mode"`
+
+	// Size is the size of the regular file.
+	Size int64 `json:"size"`
+
+	UID     int       `json:"uid"`
+	GID     int       `json:"gid"`
+	ModTime time.Time `json:"modTime"`
+
+	// LinkName is the target of the symlink.
+	LinkName string `json:"linkName,omitempty"`
+
+	// DevMajor and DevMinor are the device numbers of the device file.
+	DevMajor int `json:"devMajor,omitempty"`
+	DevMinor int `json:"devMinor,omitempty"`
+
+	// Xattrs are the extended attributes of the file. These are returned only by /stat.
+	Xattrs map[string]string `json:"xattrs,omitempty"`
+
+	// Layer is the digest of the layer that provides the file.
+	Layer digest.Digest `json:"layer"`
+}
+
+// Usage is the total size and the number of the files under a directory in the image.
+type Usage struct {
+	// Size is the total size of the regular files under the directory. Hardlinks are
+	// counted once.
+	Size int64 `json:"size"`
+
+	// Entries is the number of the files under the directory including whiteouts.
+	Entries int64 `json:"entries"`
+
+	// Layers are the usages of the directory in the layers where the directory is visible
+	// in the merged layers, from the upper layer. Totals are the sums of them so files
+	// hidden by upper layers are counted as well.
+	Layers []LayerUsage `json:"layers"`
+}
+
+// LayerUsage is the usage of a directory in a layer.
+type LayerUsage struct {
+	Layer   digest.Digest `json:"layer"`
+	Size    int64         `json:"size"`
+	Entries int64         `json:"entries"`
+}
+
+// Handler is the http.Handler of the preview API.
+type Handler struct {
+	config Config
+	mux    *http.ServeMux
+
+	// load fetches the TOCs of the layers of the image.
+	load func(ctx context.Context, refspec reference.Spec) (*image, error)
+
+	images *cacheutil.LRUCache
+	loadMu *namedmutex.NamedMutex
+}
+
+// NewHandler returns the handler of the preview API that resolves images using hosts.
+// blobConfig configures fetching the layers.
+func NewHandler(config Config, hosts source.RegistryHosts, blobConfig fsconfig.BlobConfig) *Handler {
+	return newHandler(config, (&imageLoader{
+		hosts:    hosts,
+		resolver: remote.NewResolver(blobConfig, nil, nil),
+	}).load)
+}
+
+func newHandler(config Config, load func(context.Context, reference.Spec) (*image, error)) *Handler {
+	maxImages := config.MaxImages
+	if maxImages <= 0 {
+		maxImages = defaultMaxImages
+	}
+	h := &Handler{
+		config: config,
+		mux:    http.NewServeMux(),
+		load:   load,
+		images: cacheutil.NewLRUCache(maxImages),
+		loadMu: new(namedmutex.NamedMutex),
+	}
+	h.images.OnEvicted = func(key string, value any) {
+		if err := value.(*image).close(); err != nil {
+			log.L.WithError(err).WithField("ref", key).Warn("failed to close previewed image")
+		}
+	}
+	h.mux.HandleFunc("GET /ls", h.serveLs)
+	h.mux.HandleFunc("GET /stat", h.serveStat)
+	h.mux.HandleFunc("GET /file", h.serveFile)
+	h.mux.HandleFunc("GET /du", h.serveDu)
+	return h
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+func (h *Handler) serveLs(w http.ResponseWriter, r *http.Request) {
+	img, p, done, ok := h.image(w, r)
+	if !ok {
+		return
+	}
+	defer done()
+	ents, err := img.readDir(p)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, r, ents)
+}
+
+func (h *Handler) serveStat(w http.ResponseWriter, r *http.Request) {
+	img, p, done, ok := h.image(w, r)
+	if !ok {
+		return
+	}
+	defer done()
+	f, err := img.lookup(p)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	e := f.entry(path.Base(p))
+	if len(f.attr.Xattrs) > 0 {
+		e.Xattrs = make(map[string]string, len(f.attr.Xattrs))
+		for k, v := range f.attr.Xattrs {
+			e.Xattrs[k] = string(v)
+		}
+	}
+	writeJSON(w, r, e)
+}
+
+func (h *Handler) serveFile(w http.ResponseWriter, r *http.Request) {
+	if !h.config.FileContents {
+		http.Error(w, "serving file contents is disabled", http.StatusForbidden)
+		return
+	}
+	img, p, done, ok := h.image(w, r)
+	if !ok {
+		return
+	}
+	defer done()
+	f, err := img.lookup(p)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if !f.attr.Mode.IsRegular() {
+		http.Error(w, fmt.Sprintf("%q isn't a regular file", p), http.StatusBadRequest)
+		return
+	}
+	fr, err := f.layer.r.OpenFile(f.id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, r, path.Base(p), f.attr.ModTime, io.NewSectionReader(fr, 0, f.attr.Size))
+}
+
+func (h *Handler) serveDu(w http.ResponseWriter, r *http.Request) {
+	img, p, done, ok := h.image(w, r)
+	if !ok {
+		return
+	}
+	defer done()
+	u, err := img.usage(p)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, r, u)
+}
+
+// image returns the image and the cleaned path specified by the request. done must be
+// called when the image is no longer used. The error is written to w if ok is false.
+func (h *Handler) image(w http.ResponseWriter, r *http.Request) (_ *image, p string, done func(), ok bool) {
+	q := r.URL.Query()
+	refspec, err := reference.Parse(q.Get("ref"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid image reference %q: %v", q.Get("ref"), err), http.StatusBadRequest)
+		return nil, "", nil, false
+	}
+	p = q.Get("path")
+	if p == "" {
+		p = "/"
+	}
+	if !path.IsAbs(p) {
+		http.Error(w, fmt.Sprintf("path %q must be absolute", p), http.StatusBadRequest)
+		return nil, "", nil, false
+	}
+	p = path.Clean(p)
+
+	key := refspec.String()
+	if img, done, ok := h.images.Get(key); ok {
+		return img.(*image), p, done, true
+	}
+	h.loadMu.Lock(key)
+	defer h.loadMu.Unlock(key)
+	if img, done, ok := h.images.Get(key); ok {
+		return img.(*image), p, done, true
+	}
+	img, err := h.load(r.Context(), refspec)
+	if err != nil {
+		log.G(r.Context()).WithError(err).Debugf("failed to load image %q for preview", key)
+		http.Error(w, fmt.Sprintf("failed to load image %q: %v", key, err), http.StatusBadGateway)
+		return nil, "", nil, false
+	}
+	cached, done, added := h.images.Add(key, img)
+	if !added {
+		img.close() // already loaded by another request
+	}
+	return cached.(*image), p, done, true
+}
+
+var (
+	errNotFound = errors.New("not found")
+	errNotDir   = errors.New("not a directory")
+)
+
+func writeError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, errNotDir):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+func writeJSON(w http.ResponseWriter, r *http.Request, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.G(r.Context()).WithError(err).Warn("failed to write preview response")
+	}
+}
+
+// image is the layers of an image.
+type image struct {
+	layers []*layer // from the lowest layer
+}
+
+type layer struct {
+	digest digest.Digest
+	r      metadata.Reader
+	blob   remote.Blob // nil if the layer isn't fetched from the registry
+}
+
+func (img *image) close() error {
+	var errs []error
+	for _, l := range img.layers {
+		errs = append(errs, l.r.Close())
+		if l.blob != nil {
+			errs = append(errs, l.blob.Close())
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// file is a file in a layer.
+type file struct {
+	layer *layer
+	id    uint32
+	attr  metadata.Attr
+}
+
+func (f *file) entry(name string) Entry {
+	e := Entry{
+		Name:     name,
+		Type:     fileType(f.attr.Mode),
+		Mode:     f.attr.Mode.String(),
+		UID:      f.attr.UID,
+		GID:      f.attr.GID,
+		ModTime:  f.attr.ModTime,
+		LinkName: f.attr.LinkName,
+		DevMajor: f.attr.DevMajor,
+		DevMinor: f.attr.DevMinor,
+		Layer:    f.layer.digest,
+	}
+	if f.attr.Mode.IsRegular() {
+		e.Size = f.attr.Size
+	}
+	return e
+}
+
+func fileType(m os.FileMode) string {
+	switch {
+	case m.IsDir():
+		return "dir"
+	case m&os.ModeSymlink != 0:
+		return "symlink"
+	case m&os.ModeCharDevice != 0:
+		return "char"
+	case m&os.ModeDevice != 0:
+		return "block"
+	case m&os.ModeNamedPipe != 0:
+		return "fifo"
+	case m&os.ModeSocket != 0:
+		return "socket"
+	}
+	return "reg"
+}
+
+// lookup returns the file at the path in the merged layers.
+func (img *image) lookup(p string) (*file, error) {
+	var found *file
+	if err := img.walk(p, func(f *file) bool {
+		found = f
+		return false
+	}); err != nil {
+		return nil, err
+	}
+	if found == nil {
+		return nil, fmt.Errorf("%q: %w", p, errNotFound)
+	}
+	return found, nil
+}
+
+// readDir returns the entries of the directory at the path in the merged layers sorted
+// by the order of the upper layers first.
+func (img *image) readDir(p string) ([]Entry, error) {
+	var (
+		ents  = []Entry{}
+		seen  = make(map[string]bool) // names provided or hidden by upper layers
+		isDir = true
+		found bool
+		err   error
+	)
+	if wErr := img.walk(p, func(f *file) bool {
+		if !f.attr.Mode.IsDir() {
+			if !found {
+				isDir = false
+			} // otherwise, hidden by the directory of the upper layer
+			return false
+		}
+		found = true
+		var opaque bool
+		if fErr := f.layer.r.ForeachChild(f.id, func(name string, id uint32, mode os.FileMode) bool {
+			if p == "/" && estargz.IsLandmark(name) {
+				return true // landmarks aren't shown by the filesystem
+			}
+			if name == whiteoutOpaqueDir {
+				opaque = true
+				return true
+			}
+			if strings.HasPrefix(name, whiteoutPrefix) {
+				seen[strings.TrimPrefix(name, whiteoutPrefix)] = true
+				return true
+			}
+			if seen[name] {
+				return true
+			}
+			seen[name] = true
+			attr, aErr := f.layer.r.GetAttr(id)
+			if aErr != nil {
+				err = aErr
+				return false
+			}
+			ents = append(ents, (&file{f.layer, id, attr}).entry(name))
+			return true
+		}); fErr != nil {
+			err = fErr
+		}
+		return err == nil && !opaque
+	}); wErr != nil {
+		return nil, wErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !isDir {
+		return nil, fmt.Errorf("%q: %w", p, errNotDir)
+	}
+	if !found {
+		return nil, fmt.Errorf("%q: %w", p, errNotFound)
+	}
+	return ents, nil
+}
+
+// usage returns the usage of the directory at the path in the merged layers using the
+// aggregates precomputed by the metadata readers.
+func (img *image) usage(p string) (*Usage, error) {
+	var (
+		u     = &Usage{Layers: []LayerUsage{}}
+		isDir = true
+		found bool
+		err   error
+	)
+	if wErr := img.walk(p, func(f *file) bool {
+		if !f.attr.Mode.IsDir() {
+			if !found {
+				isDir = false
+			} // otherwise, hidden by the directory of the upper layer
+			return false
+		}
+		found = true
+		s, sErr := f.layer.r.DirStats(f.id)
+		if sErr != nil {
+			err = sErr
+			return false
+		}
+		if p == "/" {
+			// landmarks aren't shown by the filesystem
+			if fErr := f.layer.r.ForeachChild(f.id, func(name string, id uint32, mode os.FileMode) bool {
+				if !estargz.IsLandmark(name) {
+					return true
+				}
+				attr, aErr := f.layer.r.GetAttr(id)
+				if aErr != nil {
+					err = aErr
+					return false
+				}
+				s.Size -= attr.Size
+				s.Entries--
+				return true
+			}); fErr != nil {
+				err = fErr
+			}
+			if err != nil {
+				return false
+			}
+		}
+		u.Size += s.Size
+		u.Entries += s.Entries
+		u.Layers = append(u.Layers, LayerUsage{Layer: f.layer.digest, Size: s.Size, Entries: s.Entries})
+		_, _, oErr := f.layer.r.GetChild(f.id, whiteoutOpaqueDir)
+		return oErr != nil
+	}); wErr != nil {
+		return nil, wErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !isDir {
+		return nil, fmt.Errorf("%q: %w", p, errNotDir)
+	}
+	if !found {
+		return nil, fmt.Errorf("%q: %w", p, errNotFound)
+	}
+	return u, nil
+}
+
+// walk calls f for the files at the path in the layers visible in the merged layers,
+// from the upper layer, until f returns false. Files of lower layers are hidden by
+// whiteouts, opaque directories and non-directories in the upper layers.
+func (img *image) walk(p string, f func(*file) bool) error {
+	var names []string
+	if p != "/" {
+		names = strings.Split(strings.TrimPrefix(p, "/"), "/")
+	}
+	if len(names) > maxPathDepth {
+		return fmt.Errorf("path %q is too deep", p)
+	}
+	if len(names) == 1 && estargz.IsLandmark(names[0]) {
+		return nil
+	}
+	for i := len(img.layers) - 1; i >= 0; i-- {
+		l := img.layers[i]
+		id := l.r.RootID()
+		attr, err := l.r.GetAttr(id)
+		if err != nil {
+			return err
+		}
+		found := true
+		hidden := false // lower layers are hidden by this layer
+		for j, name := range names {
+			if _, _, err := l.r.GetChild(id, whiteoutPrefix+name); err == nil {
+				hidden = true
+			} else if j > 0 {
+				if _, _, err := l.r.GetChild(id, whiteoutOpaqueDir); err == nil {
+					hidden = true
+				}
+			}
+			if id, attr, err = l.r.GetChild(id, name); err != nil {
+				found = false
+				break
+			}
+			if j < len(names)-1 && !attr.Mode.IsDir() {
+				found, hidden = false, true
+				break
+			}
+		}
+		if found && !f(&file{l, id, attr}) {
+			return nil
+		}
+		if hidden {
+			return nil
+		}
+	}
+	return nil
+}
+
+// imageLoader fetches the TOCs of the layers of images from the registry.
+type imageLoader struct {
+	hosts    source.RegistryHosts
+	resolver *remote.Resolver
+}
+
+func (il *imageLoader) load(ctx context.Context, refspec reference.Spec) (_ *image, retErr error) {
+	resolver := docker.NewResolver(docker.ResolverOptions{
+		Hosts: func(host string) ([]docker.RegistryHost, error) {
+			if host != refspec.Hostname() {
+				return nil, fmt.Errorf("unexpected host %q for image ref %q", host, refspec.String())
+			}
+			return il.hosts(refspec)
+		},
+	})
+	_, desc, err := resolver.Resolve(ctx, refspec.String())
+	if err != nil {
+		return nil, err
+	}
+	fetcher, err := resolver.Fetcher(ctx, refspec.String())
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := containerdutil.FetchManifestPlatform(ctx, fetcher, desc, platforms.DefaultSpec())
+	if err != nil {
+		return nil, err
+	}
+	img := &image{}
+	defer func() {
+		if retErr != nil {
+			img.close()
+		}
+	}()
+	for _, desc := range manifest.Layers {
+		l, err := il.loadLayer(ctx, refspec, desc)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load layer %q: %w", desc.Digest, err)
+		}
+		img.layers = append(img.layers, l)
+	}
+	return img, nil
+}
+
+func (il *imageLoader) loadLayer(ctx context.Context, refspec reference.Spec, desc ocispec.Descriptor) (_ *layer, retErr error) {
+	blob, err := il.resolver.Resolve(ctx, il.hosts, refspec, desc, cache.NewMemoryCache())
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if retErr != nil {
+			blob.Close()
+		}
+	}()
+	sr := io.NewSectionReader(readerAtFunc(func(p []byte, offset int64) (int, error) {
+		return blob.ReadAt(p, offset)
+	}), 0, blob.Size())
+	r, err := memory.NewReader(sr, metadata.WithDecompressors(new(zstdchunked.Decompressor)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read TOC (is it eStargz?): %w", err)
+	}
+	if want, ok := desc.Annotations[estargz.TOCJSONDigestAnnotation]; ok && r.TOCDigest().String() != want {
+		r.Close()
+		return nil, fmt.Errorf("invalid TOC digest %q; want %q", r.TOCDigest(), want)
+	}
+	return &layer{digest: desc.Digest, r: r, blob: blob}, nil
+}
+
+type readerAtFunc func([]byte, int64) (int, error)
+
+func (f readerAtFunc) ReadAt(p []byte, offset int64) (int, error) { return f(p, offset) }
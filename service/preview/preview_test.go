@@ -0,0 +1,184 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package preview
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/containerd/containerd/v2/pkg/reference"
+	"github.com/containerd/stargz-snapshotter/metadata/memory"
+	"github.com/containerd/stargz-snapshotter/util/testutil"
+	digest "github.com/opencontainers/go-digest"
+)
+
+func TestPreview(t *testing.T) {
+	layers := [][]testutil.TarEntry{
+		{
+			testutil.Dir("etc/"),
+			testutil.File("etc/removed", "removed"),
+			testutil.File("etc/kept", "kept"),
+			testutil.File("etc/replaced", "lower"),
+			testutil.Dir("opaque/"),
+			testutil.File("opaque/lower", "lower"),
+			testutil.Dir("dir2file/"),
+			testutil.File("dir2file/lower", "lower"),
+		},
+		{
+			testutil.Dir("etc/", testutil.WithDirXattrs(map[string]string{"user.foo": "bar"})),
+			testutil.File("etc/.wh.removed", ""),
+			testutil.File("etc/replaced", "upper"),
+			testutil.File("etc/added", "added"),
+			testutil.Symlink("etc/link", "kept"),
+			testutil.Dir("opaque/"),
+			testutil.File("opaque/.wh..wh..opq", ""),
+			testutil.File("opaque/upper", "upper"),
+			testutil.File("dir2file", "file"),
+		},
+	}
+	var digests []digest.Digest
+	load := func(ctx context.Context, refspec reference.Spec) (*image, error) {
+		img := &image{}
+		for i, ents := range layers {
+			sr, _, err := testutil.BuildEStargz(ents)
+			if err != nil {
+				return nil, err
+			}
+			r, err := memory.NewReader(sr)
+			if err != nil {
+				return nil, err
+			}
+			img.layers = append(img.layers, &layer{digest: digests[i], r: r})
+		}
+		return img, nil
+	}
+	for i := range layers {
+		digests = append(digests, digest.FromString(string(rune('0'+i))))
+	}
+	h := newHandler(Config{}, load)
+	hc := newHandler(Config{FileContents: true}, load)
+
+	get := func(h http.Handler, endpoint, p string) *httptest.ResponseRecorder {
+		q := url.Values{"ref": {"example.com/test:latest"}, "path": {p}}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, endpoint+"?"+q.Encode(), nil))
+		return rec
+	}
+	ls := func(p string) map[string]Entry {
+		rec := get(h, "/ls", p)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("ls %q: status %d: %s", p, rec.Code, rec.Body)
+		}
+		var ents []Entry
+		if err := json.NewDecoder(rec.Body).Decode(&ents); err != nil {
+			t.Fatalf("ls %q: failed to decode: %v", p, err)
+		}
+		m := make(map[string]Entry)
+		for _, e := range ents {
+			m[e.Name] = e
+		}
+		return m
+	}
+	checkNames := func(p string, want ...string) map[string]Entry {
+		got := ls(p)
+		if len(got) != len(want) {
+			t.Errorf("ls %q = %v; want %v", p, got, want)
+		}
+		for _, name := range want {
+			if _, ok := got[name]; !ok {
+				t.Errorf("ls %q: %q not found in %v", p, name, got)
+			}
+		}
+		return got
+	}
+
+	root := checkNames("/", "etc", "opaque", "dir2file")
+	if e := root["dir2file"]; e.Type != "reg" || e.Layer != digests[1] {
+		t.Errorf("dir2file must be the file of the upper layer: %+v", e)
+	}
+	etc := checkNames("/etc", "kept", "replaced", "added", "link")
+	if e := etc["kept"]; e.Layer != digests[0] || e.Size != 4 {
+		t.Errorf("kept must be the file of the lower layer: %+v", e)
+	}
+	if e := etc["replaced"]; e.Layer != digests[1] {
+		t.Errorf("replaced must be the file of the upper layer: %+v", e)
+	}
+	if e := etc["link"]; e.Type != "symlink" || e.LinkName != "kept" {
+		t.Errorf("unexpected symlink: %+v", e)
+	}
+	checkNames("/opaque", "upper")
+
+	var st Entry
+	if rec := get(h, "/stat", "/etc/"); rec.Code != http.StatusOK {
+		t.Fatalf("stat: status %d: %s", rec.Code, rec.Body)
+	} else if err := json.NewDecoder(rec.Body).Decode(&st); err != nil {
+		t.Fatalf("stat: failed to decode: %v", err)
+	}
+	if st.Type != "dir" || st.Xattrs["user.foo"] != "bar" {
+		t.Errorf("unexpected stat of etc: %+v", st)
+	}
+
+	du := func(p string) (u Usage) {
+		rec := get(h, "/du", p)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("du %q: status %d: %s", p, rec.Code, rec.Body)
+		}
+		if err := json.NewDecoder(rec.Body).Decode(&u); err != nil {
+			t.Fatalf("du %q: failed to decode: %v", p, err)
+		}
+		return u
+	}
+	if u := du("/etc"); u.Size != 10+16 || u.Entries != 4+3 || len(u.Layers) != 2 ||
+		u.Layers[0].Layer != digests[1] || u.Layers[0].Size != 10 || u.Layers[0].Entries != 4 {
+		t.Errorf("unexpected usage of etc: %+v", u)
+	}
+	if u := du("/opaque"); u.Size != 5 || u.Entries != 2 || len(u.Layers) != 1 { // lower is hidden
+		t.Errorf("unexpected usage of opaque: %+v", u)
+	}
+	if u := du("/"); u.Size != 19+26 || u.Entries != 9+8 { // landmarks aren't counted
+		t.Errorf("unexpected usage of root: %+v", u)
+	}
+
+	for _, tt := range []struct {
+		h        http.Handler
+		endpoint string
+		path     string
+		code     int
+	}{
+		{h, "/stat", "/etc/removed", http.StatusNotFound},
+		{h, "/stat", "/opaque/lower", http.StatusNotFound},
+		{h, "/stat", "/dir2file/lower", http.StatusNotFound},
+		{h, "/ls", "/dir2file", http.StatusBadRequest},
+		{h, "/du", "/dir2file", http.StatusBadRequest},
+		{h, "/du", "/etc/removed", http.StatusNotFound},
+		{h, "/ls", "relative", http.StatusBadRequest},
+		{h, "/file", "/etc/kept", http.StatusForbidden},
+		{hc, "/file", "/etc", http.StatusBadRequest},
+	} {
+		if rec := get(tt.h, tt.endpoint, tt.path); rec.Code != tt.code {
+			t.Errorf("%s %q: status %d; want %d: %s", tt.endpoint, tt.path, rec.Code, tt.code, rec.Body)
+		}
+	}
+
+	if rec := get(hc, "/file", "/etc/replaced"); rec.Code != http.StatusOK || rec.Body.String() != "upper" {
+		t.Errorf("unexpected contents: status %d: %q", rec.Code, rec.Body)
+	}
+}
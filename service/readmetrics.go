@@ -0,0 +1,77 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package service
+
+import (
+	"sync"
+
+	commonmetrics "github.com/containerd/stargz-snapshotter/fs/metrics/common"
+	"github.com/containerd/stargz-snapshotter/fs/reader"
+)
+
+const (
+	defaultReadMetricsMaxPaths = 1000
+
+	// otherFilesPath is the path label of the remote reads of the files beyond the max
+	// number of paths.
+	otherFilesPath = "other"
+)
+
+// readMetrics exports the reads of files to Prometheus. Remote reads are counted per file
+// path for up to maxPaths paths and the remote reads of the other files are counted as
+// otherFilesPath, so the cardinality of the metrics is bounded.
+type readMetrics struct {
+	maxPaths int
+
+	mu    sync.Mutex
+	paths map[string]struct{}
+}
+
+func newReadMetrics(cfg ReadMetricsConfig) *readMetrics {
+	maxPaths := cfg.MaxPaths
+	if maxPaths == 0 {
+		maxPaths = defaultReadMetricsMaxPaths
+	}
+	return &readMetrics{maxPaths: maxPaths, paths: make(map[string]struct{})}
+}
+
+func (m *readMetrics) OnReadStart(reader.ReadEvent) {}
+
+func (m *readMetrics) OnReadDone(ev reader.ReadEvent, stats reader.ReadStats) {
+	commonmetrics.ObserveFileRead(string(stats.Source), ev.Layer, stats.Bytes, stats.Latency)
+	if stats.Source == reader.ReadSourceRemote {
+		commonmetrics.IncFileRemoteReadCount(ev.Layer, m.pathLabel(ev.Path))
+	}
+}
+
+// pathLabel returns the path label of the file. New paths are labeled as otherFilesPath once
+// maxPaths paths are labeled.
+func (m *readMetrics) pathLabel(path string) string {
+	if path == "" {
+		return otherFilesPath
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.paths[path]; ok {
+		return path
+	}
+	if len(m.paths) >= m.maxPaths {
+		return otherFilesPath
+	}
+	m.paths[path] = struct{}{}
+	return path
+}
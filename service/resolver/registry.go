@@ -17,12 +17,17 @@
 package resolver
 
 import (
+	"context"
 	"fmt"
 	"net/http"
+	"sync"
 	"time"
 
+	ctdevents "github.com/containerd/containerd/v2/core/events"
 	"github.com/containerd/containerd/v2/core/remotes/docker"
 	"github.com/containerd/containerd/v2/pkg/reference"
+	"github.com/containerd/log"
+	"github.com/containerd/stargz-snapshotter/events"
 	"github.com/containerd/stargz-snapshotter/fs/source"
 	rhttp "github.com/hashicorp/go-retryablehttp"
 )
@@ -40,6 +45,11 @@ type Config struct {
 
 type HostConfig struct {
 	Mirrors []MirrorConfig `toml:"mirrors" json:"mirrors"`
+
+	// PlainHTTP is true means use http scheme instead of https for the host itself. Hosts other
+	// than localhost are connected with https unless explicitly allowed by this or Insecure of
+	// the mirrors.
+	PlainHTTP bool `toml:"plain_http" json:"plain_http"`
 }
 
 type MirrorConfig struct {
@@ -66,7 +76,8 @@ func RegistryHostsFromConfig(cfg Config, credsFuncs ...Credential) source.Regist
 	return func(ref reference.Spec) (hosts []docker.RegistryHost, _ error) {
 		host := ref.Hostname()
 		for _, h := range append(cfg.Host[host].Mirrors, MirrorConfig{
-			Host: host,
+			Host:     host,
+			Insecure: cfg.Host[host].PlainHTTP,
 		}) {
 			client := rhttp.NewClient()
 			client.Logger = nil // disable logging every request
@@ -123,6 +134,30 @@ func RegistryHostsFromConfig(cfg Config, credsFuncs ...Credential) source.Regist
 	}
 }
 
+// WarnPlainHTTP returns RegistryHosts that logs and publishes a warning event when hosts
+// connects to a registry host other than localhost with plain HTTP. The warning is emitted
+// once per host.
+func WarnPlainHTTP(ctx context.Context, hosts source.RegistryHosts, publisher ctdevents.Publisher) source.RegistryHosts {
+	var warned sync.Map
+	return func(ref reference.Spec) ([]docker.RegistryHost, error) {
+		rhs, err := hosts(ref)
+		for _, rh := range rhs {
+			if rh.Scheme != "http" {
+				continue
+			}
+			if localhost, _ := docker.MatchLocalhost(rh.Host); localhost {
+				continue
+			}
+			if _, loaded := warned.LoadOrStore(rh.Host, struct{}{}); loaded {
+				continue
+			}
+			log.G(ctx).WithField("host", rh.Host).Warn("connecting to registry with plain HTTP; contents and credentials are sent without encryption")
+			events.Publish(ctx, publisher, events.TopicPlainHTTP, &events.PlainHTTP{Host: rh.Host, Ref: ref.String()})
+		}
+		return rhs, err
+	}
+}
+
 func multiCredsFuncs(ref reference.Spec, credsFuncs ...Credential) func(string) (string, string, error) {
 	return func(host string) (string, string, error) {
 		for _, f := range credsFuncs {
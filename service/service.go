@@ -22,12 +22,14 @@ import (
 	"fmt"
 	"path/filepath"
 
+	"github.com/containerd/containerd/v2/core/events"
 	"github.com/containerd/containerd/v2/core/snapshots"
 	"github.com/containerd/containerd/v2/pkg/reference"
 	"github.com/containerd/containerd/v2/plugins/snapshots/overlay/overlayutils"
 	"github.com/containerd/log"
 	stargzfs "github.com/containerd/stargz-snapshotter/fs"
 	"github.com/containerd/stargz-snapshotter/fs/layer"
+	"github.com/containerd/stargz-snapshotter/fs/remote/objectstorage"
 	"github.com/containerd/stargz-snapshotter/fs/source"
 	"github.com/containerd/stargz-snapshotter/metadata"
 	esgzexternaltoc "github.com/containerd/stargz-snapshotter/nativeconverter/estargz/externaltoc"
@@ -39,9 +41,10 @@ import (
 type Option func(*options)
 
 type options struct {
-	credsFuncs    []resolver.Credential
-	registryHosts source.RegistryHosts
-	fsOpts        []stargzfs.Option
+	credsFuncs     []resolver.Credential
+	registryHosts  source.RegistryHosts
+	fsOpts         []stargzfs.Option
+	eventPublisher events.Publisher
 }
 
 // WithCredsFuncs specifies credsFuncs to be used for connecting to the registries.
@@ -65,8 +68,29 @@ func WithFilesystemOptions(opts ...stargzfs.Option) Option {
 	}
 }
 
+// WithEventPublisher specifies the publisher of the events instead of the one connecting
+// to the address in EventsConfig. This is used only when EventsConfig is enabled.
+func WithEventPublisher(p events.Publisher) Option {
+	return func(o *options) {
+		o.eventPublisher = p
+	}
+}
+
 // NewStargzSnapshotterService returns stargz snapshotter.
 func NewStargzSnapshotterService(ctx context.Context, root string, config *Config, opts ...Option) (snapshots.Snapshotter, error) {
+	var sOpts options
+	for _, o := range opts {
+		o(&sOpts)
+	}
+	publisher, err := eventPublisher(config, &sOpts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure event publisher: %w", err)
+	}
+	if publisher != nil {
+		// Share the publisher with the filesystem.
+		opts = append(opts, WithEventPublisher(publisher))
+	}
+
 	fs, err := NewFileSystem(ctx, root, config, opts...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to configure filesystem: %w", err)
@@ -78,6 +102,15 @@ func NewStargzSnapshotterService(ctx context.Context, root string, config *Confi
 	if config.AllowInvalidMountsOnRestart {
 		snOpts = append(snOpts, snapshot.AllowInvalidMountsOnRestart)
 	}
+	if config.WriteLayerRedirect != "" {
+		snOpts = append(snOpts, snapshot.WithWriteLayerRedirect(config.WriteLayerRedirect))
+	}
+	if publisher != nil {
+		snOpts = append(snOpts, snapshot.WithEventPublisher(publisher))
+	}
+	if config.DataOnlyLower {
+		snOpts = append(snOpts, snapshot.WithDataOnlyStore(dataOnlyStore(root)))
+	}
 
 	snapshotter, err = snapshot.NewSnapshotter(ctx, snapshotterRoot(root), fs, snOpts...)
 	if err != nil {
@@ -93,10 +126,16 @@ func NewFileSystem(ctx context.Context, root string, config *Config, opts ...Opt
 		o(&sOpts)
 	}
 
+	publisher, err := eventPublisher(config, &sOpts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure event publisher: %w", err)
+	}
+
 	hosts := sOpts.registryHosts
 	if hosts == nil {
 		// Use RegistryHosts based on ResolverConfig and keychain
-		hosts = resolver.RegistryHostsFromConfig(resolver.Config(config.ResolverConfig), sOpts.credsFuncs...)
+		hosts = resolver.WarnPlainHTTP(ctx,
+			resolver.RegistryHostsFromConfig(resolver.Config(config.ResolverConfig), sOpts.credsFuncs...), publisher)
 	}
 
 	userxattr, err := overlayutils.NeedsUserXAttr(snapshotterRoot(root))
@@ -117,6 +156,32 @@ func NewFileSystem(ctx context.Context, root string, config *Config, opts ...Opt
 			return []metadata.Decompressor{esgzexternaltoc.NewRemoteDecompressor(ctx, hosts, refspec, desc)}
 		}),
 	)
+	if osc := config.ObjectStorageConfig; osc.Enable {
+		var creds []objectstorage.Credential
+		for _, f := range sOpts.credsFuncs {
+			creds = append(creds, func(host string) (string, string, error) {
+				return f(host, reference.Spec{})
+			})
+		}
+		oc := objectstorage.Config{
+			S3Region:    osc.S3Region,
+			S3Endpoint:  osc.S3Endpoint,
+			GCSEndpoint: osc.GCSEndpoint,
+		}
+		if osc.S3EnvCredential {
+			oc.S3Credential = objectstorage.EnvS3Credential
+		}
+		fsOpts = append(fsOpts, stargzfs.WithResolveHandler("objectstorage", objectstorage.NewResolveHandler(oc, creds...)))
+	}
+	if publisher != nil {
+		fsOpts = append(fsOpts, stargzfs.WithEventPublisher(publisher))
+	}
+	if config.DataOnlyLower && !userxattr {
+		fsOpts = append(fsOpts, stargzfs.WithMetacopyStore(dataOnlyStore(root)))
+	}
+	if config.ReadMetricsConfig.Enable && !config.NoPrometheus {
+		fsOpts = append(fsOpts, stargzfs.WithReadHooks(newReadMetrics(config.ReadMetricsConfig)))
+	}
 	fs, err := stargzfs.NewFilesystem(fsRoot(root), config.Config, fsOpts...)
 	if err != nil {
 		return nil, err
@@ -125,6 +190,17 @@ func NewFileSystem(ctx context.Context, root string, config *Config, opts ...Opt
 	return fs, nil
 }
 
+// eventPublisher returns the publisher of the events or nil if events are disabled.
+func eventPublisher(config *Config, sOpts *options) (events.Publisher, error) {
+	if !config.EventsConfig.Enable {
+		return nil, nil
+	}
+	if sOpts.eventPublisher != nil {
+		return sOpts.eventPublisher, nil
+	}
+	return NewEventPublisher(config.EventsConfig)
+}
+
 func snapshotterRoot(root string) string {
 	return filepath.Join(root, "snapshotter")
 }
@@ -133,6 +209,10 @@ func fsRoot(root string) string {
 	return filepath.Join(root, "stargz")
 }
 
+func dataOnlyStore(root string) string {
+	return filepath.Join(root, "objects")
+}
+
 func sources(ps ...source.GetSources) source.GetSources {
 	return func(labels map[string]string) (source []source.Source, allErr error) {
 		var errs []error
@@ -22,8 +22,10 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"syscall"
 
+	ctdevents "github.com/containerd/containerd/v2/core/events"
 	"github.com/containerd/containerd/v2/core/mount"
 	"github.com/containerd/containerd/v2/core/snapshots"
 	"github.com/containerd/containerd/v2/core/snapshots/storage"
@@ -31,8 +33,11 @@ import (
 	"github.com/containerd/continuity/fs"
 	"github.com/containerd/errdefs"
 	"github.com/containerd/log"
+	"github.com/containerd/stargz-snapshotter/events"
+	"github.com/containerd/stargz-snapshotter/fs/metacopy"
 	"github.com/moby/sys/mountinfo"
 	"golang.org/x/sync/errgroup"
+	"golang.org/x/sys/unix"
 )
 
 const (
@@ -51,6 +56,15 @@ const (
 	remoteSnapshotLogKey = "remote-snapshot-prepared"
 	prepareSucceeded     = "true"
 	prepareFailed        = "false"
+
+	// WriteLayerRedirectDirectory makes the snapshotter compose the overlay of writable
+	// snapshots with the upper directory on the snapshotter's root. See WithWriteLayerRedirect.
+	WriteLayerRedirectDirectory = "directory"
+
+	// WriteLayerRedirectTmpfs makes the snapshotter compose the overlay of writable snapshots
+	// with the upper directory on tmpfs. Changes are copied to the snapshotter's root on commit.
+	// See WithWriteLayerRedirect.
+	WriteLayerRedirectTmpfs = "tmpfs"
 )
 
 // FileSystem is a backing filesystem abstraction.
@@ -68,11 +82,33 @@ type FileSystem interface {
 	Unmount(ctx context.Context, mountpoint string) error
 }
 
+// Flusher is optionally implemented by FileSystem that keeps the data of the mounted
+// layers in memory. Flush writes it to the disk so it survives the exit of the process
+// without unmounting the layers.
+type Flusher interface {
+	Flush(ctx context.Context) error
+}
+
+// Cloner is implemented by the snapshotter returned by NewSnapshotter.
+//
+// Clone creates the active snapshot key on the parent of the active snapshot source, with a
+// copy of the labels and the changes of source. opts are applied after the labels are copied.
+// The clone shares the lower layers with source, including the remote snapshots which have
+// already been mounted and checked for source, so they aren't resolved or checked again for
+// the clone. After cloning, source and the clone are modified independently. The changes of
+// source must not be modified during cloning.
+type Cloner interface {
+	Clone(ctx context.Context, key, source string, opts ...snapshots.Opt) ([]mount.Mount, error)
+}
+
 // SnapshotterConfig is used to configure the remote snapshotter instance
 type SnapshotterConfig struct {
 	asyncRemove                 bool
 	noRestore                   bool
 	allowInvalidMountsOnRestart bool
+	writeLayerRedirect          string
+	eventPublisher              ctdevents.Publisher
+	dataOnlyStore               string
 }
 
 // Opt is an option to configure the remote snapshotter
@@ -97,6 +133,33 @@ func AllowInvalidMountsOnRestart(config *SnapshotterConfig) error {
 	return nil
 }
 
+// WithWriteLayerRedirect makes the snapshotter mount the overlay of the writable layer and
+// the (lazily pulled) lower layers by itself and return a single bind mount of the merged
+// directory instead of an overlay mount. This is for runtimes that can't assemble overlay
+// mounts themselves. The mount is made in the mount namespace of the snapshotter so it must
+// be propagated to the runtime, as the mounts of remote snapshots are. upper is
+// WriteLayerRedirectDirectory or WriteLayerRedirectTmpfs.
+func WithWriteLayerRedirect(upper string) Opt {
+	return func(config *SnapshotterConfig) error {
+		switch upper {
+		case WriteLayerRedirectDirectory, WriteLayerRedirectTmpfs:
+		default:
+			return fmt.Errorf("unknown upper of write layer redirect %q", upper)
+		}
+		config.writeLayerRedirect = upper
+		return nil
+	}
+}
+
+// WithEventPublisher makes the snapshotter publish the events of remote snapshots (e.g.
+// events.TopicSealed) with the publisher.
+func WithEventPublisher(p ctdevents.Publisher) Opt {
+	return func(config *SnapshotterConfig) error {
+		config.eventPublisher = p
+		return nil
+	}
+}
+
 type snapshotter struct {
 	root        string
 	ms          *storage.MetaStore
@@ -107,6 +170,29 @@ type snapshotter struct {
 	userxattr                   bool // whether to enable "userxattr" mount option
 	noRestore                   bool
 	allowInvalidMountsOnRestart bool
+
+	// writeLayerRedirect is the upper of the overlay composed by the snapshotter. Empty if
+	// the snapshotter returns overlay mounts.
+	writeLayerRedirect string
+	redirectMu         sync.Mutex
+
+	eventPublisher ctdevents.Publisher
+
+	// dataOnlyStore is the data-only lower layer of metadata-only lowers. Empty if
+	// metadata-only lowers aren't used.
+	dataOnlyStore string
+}
+
+// WithDataOnlyStore makes the snapshotter compose overlays with the metadata-only lowers
+// of the remote snapshots instead of their mountpoints once they are generated (see the
+// metacopy package). store is the data-only lower layer shared among snapshots and is
+// pruned on Cleanup. This requires Linux 6.5 or later and is ignored when overlayfs
+// needs "userxattr".
+func WithDataOnlyStore(store string) Opt {
+	return func(config *SnapshotterConfig) error {
+		config.dataOnlyStore = store
+		return nil
+	}
 }
 
 // NewSnapshotter returns a Snapshotter which can use unpacked remote layers
@@ -157,6 +243,11 @@ func NewSnapshotter(ctx context.Context, root string, targetFs FileSystem, opts
 		userxattr:                   userxattr,
 		noRestore:                   config.noRestore,
 		allowInvalidMountsOnRestart: config.allowInvalidMountsOnRestart,
+		writeLayerRedirect:          config.writeLayerRedirect,
+		eventPublisher:              config.eventPublisher,
+	}
+	if config.dataOnlyStore != "" && !userxattr {
+		o.dataOnlyStore = config.dataOnlyStore
 	}
 
 	if err := o.restoreRemoteSnapshot(ctx); err != nil {
@@ -265,6 +356,9 @@ func (o *snapshotter) Prepare(ctx context.Context, key, parent string, opts ...s
 		} else {
 			base.Labels[remoteLabel] = remoteLabelVal // Mark this snapshot as remote
 			err := o.commit(ctx, true, target, key, append(opts, snapshots.WithLabels(base.Labels))...)
+			if err == nil {
+				events.Publish(ctx, o.eventPublisher, events.TopicSealed, &events.Sealed{Key: key, Name: target, Parent: parent})
+			}
 			if err == nil || errdefs.IsAlreadyExists(err) {
 				// count also AlreadyExists as "success"
 				log.G(lCtx).WithField(remoteSnapshotLogKey, prepareSucceeded).Debug("prepared remote snapshot")
@@ -288,6 +382,63 @@ func (o *snapshotter) View(ctx context.Context, key, parent string, opts ...snap
 	return o.mounts(ctx, s, parent)
 }
 
+// Clone implements Cloner.
+func (o *snapshotter) Clone(ctx context.Context, key, source string, opts ...snapshots.Opt) (_ []mount.Mount, retErr error) {
+	sctx, t, err := o.ms.TransactionContext(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	id, info, _, err := storage.GetInfo(sctx, source)
+	t.Rollback()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get source snapshot %q: %w", source, err)
+	}
+	if info.Kind != snapshots.KindActive {
+		return nil, fmt.Errorf("source snapshot %q isn't active: %w", source, errdefs.ErrFailedPrecondition)
+	}
+
+	labels := make(map[string]string, len(info.Labels))
+	for k, v := range info.Labels {
+		labels[k] = v
+	}
+	s, err := o.createSnapshot(ctx, snapshots.KindActive, key, info.Parent, append([]snapshots.Opt{snapshots.WithLabels(labels)}, opts...))
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if retErr != nil {
+			if err := o.Remove(ctx, key); err != nil {
+				log.G(ctx).WithError(err).WithField("key", key).Warn("failed to remove clone")
+			}
+		}
+	}()
+	if err := o.copyChanges(s.ID, id); err != nil {
+		return nil, fmt.Errorf("failed to copy changes of %q: %w", source, err)
+	}
+
+	// The lower layers have been checked for source.
+	return o.mounts(ctx, s, "")
+}
+
+// copyChanges copies the changes of the active snapshot src to the active snapshot dst.
+// When the changes are on tmpfs, they are copied from and to tmpfs.
+func (o *snapshotter) copyChanges(dst, src string) error {
+	if o.writeLayerRedirect != WriteLayerRedirectTmpfs {
+		return fs.CopyDir(o.upperPath(dst), o.upperPath(src))
+	}
+
+	o.redirectMu.Lock()
+	defer o.redirectMu.Unlock()
+	srcUpper := o.upperPath(src)
+	if mounted, err := mountinfo.Mounted(o.tmpfsPath(src)); err == nil && mounted {
+		srcUpper = o.tmpfsUpperPath(src)
+	}
+	if err := o.prepareTmpfs(dst); err != nil {
+		return err
+	}
+	return fs.CopyDir(o.tmpfsUpperPath(dst), srcUpper)
+}
+
 // Mounts returns the mounts for the transaction identified by key. Can be
 // called on an read-write or readonly transaction.
 //
@@ -330,6 +481,12 @@ func (o *snapshotter) commit(ctx context.Context, isRemote bool, name, key strin
 		return err
 	}
 
+	if !isRemote && o.writeLayerRedirect != "" {
+		if err := o.releaseRedirect(ctx, id, true); err != nil {
+			return fmt.Errorf("failed to release composed mount: %w", err)
+		}
+	}
+
 	if !isRemote { // skip diskusage for remote snapshots for allowing lazy preparation of nodes
 		du, err := fs.DiskUsage(ctx, o.upperPath(id))
 		if err != nil {
@@ -422,6 +579,18 @@ func (o *snapshotter) cleanup(ctx context.Context, cleanupCommitted bool) error
 		}
 	}
 
+	if o.dataOnlyStore != "" {
+		metaDirs, err := filepath.Glob(filepath.Join(o.root, "snapshots", "*", "meta"))
+		if err != nil {
+			return err
+		}
+		if removed, err := metacopy.Prune(o.dataOnlyStore, metaDirs); err != nil {
+			log.G(ctx).WithError(err).Warn("failed to prune data-only store")
+		} else {
+			log.G(ctx).Debugf("cleanup: pruned %d objects in data-only store", removed)
+		}
+	}
+
 	return nil
 }
 
@@ -500,6 +669,11 @@ func (o *snapshotter) cleanupSnapshotDirectory(ctx context.Context, dir string)
 	if err := o.fs.Unmount(ctx, mp); err != nil {
 		log.G(ctx).WithError(err).WithField("dir", mp).Debug("failed to unmount")
 	}
+	if o.writeLayerRedirect != "" {
+		if err := o.releaseRedirect(ctx, filepath.Base(dir), false); err != nil {
+			log.G(ctx).WithError(err).WithField("dir", dir).Debug("failed to unmount composed mount")
+		}
+	}
 	if err := os.RemoveAll(dir); err != nil {
 		return fmt.Errorf("failed to remove directory %q: %w", dir, err)
 	}
@@ -628,9 +802,13 @@ func (o *snapshotter) mounts(ctx context.Context, s storage.Snapshot, checkKey s
 	var options []string
 
 	if s.Kind == snapshots.KindActive {
+		upper, work := o.upperPath(s.ID), o.workPath(s.ID)
+		if o.writeLayerRedirect == WriteLayerRedirectTmpfs {
+			upper, work = o.tmpfsUpperPath(s.ID), o.tmpfsWorkPath(s.ID)
+		}
 		options = append(options,
-			fmt.Sprintf("workdir=%s", o.workPath(s.ID)),
-			fmt.Sprintf("upperdir=%s", o.upperPath(s.ID)),
+			fmt.Sprintf("workdir=%s", work),
+			fmt.Sprintf("upperdir=%s", upper),
 		)
 	} else if len(s.ParentIDs) == 1 {
 		return []mount.Mount{
@@ -646,22 +824,135 @@ func (o *snapshotter) mounts(ctx context.Context, s storage.Snapshot, checkKey s
 	}
 
 	parentPaths := make([]string, len(s.ParentIDs))
+	var useMetacopy bool
 	for i := range s.ParentIDs {
 		parentPaths[i] = o.upperPath(s.ParentIDs[i])
+		if o.dataOnlyStore != "" {
+			if meta := metacopy.MetadataDir(parentPaths[i]); metacopy.Exists(meta) {
+				parentPaths[i], useMetacopy = meta, true
+			}
+		}
 	}
 
-	options = append(options, fmt.Sprintf("lowerdir=%s", strings.Join(parentPaths, ":")))
+	lowerdir := strings.Join(parentPaths, ":")
+	if useMetacopy {
+		lowerdir += "::" + o.dataOnlyStore
+		options = append(options, "metacopy=on", "redirect_dir=on")
+	}
+	options = append(options, fmt.Sprintf("lowerdir=%s", lowerdir))
 	if o.userxattr {
 		options = append(options, "userxattr")
 	}
-	return []mount.Mount{
-		{
-			Type:    "overlay",
-			Source:  "overlay",
-			Options: options,
-		},
-	}, nil
+	m := mount.Mount{
+		Type:    "overlay",
+		Source:  "overlay",
+		Options: options,
+	}
+	if o.writeLayerRedirect != "" && s.Kind == snapshots.KindActive {
+		if err := o.redirect(ctx, s.ID, m); err != nil {
+			return nil, fmt.Errorf("failed to compose mount of %q: %w", s.ID, err)
+		}
+		return []mount.Mount{
+			{
+				Source: o.mergedPath(s.ID),
+				Type:   "bind",
+				Options: []string{
+					"rw",
+					"rbind",
+				},
+			},
+		}, nil
+	}
+	return []mount.Mount{m}, nil
+
+}
+
+// redirect mounts the overlay m of the active snapshot id on the merged directory unless
+// it's already mounted. The upper directory is prepared on tmpfs if configured.
+func (o *snapshotter) redirect(ctx context.Context, id string, m mount.Mount) error {
+	o.redirectMu.Lock()
+	defer o.redirectMu.Unlock()
+
+	merged := o.mergedPath(id)
+	if err := os.Mkdir(merged, 0755); err != nil && !os.IsExist(err) {
+		return err
+	}
+	if mounted, err := mountinfo.Mounted(merged); err != nil {
+		return err
+	} else if mounted {
+		return nil
+	}
+	if o.writeLayerRedirect == WriteLayerRedirectTmpfs {
+		if err := o.prepareTmpfs(id); err != nil {
+			return err
+		}
+	}
+	log.G(ctx).WithField("mountpoint", merged).Debug("composing mount of writable snapshot")
+	return m.Mount(merged)
+}
+
+// prepareTmpfs mounts tmpfs for the upper and work directories of the snapshot id. The
+// upper directory has the same owner as the upper directory on the snapshotter's root.
+func (o *snapshotter) prepareTmpfs(id string) error {
+	dir := o.tmpfsPath(id)
+	if err := os.Mkdir(dir, 0700); err != nil && !os.IsExist(err) {
+		return err
+	}
+	mounted, err := mountinfo.Mounted(dir)
+	if err != nil {
+		return err
+	}
+	if !mounted {
+		if err := unix.Mount("tmpfs", dir, "tmpfs", 0, "mode=0700"); err != nil {
+			return fmt.Errorf("failed to mount tmpfs: %w", err)
+		}
+	}
+	st, err := os.Stat(o.upperPath(id))
+	if err != nil {
+		return err
+	}
+	stat := st.Sys().(*syscall.Stat_t)
+	if err := os.Mkdir(o.tmpfsUpperPath(id), st.Mode().Perm()); err != nil && !os.IsExist(err) {
+		return err
+	}
+	if err := os.Lchown(o.tmpfsUpperPath(id), int(stat.Uid), int(stat.Gid)); err != nil {
+		return err
+	}
+	if err := os.Mkdir(o.tmpfsWorkPath(id), 0711); err != nil && !os.IsExist(err) {
+		return err
+	}
+	return nil
+}
 
+// releaseRedirect unmounts the composed mount of the snapshot id. If save is true, changes
+// on tmpfs are copied to the upper directory on the snapshotter's root before unmounting
+// tmpfs so that they can be committed.
+func (o *snapshotter) releaseRedirect(ctx context.Context, id string, save bool) error {
+	o.redirectMu.Lock()
+	defer o.redirectMu.Unlock()
+
+	if err := mount.UnmountAll(o.mergedPath(id), 0); err != nil {
+		return err
+	}
+	if o.writeLayerRedirect != WriteLayerRedirectTmpfs {
+		return nil
+	}
+	tmpfs := o.tmpfsPath(id)
+	if mounted, err := mountinfo.Mounted(tmpfs); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	} else if !mounted {
+		return nil
+	}
+	if save {
+		log.G(ctx).WithField("snapshot", id).Debug("saving changes on tmpfs")
+		if err := fs.CopyDir(o.upperPath(id), o.tmpfsUpperPath(id)); err != nil {
+			return fmt.Errorf("failed to copy changes on tmpfs: %w", err)
+		}
+	}
+	return mount.UnmountAll(tmpfs, 0)
 }
 
 func (o *snapshotter) upperPath(id string) string {
@@ -672,6 +963,22 @@ func (o *snapshotter) workPath(id string) string {
 	return filepath.Join(o.root, "snapshots", id, "work")
 }
 
+func (o *snapshotter) mergedPath(id string) string {
+	return filepath.Join(o.root, "snapshots", id, "merged")
+}
+
+func (o *snapshotter) tmpfsPath(id string) string {
+	return filepath.Join(o.root, "snapshots", id, "tmpfs")
+}
+
+func (o *snapshotter) tmpfsUpperPath(id string) string {
+	return filepath.Join(o.tmpfsPath(id), "fs")
+}
+
+func (o *snapshotter) tmpfsWorkPath(id string) string {
+	return filepath.Join(o.tmpfsPath(id), "work")
+}
+
 // Close closes the snapshotter
 func (o *snapshotter) Close() error {
 	// unmount all mounts including Committed
@@ -24,13 +24,17 @@ import (
 	"path/filepath"
 	"syscall"
 	"testing"
+	"time"
 
+	ctdevents "github.com/containerd/containerd/v2/core/events"
 	"github.com/containerd/containerd/v2/core/mount"
 	"github.com/containerd/containerd/v2/core/snapshots"
 	"github.com/containerd/containerd/v2/core/snapshots/storage"
 	"github.com/containerd/containerd/v2/core/snapshots/testsuite"
 	"github.com/containerd/containerd/v2/pkg/testutil"
 	"github.com/containerd/errdefs"
+	"github.com/containerd/stargz-snapshotter/events"
+	"github.com/moby/sys/mountinfo"
 )
 
 const (
@@ -102,6 +106,38 @@ func TestRemotePrepare(t *testing.T) {
 	}
 }
 
+type testPublisher chan ctdevents.Event
+
+func (p testPublisher) Publish(ctx context.Context, topic string, event ctdevents.Event) error {
+	if topic == events.TopicSealed {
+		p <- event
+	}
+	return nil
+}
+
+func TestSealedEvent(t *testing.T) {
+	testutil.RequiresRoot(t)
+	ctx := context.TODO()
+	root := t.TempDir()
+	p := make(testPublisher, 1)
+	sn, err := NewSnapshotter(ctx, root, bindFileSystem(t), WithEventPublisher(p))
+	if err != nil {
+		t.Fatalf("failed to make new remote snapshotter: %q", err)
+	}
+	defer sn.Close()
+
+	target := prepareWithTarget(t, sn, "testTarget", "/tmp/prepareTarget", "", nil)
+	defer sn.Remove(ctx, target)
+	select {
+	case ev := <-p:
+		if s, ok := ev.(*events.Sealed); !ok || s.Name != target || s.Key != "/tmp/prepareTarget" {
+			t.Errorf("unexpected event %+v", ev)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("sealed event isn't published")
+	}
+}
+
 func TestRemoteOverlay(t *testing.T) {
 	testutil.RequiresRoot(t)
 	ctx := context.TODO()
@@ -231,6 +267,95 @@ func TestRemoteCommit(t *testing.T) {
 	}
 }
 
+func TestWriteLayerRedirect(t *testing.T) {
+	testutil.RequiresRoot(t)
+	for _, upper := range []string{WriteLayerRedirectDirectory, WriteLayerRedirectTmpfs} {
+		t.Run(upper, func(t *testing.T) {
+			ctx := context.TODO()
+			root, err := os.MkdirTemp("", "remote")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(root)
+			sn, err := NewSnapshotter(context.TODO(), root, bindFileSystem(t), WithWriteLayerRedirect(upper))
+			if err != nil {
+				t.Fatalf("failed to make new remote snapshotter: %q", err)
+			}
+			defer sn.Close()
+
+			// Prepare a remote snapshot.
+			target := prepareWithTarget(t, sn, "testTarget", "/tmp/prepareTarget", "", nil)
+
+			// Prepare a new snapshot based on the remote snapshot. This must be a bind mount
+			// of the overlay composed by the snapshotter.
+			pKey := "/tmp/test"
+			mounts, err := sn.Prepare(ctx, pKey, target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(mounts) != 1 || mounts[0].Type != "bind" {
+				t.Fatalf("expected a bind mount but received %+v", mounts)
+			}
+			if again, err := sn.Mounts(ctx, pKey); err != nil || again[0].Source != mounts[0].Source {
+				t.Fatalf("mounts must be stable: %+v, %v", again, err)
+			}
+			snapshot, err := os.MkdirTemp("", "snapshot")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(snapshot)
+			m := mounts[0]
+			if err := m.Mount(snapshot); err != nil {
+				t.Fatal(err)
+			}
+			data, err := os.ReadFile(filepath.Join(snapshot, remoteSampleFile))
+			if err != nil {
+				t.Fatalf("failed to read a file in the remote snapshot: %v", err)
+			}
+			if e := string(data); e != remoteSampleFileContents {
+				t.Fatalf("expected file contents %q but got %q", remoteSampleFileContents, e)
+			}
+			if err := os.WriteFile(filepath.Join(snapshot, "bar"), []byte("hi"), 0660); err != nil {
+				t.Fatal(err)
+			}
+			mount.Unmount(snapshot, 0)
+
+			// Changes must be committed.
+			cKey := "/tmp/layer"
+			if err := sn.Commit(ctx, cKey, pKey); err != nil {
+				t.Fatal(err)
+			}
+			mounts, err = sn.Prepare(ctx, "/tmp/test2", cKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m = mounts[0]
+			if err := m.Mount(snapshot); err != nil {
+				t.Fatal(err)
+			}
+			data, err = os.ReadFile(filepath.Join(snapshot, "bar"))
+			mount.Unmount(snapshot, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if e := string(data); e != "hi" {
+				t.Fatalf("expected file contents %q but got %q", "hi", e)
+			}
+
+			// Composed mounts must be released on removal.
+			if err := sn.Remove(ctx, "/tmp/test2"); err != nil {
+				t.Fatal(err)
+			}
+			if err := sn.(snapshots.Cleaner).Cleanup(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if mounted, err := mountinfo.Mounted(m.Source); err == nil && mounted {
+				t.Errorf("composed mount %q must be unmounted", m.Source)
+			}
+		})
+	}
+}
+
 func TestFailureDetection(t *testing.T) {
 	testutil.RequiresRoot(t)
 	tests := []struct {
@@ -510,6 +635,75 @@ func TestOverlayCommit(t *testing.T) {
 	}
 }
 
+func TestClone(t *testing.T) {
+	ctx := context.TODO()
+	root, err := os.MkdirTemp("", "overlay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	o, _, err := newSnapshotter(ctx, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := o.Prepare(ctx, "/tmp/base", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Commit(ctx, "base", "/tmp/base"); err != nil {
+		t.Fatal(err)
+	}
+	source := "/tmp/source"
+	if _, err := o.Prepare(ctx, source, "base", snapshots.WithLabels(map[string]string{"foo": "a"})); err != nil {
+		t.Fatal(err)
+	}
+	sourceUpper := filepath.Join(getBasePath(ctx, o, root, source), "fs")
+	if err := os.WriteFile(filepath.Join(sourceUpper, "foo"), []byte("hi"), 0660); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := o.(Cloner).Clone(ctx, "/tmp/clone", "base"); !errdefs.IsFailedPrecondition(err) {
+		t.Errorf("cloning committed snapshot must fail with failed precondition: %v", err)
+	}
+	clone := "/tmp/clone"
+	mounts, err := o.(Cloner).Clone(ctx, clone, source, snapshots.WithLabels(map[string]string{"bar": "b"}))
+	if err != nil {
+		t.Fatalf("failed to clone: %v", err)
+	}
+	info, err := o.Stat(ctx, clone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Kind != snapshots.KindActive || info.Parent != "base" {
+		t.Errorf("clone is %v snapshot on %q; want active snapshot on %q", info.Kind, info.Parent, "base")
+	}
+	if info.Labels["bar"] != "b" {
+		t.Errorf("labels of clone are %v; want the labels passed to Clone", info.Labels)
+	}
+	if len(mounts) != 1 || mounts[0].Type != "overlay" {
+		t.Fatalf("clone must be mounted with overlay: %v", mounts)
+	}
+	cloneUpper := filepath.Join(getBasePath(ctx, o, root, clone), "fs")
+	if data, err := os.ReadFile(filepath.Join(cloneUpper, "foo")); err != nil || string(data) != "hi" {
+		t.Errorf("changes of source must be copied to clone: %q, %v", data, err)
+	}
+
+	// Changes of the clone aren't visible from the source.
+	if err := os.WriteFile(filepath.Join(cloneUpper, "foo"), []byte("bye"), 0660); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(filepath.Join(sourceUpper, "foo")); err != nil || string(data) != "hi" {
+		t.Errorf("source must not be modified by clone: %q, %v", data, err)
+	}
+
+	// Labels are copied from the source if they aren't passed.
+	if _, err := o.(Cloner).Clone(ctx, "/tmp/clone2", source); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := o.Stat(ctx, "/tmp/clone2"); err != nil || info.Labels["foo"] != "a" {
+		t.Errorf("labels of source must be copied to clone: %v, %v", info.Labels, err)
+	}
+}
+
 func TestOverlayOverlayMount(t *testing.T) {
 	ctx := context.TODO()
 	root, err := os.MkdirTemp("", "overlay")
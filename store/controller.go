@@ -0,0 +1,89 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package store
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"maps"
+	"sync"
+
+	"github.com/containerd/containerd/v2/pkg/reference"
+	"github.com/containerd/stargz-snapshotter/store/pb"
+)
+
+// NewControllerServer returns the server of the controller API of the store, which adds the
+// credentials passed by the clients (e.g. Podman) to the keychain.
+func NewControllerServer(k *Keychain) pb.ControllerServer {
+	return &controller{keychain: k}
+}
+
+type controller struct {
+	keychain *Keychain
+}
+
+func (c *controller) AddCredential(ctx context.Context, req *pb.AddCredentialRequest) (resp *pb.AddCredentialResponse, _ error) {
+	return &pb.AddCredentialResponse{}, c.keychain.Add(req.Data)
+}
+
+type authConfig struct {
+	Username      string `json:"username,omitempty"`
+	Password      string `json:"password,omitempty"`
+	IdentityToken string `json:"identityToken,omitempty"`
+}
+
+// Keychain is the credentials of the images added through the controller API.
+type Keychain struct {
+	config   map[string]authConfig
+	configMu sync.Mutex
+}
+
+// Add adds the credentials in data, the JSON object of the credentials keyed by the image
+// references.
+func (k *Keychain) Add(data []byte) error {
+	conf := make(map[string]authConfig)
+	if err := json.NewDecoder(bytes.NewReader(data)).Decode(&conf); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	k.configMu.Lock()
+	if k.config == nil {
+		k.config = make(map[string]authConfig)
+	}
+	maps.Copy(k.config, conf)
+	k.configMu.Unlock()
+	return nil
+}
+
+// Credentials returns the credentials of the image. This can be used as resolver.Credential.
+func (k *Keychain) Credentials(host string, refspec reference.Spec) (string, string, error) {
+	if host != refspec.Hostname() {
+		return "", "", nil // Do not use creds for mirrors
+	}
+	k.configMu.Lock()
+	defer k.configMu.Unlock()
+	if acfg, ok := k.config[refspec.String()]; ok {
+		if acfg.IdentityToken != "" {
+			return "", acfg.IdentityToken, nil
+		} else if acfg.Username != "" || acfg.Password != "" {
+			return acfg.Username, acfg.Password, nil
+		}
+	}
+	return "", "", nil
+}
@@ -281,7 +281,7 @@ func (r *LayerManager) resolveLayer(ctx context.Context, refspec reference.Spec,
 	// about NW traffic.
 	if !r.noBackgroundFetch {
 		go func() {
-			if err := l.BackgroundFetch(); err != nil {
+			if err := l.BackgroundFetch(nil, nil); err != nil {
 				log.G(ctx).WithError(err).Debug("failed to fetch whole layer")
 				return
 			}
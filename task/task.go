@@ -21,8 +21,6 @@ import (
 	"sync"
 	"sync/atomic"
 	"time"
-
-	"golang.org/x/sync/semaphore"
 )
 
 // NewBackgroundTaskManager provides a task manager. You can specify the
@@ -31,7 +29,8 @@ import (
 // specify the period through the argument of this function, too.
 func NewBackgroundTaskManager(concurrency int64, period time.Duration) *BackgroundTaskManager {
 	return &BackgroundTaskManager{
-		backgroundSem:                semaphore.NewWeighted(concurrency),
+		backgroundConcurrency:        concurrency,
+		backgroundCond:               sync.NewCond(&sync.Mutex{}),
 		prioritizedTaskSilencePeriod: period,
 		prioritizedTaskStartNotify:   make(chan struct{}),
 		prioritizedTaskDoneCond:      sync.NewCond(&sync.Mutex{}),
@@ -54,14 +53,17 @@ func NewBackgroundTaskManager(concurrency int64, period time.Duration) *Backgrou
 // The task is forced to wait until no prioritized task is running for some
 // period. You can specify the period when making this manager instance. The
 // limited number of background tasks run simultaneously and you can specify the
-// concurrency when making this manager instance too. If a prioritized task
+// concurrency when making this manager instance too and change it with
+// SetConcurrency method. If a prioritized task
 // starts during the execution of background tasks, all background tasks running
 // will be cancelled via context. These cancelled tasks will be executed again
 // later, same as other background tasks (when no prioritized task is running
 // for some period).
 type BackgroundTaskManager struct {
 	prioritizedTasks             int64
-	backgroundSem                *semaphore.Weighted
+	backgroundConcurrency        int64
+	backgroundRunning            int64
+	backgroundCond               *sync.Cond
 	prioritizedTaskSilencePeriod time.Duration
 	prioritizedTaskStartNotify   chan struct{}
 	prioritizedTaskStartNotifyMu sync.Mutex
@@ -113,8 +115,8 @@ func (ts *BackgroundTaskManager) InvokeBackgroundTask(do func(context.Context),
 		// limited number of background tasks can run at once.
 		// if prioritized tasks are running, cancel this task.
 		if func() bool {
-			ts.backgroundSem.Acquire(context.Background(), 1)
-			defer ts.backgroundSem.Release(1)
+			ts.acquireBackground()
+			defer ts.releaseBackground()
 
 			// Get notify the prioritized tasks execution.
 			ts.prioritizedTaskStartNotifyMu.Lock()
@@ -150,3 +152,36 @@ func (ts *BackgroundTaskManager) InvokeBackgroundTask(do func(context.Context),
 		}
 	}
 }
+
+// SetConcurrency changes the number of background tasks that can run simultaneously.
+// Running tasks aren't stopped even if they exceed the new concurrency but new tasks
+// wait until the number of running tasks falls below it.
+func (ts *BackgroundTaskManager) SetConcurrency(concurrency int64) {
+	ts.backgroundCond.L.Lock()
+	ts.backgroundConcurrency = concurrency
+	ts.backgroundCond.Broadcast()
+	ts.backgroundCond.L.Unlock()
+}
+
+// Concurrency returns the number of background tasks that can run simultaneously.
+func (ts *BackgroundTaskManager) Concurrency() int64 {
+	ts.backgroundCond.L.Lock()
+	defer ts.backgroundCond.L.Unlock()
+	return ts.backgroundConcurrency
+}
+
+func (ts *BackgroundTaskManager) acquireBackground() {
+	ts.backgroundCond.L.Lock()
+	for ts.backgroundRunning >= ts.backgroundConcurrency {
+		ts.backgroundCond.Wait()
+	}
+	ts.backgroundRunning++
+	ts.backgroundCond.L.Unlock()
+}
+
+func (ts *BackgroundTaskManager) releaseBackground() {
+	ts.backgroundCond.L.Lock()
+	ts.backgroundRunning--
+	ts.backgroundCond.Broadcast()
+	ts.backgroundCond.L.Unlock()
+}
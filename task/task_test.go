@@ -91,6 +91,28 @@ func TestBackgroundTasks(t *testing.T) {
 					task4.assert(false, false, false))
 			},
 		},
+		{
+			name:          "set_concurrency",
+			concurrency:   1,
+			checkInterval: time.Duration(0), // We don't care prioritized tasks now
+			context: func(t *testing.T, pm *BackgroundTaskManager, task1, task2, task3, task4 *sampleTask) {
+				doGo(func() { pm.InvokeBackgroundTask(task1.do, 24*time.Hour) })
+				wait(t, "task1 started", task1.checkStarted())
+				doGo(func() { pm.InvokeBackgroundTask(task2.do, 24*time.Hour) })
+				pm.SetConcurrency(2)
+				wait(t, "task2 started", task2.checkStarted())
+				pm.SetConcurrency(1)
+				task1.finish()
+				wait(t, "task1 done", task1.checkDone())
+				doGo(func() { pm.InvokeBackgroundTask(task3.do, 24*time.Hour) })
+				time.Sleep(300 * time.Millisecond) // wait for long time...
+			},
+			assert: func(task1, task2, task3, task4 *sampleTask) bool {
+				return (task1.assert(true, true, false) &&
+					task2.assert(true, false, false) &&
+					task3.assert(false, false, false))
+			},
+		},
 		{
 			name:          "cancel",
 			concurrency:   2,
@@ -0,0 +1,147 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package criuutil contains helpers for checkpointing and restoring (e.g. with
+// CRIU) containers running on lazily pulled layers.
+//
+// When a process is checkpointed, CRIU only dumps anonymous memory and records
+// file-backed mappings by path. On restore, these files are mapped again from the
+// snapshot on the destination node. FetchMappedRegions can be used before the
+// checkpoint to make sure that all currently mapped regions are available in the
+// local cache so that the dump doesn't block on the network.
+//
+// Layers mounted in the mount namespace of the container are passed to CRIU as
+// external mounts keyed by the layer digest (see ExternalMounts), which is the same
+// on every node unlike the mount IDs. BindMount mounts the layer on the destination
+// node to be passed to the restored container. Files on layers can be recorded with
+// Handle and opened again on the destination node.
+package criuutil
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/log"
+)
+
+// Region is a file-backed memory mapping of a process.
+type Region struct {
+	// Start and End are the virtual addresses of the mapping ([Start, End)).
+	Start, End uint64
+
+	// Offset is the offset in the file where the mapping starts.
+	Offset int64
+
+	// Path is the path of the mapped file.
+	Path string
+}
+
+// Size returns the size of the mapping.
+func (r Region) Size() int64 {
+	return int64(r.End - r.Start)
+}
+
+// MappedRegions returns file-backed memory mappings of the specified process.
+func MappedRegions(pid int) ([]Region, error) {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/maps", pid))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseMaps(f)
+}
+
+// FetchMappedRegions reads all file-backed memory mappings of the specified process
+// so that the mapped contents of files on lazily pulled layers are fetched and cached.
+// Files are read through /proc/<pid>/map_files so that mappings of files that are
+// no longer reachable by path are also covered.
+func FetchMappedRegions(ctx context.Context, pid int) error {
+	regions, err := MappedRegions(pid)
+	if err != nil {
+		return fmt.Errorf("failed to get mapped regions of %d: %w", pid, err)
+	}
+	var errs []error
+	for _, r := range regions {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fetchRegion(pid, r); err != nil {
+			log.G(ctx).WithError(err).Debugf("failed to fetch region %x-%x of %q", r.Start, r.End, r.Path)
+			errs = append(errs, fmt.Errorf("failed to fetch %q: %w", r.Path, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func fetchRegion(pid int, r Region) error {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/map_files/%x-%x", pid, r.Start, r.End))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	// Mappings can exceed the end of the file. Reading stops at EOF in that case.
+	_, err = io.Copy(io.Discard, io.NewSectionReader(f, r.Offset, r.Size()))
+	return err
+}
+
+// parseMaps parses the contents of /proc/<pid>/maps and returns file-backed mappings.
+func parseMaps(rd io.Reader) ([]Region, error) {
+	var regions []Region
+	sc := bufio.NewScanner(rd)
+	for sc.Scan() {
+		// address perms offset dev inode pathname
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 6 {
+			continue // anonymous mapping
+		}
+		if fields[4] == "0" || !strings.HasPrefix(fields[5], "/") {
+			continue // not backed by a file (e.g. [heap], [stack])
+		}
+		start, end, ok := strings.Cut(fields[0], "-")
+		if !ok {
+			return nil, fmt.Errorf("invalid address %q", fields[0])
+		}
+		var (
+			r   Region
+			err error
+		)
+		if r.Start, err = strconv.ParseUint(start, 16, 64); err != nil {
+			return nil, fmt.Errorf("invalid start address %q: %w", start, err)
+		}
+		if r.End, err = strconv.ParseUint(end, 16, 64); err != nil {
+			return nil, fmt.Errorf("invalid end address %q: %w", end, err)
+		}
+		if r.End < r.Start {
+			return nil, fmt.Errorf("invalid address range %q", fields[0])
+		}
+		if r.Offset, err = strconv.ParseInt(fields[2], 16, 64); err != nil {
+			return nil, fmt.Errorf("invalid offset %q: %w", fields[2], err)
+		}
+		// Path can contain spaces and can be followed by " (deleted)".
+		r.Path = strings.Join(fields[5:], " ")
+		regions = append(regions, r)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return regions, nil
+}
@@ -0,0 +1,146 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package criuutil
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	digest "github.com/opencontainers/go-digest"
+	"golang.org/x/sys/unix"
+)
+
+func TestParseMaps(t *testing.T) {
+	maps := `55d0c3a00000-55d0c3a02000 r--p 00000000 00:2a 1234                       /usr/bin/cat
+55d0c3a02000-55d0c3a07000 r-xp 00002000 00:2a 1234                       /usr/bin/cat
+55d0c4a00000-55d0c4a21000 rw-p 00000000 00:00 0                          [heap]
+7f1e2c000000-7f1e2c021000 rw-p 00000000 00:00 0 
+7f1e2d000000-7f1e2d001000 r--p 0001a000 00:2a 5678                       /tmp/a file (deleted)
+7ffd1b3fe000-7ffd1b41f000 rw-p 00000000 00:00 0                          [stack]
+`
+	regions, err := parseMaps(strings.NewReader(maps))
+	if err != nil {
+		t.Fatalf("failed to parse maps: %v", err)
+	}
+	want := []Region{
+		{Start: 0x55d0c3a00000, End: 0x55d0c3a02000, Offset: 0, Path: "/usr/bin/cat"},
+		{Start: 0x55d0c3a02000, End: 0x55d0c3a07000, Offset: 0x2000, Path: "/usr/bin/cat"},
+		{Start: 0x7f1e2d000000, End: 0x7f1e2d001000, Offset: 0x1a000, Path: "/tmp/a file (deleted)"},
+	}
+	if !reflect.DeepEqual(regions, want) {
+		t.Fatalf("unexpected regions: got %+v, want %+v", regions, want)
+	}
+
+	if _, err := parseMaps(strings.NewReader("zz-10 r--p 00000000 00:2a 1 /a\n")); err == nil {
+		t.Fatalf("invalid address must be rejected")
+	}
+}
+
+// newLayerDir makes a directory laid out like a mounted layer of the digest.
+func newLayerDir(t *testing.T, dgst digest.Digest) string {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, stateDirName), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, stateDirName, dgst.String()+".json"), []byte("{}"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "usr", "bin"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "usr", "bin", "cat"), []byte("cat"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestExternalMount(t *testing.T) {
+	dgst := digest.FromString("layer")
+	dir := newLayerDir(t, dgst)
+	key, err := MountKey(dir)
+	if err != nil {
+		t.Fatalf("failed to get key: %v", err)
+	}
+	if key != dgst {
+		t.Errorf("key = %q; want %q", key, dgst)
+	}
+	if _, err := MountKey(t.TempDir()); err == nil {
+		t.Errorf("directory other than layers must be rejected")
+	}
+
+	m := ExternalMount{Mountpoint: "/layers/0", Key: dgst}
+	if got, want := m.DumpOption(), "--external=mnt[/layers/0]:"+dgst.Encoded(); got != want {
+		t.Errorf("dump option = %q; want %q", got, want)
+	}
+	if got, want := m.RestoreOption(dir), "--external=mnt["+dgst.Encoded()+"]:"+dir; got != want {
+		t.Errorf("restore option = %q; want %q", got, want)
+	}
+	if _, err := ExternalMounts(os.Getpid()); err != nil {
+		t.Errorf("failed to get external mounts: %v", err)
+	}
+}
+
+func TestHandle(t *testing.T) {
+	dgst := digest.FromString("layer")
+	src := newLayerDir(t, dgst)
+	h, err := NewHandle(src, "/usr/bin/../bin/cat")
+	if err != nil {
+		t.Fatalf("failed to get handle: %v", err)
+	}
+	if h.Layer != dgst || h.Path != "usr/bin/cat" {
+		t.Errorf("unexpected handle: %+v", h)
+	}
+	f, err := h.Open(src)
+	if err != nil {
+		t.Fatalf("failed to open handle: %v", err)
+	}
+	f.Close()
+
+	// Another layer or another file of the same path must not be opened.
+	if _, err := h.Open(newLayerDir(t, digest.FromString("other"))); err == nil {
+		t.Errorf("handle must not be opened on another layer")
+	}
+	if _, err := h.Open(newLayerDir(t, dgst)); err == nil {
+		t.Errorf("handle must not be opened for another inode")
+	}
+	for _, p := range []string{"/", "..", stateDirName + "/a.json"} {
+		if _, err := NewHandle(src, p); err == nil {
+			t.Errorf("path %q must be rejected", p)
+		}
+	}
+}
+
+func TestBindMount(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("bind mount needs root")
+	}
+	src := newLayerDir(t, digest.FromString("layer"))
+	dst := t.TempDir()
+	if err := BindMount(src, dst); err != nil {
+		t.Skipf("failed to bind mount: %v", err)
+	}
+	defer unix.Unmount(dst, 0)
+	if _, err := os.Stat(filepath.Join(dst, "usr", "bin", "cat")); err != nil {
+		t.Errorf("layer isn't mounted: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dst, "new"), nil, 0600); err == nil {
+		t.Errorf("mount must be read-only")
+	}
+}
@@ -0,0 +1,102 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package criuutil
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+// Handle identifies a file on a layer independently of the node. Files on the same layer
+// have the same inode numbers on every node so the file can be opened again on the node
+// where the container is restored.
+type Handle struct {
+	// Layer is the digest of the layer.
+	Layer digest.Digest `json:"layer"`
+
+	// Path is the path of the file relative to the mountpoint of the layer.
+	Path string `json:"path"`
+
+	// Ino is the inode number of the file.
+	Ino uint64 `json:"ino"`
+}
+
+// NewHandle returns the handle of the file at the path relative to the mountpoint of the
+// layer.
+func NewHandle(mountpoint, path string) (Handle, error) {
+	path, err := cleanPath(path)
+	if err != nil {
+		return Handle{}, err
+	}
+	key, err := MountKey(mountpoint)
+	if err != nil {
+		return Handle{}, err
+	}
+	fi, err := os.Lstat(filepath.Join(mountpoint, path))
+	if err != nil {
+		return Handle{}, err
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return Handle{}, fmt.Errorf("failed to get inode number of %q", path)
+	}
+	return Handle{Layer: key, Path: path, Ino: st.Ino}, nil
+}
+
+// Open opens the file of the handle on the layer mounted on the mountpoint. This fails if
+// another layer is mounted or the path points to another file.
+func (h Handle) Open(mountpoint string) (*os.File, error) {
+	path, err := cleanPath(h.Path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := MountKey(mountpoint)
+	if err != nil {
+		return nil, err
+	}
+	if key != h.Layer {
+		return nil, fmt.Errorf("layer %q is mounted on %q; want %q", key, mountpoint, h.Layer)
+	}
+	f, err := os.Open(filepath.Join(mountpoint, path))
+	if err != nil {
+		return nil, err
+	}
+	var st syscall.Stat_t
+	if err := syscall.Fstat(int(f.Fd()), &st); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if st.Ino != h.Ino {
+		f.Close()
+		return nil, fmt.Errorf("inode number of %q is %d; want %d", path, st.Ino, h.Ino)
+	}
+	return f, nil
+}
+
+// cleanPath returns the path relative to the mountpoint, which must not be outside of it.
+func cleanPath(path string) (string, error) {
+	p := filepath.Clean(string(filepath.Separator) + path)[1:]
+	if p == "" || p == stateDirName || strings.HasPrefix(p, stateDirName+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid path %q", path)
+	}
+	return p, nil
+}
@@ -0,0 +1,117 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package criuutil
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/moby/sys/mountinfo"
+	digest "github.com/opencontainers/go-digest"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// stateDirName is the state directory at the root of each layer, which contains
+	// "<digest>.json" of the layer.
+	stateDirName = ".stargz-snapshotter"
+
+	// fsName is the source of the mounts of the layers.
+	fsName = "stargz"
+)
+
+// MountKey returns the key of the layer mounted on the mountpoint. The key is the digest
+// of the layer so the same layer has the same key on every node.
+func MountKey(mountpoint string) (digest.Digest, error) {
+	ents, err := os.ReadDir(filepath.Join(mountpoint, stateDirName))
+	if err != nil {
+		return "", fmt.Errorf("failed to read state directory of %q: %w", mountpoint, err)
+	}
+	for _, e := range ents {
+		name, ok := strings.CutSuffix(e.Name(), ".json")
+		if !ok {
+			continue
+		}
+		if dgst, err := digest.Parse(name); err == nil {
+			return dgst, nil
+		}
+	}
+	return "", fmt.Errorf("%q isn't a layer", mountpoint)
+}
+
+// ExternalMount is a layer mounted in the mount namespace of a process.
+type ExternalMount struct {
+	// Mountpoint is the mountpoint of the layer seen from the process.
+	Mountpoint string
+
+	// Key is the key of the layer (see MountKey).
+	Key digest.Digest
+}
+
+// DumpOption returns the option of "criu dump" to record the mount as an external mount.
+func (m ExternalMount) DumpOption() string {
+	return fmt.Sprintf("--external=mnt[%s]:%s", m.Mountpoint, m.Key.Encoded())
+}
+
+// RestoreOption returns the option of "criu restore" to restore the mount from the layer
+// mounted on the mountpoint of this node (e.g. with BindMount).
+func (m ExternalMount) RestoreOption(mountpoint string) string {
+	return fmt.Sprintf("--external=mnt[%s]:%s", m.Key.Encoded(), mountpoint)
+}
+
+// ExternalMounts returns the layers mounted in the mount namespace of the process. These
+// need to be passed to CRIU as external mounts because the mount IDs differ on the
+// destination node.
+func ExternalMounts(pid int) ([]ExternalMount, error) {
+	infos, err := mountinfo.PidMountInfo(pid)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get mounts of %d: %w", pid, err)
+	}
+	root := fmt.Sprintf("/proc/%d/root", pid)
+	var mounts []ExternalMount
+	for _, info := range infos {
+		if info.Source != fsName || !strings.HasPrefix(info.FSType, "fuse") {
+			continue
+		}
+		key, err := MountKey(filepath.Join(root, info.Mountpoint))
+		if err != nil {
+			return nil, err
+		}
+		mounts = append(mounts, ExternalMount{Mountpoint: info.Mountpoint, Key: key})
+	}
+	return mounts, nil
+}
+
+// BindMount bind-mounts the layer mounted on src to dst read-only with the private
+// propagation so mounting and unmounting the layer on the node isn't propagated to the
+// restored container and vice versa.
+func BindMount(src, dst string) error {
+	if err := unix.Mount(src, dst, "", unix.MS_BIND, ""); err != nil {
+		return fmt.Errorf("failed to bind mount %q on %q: %w", src, dst, err)
+	}
+	if err := unix.Mount("", dst, "", unix.MS_PRIVATE, ""); err != nil {
+		unix.Unmount(dst, 0)
+		return fmt.Errorf("failed to make %q private: %w", dst, err)
+	}
+	if err := unix.Mount("", dst, "", unix.MS_BIND|unix.MS_REMOUNT|unix.MS_RDONLY, ""); err != nil {
+		unix.Unmount(dst, 0)
+		return fmt.Errorf("failed to make %q read-only: %w", dst, err)
+	}
+	return nil
+}
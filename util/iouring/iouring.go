@@ -0,0 +1,405 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package iouring reads files with io_uring(7). Reads issued concurrently are submitted
+// to the kernel in batches so that serving many reads doesn't need a syscall per read.
+package iouring
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	opNop  = 0
+	opRead = 22
+
+	enterGetEvents = 1 << 0
+
+	featSingleMmap = 1 << 0
+
+	offSQRing = 0
+	offCQRing = 0x8000000
+	offSQEs   = 0x10000000
+
+	sqeSize = 64
+	cqeSize = 16
+
+	// stopUserData is the user data of the NOP request stopping the reaper.
+	stopUserData = 0
+)
+
+// ErrClosed is returned on reading with the closed ring.
+var ErrClosed = errors.New("io_uring is closed")
+
+// params is struct io_uring_params.
+type params struct {
+	sqEntries    uint32
+	cqEntries    uint32
+	flags        uint32
+	sqThreadCPU  uint32
+	sqThreadIdle uint32
+	features     uint32
+	wqFd         uint32
+	resv         [3]uint32
+	sqOff        sqringOffsets
+	cqOff        cqringOffsets
+}
+
+// sqringOffsets is struct io_sqring_offsets.
+type sqringOffsets struct {
+	head, tail, ringMask, ringEntries, flags, dropped, array, resv1 uint32
+	userAddr                                                       uint64
+}
+
+// cqringOffsets is struct io_cqring_offsets.
+type cqringOffsets struct {
+	head, tail, ringMask, ringEntries, overflow, cqes, flags, resv1 uint32
+	userAddr                                                        uint64
+}
+
+// sqe is struct io_uring_sqe.
+type sqe struct {
+	opcode      uint8
+	flags       uint8
+	ioprio      uint16
+	fd          int32
+	off         uint64
+	addr        uint64
+	len         uint32
+	rwFlags     uint32
+	userData    uint64
+	bufIndex    uint16
+	personality uint16
+	spliceFdIn  int32
+	addr3       uint64
+	pad         uint64
+}
+
+// cqe is struct io_uring_cqe.
+type cqe struct {
+	userData uint64
+	res      int32
+	flags    uint32
+}
+
+type request struct {
+	op   uint8
+	fd   int
+	p    []byte
+	off  int64
+	done chan int32 // result of the read
+}
+
+// Ring is an io_uring instance. Ring is safe for concurrent use.
+type Ring struct {
+	fd      int
+	entries uint32
+
+	sqRing, cqRing, sqesMem []byte
+	sqHead, sqTail, sqMask  *uint32
+	sqArray                 unsafe.Pointer
+	cqHead, cqTail, cqMask  *uint32
+	cqes                    unsafe.Pointer
+
+	reqs  chan *request
+	slots chan struct{} // limits the in-flight requests not to overflow the CQ
+
+	mu      sync.Mutex
+	closing bool           // reads aren't accepted anymore
+	readers sync.WaitGroup // reads accepted before closing
+
+	inflightMu sync.Mutex
+	inflight   map[uint64]*request
+	nextID     uint64
+	failErr    unix.Errno // requests are failed with this error once set
+
+	closeOnce sync.Once
+	closeErr  error
+	submitted chan struct{} // closed when the submitter stops
+	stopped   chan struct{} // closed when the reaper stops
+	broken    atomic.Bool   // the submitter failed to submit requests
+}
+
+// New creates a ring submitting up to entries reads at once. An error wrapping ENOSYS or
+// EPERM is returned if io_uring isn't available (e.g. disabled by seccomp).
+func New(entries uint32) (*Ring, error) {
+	var p params
+	fd, _, errno := unix.Syscall(unix.SYS_IO_URING_SETUP, uintptr(entries), uintptr(unsafe.Pointer(&p)), 0)
+	if errno != 0 {
+		return nil, fmt.Errorf("failed to setup io_uring: %w", errno)
+	}
+	r := &Ring{
+		fd:        int(fd),
+		entries:   p.sqEntries,
+		reqs:      make(chan *request, p.sqEntries),
+		slots:     make(chan struct{}, p.sqEntries),
+		inflight:  make(map[uint64]*request),
+		nextID:    stopUserData + 1,
+		submitted: make(chan struct{}),
+		stopped:   make(chan struct{}),
+	}
+	if err := r.mmap(&p); err != nil {
+		r.unmap()
+		unix.Close(r.fd)
+		return nil, err
+	}
+	go r.submit()
+	go r.reap()
+	return r, nil
+}
+
+func (r *Ring) mmap(p *params) (err error) {
+	sqSize := int(p.sqOff.array + p.sqEntries*4)
+	cqSize := int(p.cqOff.cqes + p.cqEntries*cqeSize)
+	if p.features&featSingleMmap != 0 {
+		sqSize = max(sqSize, cqSize)
+	}
+	r.sqRing, err = unix.Mmap(r.fd, offSQRing, sqSize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE)
+	if err != nil {
+		return fmt.Errorf("failed to map SQ ring: %w", err)
+	}
+	if p.features&featSingleMmap != 0 {
+		r.cqRing = r.sqRing
+	} else {
+		r.cqRing, err = unix.Mmap(r.fd, offCQRing, cqSize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE)
+		if err != nil {
+			return fmt.Errorf("failed to map CQ ring: %w", err)
+		}
+	}
+	r.sqesMem, err = unix.Mmap(r.fd, offSQEs, int(p.sqEntries*sqeSize), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE)
+	if err != nil {
+		return fmt.Errorf("failed to map SQEs: %w", err)
+	}
+	sq, cq := unsafe.Pointer(&r.sqRing[0]), unsafe.Pointer(&r.cqRing[0])
+	r.sqHead = (*uint32)(unsafe.Add(sq, p.sqOff.head))
+	r.sqTail = (*uint32)(unsafe.Add(sq, p.sqOff.tail))
+	r.sqMask = (*uint32)(unsafe.Add(sq, p.sqOff.ringMask))
+	r.sqArray = unsafe.Add(sq, p.sqOff.array)
+	r.cqHead = (*uint32)(unsafe.Add(cq, p.cqOff.head))
+	r.cqTail = (*uint32)(unsafe.Add(cq, p.cqOff.tail))
+	r.cqMask = (*uint32)(unsafe.Add(cq, p.cqOff.ringMask))
+	r.cqes = unsafe.Add(cq, p.cqOff.cqes)
+	return nil
+}
+
+func (r *Ring) unmap() {
+	if r.sqesMem != nil {
+		unix.Munmap(r.sqesMem)
+	}
+	if r.cqRing != nil && &r.cqRing[0] != &r.sqRing[0] {
+		unix.Munmap(r.cqRing)
+	}
+	if r.sqRing != nil {
+		unix.Munmap(r.sqRing)
+	}
+}
+
+// ReadAt reads len(p) bytes from the file at off in the same manner as io.ReaderAt.
+func (r *Ring) ReadAt(fd int, p []byte, off int64) (int, error) {
+	var n int
+	for n < len(p) {
+		res, err := r.read(fd, p[n:], off+int64(n))
+		if err != nil {
+			return n, err
+		}
+		if res == 0 {
+			return n, io.EOF
+		}
+		n += res
+	}
+	return n, nil
+}
+
+func (r *Ring) read(fd int, p []byte, off int64) (int, error) {
+	r.mu.Lock()
+	if r.closing {
+		r.mu.Unlock()
+		return 0, ErrClosed
+	}
+	r.readers.Add(1)
+	r.mu.Unlock()
+	defer r.readers.Done()
+
+	// The submitter keeps receiving requests until Close waits for the accepted reads, and
+	// the slot is released on completion or failure of the request.
+	r.slots <- struct{}{}
+	req := &request{op: opRead, fd: fd, p: p, off: off, done: make(chan int32, 1)}
+	r.reqs <- req
+	res := <-req.done
+	runtime.KeepAlive(p) // the kernel writes to p until the completion
+	if res < 0 {
+		return 0, unix.Errno(-res)
+	}
+	return int(res), nil
+}
+
+// submit puts the requests to the SQ and submits them in batches. This keeps receiving
+// requests after a failure to fail them until the NOP request of Close.
+func (r *Ring) submit() {
+	defer close(r.submitted)
+	for {
+		req := <-r.reqs
+		n, stop := uint32(0), false
+		for {
+			if r.put(req) {
+				n++
+			}
+			stop = stop || req.op == opNop
+			if stop || n == r.entries {
+				break
+			}
+			var ok bool
+			select {
+			case req, ok = <-r.reqs:
+			default:
+			}
+			if !ok {
+				break
+			}
+		}
+		for n > 0 {
+			submitted, _, errno := unix.Syscall6(unix.SYS_IO_URING_ENTER, uintptr(r.fd), uintptr(n), 0, 0, 0, 0)
+			if errno == unix.EINTR || errno == unix.EAGAIN || errno == unix.EBUSY {
+				continue
+			} else if errno != 0 {
+				// The SQEs stay in the SQ. Fail the requests rather than leaving them hanging.
+				r.broken.Store(true)
+				r.failAll(errno)
+				break
+			}
+			n -= uint32(submitted)
+		}
+		if stop {
+			return
+		}
+	}
+}
+
+// put writes the request to the SQ. There is always a free SQE because the in-flight
+// requests are limited to the size of the SQ and all SQEs are consumed on submission.
+// If the ring has failed, the request is failed instead and this returns false.
+func (r *Ring) put(req *request) bool {
+	r.inflightMu.Lock()
+	if r.failErr != 0 {
+		if req.op != opNop {
+			req.done <- -int32(r.failErr)
+			<-r.slots
+		}
+		r.inflightMu.Unlock()
+		return false
+	}
+	var userData uint64
+	if req.op == opNop {
+		userData = stopUserData
+	} else {
+		userData = r.nextID
+		r.nextID++
+		r.inflight[userData] = req
+	}
+	r.inflightMu.Unlock()
+	tail := atomic.LoadUint32(r.sqTail)
+	idx := tail & *r.sqMask
+	e := (*sqe)(unsafe.Pointer(&r.sqesMem[idx*sqeSize]))
+	*e = sqe{opcode: req.op, fd: int32(req.fd), userData: userData}
+	if len(req.p) > 0 {
+		e.addr = uint64(uintptr(unsafe.Pointer(&req.p[0])))
+		e.len = uint32(len(req.p))
+		e.off = uint64(req.off)
+	}
+	*(*uint32)(unsafe.Add(r.sqArray, idx*4)) = idx
+	atomic.StoreUint32(r.sqTail, tail+1)
+	return true
+}
+
+// reap waits for the completions and passes the results to the requests.
+func (r *Ring) reap() {
+	defer close(r.stopped)
+	for {
+		_, _, errno := unix.Syscall6(unix.SYS_IO_URING_ENTER, uintptr(r.fd), 0, 1, enterGetEvents, 0, 0)
+		if errno != 0 && errno != unix.EINTR && errno != unix.EAGAIN && errno != unix.EBUSY {
+			r.failAll(errno)
+			return
+		}
+		head, tail := atomic.LoadUint32(r.cqHead), atomic.LoadUint32(r.cqTail)
+		stop := false
+		for ; head != tail; head++ {
+			c := (*cqe)(unsafe.Add(r.cqes, uintptr(head&*r.cqMask)*cqeSize))
+			if c.userData == stopUserData {
+				stop = true
+				continue
+			}
+			r.inflightMu.Lock()
+			req, ok := r.inflight[c.userData]
+			delete(r.inflight, c.userData)
+			r.inflightMu.Unlock()
+			if ok {
+				req.done <- c.res
+				<-r.slots
+			}
+		}
+		atomic.StoreUint32(r.cqHead, head)
+		if stop {
+			return
+		}
+	}
+}
+
+// failAll fails all in-flight requests. The following requests are failed by put.
+func (r *Ring) failAll(errno unix.Errno) {
+	r.inflightMu.Lock()
+	defer r.inflightMu.Unlock()
+	if r.failErr == 0 {
+		r.failErr = errno
+	}
+	for id, req := range r.inflight {
+		req.done <- -int32(errno)
+		delete(r.inflight, id)
+		<-r.slots
+	}
+}
+
+// Close waits for the reads in flight and closes the ring. Reads after Close fail with
+// ErrClosed.
+func (r *Ring) Close() error {
+	r.closeOnce.Do(func() {
+		r.mu.Lock()
+		r.closing = true
+		r.mu.Unlock()
+		r.readers.Wait()
+
+		// Stop the submitter and then the reaper with a NOP request.
+		r.reqs <- &request{op: opNop}
+		<-r.submitted
+		if r.broken.Load() {
+			// The reaper can't be stopped without the submitter. Leave the rings mapped
+			// because the reaper may still refer to them.
+			r.closeErr = unix.Close(r.fd)
+			return
+		}
+		<-r.stopped
+		r.unmap()
+		r.closeErr = unix.Close(r.fd)
+	})
+	return r.closeErr
+}
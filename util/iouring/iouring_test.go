@@ -0,0 +1,138 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package iouring
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func newTestRing(t *testing.T) *Ring {
+	r, err := New(8)
+	if errors.Is(err, unix.ENOSYS) || errors.Is(err, unix.EPERM) {
+		t.Skipf("io_uring is unavailable: %v", err)
+	} else if err != nil {
+		t.Fatalf("failed to create ring: %v", err)
+	}
+	return r
+}
+
+func TestReadAt(t *testing.T) {
+	r := newTestRing(t)
+	defer r.Close()
+
+	data := make([]byte, 1<<20)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "data")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// More concurrent reads than the entries of the ring.
+	const chunkSize = 4096
+	var wg sync.WaitGroup
+	for i := 0; i < 64; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for off := int64(i * chunkSize); off < int64(len(data)); off += 64 * chunkSize {
+				p := make([]byte, chunkSize)
+				if n, err := r.ReadAt(int(f.Fd()), p, off); err != nil || n != chunkSize {
+					t.Errorf("failed to read at %d: n=%d: %v", off, n, err)
+					return
+				}
+				if !bytes.Equal(p, data[off:off+chunkSize]) {
+					t.Errorf("unexpected data at %d", off)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Reading across the end of the file.
+	p := make([]byte, 100)
+	if n, err := r.ReadAt(int(f.Fd()), p, int64(len(data)-10)); err != io.EOF || n != 10 {
+		t.Errorf("unexpected result at the end: n=%d: %v", n, err)
+	}
+	if _, err := r.ReadAt(-1, p, 0); !errors.Is(err, unix.EBADF) {
+		t.Errorf("unexpected error with invalid fd: %v", err)
+	}
+}
+
+func TestClose(t *testing.T) {
+	r := newTestRing(t)
+	if err := r.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatalf("failed to close twice: %v", err)
+	}
+	if _, err := r.ReadAt(0, make([]byte, 1), 0); !errors.Is(err, ErrClosed) {
+		t.Errorf("unexpected error after close: %v", err)
+	}
+}
+
+func TestCloseWhileReading(t *testing.T) {
+	r := newTestRing(t)
+	path := filepath.Join(t.TempDir(), "data")
+	if err := os.WriteFile(path, make([]byte, 4096), 0600); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// Reads racing with Close either succeed or fail with ErrClosed but never hang.
+	var wg sync.WaitGroup
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p := make([]byte, 512)
+			for {
+				if _, err := r.ReadAt(int(f.Fd()), p, 0); errors.Is(err, ErrClosed) {
+					return
+				} else if err != nil {
+					t.Errorf("unexpected error: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	if err := r.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+	wg.Wait()
+}
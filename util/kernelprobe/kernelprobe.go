@@ -0,0 +1,237 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package kernelprobe detects the kernel features used by the optional fast paths of the
+// snapshotter so they can be enabled only on the nodes supporting them.
+package kernelprobe
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// DisableEnv is the environment variable listing the features (separated by commas) that
+// are treated as unavailable regardless of the kernel. This allows running the fallback
+// paths on kernels supporting all features (e.g. a test matrix in CI).
+const DisableEnv = "STARGZ_KERNELPROBE_DISABLE"
+
+// Feature is an optional kernel feature.
+type Feature string
+
+const (
+	// FUSEPassthrough is the passthrough of reads of FUSE files to backing files (Linux 6.9+).
+	FUSEPassthrough Feature = "fuse_passthrough"
+
+	// IDMappedMounts is idmapped mounts created by mount_setattr(2) (Linux 5.12+).
+	IDMappedMounts Feature = "idmapped_mounts"
+
+	// EROFS is the erofs filesystem.
+	EROFS Feature = "erofs"
+
+	// OverlayDataOnlyLowers is the data-only lower layers of overlayfs (Linux 6.5+).
+	OverlayDataOnlyLowers Feature = "overlay_data_only_lowers"
+)
+
+// Features are all features probed by Probe.
+var Features = []Feature{FUSEPassthrough, IDMappedMounts, EROFS, OverlayDataOnlyLowers}
+
+// Result is the result of probing a feature.
+type Result struct {
+	// Available is true if the feature can be used.
+	Available bool `json:"available"`
+
+	// Reason describes why the feature is unavailable.
+	Reason string `json:"reason,omitempty"`
+}
+
+// Results are the results of probing the kernel.
+type Results struct {
+	// KernelVersion is the release of the running kernel (e.g. "6.9.0-1-generic").
+	KernelVersion string `json:"kernel_version"`
+
+	// Features are the results keyed by the features.
+	Features map[Feature]Result `json:"features"`
+}
+
+// Available returns true if the feature is available. This returns false on nil Results.
+func (r *Results) Available(f Feature) bool {
+	if r == nil {
+		return false
+	}
+	return r.Features[f].Available
+}
+
+// Require skips the test unless all the features are available.
+func (r *Results) Require(t interface{ Skipf(string, ...any) }, features ...Feature) {
+	for _, f := range features {
+		if !r.Available(f) {
+			var reason string
+			if r != nil {
+				reason = r.Features[f].Reason
+			}
+			t.Skipf("kernel feature %q is unavailable: %s", f, reason)
+		}
+	}
+}
+
+// Probe detects the features of the running kernel.
+func Probe() *Results {
+	var uts unix.Utsname
+	var release string
+	if err := unix.Uname(&uts); err == nil {
+		release = unix.ByteSliceToString(uts.Release[:])
+	}
+	filesystems, fsErr := readFilesystems("/proc/filesystems")
+	p := prober{
+		release:      release,
+		filesystems:  filesystems,
+		fsErr:        fsErr,
+		moduleDir:    "/sys/module",
+		mountSetattr: probeMountSetattr,
+	}
+	return p.probe(os.Getenv(DisableEnv))
+}
+
+type prober struct {
+	release     string
+	filesystems map[string]bool
+	fsErr       error
+	moduleDir   string // directory of the loaded modules
+
+	// mountSetattr calls mount_setattr(2) for probing the syscall.
+	mountSetattr func() error
+}
+
+func (p *prober) probe(disable string) *Results {
+	r := &Results{KernelVersion: p.release, Features: make(map[Feature]Result)}
+	for _, f := range Features {
+		r.Features[f] = p.probeFeature(f)
+	}
+	for _, f := range strings.Split(disable, ",") {
+		f := Feature(strings.TrimSpace(f))
+		if _, ok := r.Features[f]; ok {
+			r.Features[f] = Result{Reason: fmt.Sprintf("disabled by %s", DisableEnv)}
+		}
+	}
+	return r
+}
+
+func (p *prober) probeFeature(f Feature) Result {
+	switch f {
+	case FUSEPassthrough:
+		if err := p.requireVersion(6, 9); err != nil {
+			return Result{Reason: err.Error()}
+		}
+		if !p.hasFilesystem("fuse") {
+			return Result{Reason: "fuse isn't supported"}
+		}
+	case IDMappedMounts:
+		if err := p.mountSetattr(); errors.Is(err, unix.ENOSYS) {
+			return Result{Reason: "mount_setattr isn't supported"}
+		}
+	case EROFS:
+		if !p.hasFilesystem("erofs") {
+			return Result{Reason: "erofs isn't supported"}
+		}
+	case OverlayDataOnlyLowers:
+		if err := p.requireVersion(6, 5); err != nil {
+			return Result{Reason: err.Error()}
+		}
+		if !p.hasFilesystem("overlay") {
+			return Result{Reason: "overlay isn't supported"}
+		}
+	default:
+		return Result{Reason: "unknown feature"}
+	}
+	return Result{Available: true}
+}
+
+func (p *prober) requireVersion(major, minor int) error {
+	gotMajor, gotMinor, err := parseVersion(p.release)
+	if err != nil {
+		return err
+	}
+	if gotMajor < major || (gotMajor == major && gotMinor < minor) {
+		return fmt.Errorf("kernel %s is older than %d.%d", p.release, major, minor)
+	}
+	return nil
+}
+
+// hasFilesystem returns true if the filesystem is registered to the kernel or its module
+// is loaded. All filesystems are assumed to be available if /proc/filesystems can't be read.
+func (p *prober) hasFilesystem(name string) bool {
+	if p.fsErr != nil {
+		return true
+	}
+	if p.filesystems[name] {
+		return true
+	}
+	_, err := os.Stat(filepath.Join(p.moduleDir, name))
+	return err == nil
+}
+
+// probeMountSetattr calls mount_setattr(2) with invalid arguments. The kernel supporting
+// the syscall returns an error other than ENOSYS.
+func probeMountSetattr() error {
+	return unix.MountSetattr(-1, "", 0, &unix.MountAttr{})
+}
+
+// parseVersion parses the major and minor numbers of the kernel release (e.g. "6.9.0-rc1").
+func parseVersion(release string) (major, minor int, _ error) {
+	majorStr, rest, ok := strings.Cut(release, ".")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid kernel release %q", release)
+	}
+	minorStr := rest
+	if i := strings.IndexFunc(rest, func(r rune) bool { return r < '0' || r > '9' }); i >= 0 {
+		minorStr = rest[:i]
+	}
+	major, err := strconv.Atoi(majorStr)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid kernel release %q: %w", release, err)
+	}
+	minor, err = strconv.Atoi(minorStr)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid kernel release %q: %w", release, err)
+	}
+	return major, minor, nil
+}
+
+// readFilesystems reads the filesystems registered to the kernel from /proc/filesystems.
+func readFilesystems(path string) (map[string]bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	filesystems := make(map[string]bool)
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		// e.g. "nodev	overlay" or "	ext4"
+		fields := strings.Fields(s.Text())
+		if len(fields) > 0 {
+			filesystems[fields[len(fields)-1]] = true
+		}
+	}
+	return filesystems, s.Err()
+}
@@ -0,0 +1,176 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package kernelprobe
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestParseVersion(t *testing.T) {
+	tests := []struct {
+		release      string
+		major, minor int
+		wantErr      bool
+	}{
+		{release: "6.9.0-1-generic", major: 6, minor: 9},
+		{release: "5.15.153.1-microsoft-standard-WSL2", major: 5, minor: 15},
+		{release: "6.10-rc1", major: 6, minor: 10},
+		{release: "6.5+", major: 6, minor: 5},
+		{release: "", wantErr: true},
+		{release: "x.y", wantErr: true},
+	}
+	for _, tt := range tests {
+		major, minor, err := parseVersion(tt.release)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%q: want error", tt.release)
+			}
+			continue
+		}
+		if err != nil || major != tt.major || minor != tt.minor {
+			t.Errorf("%q: got %d.%d (%v); want %d.%d", tt.release, major, minor, err, tt.major, tt.minor)
+		}
+	}
+}
+
+func TestProbe(t *testing.T) {
+	moduleDir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(moduleDir, "erofs"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name         string
+		release      string
+		filesystems  []string
+		noSetattr    bool
+		disable      string
+		wantFeatures map[Feature]bool
+	}{
+		{
+			name:        "new kernel",
+			release:     "6.10.0",
+			filesystems: []string{"fuse", "overlay"},
+			wantFeatures: map[Feature]bool{
+				FUSEPassthrough:       true,
+				IDMappedMounts:        true,
+				EROFS:                 true, // loaded as a module
+				OverlayDataOnlyLowers: true,
+			},
+		},
+		{
+			name:        "old kernel",
+			release:     "5.10.0",
+			filesystems: []string{"fuse", "overlay"},
+			noSetattr:   true,
+			wantFeatures: map[Feature]bool{
+				FUSEPassthrough:       false,
+				IDMappedMounts:        false,
+				EROFS:                 true,
+				OverlayDataOnlyLowers: false,
+			},
+		},
+		{
+			name:        "6.5 without fuse",
+			release:     "6.5.0",
+			filesystems: []string{"overlay"},
+			wantFeatures: map[Feature]bool{
+				FUSEPassthrough:       false,
+				IDMappedMounts:        true,
+				EROFS:                 true,
+				OverlayDataOnlyLowers: true,
+			},
+		},
+		{
+			name:        "disabled",
+			release:     "6.10.0",
+			filesystems: []string{"fuse", "overlay"},
+			disable:     "fuse_passthrough, erofs,unknown",
+			wantFeatures: map[Feature]bool{
+				FUSEPassthrough:       false,
+				IDMappedMounts:        true,
+				EROFS:                 false,
+				OverlayDataOnlyLowers: true,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := prober{
+				release:     tt.release,
+				filesystems: make(map[string]bool),
+				moduleDir:   moduleDir,
+				mountSetattr: func() error {
+					if tt.noSetattr {
+						return unix.ENOSYS
+					}
+					return unix.EBADF
+				},
+			}
+			for _, fs := range tt.filesystems {
+				p.filesystems[fs] = true
+			}
+			r := p.probe(tt.disable)
+			if r.KernelVersion != tt.release {
+				t.Errorf("unexpected kernel version %q; want %q", r.KernelVersion, tt.release)
+			}
+			for f, want := range tt.wantFeatures {
+				if got := r.Available(f); got != want {
+					t.Errorf("unexpected availability of %q: %v (%q); want %v", f, got, r.Features[f].Reason, want)
+				}
+				if !r.Available(f) && r.Features[f].Reason == "" {
+					t.Errorf("reason of unavailable %q must be reported", f)
+				}
+			}
+		})
+	}
+}
+
+func TestReadFilesystems(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "filesystems")
+	if err := os.WriteFile(p, []byte("nodev\tsysfs\nnodev\toverlay\n\text4\nnodev\tfuse\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	filesystems, err := readFilesystems(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fs := range []string{"sysfs", "overlay", "ext4", "fuse"} {
+		if !filesystems[fs] {
+			t.Errorf("%q not found in %v", fs, filesystems)
+		}
+	}
+	if filesystems["nodev"] {
+		t.Errorf("\"nodev\" must not be a filesystem")
+	}
+}
+
+func TestProbeRunningKernel(t *testing.T) {
+	r := Probe()
+	if r.KernelVersion == "" {
+		t.Errorf("kernel version must be detected")
+	}
+	for _, f := range Features {
+		if _, ok := r.Features[f]; !ok {
+			t.Errorf("result of %q not found", f)
+		}
+	}
+	t.Logf("probed: %+v", r)
+}
@@ -0,0 +1,108 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package testutil
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+)
+
+// ELF returns a minimal x86-64 ELF file with the program interpreter, the needed shared
+// libraries (DT_NEEDED) and the runpath (DT_RUNPATH). The file contains only the headers
+// and can't be run. Empty interp and runpath are omitted.
+func ELF(interp string, needed []string, runpath string) []byte {
+	const (
+		ehdrSize = 64
+		phdrSize = 56
+		shdrSize = 64
+		dynSize  = 16
+	)
+	var progs []elf.Prog64
+	nprogs := 1 // PT_DYNAMIC
+	if interp != "" {
+		nprogs++
+	}
+	off := uint64(ehdrSize + phdrSize*nprogs)
+
+	interpOff := off
+	if interp != "" {
+		off += uint64(len(interp) + 1)
+	}
+
+	var dynstr bytes.Buffer
+	dynstr.WriteByte(0)
+	var dyns []elf.Dyn64
+	for _, n := range needed {
+		dyns = append(dyns, elf.Dyn64{Tag: int64(elf.DT_NEEDED), Val: uint64(dynstr.Len())})
+		dynstr.WriteString(n + "\x00")
+	}
+	if runpath != "" {
+		dyns = append(dyns, elf.Dyn64{Tag: int64(elf.DT_RUNPATH), Val: uint64(dynstr.Len())})
+		dynstr.WriteString(runpath + "\x00")
+	}
+	dyns = append(dyns, elf.Dyn64{Tag: int64(elf.DT_NULL)})
+	dynstrOff := off
+	off += uint64(dynstr.Len())
+	dynOff := off
+	off += uint64(len(dyns) * dynSize)
+	shOff := off
+
+	if interp != "" {
+		progs = append(progs, elf.Prog64{Type: uint32(elf.PT_INTERP), Flags: uint32(elf.PF_R),
+			Off: interpOff, Filesz: uint64(len(interp) + 1), Memsz: uint64(len(interp) + 1), Align: 1})
+	}
+	progs = append(progs, elf.Prog64{Type: uint32(elf.PT_DYNAMIC), Flags: uint32(elf.PF_R | elf.PF_W),
+		Off: dynOff, Filesz: uint64(len(dyns) * dynSize), Memsz: uint64(len(dyns) * dynSize), Align: 8})
+
+	hdr := elf.Header64{
+		Type:      uint16(elf.ET_DYN),
+		Machine:   uint16(elf.EM_X86_64),
+		Version:   uint32(elf.EV_CURRENT),
+		Phoff:     ehdrSize,
+		Shoff:     shOff,
+		Ehsize:    ehdrSize,
+		Phentsize: phdrSize,
+		Phnum:     uint16(len(progs)),
+		Shentsize: shdrSize,
+		Shnum:     3,
+	}
+	copy(hdr.Ident[:], elf.ELFMAG)
+	hdr.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS64)
+	hdr.Ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	hdr.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+
+	sections := []elf.Section64{
+		{}, // SHN_UNDEF
+		{Type: uint32(elf.SHT_STRTAB), Flags: uint64(elf.SHF_ALLOC), Off: dynstrOff, Size: uint64(dynstr.Len()), Addralign: 1},
+		{Type: uint32(elf.SHT_DYNAMIC), Flags: uint64(elf.SHF_ALLOC | elf.SHF_WRITE), Off: dynOff,
+			Size: uint64(len(dyns) * dynSize), Link: 1, Addralign: 8, Entsize: dynSize},
+	}
+
+	var b bytes.Buffer
+	for _, v := range []any{hdr, progs} {
+		binary.Write(&b, binary.LittleEndian, v)
+	}
+	if interp != "" {
+		b.WriteString(interp + "\x00")
+	}
+	b.Write(dynstr.Bytes())
+	for _, v := range []any{dyns, sections} {
+		binary.Write(&b, binary.LittleEndian, v)
+	}
+	return b.Bytes()
+}